@@ -24,6 +24,8 @@ var runtimeDir = flag.String("runtime-dir", os.Getenv("KEYBASE_RUNTIME_DIR"), "r
 var label = flag.String("label", os.Getenv("KEYBASE_LABEL"), "label to help identify if running as a service")
 var mountType = flag.String("mount-type", defaultMountType, "mount type: default, force, none")
 var version = flag.Bool("version", false, "Print version")
+var attrCacheTTL = flag.Duration("attr-cache-ttl", 0, "how long the kernel may cache file attributes (0 for the default, negative to disable)")
+var entryCacheTTL = flag.Duration("entry-cache-ttl", 0, "how long the kernel may cache directory entries (0 for the default, negative to disable)")
 
 const usageFormatStr = `Usage:
   kbfsfuse -version
@@ -31,12 +33,14 @@ const usageFormatStr = `Usage:
 To run against remote KBFS servers:
   kbfsfuse
     [-runtime-dir=path/to/dir] [-label=label] [-mount-type=default|force|required|none]
+    [-attr-cache-ttl=duration] [-entry-cache-ttl=duration]
 %s
     %s[/path/to/mountpoint]
 
 To run in a local testing environment:
   kbfsfuse
     [-runtime-dir=path/to/dir] [-label=label] [-mount-type=default|force|required|none]
+    [-attr-cache-ttl=duration] [-entry-cache-ttl=duration]
 %s
     %s[/path/to/mountpoint]
 
@@ -102,6 +106,10 @@ func start() *libfs.Error {
 		MountErrorIsFatal: *mountType == "required",
 		SkipMount:         *mountType == "none",
 		MountPoint:        mountDir,
+		CacheTTLs: libfuse.CacheTTLs{
+			Attr:  *attrCacheTTL,
+			Entry: *entryCacheTTL,
+		},
 	}
 
 	return libfuse.Start(options, ctx)
@@ -172,6 +172,24 @@ func (rmds *RootMetadataSigned) IsValidAndSigned(
 		return err
 	}
 
+	return rmds.VerifySignatures(codec)
+}
+
+// VerifySignatures checks the RootMetadata and WriterMetadata
+// signatures of the RootMetadataSigned against the verifying keys
+// they name.  Unlike IsValidAndSigned, it doesn't check the metadata
+// itself, or that the keys belong to writers of the TLF, so it needs
+// none of the TLF's key bundles or team information; the caller must
+// check the keys some other way.
+func (rmds *RootMetadataSigned) VerifySignatures(
+	codec kbfscodec.Codec) error {
+	if rmds.SigInfo.IsNil() {
+		return errors.New("Missing RootMetadata signature")
+	}
+	if rmds.WriterSigInfo.IsNil() {
+		return errors.New("Missing WriterMetadata signature")
+	}
+
 	md := rmds.MD
 	if rmds.MD.IsFinal() {
 		mdCopy, err := md.DeepCopy(codec)
@@ -0,0 +1,126 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// writeBlockLayoutDot writes `layout` to `w` as a graphviz digraph,
+// with one vertex per block and an edge from each indirect block to
+// each of its children.
+func writeBlockLayoutDot(w io.Writer, layout libkbfs.FileBlockLayout) error {
+	_, err := fmt.Fprintf(w, "digraph blocks {\n"+
+		"  label=\"size=%d depth=%d blocks=%d deduped=%d\";\n"+
+		"  node [shape=box];\n",
+		layout.Size, layout.Depth, layout.NumBlocks, layout.NumDeduped)
+	if err != nil {
+		return err
+	}
+
+	nextVertex := 0
+	var writeNode func(n *libkbfs.FileBlockLayoutNode) (int, error)
+	writeNode = func(n *libkbfs.FileBlockLayoutNode) (int, error) {
+		vertex := nextVertex
+		nextVertex++
+		label := fmt.Sprintf("%s\\noff=%d enc=%d", n.ID, n.Off, n.EncodedSize)
+		if len(n.Children) == 0 {
+			label += fmt.Sprintf(" data=%d", n.DataSize)
+		}
+		style := ""
+		if n.Dirty {
+			style = ",style=dashed"
+		} else if n.RefNonce != "" {
+			label += "\\nref=" + n.RefNonce
+			style = ",style=filled"
+		}
+		_, err := fmt.Fprintf(w, "  b%d [label=\"%s\"%s];\n",
+			vertex, label, style)
+		if err != nil {
+			return 0, err
+		}
+		for _, child := range n.Children {
+			childVertex, err := writeNode(child)
+			if err != nil {
+				return 0, err
+			}
+			_, err = fmt.Fprintf(w, "  b%d -> b%d;\n", vertex, childVertex)
+			if err != nil {
+				return 0, err
+			}
+		}
+		return vertex, nil
+	}
+	if layout.Root != nil {
+		if _, err := writeNode(layout.Root); err != nil {
+			return err
+		}
+	}
+
+	_, err = fmt.Fprintf(w, "}\n")
+	return err
+}
+
+func blockLayoutHelper(
+	ctx context.Context, config libkbfs.Config, args []string) error {
+	flags := flag.NewFlagSet("kbfs block-layout", flag.ContinueOnError)
+	format := flags.String("format", "json",
+		"The output format, either 'json' or 'dot' (for graphviz).")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return errExactlyOnePath
+	}
+	if *format != "json" && *format != "dot" {
+		return fmt.Errorf("Unknown format %q", *format)
+	}
+
+	p, err := fsrpc.NewPath(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if p.PathType != fsrpc.TLFPathType {
+		return fmt.Errorf("Cannot get the block layout of %s", p)
+	}
+
+	fileNode, err := p.GetFileNode(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	layout, err := config.KBFSOps().GetFileBlockLayout(ctx, fileNode)
+	if err != nil {
+		return err
+	}
+
+	if *format == "dot" {
+		return writeBlockLayoutDot(os.Stdout, layout)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(layout)
+}
+
+func blockLayout(ctx context.Context, config libkbfs.Config,
+	args []string) (exitStatus int) {
+	err := blockLayoutHelper(ctx, config, args)
+	if err != nil {
+		printError("block-layout", err)
+		exitStatus = 1
+	}
+	return
+}
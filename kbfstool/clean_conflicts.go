@@ -0,0 +1,76 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+func cleanConflictsHelper(
+	ctx context.Context, config libkbfs.Config, args []string) error {
+	flags := flag.NewFlagSet("kbfs clean-conflicts", flag.ContinueOnError)
+	dryRun := flags.Bool("n", false,
+		"Only print the conflicted copies that would be removed.")
+	retention := flags.Duration("retention", 0,
+		"Remove conflicted copies last changed longer ago than this "+
+			"(0 means never).")
+	identical := flags.Bool("identical", false,
+		"Remove conflicted copies identical to the surviving version.")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return errExactlyOnePath
+	}
+
+	p, err := fsrpc.NewPath(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if p.PathType != fsrpc.TLFPathType {
+		return fmt.Errorf("Cannot clean %s", p)
+	}
+
+	dirNode, ei, err := p.GetNode(ctx, config)
+	if err != nil {
+		return err
+	}
+	if ei.Type != libkbfs.Dir {
+		return fmt.Errorf("%s is not a directory", p)
+	}
+
+	policy := libkbfs.ConflictCleanupPolicy{
+		Retention:      *retention,
+		PruneIdentical: *identical,
+	}
+	actions, err := libkbfs.CleanConflictedCopies(
+		ctx, config, dirNode, policy, *dryRun)
+	for _, action := range actions {
+		verb := "Removed"
+		if *dryRun {
+			verb = "Would remove"
+		}
+		fmt.Printf("%s %s (%s)\n", verb, action.RelPath, action.Reason)
+	}
+	return err
+}
+
+func cleanConflicts(ctx context.Context, config libkbfs.Config,
+	args []string) (exitStatus int) {
+	err := cleanConflictsHelper(ctx, config, args)
+	if err != nil {
+		printError("clean-conflicts", err)
+		exitStatus = 1
+	}
+	return
+}
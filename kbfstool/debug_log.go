@@ -0,0 +1,85 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/go-framed-msgpack-rpc/rpc"
+	"github.com/keybase/kbfs/libkbfs"
+	kbgitkbfs "github.com/keybase/kbfs/protocol/kbgitkbfs1"
+	"github.com/keybase/kbfs/tlf"
+	"golang.org/x/net/context"
+)
+
+const debugLogUsageStr = `Usage:
+  kbfstool debug-log [-tlf-id <TLF ID>]
+
+Print the recent log messages, of every level, kept in memory by the
+running KBFS instance, either for all folders or only for the folder
+with the given TLF ID.
+`
+
+// debugLog prints the log messages kept in memory by the running
+// KBFS instance, fetched over its RPC socket.
+func debugLog(ctx context.Context, kbCtx libkbfs.Context,
+	args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs debug-log", flag.ContinueOnError)
+	tlfIDStr := flags.String("tlf-id", "", "If non-empty, only print "+
+		"the messages for the folder with this TLF ID.")
+	err := flags.Parse(args)
+	if err != nil {
+		printError("debug-log", err)
+		return 1
+	}
+
+	if len(flags.Args()) != 0 {
+		fmt.Print(debugLogUsageStr)
+		return 1
+	}
+
+	var tlfIDBytes []byte
+	if *tlfIDStr != "" {
+		tlfID, err := tlf.ParseID(*tlfIDStr)
+		if err != nil {
+			printError("debug-log", err)
+			return 1
+		}
+		tlfIDBytes = tlfID.Bytes()
+	}
+
+	conn, xp, _, err := kbCtx.GetKBFSSocket(true)
+	if err != nil {
+		printError("debug-log", err)
+		return 1
+	}
+	defer conn.Close()
+	cli := rpc.NewClient(xp, libkbfs.KBFSErrorUnwrapper{},
+		libkb.LogTagsFromContext)
+	client := kbgitkbfs.DebugLogClient{Cli: cli}
+
+	entries, err := client.GetDebugLog(ctx, tlfIDBytes)
+	if err != nil {
+		printError("debug-log", err)
+		return 1
+	}
+
+	for _, e := range entries {
+		tlfStr := "-"
+		if len(e.TlfID) != 0 {
+			var tlfID tlf.ID
+			if err := tlfID.UnmarshalBinary(e.TlfID); err == nil {
+				tlfStr = tlfID.String()
+			}
+		}
+		fmt.Printf("%s %s %s [%s] %s\n",
+			time.Unix(0, e.Time).Format(time.RFC3339Nano), tlfStr,
+			e.Level, e.Module, e.Msg)
+	}
+	return 0
+}
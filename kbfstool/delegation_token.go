@@ -0,0 +1,75 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+func mintDelegationHelper(
+	ctx context.Context, config libkbfs.Config, args []string) error {
+	flags := flag.NewFlagSet("kbfs mint-delegation", flag.ContinueOnError)
+	holder := flags.String("holder", "",
+		"The user (usually a service account) the token is for.")
+	ttl := flags.Duration("ttl", 24*time.Hour,
+		"How long the token is valid for.")
+	out := flags.String("o", "", "The file to write the token to.")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() < 1 {
+		return fmt.Errorf("At least one path must be given")
+	}
+	if *holder == "" {
+		return fmt.Errorf("A holder must be given with -holder")
+	}
+	if *out == "" {
+		return fmt.Errorf("A file for the token must be given with -o")
+	}
+
+	_, id, err := config.KBPKI().Resolve(ctx, *holder)
+	if err != nil {
+		return err
+	}
+	uid, err := id.AsUser()
+	if err != nil {
+		return err
+	}
+
+	token, err := libkbfs.MintDelegationToken(
+		ctx, config, uid, flags.Args(), *ttl)
+	if err != nil {
+		return err
+	}
+	buf, err := config.Codec().Encode(token)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(*out, buf, 0600)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wrote a token letting %s read %v until %s to %s\n",
+		*holder, token.Paths, time.Unix(0, token.Expires), *out)
+	return nil
+}
+
+func mintDelegation(ctx context.Context, config libkbfs.Config,
+	args []string) (exitStatus int) {
+	err := mintDelegationHelper(ctx, config, args)
+	if err != nil {
+		printError("mint-delegation", err)
+		exitStatus = 1
+	}
+	return
+}
@@ -0,0 +1,183 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+func proveExistenceHelper(
+	ctx context.Context, config libkbfs.Config, args []string) error {
+	flags := flag.NewFlagSet("kbfs prove-existence", flag.ContinueOnError)
+	rev := flags.Int64("rev", 0,
+		"The revision at which to prove the file's contents.")
+	out := flags.String("o", "", "The file to write the proof to.")
+	keyOut := flags.String("key-out", "",
+		"For a private or team TLF, a file to write the TLF crypt key "+
+			"needed to check the proof to.  Anyone with the key can read "+
+			"everything in the TLF encrypted with it.")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return errExactlyOnePath
+	}
+	if *rev <= 0 {
+		return fmt.Errorf("A revision must be given with -rev")
+	}
+	if *out == "" {
+		return fmt.Errorf("A file for the proof must be given with -o")
+	}
+
+	p, err := fsrpc.NewPath(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if p.PathType != fsrpc.TLFPathType || len(p.TLFComponents) == 0 {
+		return fmt.Errorf("%s is not a file in a TLF", p)
+	}
+
+	h, err := libkbfs.GetHandleFromFolderNameAndType(
+		ctx, config.KBPKI(), config.MDOps(), p.TLFName, p.TLFType)
+	if err != nil {
+		return err
+	}
+
+	proof, err := libkbfs.MakeExistenceProof(ctx, config, h,
+		kbfsmd.Revision(*rev), path.Join(p.TLFComponents...))
+	if err != nil {
+		return err
+	}
+	buf, err := config.Codec().Encode(proof)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(*out, buf, 0600)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wrote a proof of %s at revision %d to %s\n", p, *rev, *out)
+
+	if proof.KeyGen < kbfsmd.FirstValidKeyGen {
+		return nil
+	}
+	if *keyOut == "" {
+		fmt.Printf("Checking the proof needs the TLF crypt key of "+
+			"generation %d; use -key-out to export it\n", proof.KeyGen)
+		return nil
+	}
+	key, err := libkbfs.GetExistenceProofTLFCryptKey(ctx, config, proof)
+	if err != nil {
+		return err
+	}
+	keyData := key.Data()
+	err = ioutil.WriteFile(
+		*keyOut, []byte(hex.EncodeToString(keyData[:])+"\n"), 0600)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wrote the TLF crypt key of generation %d to %s\n",
+		proof.KeyGen, *keyOut)
+	return nil
+}
+
+func proveExistence(ctx context.Context, config libkbfs.Config,
+	args []string) (exitStatus int) {
+	err := proveExistenceHelper(ctx, config, args)
+	if err != nil {
+		printError("prove-existence", err)
+		exitStatus = 1
+	}
+	return
+}
+
+func verifyProofHelper(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("kbfs verify-proof", flag.ContinueOnError)
+	keyFile := flags.String("key", "",
+		"For a private or team TLF, the file holding the TLF crypt key "+
+			"written by prove-existence -key-out.")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Exactly one proof file must be given")
+	}
+
+	buf, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	codec := kbfscodec.NewMsgpack()
+	var proof libkbfs.ExistenceProof
+	err = codec.Decode(buf, &proof)
+	if err != nil {
+		return err
+	}
+	var key *kbfscrypto.TLFCryptKey
+	if *keyFile != "" {
+		keyBuf, err := ioutil.ReadFile(*keyFile)
+		if err != nil {
+			return err
+		}
+		keyData, err := hex.DecodeString(strings.TrimSpace(string(keyBuf)))
+		if err != nil {
+			return err
+		}
+		var data [32]byte
+		if len(keyData) != len(data) {
+			return fmt.Errorf("%s doesn't hold a TLF crypt key", *keyFile)
+		}
+		copy(data[:], keyData)
+		k := kbfscrypto.MakeTLFCryptKey(data)
+		key = &k
+	}
+	res, err := libkbfs.VerifyExistenceProof(ctx, codec, &proof, key)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("TLF ID: %s\n", res.TlfID)
+	fmt.Printf("Path: %s\n", res.Path)
+	fmt.Printf("Revision: %d\n", res.Revision)
+	fmt.Printf("Size: %d\n", res.Size)
+	fmt.Printf("SHA256: %x\n", res.SHA256)
+	fmt.Printf("Mtime: %s\n", time.Unix(0, res.Mtime))
+	fmt.Printf("Writer: %s\n", res.Writer)
+	fmt.Printf("Writer device (verifying key): %s\n", res.WriterKey)
+	fmt.Printf("Head revision: %d\n", res.HeadRevision)
+	fmt.Printf("Head writer device (verifying key): %s\n",
+		res.HeadWriterKey)
+	fmt.Print("The proof is valid, as long as the writer devices above " +
+		"belonged to writers of the TLF.\n")
+	return nil
+}
+
+// verifyProof checks an existence proof without contacting any
+// servers, so it doesn't need a KBFS config.
+func verifyProof(ctx context.Context, args []string) (exitStatus int) {
+	err := verifyProofHelper(ctx, args)
+	if err != nil {
+		printError("verify-proof", err)
+		exitStatus = 1
+	}
+	return
+}
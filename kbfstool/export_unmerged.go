@@ -0,0 +1,103 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const exportUnmergedUsageStr = `Usage:
+  kbfstool export-unmerged [-tar] /keybase/[public|private]/tlf dest
+
+Writes the unmerged branch of this device for the given TLF into
+dest/unmerged, and the latest merged revision into dest/merged, so
+they can be reconciled by hand.  With -tar, dest is instead a new tar
+archive holding both directories.
+
+Only the revisions already on the server are exported; if the running
+KBFS has a journal, flush it first.
+
+`
+
+func exportUnmergedHelper(
+	ctx context.Context, config libkbfs.Config, args []string) (err error) {
+	flags := flag.NewFlagSet("kbfs export-unmerged", flag.ContinueOnError)
+	asTar := flags.Bool("tar", false,
+		"Write a tar archive instead of a directory.")
+	err = flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 2 {
+		fmt.Print(exportUnmergedUsageStr)
+		return fmt.Errorf("Expected a TLF path and a destination")
+	}
+
+	p, err := fsrpc.NewPath(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if p.PathType != fsrpc.TLFPathType || len(p.TLFComponents) > 0 {
+		return fmt.Errorf("%s is not the root of a TLF", p)
+	}
+
+	h, err := libkbfs.GetHandleFromFolderNameAndType(
+		ctx, config.KBPKI(), config.MDOps(), p.TLFName, p.TLFType)
+	if err != nil {
+		return err
+	}
+
+	dest := flags.Arg(1)
+	var export libkbfs.UnmergedExport
+	if *asTar {
+		f, err := ioutil.OpenFile(
+			dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			closeErr := f.Close()
+			if err == nil {
+				err = closeErr
+			}
+		}()
+		export, err = libkbfs.ExportUnmergedBranchToTar(ctx, config, h, f)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = ioutil.MkdirAll(dest, 0700)
+		if err != nil {
+			return err
+		}
+		export, err = libkbfs.ExportUnmergedBranchToDir(ctx, config, h, dest)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Exported unmerged branch %s (revision %d) and merged "+
+		"revision %d to %s\n", export.BranchID, export.UnmergedRevision,
+		export.MergedRevision, dest)
+	return nil
+}
+
+func exportUnmerged(ctx context.Context, config libkbfs.Config,
+	args []string) (exitStatus int) {
+	err := exportUnmergedHelper(ctx, config, args)
+	if err != nil {
+		printError("export-unmerged", err)
+		exitStatus = 1
+	}
+	return
+}
@@ -42,6 +42,24 @@ The possible commands are:
   write		Write stdin to file
   md            Operate on metadata objects
   git           Operate on git repositories
+  clean-conflicts
+                Remove old or redundant conflicted copies of files
+  debug-log     Print recent log messages from the running KBFS
+  block-layout  Export the block tree of a file as JSON or graphviz
+  export-unmerged
+                Export this device's unmerged branch of a TLF, along
+                with its merged view, for manual resolution
+  revert        Restore a TLF to the state of an earlier revision
+  storage-attribution
+                Attribute the storage of a TLF to the revisions that
+                introduced it
+  prove-existence
+                Export a signed proof that a file had certain contents
+                at a revision
+  verify-proof  Check a proof made by prove-existence, offline
+  mint-delegation
+                Make a token restricting a service account to reading
+                some paths, for its kbfs -delegation-token-file
 
 `
 
@@ -70,11 +88,29 @@ func realMain() (exitStatus int) {
 		return 1
 	}
 
+	cmd := flag.Arg(0)
+	args := flag.Args()[1:]
+
+	// This talks to the running KBFS instance, so don't start
+	// another one.
+	if cmd == "debug-log" {
+		return debugLog(context.Background(), kbCtx, args)
+	}
+
+	// Proofs are checked offline, so don't start KBFS either.
+	if cmd == "verify-proof" {
+		return verifyProof(context.Background(), args)
+	}
+
 	log := logger.New("")
 
 	// Turn these off to not interfere with a running kbfs daemon.
 	kbfsParams.EnableJournal = false
 	kbfsParams.DiskCacheMode = libkbfs.DiskCacheModeOff
+	if cmd == "export-unmerged" {
+		// Don't let this instance resolve the branch being exported.
+		kbfsParams.Mode = libkbfs.InitViewerString
+	}
 
 	ctx := context.Background()
 	config, err := libkbfs.Init(ctx, kbCtx, *kbfsParams, nil, nil, log)
@@ -89,9 +125,6 @@ func realMain() (exitStatus int) {
 	// figure out some other way to log the full folder-branch
 	// name for kbfsfuse but not for kbfs.
 
-	cmd := flag.Arg(0)
-	args := flag.Args()[1:]
-
 	switch cmd {
 	case "stat":
 		return stat(ctx, config, args)
@@ -107,6 +140,20 @@ func realMain() (exitStatus int) {
 		return mdMain(ctx, config, args)
 	case "git":
 		return gitMain(ctx, config, args)
+	case "clean-conflicts":
+		return cleanConflicts(ctx, config, args)
+	case "block-layout":
+		return blockLayout(ctx, config, args)
+	case "export-unmerged":
+		return exportUnmerged(ctx, config, args)
+	case "revert":
+		return revert(ctx, config, args)
+	case "storage-attribution":
+		return storageAttribution(ctx, config, args)
+	case "prove-existence":
+		return proveExistence(ctx, config, args)
+	case "mint-delegation":
+		return mintDelegation(ctx, config, args)
 	default:
 		printError("kbfs", fmt.Errorf("unknown command %q", cmd))
 		return 1
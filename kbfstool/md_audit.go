@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const mdAuditUsageStr = `Usage:
+  kbfstool md audit /keybase/[public|private]/user1,assertion2 [tlf...]
+
+Each TLF may also be given as a TLF ID. The entire merged history of
+each TLF is fetched and checked, from its first revision to its
+latest: every revision must be properly signed by a device (or team
+member) that was allowed to write it at the time, and must point back
+to the revision before it. The first revision that fails is reported.
+
+`
+
+func mdAudit(ctx context.Context, config libkbfs.Config, args []string) (
+	exitStatus int) {
+	flags := flag.NewFlagSet("kbfs md audit", flag.ContinueOnError)
+	err := flags.Parse(args)
+	if err != nil {
+		printError("md audit", err)
+		return 1
+	}
+
+	inputs := flags.Args()
+	if len(inputs) < 1 {
+		fmt.Print(mdAuditUsageStr)
+		return 1
+	}
+
+	for _, input := range inputs {
+		tlfID, err := getTlfID(ctx, config, input)
+		if err != nil {
+			printError("md audit", err)
+			return 1
+		}
+
+		fmt.Printf("Auditing %s (%s)...\n", input, tlfID)
+		result, err := libkbfs.AuditMDChain(ctx, config, tlfID)
+		if err != nil {
+			printError("md audit", err)
+			return 1
+		}
+
+		switch {
+		case result.Head == 0:
+			fmt.Printf("No revisions found for %q\n", input)
+		case result.Passed():
+			fmt.Printf("All %d revisions passed\n", result.Head)
+		default:
+			fmt.Printf("Revisions 1-%d (of %d) passed, but revision %d "+
+				"failed: %v\n", result.LastVerified, result.Head,
+				result.FirstBad, result.Err)
+			exitStatus = 1
+		}
+		fmt.Print("\n")
+	}
+
+	return exitStatus
+}
@@ -13,8 +13,10 @@ const mdUsageStr = `Usage:
 The possible subcommands are:
   dump	      Dump metadata objects
   check	      Check metadata objects and their associated blocks for errors
+  audit	      Verify the signatures and links of a folder's entire history
   reset	      Reset a broken top-level folder
   force-qr    Append a fake quota reclamation record to the folder history
+  simulate-qr Report what quota reclamation would free at various ages
 `
 
 func mdMain(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
@@ -31,10 +33,14 @@ func mdMain(ctx context.Context, config libkbfs.Config, args []string) (exitStat
 		return mdDump(ctx, config, args)
 	case "check":
 		return mdCheck(ctx, config, args)
+	case "audit":
+		return mdAudit(ctx, config, args)
 	case "reset":
 		return mdReset(ctx, config, args)
 	case "force-qr":
 		return mdForceQR(ctx, config, args)
+	case "simulate-qr":
+		return mdSimulateQR(ctx, config, args)
 	default:
 		printError("md", fmt.Errorf("unknown command %q", cmd))
 		return 1
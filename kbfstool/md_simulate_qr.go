@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const mdSimulateQRUsageStr = `Usage:
+  kbfstool md simulate-qr [-windows 0s,24h,...] /keybase/[public|private]/user1,assertion2 [tlf...]
+
+Each TLF may also be given as a TLF ID. Nothing is deleted: for each
+retention window, the revisions that quota reclamation would clean up
+if it only reclaimed blocks unreferenced for at least that long are
+found, and the number of bytes they unreferenced is reported.
+
+`
+
+func parseQRWindows(s string) ([]time.Duration, error) {
+	var windows []time.Duration
+	for _, w := range strings.Split(s, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(w))
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, d)
+	}
+	return windows, nil
+}
+
+func mdSimulateQR(ctx context.Context, config libkbfs.Config,
+	args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs md simulate-qr", flag.ContinueOnError)
+	windowsStr := flags.String("windows", "0s,1h,24h,168h,336h,720h",
+		"Comma-separated list of minimum unref ages to simulate.")
+	err := flags.Parse(args)
+	if err != nil {
+		printError("md simulate-qr", err)
+		return 1
+	}
+
+	inputs := flags.Args()
+	if len(inputs) < 1 {
+		fmt.Print(mdSimulateQRUsageStr)
+		return 1
+	}
+
+	windows, err := parseQRWindows(*windowsStr)
+	if err != nil {
+		printError("md simulate-qr", err)
+		return 1
+	}
+
+	for _, input := range inputs {
+		tlfID, err := getTlfID(ctx, config, input)
+		if err != nil {
+			printError("md simulate-qr", err)
+			return 1
+		}
+
+		sim, err := libkbfs.SimulateQuotaReclamation(
+			ctx, config, tlfID, windows)
+		if err != nil {
+			printError("md simulate-qr", err)
+			return 1
+		}
+
+		fmt.Printf("%s (%s): head revision %d, last reclaimed "+
+			"revision %d\n", input, tlfID, sim.Head, sim.LastGCRev)
+		for _, w := range sim.Windows {
+			if w.LatestRev == 0 {
+				fmt.Printf("  %v:\tnothing to reclaim\n", w.MinUnrefAge)
+				continue
+			}
+			fmt.Printf("  %v:\tup to %d bytes in %d blocks, through "+
+				"revision %d\n", w.MinUnrefAge, w.Bytes, w.Blocks,
+				w.LatestRev)
+		}
+		fmt.Print("\n")
+	}
+
+	return 0
+}
@@ -0,0 +1,84 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+func revertHelper(
+	ctx context.Context, config libkbfs.Config, args []string) error {
+	flags := flag.NewFlagSet("kbfs revert", flag.ContinueOnError)
+	rev := flags.Int64("rev", 0, "The revision to restore the TLF to.")
+	dryRun := flags.Bool("n", false,
+		"Only print the changes the revert would make.")
+	expectedHead := flags.Int64("expected-head", 0,
+		"If non-zero, fail unless this is the current head revision "+
+			"(as printed by a dry run).")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return errExactlyOnePath
+	}
+	if *rev <= 0 {
+		return fmt.Errorf("A revision to revert to must be given with -rev")
+	}
+
+	p, err := fsrpc.NewPath(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if p.PathType != fsrpc.TLFPathType || len(p.TLFComponents) > 0 {
+		return fmt.Errorf("%s is not the root of a TLF", p)
+	}
+
+	h, err := libkbfs.GetHandleFromFolderNameAndType(
+		ctx, config.KBPKI(), config.MDOps(), p.TLFName, p.TLFType)
+	if err != nil {
+		return err
+	}
+
+	expected := kbfsmd.RevisionUninitialized
+	if *expectedHead != 0 {
+		expected = kbfsmd.Revision(*expectedHead)
+	}
+	revert, err := libkbfs.RevertTLF(
+		ctx, config, h, kbfsmd.Revision(*rev), expected, *dryRun)
+	if err != nil {
+		return err
+	}
+
+	for _, change := range revert.Changes {
+		fmt.Printf("%s %s\n", change.Action, change.Path)
+	}
+	if *dryRun {
+		fmt.Printf("Would revert %s from revision %d to revision %d; "+
+			"pass -expected-head %d to apply\n", p, revert.FromRevision,
+			revert.ToRevision, revert.FromRevision)
+	} else {
+		fmt.Printf("Reverted %s from revision %d to revision %d\n",
+			p, revert.FromRevision, revert.ToRevision)
+	}
+	return nil
+}
+
+func revert(ctx context.Context, config libkbfs.Config,
+	args []string) (exitStatus int) {
+	err := revertHelper(ctx, config, args)
+	if err != nil {
+		printError("revert", err)
+		exitStatus = 1
+	}
+	return
+}
@@ -0,0 +1,96 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const storageAttributionUsageStr = `Usage:
+  kbfstool storage-attribution [-n N] [-ops] [-json] /keybase/[public|private]/tlf
+
+The TLF may also be given as a TLF ID. Every block reachable from the
+latest revision of the TLF is attributed to the revision (and op)
+that first referenced it, and the revisions responsible for the most
+storage are listed first.
+
+`
+
+func storageAttributionHelper(
+	ctx context.Context, config libkbfs.Config, args []string) error {
+	flags := flag.NewFlagSet(
+		"kbfs storage-attribution", flag.ContinueOnError)
+	top := flags.Int("n", 20,
+		"The number of revisions to list, or 0 to list them all.")
+	showOps := flags.Bool("ops", false,
+		"Also list the ops responsible within each revision.")
+	asJSON := flags.Bool("json", false,
+		"Print the whole attribution as JSON.")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		fmt.Print(storageAttributionUsageStr)
+		return errExactlyOnePath
+	}
+
+	tlfID, err := getTlfID(ctx, config, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	attribution, err := libkbfs.AttributeStorage(ctx, config, tlfID)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(attribution)
+	}
+
+	fmt.Printf("Head revision %d: %d live bytes, %d unattributed\n",
+		attribution.Head, attribution.TotalBytes,
+		attribution.UnattributedBytes)
+	revs := attribution.Revisions
+	sort.SliceStable(revs, func(i, j int) bool {
+		return revs[i].Bytes > revs[j].Bytes
+	})
+	if *top > 0 && len(revs) > *top {
+		revs = revs[:*top]
+	}
+	for _, rev := range revs {
+		fmt.Printf("rev %d\t%d bytes\t%d blocks\t%s\t%s\n", rev.Revision,
+			rev.Bytes, rev.Blocks, rev.Writer, rev.Time)
+		if !*showOps {
+			continue
+		}
+		for _, op := range rev.Ops {
+			fmt.Printf("\t%d bytes\t%d blocks\t%s\n",
+				op.Bytes, op.Blocks, op.Op)
+		}
+	}
+	return nil
+}
+
+func storageAttribution(ctx context.Context, config libkbfs.Config,
+	args []string) (exitStatus int) {
+	err := storageAttributionHelper(ctx, config, args)
+	if err != nil {
+		printError("storage-attribution", err)
+		exitStatus = 1
+	}
+	return
+}
@@ -7,7 +7,6 @@ package main
 import (
 	"flag"
 	"fmt"
-	"io"
 	"os"
 
 	"github.com/keybase/kbfs/fsrpc"
@@ -15,28 +14,6 @@ import (
 	"golang.org/x/net/context"
 )
 
-type nodeWriter struct {
-	ctx     context.Context
-	kbfsOps libkbfs.KBFSOps
-	node    libkbfs.Node
-	off     int64
-	verbose bool
-}
-
-var _ io.Writer = (*nodeWriter)(nil)
-
-func (nw *nodeWriter) Write(p []byte) (n int, err error) {
-	if nw.verbose {
-		fmt.Fprintf(os.Stderr, "Writing %s at offset %d\n", byteCountStr(len(p)), nw.off)
-	}
-	err = nw.kbfsOps.Write(nw.ctx, nw.node, p, nw.off)
-	if err == nil {
-		n = len(p)
-		nw.off += int64(n)
-	}
-	return
-}
-
 func writeHelper(ctx context.Context, config libkbfs.Config, args []string) (err error) {
 	flags := flag.NewFlagSet("kbfs write", flag.ContinueOnError)
 	append := flags.Bool("a", false, "Append to an existing file instead of truncating it.")
@@ -128,15 +105,11 @@ func writeHelper(ctx context.Context, config libkbfs.Config, args []string) (err
 		}
 	}
 
-	nw := nodeWriter{
-		ctx:     ctx,
-		kbfsOps: kbfsOps,
-		node:    fileNode,
-		off:     off,
-		verbose: *verbose,
+	written, err := kbfsOps.WriteStream(ctx, fileNode, os.Stdin, off)
+	if *verbose {
+		fmt.Fprintf(os.Stderr, "Wrote %s at offset %d\n",
+			byteCountStr(int(written)), off)
 	}
-
-	written, err := io.Copy(&nw, os.Stdin)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,16 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdokan
+
+import (
+	"github.com/keybase/kbfs/libfs"
+)
+
+// NewBlockTrafficFile returns a special read file that contains a
+// JSON representation of the block traffic of each TLF.
+func NewBlockTrafficFile(fs *FS) *SpecialReadFile {
+	return &SpecialReadFile{
+		read: libfs.GetEncodedBlockTraffic(fs.config), fs: fs}
+}
@@ -76,7 +76,8 @@ func (f *File) FlushFileBuffers(ctx context.Context, fi *dokan.FileInfo) (err er
 	f.folder.fs.logEnter(ctx, "File FlushFileBuffers")
 	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
 
-	return f.folder.fs.config.KBFSOps().SyncAll(ctx, f.node.GetFolderBranch())
+	return libkbfs.FsyncAll(
+		ctx, f.folder.fs.config, f.node.GetFolderBranch(), f.folder.fs.log)
 }
 
 // ReadFile for dokan reads.
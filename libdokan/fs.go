@@ -311,6 +311,10 @@ func (f *FS) open(ctx context.Context, oc *openContext, ps []string) (dokan.File
 		return oc.returnFileNoCleanup(NewErrorFile(f))
 	case libfs.MetricsFileName == ps[psl-1]:
 		return oc.returnFileNoCleanup(NewMetricsFile(f))
+	case libfs.MemoryUsageFileName == ps[psl-1]:
+		return oc.returnFileNoCleanup(NewMemoryUsageFile(f))
+	case libfs.BlockTrafficFileName == ps[psl-1]:
+		return oc.returnFileNoCleanup(NewBlockTrafficFile(f))
 		// TODO: Make the two cases below available from any
 		// directory.
 	case libfs.ProfileListDirName == ps[0]:
@@ -351,6 +355,9 @@ func (f *FS) open(ctx context.Context, oc *openContext, ps []string) (dokan.File
 			enable: false,
 		})
 
+	case libfs.FsyncModeFileName == ps[0]:
+		return oc.returnFileNoCleanup(&FsyncModeFile{fs: f})
+
 	case libfs.EditHistoryName == ps[0]:
 		return oc.returnFileNoCleanup(NewUserEditHistoryFile(&Folder{fs: f}))
 
@@ -0,0 +1,36 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdokan
+
+import (
+	"github.com/keybase/kbfs/dokan"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// FsyncModeFile represents a write-only file where a write sets when
+// an fsync returns.
+type FsyncModeFile struct {
+	fs *FS
+	specialWriteFile
+}
+
+// WriteFile performs writes for dokan.
+func (f *FsyncModeFile) WriteFile(ctx context.Context, fi *dokan.FileInfo, bs []byte, offset int64) (n int, err error) {
+	f.fs.logEnter(ctx, "FsyncModeFile WriteFile")
+	defer func() { f.fs.reportErr(ctx, libkbfs.WriteMode, err) }()
+	if len(bs) == 0 {
+		return 0, nil
+	}
+
+	mode, err := libfs.SetFsyncMode(f.fs.config, string(bs))
+	if err != nil {
+		return 0, err
+	}
+	f.fs.log.CDebugf(ctx, "Fsync mode is now %s", mode)
+
+	return len(bs), nil
+}
@@ -0,0 +1,29 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/keybase/kbfs/tlf"
+	"golang.org/x/net/context"
+)
+
+// blockTrafficFileDepth is how many path components the block
+// traffic file breaks the traffic of each TLF down by.
+const blockTrafficFileDepth = 2
+
+// GetEncodedBlockTraffic returns the recorded block traffic of every
+// TLF, per day and top-level path, encoded as JSON, for the block
+// traffic file.
+func GetEncodedBlockTraffic(config libkbfs.Config) func(
+	context.Context) ([]byte, time.Time, error) {
+	return func(context.Context) ([]byte, time.Time, error) {
+		data, err := PrettyJSON(config.BlockTrafficLog().Summarize(
+			time.Time{}, tlf.NullID, "", blockTrafficFileDepth))
+		return data, time.Time{}, err
+	}
+}
@@ -8,6 +8,14 @@ package libfs
 // reached from any KBFS directory.
 const MetricsFileName = ".kbfs_metrics"
 
+// MemoryUsageFileName is the name of the KBFS memory usage file -- it
+// can be reached from any KBFS directory.
+const MemoryUsageFileName = ".kbfs_memory_usage"
+
+// BlockTrafficFileName is the name of the KBFS block traffic file --
+// it can be reached from any KBFS directory.
+const BlockTrafficFileName = ".kbfs_block_traffic"
+
 // ReclaimQuotaFileName is the name of the KBFS quota-reclaiming file
 // -- it can be reached anywhere within a top-level folder.
 const ReclaimQuotaFileName = ".kbfs_reclaim_quota"
@@ -86,6 +94,16 @@ const EnableDebugServerFileName = ".kbfs_enable_debug_server"
 // debug HTTP server. It's accessible anywhere outside a TLF.
 const DisableDebugServerFileName = ".kbfs_disable_debug_server"
 
+// LogLevelsFileName is the name of the file to set per-module log
+// levels, e.g. "blockops=debug,cr=warning". It's accessible anywhere
+// outside a TLF.
+const LogLevelsFileName = ".kbfs_log_levels"
+
+// FsyncModeFileName is the name of the file to set when an fsync
+// returns, by writing "journal" or "server" to it.  It's accessible
+// anywhere outside a TLF.
+const FsyncModeFileName = ".kbfs_fsync_mode"
+
 // EditHistoryName is the name of the KBFS TLF edit history file --
 // it can be reached anywhere within a top-level folder.
 const EditHistoryName = ".kbfs_edit_history"
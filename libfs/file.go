@@ -63,6 +63,22 @@ func (f *File) Write(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
+// WriteStream streams everything read from `r` into the file at the
+// current offset through `KBFSOps.WriteStream`, so a caller can hand
+// over a large upload without chunking it or holding it all in
+// memory.  As with Write, the data isn't synced when it returns.
+func (f *File) WriteStream(r io.Reader) (n int64, err error) {
+	if f.readOnly {
+		return 0, errors.New("Trying to write a read-only file")
+	}
+
+	origOffset := atomic.LoadInt64(&f.offset)
+	n, err = f.fs.config.KBFSOps().WriteStream(
+		f.fs.ctx, f.node, r, origOffset)
+	f.updateOffset(origOffset, n)
+	return n, err
+}
+
 // Read implements the billy.File interface for File.
 func (f *File) Read(p []byte) (n int, err error) {
 	origOffset := atomic.LoadInt64(&f.offset)
@@ -78,6 +78,19 @@ type PrevRevisionsGetter interface {
 	PrevRevisions() libkbfs.PrevRevisions
 }
 
+// AllocatedSizeGetter is an interface for something that can return
+// the number of bytes of an entry that aren't part of a hole.
+type AllocatedSizeGetter interface {
+	AllocatedSize() (uint64, error)
+}
+
+// SyncErrorGetter is an interface for something that can return the
+// most recent error that kept an entry's unsynced changes from being
+// synced.
+type SyncErrorGetter interface {
+	SyncError() (*libkbfs.FileSyncError, error)
+}
+
 type fileInfoSys struct {
 	fi *FileInfo
 }
@@ -124,6 +137,31 @@ func (fis fileInfoSys) PrevRevisions() (revs libkbfs.PrevRevisions) {
 	return fis.fi.ei.PrevRevisions
 }
 
+var _ AllocatedSizeGetter = fileInfoSys{}
+
+func (fis fileInfoSys) AllocatedSize() (uint64, error) {
+	if fis.fi.node == nil {
+		// Symlinks have no data.
+		return fis.fi.ei.Size, nil
+	}
+	return fis.fi.fs.config.KBFSOps().GetAllocatedSize(
+		fis.fi.fs.ctx, fis.fi.node)
+}
+
+var _ SyncErrorGetter = fileInfoSys{}
+
+func (fis fileInfoSys) SyncError() (*libkbfs.FileSyncError, error) {
+	if fis.fi.node == nil || fis.fi.ei.Type == libkbfs.Dir {
+		return nil, nil
+	}
+	md, err := fis.fi.fs.config.KBFSOps().GetNodeMetadata(
+		fis.fi.fs.ctx, fis.fi.node)
+	if err != nil {
+		return nil, err
+	}
+	return md.SyncError, nil
+}
+
 func (fis fileInfoSys) EntryInfo() libkbfs.EntryInfo {
 	return fis.fi.ei
 }
@@ -80,10 +80,6 @@ type FS struct {
 
 var _ billy.Filesystem = (*FS)(nil)
 
-const (
-	maxSymlinkLevels = 40 // same as Linux
-)
-
 func followSymlink(parentPath, link string) (newPath string, err error) {
 	if path.IsAbs(link) {
 		return "", errors.Errorf("Can't follow absolute link: %s", link)
@@ -137,6 +133,7 @@ func NewFS(ctx context.Context, config libkbfs.Config,
 		parts = strings.Split(subdir, "/")
 	}
 	// Loop while we follow symlinks.
+	sr := libkbfs.NewSymlinkResolver(config)
 outer:
 	for {
 		for i, p := range parts {
@@ -156,6 +153,11 @@ outer:
 				}
 				newParts := strings.Split(newPath, "/")
 				newParts = append(newParts, parts[i+1:]...)
+				err = sr.Follow(
+					path.Join(parts[:i+1]...), path.Join(newParts...))
+				if err != nil {
+					return nil, err
+				}
 				// Fix subdir so we'll get the correct default lock namespace.
 				oldSubdir := subdir
 				subdir = path.Join(newParts...)
@@ -251,13 +253,13 @@ func (fs *FS) lookupOrCreateEntryNoFollow(
 	}
 }
 
-// lookupParentWithDepth looks up the parent node of the given
-// filename.  It follows symlinks in the path, but doesn't resolve the
-// final base name.  If `exitEarly` is true, it returns on the first
-// not-found error and `base` will contain the subpath of filename not
-// yet found.
-func (fs *FS) lookupParentWithDepth(
-	filename string, exitEarly bool, depth int) (
+// lookupParentWithResolver looks up the parent node of the given
+// filename.  It follows symlinks in the path, as allowed by `sr`, but
+// doesn't resolve the final base name.  If `exitEarly` is true, it
+// returns on the first not-found error and `base` will contain the
+// subpath of filename not yet found.
+func (fs *FS) lookupParentWithResolver(
+	filename string, exitEarly bool, sr *libkbfs.SymlinkResolver) (
 	parent libkbfs.Node, parentDir, base string, err error) {
 	parts := strings.Split(filename, "/")
 	n := fs.root
@@ -282,17 +284,18 @@ func (fs *FS) lookupParentWithDepth(
 
 		switch ei.Type {
 		case libkbfs.Sym:
-			if depth == maxSymlinkLevels {
-				return nil, "", "", errors.New("Too many levels of symlinks")
-			}
 			parentDir = path.Join(parts[:i]...)
 			newPath, err := followSymlink(parentDir, ei.SymPath)
 			if err != nil {
 				return nil, "", "", err
 			}
 			newPathPlusRemainder := append([]string{newPath}, parts[i+1:]...)
-			return fs.lookupParentWithDepth(
-				path.Join(newPathPlusRemainder...), exitEarly, depth+1)
+			newFilename := path.Join(newPathPlusRemainder...)
+			err = sr.Follow(path.Join(parts[:i+1]...), newFilename)
+			if err != nil {
+				return nil, "", "", err
+			}
+			return fs.lookupParentWithResolver(newFilename, exitEarly, sr)
 		case libkbfs.Dir:
 			continue
 		default:
@@ -307,7 +310,8 @@ func (fs *FS) lookupParentWithDepth(
 
 func (fs *FS) lookupParent(filename string) (
 	parent libkbfs.Node, parentDir, base string, err error) {
-	return fs.lookupParentWithDepth(filename, false, 0)
+	return fs.lookupParentWithResolver(
+		filename, false, libkbfs.NewSymlinkResolver(fs.config))
 }
 
 // lookupOrCreateEntry looks up the entry for a filename, following
@@ -323,9 +327,11 @@ func (fs *FS) lookupOrCreateEntry(
 	}
 	filename = strings.TrimPrefix(filename, "/")
 
-	for i := 0; i < maxSymlinkLevels; i++ {
+	sr := libkbfs.NewSymlinkResolver(fs.config)
+	for {
 		var parentDir, fName string
-		n, parentDir, fName, err = fs.lookupParent(filename)
+		n, parentDir, fName, err = fs.lookupParentWithResolver(
+			filename, false, sr)
 		if err != nil {
 			return nil, libkbfs.EntryInfo{}, err
 		}
@@ -340,12 +346,16 @@ func (fs *FS) lookupOrCreateEntry(
 		}
 		fs.log.CDebugf(fs.ctx, "Following symlink=%s from dir=%s",
 			ei.SymPath, parentDir)
+		link := path.Join(parentDir, fName)
 		filename, err = followSymlink(parentDir, ei.SymPath)
 		if err != nil {
 			return nil, libkbfs.EntryInfo{}, err
 		}
+		err = sr.Follow(link, filename)
+		if err != nil {
+			return nil, libkbfs.EntryInfo{}, err
+		}
 	}
-	return nil, libkbfs.EntryInfo{}, errors.New("Too many levels of symlinks")
 }
 
 func translateErr(err error) error {
@@ -372,7 +382,8 @@ func (fs *FS) mkdirAll(filename string, perm os.FileMode) (err error) {
 		return nil
 	}
 
-	n, _, leftover, err := fs.lookupParentWithDepth(filename, true, 0)
+	n, _, leftover, err := fs.lookupParentWithResolver(
+		filename, true, libkbfs.NewSymlinkResolver(fs.config))
 	if err != nil {
 		return err
 	}
@@ -526,6 +537,36 @@ func (fs *FS) Rename(oldpath, newpath string) (err error) {
 		fs.ctx, oldParent, oldBase, newParent, newBase)
 }
 
+// CloneFile creates `dst` as a clone of the file `src` in `srcFS`
+// (see KBFSOps.CloneFile), which shares its blocks rather than
+// copying its data.  Both FSes must be in the same TLF, and `dst`
+// must not exist yet.
+func (fs *FS) CloneFile(srcFS *FS, src, dst string) (err error) {
+	fs.log.CDebugf(fs.ctx, "CloneFile %s -> %s", src, dst)
+	defer func() {
+		fs.deferLog.CDebugf(fs.ctx, "CloneFile done: %+v", err)
+		err = translateErr(err)
+	}()
+
+	srcNode, _, err := srcFS.lookupOrCreateEntry(src, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	err = fs.ensureParentDir(dst)
+	if err != nil {
+		return err
+	}
+
+	parent, _, base, err := fs.lookupParent(dst)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = fs.config.KBFSOps().CloneFile(fs.ctx, srcNode, parent, base)
+	return err
+}
+
 // Remove implements the billy.Filesystem interface for FS.
 func (fs *FS) Remove(filename string) (err error) {
 	fs.log.CDebugf(fs.ctx, "Remove %s", filename)
@@ -17,6 +17,7 @@ import (
 	"github.com/keybase/kbfs/kbfsmd"
 	"github.com/keybase/kbfs/libkbfs"
 	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	billy "gopkg.in/src-d/go-billy.v4"
@@ -192,6 +193,42 @@ func TestAppendFile(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestFileWriteStream(t *testing.T) {
+	ctx, _, fs := makeFS(t, "")
+	defer libkbfs.CheckConfigAndShutdown(ctx, t, fs.config)
+
+	f, err := fs.Create("foo")
+	require.NoError(t, err)
+	n, err := f.Write([]byte{1})
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	// Stream the rest of the file in after the first byte.
+	data := bytes.Repeat([]byte{2, 3, 4}, 100000)
+	n64, err := f.(*File).WriteStream(bytes.NewReader(data))
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n64)
+
+	// The offset moved past the streamed data.
+	n, err = f.Write([]byte{5})
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	err = f.Close()
+	require.NoError(t, err)
+
+	f, err = fs.Open("foo")
+	require.NoError(t, err)
+	gotData, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	expected := append(append([]byte{1}, data...), 5)
+	require.True(t, bytes.Equal(expected, gotData))
+	err = f.Close()
+	require.NoError(t, err)
+
+	err = fs.SyncAll()
+	require.NoError(t, err)
+}
+
 func TestRecreateAndExcl(t *testing.T) {
 	ctx, h, fs := makeFS(t, "")
 	defer libkbfs.CheckConfigAndShutdown(ctx, t, fs.config)
@@ -341,6 +378,33 @@ func TestRename(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestCloneFile(t *testing.T) {
+	ctx, _, fs := makeFS(t, "")
+	defer libkbfs.CheckConfigAndShutdown(ctx, t, fs.config)
+
+	data := []byte{1, 2, 3, 4, 5}
+	f, err := fs.Create("foo")
+	require.NoError(t, err)
+	_, err = f.Write(data)
+	require.NoError(t, err)
+	err = f.Close()
+	require.NoError(t, err)
+
+	err = fs.CloneFile(fs, "foo", "a/b/bar")
+	require.NoError(t, err)
+	f, err = fs.Open("a/b/bar")
+	require.NoError(t, err)
+	gotData := make([]byte, len(data))
+	_, err = f.Read(gotData)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data, gotData))
+	err = f.Close()
+	require.NoError(t, err)
+
+	err = fs.CloneFile(fs, "foo", "a/b/bar")
+	require.True(t, os.IsExist(err))
+}
+
 func TestRemove(t *testing.T) {
 	ctx, h, fs := makeFS(t, "")
 	defer libkbfs.CheckConfigAndShutdown(ctx, t, fs.config)
@@ -494,6 +558,8 @@ func TestSymlink(t *testing.T) {
 	require.NoError(t, err)
 	bar, err = fs.Open("x")
 	require.NotNil(t, err)
+	_, ok := errors.Cause(err).(libkbfs.SymlinkLoopError)
+	require.True(t, ok, "err=%+v", err)
 
 	t.Log("Symlink that tries to break chroot")
 	err = fs.Symlink("../../a", "a/breakout")
@@ -701,3 +767,174 @@ func TestArchivedByRevision(t *testing.T) {
 	require.NoError(t, err)
 	require.Len(t, fis, 0)
 }
+
+func TestMirror(t *testing.T) {
+	ctx, _, fs := makeFS(t, "")
+	defer libkbfs.CheckConfigAndShutdown(ctx, t, fs.config)
+
+	localDir, err := ioutil.TempDir(os.TempDir(), "mirror")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(localDir)
+		assert.NoError(t, err)
+	}()
+
+	writeFile := func(name string, data []byte) {
+		f, err := fs.Create(name)
+		require.NoError(t, err)
+		_, err = f.Write(data)
+		require.NoError(t, err)
+		err = f.Close()
+		require.NoError(t, err)
+	}
+	checkFile := func(name string, data []byte) {
+		gotData, err := ioutil.ReadFile(path.Join(localDir, name))
+		require.NoError(t, err)
+		require.Equal(t, data, gotData)
+	}
+
+	t.Log("Initial sync")
+	writeFile("a/b/foo", []byte{1, 2, 3})
+	err = fs.Symlink("b/foo", "a/bar")
+	require.NoError(t, err)
+	err = fs.SyncAll()
+	require.NoError(t, err)
+	m, err := NewMirror(fs, localDir)
+	require.NoError(t, err)
+	defer func() {
+		err := m.Shutdown()
+		require.NoError(t, err)
+	}()
+	err = m.SyncNow()
+	require.NoError(t, err)
+	checkFile("a/b/foo", []byte{1, 2, 3})
+	checkFile("a/bar", []byte{1, 2, 3})
+
+	t.Log("Changes and removals in KBFS show up locally")
+	writeFile("a/b/foo", []byte{4, 5, 6, 7})
+	err = fs.Remove("a/bar")
+	require.NoError(t, err)
+	writeFile("a/baz", []byte{8})
+	err = fs.SyncAll()
+	require.NoError(t, err)
+	err = m.SyncNow()
+	require.NoError(t, err)
+	checkFile("a/b/foo", []byte{4, 5, 6, 7})
+	checkFile("a/baz", []byte{8})
+	_, err = ioutil.Lstat(path.Join(localDir, "a/bar"))
+	require.True(t, ioutil.IsNotExist(err))
+
+	t.Log("Local changes are overwritten")
+	err = ioutil.WriteFile(
+		path.Join(localDir, "a/baz"), []byte{9}, os.FileMode(0600))
+	require.NoError(t, err)
+	err = ioutil.WriteFile(
+		path.Join(localDir, "extra"), []byte{10}, os.FileMode(0600))
+	require.NoError(t, err)
+	err = m.SyncNow()
+	require.NoError(t, err)
+	checkFile("a/baz", []byte{8})
+	_, err = ioutil.Lstat(path.Join(localDir, "extra"))
+	require.True(t, ioutil.IsNotExist(err))
+}
+
+func TestImporter(t *testing.T) {
+	ctx, _, fs := makeFS(t, "")
+	defer libkbfs.CheckConfigAndShutdown(ctx, t, fs.config)
+
+	localDir, err := ioutil.TempDir(os.TempDir(), "importer")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(localDir)
+		assert.NoError(t, err)
+	}()
+
+	writeFile := func(name string, data []byte) {
+		p := path.Join(localDir, name)
+		err := ioutil.MkdirAll(path.Dir(p), 0700)
+		require.NoError(t, err)
+		err = ioutil.WriteFile(p, data, 0600)
+		require.NoError(t, err)
+	}
+	checkFile := func(name string, data []byte) {
+		f, err := fs.Open(name)
+		require.NoError(t, err)
+		defer f.Close()
+		gotData := make([]byte, len(data)+1)
+		n, err := f.Read(gotData)
+		require.NoError(t, err)
+		require.Equal(t, data, gotData[:n])
+	}
+	checkMissing := func(name string) {
+		_, err := fs.Lstat(name)
+		require.True(t, os.IsNotExist(err))
+	}
+
+	t.Log("Initial import")
+	writeFile("a/b/foo", []byte{1, 2, 3})
+	writeFile("a/bar.tmp", []byte{4})
+	err = os.Symlink("b/foo", path.Join(localDir, "a/baz"))
+	require.NoError(t, err)
+	i, err := NewImporter(fs, localDir, []string{"*.tmp"}, time.Hour)
+	require.NoError(t, err)
+	defer i.Shutdown()
+	err = i.ImportNow()
+	require.NoError(t, err)
+	checkFile("a/b/foo", []byte{1, 2, 3})
+	checkFile("a/baz", []byte{1, 2, 3})
+	checkMissing("a/bar.tmp")
+
+	t.Log("Renames, changes and removals show up in KBFS")
+	err = ioutil.Rename(path.Join(localDir, "a"), path.Join(localDir, "c"))
+	require.NoError(t, err)
+	writeFile("c/b/foo", []byte{5, 6, 7, 8})
+	err = ioutil.Remove(path.Join(localDir, "c/baz"))
+	require.NoError(t, err)
+	err = i.ImportNow()
+	require.NoError(t, err)
+	checkMissing("a")
+	checkFile("c/b/foo", []byte{5, 6, 7, 8})
+	checkMissing("c/baz")
+	checkMissing("c/bar.tmp")
+
+	t.Log("Things only in KBFS are left alone")
+	f, err := fs.Create("d")
+	require.NoError(t, err)
+	err = f.Close()
+	require.NoError(t, err)
+	err = i.ImportNow()
+	require.NoError(t, err)
+	_, err = fs.Lstat("d")
+	require.NoError(t, err)
+}
+
+func TestSyncStateFiles(t *testing.T) {
+	ctx, _, fs := makeFS(t, "")
+	defer libkbfs.CheckConfigAndShutdown(ctx, t, fs.config)
+
+	read := func(name string) string {
+		f := SyncStateGet(name, fs.config, fs.root.GetFolderBranch())
+		require.NotNil(t, f)
+		buf, _, err := f(ctx)
+		require.NoError(t, err)
+		return string(buf)
+	}
+
+	require.Nil(t, SyncStateGet("foo", fs.config, fs.root.GetFolderBranch()))
+	require.Equal(t, "", read(SyncStateDirtyFilesName))
+	require.Equal(t, "", read(SyncStateDeferredWritesName))
+	require.Equal(t, "Journal: disabled\n", read(SyncStateJournalName))
+
+	t.Log("Unsynced writes show up as dirty")
+	f, err := fs.Create("a")
+	require.NoError(t, err)
+	_, err = f.Write([]byte{1, 2, 3})
+	require.NoError(t, err)
+	err = f.Close()
+	require.NoError(t, err)
+	require.Contains(t, read(SyncStateDirtyFilesName), "user1/a\n")
+
+	err = fs.SyncAll()
+	require.NoError(t, err)
+	require.Equal(t, "", read(SyncStateDirtyFilesName))
+}
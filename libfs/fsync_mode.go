@@ -0,0 +1,25 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"strings"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/pkg/errors"
+)
+
+// SetFsyncMode parses `s`, which was written to the FsyncModeFileName
+// file, and sets the resulting fsync mode in the given config.
+func SetFsyncMode(config libkbfs.Config, s string) (
+	libkbfs.FsyncMode, error) {
+	var mode libkbfs.FsyncMode
+	_ = mode.Set(s)
+	if mode.String() != strings.ToLower(strings.TrimSpace(s)) {
+		return config.FsyncMode(), errors.Errorf("Unknown fsync mode %q", s)
+	}
+	config.SetFsyncMode(mode)
+	return mode, nil
+}
@@ -0,0 +1,360 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/pkg/errors"
+)
+
+// DefaultImportInterval is how often an Importer scans its local
+// directory, by default.
+const DefaultImportInterval = 10 * time.Second
+
+// Importer keeps the subtree of KBFS rooted at an FS up to date with
+// a plain local directory, so KBFS can serve as a drop-folder backup
+// target without a mounted filesystem.  It's the inverse of Mirror.
+// The local directory is scanned periodically, and all changes found
+// in a scan are written to KBFS as a single batch.  Local renames are
+// detected and turned into KBFS renames, so moved files aren't
+// uploaded again.
+//
+// Only things removed locally while the importer is watching are
+// removed from KBFS; anything else already in KBFS is left alone.
+type Importer struct {
+	fs       *FS
+	localDir string
+	ignore   []string
+	log      logger.Logger
+
+	shutdownCh chan struct{}
+	doneCh     chan struct{}
+
+	lock sync.Mutex
+	// prev is the result of the last successful scan, keyed by
+	// slash-separated path relative to localDir.  It's nil until
+	// the first scan has been imported.
+	prev map[string]os.FileInfo
+}
+
+// NewImporter starts importing `localDir` into the given FS every
+// `interval`.  Entries whose base names match any of the
+// `filepath.Match` patterns in `ignore` are skipped, along with
+// everything beneath them.  The caller must call Shutdown when done.
+func NewImporter(fs *FS, localDir string, ignore []string,
+	interval time.Duration) (*Importer, error) {
+	for _, pattern := range ignore {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, errors.Wrapf(err, "Bad ignore pattern %q", pattern)
+		}
+	}
+	fi, err := ioutil.Stat(localDir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, errors.Errorf("%s is not a directory", localDir)
+	}
+	i := &Importer{
+		fs:         fs,
+		localDir:   localDir,
+		ignore:     ignore,
+		log:        fs.config.MakeLogger(""),
+		shutdownCh: make(chan struct{}),
+		doneCh:     make(chan struct{}),
+	}
+	go i.loop(interval)
+	return i, nil
+}
+
+func (i *Importer) loop(interval time.Duration) {
+	defer close(i.doneCh)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err := i.ImportNow()
+		if err != nil {
+			i.log.CDebugf(i.fs.ctx, "Couldn't import %s to %s: %+v",
+				i.localDir, i.fs.root.GetBasename(), err)
+		}
+		select {
+		case <-ticker.C:
+		case <-i.shutdownCh:
+			return
+		}
+	}
+}
+
+// Shutdown stops importing.  KBFS is left as of the last scan.
+func (i *Importer) Shutdown() {
+	close(i.shutdownCh)
+	<-i.doneCh
+}
+
+func (i *Importer) isIgnored(name string) bool {
+	for _, pattern := range i.ignore {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (i *Importer) scan() (map[string]os.FileInfo, error) {
+	cur := make(map[string]os.FileInfo)
+	err := filepath.Walk(i.localDir,
+		func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if p == i.localDir {
+				return nil
+			}
+			if i.isIgnored(fi.Name()) {
+				if fi.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			rel, err := filepath.Rel(i.localDir, p)
+			if err != nil {
+				return err
+			}
+			cur[filepath.ToSlash(rel)] = fi
+			return nil
+		})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return cur, nil
+}
+
+func isLocalEntryChanged(oldFi, newFi os.FileInfo) bool {
+	return oldFi.Mode() != newFi.Mode() || oldFi.Size() != newFi.Size() ||
+		!TimeEqual(oldFi.ModTime(), newFi.ModTime())
+}
+
+func sortedPaths(m map[string]os.FileInfo) []string {
+	paths := make([]string, 0, len(m))
+	for p := range m {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// ImportNow scans the local directory and writes any changes into
+// KBFS, and returns once they've been synced.
+func (i *Importer) ImportNow() (err error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.log.CDebugf(i.fs.ctx, "Importing from %s", i.localDir)
+	defer func() {
+		i.log.CDebugf(i.fs.ctx, "Importing from %s done: %+v",
+			i.localDir, err)
+	}()
+
+	cur, err := i.scan()
+	if err != nil {
+		return err
+	}
+
+	// Sort everything into what was removed, what was added, and
+	// what's still there but may have changed.
+	removed := make(map[string]os.FileInfo)
+	added := make(map[string]os.FileInfo)
+	for p, oldFi := range i.prev {
+		newFi, ok := cur[p]
+		if !ok || oldFi.Mode()&os.ModeType != newFi.Mode()&os.ModeType {
+			removed[p] = oldFi
+		}
+	}
+	for p, newFi := range cur {
+		oldFi, ok := i.prev[p]
+		if !ok || oldFi.Mode()&os.ModeType != newFi.Mode()&os.ModeType {
+			added[p] = newFi
+		}
+	}
+
+	defer func() {
+		if err != nil {
+			// We don't know how much of the batch made it, so
+			// start over from what's actually in KBFS next time.
+			i.prev = nil
+		}
+	}()
+
+	err = i.applyRenames(removed, added)
+	if err != nil {
+		return err
+	}
+
+	// Remove children before their parents.
+	removedPaths := sortedPaths(removed)
+	for j := len(removedPaths) - 1; j >= 0; j-- {
+		err := i.fs.Remove(removedPaths[j])
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// Create parents before their children.
+	for _, p := range sortedPaths(cur) {
+		newFi := cur[p]
+		if _, ok := added[p]; !ok && !isLocalEntryChanged(i.prev[p], newFi) {
+			continue
+		}
+		err := i.importEntry(p, newFi)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = i.fs.SyncAll()
+	if err != nil {
+		return err
+	}
+	i.prev = cur
+	return nil
+}
+
+// applyRenames finds added entries that are the same local file as a
+// removed entry, and renames them in KBFS instead.  Both entries are
+// dropped from `removed` and `added`, and the children of renamed
+// directories are re-keyed under their new paths.
+func (i *Importer) applyRenames(removed, added map[string]os.FileInfo) error {
+	for _, newPath := range sortedPaths(added) {
+		newFi, ok := added[newPath]
+		if !ok {
+			// Already handled as part of a directory rename.
+			continue
+		}
+		var oldPath string
+		for p, oldFi := range removed {
+			if oldFi.Mode()&os.ModeType == newFi.Mode()&os.ModeType &&
+				os.SameFile(oldFi, newFi) {
+				oldPath = p
+				break
+			}
+		}
+		if oldPath == "" {
+			continue
+		}
+
+		i.log.CDebugf(i.fs.ctx, "Detected rename %s -> %s", oldPath, newPath)
+		err := i.fs.Rename(oldPath, newPath)
+		if err != nil {
+			return err
+		}
+		oldFi := removed[oldPath]
+		delete(removed, oldPath)
+		delete(added, newPath)
+		// Remember the old info so the contents are re-imported if
+		// they changed along with the name.
+		i.prev[newPath] = oldFi
+		if !newFi.IsDir() {
+			continue
+		}
+
+		oldPrefix := oldPath + "/"
+		for p, childFi := range removed {
+			if !strings.HasPrefix(p, oldPrefix) {
+				continue
+			}
+			movedPath := path.Join(newPath, strings.TrimPrefix(p, oldPrefix))
+			delete(removed, p)
+			if _, ok := added[movedPath]; ok {
+				delete(added, movedPath)
+				i.prev[movedPath] = childFi
+			} else {
+				removed[movedPath] = childFi
+			}
+		}
+	}
+	return nil
+}
+
+func (i *Importer) importEntry(p string, fi os.FileInfo) error {
+	localPath := filepath.Join(i.localDir, filepath.FromSlash(p))
+	switch {
+	case fi.IsDir():
+		return i.fs.MkdirAll(p, fi.Mode().Perm())
+	case fi.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(localPath)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if kbfsTarget, err := i.fs.Readlink(p); err == nil {
+			if kbfsTarget == target {
+				return nil
+			}
+			err = i.fs.Remove(p)
+			if err != nil {
+				return err
+			}
+		}
+		return i.fs.Symlink(target, p)
+	case fi.Mode().IsRegular():
+		return i.importFile(p, localPath, fi)
+	default:
+		i.log.CDebugf(i.fs.ctx, "Skipping special file %s", p)
+		return nil
+	}
+}
+
+func (i *Importer) importFile(p, localPath string, fi os.FileInfo) error {
+	kbfsFi, err := i.fs.Lstat(p)
+	switch {
+	case err == nil && kbfsFi.Mode().IsRegular() &&
+		kbfsFi.Size() == fi.Size() &&
+		TimeEqual(kbfsFi.ModTime(), fi.ModTime()):
+		// Already up to date, probably from a previous run.
+		return nil
+	case err == nil && !kbfsFi.Mode().IsRegular():
+		err = i.fs.Remove(p)
+		if err != nil {
+			return err
+		}
+	case err != nil && !os.IsNotExist(err):
+		return err
+	}
+
+	i.log.CDebugf(i.fs.ctx, "Copying %s", p)
+	src, err := os.Open(localPath)
+	if os.IsNotExist(err) {
+		// Removed since the scan; the next scan will notice.
+		return nil
+	} else if err != nil {
+		return errors.WithStack(err)
+	}
+	defer src.Close()
+	dst, err := i.fs.OpenFile(
+		p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = i.fs.Chmod(p, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	return i.fs.Chtimes(p, fi.ModTime(), fi.ModTime())
+}
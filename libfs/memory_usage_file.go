@@ -0,0 +1,22 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// GetEncodedMemoryUsage returns the memory usage of the KBFS caches,
+// encoded as JSON, for the memory usage file.
+func GetEncodedMemoryUsage(config libkbfs.Config) func(
+	context.Context) ([]byte, time.Time, error) {
+	return func(context.Context) ([]byte, time.Time, error) {
+		data, err := PrettyJSON(libkbfs.GetMemoryUsage(config))
+		return data, time.Time{}, err
+	}
+}
@@ -0,0 +1,267 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const mirrorTempPrefix = ".kbfs_mirror_tmp_"
+
+// Mirror keeps a plain local directory in sync with the subtree of
+// KBFS rooted at an FS, for applications that can't read KBFS
+// through a mounted filesystem.  Syncing is strictly one-way: the
+// local directory is made to match KBFS after every batch of changes
+// to the TLF, and any local edits to it are overwritten or removed.
+type Mirror struct {
+	fs       *FS
+	localDir string
+	log      logger.Logger
+	obs      *mirrorObserver
+
+	syncCh     chan struct{}
+	shutdownCh chan struct{}
+	doneCh     chan struct{}
+
+	lock        sync.Mutex
+	lastSyncErr error
+}
+
+// mirrorObserver asks the mirror for a sync after each batch of
+// changes to its folder.
+type mirrorObserver struct {
+	m *Mirror
+}
+
+var _ libkbfs.Observer = (*mirrorObserver)(nil)
+
+func (mo *mirrorObserver) LocalChange(
+	context.Context, libkbfs.Node, libkbfs.WriteRange) {
+	// Wait for the change to show up as part of a batch.
+}
+
+func (mo *mirrorObserver) BatchChanges(
+	context.Context, []libkbfs.NodeChange, []libkbfs.NodeID) {
+	mo.m.requestSync()
+}
+
+func (mo *mirrorObserver) TlfHandleChange(context.Context, *libkbfs.TlfHandle) {
+}
+
+// NewMirror starts mirroring the given FS into `localDir`, which is
+// created if needed.  Anything already in `localDir` that isn't in
+// the FS will be removed.  The caller must call Shutdown when done.
+func NewMirror(fs *FS, localDir string) (*Mirror, error) {
+	err := ioutil.MkdirAll(localDir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	m := &Mirror{
+		fs:         fs,
+		localDir:   localDir,
+		log:        fs.config.MakeLogger(""),
+		syncCh:     make(chan struct{}, 1),
+		shutdownCh: make(chan struct{}),
+		doneCh:     make(chan struct{}),
+	}
+	m.obs = &mirrorObserver{m}
+	err = fs.config.Notifier().RegisterForChanges(
+		[]libkbfs.FolderBranch{fs.root.GetFolderBranch()}, m.obs)
+	if err != nil {
+		return nil, err
+	}
+	// Always start with a full sync.
+	m.requestSync()
+	go m.loop()
+	return m, nil
+}
+
+func (m *Mirror) requestSync() {
+	select {
+	case m.syncCh <- struct{}{}:
+	default:
+		// A sync is already pending, and it'll pick up this change.
+	}
+}
+
+func (m *Mirror) loop() {
+	defer close(m.doneCh)
+	for {
+		select {
+		case <-m.syncCh:
+			err := m.SyncNow()
+			if err != nil {
+				m.log.CDebugf(m.fs.ctx, "Couldn't mirror %s to %s: %+v",
+					m.fs.root.GetBasename(), m.localDir, err)
+			}
+		case <-m.shutdownCh:
+			return
+		}
+	}
+}
+
+// SyncNow brings the local directory up to date with the FS, and
+// returns once it's done.
+func (m *Mirror) SyncNow() (err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.log.CDebugf(m.fs.ctx, "Mirroring to %s", m.localDir)
+	defer func() {
+		m.log.CDebugf(m.fs.ctx, "Mirroring to %s done: %+v", m.localDir, err)
+		m.lastSyncErr = err
+	}()
+	return m.syncDir("", m.localDir)
+}
+
+// LastSyncErr returns the error from the most recent sync, if any.
+func (m *Mirror) LastSyncErr() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.lastSyncErr
+}
+
+// Shutdown stops mirroring.  The local directory is left as is.
+func (m *Mirror) Shutdown() error {
+	err := m.fs.config.Notifier().UnregisterFromChanges(
+		[]libkbfs.FolderBranch{m.fs.root.GetFolderBranch()}, m.obs)
+	close(m.shutdownCh)
+	<-m.doneCh
+	return err
+}
+
+func (m *Mirror) syncDir(kbfsDir, localDir string) error {
+	fis, err := m.fs.ReadDir(kbfsDir)
+	if err != nil {
+		return err
+	}
+	localFis, err := ioutil.ReadDir(localDir)
+	if err != nil {
+		return err
+	}
+	localByName := make(map[string]os.FileInfo, len(localFis))
+	for _, localFi := range localFis {
+		localByName[localFi.Name()] = localFi
+	}
+
+	for _, fi := range fis {
+		kbfsPath := path.Join(kbfsDir, fi.Name())
+		localPath := filepath.Join(localDir, fi.Name())
+		localFi, exists := localByName[fi.Name()]
+		delete(localByName, fi.Name())
+		if exists && localFi.Mode()&os.ModeType != fi.Mode()&os.ModeType {
+			// The type changed, so start over.
+			err := ioutil.RemoveAll(localPath)
+			if err != nil {
+				return err
+			}
+			exists = false
+		}
+
+		switch {
+		case fi.IsDir():
+			if !exists {
+				err := ioutil.Mkdir(localPath, 0700)
+				if err != nil {
+					return err
+				}
+			}
+			err = m.syncDir(kbfsPath, localPath)
+		case fi.Mode()&os.ModeSymlink != 0:
+			err = m.syncSymlink(kbfsPath, localPath, exists)
+		default:
+			if exists && localFi.Size() == fi.Size() &&
+				TimeEqual(localFi.ModTime(), fi.ModTime()) &&
+				localFi.Mode().Perm() == fi.Mode().Perm() {
+				continue
+			}
+			err = m.syncFile(kbfsPath, localDir, localPath, fi)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Anything left over isn't in KBFS anymore.
+	for name := range localByName {
+		err := ioutil.RemoveAll(filepath.Join(localDir, name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Mirror) syncSymlink(kbfsPath, localPath string, exists bool) error {
+	target, err := m.fs.Readlink(kbfsPath)
+	if err != nil {
+		return err
+	}
+	if exists {
+		localTarget, err := os.Readlink(localPath)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if localTarget == target {
+			return nil
+		}
+		err = ioutil.Remove(localPath)
+		if err != nil {
+			return err
+		}
+	}
+	return errors.WithStack(os.Symlink(target, localPath))
+}
+
+// syncFile copies a file out of KBFS into a temporary file, and then
+// renames it into place, so readers never see a partial copy.
+func (m *Mirror) syncFile(
+	kbfsPath, localDir, localPath string, fi os.FileInfo) (err error) {
+	m.log.CDebugf(m.fs.ctx, "Copying %s", kbfsPath)
+	src, err := m.fs.Open(kbfsPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(
+		filepath.Join(localDir, mirrorTempPrefix+fi.Name()),
+		os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmpPath := dst.Name()
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmpPath)
+		}
+	}()
+	_, err = io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	// The umask may have masked out some of the permissions.
+	err = os.Chmod(tmpPath, fi.Mode().Perm())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = os.Chtimes(tmpPath, fi.ModTime(), fi.ModTime())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return ioutil.Rename(tmpPath, localPath)
+}
@@ -0,0 +1,118 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// SyncStateDirName is the name of the KBFS sync state directory --
+// it can be reached anywhere within a top-level folder, and holds
+// plain-text files describing what hasn't been synced yet.
+const SyncStateDirName = ".kbfs_sync"
+
+const (
+	// SyncStateDirtyFilesName lists the files with unsynced writes,
+	// one path per line.
+	SyncStateDirtyFilesName = "dirty_files"
+	// SyncStateDeferredWritesName lists the number of writes
+	// waiting for an in-progress sync to finish, per file.
+	SyncStateDeferredWritesName = "deferred_writes"
+	// SyncStateJournalName summarizes what's waiting in the TLF's
+	// journal to be flushed to the servers.
+	SyncStateJournalName = "journal"
+)
+
+// SyncStateNames returns the names of the files in the sync state
+// directory.
+func SyncStateNames() []string {
+	return []string{
+		SyncStateDirtyFilesName,
+		SyncStateDeferredWritesName,
+		SyncStateJournalName,
+	}
+}
+
+type syncStateFormatter func(buf *bytes.Buffer, status libkbfs.FolderBranchStatus)
+
+func formatSyncStateDirtyFiles(
+	buf *bytes.Buffer, status libkbfs.FolderBranchStatus) {
+	paths := append([]string(nil), status.DirtyPaths...)
+	sort.Strings(paths)
+	for _, p := range paths {
+		fmt.Fprintln(buf, p)
+	}
+}
+
+func formatSyncStateDeferredWrites(
+	buf *bytes.Buffer, status libkbfs.FolderBranchStatus) {
+	paths := make([]string, 0, len(status.DeferredWrites))
+	for p := range status.DeferredWrites {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		fmt.Fprintf(buf, "%d\t%s\n", status.DeferredWrites[p], p)
+	}
+}
+
+func formatSyncStateJournal(
+	buf *bytes.Buffer, status libkbfs.FolderBranchStatus) {
+	j := status.Journal
+	if j == nil {
+		fmt.Fprintln(buf, "Journal: disabled")
+		return
+	}
+	fmt.Fprintln(buf, "Journal: enabled")
+	if j.RevisionStart == 0 {
+		fmt.Fprintln(buf, "Revisions: none")
+	} else {
+		fmt.Fprintf(buf, "Revisions: %d-%d\n", j.RevisionStart, j.RevisionEnd)
+	}
+	fmt.Fprintf(buf, "Block ops: %d\n", j.BlockOpCount)
+	fmt.Fprintf(buf, "Unflushed bytes: %d\n", j.UnflushedBytes)
+	if j.LastFlushErr != "" {
+		fmt.Fprintf(buf, "Last flush error: %s\n", j.LastFlushErr)
+	}
+	paths := append([]string(nil), j.UnflushedPaths...)
+	sort.Strings(paths)
+	for _, p := range paths {
+		fmt.Fprintf(buf, "Unflushed: %s\n", p)
+	}
+}
+
+// SyncStateGet gets the read function for the named file in the
+// sync state directory of the given folder, or nil if there's no
+// such file.
+func SyncStateGet(name string, config libkbfs.Config,
+	folderBranch libkbfs.FolderBranch) func(context.Context) (
+	[]byte, time.Time, error) {
+	var format syncStateFormatter
+	switch name {
+	case SyncStateDirtyFilesName:
+		format = formatSyncStateDirtyFiles
+	case SyncStateDeferredWritesName:
+		format = formatSyncStateDeferredWrites
+	case SyncStateJournalName:
+		format = formatSyncStateJournal
+	default:
+		return nil
+	}
+	return func(ctx context.Context) ([]byte, time.Time, error) {
+		status, _, err := config.KBFSOps().FolderStatus(ctx, folderBranch)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		var buf bytes.Buffer
+		format(&buf, status)
+		return buf.Bytes(), time.Now(), nil
+	}
+}
@@ -364,7 +364,7 @@ func (f *Folder) writePermMode(ctx context.Context,
 func (f *Folder) fillAttrWithUIDAndWritePerm(
 	ctx context.Context, node libkbfs.Node, ei *libkbfs.EntryInfo,
 	a *fuse.Attr) (err error) {
-	a.Valid = 1 * time.Minute
+	a.Valid = f.fs.cacheTTLs.attr()
 
 	a.Size = ei.Size
 	a.Blocks = getNumBlocksFromSize(ei.Size)
@@ -380,6 +380,25 @@ func (f *Folder) fillAttrWithUIDAndWritePerm(
 	return nil
 }
 
+// fillAtime sets the atime of `a` to the one libkbfs tracks for
+// `node`, if it tracks any; until the node is accessed, its atime is
+// its mtime.
+func (f *Folder) fillAtime(
+	ctx context.Context, node libkbfs.Node, a *fuse.Attr) error {
+	if f.fs.config.TimestampMode() != libkbfs.TimestampsPOSIXWithAtime {
+		return nil
+	}
+	md, err := f.fs.config.KBFSOps().GetNodeMetadata(ctx, node)
+	if err != nil {
+		return err
+	}
+	a.Atime = a.Mtime
+	if md.Atime.After(a.Atime) {
+		a.Atime = md.Atime
+	}
+	return nil
+}
+
 func (f *Folder) isWriter(ctx context.Context) (bool, error) {
 	f.handleMu.RLock()
 	defer f.handleMu.RUnlock()
@@ -498,6 +517,9 @@ func (d *Dir) attr(ctx context.Context, a *fuse.Attr) (err error) {
 		ctx, d.node, &de, a); err != nil {
 		return err
 	}
+	if err = d.folder.fillAtime(ctx, d.node, a); err != nil {
+		return err
+	}
 
 	a.Mode |= os.ModeDir | 0500
 	a.Inode = d.inode
@@ -540,6 +562,7 @@ func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.Lo
 		}
 		return nil, err
 	}
+	resp.EntryValid = d.folder.fs.cacheTTLs.entry()
 
 	// No libkbfs calls after this point!
 	d.folder.nodesMu.Lock()
@@ -602,11 +625,16 @@ func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.Cr
 
 	isExec := (req.Mode.Perm() & 0100) != 0
 	excl := getEXCLFromCreateRequest(req)
+	// This can't use `CreateFiles`: the kernel sends one create at a
+	// time and needs its node before sending the next one.  Creates
+	// made this way are batched into fewer revisions by the
+	// background flusher instead.
 	newNode, ei, err := d.folder.fs.config.KBFSOps().CreateFile(
 		ctx, d.node, req.Name, isExec, excl)
 	if err != nil {
 		return nil, nil, err
 	}
+	resp.EntryValid = d.folder.fs.cacheTTLs.entry()
 
 	child := &File{
 		folder: d.folder,
@@ -815,6 +843,58 @@ func (d *Dir) ReadDirAll(ctx context.Context) (res []fuse.Dirent, err error) {
 	return res, nil
 }
 
+// damagedXattr is the extended attribute that describes why a
+// damaged directory can't be read.
+const damagedXattr = "user.kbfs.damaged"
+
+func (d *Dir) damaged(ctx context.Context) (*libkbfs.DamagedSubtree, error) {
+	md, err := d.folder.fs.config.KBFSOps().GetNodeMetadata(ctx, d.node)
+	if err != nil {
+		return nil, err
+	}
+	return md.Damaged, nil
+}
+
+var _ fs.NodeGetxattrer = (*Dir)(nil)
+
+// Getxattr implements the fs.NodeGetxattrer interface for Dir.
+func (d *Dir) Getxattr(ctx context.Context, req *fuse.GetxattrRequest,
+	resp *fuse.GetxattrResponse) (err error) {
+	d.folder.fs.log.CDebugf(ctx, "Dir Getxattr %s", req.Name)
+	defer func() { err = d.folder.processError(ctx, libkbfs.ReadMode, err) }()
+
+	if req.Name != damagedXattr {
+		return fuse.ErrNoXattr
+	}
+	damaged, err := d.damaged(ctx)
+	if err != nil {
+		return err
+	}
+	if damaged == nil {
+		return fuse.ErrNoXattr
+	}
+	resp.Xattr = []byte(damaged.Err)
+	return nil
+}
+
+var _ fs.NodeListxattrer = (*Dir)(nil)
+
+// Listxattr implements the fs.NodeListxattrer interface for Dir.
+func (d *Dir) Listxattr(ctx context.Context, req *fuse.ListxattrRequest,
+	resp *fuse.ListxattrResponse) (err error) {
+	d.folder.fs.log.CDebugf(ctx, "Dir Listxattr")
+	defer func() { err = d.folder.processError(ctx, libkbfs.ReadMode, err) }()
+
+	damaged, err := d.damaged(ctx)
+	if err != nil {
+		return err
+	}
+	if damaged != nil {
+		resp.Append(damagedXattr)
+	}
+	return nil
+}
+
 // Forget kernel reference to this node.
 func (d *Dir) Forget() {
 	d.folder.forgetNode(d.node)
@@ -894,7 +974,8 @@ func (d *Dir) Fsync(ctx context.Context, req *fuse.FsyncRequest) (err error) {
 		return err
 	}
 
-	return d.folder.fs.config.KBFSOps().SyncAll(ctx, d.node.GetFolderBranch())
+	return libkbfs.FsyncAll(
+		ctx, d.folder.fs.config, d.node.GetFolderBranch(), d.folder.fs.log)
 }
 
 // isNoSuchNameError checks for libkbfs.NoSuchNameError.
@@ -66,6 +66,12 @@ func filterError(err error) error {
 		return errorWithErrno{err, syscall.ENAMETOOLONG}
 	case libkbfs.DirTooBigError:
 		return errorWithErrno{err, syscall.EFBIG}
+	case libkbfs.DirTooManyEntriesError:
+		return errorWithErrno{err, syscall.EFBIG}
+	case libkbfs.SymlinkDepthError:
+		return errorWithErrno{err, syscall.ELOOP}
+	case libkbfs.SymlinkLoopError:
+		return errorWithErrno{err, syscall.ELOOP}
 	case libkbfs.NoCurrentSessionError:
 		return errorWithErrno{err, syscall.EACCES}
 	case libkbfs.NoSuchFolderListError:
@@ -76,6 +82,12 @@ func filterError(err error) error {
 		return errorWithErrno{err, syscall.ENOSPC}
 	case libkbfs.RevGarbageCollectedError:
 		return errorWithErrno{err, syscall.ENOENT}
+	case libkbfs.TeamFileTooLargeError:
+		return errorWithErrno{err, syscall.EFBIG}
+	case libkbfs.TeamBannedExtensionError:
+		return errorWithErrno{err, syscall.EACCES}
+	case libkbfs.TeamReadOnlySubtreeError:
+		return errorWithErrno{err, syscall.EACCES}
 	}
 	return err
 }
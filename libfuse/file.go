@@ -70,6 +70,9 @@ func (f *File) fillAttrWithMode(
 		ctx, f.node, ei, a); err != nil {
 		return err
 	}
+	if err = f.folder.fillAtime(ctx, f.node, a); err != nil {
+		return err
+	}
 	a.Mode |= 0400
 	if ei.Type == libkbfs.Exec {
 		a.Mode |= 0100
@@ -113,7 +116,21 @@ func (f *File) attr(ctx context.Context, a *fuse.Attr) (err error) {
 		return err
 	}
 
-	return f.fillAttrWithMode(ctx, &de, a)
+	err = f.fillAttrWithMode(ctx, &de, a)
+	if err != nil {
+		return err
+	}
+
+	// Report only the non-hole bytes as allocated, so that tools
+	// like `du` see sparse files correctly.
+	allocated, err := f.folder.fs.config.KBFSOps().GetAllocatedSize(
+		ctx, f.node)
+	if err != nil {
+		f.folder.fs.log.CDebugf(ctx, "Couldn't get allocated size: %+v", err)
+		return nil
+	}
+	a.Blocks = getNumBlocksFromSize(allocated)
+	return nil
 }
 
 var _ fs.NodeAccesser = (*File)(nil)
@@ -174,7 +191,8 @@ var _ fs.NodeFsyncer = (*File)(nil)
 
 func (f *File) sync(ctx context.Context) error {
 	f.eiCache.destroy()
-	err := f.folder.fs.config.KBFSOps().SyncAll(ctx, f.node.GetFolderBranch())
+	err := libkbfs.FsyncAll(
+		ctx, f.folder.fs.config, f.node.GetFolderBranch(), f.folder.fs.log)
 	if err != nil {
 		return err
 	}
@@ -320,6 +338,59 @@ func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest,
 	return f.attr(ctx, &resp.Attr)
 }
 
+// syncErrorXattr is the extended attribute that holds the most recent
+// error that kept a dirty file from being synced.
+const syncErrorXattr = "user.kbfs.sync_error"
+
+func (f *File) syncError(ctx context.Context) (
+	*libkbfs.FileSyncError, error) {
+	md, err := f.folder.fs.config.KBFSOps().GetNodeMetadata(ctx, f.node)
+	if err != nil {
+		return nil, err
+	}
+	return md.SyncError, nil
+}
+
+var _ fs.NodeGetxattrer = (*File)(nil)
+
+// Getxattr implements the fs.NodeGetxattrer interface for File.
+func (f *File) Getxattr(ctx context.Context, req *fuse.GetxattrRequest,
+	resp *fuse.GetxattrResponse) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "File Getxattr %s", req.Name)
+	defer func() { err = f.folder.processError(ctx, libkbfs.ReadMode, err) }()
+
+	if req.Name != syncErrorXattr {
+		return fuse.ErrNoXattr
+	}
+	syncErr, err := f.syncError(ctx)
+	if err != nil {
+		return err
+	}
+	if syncErr == nil {
+		return fuse.ErrNoXattr
+	}
+	resp.Xattr = []byte(syncErr.Error)
+	return nil
+}
+
+var _ fs.NodeListxattrer = (*File)(nil)
+
+// Listxattr implements the fs.NodeListxattrer interface for File.
+func (f *File) Listxattr(ctx context.Context, req *fuse.ListxattrRequest,
+	resp *fuse.ListxattrResponse) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "File Listxattr")
+	defer func() { err = f.folder.processError(ctx, libkbfs.ReadMode, err) }()
+
+	syncErr, err := f.syncError(ctx)
+	if err != nil {
+		return err
+	}
+	if syncErr != nil {
+		resp.Append(syncErrorXattr)
+	}
+	return nil
+}
+
 var _ fs.NodeForgetter = (*File)(nil)
 
 // Forget kernel reference to this node.
@@ -5,6 +5,7 @@
 package libfuse
 
 import (
+	"encoding/json"
 	"net"
 	"net/http"
 	"net/http/pprof"
@@ -60,6 +61,42 @@ type FS struct {
 
 	inodeLock sync.Mutex
 	nextInode uint64
+
+	// cacheTTLs controls how long the kernel may cache attributes
+	// and entries for this mount.  It's set before the FS is served.
+	cacheTTLs CacheTTLs
+}
+
+// defaultCacheTTL is the kernel cache TTL used when none is specified.
+const defaultCacheTTL = 1 * time.Minute
+
+// CacheTTLs holds the durations for which the kernel may cache the
+// attributes and directory entries returned by a mount.  Longer TTLs
+// speed up stat-heavy workloads at the cost of coherence with changes
+// made by other devices.  A zero value means to use the default TTL,
+// and a negative value disables the corresponding cache.
+type CacheTTLs struct {
+	Attr  time.Duration
+	Entry time.Duration
+}
+
+func resolveCacheTTL(ttl time.Duration) time.Duration {
+	switch {
+	case ttl < 0:
+		return 0
+	case ttl == 0:
+		return defaultCacheTTL
+	default:
+		return ttl
+	}
+}
+
+func (c CacheTTLs) attr() time.Duration {
+	return resolveCacheTTL(c.Attr)
+}
+
+func (c CacheTTLs) entry() time.Duration {
+	return resolveCacheTTL(c.Entry)
 }
 
 func makeTraceHandler(renderFn func(http.ResponseWriter, *http.Request, bool)) func(http.ResponseWriter, *http.Request) {
@@ -74,6 +111,38 @@ func makeTraceHandler(renderFn func(http.ResponseWriter, *http.Request, bool)) f
 	}
 }
 
+// makeBlockLockProfileHandler returns a handler that reports the
+// block lock contention stats as JSON.  The `enable` query parameter
+// turns the profiler on or off, and `reset` clears the stats.
+func makeBlockLockProfileHandler(
+	config libkbfs.Config) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		profiler := config.BlockLockProfiler()
+		if profiler == nil {
+			http.Error(w, "no block lock profiler", http.StatusNotFound)
+			return
+		}
+		if enable := req.FormValue("enable"); enable != "" {
+			enabled, err := strconv.ParseBool(enable)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			profiler.SetEnabled(enabled)
+		}
+		if req.FormValue("reset") != "" {
+			profiler.Reset()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(struct {
+			Enabled bool
+			Ops     map[string]libkbfs.LockProfileEntry
+		}{profiler.Enabled(), profiler.Snapshot()})
+	}
+}
+
 // NewFS creates an FS. Note that this isn't the only constructor; see
 // makeFS in libfuse/mount_test.go.
 func NewFS(config libkbfs.Config, conn *fuse.Conn, debug bool, platformParams PlatformParams) *FS {
@@ -103,6 +172,10 @@ func NewFS(config libkbfs.Config, conn *fuse.Conn, debug bool, platformParams Pl
 	}))
 	serveMux.HandleFunc("/debug/events", makeTraceHandler(trace.RenderEvents))
 
+	// KBFS-specific debugging endpoints.
+	serveMux.HandleFunc("/debug/blocklocks",
+		makeBlockLockProfileHandler(config))
+
 	// Leave Addr blank to be set in enableDebugServer() and
 	// disableDebugServer().
 	debugServer := &http.Server{
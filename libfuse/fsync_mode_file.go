@@ -0,0 +1,53 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// FsyncModeFile represents a write-only file where a write sets when
+// an fsync returns, e.g.
+//
+//   echo server > /keybase/.kbfs_fsync_mode
+type FsyncModeFile struct {
+	fs *FS
+}
+
+var _ fs.Node = (*FsyncModeFile)(nil)
+
+// Attr implements the fs.Node interface for FsyncModeFile.
+func (f *FsyncModeFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Size = 0
+	a.Mode = 0222
+	return nil
+}
+
+var _ fs.Handle = (*FsyncModeFile)(nil)
+
+var _ fs.HandleWriter = (*FsyncModeFile)(nil)
+
+// Write implements the fs.HandleWriter interface for FsyncModeFile.
+func (f *FsyncModeFile) Write(ctx context.Context, req *fuse.WriteRequest,
+	resp *fuse.WriteResponse) (err error) {
+	f.fs.log.CDebugf(ctx, "FsyncModeFile Write")
+	defer func() { err = f.fs.processError(ctx, libkbfs.WriteMode, err) }()
+	if len(req.Data) == 0 {
+		return nil
+	}
+
+	mode, err := libfs.SetFsyncMode(f.fs.config, string(req.Data))
+	if err != nil {
+		return err
+	}
+	f.fs.log.CDebugf(ctx, "Fsync mode is now %s", mode)
+
+	resp.Size = len(req.Data)
+	return nil
+}
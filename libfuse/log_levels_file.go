@@ -0,0 +1,58 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"errors"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// LogLevelsFile represents a write-only file where a write sets the
+// log levels of the given modules, e.g.
+//
+//   echo blockops=debug,cr=warning > /keybase/.kbfs_log_levels
+type LogLevelsFile struct {
+	fs *FS
+}
+
+var _ fs.Node = (*LogLevelsFile)(nil)
+
+// Attr implements the fs.Node interface for LogLevelsFile.
+func (f *LogLevelsFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Size = 0
+	a.Mode = 0222
+	return nil
+}
+
+var _ fs.Handle = (*LogLevelsFile)(nil)
+
+var _ fs.HandleWriter = (*LogLevelsFile)(nil)
+
+// Write implements the fs.HandleWriter interface for LogLevelsFile.
+func (f *LogLevelsFile) Write(ctx context.Context, req *fuse.WriteRequest,
+	resp *fuse.WriteResponse) (err error) {
+	f.fs.log.CDebugf(ctx, "LogLevelsFile Write")
+	defer func() { err = f.fs.processError(ctx, libkbfs.WriteMode, err) }()
+	if len(req.Data) == 0 {
+		return nil
+	}
+
+	config, ok := f.fs.config.(*libkbfs.ConfigLocal)
+	if !ok {
+		return errors.New("Log levels can't be set for this config")
+	}
+	levels := config.LogLevels()
+	if err := levels.Set(string(req.Data)); err != nil {
+		return err
+	}
+	f.fs.log.CDebugf(ctx, "Log levels are now %s", levels)
+
+	resp.Size = len(req.Data)
+	return nil
+}
@@ -3111,6 +3111,52 @@ func TestStatusFile(t *testing.T) {
 	}
 }
 
+func TestSyncStateDir(t *testing.T) {
+	ctx := libkbfs.BackgroundContextWithCancellationDelayer()
+	defer libkbfs.CleanupCancellationDelayer(ctx)
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(ctx, t, config)
+	mnt, _, cancelFn := makeFS(t, ctx, config)
+	defer mnt.Close()
+	defer cancelFn()
+
+	syncDir := path.Join(mnt.Dir, PrivateName, "jdoe", libfs.SyncStateDirName)
+	fis, err := ioutil.ReadDir(syncDir)
+	if err != nil {
+		t.Fatalf("Couldn't read the sync state dir: %v", err)
+	}
+	if len(fis) != len(libfs.SyncStateNames()) {
+		t.Fatalf("Unexpected sync state files: %v", fis)
+	}
+
+	// Leave a write unsynced by keeping the file open.
+	f, err := os.Create(path.Join(mnt.Dir, PrivateName, "jdoe", "myfile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syncAndClose(t, f)
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := ioutil.ReadFile(
+		path.Join(syncDir, libfs.SyncStateDirtyFilesName))
+	if err != nil {
+		t.Fatalf("Couldn't read the dirty files: %v", err)
+	}
+	if !strings.Contains(string(buf), "myfile") {
+		t.Fatalf("Dirty files (%s) didn't include the written file", buf)
+	}
+
+	buf, err = ioutil.ReadFile(path.Join(syncDir, libfs.SyncStateJournalName))
+	if err != nil {
+		t.Fatalf("Couldn't read the journal state: %v", err)
+	}
+	if string(buf) != "Journal: disabled\n" {
+		t.Fatalf("Unexpected journal state: %s", buf)
+	}
+}
+
 // TODO: remove once we have automatic conflict resolution tests
 func TestUnstageFile(t *testing.T) {
 	ctx := libkbfs.BackgroundContextWithCancellationDelayer()
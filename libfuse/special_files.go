@@ -21,6 +21,10 @@ func handleCommonSpecialFile(
 		return NewErrorFile(fs, entryValid)
 	case libfs.MetricsFileName:
 		return NewMetricsFile(fs, entryValid)
+	case libfs.MemoryUsageFileName:
+		return NewMemoryUsageFile(fs, entryValid)
+	case libfs.BlockTrafficFileName:
+		return NewBlockTrafficFile(fs, entryValid)
 	case libfs.ProfileListDirName:
 		return ProfileList{}
 	case libfs.ResetCachesFileName:
@@ -65,6 +69,12 @@ func handleNonTLFSpecialFile(
 	case libfs.DisableDebugServerFileName:
 		return &DebugServerFile{fs: fs, enable: false}
 
+	case libfs.LogLevelsFileName:
+		return &LogLevelsFile{fs: fs}
+
+	case libfs.FsyncModeFileName:
+		return &FsyncModeFile{fs: fs}
+
 	case libfs.EditHistoryName:
 		return NewUserEditHistoryFile(&Folder{fs: fs}, entryValid)
 	}
@@ -87,6 +97,9 @@ func handleTLFSpecialFile(
 	case libfs.UpdateHistoryFileName:
 		return NewUpdateHistoryFile(folder, entryValid)
 
+	case libfs.SyncStateDirName:
+		return SyncStateDir{folder: folder}
+
 	case libfs.EditHistoryName:
 		return NewTlfEditHistoryFile(folder, entryValid)
 
@@ -30,6 +30,7 @@ type StartOptions struct {
 	MountErrorIsFatal bool
 	SkipMount         bool
 	MountPoint        string
+	CacheTTLs         CacheTTLs
 }
 
 func startMounting(ctx context.Context,
@@ -49,6 +50,7 @@ func startMounting(ctx context.Context,
 
 	log.CDebugf(ctx, "Creating filesystem")
 	fs := NewFS(config, mounter.c, options.KbfsParams.Debug, options.PlatformParams)
+	fs.cacheTTLs = options.CacheTTLs
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	ctx = context.WithValue(ctx, libfs.CtxAppIDKey, fs)
@@ -0,0 +1,66 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"os"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libfs"
+	"golang.org/x/net/context"
+)
+
+// SyncStateDir is a node listing read-only files that describe the
+// sync state of a TLF.
+type SyncStateDir struct {
+	folder *Folder
+}
+
+var _ fs.Node = SyncStateDir{}
+
+// Attr implements the fs.Node interface.
+func (SyncStateDir) Attr(_ context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0555
+	return nil
+}
+
+var _ fs.NodeRequestLookuper = SyncStateDir{}
+
+// Lookup implements the fs.NodeRequestLookuper interface.
+func (ssd SyncStateDir) Lookup(_ context.Context, req *fuse.LookupRequest,
+	resp *fuse.LookupResponse) (node fs.Node, err error) {
+	f := libfs.SyncStateGet(
+		req.Name, ssd.folder.fs.config, ssd.folder.getFolderBranch())
+	if f == nil {
+		return nil, fuse.ENOENT
+	}
+	resp.EntryValid = 0
+	return &SpecialReadFile{read: f}, nil
+}
+
+var _ fs.Handle = SyncStateDir{}
+
+var _ fs.HandleReadDirAller = SyncStateDir{}
+
+// ReadDirAll implements the ReadDirAll interface.
+func (SyncStateDir) ReadDirAll(_ context.Context) (
+	res []fuse.Dirent, err error) {
+	for _, name := range libfs.SyncStateNames() {
+		res = append(res, fuse.Dirent{
+			Type: fuse.DT_File,
+			Name: name,
+		})
+	}
+	return res, nil
+}
+
+var _ fs.NodeRemover = SyncStateDir{}
+
+// Remove implements the fs.NodeRemover interface for SyncStateDir.
+func (SyncStateDir) Remove(_ context.Context, req *fuse.RemoveRequest) (
+	err error) {
+	return fuse.EPERM
+}
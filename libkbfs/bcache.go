@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	lru "github.com/hashicorp/golang-lru"
 	"github.com/keybase/kbfs/kbfsblock"
@@ -18,7 +19,31 @@ import (
 
 type blockContainer struct {
 	block          Block
+	tlfID          tlf.ID
 	prefetchStatus PrefetchStatus
+	// expires is when the entry stops being served from the cache,
+	// or the zero time if it only leaves the cache on eviction.
+	expires time.Time
+}
+
+// BlockCacheLifetimePolicy controls how long transient entries for a
+// TLF may stay in a BlockCacheStandard.  A zero TTL means entries stay
+// until they are evicted to make room for others, which is the
+// default.
+type BlockCacheLifetimePolicy struct {
+	// DirBlockTTL limits how long a transient directory block is
+	// served from the cache after it is put.
+	DirBlockTTL time.Duration
+	// FileBlockTTL limits how long a transient file block is served
+	// from the cache after it is put.
+	FileBlockTTL time.Duration
+}
+
+func (p BlockCacheLifetimePolicy) ttl(block Block) time.Duration {
+	if _, isDir := block.(*DirBlock); isDir {
+		return p.DirBlockTTL
+	}
+	return p.FileBlockTTL
 }
 
 type idCacheKey struct {
@@ -38,10 +63,18 @@ type BlockCacheStandard struct {
 	cleanTransient *lru.Cache
 
 	cleanLock      sync.RWMutex
-	cleanPermanent map[kbfsblock.ID]Block
+	cleanPermanent map[kbfsblock.ID]blockContainer
 
 	bytesLock       sync.Mutex
 	cleanTotalBytes uint64
+
+	// clock is used to expire transient entries; if nil, the wall
+	// clock is used.
+	clock Clock
+
+	policyLock    sync.RWMutex
+	defaultPolicy BlockCacheLifetimePolicy
+	policiesByTlf map[tlf.ID]BlockCacheLifetimePolicy
 }
 
 // NewBlockCacheStandard constructs a new BlockCacheStandard instance
@@ -54,7 +87,8 @@ func NewBlockCacheStandard(transientCapacity int,
 	cleanBytesCapacity uint64) *BlockCacheStandard {
 	b := &BlockCacheStandard{
 		cleanBytesCapacity: cleanBytesCapacity,
-		cleanPermanent:     make(map[kbfsblock.ID]Block),
+		cleanPermanent:     make(map[kbfsblock.ID]blockContainer),
+		policiesByTlf:      make(map[tlf.ID]BlockCacheLifetimePolicy),
 	}
 
 	if transientCapacity > 0 {
@@ -82,14 +116,17 @@ func (b *BlockCacheStandard) GetWithPrefetch(ptr BlockPointer) (
 			if !ok {
 				return nil, NoPrefetch, NoCacheEntry, BadDataError{ptr.ID}
 			}
-			return bc.block, bc.prefetchStatus, TransientEntry, nil
+			if bc.expires.IsZero() || b.now().Before(bc.expires) {
+				return bc.block, bc.prefetchStatus, TransientEntry, nil
+			}
+			b.cleanTransient.Remove(ptr.ID)
 		}
 	}
 
 	block := func() Block {
 		b.cleanLock.RLock()
 		defer b.cleanLock.RUnlock()
-		return b.cleanPermanent[ptr.ID]
+		return b.cleanPermanent[ptr.ID].block
 	}()
 	if block != nil {
 		// A permanent entry can only be created if this client is performing a
@@ -102,6 +139,67 @@ func (b *BlockCacheStandard) GetWithPrefetch(ptr BlockPointer) (
 	return nil, NoPrefetch, NoCacheEntry, NoSuchBlockError{ptr.ID}
 }
 
+func (b *BlockCacheStandard) now() time.Time {
+	if b.clock == nil {
+		return time.Now()
+	}
+	return b.clock.Now()
+}
+
+// SetDefaultLifetimePolicy sets the lifetime policy for transient
+// entries of TLFs without a policy of their own.  It only affects
+// blocks put after the call.
+func (b *BlockCacheStandard) SetDefaultLifetimePolicy(
+	policy BlockCacheLifetimePolicy) {
+	b.policyLock.Lock()
+	defer b.policyLock.Unlock()
+	b.defaultPolicy = policy
+}
+
+// SetLifetimePolicy sets the lifetime policy for transient entries
+// of the given TLF, overriding the default.  It only affects blocks
+// put after the call.
+func (b *BlockCacheStandard) SetLifetimePolicy(
+	tlfID tlf.ID, policy BlockCacheLifetimePolicy) {
+	b.policyLock.Lock()
+	defer b.policyLock.Unlock()
+	b.policiesByTlf[tlfID] = policy
+}
+
+// ClearLifetimePolicy makes the given TLF use the default lifetime
+// policy again.
+func (b *BlockCacheStandard) ClearLifetimePolicy(tlfID tlf.ID) {
+	b.policyLock.Lock()
+	defer b.policyLock.Unlock()
+	delete(b.policiesByTlf, tlfID)
+}
+
+// LifetimePolicy returns the lifetime policy in effect for the given
+// TLF.
+func (b *BlockCacheStandard) LifetimePolicy(
+	tlfID tlf.ID) BlockCacheLifetimePolicy {
+	b.policyLock.RLock()
+	defer b.policyLock.RUnlock()
+	if policy, ok := b.policiesByTlf[tlfID]; ok {
+		return policy
+	}
+	return b.defaultPolicy
+}
+
+// copyLifetimePolicies makes this cache use the same lifetime
+// policies as `other`.
+func (b *BlockCacheStandard) copyLifetimePolicies(
+	other *BlockCacheStandard) {
+	other.policyLock.RLock()
+	defer other.policyLock.RUnlock()
+	b.policyLock.Lock()
+	defer b.policyLock.Unlock()
+	b.defaultPolicy = other.defaultPolicy
+	for tlfID, policy := range other.policiesByTlf {
+		b.policiesByTlf[tlfID] = policy
+	}
+}
+
 // Get implements the BlockCache interface for BlockCacheStandard.
 func (b *BlockCacheStandard) Get(ptr BlockPointer) (Block, error) {
 	block, _, _, err := b.GetWithPrefetch(ptr)
@@ -297,7 +395,10 @@ func (b *BlockCacheStandard) PutWithPrefetch(
 			b.cleanLock.Lock()
 			defer b.cleanLock.Unlock()
 			_, wasInCache = b.cleanPermanent[ptr.ID]
-			b.cleanPermanent[ptr.ID] = block
+			b.cleanPermanent[ptr.ID] = blockContainer{
+				block: block,
+				tlfID: tlf,
+			}
 		}()
 
 	default:
@@ -319,7 +420,12 @@ func (b *BlockCacheStandard) PutWithPrefetch(
 		if !transientCacheHasRoom {
 			return cachePutCacheFullError{ptr.ID}
 		}
-		b.cleanTransient.Add(ptr.ID, blockContainer{block, prefetchStatus})
+		var expires time.Time
+		if ttl := b.LifetimePolicy(tlf).ttl(block); ttl > 0 {
+			expires = b.now().Add(ttl)
+		}
+		b.cleanTransient.Add(
+			ptr.ID, blockContainer{block, tlf, prefetchStatus, expires})
 	}
 
 	return nil
@@ -338,10 +444,10 @@ func (b *BlockCacheStandard) Put(
 func (b *BlockCacheStandard) DeletePermanent(id kbfsblock.ID) error {
 	b.cleanLock.Lock()
 	defer b.cleanLock.Unlock()
-	block, ok := b.cleanPermanent[id]
+	bc, ok := b.cleanPermanent[id]
 	if ok {
 		delete(b.cleanPermanent, id)
-		b.subtractBlockBytes(block)
+		b.subtractBlockBytes(bc.block)
 	}
 	return nil
 }
@@ -390,3 +496,27 @@ func (b *BlockCacheStandard) DeleteKnownPtr(tlf tlf.ID, block *FileBlock) error
 	b.ids.Remove(key)
 	return nil
 }
+
+// memoryUsage returns the estimated memory held by the clean blocks
+// in this cache.
+func (b *BlockCacheStandard) memoryUsage() MemoryUsage {
+	var usage MemoryUsage
+	if b.cleanTransient != nil {
+		for _, key := range b.cleanTransient.Keys() {
+			tmp, ok := b.cleanTransient.Peek(key)
+			if !ok {
+				continue
+			}
+			if bc, ok := tmp.(blockContainer); ok {
+				usage.add(bc.tlfID, int64(getCachedBlockSize(bc.block)))
+			}
+		}
+	}
+
+	b.cleanLock.RLock()
+	defer b.cleanLock.RUnlock()
+	for _, bc := range b.cleanPermanent {
+		usage.add(bc.tlfID, int64(getCachedBlockSize(bc.block)))
+	}
+	return usage
+}
@@ -6,6 +6,7 @@ package libkbfs
 
 import (
 	"testing"
+	"time"
 
 	"github.com/keybase/kbfs/kbfsblock"
 	"github.com/keybase/kbfs/kbfshash"
@@ -378,3 +379,46 @@ func TestBlockCacheDoublePut(t *testing.T) {
 	testBcachePutWithBlock(t, id2, cache, TransientEntry, block)
 	require.Equal(t, bytes, cache.cleanTotalBytes)
 }
+
+func TestBlockCacheLifetimePolicy(t *testing.T) {
+	ctx := context.Background()
+	config := blockCacheTestInit(t, 100, 1<<30)
+	defer CheckConfigAndShutdown(ctx, t, config)
+	cache := config.BlockCache().(*BlockCacheStandard)
+	clock := newTestClockNow()
+	cache.clock = clock
+	tlfID := tlf.FakeID(1, tlf.Private)
+	archiveID := tlf.FakeID(2, tlf.Private)
+
+	cache.SetDefaultLifetimePolicy(BlockCacheLifetimePolicy{
+		DirBlockTTL:  time.Minute,
+		FileBlockTTL: time.Hour,
+	})
+	cache.SetLifetimePolicy(archiveID, BlockCacheLifetimePolicy{})
+
+	dirPtr := BlockPointer{ID: kbfsblock.FakeID(1)}
+	filePtr := BlockPointer{ID: kbfsblock.FakeID(2)}
+	archivePtr := BlockPointer{ID: kbfsblock.FakeID(3)}
+	err := cache.Put(dirPtr, tlfID, NewDirBlock(), TransientEntry)
+	require.NoError(t, err)
+	err = cache.Put(filePtr, tlfID, NewFileBlock(), TransientEntry)
+	require.NoError(t, err)
+	err = cache.Put(archivePtr, archiveID, NewDirBlock(), TransientEntry)
+	require.NoError(t, err)
+
+	t.Log("Directory blocks expire first")
+	clock.Add(2 * time.Minute)
+	testExpectedMissing(t, dirPtr.ID, cache)
+	_, err = cache.Get(filePtr)
+	require.NoError(t, err)
+
+	t.Log("Then file blocks, but not the archive's blocks")
+	clock.Add(time.Hour)
+	testExpectedMissing(t, filePtr.ID, cache)
+	_, err = cache.Get(archivePtr)
+	require.NoError(t, err)
+
+	t.Log("Clearing the archive's policy applies the default again")
+	cache.ClearLifetimePolicy(archiveID)
+	require.Equal(t, time.Minute, cache.LifetimePolicy(archiveID).DirBlockTTL)
+}
@@ -262,6 +262,24 @@ func (s *blockDiskStore) hasContext(id kbfsblock.ID, context kbfsblock.Context)
 	return info.Refs.checkExists(context)
 }
 
+// hasLiveContexts returns whether the data for the given ID is
+// stored, with live references matching all the given contexts.
+func (s *blockDiskStore) hasLiveContexts(
+	id kbfsblock.ID, contexts []kbfsblock.Context) (bool, error) {
+	info, err := s.getInfo(id)
+	if err != nil {
+		return false, err
+	}
+
+	for _, context := range contexts {
+		if !info.Refs.hasLiveContext(context) {
+			return false, nil
+		}
+	}
+
+	return s.hasData(id)
+}
+
 func (s *blockDiskStore) hasData(id kbfsblock.ID) (bool, error) {
 	_, err := ioutil.Stat(s.dataPath(id))
 	if ioutil.IsNotExist(err) {
@@ -156,6 +156,47 @@ func TestBlockDiskStoreArchiveNonExistentReference(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestBlockDiskStoreHasLiveContexts(t *testing.T) {
+	tempdir, s := setupBlockDiskStoreTest(t)
+	defer teardownBlockDiskStoreTest(t, tempdir)
+
+	// Put the block, and add a reference.
+	data := []byte{1, 2, 3, 4}
+	bID, bCtx, _ := putBlockDisk(t, s, data)
+	bCtx2 := addBlockDiskRef(t, s, bID)
+
+	ok, err := s.hasLiveContexts(bID, []kbfsblock.Context{bCtx, bCtx2})
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// A different creator doesn't match.
+	uid2 := keybase1.MakeTestUID(2)
+	otherCtx := kbfsblock.MakeFirstContext(
+		uid2.AsUserOrTeam(), keybase1.BlockType_DATA)
+	ok, err = s.hasLiveContexts(bID, []kbfsblock.Context{otherCtx})
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// Archived references don't count.
+	err = s.archiveReferences(kbfsblock.ContextMap{bID: {bCtx2}}, "")
+	require.NoError(t, err)
+	ok, err = s.hasLiveContexts(bID, []kbfsblock.Context{bCtx})
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = s.hasLiveContexts(bID, []kbfsblock.Context{bCtx2})
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// Neither does a reference to a block without data.
+	data2 := []byte{5, 6, 7, 8}
+	bID2, err := kbfsblock.MakePermanentID(data2)
+	require.NoError(t, err)
+	bCtx3 := addBlockDiskRef(t, s, bID2)
+	ok, err = s.hasLiveContexts(bID2, []kbfsblock.Context{bCtx3})
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
 func TestBlockDiskStoreRemoveReferences(t *testing.T) {
 	tempdir, s := setupBlockDiskStoreTest(t)
 	defer teardownBlockDiskStoreTest(t, tempdir)
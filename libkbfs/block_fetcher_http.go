@@ -0,0 +1,157 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// blockHTTPResponse is the body of a successful fetch from a
+// BlockFetcherHTTP endpoint.
+type blockHTTPResponse struct {
+	Buf        []byte
+	ServerHalf []byte
+}
+
+// decodeBlockHTTPResponse reads a blockHTTPResponse from `r`, and
+// checks that it holds the block with the given ID.
+func decodeBlockHTTPResponse(codec kbfscodec.Codec, r io.Reader,
+	id kbfsblock.ID) ([]byte, kbfscrypto.BlockCryptKeyServerHalf, error) {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
+	}
+	var res blockHTTPResponse
+	err = codec.Decode(body, &res)
+	if err != nil {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
+	}
+	// Don't trust the sender with the contents; the server half is
+	// checked when the block is decrypted.
+	err = kbfsblock.VerifyID(res.Buf, id)
+	if err != nil {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
+	}
+	var serverHalf kbfscrypto.BlockCryptKeyServerHalf
+	err = serverHalf.UnmarshalBinary(res.ServerHalf)
+	if err != nil {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
+	}
+	return res.Buf, serverHalf, nil
+}
+
+const (
+	// blockFetcherHTTPTimeout is how long a BlockFetcherHTTP
+	// endpoint gets to answer before falling back to the block
+	// server.
+	blockFetcherHTTPTimeout = 5 * time.Second
+	// How long to stop asking an endpoint after it fails to answer.
+	blockFetcherHTTPBackoff = 1 * time.Minute
+)
+
+// errBlockFetcherNotFound is returned when a BlockFetcherHTTP
+// endpoint doesn't have a requested block.
+var errBlockFetcherNotFound = errors.New("Block not found by fetcher")
+
+// errBlockFetcherDown is returned while a BlockFetcherHTTP endpoint
+// is being skipped after a failure.
+var errBlockFetcherDown = errors.New("Block fetcher is down")
+
+// BlockFetcherHTTP is a BlockFetcher that reads blocks from an HTTP
+// endpoint, such as a CDN in front of a cache of public TLF blocks.
+// A block is requested as <baseURL>/<tlfID>/<blockID>, and the
+// endpoint should answer with an encoded blockHTTPResponse, or a 404
+// if it doesn't have the block.
+//
+// After the endpoint fails to answer, it is skipped for a while, so
+// that reads don't keep waiting on it.
+type BlockFetcherHTTP struct {
+	codec   kbfscodec.Codec
+	clock   Clock
+	baseURL string
+	client  *http.Client
+
+	lock      sync.Mutex
+	downUntil time.Time
+}
+
+var _ BlockFetcher = (*BlockFetcherHTTP)(nil)
+
+// NewBlockFetcherHTTP creates a new BlockFetcherHTTP for the given
+// base URL.
+func NewBlockFetcherHTTP(codec kbfscodec.Codec, clock Clock,
+	baseURL string) *BlockFetcherHTTP {
+	return &BlockFetcherHTTP{
+		codec:   codec,
+		clock:   clock,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Timeout: blockFetcherHTTPTimeout},
+	}
+}
+
+func (f *BlockFetcherHTTP) isDown() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.clock.Now().Before(f.downUntil)
+}
+
+func (f *BlockFetcherHTTP) markDown() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.downUntil = f.clock.Now().Add(blockFetcherHTTPBackoff)
+}
+
+// Get implements the BlockFetcher interface for BlockFetcherHTTP.
+func (f *BlockFetcherHTTP) Get(ctx context.Context, tlfID tlf.ID,
+	id kbfsblock.ID, _ kbfsblock.Context) (
+	buf []byte, serverHalf kbfscrypto.BlockCryptKeyServerHalf, err error) {
+	if f.isDown() {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, errBlockFetcherDown
+	}
+	defer func() {
+		switch {
+		case err == nil:
+		case errors.Cause(err) == errBlockFetcherNotFound:
+		case ctx.Err() != nil:
+			// Don't blame the endpoint for our own cancellation.
+		default:
+			f.markDown()
+		}
+	}()
+
+	url := fmt.Sprintf("%s/%s/%s", f.baseURL, tlfID, id)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
+	}
+	resp, err := f.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{},
+			errBlockFetcherNotFound
+	default:
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, errors.Errorf(
+			"Unexpected status for block %s: %s", id, resp.Status)
+	}
+	return decodeBlockHTTPResponse(f.codec, resp.Body, id)
+}
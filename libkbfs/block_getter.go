@@ -9,6 +9,7 @@ import (
 
 	"github.com/keybase/kbfs/kbfsblock"
 	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/tlf"
 	"golang.org/x/net/context"
 )
 
@@ -22,10 +23,51 @@ type blockGetter interface {
 // realBlockGetter obtains real blocks using the APIs available in Config.
 type realBlockGetter struct {
 	config blockOpsConfig
+	log    traceLogger
+}
+
+// getPublicBlock tries to get a public block from the configured
+// alternate fetcher, returning false if there isn't one or if it
+// can't supply the block.  Blocks still in the local journal never
+// come from the fetcher, since it can't have them yet.
+func (bg *realBlockGetter) getPublicBlock(ctx context.Context,
+	kmd KeyMetadata, blockPtr BlockPointer, block Block) bool {
+	fetcher := bg.config.PublicBlockFetcher()
+	if fetcher == nil || kmd.TlfID().Type() != tlf.Public {
+		return false
+	}
+	unflushed, err := bg.config.BlockServer().IsUnflushed(
+		ctx, kmd.TlfID(), blockPtr.ID)
+	if err != nil || unflushed {
+		return false
+	}
+
+	// Decode into a separate block, so a bad response can't leave
+	// `block` half-filled for the block server fallback.
+	fetched := block.NewEmpty()
+	buf, blockServerHalf, err := fetcher.Get(
+		ctx, kmd.TlfID(), blockPtr.ID, blockPtr.Context)
+	if err == nil {
+		err = assembleBlock(
+			ctx, bg.config.keyGetter(), bg.config.Codec(),
+			bg.config.cryptoPure(), kmd, blockPtr, fetched, buf,
+			blockServerHalf)
+	}
+	if err != nil {
+		bg.log.CDebugf(ctx, "Couldn't get public block %v from the "+
+			"alternate fetcher: %+v", blockPtr, err)
+		return false
+	}
+	block.Set(fetched)
+	return true
 }
 
 // getBlock implements the interface for realBlockGetter.
 func (bg *realBlockGetter) getBlock(ctx context.Context, kmd KeyMetadata, blockPtr BlockPointer, block Block) error {
+	if bg.getPublicBlock(ctx, kmd, blockPtr, block) {
+		return nil
+	}
+
 	bserv := bg.config.BlockServer()
 	buf, blockServerHalf, err := bserv.Get(
 		ctx, kmd.TlfID(), blockPtr.ID, blockPtr.Context)
@@ -81,6 +81,10 @@ type blockJournal struct {
 	s *blockDiskStore
 
 	aggregateInfo blockAggregateInfo
+
+	// crashRepair describes how the main journal was repaired when
+	// it was opened, if at all.
+	crashRepair diskJournalRepair
 }
 
 type blockOpType int
@@ -131,6 +135,11 @@ type blockJournalEntry struct {
 	// It can be removed as soon as we are sure there are no more
 	// journal entries in the wild with this set.
 	Unignorable bool `codec:",omitempty"`
+	// OnServer is set for an addRefOp whose reference was already
+	// added directly on the server, to a block flushed earlier.
+	// Flushing it then does nothing, unless it's ignored, in which
+	// case the reference is removed from the server again.
+	OnServer bool `codec:",omitempty"`
 
 	codec.UnknownFieldSetHandler
 }
@@ -173,10 +182,12 @@ func deferredGCBlockJournalDir(dir string) string {
 }
 
 // makeBlockJournal returns a new blockJournal for the given
-// directory. Any existing journal entries are read.
+// directory. Any existing journal entries are read. If `repair` is
+// true, the journal is checked for writes torn by a crash, which
+// requires reading every entry.
 func makeBlockJournal(
 	ctx context.Context, codec kbfscodec.Codec, dir string,
-	log logger.Logger) (*blockJournal, error) {
+	log logger.Logger, repair bool) (*blockJournal, error) {
 	journalPath := blockJournalDir(dir)
 	deferLog := log.CloneWithAddedDepth(1)
 	j, err := makeDiskJournal(
@@ -205,15 +216,123 @@ func makeBlockJournal(
 	}
 
 	// Get initial aggregate info.
-	err = kbfscodec.DeserializeFromFile(
-		codec, aggregateInfoPath(dir), &journal.aggregateInfo)
-	if !ioutil.IsNotExist(err) && err != nil {
+	aggregateInfoTorn := false
+	buf, err := ioutil.ReadFile(aggregateInfoPath(dir))
+	if ioutil.IsNotExist(err) {
+		// Continue with an empty aggregate info.
+	} else if err != nil {
 		return nil, err
+	} else if err := codec.Decode(buf, &journal.aggregateInfo); err != nil {
+		log.CWarningf(ctx, "Torn block aggregate info: %+v", err)
+		journal.aggregateInfo = blockAggregateInfo{}
+		aggregateInfoTorn = true
+	}
+
+	if repair || aggregateInfoTorn {
+		err = journal.repairAfterCrash(ctx, aggregateInfoTorn)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return journal, nil
 }
 
+// repairAfterCrash makes the journals consistent after a crash may
+// have interrupted a write to them (see diskJournal.repair).  A
+// leading put whose block is no longer unflushed in the store was
+// already flushed, and is removed if EARLIEST has to be rebuilt;
+// other leading entries are kept, since flushing them again is
+// harmless.  Puts of blocks whose data is missing are treated as
+// torn.  If anything was repaired, the unflushed byte count is
+// recomputed from the remaining entries.
+func (j *blockJournal) repairAfterCrash(
+	ctx context.Context, aggregateInfoTorn bool) error {
+	flushed := func(o journalOrdinal, entry interface{}) (bool, error) {
+		e := entry.(blockJournalEntry)
+		if e.Op != blockPutOp || e.Ignore {
+			return false, nil
+		}
+		id, _, err := e.getSingleContext()
+		if err != nil {
+			return false, nil
+		}
+		unflushed, err := j.s.isUnflushed(id)
+		if err != nil {
+			j.log.CDebugf(ctx, "Couldn't tell if %s was flushed: %+v",
+				id, err)
+			return false, nil
+		}
+		return !unflushed, nil
+	}
+	r, err := j.j.repair(flushed, func(o journalOrdinal, entry interface{}) (
+		bool, error) {
+		e := entry.(blockJournalEntry)
+		if e.Op != blockPutOp || e.Ignore {
+			return true, nil
+		}
+		id, _, err := e.getSingleContext()
+		if err != nil {
+			return false, nil
+		}
+		return j.s.hasData(id)
+	})
+	if err != nil {
+		return err
+	}
+	j.crashRepair = r
+
+	gcR, err := j.deferredGC.repair(nil, nil)
+	if err != nil {
+		return err
+	}
+
+	if r.repaired() || gcR.repaired() {
+		j.log.CWarningf(ctx, "Repaired block journal after a crash: "+
+			"rebuilt ordinals=%t, dropped %d entries starting at %s; "+
+			"deferred GC journal: rebuilt ordinals=%t, dropped %d entries",
+			r.rebuiltOrdinals, r.dropped, r.firstDropped,
+			gcR.rebuiltOrdinals, gcR.dropped)
+	}
+	if !r.repaired() && !aggregateInfoTorn {
+		return nil
+	}
+
+	// Count the data of each unflushed put once.
+	unflushed := make(map[kbfsblock.ID]int64)
+	if !j.j.empty() {
+		for o := j.j.earliest; o <= j.j.latest; o++ {
+			e, err := j.readJournalEntry(o)
+			if err != nil {
+				return err
+			}
+			if e.Op != blockPutOp || e.Ignore {
+				continue
+			}
+			id, _, err := e.getSingleContext()
+			if err != nil {
+				return err
+			}
+			size, err := j.s.getDataSize(id)
+			if err != nil {
+				return err
+			}
+			unflushed[id] = size
+		}
+	}
+	var unflushedBytes int64
+	for _, size := range unflushed {
+		unflushedBytes += size
+	}
+	if aggregateInfoTorn {
+		// Without the old counts, assume that the only stored
+		// blocks are the unflushed ones.
+		j.aggregateInfo.StoredBytes = unflushedBytes
+		j.aggregateInfo.StoredFiles = int64(len(unflushed)) * filesPerBlockMax
+	}
+	return j.changeCounts(0, 0, unflushedBytes-j.aggregateInfo.UnflushedBytes)
+}
+
 func (j *blockJournal) blockJournalFiles() []string {
 	return []string{
 		blockJournalDir(j.dir), deferredGCBlockJournalDir(j.dir),
@@ -350,6 +469,11 @@ func (j *blockJournal) hasData(id kbfsblock.ID) (bool, error) {
 	return j.s.hasData(id)
 }
 
+func (j *blockJournal) hasLiveContexts(
+	id kbfsblock.ID, contexts []kbfsblock.Context) (bool, error) {
+	return j.s.hasLiveContexts(id, contexts)
+}
+
 func (j *blockJournal) isUnflushed(id kbfsblock.ID) (bool, error) {
 	return j.s.isUnflushed(id)
 }
@@ -485,6 +609,31 @@ func (j *blockJournal) addReference(
 	return nil
 }
 
+// addFlushedReference records a reference that was already added on
+// the server, to a block flushed earlier.  The block store isn't
+// touched: the block's data may be garbage-collected concurrently,
+// and the reference is only needed on the server anyway.
+func (j *blockJournal) addFlushedReference(
+	ctx context.Context, id kbfsblock.ID, context kbfsblock.Context) (
+	err error) {
+	j.log.CDebugf(ctx, "Adding flushed reference for block %s "+
+		"with context %v", id, context)
+	defer func() {
+		if err != nil {
+			j.deferLog.CDebugf(ctx,
+				"Adding flushed reference for block %s with context %v "+
+					"failed with %+v", id, context, err)
+		}
+	}()
+
+	_, err = j.appendJournalEntry(ctx, blockJournalEntry{
+		Op:       addRefOp,
+		Contexts: kbfsblock.ContextMap{id: {context}},
+		OnServer: true,
+	})
+	return err
+}
+
 func (j *blockJournal) archiveReferences(
 	ctx context.Context, contexts kbfsblock.ContextMap) (err error) {
 	j.log.CDebugf(ctx, "Archiving references for %v", contexts)
@@ -706,6 +855,11 @@ func (j *blockJournal) getNextEntriesToFlush(
 				ReadyBlockData{data, serverHalf}, nil)
 
 		case addRefOp:
+			if entry.OnServer {
+				entries.other = append(entries.other, entry)
+				break
+			}
+
 			id, bctx, err := entry.getSingleContext()
 			if err != nil {
 				return blockEntriesToFlush{}, 0,
@@ -764,6 +918,20 @@ func flushNonBPSBlockJournalEntry(
 		}
 		// Otherwise nothing to do.
 
+	case addRefOp:
+		if !entry.Ignore && !entry.OnServer {
+			return errors.New("Trying to flush unignored addRef as other")
+		}
+		// A reference that's already on the server has to be taken
+		// back if the revision that used it was dropped.
+		if entry.Ignore && entry.OnServer {
+			_, err := bserver.RemoveBlockReferences(
+				ctx, tlfID, entry.Contexts)
+			if err != nil {
+				return err
+			}
+		}
+
 	case mdRevMarkerOp:
 		// Nothing to do.
 
@@ -863,8 +1031,13 @@ func (j *blockJournal) removeFlushedEntry(ctx context.Context,
 	// a subsequent block op (i.e., that has earliestOrdinal as a
 	// tag). Has no effect for removeRefsOp (since those are
 	// already removed) or mdRevMarkerOp (which has no
-	// references).
-	for id, idContexts := range entry.Contexts {
+	// references).  References that were only ever on the server
+	// aren't in the block store at all.
+	contexts := entry.Contexts
+	if entry.OnServer {
+		contexts = nil
+	}
+	for id, idContexts := range contexts {
 		liveCount, err := j.s.removeReferences(
 			id, idContexts, earliestOrdinal.String())
 		if err != nil {
@@ -1238,6 +1411,26 @@ func (j *blockJournal) getAllRefsForTest() (map[kbfsblock.ID]blockRefMap, error)
 	return refs, nil
 }
 
+// latestMDRevMarker returns the revision of the latest MD revision
+// marker that isn't ignored, or kbfsmd.RevisionUninitialized if there
+// is none.
+func (j *blockJournal) latestMDRevMarker() (kbfsmd.Revision, error) {
+	if j.j.empty() {
+		return kbfsmd.RevisionUninitialized, nil
+	}
+	for i := j.j.latest; i >= j.j.earliest && i <= j.j.latest; i-- {
+		e, err := j.readJournalEntry(i)
+		if err != nil {
+			return kbfsmd.RevisionUninitialized, err
+		}
+		if e.Ignore || e.Op != mdRevMarkerOp {
+			continue
+		}
+		return e.Revision, nil
+	}
+	return kbfsmd.RevisionUninitialized, nil
+}
+
 func (j *blockJournal) markLatestRevMarkerAsLocalSquash() error {
 	first, err := j.j.readEarliestOrdinal()
 	if ioutil.IsNotExist(err) {
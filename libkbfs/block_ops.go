@@ -16,12 +16,16 @@ type blockOpsConfig interface {
 	logMaker
 	blockCacher
 	blockServerGetter
+	publicBlockFetcherGetter
 	codecGetter
 	cryptoPureGetter
 	keyGetterGetter
 	diskBlockCacheGetter
 	syncedTlfGetterSetter
 	initModeGetter
+	idleTrackerGetter
+	powerMonitorGetter
+	prefetchBudgetGetter
 }
 
 // BlockOpsStandard implements the BlockOps interface by relaying
@@ -37,7 +41,10 @@ var _ BlockOps = (*BlockOpsStandard)(nil)
 // NewBlockOpsStandard creates a new BlockOpsStandard
 func NewBlockOpsStandard(config blockOpsConfig,
 	queueSize, prefetchQueueSize int) *BlockOpsStandard {
-	bg := &realBlockGetter{config: config}
+	bg := &realBlockGetter{
+		config: config,
+		log:    traceLogger{config.MakeLogger("BOPS")},
+	}
 	qConfig := &realBlockRetrievalConfig{
 		blockRetrievalPartialConfig: config,
 		bg: bg,
@@ -45,7 +52,7 @@ func NewBlockOpsStandard(config blockOpsConfig,
 	q := newBlockRetrievalQueue(queueSize, prefetchQueueSize, qConfig)
 	bops := &BlockOpsStandard{
 		config: config,
-		log:    traceLogger{config.MakeLogger("")},
+		log:    traceLogger{config.MakeLogger("BOPS")},
 		queue:  q,
 	}
 	return bops
@@ -54,6 +61,12 @@ func NewBlockOpsStandard(config blockOpsConfig,
 // Get implements the BlockOps interface for BlockOpsStandard.
 func (b *BlockOpsStandard) Get(ctx context.Context, kmd KeyMetadata,
 	blockPtr BlockPointer, block Block, lifetime BlockCacheLifetime) error {
+	ctx = CtxWithLogFields(ctx, LogFields{
+		TlfID:    kmd.TlfID(),
+		Op:       "BlockGet",
+		BlockPtr: blockPtr,
+	})
+
 	// Check the journal explicitly first, so we don't get stuck in
 	// the block-fetching queue.
 	if journalBServer, ok := b.config.BlockServer().(journalBlockServer); ok {
@@ -208,6 +221,20 @@ func (b *BlockOpsStandard) BlockRetriever() BlockRetriever {
 	return b.queue
 }
 
+// SetMaxFetchesPerTlf limits how many blocks can be fetched from the
+// network at once for any single TLF, independent of the total number
+// of block retrieval workers.  This keeps one TLF's deep prefetch from
+// tying up all the workers.  A limit of 0 means no limit.
+func (b *BlockOpsStandard) SetMaxFetchesPerTlf(max int) {
+	b.queue.setMaxFetchesPerTlf(max)
+}
+
+// RetrievalStatus returns the status of the block retrieval queue,
+// including how many requests were coalesced.
+func (b *BlockOpsStandard) RetrievalStatus() BlockRetrievalStatus {
+	return b.queue.Status()
+}
+
 // Shutdown implements the BlockOps interface for BlockOpsStandard.
 func (b *BlockOpsStandard) Shutdown() {
 	b.queue.Shutdown()
@@ -6,6 +6,8 @@ package libkbfs
 
 import (
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"sync"
 	"testing"
 
@@ -82,11 +84,15 @@ type testBlockOpsConfig struct {
 	testCodecGetter
 	logMaker
 	bserver BlockServer
+	fetcher BlockFetcher
 	cp      cryptoPure
 	cache   BlockCache
 	diskBlockCacheGetter
 	*testSyncedTlfGetterSetter
 	initModeGetter
+	idleTrackerGetter
+	powerMonitorGetter
+	prefetchBudgetGetter
 }
 
 var _ blockOpsConfig = (*testBlockOpsConfig)(nil)
@@ -95,6 +101,10 @@ func (config testBlockOpsConfig) BlockServer() BlockServer {
 	return config.bserver
 }
 
+func (config testBlockOpsConfig) PublicBlockFetcher() BlockFetcher {
+	return config.fetcher
+}
+
 func (config testBlockOpsConfig) cryptoPure() cryptoPure {
 	return config.cp
 }
@@ -119,8 +129,9 @@ func makeTestBlockOpsConfig(t *testing.T) testBlockOpsConfig {
 	cache := NewBlockCacheStandard(10, getDefaultCleanBlockCacheCapacity())
 	dbcg := newTestDiskBlockCacheGetter(t, nil)
 	stgs := newTestSyncedTlfGetterSetter()
-	return testBlockOpsConfig{codecGetter, lm, bserver, crypto, cache, dbcg,
-		stgs, testInitModeGetter{InitDefault}}
+	return testBlockOpsConfig{codecGetter, lm, bserver, nil, crypto, cache,
+		dbcg, stgs, testInitModeGetter{InitDefault}, testIdleTrackerGetter{},
+		testPowerMonitorGetter{}, testPrefetchBudgetGetter{}}
 }
 
 // TestBlockOpsReadySuccess checks that BlockOpsStandard.Ready()
@@ -340,6 +351,166 @@ func TestBlockOpsGetSuccess(t *testing.T) {
 	require.Equal(t, block, decryptedBlock)
 }
 
+// TestBlockOpsGetPublicFetcher checks that BlockOpsStandard.Get()
+// reads public blocks from the configured fetcher first, and falls
+// back to the block server.
+func TestBlockOpsGetPublicFetcher(t *testing.T) {
+	config := makeTestBlockOpsConfig(t)
+	cdnBlocks := make(map[string]blockHTTPResponse)
+	var cdnLock sync.Mutex
+	cdnRequests := make(map[string]int)
+	cdnBroken := false
+	cdn := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			cdnLock.Lock()
+			defer cdnLock.Unlock()
+			cdnRequests[r.URL.Path]++
+			if cdnBroken {
+				http.Error(w, "broken", http.StatusInternalServerError)
+				return
+			}
+			res, ok := cdnBlocks[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			body, err := config.Codec().Encode(res)
+			require.NoError(t, err)
+			_, _ = w.Write(body)
+		}))
+	defer cdn.Close()
+	clock := newTestClockNow()
+	config.fetcher = NewBlockFetcherHTTP(config.Codec(), clock, cdn.URL+"/")
+	bserver := &blockServerUnflushed{
+		BlockServer: config.bserver,
+		unflushed:   make(map[kbfsblock.ID]bool),
+	}
+	config.bserver = bserver
+	bops := NewBlockOpsStandard(config, testBlockRetrievalWorkerQueueSize,
+		testPrefetchWorkerQueueSize)
+	defer bops.Shutdown()
+
+	ctx := context.Background()
+	bCtx := kbfsblock.MakeFirstContext(
+		keybase1.MakeTestUID(1).AsUserOrTeam(), keybase1.BlockType_DATA)
+	var keyGen kbfsmd.KeyGen = 3
+	readyOnCDN := func(tlfID tlf.ID, block *FileBlock) BlockPointer {
+		kmd := makeFakeKeyMetadata(tlfID, keyGen)
+		id, _, readyBlockData, err := bops.Ready(ctx, kmd, block)
+		require.NoError(t, err)
+		cdnLock.Lock()
+		defer cdnLock.Unlock()
+		cdnBlocks[fmt.Sprintf("/%s/%s", tlfID, id)] = blockHTTPResponse{
+			Buf:        readyBlockData.buf,
+			ServerHalf: readyBlockData.serverHalf.Bytes(),
+		}
+		return BlockPointer{ID: id, DataVer: FirstValidDataVer,
+			KeyGen: keyGen, Context: bCtx}
+	}
+
+	t.Log("A public block only on the CDN")
+	publicID := tlf.FakeID(1, tlf.Public)
+	publicKmd := makeFakeKeyMetadata(publicID, keyGen)
+	block := &FileBlock{Contents: []byte{1, 2, 3, 4, 5}}
+	ptr := readyOnCDN(publicID, block)
+	decryptedBlock := &FileBlock{}
+	err := bops.Get(ctx, publicKmd, ptr, decryptedBlock, NoCacheEntry)
+	require.NoError(t, err)
+	require.Equal(t, block, decryptedBlock)
+
+	t.Log("A public block only on the block server")
+	block2 := &FileBlock{Contents: []byte{6, 7, 8, 9}}
+	id2, _, readyBlockData2, err := bops.Ready(ctx, publicKmd, block2)
+	require.NoError(t, err)
+	err = config.bserver.Put(ctx, publicID, id2, bCtx,
+		readyBlockData2.buf, readyBlockData2.serverHalf)
+	require.NoError(t, err)
+	decryptedBlock = &FileBlock{}
+	err = bops.Get(ctx, publicKmd,
+		BlockPointer{ID: id2, DataVer: FirstValidDataVer,
+			KeyGen: keyGen, Context: bCtx},
+		decryptedBlock, NoCacheEntry)
+	require.NoError(t, err)
+	require.Equal(t, block2, decryptedBlock)
+
+	t.Log("Private blocks never come from the CDN")
+	privateID := tlf.FakeID(2, tlf.Private)
+	block3 := &FileBlock{Contents: []byte{10, 11, 12}}
+	ptr = readyOnCDN(privateID, block3)
+	decryptedBlock = &FileBlock{}
+	err = bops.Get(ctx, makeFakeKeyMetadata(privateID, keyGen), ptr,
+		decryptedBlock, NoCacheEntry)
+	require.IsType(t, kbfsblock.ServerErrorBlockNonExistent{}, err)
+
+	getCDNRequests := func(ptr BlockPointer) int {
+		cdnLock.Lock()
+		defer cdnLock.Unlock()
+		return cdnRequests[fmt.Sprintf("/%s/%s", publicID, ptr.ID)]
+	}
+	readyOnBoth := func(block *FileBlock) BlockPointer {
+		id, _, readyBlockData, err := bops.Ready(ctx, publicKmd, block)
+		require.NoError(t, err)
+		err = bserver.Put(ctx, publicID, id, bCtx,
+			readyBlockData.buf, readyBlockData.serverHalf)
+		require.NoError(t, err)
+		cdnLock.Lock()
+		defer cdnLock.Unlock()
+		cdnBlocks[fmt.Sprintf("/%s/%s", publicID, id)] = blockHTTPResponse{
+			Buf:        readyBlockData.buf,
+			ServerHalf: readyBlockData.serverHalf.Bytes(),
+		}
+		return BlockPointer{ID: id, DataVer: FirstValidDataVer,
+			KeyGen: keyGen, Context: bCtx}
+	}
+	getCountingCDN := func(ptr BlockPointer, block *FileBlock) int {
+		decryptedBlock := &FileBlock{}
+		err := bops.Get(ctx, publicKmd, ptr, decryptedBlock, NoCacheEntry)
+		require.NoError(t, err)
+		require.Equal(t, block, decryptedBlock)
+		return getCDNRequests(ptr)
+	}
+
+	t.Log("Unflushed public blocks never come from the CDN")
+	block4 := &FileBlock{Contents: []byte{13, 14, 15}}
+	ptr = readyOnBoth(block4)
+	bserver.setUnflushed(ptr.ID)
+	require.Equal(t, 0, getCountingCDN(ptr, block4))
+
+	t.Log("A failing CDN is skipped until the backoff passes")
+	cdnLock.Lock()
+	cdnBroken = true
+	cdnLock.Unlock()
+	for i, expected := range []int{1, 0} {
+		block := &FileBlock{Contents: []byte{16, byte(i)}}
+		require.Equal(t, expected, getCountingCDN(readyOnBoth(block), block))
+	}
+	clock.Add(blockFetcherHTTPBackoff)
+	block5 := &FileBlock{Contents: []byte{17}}
+	require.Equal(t, 1, getCountingCDN(readyOnBoth(block5), block5))
+}
+
+// blockServerUnflushed reports the given blocks as still being
+// queued in a journal.
+type blockServerUnflushed struct {
+	BlockServer
+
+	lock      sync.Mutex
+	unflushed map[kbfsblock.ID]bool
+}
+
+func (b *blockServerUnflushed) setUnflushed(id kbfsblock.ID) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.unflushed[id] = true
+}
+
+func (b *blockServerUnflushed) IsUnflushed(
+	ctx context.Context, tlfID tlf.ID, id kbfsblock.ID) (bool, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.unflushed[id], nil
+}
+
 // TestBlockOpsReadySuccess checks that BlockOpsStandard.Get() fails
 // if it can't retrieve the block from the server.
 func TestBlockOpsGetFailServerGet(t *testing.T) {
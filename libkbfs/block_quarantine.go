@@ -0,0 +1,133 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfshash"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/pkg/errors"
+)
+
+// blockQuarantineThreshold is the number of consecutive
+// decryption/verification failures after which a block is
+// quarantined.
+const blockQuarantineThreshold = 3
+
+// QuarantinedBlock describes a block that has repeatedly failed
+// decryption or verification.  It is suitable for encoding directly
+// as JSON.
+type QuarantinedBlock struct {
+	ID       string
+	Path     string          `json:",omitempty"`
+	Revision kbfsmd.Revision `json:",omitempty"`
+	Failures int
+	LastErr  string
+	Time     time.Time
+}
+
+// isQuarantinableBlockError returns true if the given error, returned
+// while fetching a block, means that the block's contents couldn't
+// be decrypted or verified, as opposed to a transient failure to get
+// the block at all.
+func isQuarantinableBlockError(err error) bool {
+	switch errors.Cause(err).(type) {
+	case libkb.DecryptionError, kbfshash.HashMismatchError,
+		BlockDecodeError:
+		return true
+	default:
+		return false
+	}
+}
+
+// blockQuarantine tracks, for a single TLF, the blocks that have
+// failed decryption or verification.  Once a block has failed
+// blockQuarantineThreshold times in a row, it is quarantined, and
+// further fetches of it fail with a QuarantinedBlockError without
+// going to the network.  The zero value is ready to use, and it is
+// goroutine-safe.
+type blockQuarantine struct {
+	lock        sync.Mutex
+	failures    map[kbfsblock.ID]int
+	quarantined map[kbfsblock.ID]QuarantinedBlock
+}
+
+// check returns a QuarantinedBlockError if `id` is quarantined.
+func (bq *blockQuarantine) check(id kbfsblock.ID) error {
+	bq.lock.Lock()
+	defer bq.lock.Unlock()
+	qb, ok := bq.quarantined[id]
+	if !ok {
+		return nil
+	}
+	return QuarantinedBlockError{id, qb.Path, qb.Revision, qb.LastErr}
+}
+
+// recordFailure counts a failed fetch of `id`, and quarantines it if
+// it has failed too many times.  It returns true if the block was
+// newly quarantined.
+func (bq *blockQuarantine) recordFailure(
+	id kbfsblock.ID, p path, rev kbfsmd.Revision, err error) bool {
+	bq.lock.Lock()
+	defer bq.lock.Unlock()
+	if _, ok := bq.quarantined[id]; ok {
+		return false
+	}
+	if bq.failures == nil {
+		bq.failures = make(map[kbfsblock.ID]int)
+	}
+	bq.failures[id]++
+	failures := bq.failures[id]
+	if failures < blockQuarantineThreshold {
+		return false
+	}
+	delete(bq.failures, id)
+
+	if bq.quarantined == nil {
+		bq.quarantined = make(map[kbfsblock.ID]QuarantinedBlock)
+	}
+	qb := QuarantinedBlock{
+		ID:       id.String(),
+		Revision: rev,
+		Failures: failures,
+		LastErr:  err.Error(),
+		Time:     time.Now(),
+	}
+	if p.isValid() {
+		qb.Path = p.String()
+	}
+	bq.quarantined[id] = qb
+	return true
+}
+
+// recordSuccess resets the failure count for `id`.
+func (bq *blockQuarantine) recordSuccess(id kbfsblock.ID) {
+	bq.lock.Lock()
+	defer bq.lock.Unlock()
+	delete(bq.failures, id)
+}
+
+// list returns all the quarantined blocks, ordered by the time they
+// were quarantined.
+func (bq *blockQuarantine) list() []QuarantinedBlock {
+	bq.lock.Lock()
+	defer bq.lock.Unlock()
+	if len(bq.quarantined) == 0 {
+		return nil
+	}
+	ret := make([]QuarantinedBlock, 0, len(bq.quarantined))
+	for _, qb := range bq.quarantined {
+		ret = append(ret, qb)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Time.Before(ret[j].Time)
+	})
+	return ret
+}
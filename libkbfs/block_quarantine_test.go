@@ -0,0 +1,52 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockQuarantine(t *testing.T) {
+	var bq blockQuarantine
+	id := kbfsblock.FakeID(1)
+	otherID := kbfsblock.FakeID(2)
+	err := errors.WithStack(libkb.DecryptionError{})
+	require.True(t, isQuarantinableBlockError(err))
+	require.False(t, isQuarantinableBlockError(
+		errors.WithStack(NoSuchBlockError{id})))
+	require.False(t, isQuarantinableBlockError(nil))
+
+	t.Log("A success resets the failure count")
+	for i := 0; i < blockQuarantineThreshold-1; i++ {
+		require.False(t, bq.recordFailure(id, path{}, 10, err))
+	}
+	bq.recordSuccess(id)
+	for i := 0; i < blockQuarantineThreshold-1; i++ {
+		require.False(t, bq.recordFailure(id, path{}, 10, err))
+	}
+	require.NoError(t, bq.check(id))
+	require.Nil(t, bq.list())
+
+	t.Log("Too many failures in a row quarantine the block")
+	require.True(t, bq.recordFailure(id, path{}, 10, err))
+	require.False(t, bq.recordFailure(id, path{}, 11, err))
+	err = bq.check(id)
+	qErr, ok := err.(QuarantinedBlockError)
+	require.True(t, ok)
+	require.Equal(t, id, qErr.ID)
+	require.Equal(t, kbfsmd.Revision(10), qErr.Revision)
+	require.NoError(t, bq.check(otherID))
+
+	qbs := bq.list()
+	require.Len(t, qbs, 1)
+	require.Equal(t, id.String(), qbs[0].ID)
+	require.Equal(t, blockQuarantineThreshold, qbs[0].Failures)
+}
@@ -0,0 +1,153 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/pkg/errors"
+)
+
+const (
+	// altRefsCapacity is the maximum number of block IDs for which
+	// known references are remembered.
+	altRefsCapacity = 10000
+	// maxAltRefsPerBlock is the maximum number of references
+	// remembered for any one block ID.
+	maxAltRefsPerBlock = 5
+)
+
+// isReadRepairableError returns true if the given error, returned
+// while fetching a block, might be specific to the reference used to
+// fetch it, so that the same block could still be fetched through a
+// different reference.
+func isReadRepairableError(err error) bool {
+	switch errors.Cause(err).(type) {
+	case kbfsblock.ServerErrorBlockNonExistent,
+		kbfsblock.ServerErrorBlockDeleted,
+		kbfsblock.ServerErrorNonceNonExistent:
+		return true
+	default:
+		return false
+	}
+}
+
+// readRepair describes a file block pointer that could only be read
+// through an alternate reference to the same block ID.
+type readRepair struct {
+	file path
+	ptr  BlockPointer
+}
+
+// blockReadRepairer remembers the different references under which
+// file blocks of a TLF are known (e.g., when the same contents were
+// deduplicated into multiple files), so that a block can still be
+// read if its own reference is broken.  It also tracks the pointers
+// that were read that way, so they can be rewritten as fresh
+// references on the next sync.  It is goroutine-safe.
+type blockReadRepairer struct {
+	lock sync.Mutex
+	// altRefs maps a kbfsblock.ID to a []BlockPointer of known
+	// references to it.
+	altRefs *lru.Cache
+	repairs map[BlockRef]readRepair
+}
+
+func newBlockReadRepairer() *blockReadRepairer {
+	altRefs, err := lru.New(altRefsCapacity)
+	if err != nil {
+		panic(err.Error())
+	}
+	return &blockReadRepairer{altRefs: altRefs}
+}
+
+func (brr *blockReadRepairer) addRef(ptr BlockPointer) {
+	brr.lock.Lock()
+	defer brr.lock.Unlock()
+	var refs []BlockPointer
+	if tmp, ok := brr.altRefs.Peek(ptr.ID); ok {
+		refs = tmp.([]BlockPointer)
+		for _, ref := range refs {
+			if ref == ptr {
+				return
+			}
+		}
+	}
+	refs = append(refs, ptr)
+	if len(refs) > maxAltRefsPerBlock {
+		refs = refs[len(refs)-maxAltRefsPerBlock:]
+	}
+	brr.altRefs.Add(ptr.ID, refs)
+}
+
+// indexChildRefs records the references to direct file blocks found
+// in the given block, which is either a directory block or an
+// indirect file block.  Only direct file blocks can be deduplicated,
+// so no other references could have alternates.
+func (brr *blockReadRepairer) indexChildRefs(block Block) {
+	switch b := block.(type) {
+	case *DirBlock:
+		for _, de := range b.Children {
+			if (de.Type == File || de.Type == Exec) &&
+				de.BlockPointer.DirectType != IndirectBlock {
+				brr.addRef(de.BlockPointer)
+			}
+		}
+	case *FileBlock:
+		if !b.IsInd {
+			return
+		}
+		for _, iptr := range b.IPtrs {
+			if iptr.DirectType != IndirectBlock {
+				brr.addRef(iptr.BlockPointer)
+			}
+		}
+	}
+}
+
+// alternates returns the other known references to the block ID of
+// `ptr`.
+func (brr *blockReadRepairer) alternates(ptr BlockPointer) []BlockPointer {
+	brr.lock.Lock()
+	defer brr.lock.Unlock()
+	tmp, ok := brr.altRefs.Get(ptr.ID)
+	if !ok {
+		return nil
+	}
+	var alts []BlockPointer
+	for _, ref := range tmp.([]BlockPointer) {
+		if ref.Ref() != ptr.Ref() {
+			alts = append(alts, ref)
+		}
+	}
+	return alts
+}
+
+// addRepair records that `ptr`, in `file`, needs to be rewritten.
+func (brr *blockReadRepairer) addRepair(file path, ptr BlockPointer) {
+	brr.lock.Lock()
+	defer brr.lock.Unlock()
+	if brr.repairs == nil {
+		brr.repairs = make(map[BlockRef]readRepair)
+	}
+	brr.repairs[ptr.Ref()] = readRepair{file, ptr}
+}
+
+// takeRepairs returns and clears all the recorded repairs.
+func (brr *blockReadRepairer) takeRepairs() []readRepair {
+	brr.lock.Lock()
+	defer brr.lock.Unlock()
+	if len(brr.repairs) == 0 {
+		return nil
+	}
+	repairs := make([]readRepair, 0, len(brr.repairs))
+	for _, r := range brr.repairs {
+		repairs = append(repairs, r)
+	}
+	brr.repairs = nil
+	return repairs
+}
@@ -0,0 +1,63 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockReadRepairerAlternates(t *testing.T) {
+	brr := newBlockReadRepairer()
+	require.True(t, isReadRepairableError(
+		errors.WithStack(kbfsblock.ServerErrorNonceNonExistent{})))
+	require.False(t, isReadRepairableError(
+		errors.WithStack(kbfsblock.ServerErrorUnauthorized{})))
+
+	uid := keybase1.MakeTestUID(1).AsUserOrTeam()
+	ptr := BlockPointer{
+		ID:         kbfsblock.FakeID(1),
+		DirectType: DirectBlock,
+		Context:    kbfsblock.MakeFirstContext(uid, keybase1.BlockType_DATA),
+	}
+	dup := ptr
+	dup.RefNonce = kbfsblock.RefNonce{1}
+	indPtr := BlockPointer{
+		ID:         kbfsblock.FakeID(2),
+		DirectType: IndirectBlock,
+		Context:    kbfsblock.MakeFirstContext(uid, keybase1.BlockType_DATA),
+	}
+
+	t.Log("Index a directory and an indirect file referencing the block")
+	dblock := NewDirBlock().(*DirBlock)
+	dblock.Children["a"] = DirEntry{
+		BlockInfo: BlockInfo{BlockPointer: ptr},
+		EntryInfo: EntryInfo{Type: File},
+	}
+	brr.indexChildRefs(dblock)
+	fblock := NewFileBlock().(*FileBlock)
+	fblock.IsInd = true
+	fblock.IPtrs = []IndirectFilePtr{
+		{BlockInfo: BlockInfo{BlockPointer: dup}},
+		{BlockInfo: BlockInfo{BlockPointer: indPtr}},
+	}
+	brr.indexChildRefs(fblock)
+
+	require.Equal(t, []BlockPointer{dup}, brr.alternates(ptr))
+	require.Equal(t, []BlockPointer{ptr}, brr.alternates(dup))
+	require.Nil(t, brr.alternates(indPtr))
+
+	t.Log("Repairs are handed out only once")
+	brr.addRepair(path{}, ptr)
+	brr.addRepair(path{}, ptr)
+	repairs := brr.takeRepairs()
+	require.Len(t, repairs, 1)
+	require.Equal(t, ptr, repairs[0].ptr)
+	require.Nil(t, brr.takeRepairs())
+}
@@ -72,6 +72,14 @@ func (refs blockRefMap) checkExists(context kbfsblock.Context) (bool, error) {
 	return true, nil
 }
 
+// hasLiveContext returns whether there's a live reference with
+// exactly the given context.
+func (refs blockRefMap) hasLiveContext(context kbfsblock.Context) bool {
+	refEntry, ok := refs[context.GetRefNonce()]
+	return ok && refEntry.Status == liveBlockRef &&
+		refEntry.checkContext(context) == nil
+}
+
 func (refs blockRefMap) getStatuses() map[kbfsblock.RefNonce]blockRefStatus {
 	statuses := make(map[kbfsblock.RefNonce]blockRefStatus)
 	for ref, refEntry := range refs {
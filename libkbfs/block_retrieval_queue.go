@@ -9,6 +9,7 @@ import (
 	"io"
 	"reflect"
 	"sync"
+	"sync/atomic"
 
 	"github.com/keybase/client/go/logger"
 	"github.com/keybase/kbfs/tlf"
@@ -36,6 +37,9 @@ type blockRetrievalPartialConfig interface {
 	diskBlockCacheGetter
 	syncedTlfGetterSetter
 	initModeGetter
+	idleTrackerGetter
+	powerMonitorGetter
+	prefetchBudgetGetter
 }
 
 type blockRetrievalConfig interface {
@@ -71,7 +75,7 @@ type blockRetrieval struct {
 	// cancel function for the context
 	cancelFunc context.CancelFunc
 
-	// protects requests, cacheLifetime, and the prefetch channels
+	// protects requests, cacheLifetime, tier, and the prefetch channels
 	reqMtx sync.RWMutex
 	// the individual requests for this block pointer: they must be notified
 	// once the block is returned
@@ -87,6 +91,14 @@ type blockRetrieval struct {
 	// state of global request counter when this retrieval was created;
 	// maintains FIFO
 	insertionOrder uint64
+	// whether this retrieval counts against its TLF's fetch limit
+	countsTowardTlfLimit bool
+	// the storage tier the block is expected to come from; it's only
+	// ArchiveBlockTier if every request expected that
+	tier BlockTier
+	// the encoded size of the block once it's been fetched, until the
+	// retrieval is finalized; accessed atomically
+	fetchedSize int64
 }
 
 // blockPtrLookup is used to uniquely identify block retrieval requests. The
@@ -99,6 +111,28 @@ type blockPtrLookup struct {
 	t  reflect.Type
 }
 
+var (
+	commonBlockType = reflect.TypeOf(&CommonBlock{})
+	// Block types that a CommonBlock request can be coalesced with.
+	coalescableBlockTypes = []reflect.Type{
+		reflect.TypeOf(&FileBlock{}),
+		reflect.TypeOf(&DirBlock{}),
+	}
+)
+
+// BlockRetrievalStatus represents the status of the block retrieval
+// queue.
+type BlockRetrievalStatus struct {
+	// Retrievals counts the requests that needed a new retrieval.
+	Retrievals MeterStatus
+	// Coalesced counts the requests that were satisfied by an
+	// already-queued or in-progress retrieval for the same block.
+	Coalesced MeterStatus
+	// ArchiveRetrievals counts the new retrievals of blocks expected
+	// to come from the (slow) archive tier.
+	ArchiveRetrievals MeterStatus
+}
+
 // blockRetrievalQueue manages block retrieval requests. Higher priority
 // requests are executed first. Requests are executed in FIFO order within a
 // given priority level.
@@ -113,6 +147,16 @@ type blockRetrievalQueue struct {
 	// capacity: ~584 years at 1 billion requests/sec
 	insertionCount uint64
 	heap           *blockRetrievalHeap
+	// the maximum number of retrievals that can be in progress at once
+	// for any one TLF; 0 means no limit
+	maxFetchesPerTlf int
+	// the number of in-progress retrievals per TLF
+	tlfFetches map[tlf.ID]int
+	// priorities of worker notifications that couldn't be used because
+	// the retrievals at the front of the heap belonged to TLFs already
+	// at their fetch limit.  They are reissued as those TLFs' in-progress
+	// retrievals finish.
+	throttledWakeups map[tlf.ID][]int
 
 	// These are notification channels to maximize the time that each request
 	// is in the heap, allowing preemption as long as possible. This way, a
@@ -124,6 +168,12 @@ type blockRetrievalQueue struct {
 	// channel to be closed when we're done accepting requests
 	doneCh chan struct{}
 
+	// meters for how many requests caused new retrievals, and how many
+	// were coalesced into existing ones
+	retrievalMeter *CountMeter
+	coalescedMeter *CountMeter
+	archiveMeter   *CountMeter
+
 	// protects prefetcher
 	prefetchMtx sync.RWMutex
 	// prefetcher for handling prefetching scenarios
@@ -144,6 +194,11 @@ func newBlockRetrievalQueue(numWorkers int, numPrefetchWorkers int,
 		log:              config.MakeLogger(""),
 		ptrs:             make(map[blockPtrLookup]*blockRetrieval),
 		heap:             &blockRetrievalHeap{},
+		tlfFetches:       make(map[tlf.ID]int),
+		throttledWakeups: make(map[tlf.ID][]int),
+		retrievalMeter:   NewCountMeter(),
+		coalescedMeter:   NewCountMeter(),
+		archiveMeter:     NewCountMeter(),
 		workerCh:         workerCh,
 		prefetchWorkerCh: prefetchWorkerCh,
 		doneCh:           make(chan struct{}),
@@ -162,17 +217,67 @@ func newBlockRetrievalQueue(numWorkers int, numPrefetchWorkers int,
 	return q
 }
 
+// setMaxFetchesPerTlf limits the number of retrievals that can be in
+// progress at once for any one TLF, so that a single TLF can't tie up
+// all the workers.  A limit of 0 means no limit.
+func (brq *blockRetrievalQueue) setMaxFetchesPerTlf(max int) {
+	brq.mtx.Lock()
+	defer brq.mtx.Unlock()
+	brq.maxFetchesPerTlf = max
+}
+
 func (brq *blockRetrievalQueue) popIfNotEmpty() *blockRetrieval {
 	brq.mtx.Lock()
 	defer brq.mtx.Unlock()
-	if brq.heap.Len() > 0 {
-		return heap.Pop(brq.heap).(*blockRetrieval)
+	if brq.maxFetchesPerTlf <= 0 {
+		if brq.heap.Len() > 0 {
+			return heap.Pop(brq.heap).(*blockRetrieval)
+		}
+		return nil
+	}
+
+	// Skip over retrievals for TLFs that are at their limit, and put
+	// them back when we're done.
+	var throttled []*blockRetrieval
+	defer func() {
+		for _, br := range throttled {
+			heap.Push(brq.heap, br)
+		}
+	}()
+	for brq.heap.Len() > 0 {
+		br := heap.Pop(brq.heap).(*blockRetrieval)
+		tlfID := br.kmd.TlfID()
+		if brq.tlfFetches[tlfID] < brq.maxFetchesPerTlf {
+			brq.tlfFetches[tlfID]++
+			br.countsTowardTlfLimit = true
+			return br
+		}
+		throttled = append(throttled, br)
+	}
+
+	if len(throttled) > 0 {
+		// This worker's notification was meant for one of the
+		// throttled retrievals, so save it until the TLF of the
+		// highest-priority one has a free slot.
+		br := throttled[0]
+		tlfID := br.kmd.TlfID()
+		brq.throttledWakeups[tlfID] = append(
+			brq.throttledWakeups[tlfID], br.priority)
 	}
 	return nil
 }
 
 func (brq *blockRetrievalQueue) shutdownRetrieval() {
-	retrieval := brq.popIfNotEmpty()
+	// Ignore the per-TLF limits, since nothing is actually being
+	// fetched.
+	var retrieval *blockRetrieval
+	func() {
+		brq.mtx.Lock()
+		defer brq.mtx.Unlock()
+		if brq.heap.Len() > 0 {
+			retrieval = heap.Pop(brq.heap).(*blockRetrieval)
+		}
+	}()
 	if retrieval != nil {
 		brq.FinalizeRequest(retrieval, nil, io.EOF)
 	}
@@ -305,12 +410,15 @@ func (brq *blockRetrievalQueue) request(ctx context.Context,
 		return ch
 	}
 
+	tier := blockTierFromCtx(ctx)
+
 	// Check caches before locking the mutex.
 	prefetchStatus, err := brq.checkCaches(ctx, kmd, ptr, block)
 	if err == nil {
 		if doPrefetch {
 			brq.Prefetcher().ProcessBlockForPrefetch(ctx, ptr, block, kmd,
-				priority, lifetime, prefetchStatus)
+				prefetchPriorityForTier(priority, tier), lifetime,
+				prefetchStatus)
 		}
 		ch <- nil
 		return ch
@@ -333,10 +441,11 @@ func (brq *blockRetrievalQueue) request(ctx context.Context,
 	// the bottom on the first iteration, or the `continue` statement first
 	// which causes it to `break` on the next iteration.
 	var br *blockRetrieval
+	prepend := false
 	for {
-		exists := false
-		br, exists = brq.ptrs[bpLookup]
-		if !exists {
+		var key blockPtrLookup
+		br, key, prepend = brq.findRetrievalLocked(bpLookup)
+		if br == nil {
 			// Add to the heap
 			br = &blockRetrieval{
 				blockPtr:       ptr,
@@ -345,29 +454,55 @@ func (brq *blockRetrievalQueue) request(ctx context.Context,
 				priority:       priority,
 				insertionOrder: brq.insertionCount,
 				cacheLifetime:  lifetime,
+				tier:           tier,
 			}
 			br.ctx, br.cancelFunc = NewCoalescingContext(ctx)
 			brq.insertionCount++
 			brq.ptrs[bpLookup] = br
 			heap.Push(brq.heap, br)
 			brq.notifyWorker(priority)
+			brq.retrievalMeter.Mark(1)
+			if tier == ArchiveBlockTier {
+				brq.log.CDebugf(ctx, "Retrieving block %v from the "+
+					"archive tier; this may be slow", ptr)
+				brq.archiveMeter.Mark(1)
+			}
 		} else {
 			err := br.ctx.AddContext(ctx)
 			if err == context.Canceled {
 				// We need to delete the request pointer, but we'll still let
 				// the existing request be processed by a worker.
-				delete(brq.ptrs, bpLookup)
+				delete(brq.ptrs, key)
 				continue
 			}
+			if prepend {
+				// Re-key the retrieval under the more specific type
+				// of this request.
+				delete(brq.ptrs, key)
+				brq.ptrs[bpLookup] = br
+			}
+			brq.coalescedMeter.Mark(1)
 		}
 		break
 	}
 	br.reqMtx.Lock()
 	defer br.reqMtx.Unlock()
-	br.requests = append(br.requests, &blockRetrievalRequest{
+	if tier != br.tier {
+		// Someone expects this block to be hot, so it shouldn't be
+		// treated as an archived one.
+		br.tier = HotBlockTier
+	}
+	req := &blockRetrievalRequest{
 		block:  block,
 		doneCh: ch,
-	})
+	}
+	if prepend {
+		// The worker creates the block to fetch from the first
+		// request, so make sure it's the one with the specific type.
+		br.requests = append([]*blockRetrievalRequest{req}, br.requests...)
+	} else {
+		br.requests = append(br.requests, req)
+	}
 	if lifetime > br.cacheLifetime {
 		br.cacheLifetime = lifetime
 	}
@@ -393,6 +528,71 @@ func (brq *blockRetrievalQueue) request(ctx context.Context,
 	return ch
 }
 
+// findRetrievalLocked returns an existing retrieval that can satisfy
+// a request for the given lookup, and the key it is stored under, or
+// nil if there isn't one.  Besides
+// exact matches, a CommonBlock request can share a retrieval of a
+// more specific block type, and a request for a specific block type
+// can take over a CommonBlock retrieval that a worker hasn't started
+// yet, in which case `prepend` is true and the caller must re-key the
+// retrieval and put its request first.  brq.mtx must be held by the
+// caller.
+func (brq *blockRetrievalQueue) findRetrievalLocked(
+	bpLookup blockPtrLookup) (
+	br *blockRetrieval, key blockPtrLookup, prepend bool) {
+	if br, ok := brq.ptrs[bpLookup]; ok {
+		return br, bpLookup, false
+	}
+	if bpLookup.t == commonBlockType {
+		for _, t := range coalescableBlockTypes {
+			key := blockPtrLookup{bpLookup.bp, t}
+			if br, ok := brq.ptrs[key]; ok {
+				return br, key, false
+			}
+		}
+		return nil, blockPtrLookup{}, false
+	}
+	for _, t := range coalescableBlockTypes {
+		if bpLookup.t != t {
+			continue
+		}
+		key := blockPtrLookup{bpLookup.bp, commonBlockType}
+		br, ok := brq.ptrs[key]
+		// An index of -1 means a worker has already popped it.
+		if ok && br.index != -1 {
+			return br, key, true
+		}
+	}
+	return nil, blockPtrLookup{}, false
+}
+
+// Status returns the coalescing stats for this queue.
+func (brq *blockRetrievalQueue) Status() BlockRetrievalStatus {
+	return BlockRetrievalStatus{
+		Retrievals:        rateMeterToStatus(brq.retrievalMeter),
+		Coalesced:         rateMeterToStatus(brq.coalescedMeter),
+		ArchiveRetrievals: rateMeterToStatus(brq.archiveMeter),
+	}
+}
+
+// memoryUsage returns the estimated memory needed by the queued and
+// in-progress retrievals, counting each block by its encoded size.
+// The size of a block isn't known until it has been fetched, so
+// blocks that are still waiting to be fetched count as nothing.
+func (brq *blockRetrievalQueue) memoryUsage() MemoryUsage {
+	brq.mtx.RLock()
+	defer brq.mtx.RUnlock()
+	var usage MemoryUsage
+	for _, br := range brq.ptrs {
+		tlfID := tlf.NullID
+		if br.kmd != nil {
+			tlfID = br.kmd.TlfID()
+		}
+		usage.add(tlfID, atomic.LoadInt64(&br.fetchedSize))
+	}
+	return usage
+}
+
 // Request implements the BlockRetriever interface for blockRetrievalQueue.
 func (brq *blockRetrievalQueue) Request(ctx context.Context,
 	priority int, kmd KeyMetadata, ptr BlockPointer, block Block,
@@ -419,8 +619,12 @@ func (brq *blockRetrievalQueue) FinalizeRequest(
 	// That's okay, because this will then be a no-op.
 	bpLookup := blockPtrLookup{retrieval.blockPtr, reflect.TypeOf(block)}
 	delete(brq.ptrs, bpLookup)
+	wakeup, doWakeup := brq.finishTlfFetchLocked(retrieval)
 	brq.mtx.Unlock()
 	defer retrieval.cancelFunc()
+	if doWakeup {
+		brq.notifyWorker(wakeup)
+	}
 
 	// This is a lock that exists for the race detector, since there
 	// shouldn't be any other goroutines accessing the retrieval at this
@@ -436,12 +640,19 @@ func (brq *blockRetrievalQueue) FinalizeRequest(
 
 	// Cache the block and trigger prefetches if there is no error.
 	if err == nil {
+		if retrieval.priority < defaultOnDemandRequestPriority {
+			// Only bytes fetched for prefetches count against the
+			// prefetch budget.
+			brq.config.PrefetchBudget().spend(
+				int64(block.GetEncodedSize()))
+		}
 		// We treat this request as not having been prefetched, because the
 		// only way to get here is if the request wasn't already cached.
 		// Need to call with context.Background() because the retrieval's
 		// context will be canceled as soon as this method returns.
 		brq.Prefetcher().ProcessBlockForPrefetch(context.Background(),
-			retrieval.blockPtr, block, retrieval.kmd, retrieval.priority,
+			retrieval.blockPtr, block, retrieval.kmd,
+			prefetchPriorityForTier(retrieval.priority, retrieval.tier),
 			retrieval.cacheLifetime, NoPrefetch)
 	} else {
 		brq.Prefetcher().CancelPrefetch(retrieval.blockPtr.ID)
@@ -464,6 +675,35 @@ func (brq *blockRetrievalQueue) FinalizeRequest(
 	retrieval.requests = nil
 }
 
+// finishTlfFetchLocked releases the retrieval's slot in its TLF's
+// fetch limit, and returns the priority of a saved worker notification
+// that should be reissued now that the slot is free, if any.  brq.mtx
+// must be held by the caller.
+func (brq *blockRetrievalQueue) finishTlfFetchLocked(
+	retrieval *blockRetrieval) (wakeup int, doWakeup bool) {
+	if !retrieval.countsTowardTlfLimit {
+		return 0, false
+	}
+	retrieval.countsTowardTlfLimit = false
+	tlfID := retrieval.kmd.TlfID()
+	brq.tlfFetches[tlfID]--
+	if brq.tlfFetches[tlfID] <= 0 {
+		delete(brq.tlfFetches, tlfID)
+	}
+
+	wakeups := brq.throttledWakeups[tlfID]
+	if len(wakeups) == 0 {
+		return 0, false
+	}
+	wakeup = wakeups[0]
+	if len(wakeups) == 1 {
+		delete(brq.throttledWakeups, tlfID)
+	} else {
+		brq.throttledWakeups[tlfID] = wakeups[1:]
+	}
+	return wakeup, true
+}
+
 // Shutdown is called when we are no longer accepting requests.
 func (brq *blockRetrievalQueue) Shutdown() {
 	select {
@@ -475,6 +715,9 @@ func (brq *blockRetrievalQueue) Shutdown() {
 		for _, w := range brq.workers {
 			w.Shutdown()
 		}
+		brq.retrievalMeter.Shutdown()
+		brq.coalescedMeter.Shutdown()
+		brq.archiveMeter.Shutdown()
 		brq.prefetchMtx.Lock()
 		defer brq.prefetchMtx.Unlock()
 		brq.prefetcher.Shutdown()
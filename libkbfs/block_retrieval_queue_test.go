@@ -23,6 +23,9 @@ type testBlockRetrievalConfig struct {
 	*testDiskBlockCacheGetter
 	*testSyncedTlfGetterSetter
 	initModeGetter
+	idleTrackerGetter
+	powerMonitorGetter
+	prefetchBudgetGetter
 }
 
 func newTestBlockRetrievalConfig(t *testing.T, bg blockGetter,
@@ -35,6 +38,9 @@ func newTestBlockRetrievalConfig(t *testing.T, bg blockGetter,
 		newTestDiskBlockCacheGetter(t, dbc),
 		newTestSyncedTlfGetterSetter(),
 		testInitModeGetter{InitDefault},
+		testIdleTrackerGetter{},
+		testPowerMonitorGetter{},
+		testPrefetchBudgetGetter{},
 	}
 }
 
@@ -205,6 +211,75 @@ func TestBlockRetrievalQueueMultipleRequestsSameBlock(t *testing.T) {
 	require.Equal(t, block, br.requests[1].block)
 }
 
+func TestBlockRetrievalQueueCoalesceBlockTypes(t *testing.T) {
+	t.Log("Request the same block as a specific and a generic type.")
+	q := initBlockRetrievalQueueTest(t)
+	require.NotNil(t, q)
+	defer q.Shutdown()
+
+	ctx := context.Background()
+	ptr1, ptr2 := makeRandomBlockPointer(t), makeRandomBlockPointer(t)
+	t.Log("A generic request for ptr1 should join the file block retrieval.")
+	fblock1, cblock1 := &FileBlock{}, NewCommonBlock()
+	_ = q.Request(ctx, 1, makeKMD(), ptr1, fblock1, NoCacheEntry)
+	_ = q.Request(ctx, 1, makeKMD(), ptr1, cblock1, NoCacheEntry)
+
+	t.Log("A file block request for ptr2 should take over the queued " +
+		"generic retrieval.")
+	cblock2, fblock2 := NewCommonBlock(), &FileBlock{}
+	_ = q.Request(ctx, 1, makeKMD(), ptr2, cblock2, NoCacheEntry)
+	_ = q.Request(ctx, 1, makeKMD(), ptr2, fblock2, NoCacheEntry)
+	require.Len(t, *q.heap, 2)
+
+	br := q.popIfNotEmpty()
+	defer q.FinalizeRequest(br, &FileBlock{}, io.EOF)
+	require.Equal(t, ptr1, br.blockPtr)
+	require.Len(t, br.requests, 2)
+	require.Equal(t, fblock1, br.requests[0].block)
+	require.Equal(t, cblock1, br.requests[1].block)
+
+	br = q.popIfNotEmpty()
+	defer q.FinalizeRequest(br, &FileBlock{}, io.EOF)
+	require.Equal(t, ptr2, br.blockPtr)
+	require.Len(t, br.requests, 2)
+	require.Equal(t, fblock2, br.requests[0].block)
+	require.Equal(t, cblock2, br.requests[1].block)
+
+	status := q.Status()
+	require.Equal(t, int64(2), status.Retrievals.Count)
+	require.Equal(t, int64(2), status.Coalesced.Count)
+}
+
+func TestBlockRetrievalQueueArchiveTier(t *testing.T) {
+	q := initBlockRetrievalQueueTest(t)
+	require.NotNil(t, q)
+	defer q.Shutdown()
+
+	ctx := context.Background()
+	archiveCtx := ctxWithBlockTier(ctx, ArchiveBlockTier)
+	ptr1, ptr2 := makeRandomBlockPointer(t), makeRandomBlockPointer(t)
+	t.Log("A request for an archived block is counted separately.")
+	_ = q.Request(archiveCtx, 1, makeKMD(), ptr1, &FileBlock{}, NoCacheEntry)
+
+	t.Log("Once anyone expects a block to be hot, it's treated as hot.")
+	_ = q.Request(archiveCtx, 1, makeKMD(), ptr2, &FileBlock{}, NoCacheEntry)
+	_ = q.Request(ctx, 1, makeKMD(), ptr2, &FileBlock{}, NoCacheEntry)
+
+	br := q.popIfNotEmpty()
+	defer q.FinalizeRequest(br, &FileBlock{}, io.EOF)
+	require.Equal(t, ptr1, br.blockPtr)
+	require.Equal(t, ArchiveBlockTier, br.tier)
+
+	br = q.popIfNotEmpty()
+	defer q.FinalizeRequest(br, &FileBlock{}, io.EOF)
+	require.Equal(t, ptr2, br.blockPtr)
+	require.Equal(t, HotBlockTier, br.tier)
+
+	status := q.Status()
+	require.Equal(t, int64(2), status.Retrievals.Count)
+	require.Equal(t, int64(2), status.ArchiveRetrievals.Count)
+}
+
 func TestBlockRetrievalQueueElevatePriorityExistingRequest(t *testing.T) {
 	t.Log("Elevate the priority on an existing request.")
 	q := initBlockRetrievalQueueTest(t)
@@ -6,6 +6,7 @@ package libkbfs
 
 import (
 	"io"
+	"sync/atomic"
 )
 
 // blockRetrievalWorker processes blockRetrievalQueue requests
@@ -77,7 +78,12 @@ func (brw *blockRetrievalWorker) HandleRequest() (err error) {
 		block = retrieval.requests[0].block.NewEmpty()
 	}()
 
-	return brw.getBlock(retrieval.ctx, retrieval.kmd, retrieval.blockPtr, block)
+	err = brw.getBlock(retrieval.ctx, retrieval.kmd, retrieval.blockPtr, block)
+	if err == nil {
+		atomic.StoreInt64(
+			&retrieval.fetchedSize, int64(block.GetEncodedSize()))
+	}
+	return err
 }
 
 // Shutdown shuts down the blockRetrievalWorker once its current work is done.
@@ -12,6 +12,7 @@ import (
 
 	"github.com/keybase/kbfs/kbfscodec"
 	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/tlf"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/net/context"
 )
@@ -378,3 +379,54 @@ func TestBlockRetrievalWorkerPrefetchedPriorityElevation(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, testBlock1, block1)
 }
+
+func TestBlockRetrievalWorkerPerTlfLimit(t *testing.T) {
+	t.Log("Test that a per-TLF fetch limit lets other TLFs' requests " +
+		"skip ahead.")
+	bg := newFakeBlockGetter(false)
+	q := newBlockRetrievalQueue(0, 2, newTestBlockRetrievalConfig(t, bg, nil))
+	require.NotNil(t, q)
+	defer q.Shutdown()
+	<-q.TogglePrefetcher(false, nil)
+	q.setMaxFetchesPerTlf(1)
+
+	ptr1, ptr2, ptr3 := makeRandomBlockPointer(t), makeRandomBlockPointer(t),
+		makeRandomBlockPointer(t)
+	block1, block2, block3 := makeFakeFileBlock(t, false),
+		makeFakeFileBlock(t, false), makeFakeFileBlock(t, false)
+	startCh1, continueCh1 := bg.setBlockToReturn(ptr1, block1)
+	startCh2, continueCh2 := bg.setBlockToReturn(ptr2, block2)
+	startCh3, continueCh3 := bg.setBlockToReturn(ptr3, block3)
+
+	t.Log("Make 2 requests for one TLF, then 1 request for another TLF.")
+	kmd1 := makeKMD()
+	kmd2 := emptyKeyMetadata{tlf.FakeID(1, tlf.Private), 1}
+	testBlock1, testBlock2, testBlock3 := &FileBlock{}, &FileBlock{},
+		&FileBlock{}
+	req1Ch := q.Request(context.Background(), 1, kmd1, ptr1, testBlock1,
+		NoCacheEntry)
+	<-startCh1
+	req2Ch := q.Request(context.Background(), 1, kmd1, ptr2, testBlock2,
+		NoCacheEntry)
+	req3Ch := q.Request(context.Background(), 1, kmd2, ptr3, testBlock3,
+		NoCacheEntry)
+
+	t.Log("The second worker should skip over the first TLF's queued " +
+		"request, since that TLF is at its limit.")
+	<-startCh3
+	continueCh3 <- nil
+	err := <-req3Ch
+	require.NoError(t, err)
+	require.Equal(t, block3, testBlock3)
+
+	t.Log("Once the first TLF's fetch is done, its next one can start.")
+	continueCh1 <- nil
+	err = <-req1Ch
+	require.NoError(t, err)
+	require.Equal(t, block1, testBlock1)
+	<-startCh2
+	continueCh2 <- nil
+	err = <-req2Ch
+	require.NoError(t, err)
+	require.Equal(t, block2, testBlock2)
+}
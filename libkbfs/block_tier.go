@@ -0,0 +1,65 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+)
+
+// BlockTier is the class of storage a block is expected to be served
+// from.
+type BlockTier int
+
+const (
+	// HotBlockTier is for blocks referenced by recent revisions,
+	// which are kept on fast storage.
+	HotBlockTier BlockTier = iota
+	// ArchiveBlockTier is for blocks that are only referenced by old
+	// revisions.  They may be kept on slower, cheaper storage, and
+	// can take much longer to fetch.
+	ArchiveBlockTier
+)
+
+func (t BlockTier) String() string {
+	switch t {
+	case HotBlockTier:
+		return "hot"
+	case ArchiveBlockTier:
+		return "archive"
+	default:
+		return fmt.Sprintf("BlockTier(%d)", int(t))
+	}
+}
+
+type ctxBlockTierKeyType int
+
+const (
+	// ctxBlockTierKey is a context key for the tier that the blocks
+	// fetched under the context are expected to come from.
+	ctxBlockTierKey ctxBlockTierKeyType = iota
+)
+
+func ctxWithBlockTier(ctx context.Context, tier BlockTier) context.Context {
+	return context.WithValue(ctx, ctxBlockTierKey, tier)
+}
+
+func blockTierFromCtx(ctx context.Context) BlockTier {
+	tier, _ := ctx.Value(ctxBlockTierKey).(BlockTier)
+	return tier
+}
+
+// prefetchPriorityForTier returns the priority at which a block
+// retrieved with `priority` from `tier` should be handed to the
+// prefetcher.  Archived blocks are slow to fetch, so reading one
+// doesn't trigger prefetches of its children; they're only fetched
+// when they're actually read.
+func prefetchPriorityForTier(priority int, tier BlockTier) int {
+	if tier == ArchiveBlockTier && priority >= lowestTriggerPrefetchPriority {
+		return defaultPrefetchPriority
+	}
+	return priority
+}
@@ -0,0 +1,399 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/go-codec/codec"
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// blockTrafficPathDepth is how many components of a path are
+	// kept when recording the traffic for it, to bound the size of
+	// the log.
+	blockTrafficPathDepth = 4
+	// blockTrafficRetention is how long recorded traffic is kept.
+	blockTrafficRetention = 60 * 24 * time.Hour
+	// blockTrafficLogFilename is the name of the file, under the
+	// storage root, that the traffic log is saved to.
+	blockTrafficLogFilename = "kbfs_block_traffic"
+	// blockTrafficSavePeriod is how often the traffic log is saved,
+	// so that a crash loses at most this much of it.
+	blockTrafficSavePeriod = 10 * time.Minute
+)
+
+type ctxBlockTrafficPathKeyType int
+
+const (
+	// ctxBlockTrafficPathKey is a context key for the TLF-relative
+	// path that the blocks fetched or put under the context belong
+	// to.
+	ctxBlockTrafficPathKey ctxBlockTrafficPathKeyType = iota
+	// ctxBlockTrafficJournalFlushKey marks the puts made by journal
+	// flushes, which were already counted when they were journaled.
+	ctxBlockTrafficJournalFlushKey
+)
+
+func ctxWithBlockTrafficPath(
+	ctx context.Context, relPath string) context.Context {
+	return context.WithValue(ctx, ctxBlockTrafficPathKey, relPath)
+}
+
+func ctxWithBlockTrafficJournalFlush(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxBlockTrafficJournalFlushKey, true)
+}
+
+func blockTrafficPathFromCtx(ctx context.Context) string {
+	relPath, _ := ctx.Value(ctxBlockTrafficPathKey).(string)
+	return relPath
+}
+
+// truncateBlockTrafficPath returns the first `depth` components of
+// the slash-separated `relPath`.
+func truncateBlockTrafficPath(relPath string, depth int) string {
+	if depth <= 0 || relPath == "" {
+		return ""
+	}
+	parts := strings.SplitN(relPath, "/", depth+1)
+	if len(parts) > depth {
+		parts = parts[:depth]
+	}
+	return strings.Join(parts, "/")
+}
+
+// BlockTrafficStats counts the blocks moved between this device and
+// the block server.
+type BlockTrafficStats struct {
+	BlocksUploaded   int64
+	BytesUploaded    int64
+	BlocksDownloaded int64
+	BytesDownloaded  int64
+}
+
+func (s *BlockTrafficStats) add(other BlockTrafficStats) {
+	s.BlocksUploaded += other.BlocksUploaded
+	s.BytesUploaded += other.BytesUploaded
+	s.BlocksDownloaded += other.BlocksDownloaded
+	s.BytesDownloaded += other.BytesDownloaded
+}
+
+// BlockTrafficSummary is the block traffic for one TLF path prefix
+// on one (UTC) day.
+type BlockTrafficSummary struct {
+	Day   time.Time
+	TlfID tlf.ID
+	// Path is the TLF-relative path prefix the traffic is for; ""
+	// is the whole TLF.
+	Path string
+	BlockTrafficStats
+}
+
+type blockTrafficKey struct {
+	// Day is the Unix time of the start of the UTC day.
+	Day   int64
+	TlfID tlf.ID
+	Path  string
+}
+
+// blockTrafficRecord is how the log is saved to disk.
+type blockTrafficRecord struct {
+	Key   blockTrafficKey
+	Stats BlockTrafficStats
+
+	codec.UnknownFieldSetHandler
+}
+
+// BlockTrafficLog keeps per-day, per-TLF counts of the blocks this
+// device has uploaded to and downloaded from the block server,
+// broken down by the path (up to a fixed depth) they belong to, so
+// that users can find out what is consuming their bandwidth.
+//
+// A path is only known for blocks fetched for a particular file or
+// directory, or put by a sync of a particular file; everything else
+// (like prefetches) is counted against the TLF as a whole.  Blocks
+// put to a journal are counted when they're journaled, since that's
+// when their path is known, rather than when they're flushed.
+//
+// Paths are as private as the files they name, so they're only kept
+// in memory; the log saved to disk only has per-TLF totals.
+type BlockTrafficLog struct {
+	clocks clockGetter
+
+	lock     sync.Mutex
+	counts   map[blockTrafficKey]*BlockTrafficStats
+	savePath string
+	codec    kbfscodec.Codec
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+}
+
+// NewBlockTrafficLog returns a new, empty BlockTrafficLog that uses
+// the clock of `clocks` to timestamp traffic.
+func NewBlockTrafficLog(clocks clockGetter) *BlockTrafficLog {
+	return &BlockTrafficLog{
+		clocks: clocks,
+		counts: make(map[blockTrafficKey]*BlockTrafficStats),
+	}
+}
+
+func blockTrafficDay(t time.Time) int64 {
+	return t.UTC().Truncate(24 * time.Hour).Unix()
+}
+
+func (btl *BlockTrafficLog) record(
+	ctx context.Context, tlfID tlf.ID, stats BlockTrafficStats) {
+	now := btl.clocks.Clock().Now()
+	key := blockTrafficKey{
+		Day:   blockTrafficDay(now),
+		TlfID: tlfID,
+		Path: truncateBlockTrafficPath(
+			blockTrafficPathFromCtx(ctx), blockTrafficPathDepth),
+	}
+
+	btl.lock.Lock()
+	defer btl.lock.Unlock()
+	s, ok := btl.counts[key]
+	if !ok {
+		btl.pruneLocked(now)
+		s = &BlockTrafficStats{}
+		btl.counts[key] = s
+	}
+	s.add(stats)
+}
+
+// pruneLocked drops the traffic older than the retention period.
+func (btl *BlockTrafficLog) pruneLocked(now time.Time) {
+	oldest := blockTrafficDay(now.Add(-blockTrafficRetention))
+	for key := range btl.counts {
+		if key.Day < oldest {
+			delete(btl.counts, key)
+		}
+	}
+}
+
+// Summarize returns the recorded traffic since the start of the UTC
+// day containing `since`, for the given TLF (or for all TLFs, if
+// `tlfID` is tlf.NullID), under the TLF-relative path `prefix` (""
+// for the whole TLF).  The traffic is grouped by day, TLF, and the
+// first `depth` components of its path, and sorted in that order.
+func (btl *BlockTrafficLog) Summarize(since time.Time, tlfID tlf.ID,
+	prefix string, depth int) []BlockTrafficSummary {
+	prefix = strings.Trim(prefix, "/")
+	sinceDay := blockTrafficDay(since)
+
+	btl.lock.Lock()
+	defer btl.lock.Unlock()
+	grouped := make(map[blockTrafficKey]*BlockTrafficStats)
+	for key, stats := range btl.counts {
+		if key.Day < sinceDay {
+			continue
+		}
+		if tlfID != tlf.NullID && key.TlfID != tlfID {
+			continue
+		}
+		if prefix != "" && key.Path != prefix &&
+			!strings.HasPrefix(key.Path, prefix+"/") {
+			continue
+		}
+		groupKey := key
+		groupKey.Path = truncateBlockTrafficPath(key.Path, depth)
+		s, ok := grouped[groupKey]
+		if !ok {
+			s = &BlockTrafficStats{}
+			grouped[groupKey] = s
+		}
+		s.add(*stats)
+	}
+
+	summaries := make([]BlockTrafficSummary, 0, len(grouped))
+	for key, stats := range grouped {
+		summaries = append(summaries, BlockTrafficSummary{
+			Day:               time.Unix(key.Day, 0).UTC(),
+			TlfID:             key.TlfID,
+			Path:              key.Path,
+			BlockTrafficStats: *stats,
+		})
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		a, b := summaries[i], summaries[j]
+		if !a.Day.Equal(b.Day) {
+			return a.Day.Before(b.Day)
+		}
+		if a.TlfID != b.TlfID {
+			return a.TlfID.String() < b.TlfID.String()
+		}
+		return a.Path < b.Path
+	})
+	return summaries
+}
+
+// Load replaces the recorded traffic with what was saved to `path`,
+// if anything, and starts saving back to it periodically, until
+// Shutdown is called.
+func (btl *BlockTrafficLog) Load(codec kbfscodec.Codec, path string) error {
+	var records []blockTrafficRecord
+	err := kbfscodec.DeserializeFromFile(codec, path, &records)
+	if err != nil && !ioutil.IsNotExist(err) {
+		return err
+	}
+
+	btl.lock.Lock()
+	defer btl.lock.Unlock()
+	if btl.stopCh != nil {
+		return errors.New("The block traffic log was already loaded")
+	}
+	btl.savePath = path
+	btl.codec = codec
+	btl.counts = make(map[blockTrafficKey]*BlockTrafficStats, len(records))
+	for _, r := range records {
+		stats := r.Stats
+		btl.counts[r.Key] = &stats
+	}
+	btl.pruneLocked(btl.clocks.Clock().Now())
+	btl.stopCh = make(chan struct{})
+	btl.doneCh = make(chan struct{})
+	go btl.saveLoop(btl.stopCh, btl.doneCh)
+	return nil
+}
+
+func (btl *BlockTrafficLog) saveLoop(stopCh <-chan struct{},
+	doneCh chan<- struct{}) {
+	defer close(doneCh)
+	ticker := time.NewTicker(blockTrafficSavePeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// Errors will be returned again by Shutdown if they
+			// persist.
+			_ = btl.save()
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// save writes the per-TLF totals of the recorded traffic to the path
+// given to Load.  It does nothing if Load was never called.
+func (btl *BlockTrafficLog) save() error {
+	btl.lock.Lock()
+	defer btl.lock.Unlock()
+	if btl.savePath == "" {
+		return nil
+	}
+	totals := make(map[blockTrafficKey]*BlockTrafficStats)
+	for key, stats := range btl.counts {
+		key.Path = ""
+		s, ok := totals[key]
+		if !ok {
+			s = &BlockTrafficStats{}
+			totals[key] = s
+		}
+		s.add(*stats)
+	}
+	records := make([]blockTrafficRecord, 0, len(totals))
+	for key, stats := range totals {
+		records = append(records, blockTrafficRecord{Key: key, Stats: *stats})
+	}
+	return kbfscodec.SerializeToFile(btl.codec, records, btl.savePath)
+}
+
+// Shutdown stops the periodic saving started by Load, and saves the
+// log one last time.
+func (btl *BlockTrafficLog) Shutdown() error {
+	btl.lock.Lock()
+	stopCh, doneCh := btl.stopCh, btl.doneCh
+	btl.stopCh = nil
+	btl.lock.Unlock()
+	if stopCh == nil {
+		return nil
+	}
+	close(stopCh)
+	<-doneCh
+	return btl.save()
+}
+
+// recordJournaled records a block put of `size` bytes to the journal
+// of `tlfID`, to be uploaded when the journal is flushed.
+func (btl *BlockTrafficLog) recordJournaled(
+	ctx context.Context, tlfID tlf.ID, size int) {
+	btl.record(ctx, tlfID, BlockTrafficStats{
+		BlocksUploaded: 1,
+		BytesUploaded:  int64(size),
+	})
+}
+
+// BlockServerTrafficLogged delegates to another BlockServer, and
+// records the blocks successfully fetched and put in a
+// BlockTrafficLog.
+type BlockServerTrafficLogged struct {
+	BlockServer
+	log *BlockTrafficLog
+}
+
+var _ BlockServer = BlockServerTrafficLogged{}
+
+// NewBlockServerTrafficLogged returns a BlockServerTrafficLogged
+// that delegates to `delegate` and records to `log`.
+func NewBlockServerTrafficLogged(
+	delegate BlockServer, log *BlockTrafficLog) BlockServerTrafficLogged {
+	return BlockServerTrafficLogged{delegate, log}
+}
+
+// Get implements the BlockServer interface for
+// BlockServerTrafficLogged.
+func (b BlockServerTrafficLogged) Get(ctx context.Context, tlfID tlf.ID,
+	id kbfsblock.ID, context kbfsblock.Context) (
+	[]byte, kbfscrypto.BlockCryptKeyServerHalf, error) {
+	buf, serverHalf, err := b.BlockServer.Get(ctx, tlfID, id, context)
+	if err == nil {
+		b.log.record(ctx, tlfID, BlockTrafficStats{
+			BlocksDownloaded: 1,
+			BytesDownloaded:  int64(len(buf)),
+		})
+	}
+	return buf, serverHalf, err
+}
+
+// Put implements the BlockServer interface for
+// BlockServerTrafficLogged.
+func (b BlockServerTrafficLogged) Put(ctx context.Context, tlfID tlf.ID,
+	id kbfsblock.ID, context kbfsblock.Context, buf []byte,
+	serverHalf kbfscrypto.BlockCryptKeyServerHalf) error {
+	err := b.BlockServer.Put(ctx, tlfID, id, context, buf, serverHalf)
+	if err == nil && ctx.Value(ctxBlockTrafficJournalFlushKey) == nil {
+		b.log.record(ctx, tlfID, BlockTrafficStats{
+			BlocksUploaded: 1,
+			BytesUploaded:  int64(len(buf)),
+		})
+	}
+	return err
+}
+
+// PutAgain implements the BlockServer interface for
+// BlockServerTrafficLogged.
+func (b BlockServerTrafficLogged) PutAgain(ctx context.Context,
+	tlfID tlf.ID, id kbfsblock.ID, context kbfsblock.Context, buf []byte,
+	serverHalf kbfscrypto.BlockCryptKeyServerHalf) error {
+	err := b.BlockServer.PutAgain(ctx, tlfID, id, context, buf, serverHalf)
+	if err == nil && ctx.Value(ctxBlockTrafficJournalFlushKey) == nil {
+		b.log.record(ctx, tlfID, BlockTrafficStats{
+			BlocksUploaded: 1,
+			BytesUploaded:  int64(len(buf)),
+		})
+	}
+	return err
+}
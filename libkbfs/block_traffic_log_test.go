@@ -0,0 +1,112 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestBlockTrafficLog(t *testing.T) {
+	ctx := context.Background()
+	config := MakeTestConfigOrBust(t, "u1")
+	defer CheckConfigAndShutdown(ctx, t, config)
+	clock := &TestClock{}
+	day1 := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	clock.Set(day1)
+	config.SetClock(clock)
+
+	trafficLog := NewBlockTrafficLog(config)
+	bserv := NewBlockServerTrafficLogged(config.BlockServer(), trafficLog)
+	tlfID1 := tlf.FakeID(1, tlf.Private)
+	tlfID2 := tlf.FakeID(2, tlf.Private)
+
+	t.Log("Put and get blocks under different paths")
+	put := func(ctx context.Context, tlfID tlf.ID, data []byte) {
+		id, bCtx, serverHalf := makeBlockPeerTestBlock(t, data)
+		err := bserv.Put(ctx, tlfID, id, bCtx, data, serverHalf)
+		require.NoError(t, err)
+		_, _, err = bserv.Get(ctx, tlfID, id, bCtx)
+		require.NoError(t, err)
+	}
+	put(ctxWithBlockTrafficPath(ctx, "a/b/c/d/e"), tlfID1, []byte{1})
+	put(ctxWithBlockTrafficPath(ctx, "a/x"), tlfID1, []byte{1, 2})
+	put(ctx, tlfID1, []byte{1, 2, 3})
+	clock.Add(24 * time.Hour)
+	put(ctxWithBlockTrafficPath(ctx, "a"), tlfID2, []byte{1, 2, 3, 4})
+
+	day1Start := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	day2Start := day1Start.Add(24 * time.Hour)
+	stats := func(blocks, bytes int64) BlockTrafficStats {
+		return BlockTrafficStats{blocks, bytes, blocks, bytes}
+	}
+	require.Equal(t, []BlockTrafficSummary{
+		{day1Start, tlfID1, "", stats(1, 3)},
+		{day1Start, tlfID1, "a", stats(2, 3)},
+		{day2Start, tlfID2, "a", stats(1, 4)},
+	}, trafficLog.Summarize(day1, tlf.NullID, "", 1))
+
+	t.Log("Summarize one TLF and path prefix in more detail")
+	require.Equal(t, []BlockTrafficSummary{
+		{day1Start, tlfID1, "a/b/c/d", stats(1, 1)},
+		{day1Start, tlfID1, "a/x", stats(1, 2)},
+	}, trafficLog.Summarize(day1, tlfID1, "/a/", 10))
+	require.Equal(t, []BlockTrafficSummary{
+		{day2Start, tlfID2, "", stats(1, 4)},
+	}, trafficLog.Summarize(day2Start, tlf.NullID, "", 0))
+
+	t.Log("Save and reload the log, which keeps only per-TLF totals")
+	tempdir, err := ioutil.TempDir(os.TempDir(), "block_traffic_log")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+	logPath := filepath.Join(tempdir, blockTrafficLogFilename)
+	err = trafficLog.Load(config.Codec(), logPath)
+	require.NoError(t, err)
+	require.Empty(t, trafficLog.Summarize(day1, tlf.NullID, "", 1))
+	put(ctxWithBlockTrafficPath(ctx, "secret-dir/x"), tlfID2,
+		[]byte{5, 6, 7, 8})
+	put(ctxWithBlockTrafficPath(ctx, "y"), tlfID2, []byte{9})
+	err = trafficLog.Shutdown()
+	require.NoError(t, err)
+	buf, err := ioutil.ReadFile(logPath)
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(buf, []byte("secret-dir")))
+
+	reloaded := NewBlockTrafficLog(config)
+	err = reloaded.Load(config.Codec(), logPath)
+	require.NoError(t, err)
+	require.Equal(t, []BlockTrafficSummary{
+		{day2Start, tlfID2, "", stats(2, 5)},
+	}, reloaded.Summarize(day1, tlf.NullID, "", 1))
+	err = reloaded.Shutdown()
+	require.NoError(t, err)
+
+	t.Log("Journal flushes aren't counted again")
+	before := trafficLog.Summarize(day2Start, tlfID2, "", 0)
+	put(ctxWithBlockTrafficJournalFlush(ctx), tlfID2, []byte{10})
+	after := trafficLog.Summarize(day2Start, tlfID2, "", 0)
+	require.Equal(t, before[0].BlocksUploaded, after[0].BlocksUploaded)
+	require.Equal(t, before[0].BlocksDownloaded+1, after[0].BlocksDownloaded)
+
+	t.Log("Old traffic is dropped after the retention period")
+	clock.Add(blockTrafficRetention + 24*time.Hour)
+	reloaded = NewBlockTrafficLog(config)
+	err = reloaded.Load(config.Codec(), logPath)
+	require.NoError(t, err)
+	require.Empty(t, reloaded.Summarize(day1, tlf.NullID, "", 1))
+	err = reloaded.Shutdown()
+	require.NoError(t, err)
+}
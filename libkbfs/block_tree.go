@@ -559,7 +559,10 @@ func (bt *blockTree) newRightBlock(
 	}
 
 	// All parents up to and including the lowest ancestor with room
-	// will have to change, so mark them as dirty.
+	// will have to change, so mark them as dirty.  Above that
+	// ancestor, the new block is reached along the same path as the
+	// old one, which isn't necessarily the rightmost path in the tree
+	// (e.g., when a directory leaf in the middle is split).
 	ptr := bt.rootBlockPointer()
 	for i := 0; i <= lowestAncestorWithRoom; i++ {
 		pb := parentBlocks[i]
@@ -569,7 +572,11 @@ func (bt *blockTree) newRightBlock(
 		newDirtyPtrs = append(newDirtyPtrs, ptr)
 		ptr = pb.childBlockPtr()
 		rightParentBlocks[i].pblock = pb.pblock
-		rightParentBlocks[i].childIndex = pb.pblock.NumIndirectPtrs() - 1
+		if i < lowestAncestorWithRoom {
+			rightParentBlocks[i].childIndex = pb.childIndex
+		} else {
+			rightParentBlocks[i].childIndex = pb.pblock.NumIndirectPtrs() - 1
+		}
 	}
 
 	return rightParentBlocks, newDirtyPtrs, nil
@@ -697,6 +704,17 @@ func (bt *blockTree) shiftBlocksToFillHole(
 		if currIndex > 0 {
 			immedPblock.SwapIndirectPtrs(currIndex-1, immedPblock, currIndex)
 			currIndex--
+			if currIndex == 0 {
+				// The new block is now the leftmost child of its
+				// parent, so the ancestor offsets must match it.
+				ndp, nu, err := bt.setParentOffsets(
+					ctx, newBlockStartOff, parents, currIndex)
+				if err != nil {
+					return nil, nil, 0, err
+				}
+				newDirtyPtrs = append(newDirtyPtrs, ndp...)
+				newUnrefs = append(newUnrefs, nu...)
+			}
 			continue
 		}
 
@@ -802,6 +820,12 @@ func (bt *blockTree) markParentsDirty(parentBlocks []parentBlockAndChildIndex) (
 
 type makeSyncFunc func(ptr BlockPointer) func() error
 
+// earlyReadiedFunc returns the readied version of the given dirty
+// leaf block, if it was already readied and put to the server before
+// the sync started.
+type earlyReadiedFunc func(ptr BlockPointer) (
+	info BlockInfo, readyBlockData ReadyBlockData, ok bool)
+
 // readyHelper takes a set of paths from a root down to a child block,
 // and readies all the blocks represented in those paths.  If the
 // caller wants leaf blocks readied, then the last element of each
@@ -809,11 +833,13 @@ type makeSyncFunc func(ptr BlockPointer) func() error
 // index of -1.  It's assumed that all slices in `pathsFromRoot` have
 // the same size. This function returns a map pointing from the new
 // block info from any readied block to its corresponding old block
-// pointer.
+// pointer.  If `earlyReadied` is non-nil, any leaf blocks it returns
+// are used as-is and are not put to the server again.
 func (bt *blockTree) readyHelper(
 	ctx context.Context, id tlf.ID, bcache BlockCache, bops BlockOps,
 	bps *blockPutState, pathsFromRoot [][]parentBlockAndChildIndex,
-	makeSync makeSyncFunc) (map[BlockInfo]BlockPointer, error) {
+	makeSync makeSyncFunc, earlyReadied earlyReadiedFunc) (
+	map[BlockInfo]BlockPointer, error) {
 	oldPtrs := make(map[BlockInfo]BlockPointer)
 	newPtrs := make(map[BlockPointer]bool)
 
@@ -834,11 +860,21 @@ func (bt *blockTree) readyHelper(
 				continue
 			}
 
-			newInfo, _, readyBlockData, err := ReadyBlock(
-				ctx, bcache, bops, bt.crypto, bt.kmd, pb.pblock,
-				bt.chargedTo, bt.rootBlockPointer().GetBlockType())
-			if err != nil {
-				return nil, err
+			isLeaf := level == len(pathsFromRoot[0])-1
+			var newInfo BlockInfo
+			var readyBlockData ReadyBlockData
+			var err error
+			alreadyPut := false
+			if earlyReadied != nil && isLeaf {
+				newInfo, readyBlockData, alreadyPut = earlyReadied(ptr)
+			}
+			if !alreadyPut {
+				newInfo, _, readyBlockData, err = ReadyBlock(
+					ctx, bcache, bops, bt.crypto, bt.kmd, pb.pblock,
+					bt.chargedTo, bt.rootBlockPointer().GetBlockType())
+				if err != nil {
+					return nil, err
+				}
 			}
 
 			err = bcache.Put(
@@ -849,13 +885,16 @@ func (bt *blockTree) readyHelper(
 
 			// Only the leaf level need to be tracked by the dirty file.
 			var syncFunc func() error
-			if makeSync != nil && level == len(pathsFromRoot[0])-1 {
+			if makeSync != nil && isLeaf {
 				syncFunc = makeSync(ptr)
 			}
 
 			bps.addNewBlock(
 				newInfo.BlockPointer, pb.pblock, readyBlockData, syncFunc)
 			bps.saveOldPtr(ptr)
+			if alreadyPut {
+				bps.markAlreadyPut()
+			}
 
 			parentPB.setChildBlockInfo(newInfo)
 			oldPtrs[newInfo] = ptr
@@ -872,8 +911,8 @@ func (bt *blockTree) readyHelper(
 func (bt *blockTree) ready(
 	ctx context.Context, id tlf.ID, bcache BlockCache,
 	dirtyBcache isDirtyProvider, bops BlockOps, bps *blockPutState,
-	topBlock BlockWithPtrs, makeSync makeSyncFunc) (
-	map[BlockInfo]BlockPointer, error) {
+	topBlock BlockWithPtrs, makeSync makeSyncFunc,
+	earlyReadied earlyReadiedFunc) (map[BlockInfo]BlockPointer, error) {
 	if !topBlock.IsIndirect() {
 		return nil, nil
 	}
@@ -908,7 +947,8 @@ func (bt *blockTree) ready(
 		return nil, nil
 	}
 
-	return bt.readyHelper(ctx, id, bcache, bops, bps, dirtyLeafPaths, makeSync)
+	return bt.readyHelper(
+		ctx, id, bcache, bops, bps, dirtyLeafPaths, makeSync, earlyReadied)
 }
 
 func (bt *blockTree) getIndirectBlocksForOffsetRange(
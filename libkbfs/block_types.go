@@ -198,6 +198,9 @@ type DirBlock struct {
 	Children map[string]DirEntry `codec:"c,omitempty"`
 	// if indirect, contains the indirect pointers to the next level of blocks
 	IPtrs []IndirectDirPtr `codec:"i,omitempty"`
+	// if indirect and non-zero, IPtrs are a fixed number of buckets
+	// that entries are sharded into by name hash
+	HashBuckets int `codec:"b,omitempty"`
 }
 
 var _ BlockWithPtrs = (*DirBlock)(nil)
@@ -224,7 +227,9 @@ func (db *DirBlock) NewEmpty() Block {
 // DataVersion returns data version for this block, which is assumed
 // to have been modified locally.
 func (db *DirBlock) DataVersion() DataVer {
-	if db.IsInd {
+	if db.IsInd && db.HashBuckets > 0 {
+		return HashedDirsDataVer
+	} else if db.IsInd {
 		return IndirectDirsDataVer
 	}
 	return FirstValidDataVer
@@ -241,6 +246,7 @@ func (db *DirBlock) Set(other Block) {
 	dbCopy := otherDb.DeepCopy()
 	db.Children = dbCopy.Children
 	db.IPtrs = dbCopy.IPtrs
+	db.HashBuckets = dbCopy.HashBuckets
 	db.ToCommonBlock().Set(dbCopy.ToCommonBlock())
 }
 
@@ -259,6 +265,7 @@ func (db *DirBlock) DeepCopy() *DirBlock {
 		CommonBlock: db.CommonBlock.DeepCopy(),
 		Children:    childrenCopy,
 		IPtrs:       iptrsCopy,
+		HashBuckets: db.HashBuckets,
 	}
 }
 
@@ -161,6 +161,7 @@ func makeFakeDirBlockFuture(t *testing.T) *dirBlockFuture {
 			},
 			nil,
 			nil,
+			0,
 		},
 		map[string]dirEntryFuture{
 			"child1": makeFakeDirEntryFuture(t),
@@ -72,8 +72,14 @@ func PutBlockCheckLimitErrs(ctx context.Context, bserv BlockServer,
 func doOneBlockPut(ctx context.Context, bserv BlockServer, reporter Reporter,
 	tlfID tlf.ID, tlfName tlf.CanonicalName, blockState blockState,
 	blocksToRemoveChan chan *FileBlock) error {
-	err := PutBlockCheckLimitErrs(ctx, bserv, reporter, tlfID, blockState.blockPtr,
-		blockState.readyBlockData, tlfName)
+	var err error
+	if blockState.trafficPath != "" {
+		ctx = ctxWithBlockTrafficPath(ctx, blockState.trafficPath)
+	}
+	if !blockState.alreadyPut {
+		err = PutBlockCheckLimitErrs(ctx, bserv, reporter, tlfID,
+			blockState.blockPtr, blockState.readyBlockData, tlfName)
+	}
 	if err == nil && blockState.syncedCb != nil {
 		err = blockState.syncedCb()
 	}
@@ -87,6 +93,40 @@ func doOneBlockPut(ctx context.Context, bserv BlockServer, reporter Reporter,
 	return err
 }
 
+// getExistingBlocks asks `bserv`, if it can tell, which of the new
+// blocks in `bps` it already has, so they don't need to be uploaded
+// again.  Errors aren't fatal; they just mean every block gets put.
+func getExistingBlocks(ctx context.Context, bserv BlockServer,
+	log traceLogger, tlfID tlf.ID, bps blockPutState) map[kbfsblock.ID]bool {
+	checker, ok := bserv.(blockExistenceChecker)
+	if !ok {
+		return nil
+	}
+
+	contexts := make(kbfsblock.ContextMap)
+	for _, blockState := range bps.blockStates {
+		ptr := blockState.blockPtr
+		if blockState.alreadyPut || ptr.RefNonce != kbfsblock.ZeroRefNonce {
+			continue
+		}
+		contexts[ptr.ID] = append(contexts[ptr.ID], ptr.Context)
+	}
+	if len(contexts) == 0 {
+		return nil
+	}
+
+	existing, err := checker.getExistingBlocks(ctx, tlfID, contexts)
+	if err != nil {
+		log.CDebugf(ctx, "Couldn't check for existing blocks: %+v", err)
+		return nil
+	}
+	if len(existing) > 0 {
+		log.CDebugf(ctx, "Skipping the put of %d existing blocks",
+			len(existing))
+	}
+	return existing
+}
+
 // doBlockPuts writes all the pending block puts to the cache and
 // server. If the err returned by this function satisfies
 // isRecoverableBlockError(err), the caller should retry its entire
@@ -130,7 +170,12 @@ func doBlockPuts(ctx context.Context, bserv BlockServer, bcache BlockCache,
 		eg.Go(worker)
 	}
 
+	existing := getExistingBlocks(ctx, bserv, log, tlfID, bps)
 	for _, blockState := range bps.blockStates {
+		if existing[blockState.blockPtr.ID] &&
+			blockState.blockPtr.RefNonce == kbfsblock.ZeroRefNonce {
+			blockState.alreadyPut = true
+		}
 		blocks <- blockState
 	}
 	close(blocks)
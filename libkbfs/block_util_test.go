@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/golang/mock/gomock"
+	"github.com/keybase/client/go/logger"
 	"github.com/keybase/kbfs/kbfsblock"
 	"github.com/keybase/kbfs/tlf"
 	"github.com/stretchr/testify/require"
@@ -99,3 +100,61 @@ func TestBlockUtilPutFail(t *testing.T) {
 	err := putBlockToServer(ctx, bserver, tlfID, blockPtr, readyBlockData)
 	require.Equal(t, expectedErr, err)
 }
+
+// existenceCheckingBlockServer is a mock block server that says it
+// has the blocks in `existing`.
+type existenceCheckingBlockServer struct {
+	*MockBlockServer
+	t        *testing.T
+	tlfID    tlf.ID
+	contexts kbfsblock.ContextMap
+	existing map[kbfsblock.ID]bool
+}
+
+func (b existenceCheckingBlockServer) getExistingBlocks(
+	_ context.Context, tlfID tlf.ID, contexts kbfsblock.ContextMap) (
+	map[kbfsblock.ID]bool, error) {
+	require.Equal(b.t, b.tlfID, tlfID)
+	require.Equal(b.t, b.contexts, contexts)
+	return b.existing, nil
+}
+
+func TestBlockUtilDoBlockPutsSkipsExisting(t *testing.T) {
+	mockCtrl, ctr, mockServer, ctx := blockUtilInit(t)
+	defer blockUtilShutdown(mockCtrl, ctr)
+
+	tlfID := tlf.FakeID(1, tlf.Private)
+	bps := newBlockPutState(3)
+	ptr1 := BlockPointer{ID: kbfsblock.FakeID(1)}
+	ptr2 := BlockPointer{ID: kbfsblock.FakeID(2)}
+	nonce := kbfsblock.RefNonce([8]byte{1, 2, 3, 4, 5, 6, 7, 8})
+	ptr3 := BlockPointer{
+		ID:      kbfsblock.FakeID(3),
+		Context: kbfsblock.Context{RefNonce: nonce},
+	}
+	readyBlockData := ReadyBlockData{buf: []byte{1, 2, 3, 4}}
+	for _, ptr := range []BlockPointer{ptr1, ptr2, ptr3} {
+		bps.addNewBlock(ptr, NewFileBlock(), readyBlockData, nil)
+	}
+
+	// Only the new blocks are checked, and only the one that the
+	// server doesn't have yet gets put.
+	bserver := existenceCheckingBlockServer{
+		MockBlockServer: mockServer,
+		t:               t,
+		tlfID:           tlfID,
+		contexts: kbfsblock.ContextMap{
+			ptr1.ID: {ptr1.Context},
+			ptr2.ID: {ptr2.Context},
+		},
+		existing: map[kbfsblock.ID]bool{ptr1.ID: true},
+	}
+	mockServer.EXPECT().Put(gomock.Any(), tlfID, ptr2.ID, ptr2.Context,
+		readyBlockData.buf, readyBlockData.serverHalf).Return(nil)
+	mockServer.EXPECT().AddBlockReference(gomock.Any(), tlfID, ptr3.ID,
+		ptr3.Context).Return(nil)
+
+	log := traceLogger{logger.NewTestLogger(t)}
+	_, err := doBlockPuts(ctx, bserver, nil, nil, log, log, tlfID, "", *bps)
+	require.NoError(t, err)
+}
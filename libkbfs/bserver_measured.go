@@ -9,7 +9,6 @@ import (
 	"github.com/keybase/kbfs/kbfsblock"
 	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/tlf"
-	metrics "github.com/rcrowley/go-metrics"
 	"golang.org/x/net/context"
 )
 
@@ -17,26 +16,27 @@ import (
 // also keeps track of stats.
 type BlockServerMeasured struct {
 	delegate                    BlockServer
-	getTimer                    metrics.Timer
-	putTimer                    metrics.Timer
-	putAgainTimer               metrics.Timer
-	addBlockReferenceTimer      metrics.Timer
-	removeBlockReferencesTimer  metrics.Timer
-	archiveBlockReferencesTimer metrics.Timer
-	isUnflushedTimer            metrics.Timer
+	getTimer                    MetricsTimer
+	putTimer                    MetricsTimer
+	putAgainTimer               MetricsTimer
+	addBlockReferenceTimer      MetricsTimer
+	removeBlockReferencesTimer  MetricsTimer
+	archiveBlockReferencesTimer MetricsTimer
+	isUnflushedTimer            MetricsTimer
 }
 
 var _ BlockServer = BlockServerMeasured{}
+var _ blockServerTiered = BlockServerMeasured{}
 
 // NewBlockServerMeasured creates and returns a new
-// BlockServerMeasured instance with the given delegate and registry.
-func NewBlockServerMeasured(delegate BlockServer, r metrics.Registry) BlockServerMeasured {
-	getTimer := metrics.GetOrRegisterTimer("BlockServer.Get", r)
-	putTimer := metrics.GetOrRegisterTimer("BlockServer.Put", r)
-	addBlockReferenceTimer := metrics.GetOrRegisterTimer("BlockServer.AddBlockReference", r)
-	removeBlockReferencesTimer := metrics.GetOrRegisterTimer("BlockServer.RemoveBlockReferences", r)
-	archiveBlockReferencesTimer := metrics.GetOrRegisterTimer("BlockServer.ArchiveBlockReferences", r)
-	isUnflushedTimer := metrics.GetOrRegisterTimer("BlockServer.IsUnflushed", r)
+// BlockServerMeasured instance with the given delegate and metrics sink.
+func NewBlockServerMeasured(delegate BlockServer, r MetricsSink) BlockServerMeasured {
+	getTimer := r.Timer("BlockServer.Get")
+	putTimer := r.Timer("BlockServer.Put")
+	addBlockReferenceTimer := r.Timer("BlockServer.AddBlockReference")
+	removeBlockReferencesTimer := r.Timer("BlockServer.RemoveBlockReferences")
+	archiveBlockReferencesTimer := r.Timer("BlockServer.ArchiveBlockReferences")
+	isUnflushedTimer := r.Timer("BlockServer.IsUnflushed")
 	return BlockServerMeasured{
 		delegate:                    delegate,
 		getTimer:                    getTimer,
@@ -110,6 +110,17 @@ func (b BlockServerMeasured) ArchiveBlockReferences(ctx context.Context,
 	return err
 }
 
+// SetBlockTiers implements the blockServerTiered interface for
+// BlockServerMeasured.  It does nothing if the delegate can't move
+// blocks between tiers.
+func (b BlockServerMeasured) SetBlockTiers(ctx context.Context,
+	tlfID tlf.ID, ids []kbfsblock.ID, tier BlockTier) error {
+	if tiered, ok := b.delegate.(blockServerTiered); ok {
+		return tiered.SetBlockTiers(ctx, tlfID, ids, tier)
+	}
+	return nil
+}
+
 // IsUnflushed implements the BlockServer interface for BlockServerMeasured.
 func (b BlockServerMeasured) IsUnflushed(ctx context.Context, tlfID tlf.ID,
 	id kbfsblock.ID) (isUnflushed bool, err error) {
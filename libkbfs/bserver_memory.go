@@ -33,15 +33,20 @@ type BlockServerMemory struct {
 	lock sync.RWMutex
 	// m is nil after Shutdown() is called.
 	m map[kbfsblock.ID]blockMemEntry
+	// archived holds the blocks that have been moved to the archive
+	// tier.
+	archived map[kbfsblock.ID]bool
 }
 
 var _ blockServerLocal = (*BlockServerMemory)(nil)
+var _ blockServerTiered = (*BlockServerMemory)(nil)
 
 // NewBlockServerMemory constructs a new BlockServerMemory that stores
 // its data in memory.
 func NewBlockServerMemory(log logger.Logger) *BlockServerMemory {
 	return &BlockServerMemory{
 		log, sync.RWMutex{}, make(map[kbfsblock.ID]blockMemEntry),
+		make(map[kbfsblock.ID]bool),
 	}
 }
 
@@ -153,6 +158,7 @@ func (b *BlockServerMemory) doPut(isRegularPut bool, tlfID tlf.ID, id kbfsblock.
 		}
 
 		refs = entry.refs
+		delete(b.archived, id)
 	} else {
 		data := make([]byte, len(buf))
 		copy(data, buf)
@@ -233,6 +239,7 @@ func (b *BlockServerMemory) AddBlockReference(ctx context.Context, tlfID tlf.ID,
 				"been archived and cannot be referenced.", id)}
 	}
 
+	delete(b.archived, id)
 	return entry.refs.put(context, liveBlockRef, "")
 }
 
@@ -266,6 +273,7 @@ func (b *BlockServerMemory) removeBlockReference(
 	count := len(entry.refs)
 	if count == 0 {
 		delete(b.m, id)
+		delete(b.archived, id)
 	}
 	return count, nil
 }
@@ -356,6 +364,47 @@ func (b *BlockServerMemory) ArchiveBlockReferences(ctx context.Context,
 	return nil
 }
 
+// SetBlockTiers implements the blockServerTiered interface for
+// BlockServerMemory.
+func (b *BlockServerMemory) SetBlockTiers(ctx context.Context,
+	tlfID tlf.ID, ids []kbfsblock.ID, tier BlockTier) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	b.log.CDebugf(ctx, "BlockServerMemory.SetBlockTiers tlfID=%s "+
+		"tier=%s ids=%v", tlfID, tier, ids)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.m == nil {
+		return errBlockServerMemoryShutdown
+	}
+
+	for _, id := range ids {
+		entry, ok := b.m[id]
+		if !ok || entry.tlfID != tlfID {
+			continue
+		}
+		if tier == ArchiveBlockTier && !entry.refs.hasNonArchivedRef() {
+			b.archived[id] = true
+		} else if tier == HotBlockTier {
+			delete(b.archived, id)
+		}
+	}
+	return nil
+}
+
+// blockTier returns the tier that the given block is stored on.
+func (b *BlockServerMemory) blockTier(id kbfsblock.ID) BlockTier {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if b.archived[id] {
+		return ArchiveBlockTier
+	}
+	return HotBlockTier
+}
+
 // getAllRefsForTest implements the blockServerLocal interface for
 // BlockServerMemory.
 func (b *BlockServerMemory) getAllRefsForTest(
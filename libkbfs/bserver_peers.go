@@ -0,0 +1,585 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// blockPeerPathPrefix is the HTTP path under which a peer serves
+	// blocks, as /kbfs/blocks/<tlfID>/<blockID>.
+	blockPeerPathPrefix = "/kbfs/blocks/"
+	blockPeerTimeHeader = "X-Kbfs-Peer-Time"
+	blockPeerSigHeader  = "X-Kbfs-Peer-Sig"
+	blockPeerKeyHeader  = "X-Kbfs-Peer-Key"
+	// blockPeerSigPrefix keeps block peer signatures from being valid
+	// in any other context.
+	blockPeerSigPrefix = "kbfs-block-peer-v2"
+	// How long a peer gets to answer a single request before we fall
+	// back to the block server.
+	blockPeerTimeout = 2 * time.Second
+	// How long to stop asking a peer after it fails to answer.
+	blockPeerBackoff = 1 * time.Minute
+	// How far a request timestamp may be from the serving peer's
+	// clock.
+	blockPeerMaxClockSkew = 5 * time.Minute
+)
+
+type ctxBlockPeerTagKey int
+
+const (
+	ctxBlockPeerIDKey ctxBlockPeerTagKey = iota
+
+	ctxBlockPeerID = "BPID"
+)
+
+type blockPeerConfig interface {
+	codecGetter
+	cryptoGetter
+	signerGetter
+	currentSessionGetterGetter
+	diskBlockCacheGetter
+	clockGetter
+	logMaker
+	KBPKI() KBPKI
+}
+
+// errBlockPeerNotFound is returned when a peer doesn't have a
+// requested block cached.
+var errBlockPeerNotFound = errors.New("Block not cached by peer")
+
+// blockPeerResponse is the body of a successful block peer fetch.
+// The block's server half is sealed to the requesting device's crypt
+// key, the same way TLF client halves are, so it never crosses the
+// network in a form anyone but that device can use.
+type blockPeerResponse struct {
+	Buf              []byte
+	EPubKey          kbfscrypto.TLFEphemeralPublicKey
+	SealedServerHalf kbfscrypto.EncryptedTLFCryptKeyClientHalf
+}
+
+// blockPeerCertHash identifies a TLS certificate, so that a device
+// signature can be bound to one end of a TLS connection.
+func blockPeerCertHash(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.Raw)
+	return base64.URLEncoding.EncodeToString(hash[:])
+}
+
+// blockPeerRequestSigMsg is what a requesting device signs.  It
+// covers the requester's own TLS certificate, so the signature can't
+// be replayed over any other connection.
+func blockPeerRequestSigMsg(clientCert string, tlfID tlf.ID,
+	id kbfsblock.ID, t int64, key kbfscrypto.CryptPublicKey) []byte {
+	return []byte(fmt.Sprintf("%s:req:%s:%s:%s:%d:%s",
+		blockPeerSigPrefix, clientCert, tlfID, id, t, key.KID()))
+}
+
+// blockPeerResponseSigMsg is what a serving device signs, binding
+// its own TLS certificate to the requester's.
+func blockPeerResponseSigMsg(serverCert, clientCert string) []byte {
+	return []byte(fmt.Sprintf("%s:resp:%s:%s",
+		blockPeerSigPrefix, serverCert, clientCert))
+}
+
+// makeBlockPeerTLSCert makes a throwaway self-signed certificate for
+// a block peer connection.  Peers don't trust it by itself; each end
+// proves which device it is by signing the certificate's hash with
+// its device key.
+func makeBlockPeerTLSCert(clock Clock) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := clock.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "kbfs block peer"},
+		NotBefore:    now.Add(-blockPeerMaxClockSkew),
+		NotAfter:     now.AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(
+		rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// peerCertHash returns the hash of the certificate the other end of
+// a TLS connection presented.
+func peerCertHash(state *tls.ConnectionState) (string, error) {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return "", errors.New("Block peer connection isn't authenticated")
+	}
+	return blockPeerCertHash(state.PeerCertificates[0]), nil
+}
+
+// checkBlockPeerSig makes sure `sig` is a signature of `msg` by one of
+// the devices of the logged-in user.
+func checkBlockPeerSig(ctx context.Context, config blockPeerConfig,
+	sig string, msg []byte) error {
+	sigBytes, err := base64.URLEncoding.DecodeString(sig)
+	if err != nil {
+		return err
+	}
+	var sigInfo kbfscrypto.SignatureInfo
+	err = config.Codec().Decode(sigBytes, &sigInfo)
+	if err != nil {
+		return err
+	}
+	err = kbfscrypto.Verify(msg, sigInfo)
+	if err != nil {
+		return err
+	}
+	session, err := config.CurrentSessionGetter().GetCurrentSession(ctx)
+	if err != nil {
+		return err
+	}
+	return config.KBPKI().HasVerifyingKey(
+		ctx, session.UID, sigInfo.VerifyingKey, time.Time{})
+}
+
+func signBlockPeerMsg(ctx context.Context, config blockPeerConfig,
+	msg []byte) (string, error) {
+	sigInfo, err := config.Signer().SignForKBFS(ctx, msg)
+	if err != nil {
+		return "", err
+	}
+	sig, err := config.Codec().Encode(sigInfo)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(sig), nil
+}
+
+// BlockServerPeers delegates to another BlockServer, but first tries
+// to fetch blocks from the disk caches of the current user's other
+// devices on the local network.  Peers talk over mutually
+// authenticated TLS: each end signs its TLS certificate with its
+// device key, and only answers a device of the user it's logged in
+// as.  Block server halves are never sent in the clear; each is
+// sealed to the requesting device's crypt key.  It can also serve
+// this device's disk cache to those peers, via Listen.
+type BlockServerPeers struct {
+	BlockServer
+	config   blockPeerConfig
+	log      traceLogger
+	peers    []string
+	cert     tls.Certificate
+	certHash string
+	client   *http.Client
+
+	lock      sync.Mutex
+	downUntil map[string]time.Time
+	server    *http.Server
+}
+
+var _ BlockServer = (*BlockServerPeers)(nil)
+
+// NewBlockServerPeers creates a new BlockServerPeers that tries the
+// given peer addresses (as host:port) before falling back to the
+// given delegate.
+func NewBlockServerPeers(config blockPeerConfig, delegate BlockServer,
+	peers []string) (*BlockServerPeers, error) {
+	cert, err := makeBlockPeerTLSCert(config.Clock())
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{
+		Timeout: blockPeerTimeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				// The serving device is authenticated by its
+				// device signature of this certificate instead.
+				InsecureSkipVerify: true,
+				MinVersion:         tls.VersionTLS12,
+			},
+		},
+	}
+	return &BlockServerPeers{
+		BlockServer: delegate,
+		config:      config,
+		log:         traceLogger{config.MakeLogger("BSP")},
+		peers:       peers,
+		cert:        cert,
+		certHash:    blockPeerCertHash(cert.Leaf),
+		client:      client,
+		downUntil:   make(map[string]time.Time),
+	}, nil
+}
+
+func (b *BlockServerPeers) isPeerDown(peer string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	downUntil, ok := b.downUntil[peer]
+	if !ok {
+		return false
+	}
+	if b.config.Clock().Now().Before(downUntil) {
+		return true
+	}
+	delete(b.downUntil, peer)
+	return false
+}
+
+func (b *BlockServerPeers) markPeerDown(peer string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.downUntil[peer] = b.config.Clock().Now().Add(blockPeerBackoff)
+}
+
+func (b *BlockServerPeers) getFromPeer(ctx context.Context, peer string,
+	tlfID tlf.ID, id kbfsblock.ID) (
+	buf []byte, serverHalf kbfscrypto.BlockCryptKeyServerHalf, err error) {
+	session, err := b.config.KBPKI().GetCurrentSession(ctx)
+	if err != nil {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
+	}
+	t := b.config.Clock().Now().Unix()
+	sig, err := signBlockPeerMsg(ctx, b.config, blockPeerRequestSigMsg(
+		b.certHash, tlfID, id, t, session.CryptPublicKey))
+	if err != nil {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
+	}
+
+	url := fmt.Sprintf("https://%s%s%s/%s", peer, blockPeerPathPrefix, tlfID, id)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
+	}
+	req.Header.Set(blockPeerTimeHeader, strconv.FormatInt(t, 10))
+	req.Header.Set(blockPeerSigHeader, sig)
+	req.Header.Set(blockPeerKeyHeader, session.CryptPublicKey.KID().String())
+	resp, err := b.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, errBlockPeerNotFound
+	default:
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, errors.Errorf(
+			"Unexpected status from peer: %s", resp.Status)
+	}
+
+	// Make sure we're talking to one of our own devices before
+	// trusting anything it says.
+	serverCertHash, err := peerCertHash(resp.TLS)
+	if err != nil {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
+	}
+	err = checkBlockPeerSig(ctx, b.config, resp.Header.Get(blockPeerSigHeader),
+		blockPeerResponseSigMsg(serverCertHash, b.certHash))
+	if err != nil {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
+	}
+	var res blockPeerResponse
+	err = b.config.Codec().Decode(body, &res)
+	if err != nil {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
+	}
+	err = kbfsblock.VerifyID(res.Buf, id)
+	if err != nil {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
+	}
+	unsealed, err := b.config.Crypto().DecryptTLFCryptKeyClientHalf(
+		ctx, res.EPubKey, res.SealedServerHalf)
+	if err != nil {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
+	}
+	return res.Buf, kbfscrypto.MakeBlockCryptKeyServerHalf(
+		unsealed.Data()), nil
+}
+
+// Get implements the BlockServer interface for BlockServerPeers.
+func (b *BlockServerPeers) Get(ctx context.Context, tlfID tlf.ID,
+	id kbfsblock.ID, context kbfsblock.Context) (
+	buf []byte, serverHalf kbfscrypto.BlockCryptKeyServerHalf, err error) {
+	for _, peer := range b.peers {
+		if b.isPeerDown(peer) {
+			continue
+		}
+		buf, serverHalf, err := b.getFromPeer(ctx, peer, tlfID, id)
+		switch {
+		case err == nil:
+			b.log.CDebugf(ctx, "Got block %s from peer %s", id, peer)
+			return buf, serverHalf, nil
+		case errors.Cause(err) == errBlockPeerNotFound:
+			continue
+		case ctx.Err() != nil:
+			// Don't blame the peer for our own cancellation.
+			return nil, kbfscrypto.BlockCryptKeyServerHalf{}, ctx.Err()
+		}
+		b.log.CDebugf(ctx, "Couldn't get block %s from peer %s: %+v",
+			id, peer, err)
+		b.markPeerDown(peer)
+	}
+	return b.BlockServer.Get(ctx, tlfID, id, context)
+}
+
+// Listen starts serving this device's disk block cache to the
+// current user's other devices, on the given address.  It returns
+// the address actually being listened on.
+func (b *BlockServerPeers) Listen(addr string) (net.Addr, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{
+		Handler: &blockPeerHandler{
+			config:   b.config,
+			log:      b.log,
+			certHash: b.certHash,
+		},
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{b.cert},
+			// The requesting device is authenticated by its device
+			// signature of this certificate instead.
+			ClientAuth: tls.RequireAnyClientCert,
+			MinVersion: tls.VersionTLS12,
+		},
+	}
+	func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		b.server = server
+	}()
+	b.log.Debug("Serving cached blocks to peers on %s", listener.Addr())
+	go func() {
+		err := server.ServeTLS(listener, "", "")
+		if err != http.ErrServerClosed {
+			b.log.Warning("Block peer server stopped: %+v", err)
+		}
+	}()
+	return listener.Addr(), nil
+}
+
+// Shutdown implements the BlockServer interface for BlockServerPeers.
+func (b *BlockServerPeers) Shutdown(ctx context.Context) {
+	server := func() *http.Server {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		server := b.server
+		b.server = nil
+		return server
+	}()
+	if server != nil {
+		if err := server.Close(); err != nil {
+			b.log.CDebugf(ctx, "Couldn't close peer server: %+v", err)
+		}
+	}
+	b.BlockServer.Shutdown(ctx)
+}
+
+// blockPeerHandler answers block requests from the current user's
+// other devices, out of the disk block cache.
+type blockPeerHandler struct {
+	config   blockPeerConfig
+	log      traceLogger
+	certHash string
+}
+
+// checkRequest makes sure the request was signed recently, over this
+// TLS connection, by a device belonging to the logged-in user.  It
+// returns that device's crypt key, to seal the server half to.
+func (h *blockPeerHandler) checkRequest(ctx context.Context,
+	r *http.Request, tlfID tlf.ID, id kbfsblock.ID) (
+	clientCertHash string, key kbfscrypto.CryptPublicKey, err error) {
+	clientCertHash, err = peerCertHash(r.TLS)
+	if err != nil {
+		return "", kbfscrypto.CryptPublicKey{}, err
+	}
+	t, err := strconv.ParseInt(r.Header.Get(blockPeerTimeHeader), 10, 64)
+	if err != nil {
+		return "", kbfscrypto.CryptPublicKey{}, err
+	}
+	skew := h.config.Clock().Now().Sub(time.Unix(t, 0))
+	if skew > blockPeerMaxClockSkew || skew < -blockPeerMaxClockSkew {
+		return "", kbfscrypto.CryptPublicKey{}, errors.Errorf(
+			"Request time is off by %s", skew)
+	}
+	kid, err := keybase1.KIDFromStringChecked(
+		r.Header.Get(blockPeerKeyHeader))
+	if err != nil {
+		return "", kbfscrypto.CryptPublicKey{}, err
+	}
+	key = kbfscrypto.MakeCryptPublicKey(kid)
+
+	err = checkBlockPeerSig(ctx, h.config, r.Header.Get(blockPeerSigHeader),
+		blockPeerRequestSigMsg(clientCertHash, tlfID, id, t, key))
+	if err != nil {
+		return "", kbfscrypto.CryptPublicKey{}, err
+	}
+
+	session, err := h.config.CurrentSessionGetter().GetCurrentSession(ctx)
+	if err != nil {
+		return "", kbfscrypto.CryptPublicKey{}, err
+	}
+	keys, err := h.config.KBPKI().GetCryptPublicKeys(ctx, session.UID)
+	if err != nil {
+		return "", kbfscrypto.CryptPublicKey{}, err
+	}
+	for _, k := range keys {
+		if k.KID().Equal(kid) {
+			return clientCertHash, key, nil
+		}
+	}
+	return "", kbfscrypto.CryptPublicKey{}, errors.Errorf(
+		"%s isn't a crypt key of the logged-in user", kid)
+}
+
+// sealServerHalf encrypts a block's server half to the given device
+// crypt key, the same way TLF client halves are.
+func sealServerHalf(key kbfscrypto.CryptPublicKey,
+	serverHalf kbfscrypto.BlockCryptKeyServerHalf) (
+	kbfscrypto.TLFEphemeralPublicKey,
+	kbfscrypto.EncryptedTLFCryptKeyClientHalf, error) {
+	ePubKey, ePrivKey, err := kbfscrypto.MakeRandomTLFEphemeralKeys()
+	if err != nil {
+		return kbfscrypto.TLFEphemeralPublicKey{},
+			kbfscrypto.EncryptedTLFCryptKeyClientHalf{}, err
+	}
+	sealed, err := kbfscrypto.EncryptTLFCryptKeyClientHalf(
+		ePrivKey, key, kbfscrypto.MakeTLFCryptKeyClientHalf(
+			serverHalf.Data()))
+	if err != nil {
+		return kbfscrypto.TLFEphemeralPublicKey{},
+			kbfscrypto.EncryptedTLFCryptKeyClientHalf{}, err
+	}
+	return ePubKey, sealed, nil
+}
+
+func (h *blockPeerHandler) parsePath(path string) (
+	tlfID tlf.ID, id kbfsblock.ID, err error) {
+	parts := strings.Split(strings.TrimPrefix(path, blockPeerPathPrefix), "/")
+	if !strings.HasPrefix(path, blockPeerPathPrefix) || len(parts) != 2 {
+		return tlf.NullID, kbfsblock.ID{}, errors.Errorf(
+			"Bad block peer path: %s", path)
+	}
+	tlfID, err = tlf.ParseID(parts[0])
+	if err != nil {
+		return tlf.NullID, kbfsblock.ID{}, err
+	}
+	id, err = kbfsblock.IDFromString(parts[1])
+	if err != nil {
+		return tlf.NullID, kbfsblock.ID{}, err
+	}
+	return tlfID, id, nil
+}
+
+func (h *blockPeerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := CtxWithRandomIDReplayable(
+		context.Background(), ctxBlockPeerIDKey, ctxBlockPeerID, h.log)
+	if r.Method != "GET" {
+		http.Error(w, "Bad method", http.StatusMethodNotAllowed)
+		return
+	}
+	tlfID, id, err := h.parsePath(r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	clientCertHash, key, err := h.checkRequest(ctx, r, tlfID, id)
+	if err != nil {
+		h.log.CDebugf(ctx, "Rejecting request for %s from %s: %+v",
+			id, r.RemoteAddr, err)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	dbc := h.config.DiskBlockCache()
+	if dbc == nil {
+		http.NotFound(w, r)
+		return
+	}
+	buf, serverHalf, _, err := dbc.Get(ctx, tlfID, id)
+	if _, ok := errors.Cause(err).(NoSuchBlockError); ok {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		h.log.CDebugf(ctx, "Couldn't get %s from the disk cache: %+v",
+			id, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	ePubKey, sealed, err := sealServerHalf(key, serverHalf)
+	if err != nil {
+		h.log.CDebugf(ctx, "Couldn't seal the server half of %s: %+v",
+			id, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	body, err := h.config.Codec().Encode(blockPeerResponse{
+		Buf:              buf,
+		EPubKey:          ePubKey,
+		SealedServerHalf: sealed,
+	})
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	sig, err := signBlockPeerMsg(ctx, h.config,
+		blockPeerResponseSigMsg(h.certHash, clientCertHash))
+	if err != nil {
+		h.log.CDebugf(ctx, "Couldn't sign the response for %s: %+v",
+			id, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(blockPeerSigHeader, sig)
+	h.log.CDebugf(ctx, "Serving block %s to %s", id, r.RemoteAddr)
+	_, err = w.Write(body)
+	if err != nil {
+		h.log.CDebugf(ctx, "Couldn't write block %s: %+v", id, err)
+	}
+}
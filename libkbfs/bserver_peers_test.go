@@ -0,0 +1,133 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func makeBlockPeerTestBlock(t *testing.T, data []byte) (
+	kbfsblock.ID, kbfsblock.Context, kbfscrypto.BlockCryptKeyServerHalf) {
+	id, err := kbfsblock.MakePermanentID(data)
+	require.NoError(t, err)
+	bCtx := kbfsblock.MakeFirstContext(
+		keybase1.MakeTestUID(1).AsUserOrTeam(), keybase1.BlockType_DATA)
+	serverHalf, err := kbfscrypto.MakeRandomBlockCryptKeyServerHalf()
+	require.NoError(t, err)
+	return id, bCtx, serverHalf
+}
+
+func TestBlockServerPeersGet(t *testing.T) {
+	ctx := context.Background()
+	config := MakeTestConfigOrBust(t, "u1", "u2")
+	defer CheckConfigAndShutdown(ctx, t, config)
+	// The config shuts the cache down.
+	cache, _ := initDiskBlockCacheTest(t)
+	config.diskBlockCache = cache
+
+	t.Log("Serve the disk cache of u1's device")
+	server, err := NewBlockServerPeers(config, config.BlockServer(), nil)
+	require.NoError(t, err)
+	defer server.Shutdown(ctx)
+	addr, err := server.Listen("127.0.0.1:0")
+	require.NoError(t, err)
+
+	tlfID := tlf.FakeID(1, tlf.Private)
+	cachedData := []byte{1, 2, 3, 4}
+	cachedID, cachedCtx, cachedServerHalf := makeBlockPeerTestBlock(
+		t, cachedData)
+	err = cache.Put(ctx, tlfID, cachedID, cachedData, cachedServerHalf)
+	require.NoError(t, err)
+
+	bserverData := []byte{5, 6, 7, 8}
+	bserverID, bserverCtx, bserverServerHalf := makeBlockPeerTestBlock(
+		t, bserverData)
+	err = config.BlockServer().Put(ctx, tlfID, bserverID, bserverCtx,
+		bserverData, bserverServerHalf)
+	require.NoError(t, err)
+
+	// The client's Shutdown would shut down the shared block
+	// server, so don't call it.
+	client, err := NewBlockServerPeers(
+		config, config.BlockServer(), []string{addr.String()})
+	require.NoError(t, err)
+
+	t.Log("A block cached by the peer comes from the peer")
+	buf, serverHalf, err := client.Get(ctx, tlfID, cachedID, cachedCtx)
+	require.NoError(t, err)
+	require.Equal(t, cachedData, buf)
+	require.Equal(t, cachedServerHalf, serverHalf)
+
+	t.Log("Other blocks come from the block server")
+	buf, serverHalf, err = client.Get(ctx, tlfID, bserverID, bserverCtx)
+	require.NoError(t, err)
+	require.Equal(t, bserverData, buf)
+	require.Equal(t, bserverServerHalf, serverHalf)
+	require.False(t, client.isPeerDown(addr.String()))
+
+	t.Log("The peer refuses other users' devices")
+	config2 := ConfigAsUser(config, "u2")
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	client2, err := NewBlockServerPeers(
+		config2, config2.BlockServer(), []string{addr.String()})
+	require.NoError(t, err)
+	_, _, err = client2.Get(ctx, tlfID, cachedID, cachedCtx)
+	require.Error(t, err)
+	require.True(t, client2.isPeerDown(addr.String()))
+
+	t.Log("The peer doesn't speak plain HTTP")
+	resp, err := http.Get(fmt.Sprintf("http://%s%s%s/%s",
+		addr, blockPeerPathPrefix, tlfID, cachedID))
+	if err == nil {
+		resp.Body.Close()
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	}
+
+	t.Log("A request signature can't be used over another connection")
+	session, err := config.KBPKI().GetCurrentSession(ctx)
+	require.NoError(t, err)
+	now := config.Clock().Now().Unix()
+	sig, err := signBlockPeerMsg(ctx, config, blockPeerRequestSigMsg(
+		client.certHash, tlfID, cachedID, now, session.CryptPublicKey))
+	require.NoError(t, err)
+	other, err := NewBlockServerPeers(
+		config, config.BlockServer(), []string{addr.String()})
+	require.NoError(t, err)
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://%s%s%s/%s",
+		addr, blockPeerPathPrefix, tlfID, cachedID), nil)
+	require.NoError(t, err)
+	req.Header.Set(blockPeerTimeHeader, strconv.FormatInt(now, 10))
+	req.Header.Set(blockPeerSigHeader, sig)
+	req.Header.Set(blockPeerKeyHeader, session.CryptPublicKey.KID().String())
+	resp, err = other.client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	t.Log("The server half is sealed to the requesting device")
+	sig, err = signBlockPeerMsg(ctx, config, blockPeerRequestSigMsg(
+		other.certHash, tlfID, cachedID, now, session.CryptPublicKey))
+	require.NoError(t, err)
+	req.Header.Set(blockPeerSigHeader, sig)
+	resp, err = other.client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(body, cachedServerHalf.Bytes()))
+}
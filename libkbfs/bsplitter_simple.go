@@ -11,6 +11,14 @@ import (
 	"strconv"
 
 	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/tlf"
+)
+
+const (
+	// minTlfBlockSizeBytes and maxTlfBlockSizeBytes bound the block
+	// sizes that can be chosen for a single TLF.
+	minTlfBlockSizeBytes = 64 << 10
+	maxTlfBlockSizeBytes = 4 << 20
 )
 
 // BlockSplitterSimple implements the BlockSplitter interface by using
@@ -20,6 +28,7 @@ type BlockSplitterSimple struct {
 	maxPtrsPerBlock         int
 	blockChangeEmbedMaxSize uint64
 	maxDirEntriesPerBlock   int
+	dirHashBuckets          int
 }
 
 func getMaxDirEntriesPerBlock() (int, error) {
@@ -34,6 +43,18 @@ func getMaxDirEntriesPerBlock() (int, error) {
 	return 0, nil // disabled by default
 }
 
+func getDirHashBuckets() (int, error) {
+	bucketsEnv := os.Getenv("KEYBASE_BSPLIT_DIR_HASH_BUCKETS")
+	if len(bucketsEnv) > 0 {
+		dirHashBuckets, err := strconv.Atoi(bucketsEnv)
+		if err != nil {
+			return 0, err
+		}
+		return dirHashBuckets, nil
+	}
+	return 0, nil // disabled by default
+}
+
 // NewBlockSplitterSimple creates a new BlockSplittleSimple and
 // adjusts the max size to try to match the desired size for file
 // blocks, given the overhead of encoding a file block and the
@@ -104,11 +125,17 @@ func NewBlockSplitterSimple(desiredBlockSize int64,
 		return nil, err
 	}
 
+	dirHashBuckets, err := getDirHashBuckets()
+	if err != nil {
+		return nil, err
+	}
+
 	return &BlockSplitterSimple{
 		maxSize:                 maxSize,
 		maxPtrsPerBlock:         maxPtrs,
 		blockChangeEmbedMaxSize: blockChangeEmbedMaxSize,
 		maxDirEntriesPerBlock:   maxDirEntriesPerBlock,
+		dirHashBuckets:          dirHashBuckets,
 	}, nil
 }
 
@@ -201,3 +228,83 @@ func (b *BlockSplitterSimple) SplitDirIfNeeded(block *DirBlock) (
 	newOffset := StringOffset(names[startOff])
 	return []*DirBlock{block, newBlock}, &newOffset
 }
+
+// DirHashBuckets implements the BlockSplitter interface for
+// BlockSplitterSimple.
+func (b *BlockSplitterSimple) DirHashBuckets() int {
+	return b.dirHashBuckets
+}
+
+// SetDirHashBuckets sets the number of hash buckets the top block of
+// a large directory is sharded into, overriding the
+// KEYBASE_BSPLIT_DIR_HASH_BUCKETS environment variable.
+func (b *BlockSplitterSimple) SetDirHashBuckets(buckets int) {
+	b.dirHashBuckets = buckets
+}
+
+// newSizedBlockSplitter returns a block splitter that aims for
+// encoded file blocks of `size` bytes, and otherwise behaves like the
+// default block splitter of `config`.
+func newSizedBlockSplitter(config Config, size int64) (
+	*BlockSplitterSimple, error) {
+	if size < minTlfBlockSizeBytes || size > maxTlfBlockSizeBytes {
+		return nil, fmt.Errorf("Block size %d is not between %d and %d",
+			size, minTlfBlockSizeBytes, maxTlfBlockSizeBytes)
+	}
+
+	var blockChangeEmbedMaxSize uint64 = 8 * 1024
+	bss, isSimple := config.BlockSplitter().(*BlockSplitterSimple)
+	if isSimple {
+		blockChangeEmbedMaxSize = bss.blockChangeEmbedMaxSize
+	}
+	bsplit, err := NewBlockSplitterSimple(
+		size, blockChangeEmbedMaxSize, config.Codec())
+	if err != nil {
+		return nil, err
+	}
+	if isSimple {
+		// Only file blocks change size; directories are still split
+		// the same way as everywhere else.
+		bsplit.maxDirEntriesPerBlock = bss.maxDirEntriesPerBlock
+		bsplit.dirHashBuckets = bss.dirHashBuckets
+	}
+	return bsplit, nil
+}
+
+// setTlfMaxBlockSize gives the TLF `tlfID` its own block splitter,
+// which aims for encoded file blocks of `size` bytes.  If `size` is
+// 0, the TLF reverts to the default block splitter.  This only
+// changes the splitter of this process; the size itself lives in the
+// TLF's MD (see `KBFSOps.SetTlfBlockSize`), which applies it here
+// whenever a new head arrives.
+func setTlfMaxBlockSize(config Config, tlfID tlf.ID, size int64) error {
+	if size == 0 {
+		config.SetTlfBlockSplitter(tlfID, nil)
+		return nil
+	}
+	bsplit, err := newSizedBlockSplitter(config, size)
+	if err != nil {
+		return err
+	}
+	config.SetTlfBlockSplitter(tlfID, bsplit)
+	return nil
+}
+
+// adaptiveBlockSize returns the block size to record for a file that
+// doesn't have one yet, when a write or truncate grows it from
+// `oldSize` to `newSize` bytes.  It returns 0 while the file still
+// fits in one small block, since its layout is the same either way,
+// and for files that already grew past that without a block size.
+// A file that grows by appending to its end is treated as a stream
+// and gets large blocks; one that grows by skipping past its end, as
+// databases and disk images tend to, gets small blocks, so that its
+// random writes dirty less data.
+func adaptiveBlockSize(oldSize, newSize uint64, isAppend bool) int64 {
+	if newSize <= minTlfBlockSizeBytes || oldSize > minTlfBlockSizeBytes {
+		return 0
+	}
+	if isAppend {
+		return maxTlfBlockSizeBytes
+	}
+	return minTlfBlockSizeBytes
+}
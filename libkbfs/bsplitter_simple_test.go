@@ -9,11 +9,13 @@ import (
 	"testing"
 
 	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/tlf"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
 )
 
 func TestBsplitterEmptyCopyAll(t *testing.T) {
-	bsplit := &BlockSplitterSimple{10, 5, 10, 0}
+	bsplit := &BlockSplitterSimple{10, 5, 10, 0, 0}
 	fblock := NewFileBlock().(*FileBlock)
 	data := []byte{1, 2, 3, 4, 5}
 
@@ -25,7 +27,7 @@ func TestBsplitterEmptyCopyAll(t *testing.T) {
 }
 
 func TestBsplitterNonemptyCopyAll(t *testing.T) {
-	bsplit := &BlockSplitterSimple{10, 5, 10, 0}
+	bsplit := &BlockSplitterSimple{10, 5, 10, 0, 0}
 	fblock := NewFileBlock().(*FileBlock)
 	fblock.Contents = []byte{10, 9}
 	data := []byte{1, 2, 3, 4, 5}
@@ -38,7 +40,7 @@ func TestBsplitterNonemptyCopyAll(t *testing.T) {
 }
 
 func TestBsplitterAppendAll(t *testing.T) {
-	bsplit := &BlockSplitterSimple{10, 5, 10, 0}
+	bsplit := &BlockSplitterSimple{10, 5, 10, 0, 0}
 	fblock := NewFileBlock().(*FileBlock)
 	fblock.Contents = []byte{10, 9}
 	data := []byte{1, 2, 3, 4, 5}
@@ -51,7 +53,7 @@ func TestBsplitterAppendAll(t *testing.T) {
 }
 
 func TestBsplitterAppendExact(t *testing.T) {
-	bsplit := &BlockSplitterSimple{10, 5, 10, 0}
+	bsplit := &BlockSplitterSimple{10, 5, 10, 0, 0}
 	fblock := NewFileBlock().(*FileBlock)
 	fblock.Contents = []byte{10, 9, 8, 7, 6}
 	data := []byte{1, 2, 3, 4, 5}
@@ -65,7 +67,7 @@ func TestBsplitterAppendExact(t *testing.T) {
 }
 
 func TestBsplitterSplitOne(t *testing.T) {
-	bsplit := &BlockSplitterSimple{10, 5, 10, 0}
+	bsplit := &BlockSplitterSimple{10, 5, 10, 0, 0}
 	fblock := NewFileBlock().(*FileBlock)
 	fblock.Contents = []byte{10, 9, 8, 7, 6}
 	data := []byte{1, 2, 3, 4, 5, 6}
@@ -79,7 +81,7 @@ func TestBsplitterSplitOne(t *testing.T) {
 }
 
 func TestBsplitterOverwriteMaxSizeBlock(t *testing.T) {
-	bsplit := &BlockSplitterSimple{5, 5, 10, 0}
+	bsplit := &BlockSplitterSimple{5, 5, 10, 0, 0}
 	fblock := NewFileBlock().(*FileBlock)
 	fblock.Contents = []byte{10, 9, 8, 7, 6}
 	data := []byte{1, 2, 3, 4, 5, 6, 7, 8}
@@ -92,7 +94,7 @@ func TestBsplitterOverwriteMaxSizeBlock(t *testing.T) {
 }
 
 func TestBsplitterBlockTooBig(t *testing.T) {
-	bsplit := &BlockSplitterSimple{3, 5, 10, 0}
+	bsplit := &BlockSplitterSimple{3, 5, 10, 0, 0}
 	fblock := NewFileBlock().(*FileBlock)
 	fblock.Contents = []byte{10, 9, 8, 7, 6}
 	data := []byte{1, 2, 3, 4, 5, 6}
@@ -105,7 +107,7 @@ func TestBsplitterBlockTooBig(t *testing.T) {
 }
 
 func TestBsplitterOffTooBig(t *testing.T) {
-	bsplit := &BlockSplitterSimple{10, 5, 10, 0}
+	bsplit := &BlockSplitterSimple{10, 5, 10, 0, 0}
 	fblock := NewFileBlock().(*FileBlock)
 	fblock.Contents = []byte{10, 9, 8, 7, 6}
 	data := []byte{1, 2, 3, 4, 5, 6}
@@ -119,7 +121,7 @@ func TestBsplitterOffTooBig(t *testing.T) {
 }
 
 func TestBsplitterShouldEmbed(t *testing.T) {
-	bsplit := &BlockSplitterSimple{10, 5, 10, 0}
+	bsplit := &BlockSplitterSimple{10, 5, 10, 0, 0}
 	bc := &BlockChanges{}
 	bc.sizeEstimate = 1
 	if !bsplit.ShouldEmbedBlockChanges(bc) {
@@ -132,7 +134,7 @@ func TestBsplitterShouldEmbed(t *testing.T) {
 }
 
 func TestBsplitterShouldNotEmbed(t *testing.T) {
-	bsplit := &BlockSplitterSimple{10, 5, 10, 0}
+	bsplit := &BlockSplitterSimple{10, 5, 10, 0, 0}
 	bc := &BlockChanges{}
 	bc.sizeEstimate = 11
 	if bsplit.ShouldEmbedBlockChanges(bc) {
@@ -171,7 +173,7 @@ func TestBsplitterOverhead(t *testing.T) {
 }
 
 func TestBsplitterSplitDir(t *testing.T) {
-	bsplit := &BlockSplitterSimple{10, 5, 10, 2}
+	bsplit := &BlockSplitterSimple{10, 5, 10, 2, 0}
 	dblock := NewDirBlock().(*DirBlock)
 	dblock.Children["a"] = DirEntry{}
 	dblock.Children["b"] = DirEntry{}
@@ -221,3 +223,30 @@ func TestBsplitterSplitDir(t *testing.T) {
 	require.Nil(t, newOffset)
 	require.Equal(t, smallerBlocks[1], noSplits[0])
 }
+
+func TestSetTlfMaxBlockSize(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "u1")
+	defer CheckConfigAndShutdown(context.Background(), t, config)
+	id1 := tlf.FakeID(1, tlf.Private)
+	id2 := tlf.FakeID(2, tlf.Private)
+
+	t.Log("Only the configured TLF gets its own splitter")
+	err := setTlfMaxBlockSize(config, id1, 64<<10)
+	require.NoError(t, err)
+	bsplit, ok := config.TlfBlockSplitter(id1).(*BlockSplitterSimple)
+	require.True(t, ok)
+	require.True(t, bsplit.maxSize < 64<<10)
+	require.Equal(t, config.BlockSplitter(), config.TlfBlockSplitter(id2))
+
+	t.Log("Out-of-range sizes are rejected")
+	err = setTlfMaxBlockSize(config, id1, 1<<10)
+	require.Error(t, err)
+	err = setTlfMaxBlockSize(config, id1, 64<<20)
+	require.Error(t, err)
+	require.Equal(t, bsplit, config.TlfBlockSplitter(id1))
+
+	t.Log("A zero size reverts to the default splitter")
+	err = setTlfMaxBlockSize(config, id1, 0)
+	require.NoError(t, err)
+	require.Equal(t, config.BlockSplitter(), config.TlfBlockSplitter(id1))
+}
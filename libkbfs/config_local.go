@@ -6,6 +6,7 @@ package libkbfs
 
 import (
 	"flag"
+	"math"
 	"os"
 	"path/filepath"
 	"strings"
@@ -54,10 +55,27 @@ const (
 	bgFlushDirOpBatchSizeDefault = 100
 	// bgFlushPeriodDefault is the default for how long to wait for a
 	// batch to fill up before syncing a set of changes to the servers.
-	bgFlushPeriodDefault         = 1 * time.Second
+	bgFlushPeriodDefault = 1 * time.Second
+	// dirtyFileMaxAgeDefault is the default for how long a file may
+	// stay dirty before a background sync is forced.
+	dirtyFileMaxAgeDefault = 30 * time.Second
+	// maxSymlinkDepthDefault is the default for how many symlinks
+	// may be followed while resolving a single path.
+	maxSymlinkDepthDefault = 40 // same as Linux
+	// crBlockBudgetDefault is the default for how many bytes of
+	// readied blocks conflict resolution may keep in memory.
+	crBlockBudgetDefault = 64 << 20
+	// debugLogBufferDurationDefault is the default for how long to
+	// keep log messages in memory for each TLF.
+	debugLogBufferDurationDefault = 10 * time.Minute
+	// debugLogBufferEntriesDefault is the default maximum number of
+	// log messages kept in memory for each TLF.
+	debugLogBufferEntriesDefault = 5000
 	keyBundlesCacheCapacityBytes = 10 * cache.MB
 	// folder name for persisted config parameters.
 	syncedTlfConfigFolderName = "synced_tlf_config"
+	// folder name for the writer keys verified while online.
+	verifiedKeysConfigFolderName = "kbfs_verified_keys"
 
 	// By default, this will be the block type given to all blocks
 	// that aren't explicitly some other type.
@@ -85,6 +103,8 @@ type ConfigLocal struct {
 	bops             BlockOps
 	mdserv           MDServer
 	bserv            BlockServer
+	publicFetcher    BlockFetcher
+	verifier         *mdVerifier
 	keyserv          KeyServer
 	service          KeybaseService
 	bsplit           BlockSplitter
@@ -94,7 +114,15 @@ type ConfigLocal struct {
 	renamer          ConflictRenamer
 	userHistory      *kbfsedits.UserHistory
 	registry         metrics.Registry
+	metricsSink      MetricsSink
+	trafficLog       *BlockTrafficLog
+	readNotifs       *ReadNotificationFilter
+	syncOutbox       *SyncOutbox
+	idleTracker      *IdleTracker
+	powerMonitor     *PowerMonitor
+	prefetchBudget   *PrefetchBudget
 	loggerFn         func(prefix string) logger.Logger
+	logLevels        *LogLevels
 	noBGFlush        bool // logic opposite so the default value is the common setting
 	rwpWaitTime      time.Duration
 	diskLimiter      DiskLimiter
@@ -122,6 +150,43 @@ type ConfigLocal struct {
 	// tlfValidDuration is the time TLFs are valid before redoing identification.
 	tlfValidDuration time.Duration
 
+	// newFileExecMode is the default mode for choosing the exec bit
+	// on new files, and tlfNewFileExecModes holds per-TLF overrides.
+	newFileExecMode     NewFileExecMode
+	tlfNewFileExecModes map[tlf.ID]NewFileExecMode
+
+	// orderedWrites is the default ordered-writes setting, and
+	// tlfOrderedWrites holds per-TLF overrides.
+	orderedWrites    bool
+	tlfOrderedWrites map[tlf.ID]bool
+
+	// tlfBlockSplitters holds per-TLF overrides of bsplit.
+	tlfBlockSplitters map[tlf.ID]BlockSplitter
+
+	// adaptiveBlockSizes is the default adaptive-block-sizes
+	// setting, and tlfAdaptiveBlockSizes holds per-TLF overrides.
+	adaptiveBlockSizes    bool
+	tlfAdaptiveBlockSizes map[tlf.ID]bool
+
+	// metadataSyncedTlfs holds the TLFs whose directory tree (but not
+	// file contents) is kept eagerly prefetched.
+	metadataSyncedTlfs map[tlf.ID]bool
+
+	// blockLockProfiler records contention on the block locks of all
+	// TLFs, when enabled.
+	blockLockProfiler *LockProfiler
+
+	// earlyBlockUpload indicates whether complete file blocks should
+	// be put to the server before the file is synced.
+	earlyBlockUpload bool
+
+	// fsyncMode indicates when an fsync through a mount returns.
+	fsyncMode FsyncMode
+
+	// timestampMode indicates how strictly file and directory times
+	// follow POSIX.
+	timestampMode TimestampMode
+
 	// bgFlushDirOpBatchSize indicates how many directory operations
 	// should be batched together in a single background flush.
 	bgFlushDirOpBatchSize int
@@ -130,6 +195,30 @@ type ConfigLocal struct {
 	// before syncing a set of changes to the servers.
 	bgFlushPeriod time.Duration
 
+	// dirtyFileMaxAge indicates how long a file may stay dirty before
+	// a background sync is forced.
+	dirtyFileMaxAge time.Duration
+
+	// maxFileBytes, if non-zero, overrides the maximum file size
+	// supported by the current data version, and tlfMaxFileBytes
+	// holds per-TLF overrides.
+	maxFileBytes    uint64
+	tlfMaxFileBytes map[tlf.ID]uint64
+
+	// maxDirEntries, if non-zero, limits the number of entries in
+	// a single directory, and tlfMaxDirEntries holds per-TLF
+	// overrides.
+	maxDirEntries    int
+	tlfMaxDirEntries map[tlf.ID]int
+
+	// maxSymlinkDepth is the maximum number of symlinks followed
+	// while resolving a single path.
+	maxSymlinkDepth int
+
+	// crBlockBudget limits the bytes of readied blocks conflict
+	// resolution keeps in memory.
+	crBlockBudget int64
+
 	// metadataVersion is the version to use when creating new metadata.
 	metadataVersion kbfsmd.MetadataVer
 
@@ -180,6 +269,163 @@ func (m *DiskCacheMode) Set(s string) error {
 	return nil
 }
 
+// NewFileExecMode indicates how the executable bit of a newly-created
+// file is chosen.
+type NewFileExecMode int
+
+var _ flag.Value = (*NewFileExecMode)(nil)
+
+const (
+	// NewFileExecFromRequest means the new file is executable only
+	// if the creator asked for it to be.
+	NewFileExecFromRequest NewFileExecMode = iota
+	// NewFileExecNever means new files are never executable.
+	NewFileExecNever
+	// NewFileExecAlways means new files are always executable.
+	NewFileExecAlways
+	// NewFileExecInherit means a new file is executable if the
+	// creator asked for it to be, or if its parent directory already
+	// contains files and all of them are executable.
+	NewFileExecInherit
+)
+
+// String outputs a human-readable description of this NewFileExecMode.
+func (m NewFileExecMode) String() string {
+	switch m {
+	case NewFileExecFromRequest:
+		return "request"
+	case NewFileExecNever:
+		return "never"
+	case NewFileExecAlways:
+		return "always"
+	case NewFileExecInherit:
+		return "inherit"
+	}
+	return "unknown"
+}
+
+// Set parses a string representing a new file exec mode, and outputs
+// the mode value corresponding to that string.  An empty string
+// means NewFileExecFromRequest.
+func (m *NewFileExecMode) Set(s string) error {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "request":
+		*m = NewFileExecFromRequest
+	case "never":
+		*m = NewFileExecNever
+	case "always":
+		*m = NewFileExecAlways
+	case "inherit":
+		*m = NewFileExecInherit
+	default:
+		return errors.Errorf("Unknown new file exec mode %q", s)
+	}
+	return nil
+}
+
+// FsyncMode indicates when an fsync of a file in a KBFS mount
+// returns.
+type FsyncMode int
+
+var _ flag.Value = (*FsyncMode)(nil)
+
+const (
+	// FsyncJournalDurable means an fsync returns once all the dirty
+	// data in the TLF has been synced into a new revision.  If the
+	// TLF journal is enabled, that revision has only been written to
+	// the local journal, and it is flushed to the servers in the
+	// background; otherwise it is already on the servers.  This is
+	// the default.
+	FsyncJournalDurable FsyncMode = iota
+	// FsyncServerDurable means an fsync also waits for the TLF
+	// journal, if any, to flush everything to the servers, so that
+	// the data is safe even if this device is lost.
+	FsyncServerDurable
+)
+
+// String outputs a human-readable description of this FsyncMode.
+func (m FsyncMode) String() string {
+	switch m {
+	case FsyncJournalDurable:
+		return "journal"
+	case FsyncServerDurable:
+		return "server"
+	}
+	return "unknown"
+}
+
+// Set parses a string representing an fsync mode, and outputs the
+// mode value corresponding to that string.  An empty string means
+// FsyncJournalDurable; any other unknown string is an error.
+func (m *FsyncMode) Set(s string) error {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "journal":
+		*m = FsyncJournalDurable
+	case "server":
+		*m = FsyncServerDurable
+	default:
+		return errors.Errorf("Unknown fsync mode %q", s)
+	}
+	return nil
+}
+
+// TimestampMode indicates how strictly the mtimes, ctimes, and atimes
+// of files and directories follow POSIX.
+type TimestampMode int
+
+var _ flag.Value = (*TimestampMode)(nil)
+
+const (
+	// TimestampsRelaxed skips a few timestamp updates that POSIX
+	// requires, but that would make common operations slower or
+	// noisier: no-op chmods and same-size truncates don't touch the
+	// file's times, zero-length writes do, explicitly-set ctimes are
+	// kept, and atimes aren't tracked.  This is the default.
+	TimestampsRelaxed TimestampMode = iota
+	// TimestampsPOSIX follows POSIX for mtimes and ctimes.
+	TimestampsPOSIX
+	// TimestampsPOSIXWithAtime also tracks the atime of each node in
+	// memory, updating it on every non-empty read and directory
+	// listing.  Atimes aren't persisted, so they're lost once a node
+	// is forgotten or the process restarts.
+	TimestampsPOSIXWithAtime
+)
+
+// String outputs a human-readable description of this TimestampMode.
+func (m TimestampMode) String() string {
+	switch m {
+	case TimestampsRelaxed:
+		return "relaxed"
+	case TimestampsPOSIX:
+		return "posix"
+	case TimestampsPOSIXWithAtime:
+		return "posix-atime"
+	}
+	return "unknown"
+}
+
+// Set parses a string representing a timestamp mode, and outputs the
+// mode value corresponding to that string.  An empty string means
+// TimestampsRelaxed; any other unknown string is an error.
+func (m *TimestampMode) Set(s string) error {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "relaxed":
+		*m = TimestampsRelaxed
+	case "posix":
+		*m = TimestampsPOSIX
+	case "posix-atime":
+		*m = TimestampsPOSIXWithAtime
+	default:
+		return errors.Errorf("Unknown timestamp mode %q", s)
+	}
+	return nil
+}
+
+// strict returns true if `m` follows POSIX for mtimes and ctimes.
+func (m TimestampMode) strict() bool {
+	return m == TimestampsPOSIX || m == TimestampsPOSIXWithAtime
+}
+
 var _ Config = (*ConfigLocal)(nil)
 
 // LocalUser represents a fake KBFS user, useful for testing.
@@ -408,6 +654,7 @@ func NewConfigLocal(mode InitMode,
 	kbCtx Context) *ConfigLocal {
 	config := &ConfigLocal{
 		loggerFn:      loggerFn,
+		logLevels:     NewLogLevels(keybase1.LogLevel_DEBUG),
 		storageRoot:   storageRoot,
 		mode:          mode,
 		diskCacheMode: diskCacheMode,
@@ -416,6 +663,7 @@ func NewConfigLocal(mode InitMode,
 	if diskCacheMode == DiskCacheModeLocal {
 		config.loadSyncedTlfsLocked()
 	}
+	config.loadMDVerifier()
 	config.SetClock(wallClock{})
 	config.SetReporter(NewReporterSimple(config.Clock(), 10))
 	config.SetConflictRenamer(WriterDeviceDateConflictRenamer{config})
@@ -425,6 +673,7 @@ func NewConfigLocal(mode InitMode,
 	config.SetRekeyQueue(NewRekeyQueueStandard(config))
 	config.SetUserHistory(kbfsedits.NewUserHistory())
 
+	config.blockLockProfiler = NewLockProfiler()
 	config.maxNameBytes = maxNameBytesDefault
 	config.maxDirBytes = maxDirBytesDefault
 	config.rwpWaitTime = rekeyWithPromptWaitTimeDefault
@@ -440,6 +689,15 @@ func NewConfigLocal(mode InitMode,
 	config.tlfValidDuration = tlfValidDurationDefault
 	config.bgFlushDirOpBatchSize = bgFlushDirOpBatchSizeDefault
 	config.bgFlushPeriod = bgFlushPeriodDefault
+	config.dirtyFileMaxAge = dirtyFileMaxAgeDefault
+	config.maxSymlinkDepth = maxSymlinkDepthDefault
+	config.crBlockBudget = crBlockBudgetDefault
+	config.trafficLog = NewBlockTrafficLog(config)
+	config.readNotifs = NewReadNotificationFilter(config)
+	config.syncOutbox = NewSyncOutbox(config)
+	config.idleTracker = NewIdleTracker(config)
+	config.powerMonitor = NewPowerMonitor(config)
+	config.prefetchBudget = NewPrefetchBudget(config)
 	config.metadataVersion = defaultClientMetadataVer
 	config.defaultBlockType = defaultBlockTypeDefault
 	config.quotaUsage =
@@ -730,6 +988,20 @@ func (c *ConfigLocal) SetBlockServer(b BlockServer) {
 	c.bserv = b
 }
 
+// PublicBlockFetcher implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) PublicBlockFetcher() BlockFetcher {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.publicFetcher
+}
+
+// SetPublicBlockFetcher implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetPublicBlockFetcher(f BlockFetcher) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.publicFetcher = f
+}
+
 // KeyServer implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) KeyServer() KeyServer {
 	c.lock.RLock()
@@ -772,6 +1044,30 @@ func (c *ConfigLocal) SetBlockSplitter(b BlockSplitter) {
 	c.bsplit = b
 }
 
+// TlfBlockSplitter implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) TlfBlockSplitter(tlfID tlf.ID) BlockSplitter {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if b, ok := c.tlfBlockSplitters[tlfID]; ok {
+		return b
+	}
+	return c.bsplit
+}
+
+// SetTlfBlockSplitter implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetTlfBlockSplitter(tlfID tlf.ID, b BlockSplitter) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if b == nil {
+		delete(c.tlfBlockSplitters, tlfID)
+		return
+	}
+	if c.tlfBlockSplitters == nil {
+		c.tlfBlockSplitters = make(map[tlf.ID]BlockSplitter)
+	}
+	c.tlfBlockSplitters[tlfID] = b
+}
+
 // Notifier implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) Notifier() Notifier {
 	c.lock.RLock()
@@ -930,6 +1226,98 @@ func (c *ConfigLocal) MaxDirBytes() uint64 {
 	return c.maxDirBytes
 }
 
+// maxFileBytesForDataVer returns the largest file size that can be
+// addressed by files of the given data version.
+func maxFileBytesForDataVer(ver DataVer, bsplit BlockSplitter) uint64 {
+	if ver < AtLeastTwoLevelsOfChildrenDataVer {
+		// The top block may only point directly to data blocks.
+		return uint64(bsplit.MaxPtrsPerBlock()) * MaxBlockSizeBytesDefault
+	}
+	// File offsets are stored as Int64Offsets.
+	return math.MaxInt64
+}
+
+// MaxFileBytes implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) MaxFileBytes(tlfID tlf.ID) uint64 {
+	c.lock.RLock()
+	maxBytes, ok := c.tlfMaxFileBytes[tlfID]
+	if !ok {
+		maxBytes = c.maxFileBytes
+	}
+	c.lock.RUnlock()
+	if maxBytes != 0 {
+		return maxBytes
+	}
+	return maxFileBytesForDataVer(
+		c.DataVersion(), c.TlfBlockSplitter(tlfID))
+}
+
+// SetMaxFileBytes implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetMaxFileBytes(tlfID tlf.ID, maxBytes uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if tlfID == tlf.NullID {
+		c.maxFileBytes = maxBytes
+		return
+	}
+	if c.tlfMaxFileBytes == nil {
+		c.tlfMaxFileBytes = make(map[tlf.ID]uint64)
+	}
+	c.tlfMaxFileBytes[tlfID] = maxBytes
+}
+
+// MaxDirEntries implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) MaxDirEntries(tlfID tlf.ID) int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if maxEntries, ok := c.tlfMaxDirEntries[tlfID]; ok {
+		return maxEntries
+	}
+	return c.maxDirEntries
+}
+
+// SetMaxDirEntries implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetMaxDirEntries(tlfID tlf.ID, maxEntries int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if tlfID == tlf.NullID {
+		c.maxDirEntries = maxEntries
+		return
+	}
+	if c.tlfMaxDirEntries == nil {
+		c.tlfMaxDirEntries = make(map[tlf.ID]int)
+	}
+	c.tlfMaxDirEntries[tlfID] = maxEntries
+}
+
+// MaxSymlinkDepth implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) MaxSymlinkDepth() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.maxSymlinkDepth
+}
+
+// SetMaxSymlinkDepth implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetMaxSymlinkDepth(depth int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.maxSymlinkDepth = depth
+}
+
+// CRBlockBudget implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) CRBlockBudget() int64 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.crBlockBudget
+}
+
+// SetCRBlockBudget implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetCRBlockBudget(budget int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.crBlockBudget = budget
+}
+
 // StorageRoot implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) StorageRoot() string {
 	return c.storageRoot
@@ -953,9 +1341,17 @@ func (c *ConfigLocal) resetCachesWithoutShutdown() DirtyBlockCache {
 		log.Debug("setting clean block cache capacity based on existing value %d",
 			capacity)
 	}
-	c.bcache = NewBlockCacheStandard(10000, capacity)
+	bcache := NewBlockCacheStandard(10000, capacity)
+	bcache.clock = c.clock
+	if oldBcache, ok := c.bcache.(*BlockCacheStandard); ok {
+		bcache.copyLifetimePolicies(oldBcache)
+	}
+	c.bcache = bcache
 
 	if !c.Mode().DirtyBlockCacheEnabled() {
+		// Reads still check the dirty block cache, so give them an
+		// empty one.
+		c.dirtyBcache = emptyDirtyBlockCache{}
 		return nil
 	}
 
@@ -1014,7 +1410,13 @@ func (c *ConfigLocal) ResetCaches() {
 func (c *ConfigLocal) MakeLogger(module string) logger.Logger {
 	// No need to lock since c.loggerFn is initialized once at
 	// construction. Also resetCachesWithoutShutdown would deadlock.
-	return c.loggerFn(module)
+	return newLeveledLogger(c.loggerFn(module), module, c.logLevels)
+}
+
+// LogLevels returns the per-module log levels for all loggers made
+// by this config, which can be changed at runtime.
+func (c *ConfigLocal) LogLevels() *LogLevels {
+	return c.logLevels
 }
 
 // MetricsRegistry implements the Config interface for ConfigLocal.
@@ -1037,6 +1439,52 @@ func (c *ConfigLocal) SetMetricsRegistry(r metrics.Registry) {
 	c.registry = r
 }
 
+// MetricsSink implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) MetricsSink() MetricsSink {
+	if c.metricsSink != nil {
+		return c.metricsSink
+	}
+	if c.registry != nil {
+		return NewGoMetricsSink(c.registry)
+	}
+	return nil
+}
+
+// SetMetricsSink implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetMetricsSink(s MetricsSink) {
+	c.metricsSink = s
+}
+
+// BlockTrafficLog implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) BlockTrafficLog() *BlockTrafficLog {
+	return c.trafficLog
+}
+
+// ReadNotifications implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) ReadNotifications() *ReadNotificationFilter {
+	return c.readNotifs
+}
+
+// SyncOutbox implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SyncOutbox() *SyncOutbox {
+	return c.syncOutbox
+}
+
+// IdleTracker implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) IdleTracker() *IdleTracker {
+	return c.idleTracker
+}
+
+// PowerMonitor implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) PowerMonitor() *PowerMonitor {
+	return c.powerMonitor
+}
+
+// PrefetchBudget implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) PrefetchBudget() *PrefetchBudget {
+	return c.prefetchBudget
+}
+
 // SetTraceOptions implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) SetTraceOptions(enabled bool) {
 	c.traceLock.Lock()
@@ -1097,6 +1545,129 @@ func (c *ConfigLocal) BGFlushDirOpBatchSize() int {
 	return c.bgFlushDirOpBatchSize
 }
 
+// SetNewFileExecMode implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetNewFileExecMode(
+	tlfID tlf.ID, mode NewFileExecMode) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if tlfID == tlf.NullID {
+		c.newFileExecMode = mode
+		return
+	}
+	if c.tlfNewFileExecModes == nil {
+		c.tlfNewFileExecModes = make(map[tlf.ID]NewFileExecMode)
+	}
+	c.tlfNewFileExecModes[tlfID] = mode
+}
+
+// NewFileExecMode implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) NewFileExecMode(tlfID tlf.ID) NewFileExecMode {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if mode, ok := c.tlfNewFileExecModes[tlfID]; ok {
+		return mode
+	}
+	return c.newFileExecMode
+}
+
+// SetOrderedWrites implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetOrderedWrites(tlfID tlf.ID, ordered bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if tlfID == tlf.NullID {
+		c.orderedWrites = ordered
+		return
+	}
+	if c.tlfOrderedWrites == nil {
+		c.tlfOrderedWrites = make(map[tlf.ID]bool)
+	}
+	c.tlfOrderedWrites[tlfID] = ordered
+}
+
+// OrderedWrites implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) OrderedWrites(tlfID tlf.ID) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if ordered, ok := c.tlfOrderedWrites[tlfID]; ok {
+		return ordered
+	}
+	return c.orderedWrites
+}
+
+// SetAdaptiveBlockSizes implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetAdaptiveBlockSizes(tlfID tlf.ID, adaptive bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if tlfID == tlf.NullID {
+		c.adaptiveBlockSizes = adaptive
+		return
+	}
+	if c.tlfAdaptiveBlockSizes == nil {
+		c.tlfAdaptiveBlockSizes = make(map[tlf.ID]bool)
+	}
+	c.tlfAdaptiveBlockSizes[tlfID] = adaptive
+}
+
+// AdaptiveBlockSizes implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) AdaptiveBlockSizes(tlfID tlf.ID) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if adaptive, ok := c.tlfAdaptiveBlockSizes[tlfID]; ok {
+		return adaptive
+	}
+	return c.adaptiveBlockSizes
+}
+
+// BlockLockProfiler implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) BlockLockProfiler() *LockProfiler {
+	return c.blockLockProfiler
+}
+
+// EarlyBlockUploadEnabled implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) EarlyBlockUploadEnabled() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.earlyBlockUpload
+}
+
+// SetEarlyBlockUploadEnabled implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetEarlyBlockUploadEnabled(enabled bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.earlyBlockUpload = enabled
+}
+
+// FsyncMode implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) FsyncMode() FsyncMode {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.fsyncMode
+}
+
+// SetFsyncMode implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetFsyncMode(mode FsyncMode) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.fsyncMode = mode
+}
+
+// TimestampMode implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) TimestampMode() TimestampMode {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.timestampMode
+}
+
+// SetTimestampMode implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetTimestampMode(mode TimestampMode) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.timestampMode = mode
+}
+
 // SetBGFlushPeriod implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) SetBGFlushPeriod(p time.Duration) {
 	c.lock.Lock()
@@ -1111,6 +1682,20 @@ func (c *ConfigLocal) BGFlushPeriod() time.Duration {
 	return c.bgFlushPeriod
 }
 
+// SetDirtyFileMaxAge implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetDirtyFileMaxAge(age time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.dirtyFileMaxAge = age
+}
+
+// DirtyFileMaxAge implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) DirtyFileMaxAge() time.Duration {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.dirtyFileMaxAge
+}
+
 // Shutdown implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) Shutdown(ctx context.Context) error {
 	c.RekeyQueue().Shutdown()
@@ -1118,7 +1703,7 @@ func (c *ConfigLocal) Shutdown(ctx context.Context) error {
 		// Before we do anything, wait for all archiving and
 		// journaling to finish.
 		for _, config := range *c.allKnownConfigsForTesting {
-			kbfsOps, ok := config.KBFSOps().(*KBFSOpsStandard)
+			kbfsOps, ok := standardKBFSOps(config.KBFSOps())
 			if !ok {
 				continue
 			}
@@ -1184,6 +1769,11 @@ func (c *ConfigLocal) Shutdown(ctx context.Context) error {
 	if kbfsServ != nil {
 		kbfsServ.Shutdown()
 	}
+	c.mdVerifier().shutdown()
+	err = c.trafficLog.Shutdown()
+	if err != nil {
+		errorList = append(errorList, err)
+	}
 
 	if len(errorList) == 1 {
 		return errorList[0]
@@ -1288,7 +1878,7 @@ func (c *ConfigLocal) EnableJournaling(
 	// TODO: Sanity-check the root directory, e.g. create
 	// it if it doesn't exist, make sure that it doesn't
 	// point to /keybase itself, etc.
-	log := c.MakeLogger("")
+	log := c.MakeLogger("JS")
 	branchListener := c.KBFSOps().(branchChangeListener)
 	flushListener := c.KBFSOps().(mdFlushListener)
 
@@ -1379,6 +1969,34 @@ func (c *ConfigLocal) openConfigLevelDB(configName string) (*levelDb, error) {
 	return openLevelDB(stor)
 }
 
+// loadMDVerifier sets up the MD verifier, backed by the keys
+// verified during previous runs unless this is a test.
+func (c *ConfigLocal) loadMDVerifier() {
+	log := c.MakeLogger("MDV")
+	var db *levelDb
+	if !c.IsTestMode() && c.storageRoot != "" {
+		var err error
+		db, err = c.openConfigLevelDB(verifiedKeysConfigFolderName)
+		if err != nil {
+			log.Warning("Couldn't open the verified key db; offline "+
+				"verification will be limited to this run: %+v", err)
+			db = nil
+		}
+	}
+	c.verifier = newMDVerifier(log, db)
+}
+
+// mdVerifier implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) mdVerifier() *mdVerifier {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.verifier == nil {
+		// Configs not made by NewConfigLocal only verify in memory.
+		c.verifier = newMDVerifier(c.MakeLogger("MDV"), nil)
+	}
+	return c.verifier
+}
+
 func (c *ConfigLocal) loadSyncedTlfsLocked() (err error) {
 	syncedTlfs := make(map[tlf.ID]bool)
 	if c.IsTestMode() {
@@ -1461,6 +2079,35 @@ func (c *ConfigLocal) SetTlfSyncState(tlfID tlf.ID, isSynced bool) error {
 	return nil
 }
 
+// IsMetadataSyncedTlf implements the syncedTlfGetterSetter interface
+// for ConfigLocal.
+func (c *ConfigLocal) IsMetadataSyncedTlf(tlfID tlf.ID) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.metadataSyncedTlfs[tlfID]
+}
+
+// SetTlfMetadataSyncState implements the Config interface for
+// ConfigLocal.  When set, the prefetcher eagerly fetches all the
+// directory blocks in the TLF, but leaves file contents to be fetched
+// on demand.  Unlike the full sync state, this setting isn't
+// persisted across restarts.
+func (c *ConfigLocal) SetTlfMetadataSyncState(
+	tlfID tlf.ID, isSynced bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.metadataSyncedTlfs == nil {
+		c.metadataSyncedTlfs = make(map[tlf.ID]bool)
+	}
+	if isSynced {
+		c.metadataSyncedTlfs[tlfID] = true
+	} else {
+		delete(c.metadataSyncedTlfs, tlfID)
+	}
+	<-c.bops.TogglePrefetcher(true)
+	return nil
+}
+
 // PrefetchStatus implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) PrefetchStatus(ctx context.Context, tlfID tlf.ID,
 	ptr BlockPointer) PrefetchStatus {
@@ -7,6 +7,7 @@ package libkbfs
 import (
 	"github.com/golang/mock/gomock"
 	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/kbfs/kbfscodec"
 	"github.com/keybase/kbfs/kbfsedits"
 	"golang.org/x/net/context"
@@ -71,6 +72,7 @@ func NewConfigMock(c *gomock.Controller, ctr *SafeTestReporter) *ConfigMock {
 			loggerFn: func(m string) logger.Logger {
 				return logger.NewTestLogger(ctr.t)
 			},
+			logLevels: NewLogLevels(keybase1.LogLevel_DEBUG),
 		},
 	}
 	config.mockKbfs = NewMockKBFSOps(c)
@@ -131,6 +133,7 @@ func NewConfigMock(c *gomock.Controller, ctr *SafeTestReporter) *ConfigMock {
 
 	config.maxNameBytes = maxNameBytesDefault
 	config.maxDirBytes = maxDirBytesDefault
+	config.maxSymlinkDepth = maxSymlinkDepthDefault
 	config.rwpWaitTime = rekeyWithPromptWaitTimeDefault
 
 	config.SetMetadataVersion(defaultClientMetadataVer)
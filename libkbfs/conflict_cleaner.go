@@ -0,0 +1,259 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"fmt"
+	pathpkg "path"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// conflictedNameRegexp matches names made by
+// WriterDeviceDateConflictRenamer.ConflictRenameHelper, capturing the
+// original base name and extension.
+var conflictedNameRegexp = regexp.MustCompile(
+	`^(.+)\.conflicted \(.+'s .+ copy \d{4}-\d{2}-\d{2}\)(.*)$`)
+
+// conflictedCopyOriginal returns the name that a conflicted copy
+// named `name` was made from, or false if `name` doesn't look like
+// a conflicted copy.
+func conflictedCopyOriginal(name string) (string, bool) {
+	m := conflictedNameRegexp.FindStringSubmatch(name)
+	if m == nil {
+		return "", false
+	}
+	return m[1] + m[2], true
+}
+
+// ConflictCleanupPolicy describes which conflicted copies of files,
+// as named by WriterDeviceDateConflictRenamer, should be pruned by
+// CleanConflictedCopies.
+type ConflictCleanupPolicy struct {
+	// Retention, if non-zero, prunes copies last changed longer
+	// ago than this.
+	Retention time.Duration
+	// PruneIdentical prunes copies whose contents are identical to
+	// the file with the original name in the same directory.
+	PruneIdentical bool
+}
+
+// ConflictCleanupReason is why a conflicted copy was pruned.
+type ConflictCleanupReason int
+
+const (
+	// ConflictCleanupExpired means the copy is older than the
+	// retention period.
+	ConflictCleanupExpired ConflictCleanupReason = iota + 1
+	// ConflictCleanupIdentical means the copy is identical to the
+	// surviving version.
+	ConflictCleanupIdentical
+)
+
+func (r ConflictCleanupReason) String() string {
+	switch r {
+	case ConflictCleanupExpired:
+		return "expired"
+	case ConflictCleanupIdentical:
+		return "identical"
+	default:
+		return fmt.Sprintf("ConflictCleanupReason(%d)", int(r))
+	}
+}
+
+// ConflictCleanupAction describes a conflicted copy that was pruned
+// by CleanConflictedCopies, or that would have been in a dry run.
+type ConflictCleanupAction struct {
+	// RelPath is the slash-separated path of the copy, relative to
+	// the cleaned directory.
+	RelPath string
+	Reason  ConflictCleanupReason
+}
+
+// conflictCleaner applies a ConflictCleanupPolicy under one
+// directory.
+type conflictCleaner struct {
+	kbfsOps KBFSOps
+	policy  ConflictCleanupPolicy
+	now     time.Time
+	root    Node
+	dirs    map[string]Node
+	// files maps the relative path of every file seen by the walk
+	// to its entry.
+	files map[string]DirEntry
+}
+
+// getDir returns the node for the directory at `relPath`, looking up
+// and caching each component as needed.
+func (cc *conflictCleaner) getDir(
+	ctx context.Context, relPath string) (Node, error) {
+	if relPath == "." {
+		return cc.root, nil
+	}
+	if n, ok := cc.dirs[relPath]; ok {
+		return n, nil
+	}
+	parent, err := cc.getDir(ctx, pathpkg.Dir(relPath))
+	if err != nil {
+		return nil, err
+	}
+	n, _, err := cc.kbfsOps.Lookup(ctx, parent, pathpkg.Base(relPath))
+	if err != nil {
+		return nil, err
+	}
+	cc.dirs[relPath] = n
+	return n, nil
+}
+
+// sameContents returns true if the files `a` and `b`, of sizes given
+// by their entries, have identical contents.
+func (cc *conflictCleaner) sameContents(ctx context.Context,
+	a Node, aDe DirEntry, b Node, bDe DirEntry) (bool, error) {
+	if aDe.Size != bDe.Size {
+		return false, nil
+	}
+	if aDe.ID == bDe.ID {
+		return true, nil
+	}
+
+	const chunkSize = 1 << 20
+	aBuf := make([]byte, chunkSize)
+	bBuf := make([]byte, chunkSize)
+	for off := int64(0); off < int64(aDe.Size); {
+		aN, err := cc.kbfsOps.Read(ctx, a, aBuf, off)
+		if err != nil {
+			return false, err
+		}
+		bN, err := cc.kbfsOps.Read(ctx, b, bBuf, off)
+		if err != nil {
+			return false, err
+		}
+		if !bytes.Equal(aBuf[:aN], bBuf[:bN]) {
+			return false, nil
+		}
+		if aN == 0 {
+			break
+		}
+		off += aN
+	}
+	return true, nil
+}
+
+// check returns the reason the conflicted copy at `relPath` should
+// be pruned, or 0 if it should be kept.
+func (cc *conflictCleaner) check(ctx context.Context, parent Node,
+	relPath string, de DirEntry, original string) (
+	ConflictCleanupReason, error) {
+	if cc.policy.Retention > 0 &&
+		cc.now.Sub(time.Unix(0, de.Ctime)) > cc.policy.Retention {
+		return ConflictCleanupExpired, nil
+	}
+	if !cc.policy.PruneIdentical {
+		return 0, nil
+	}
+
+	origPath := pathpkg.Join(pathpkg.Dir(relPath), original)
+	origDe, ok := cc.files[origPath]
+	if !ok {
+		return 0, nil
+	}
+	node, _, err := cc.kbfsOps.Lookup(ctx, parent, pathpkg.Base(relPath))
+	if err != nil {
+		return 0, err
+	}
+	origNode, _, err := cc.kbfsOps.Lookup(ctx, parent, original)
+	if _, ok := errors.Cause(err).(NoSuchNameError); ok {
+		// The original was removed after the walk.
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	same, err := cc.sameContents(ctx, node, de, origNode, origDe)
+	if err != nil {
+		return 0, err
+	}
+	if !same {
+		return 0, nil
+	}
+	return ConflictCleanupIdentical, nil
+}
+
+// CleanConflictedCopies prunes the conflicted copies of files under
+// `dir` (recursively) that match `policy`, if the logged-in user has
+// write permission to the top-level folder.  If `dryRun` is true,
+// nothing is removed.  Either way, it returns the copies that were
+// (or would be) pruned, sorted by path.
+func CleanConflictedCopies(ctx context.Context, config Config, dir Node,
+	policy ConflictCleanupPolicy, dryRun bool) (
+	[]ConflictCleanupAction, error) {
+	kbfsOps := config.KBFSOps()
+
+	type candidate struct {
+		relPath  string
+		de       DirEntry
+		original string
+	}
+	var lock sync.Mutex
+	var candidates []candidate
+	files := make(map[string]DirEntry)
+	err := kbfsOps.WalkTLF(ctx, dir, func(relPath string, de DirEntry) error {
+		if de.Type != File && de.Type != Exec {
+			return nil
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if policy.PruneIdentical {
+			files[relPath] = de
+		}
+		original, ok := conflictedCopyOriginal(pathpkg.Base(relPath))
+		if ok {
+			candidates = append(candidates, candidate{relPath, de, original})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].relPath < candidates[j].relPath
+	})
+
+	cc := &conflictCleaner{
+		kbfsOps: kbfsOps,
+		policy:  policy,
+		now:     config.Clock().Now(),
+		root:    dir,
+		dirs:    make(map[string]Node),
+		files:   files,
+	}
+	var actions []ConflictCleanupAction
+	for _, c := range candidates {
+		parent, err := cc.getDir(ctx, pathpkg.Dir(c.relPath))
+		if err != nil {
+			return actions, err
+		}
+		reason, err := cc.check(ctx, parent, c.relPath, c.de, c.original)
+		if err != nil {
+			return actions, err
+		}
+		if reason == 0 {
+			continue
+		}
+		if !dryRun {
+			err := kbfsOps.RemoveEntry(ctx, parent, pathpkg.Base(c.relPath))
+			if err != nil {
+				return actions, err
+			}
+		}
+		actions = append(actions, ConflictCleanupAction{c.relPath, reason})
+	}
+	return actions, nil
+}
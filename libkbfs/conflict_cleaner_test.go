@@ -0,0 +1,97 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConflictedCopyOriginal(t *testing.T) {
+	cr := WriterDeviceDateConflictRenamer{}
+	now := time.Now()
+	for _, name := range []string{"a.txt", "noext", "b.tar.gz", ".hidden"} {
+		copyName := cr.ConflictRenameHelper(now, "u1", "dev (1)", name)
+		original, ok := conflictedCopyOriginal(copyName)
+		require.True(t, ok, copyName)
+		require.Equal(t, name, original)
+	}
+	_, ok := conflictedCopyOriginal("a.conflicted.txt")
+	require.False(t, ok)
+}
+
+func TestCleanConflictedCopies(t *testing.T) {
+	ctx := BackgroundContextWithCancellationDelayer()
+	defer CleanupCancellationDelayer(ctx)
+	config := MakeTestConfigOrBust(t, "u1")
+	defer CheckConfigAndShutdown(ctx, t, config)
+	clock := newTestClockNow()
+	config.SetClock(clock)
+	kbfsOps := config.KBFSOps()
+
+	t.Log("Make some originals and conflicted copies")
+	cr := WriterDeviceDateConflictRenamer{}
+	copyName := func(name string) string {
+		return cr.ConflictRenameHelper(clock.Now(), "u1", "dev", name)
+	}
+	root := "/keybase/private/u1"
+	sameName := copyName("same.txt")
+	diffName := copyName("diff.txt")
+	orphanName := copyName("orphan.txt")
+	files := map[string][]byte{
+		"same.txt":            {1, 2, 3},
+		"d/" + sameName:       {1, 2, 3},
+		"d/same.txt":          {1, 2, 3},
+		sameName:              {1, 2, 3},
+		"diff.txt":            {1, 2, 3},
+		diffName:              {1, 2, 4},
+		orphanName:            {5},
+		"plain.conflicted.go": {6},
+	}
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	_, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	for p, data := range files {
+		err := kbfsOps.WriteFileAt(ctx, root+"/"+p, data)
+		require.NoError(t, err)
+	}
+
+	t.Log("A dry run prunes only identical copies")
+	policy := ConflictCleanupPolicy{
+		Retention:      24 * time.Hour,
+		PruneIdentical: true,
+	}
+	actions, err := CleanConflictedCopies(ctx, config, rootNode, policy, true)
+	require.NoError(t, err)
+	require.Equal(t, []ConflictCleanupAction{
+		{"d/" + sameName, ConflictCleanupIdentical},
+		{sameName, ConflictCleanupIdentical},
+	}, actions)
+	children, err := kbfsOps.ListAt(ctx, root)
+	require.NoError(t, err)
+	require.Contains(t, children, sameName)
+
+	t.Log("After the retention period, everything goes")
+	clock.Add(25 * time.Hour)
+	policy.PruneIdentical = false
+	actions, err = CleanConflictedCopies(ctx, config, rootNode, policy, false)
+	require.NoError(t, err)
+	require.Equal(t, []ConflictCleanupAction{
+		{"d/" + sameName, ConflictCleanupExpired},
+		{diffName, ConflictCleanupExpired},
+		{orphanName, ConflictCleanupExpired},
+		{sameName, ConflictCleanupExpired},
+	}, actions)
+	children, err = kbfsOps.ListAt(ctx, root)
+	require.NoError(t, err)
+	require.Len(t, children, 4)
+	for _, name := range []string{
+		"same.txt", "diff.txt", "plain.conflicted.go", "d"} {
+		require.Contains(t, children, name)
+	}
+}
@@ -72,6 +72,10 @@ type ConflictResolver struct {
 	currCancel    context.CancelFunc
 	lockNextTime  bool
 	canceledCount int
+	// committing is set while the current resolution is putting its
+	// MD.  Local writes made then don't cancel it, since they are
+	// handed off to the resolved branch instead.
+	committing bool
 }
 
 // NewConflictResolver constructs a new ConflictResolver (and launches
@@ -84,8 +88,8 @@ func NewConflictResolver(
 		branchSuffix = " " + string(fbo.branch())
 	}
 	tlfStringFull := fbo.id().String()
-	log := config.MakeLogger(fmt.Sprintf("CR %s%s", tlfStringFull[:8],
-		branchSuffix))
+	log := logWithTlfID(config.MakeLogger(fmt.Sprintf("CR %s%s",
+		tlfStringFull[:8], branchSuffix)), fbo.id())
 
 	cr := &ConflictResolver{
 		config: config,
@@ -152,11 +156,35 @@ func (cr *ConflictResolver) cancelExistingLocked(ci conflictInput) bool {
 func (cr *ConflictResolver) ForceCancel() {
 	cr.inputLock.Lock()
 	defer cr.inputLock.Unlock()
+	if cr.committing {
+		return
+	}
 	if cr.currCancel != nil {
 		cr.currCancel()
 	}
 }
 
+// beginCommit marks the resolution running under `ctx` as committing,
+// so that ForceCancel leaves it alone, unless it has already been
+// canceled.  endCommit must be called once the MD put is done.
+func (cr *ConflictResolver) beginCommit(ctx context.Context) error {
+	cr.inputLock.Lock()
+	defer cr.inputLock.Unlock()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	cr.committing = true
+	return nil
+}
+
+func (cr *ConflictResolver) endCommit() {
+	cr.inputLock.Lock()
+	defer cr.inputLock.Unlock()
+	cr.committing = false
+}
+
 // processInput processes conflict resolution jobs from the given
 // channel until it is closed. This function uses a parameter for the
 // channel instead of accessing cr.inputChan directly so that it
@@ -178,6 +206,12 @@ func (cr *ConflictResolver) processInput(baseCtx context.Context,
 	}()
 	for ci := range inputChan {
 		ctx := CtxWithRandomIDReplayable(baseCtx, CtxCRIDKey, CtxCROpID, cr.log)
+		ctx = NewContextReplayable(ctx, func(ctx context.Context) context.Context {
+			return CtxWithLogFields(ctx, LogFields{
+				TlfID: cr.fbo.id(),
+				Op:    "CR",
+			})
+		})
 
 		valid := func() bool {
 			cr.inputLock.Lock()
@@ -3086,6 +3120,11 @@ func (cr *ConflictResolver) completeResolution(ctx context.Context,
 		}
 	}
 
+	// Don't hold more readied blocks in memory than the budget
+	// allows; the prepper spills the rest to the disk block cache.
+	budget := newCRBlockBudget(cr.config, cr.fbo.id())
+	cr.prepper.budget = budget
+	defer func() { cr.prepper.budget = nil }()
 	updates, bps, blocksToDelete, err := cr.prepper.prepUpdateForPaths(
 		ctx, lState, md, unmergedChains, mergedChains,
 		mostRecentUnmergedMD, mostRecentMergedMD, resolvedPaths, lbc,
@@ -3114,10 +3153,7 @@ func (cr *ConflictResolver) completeResolution(ctx context.Context,
 		return err
 	}
 
-	// Put all the blocks.  TODO: deal with recoverable block errors?
-	_, err = doBlockPuts(ctx, cr.config.BlockServer(), cr.config.BlockCache(),
-		cr.config.Reporter(), cr.log, cr.deferLog, md.TlfID(),
-		md.GetTlfHandle().GetCanonicalName(), *bps)
+	err = cr.putResolvedBlocks(ctx, md, bps, budget)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,186 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// crBlockBudget keeps track of how many bytes of readied blocks a
+// single conflict resolution holds in memory.  Once the budget is
+// used up, the data of each newly-readied block is moved into the
+// disk block cache until it's time to put it, and the block's
+// plaintext is dropped from the resolution's blockPutState.
+type crBlockBudget struct {
+	budget int64
+	dbc    DiskBlockCache
+	tlfID  tlf.ID
+
+	lock     sync.Mutex
+	inMemory int64
+	// dropped maps each block whose plaintext was dropped to its
+	// encoded size.
+	dropped map[BlockPointer]int
+	// spilled holds the IDs of the blocks whose data is waiting in
+	// the disk block cache.
+	spilled map[kbfsblock.ID]bool
+}
+
+// newCRBlockBudget returns a budget for one resolution of `tlfID`,
+// or nil if `Config.CRBlockBudget()` is unlimited.  If there is no
+// disk block cache, everything stays in memory, and the budget is
+// only used to log how far over it a resolution went.
+func newCRBlockBudget(config Config, tlfID tlf.ID) *crBlockBudget {
+	budget := config.CRBlockBudget()
+	if budget <= 0 {
+		return nil
+	}
+	return &crBlockBudget{
+		budget:  budget,
+		dbc:     config.DiskBlockCache(),
+		tlfID:   tlfID,
+		dropped: make(map[BlockPointer]int),
+		spilled: make(map[kbfsblock.ID]bool),
+	}
+}
+
+// admit accounts for the newly-readied block `ptr`.  If it doesn't
+// fit in the budget, its data is spilled to the disk block cache and
+// the returned ReadyBlockData holds no data.  The returned bool is
+// true if the caller should drop the block's plaintext.
+func (b *crBlockBudget) admit(ctx context.Context, ptr BlockPointer,
+	readyBlockData ReadyBlockData) (ReadyBlockData, bool, error) {
+	size := readyBlockData.GetEncodedSize()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.inMemory+int64(size) <= b.budget || b.dbc == nil {
+		b.inMemory += int64(size)
+		return readyBlockData, false, nil
+	}
+
+	b.dropped[ptr] = size
+	if !ptr.IsFirstRef() {
+		// Only a new reference to an existing block will be put, so
+		// the data isn't needed.
+		return ReadyBlockData{}, true, nil
+	}
+	err := b.dbc.Put(ctx, b.tlfID, ptr.ID, readyBlockData.buf,
+		readyBlockData.serverHalf)
+	if err != nil {
+		return ReadyBlockData{}, false, err
+	}
+	b.spilled[ptr.ID] = true
+	return ReadyBlockData{}, true, nil
+}
+
+// droppedSize returns the encoded size of `ptr`, if its plaintext
+// was dropped.
+func (b *crBlockBudget) droppedSize(ptr BlockPointer) (int, bool) {
+	if b == nil {
+		return 0, false
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	size, ok := b.dropped[ptr]
+	return size, ok
+}
+
+// isSpilled returns whether the data of `ptr` is in the disk block
+// cache.
+func (b *crBlockBudget) isSpilled(ptr BlockPointer) bool {
+	if b == nil {
+		return false
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return ptr.IsFirstRef() && b.spilled[ptr.ID]
+}
+
+// numSpilled returns how many blocks were spilled.
+func (b *crBlockBudget) numSpilled() int {
+	if b == nil {
+		return 0
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.spilled)
+}
+
+// putResolvedBlocks puts all the blocks in `bps`.  If some of them
+// were spilled to the disk block cache while being readied, they're
+// put in chunks that each fit in the block budget, loading each
+// chunk's spilled data back just before it's put.
+func (cr *ConflictResolver) putResolvedBlocks(ctx context.Context,
+	md *RootMetadata, bps *blockPutState, budget *crBlockBudget) error {
+	tlfName := md.GetTlfHandle().GetCanonicalName()
+	if budget.numSpilled() == 0 {
+		if budget != nil && budget.dbc == nil &&
+			budget.inMemory > budget.budget {
+			cr.log.CDebugf(ctx, "No disk block cache; kept %d bytes of "+
+				"blocks in memory, over the budget of %d",
+				budget.inMemory, budget.budget)
+		}
+		// Put all the blocks.  TODO: deal with recoverable block
+		// errors?
+		_, err := doBlockPuts(ctx, cr.config.BlockServer(),
+			cr.config.BlockCache(), cr.config.Reporter(), cr.log,
+			cr.deferLog, md.TlfID(), tlfName, *bps)
+		return err
+	}
+
+	cr.log.CDebugf(ctx, "Putting blocks in chunks; %d were spilled to "+
+		"the disk block cache", budget.numSpilled())
+	chunk := newBlockPutState(0)
+	var chunkSize int64
+	putChunk := func() error {
+		if len(chunk.blockStates) == 0 {
+			return nil
+		}
+		cr.log.CDebugf(ctx, "Putting a chunk of %d blocks (%d bytes)",
+			len(chunk.blockStates), chunkSize)
+		_, err := doBlockPuts(ctx, cr.config.BlockServer(),
+			cr.config.BlockCache(), cr.config.Reporter(), cr.log,
+			cr.deferLog, md.TlfID(), tlfName, *chunk)
+		if err != nil {
+			return err
+		}
+		chunk = newBlockPutState(0)
+		chunkSize = 0
+		return cr.checkDone(ctx)
+	}
+
+	for _, bs := range bps.blockStates {
+		if budget.isSpilled(bs.blockPtr) && !bs.alreadyPut {
+			// The disk block cache may have evicted the block in the
+			// meantime, in which case this resolution attempt fails
+			// and is retried from scratch.
+			buf, serverHalf, _, err := budget.dbc.Get(
+				ctx, md.TlfID(), bs.blockPtr.ID)
+			if err != nil {
+				return errors.Wrapf(err, "Couldn't load spilled block %v",
+					bs.blockPtr)
+			}
+			bs.readyBlockData = ReadyBlockData{
+				buf:        buf,
+				serverHalf: serverHalf,
+			}
+		}
+		size := int64(bs.readyBlockData.GetEncodedSize())
+		if chunkSize > 0 && chunkSize+size > budget.budget {
+			err := putChunk()
+			if err != nil {
+				return err
+			}
+		}
+		chunk.blockStates = append(chunk.blockStates, bs)
+		chunkSize += size
+	}
+	return putChunk()
+}
@@ -0,0 +1,128 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DamagedSubtree describes a directory whose contents couldn't be
+// fetched or verified, making everything under it unavailable.  It
+// is suitable for encoding directly as JSON.
+type DamagedSubtree struct {
+	Path    string
+	BlockID string
+	Err     string
+	Time    time.Time
+}
+
+// isSubtreeDamageError returns true if the given error, returned
+// while fetching a directory block, means that the directory won't
+// be readable no matter how many times it's retried.
+func isSubtreeDamageError(err error) bool {
+	if isQuarantinableBlockError(err) {
+		return true
+	}
+	_, ok := errors.Cause(err).(QuarantinedBlockError)
+	return ok
+}
+
+// damagedSubtrees tracks, for a single TLF, the directories that
+// couldn't be read because of a subtree damage error, so that they
+// can be reported in the folder's status and in their own node
+// metadata.  A directory is forgotten once it's read successfully,
+// or when updates from other devices are applied.  The zero value is
+// ready to use, and it is goroutine-safe.
+type damagedSubtrees struct {
+	// n is the number of damaged subtrees, accessed atomically, so
+	// that successful reads don't need the lock when nothing is
+	// damaged.
+	n        int32
+	lock     sync.Mutex
+	subtrees map[BlockRef]DamagedSubtree
+}
+
+// record notes that the directory `dir` is damaged, because its
+// block `ptr` couldn't be fetched due to `err`.  It returns true if
+// the directory wasn't already known to be damaged.
+func (ds *damagedSubtrees) record(
+	dir path, ptr BlockPointer, err error, now time.Time) bool {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	ref := dir.tailPointer().Ref()
+	if _, ok := ds.subtrees[ref]; ok {
+		return false
+	}
+	if ds.subtrees == nil {
+		ds.subtrees = make(map[BlockRef]DamagedSubtree)
+	}
+	ds.subtrees[ref] = DamagedSubtree{
+		Path:    dir.String(),
+		BlockID: ptr.ID.String(),
+		Err:     err.Error(),
+		Time:    now,
+	}
+	atomic.StoreInt32(&ds.n, int32(len(ds.subtrees)))
+	return true
+}
+
+// get returns the damage recorded for the directory `dir`, if any.
+func (ds *damagedSubtrees) get(dir path) (DamagedSubtree, bool) {
+	if atomic.LoadInt32(&ds.n) == 0 {
+		return DamagedSubtree{}, false
+	}
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	s, ok := ds.subtrees[dir.tailPointer().Ref()]
+	return s, ok
+}
+
+// clear forgets any damage recorded for the directory `dir`, since
+// it was just read successfully.
+func (ds *damagedSubtrees) clear(dir path) {
+	if atomic.LoadInt32(&ds.n) == 0 {
+		return
+	}
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	delete(ds.subtrees, dir.tailPointer().Ref())
+	atomic.StoreInt32(&ds.n, int32(len(ds.subtrees)))
+}
+
+// reset forgets all the damaged subtrees, since other devices might
+// have removed or replaced them.  Any that are still damaged are
+// recorded again the next time they're read.
+func (ds *damagedSubtrees) reset() {
+	if atomic.LoadInt32(&ds.n) == 0 {
+		return
+	}
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	ds.subtrees = nil
+	atomic.StoreInt32(&ds.n, 0)
+}
+
+// list returns all the damaged subtrees, ordered by the time they
+// were found.
+func (ds *damagedSubtrees) list() []DamagedSubtree {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	if len(ds.subtrees) == 0 {
+		return nil
+	}
+	ret := make([]DamagedSubtree, 0, len(ds.subtrees))
+	for _, s := range ds.subtrees {
+		ret = append(ret, s)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Time.Before(ret[j].Time)
+	})
+	return ret
+}
@@ -0,0 +1,102 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sort"
+	"sync"
+	"testing"
+
+	kbname "github.com/keybase/client/go/kbun"
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDamagedSubtreeLeavesRestAvailable(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+	clock := newTestClockNow()
+	config.SetClock(clock)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	aNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, aNode, "f", false, NoExcl)
+	require.NoError(t, err)
+	bNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "b")
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, bNode, "g", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	t.Log("Quarantine the block of one directory")
+	ops := getOps(config, fb.Tlf)
+	aPath := ops.nodeCache.PathFromNode(aNode)
+	aPtr := aPath.tailPointer()
+	for i := 0; i < blockQuarantineThreshold; i++ {
+		ops.blocks.quarantine.recordFailure(
+			aPtr.ID, aPath, 0, errors.WithStack(libkb.DecryptionError{}))
+	}
+	err = config.BlockCache().DeleteTransient(aPtr, fb.Tlf)
+	require.NoError(t, err)
+
+	t.Log("Only the damaged directory is unavailable")
+	_, err = kbfsOps.GetDirChildren(ctx, aNode)
+	require.IsType(t, DamagedSubtreeError{}, errors.Cause(err))
+	children, err := kbfsOps.GetDirChildren(ctx, rootNode)
+	require.NoError(t, err)
+	require.Len(t, children, 2)
+	children, err = kbfsOps.GetDirChildren(ctx, bNode)
+	require.NoError(t, err)
+	require.Len(t, children, 1)
+
+	t.Log("A walk covers everything else, then reports the damage")
+	var lock sync.Mutex
+	var walked []string
+	err = kbfsOps.WalkTLF(ctx, rootNode,
+		func(relPath string, de DirEntry) error {
+			lock.Lock()
+			defer lock.Unlock()
+			walked = append(walked, relPath)
+			return nil
+		})
+	require.IsType(t, DamagedSubtreeError{}, errors.Cause(err))
+	sort.Strings(walked)
+	require.Equal(t, []string{"a", "b", "b/g"}, walked)
+
+	t.Log("The damage shows up in the status")
+	status, _, err := kbfsOps.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	require.Len(t, status.DamagedSubtrees, 1)
+	require.Equal(t, aPath.String(), status.DamagedSubtrees[0].Path)
+	require.Equal(t, aPtr.ID.String(), status.DamagedSubtrees[0].BlockID)
+	require.Equal(t, clock.Now(), status.DamagedSubtrees[0].Time)
+
+	t.Log("The damaged directory is an error node with the details")
+	md, err := kbfsOps.GetNodeMetadata(ctx, aNode)
+	require.NoError(t, err)
+	require.NotNil(t, md.Damaged)
+	require.Equal(t, status.DamagedSubtrees[0], *md.Damaged)
+	md, err = kbfsOps.GetNodeMetadata(ctx, bNode)
+	require.NoError(t, err)
+	require.Nil(t, md.Damaged)
+
+	t.Log("The damage is forgotten once the directory can be read")
+	ops.blocks.quarantine.lock.Lock()
+	delete(ops.blocks.quarantine.quarantined, aPtr.ID)
+	ops.blocks.quarantine.lock.Unlock()
+	children, err = kbfsOps.GetDirChildren(ctx, aNode)
+	require.NoError(t, err)
+	require.Len(t, children, 1)
+	status, _, err = kbfsOps.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	require.Empty(t, status.DamagedSubtrees)
+}
@@ -74,6 +74,8 @@ type TeamInfo struct {
 
 	Writers map[keybase1.UID]bool
 	Readers map[keybase1.UID]bool
+	// Admins holds the members with at least the admin role.
+	Admins map[keybase1.UID]bool
 
 	// Last writers map a KID to the last time the writer associated
 	// with that KID trasitioned from writer to non-writer.
@@ -163,6 +165,10 @@ const (
 	// IndirectDirsDataVer is the data version for a directory block
 	// that contains indirect pointers.
 	IndirectDirsDataVer DataVer = 4
+	// HashedDirsDataVer is the data version for a directory block
+	// whose indirect pointers shard its entries into a fixed number
+	// of buckets by name hash.
+	HashedDirsDataVer DataVer = 5
 )
 
 // BlockRef is a block ID/ref nonce pair, which defines a unique
@@ -559,6 +565,113 @@ func (o Excl) String() string {
 	}
 }
 
+// NodeTimes describes the times to set on a single node as part of
+// a batched time change.
+type NodeTimes struct {
+	Node  Node
+	Mtime time.Time
+	// Ctime, if non-nil, is recorded as the node's change time,
+	// instead of the time of the change itself.
+	Ctime *time.Time
+}
+
+// FileRange describes the byte range `[Off, Off+Len)` within a file.
+type FileRange struct {
+	Off int64
+	Len int64
+}
+
+// End returns the offset just past the last byte of the range.
+func (fr FileRange) End() int64 {
+	return fr.Off + fr.Len
+}
+
+// IOVec is one buffer of a vectored read or write, along with the
+// offset in the file where it starts.
+type IOVec struct {
+	Off int64
+	Buf []byte
+}
+
+// SyncTicket identifies one call to KBFSOps.SyncAllAsync, so that its
+// completion can be matched up with the call.
+type SyncTicket uint64
+
+// WalkTLFFunc is called by KBFSOps.WalkTLF for each entry found
+// under the walked directory.  `relPath` is the slash-separated path
+// of the entry relative to that directory.  It may be called
+// concurrently from multiple goroutines.  Returning
+// filepath.SkipDir for a directory entry skips its contents; any
+// other error stops the walk.  The contents of damaged directories
+// are skipped, and the walk then fails with a DamagedSubtreeError.
+type WalkTLFFunc func(relPath string, de DirEntry) error
+
+// WatchEventType is a bitmask of the kinds of changes that can be
+// reported to a WatchFunc.
+type WatchEventType int
+
+const (
+	// WatchCreate is for newly-created entries.
+	WatchCreate WatchEventType = 1 << iota
+	// WatchModify is for writes to, and truncates of, existing files.
+	WatchModify
+	// WatchRename is for entries that were renamed.
+	WatchRename
+	// WatchDelete is for removed entries.
+	WatchDelete
+	// WatchOverflow is reported to every watch, whatever its
+	// filter, when changes were dropped because they piled up faster
+	// than they could be reported.  The watcher should rescan
+	// whatever it's watching.  Only Type and Revision are set, to the
+	// last revision that was dropped.
+	WatchOverflow
+
+	// WatchAllEvents matches all kinds of changes.
+	WatchAllEvents = WatchCreate | WatchModify | WatchRename | WatchDelete
+)
+
+// WatchEvent describes a single change reported to a WatchFunc.
+type WatchEvent struct {
+	Type WatchEventType
+	// Path is the canonical path of the changed entry; for renames,
+	// it's the new path.
+	Path string
+	// OldPath is the canonical path of a renamed entry before the
+	// rename, and is empty for other event types.
+	OldPath   string
+	EntryType EntryType
+	// Revision is the MD revision that included the change.
+	Revision kbfsmd.Revision
+	// Writer is the user that made the change.
+	Writer keybase1.UID
+}
+
+// WatchFunc is called by a watch registered with KBFSOps.Watch for
+// each matching change, in revision order.  It should not block or
+// call back into KBFSOps.
+type WatchFunc func(event WatchEvent)
+
+// UnlinkedNodeStats describes the nodes of a TLF that have been
+// unlinked from the directory tree, but are still referenced by a
+// caller (e.g., through an open file handle).
+type UnlinkedNodeStats struct {
+	// NumNodes is the number of unlinked nodes still in use.
+	NumNodes int
+	// DirtyBytes is the number of unsynced data bytes held by those
+	// nodes, which will never be synced to the server.
+	DirtyBytes int64
+}
+
+// NewFileInfo describes a single file to create as part of a bulk
+// create.
+type NewFileInfo struct {
+	Name   string
+	IsExec bool
+	// Data, if non-empty, is written as the initial contents of the
+	// new file.
+	Data []byte
+}
+
 // EntryInfo is the (non-block-related) info a directory knows about
 // its child.
 //
@@ -578,10 +691,14 @@ type EntryInfo struct {
 	TeamWriter keybase1.UID `codec:"tw,omitempty"`
 	// Tracks a skiplist of the previous revisions for this entry.
 	PrevRevisions PrevRevisions `codec:"pr,omitempty"`
+	// BlockSize, if non-zero, is the block size that was chosen for
+	// this file's data when it was first written, which later writes
+	// keep using.  If zero, the file uses the TLF's block size.
+	BlockSize int64 `codec:"bs,omitempty"`
 }
 
 func init() {
-	if reflect.ValueOf(EntryInfo{}).NumField() != 7 {
+	if reflect.ValueOf(EntryInfo{}).NumField() != 8 {
 		panic(errors.New(
 			"Unexpected number of fields in EntryInfo; " +
 				"please update EntryInfo.Eq() for your " +
@@ -597,6 +714,7 @@ func (ei EntryInfo) Eq(other EntryInfo) bool {
 		ei.Mtime == other.Mtime &&
 		ei.Ctime == other.Ctime &&
 		ei.TeamWriter == other.TeamWriter &&
+		ei.BlockSize == other.BlockSize &&
 		len(ei.PrevRevisions) == len(other.PrevRevisions)
 	if !eq {
 		return false
@@ -691,6 +809,26 @@ type NodeMetadata struct {
 	LastWriterUnverified kbname.NormalizedUsername
 	BlockInfo            BlockInfo
 	PrefetchStatus       string
+	// SyncError is the most recent error that kept the node's
+	// unsynced changes from being synced, or nil if there was none
+	// since they were made.
+	SyncError *FileSyncError
+	// Damaged describes why the node, a directory, can't be read,
+	// or is nil if it isn't known to be damaged.  A damaged
+	// directory still shows up in its parent, so that the damage is
+	// visible, but everything under it fails with a
+	// DamagedSubtreeError.
+	Damaged *DamagedSubtree
+	// Atime is the node's last access time, or the zero time if
+	// atimes aren't being tracked (see `TimestampsPOSIXWithAtime`).
+	Atime time.Time
+}
+
+// FileSyncError describes an error that kept a dirty file from being
+// synced.
+type FileSyncError struct {
+	Error string
+	Time  time.Time
 }
 
 // FavoritesOp defines an operation related to favorites.
@@ -709,6 +847,37 @@ const (
 	FavoritesOpNoChange
 )
 
+// TlfSyncPolicy describes how much of a TLF is kept synced locally.
+type TlfSyncPolicy int
+
+const (
+	// TlfSyncPolicyUnchanged leaves the current policy of the TLF
+	// as is.
+	TlfSyncPolicyUnchanged TlfSyncPolicy = iota
+	// TlfSyncPolicyNone fetches all blocks on demand.
+	TlfSyncPolicyNone
+	// TlfSyncPolicyMetadata keeps the directory tree synced, but
+	// fetches file contents on demand.
+	TlfSyncPolicyMetadata
+	// TlfSyncPolicyFull pins the whole TLF, including file contents,
+	// for offline use.
+	TlfSyncPolicyFull
+)
+
+// TlfConfigRequest describes the changes to make to one TLF in a
+// call to `KBFSOps.ConfigureTlfs`.
+type TlfConfigRequest struct {
+	Favorite Favorite
+	// FavoritesOp is the change to make to the favorites list.  If
+	// unset, the list is left as is.
+	FavoritesOp FavoritesOp
+	SyncPolicy  TlfSyncPolicy
+	// MaxBlockSize, if non-zero, is the block size to use for the
+	// data of the TLF (see `KBFSOps.SetTlfBlockSize`).  A negative value
+	// reverts the TLF to the default block size.
+	MaxBlockSize int64
+}
+
 // RekeyResult represents the result of an rekey operation.
 type RekeyResult struct {
 	DidRekey      bool
@@ -733,6 +902,10 @@ const (
 	// InitConstrained is a mode where KBFS reads and writes data, but
 	// constrains itself to using fewer resources (e.g. on mobile).
 	InitConstrained
+	// InitViewer is a mode where KBFS only ever reads data (e.g., on
+	// a kiosk or gateway serving public or team folders), so it
+	// skips all the machinery needed for writes.
+	InitViewer
 )
 
 func (im InitModeType) String() string {
@@ -745,6 +918,8 @@ func (im InitModeType) String() string {
 		return InitSingleOpString
 	case InitConstrained:
 		return InitConstrainedString
+	case InitViewer:
+		return InitViewerString
 	default:
 		return "unknown"
 	}
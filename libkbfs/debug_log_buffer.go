@@ -0,0 +1,129 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/keybase/kbfs/tlf"
+)
+
+// DebugLogEntry is a single log message kept by a DebugLogBuffer.
+type DebugLogEntry struct {
+	TlfID  tlf.ID
+	Time   time.Time
+	Level  string
+	Module string
+	Msg    string
+}
+
+// debugLogRing holds the most recent entries for one TLF.
+type debugLogRing struct {
+	entries []DebugLogEntry
+	// next is the index of the oldest entry, to be overwritten
+	// next, once entries is full.
+	next int
+}
+
+func (r *debugLogRing) add(e DebugLogEntry, capacity int) {
+	if len(r.entries) < capacity {
+		r.entries = append(r.entries, e)
+		return
+	}
+	r.entries[r.next] = e
+	r.next = (r.next + 1) % capacity
+}
+
+// DebugLogBuffer keeps the log messages of every level from the last
+// few minutes in memory, separately for each TLF, so they can be
+// retrieved after a bug happens even when debug logging is off.
+// Messages that aren't about any TLF are kept under tlf.NullID.
+type DebugLogBuffer struct {
+	clock         Clock
+	maxAge        time.Duration
+	maxEntriesTLF int
+
+	lock sync.Mutex
+	tlfs map[tlf.ID]*debugLogRing
+}
+
+// NewDebugLogBuffer returns a buffer that keeps messages for up to
+// `maxAge`, and at most `maxEntriesPerTLF` messages for each TLF.
+func NewDebugLogBuffer(
+	clock Clock, maxAge time.Duration,
+	maxEntriesPerTLF int) *DebugLogBuffer {
+	return &DebugLogBuffer{
+		clock:         clock,
+		maxAge:        maxAge,
+		maxEntriesTLF: maxEntriesPerTLF,
+		tlfs:          make(map[tlf.ID]*debugLogRing),
+	}
+}
+
+func (b *DebugLogBuffer) add(
+	tlfID tlf.ID, level, module, msg string) {
+	e := DebugLogEntry{
+		TlfID:  tlfID,
+		Time:   b.clock.Now(),
+		Level:  level,
+		Module: module,
+		Msg:    msg,
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	r, ok := b.tlfs[tlfID]
+	if !ok {
+		r = &debugLogRing{}
+		b.tlfs[tlfID] = r
+	}
+	r.add(e, b.maxEntriesTLF)
+}
+
+// Entries returns the kept messages for the given TLF, oldest first.
+// It drops any messages older than the maximum age.
+func (b *DebugLogBuffer) Entries(tlfID tlf.ID) []DebugLogEntry {
+	cutoff := b.clock.Now().Add(-b.maxAge)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	r, ok := b.tlfs[tlfID]
+	if !ok {
+		return nil
+	}
+	ordered := append(
+		append([]DebugLogEntry(nil), r.entries[r.next:]...),
+		r.entries[:r.next]...)
+	i := sort.Search(len(ordered), func(i int) bool {
+		return ordered[i].Time.After(cutoff)
+	})
+	ordered = ordered[i:]
+	if len(ordered) == 0 {
+		delete(b.tlfs, tlfID)
+		return nil
+	}
+	r.entries = ordered
+	r.next = 0
+	return append([]DebugLogEntry(nil), ordered...)
+}
+
+// AllEntries returns the kept messages for every TLF, oldest first.
+func (b *DebugLogBuffer) AllEntries() []DebugLogEntry {
+	b.lock.Lock()
+	tlfIDs := make([]tlf.ID, 0, len(b.tlfs))
+	for tlfID := range b.tlfs {
+		tlfIDs = append(tlfIDs, tlfID)
+	}
+	b.lock.Unlock()
+
+	var entries []DebugLogEntry
+	for _, tlfID := range tlfIDs {
+		entries = append(entries, b.Entries(tlfID)...)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Time.Before(entries[j].Time)
+	})
+	return entries
+}
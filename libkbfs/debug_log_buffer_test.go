@@ -0,0 +1,75 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func debugLogMsgs(entries []DebugLogEntry) (msgs []string) {
+	for _, e := range entries {
+		msgs = append(msgs, e.Msg)
+	}
+	return msgs
+}
+
+func TestDebugLogBuffer(t *testing.T) {
+	clock := newTestClockNow()
+	b := NewDebugLogBuffer(clock, time.Minute, 3)
+	tlfID1 := tlf.FakeID(1, tlf.Private)
+	tlfID2 := tlf.FakeID(2, tlf.Public)
+
+	for i := 0; i < 5; i++ {
+		b.add(tlfID1, "debug", "FBO", fmt.Sprintf("msg %d", i))
+		clock.Add(time.Second)
+	}
+	b.add(tlfID2, "info", "FBO", "other")
+	require.Equal(t, []string{"msg 2", "msg 3", "msg 4"},
+		debugLogMsgs(b.Entries(tlfID1)))
+	require.Equal(t, []string{"msg 2", "msg 3", "msg 4", "other"},
+		debugLogMsgs(b.AllEntries()))
+	require.Nil(t, b.Entries(tlf.NullID))
+
+	// Old messages are dropped.
+	clock.Add(time.Minute - 2*time.Second)
+	require.Equal(t, []string{"msg 4"}, debugLogMsgs(b.Entries(tlfID1)))
+	b.add(tlfID1, "debug", "FBO", "msg 5")
+	require.Equal(t, []string{"msg 4", "msg 5"},
+		debugLogMsgs(b.Entries(tlfID1)))
+	clock.Add(time.Minute)
+	require.Nil(t, b.AllEntries())
+}
+
+func TestDebugLogBufferKeepsDroppedLevels(t *testing.T) {
+	clock := newTestClockNow()
+	levels := NewLogLevels(keybase1.LogLevel_WARN)
+	b := NewDebugLogBuffer(clock, time.Minute, 10)
+	levels.SetDebugBuffer(b)
+
+	tlfID := tlf.FakeID(1, tlf.Private)
+	fboLog := logWithTlfID(
+		newLeveledLogger(logger.NewTestLogger(t), "FBO", levels), tlfID)
+	mdopsLog := newLeveledLogger(logger.NewTestLogger(t), "MDOPS", levels)
+
+	ctx := context.Background()
+	fboLog.CDebugf(ctx, "Hidden %d", 1)
+	mdopsLog.CDebugf(ctx, "No TLF")
+	mdopsLog.CDebugf(
+		CtxWithLogFields(ctx, LogFields{TlfID: tlfID}), "With TLF")
+
+	entries := b.Entries(tlfID)
+	require.Equal(t, []string{"Hidden 1", "With TLF"}, debugLogMsgs(entries))
+	require.Equal(t, "debug", entries[0].Level)
+	require.Equal(t, "FBO", entries[0].Module)
+	require.Equal(t, []string{"No TLF"}, debugLogMsgs(b.Entries(tlf.NullID)))
+}
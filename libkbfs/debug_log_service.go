@@ -0,0 +1,69 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"context"
+	"errors"
+
+	kbgitkbfs "github.com/keybase/kbfs/protocol/kbgitkbfs1"
+	"github.com/keybase/kbfs/tlf"
+)
+
+type logLevelsGetter interface {
+	LogLevels() *LogLevels
+}
+
+// DebugLogService serves the recent log messages kept in this KBFS
+// instance's debug log buffer.
+type DebugLogService struct {
+	config logLevelsGetter
+}
+
+var _ kbgitkbfs.DebugLogInterface = (*DebugLogService)(nil)
+
+// NewDebugLogService creates a new DebugLogService.
+func NewDebugLogService(config logLevelsGetter) *DebugLogService {
+	return &DebugLogService{
+		config: config,
+	}
+}
+
+// GetDebugLog implements the DebugLogInterface interface for
+// DebugLogService.
+func (s *DebugLogService) GetDebugLog(ctx context.Context, tlfIDBytes []byte) (
+	[]kbgitkbfs.DebugLogEntry, error) {
+	b := s.config.LogLevels().DebugBuffer()
+	if b == nil {
+		return nil, errors.New("The debug log buffer is not enabled")
+	}
+
+	var entries []DebugLogEntry
+	if len(tlfIDBytes) == 0 {
+		entries = b.AllEntries()
+	} else {
+		var tlfID tlf.ID
+		if err := tlfID.UnmarshalBinary(tlfIDBytes); err != nil {
+			return nil, err
+		}
+		entries = b.Entries(tlfID)
+	}
+
+	res := make([]kbgitkbfs.DebugLogEntry, 0, len(entries))
+	for _, e := range entries {
+		var tlfIDBytes []byte
+		if e.TlfID != tlf.NullID {
+			tlfIDBytes = e.TlfID.Bytes()
+		}
+		res = append(res, kbgitkbfs.DebugLogEntry{
+			TlfID:  tlfIDBytes,
+			Time:   e.Time.UnixNano(),
+			Level:  e.Level,
+			Module: e.Module,
+			Msg:    e.Msg,
+		})
+	}
+	return res, nil
+}
@@ -0,0 +1,933 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io"
+	pathpkg "path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/keybase/client/go/protocol/chat1"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// DelegationToken is a signed, expiring grant from one user (the
+// issuer) to another (the holder, usually a service account), that
+// restricts a libkbfs instance logged in as the holder to reading
+// the given paths.  It grants no access the holder doesn't already
+// have: it's meant for running a headless service with the least
+// access it needs, and is enforced by the service's own libkbfs
+// once installed with InstallDelegationToken, not by any server.
+type DelegationToken struct {
+	Issuer keybase1.UID
+	Holder keybase1.UID
+	// Paths are the canonical paths (e.g.,
+	// "/keybase/private/alice#svc/data") the holder may read,
+	// including everything under them.
+	Paths []string
+	// Issued and Expires are in Unix nanoseconds.
+	Issued  int64
+	Expires int64
+	// Sig is the issuer's signature over the rest of the token.
+	Sig kbfscrypto.SignatureInfo
+}
+
+func (t DelegationToken) bodyBytes(config Config) ([]byte, error) {
+	t.Sig = kbfscrypto.SignatureInfo{}
+	return config.Codec().Encode(t)
+}
+
+func (t DelegationToken) checkExpiry(now time.Time) error {
+	expires := time.Unix(0, t.Expires)
+	if !now.Before(expires) {
+		return DelegationTokenExpiredError{expires}
+	}
+	return nil
+}
+
+// allows returns whether `p` is one of the token's paths or under
+// one, or, if `ancestors` is true, a directory leading to one.
+func (t DelegationToken) allows(p string, ancestors bool) bool {
+	for _, tp := range t.Paths {
+		if p == tp || strings.HasPrefix(p, tp+"/") {
+			return true
+		}
+		if ancestors && strings.HasPrefix(tp, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// MintDelegationToken returns a token, signed by the current user,
+// restricting the given holder to reading `paths` for the next
+// `ttl`.  The TLF names in the paths are canonicalized.
+func MintDelegationToken(ctx context.Context, config Config,
+	holder keybase1.UID, paths []string, ttl time.Duration) (
+	DelegationToken, error) {
+	if len(paths) == 0 {
+		return DelegationToken{}, errors.New("No paths given")
+	}
+	session, err := config.KBPKI().GetCurrentSession(ctx)
+	if err != nil {
+		return DelegationToken{}, err
+	}
+
+	now := config.Clock().Now()
+	token := DelegationToken{
+		Issuer:  session.UID,
+		Holder:  holder,
+		Issued:  now.UnixNano(),
+		Expires: now.Add(ttl).UnixNano(),
+	}
+	for _, p := range paths {
+		t, tlfName, parts, err := splitCanonicalPath(p)
+		if err != nil {
+			return DelegationToken{}, err
+		}
+		h, err := GetHandleFromFolderNameAndType(
+			ctx, config.KBPKI(), config.MDOps(), tlfName, t)
+		if err != nil {
+			return DelegationToken{}, err
+		}
+		token.Paths = append(token.Paths, pathpkg.Join(
+			append([]string{h.GetCanonicalPath()}, parts...)...))
+	}
+
+	buf, err := token.bodyBytes(config)
+	if err != nil {
+		return DelegationToken{}, err
+	}
+	token.Sig, err = config.Crypto().Sign(ctx, buf)
+	if err != nil {
+		return DelegationToken{}, err
+	}
+	return token, nil
+}
+
+// VerifyDelegationToken checks that `token` was signed by a current
+// device of its issuer, that it's held by the current user, and that
+// it hasn't expired.
+func VerifyDelegationToken(
+	ctx context.Context, config Config, token DelegationToken) error {
+	buf, err := token.bodyBytes(config)
+	if err != nil {
+		return err
+	}
+	err = kbfscrypto.Verify(buf, token.Sig)
+	if err != nil {
+		return err
+	}
+	now := config.Clock().Now()
+	err = config.KBPKI().HasVerifyingKey(
+		ctx, token.Issuer, token.Sig.VerifyingKey, now)
+	if err != nil {
+		return err
+	}
+
+	session, err := config.KBPKI().GetCurrentSession(ctx)
+	if err != nil {
+		return err
+	}
+	if session.UID != token.Holder {
+		return errors.Errorf("The delegation token is for %s, not %s",
+			token.Holder, session.UID)
+	}
+	for _, p := range token.Paths {
+		if _, _, _, err := splitCanonicalPath(p); err != nil {
+			return err
+		}
+		if pathpkg.Clean(p) != p {
+			return errors.Errorf("%q is not a clean path", p)
+		}
+	}
+	return token.checkExpiry(now)
+}
+
+// InstallDelegationToken verifies `token` and then restricts
+// `config` to it: every node becomes read-only, the holder is no
+// longer considered a writer of any team, entries outside the
+// token's paths can't be looked up or listed, and once the token
+// expires, the current session (and so nearly every operation) fails
+// with a DelegationTokenExpiredError.  It must be called before any
+// TLF is accessed through `config`, and after any OpLogRecorder is
+// installed.
+func InstallDelegationToken(
+	ctx context.Context, config Config, token DelegationToken) error {
+	std, ok := standardKBFSOps(config.KBFSOps())
+	if !ok {
+		return errors.Errorf("Can't restrict ops of %T", config.KBFSOps())
+	}
+	err := VerifyDelegationToken(ctx, config, token)
+	if err != nil {
+		return err
+	}
+
+	config.SetKBPKI(delegatedKBPKI{config.KBPKI(), token, config.Clock()})
+	config.AddRootNodeWrapper(delegatedWrapper)
+	config.SetKBFSOps(&delegatedKBFSOps{
+		wrapped: config.KBFSOps(),
+		ops:     std,
+		token:   token,
+		clock:   config.Clock(),
+	})
+	return nil
+}
+
+// delegatedKBPKI enforces the expiry of a delegation token, and
+// keeps the holder from writing to team TLFs.
+type delegatedKBPKI struct {
+	KBPKI
+	token DelegationToken
+	clock Clock
+}
+
+var _ KBPKI = delegatedKBPKI{}
+
+func (k delegatedKBPKI) GetCurrentSession(ctx context.Context) (
+	SessionInfo, error) {
+	if err := k.token.checkExpiry(k.clock.Now()); err != nil {
+		return SessionInfo{}, err
+	}
+	return k.KBPKI.GetCurrentSession(ctx)
+}
+
+func (k delegatedKBPKI) IsTeamWriter(
+	ctx context.Context, tid keybase1.TeamID, uid keybase1.UID,
+	verifyingKey kbfscrypto.VerifyingKey) (bool, error) {
+	if uid == k.token.Holder {
+		return false, nil
+	}
+	return k.KBPKI.IsTeamWriter(ctx, tid, uid, verifyingKey)
+}
+
+// delegatedNode is read-only, with no way to override it.
+type delegatedNode struct {
+	Node
+}
+
+var _ Node = (*delegatedNode)(nil)
+
+// Readonly implements the Node interface for delegatedNode.
+func (dn delegatedNode) Readonly(ctx context.Context) bool {
+	return true
+}
+
+// WrapChild implements the Node interface for delegatedNode.
+func (dn delegatedNode) WrapChild(child Node) Node {
+	return &delegatedNode{dn.Node.WrapChild(child)}
+}
+
+func delegatedWrapper(node Node) Node {
+	return &delegatedNode{Node: node}
+}
+
+// delegatedKBFSOps hides everything outside the paths of a
+// delegation token.  Entries that are out of scope act as if they
+// don't exist.  Only the ops that read, or that just manage local
+// state, are passed through; all others fail with a
+// WriteToReadonlyNodeError, or do nothing if they can't fail.
+type delegatedKBFSOps struct {
+	wrapped KBFSOps
+	ops     *KBFSOpsStandard
+	token   DelegationToken
+	clock   Clock
+}
+
+var _ KBFSOps = (*delegatedKBFSOps)(nil)
+
+func (d *delegatedKBFSOps) wrappedKBFSOps() KBFSOps {
+	return d.wrapped
+}
+
+// checkNode returns the canonical path of `node`, if it's allowed
+// by the token.
+func (d *delegatedKBFSOps) checkNode(
+	ctx context.Context, node Node, ancestors bool) (string, error) {
+	if err := d.token.checkExpiry(d.clock.Now()); err != nil {
+		return "", err
+	}
+	p := d.ops.nodePath(ctx, node)
+	if !p.isValid() {
+		return "", NoSuchNameError{node.GetBasename()}
+	}
+	canonical := p.CanonicalPathString()
+	if !d.token.allows(canonical, ancestors) {
+		return "", NoSuchNameError{node.GetBasename()}
+	}
+	return canonical, nil
+}
+
+// checkPath resolves the canonical path `p` and returns the
+// canonical path of what it leads to, if both are allowed by the
+// token.  Checking the result keeps symlinks from leading out of
+// scope.
+func (d *delegatedKBFSOps) checkPath(
+	ctx context.Context, p string, ancestors bool) (string, error) {
+	if err := d.token.checkExpiry(d.clock.Now()); err != nil {
+		return "", err
+	}
+	if !d.token.allows(pathpkg.Clean(p), ancestors) {
+		return "", NoSuchNameError{p}
+	}
+	_, _, node, _, err := d.ops.resolveCanonicalPath(ctx, p, false)
+	if err != nil {
+		return "", err
+	}
+	return d.checkNode(ctx, node, ancestors)
+}
+
+func (d *delegatedKBFSOps) checkRoot(h *TlfHandle) error {
+	if err := d.token.checkExpiry(d.clock.Now()); err != nil {
+		return err
+	}
+	if !d.token.allows(h.GetCanonicalPath(), true) {
+		return NoSuchNameError{h.GetCanonicalPath()}
+	}
+	return nil
+}
+
+// GetTLFCryptKeys implements the KBFSOps interface for
+// delegatedKBFSOps.
+func (d *delegatedKBFSOps) GetTLFCryptKeys(
+	ctx context.Context, tlfHandle *TlfHandle) (
+	[]kbfscrypto.TLFCryptKey, tlf.ID, error) {
+	return nil, tlf.NullID, errors.New(
+		"TLF keys can't be fetched with a delegation token")
+}
+
+// GetOrCreateRootNode implements the KBFSOps interface for
+// delegatedKBFSOps.  TLFs are never created.
+func (d *delegatedKBFSOps) GetOrCreateRootNode(
+	ctx context.Context, h *TlfHandle, branch BranchName) (
+	Node, EntryInfo, error) {
+	node, ei, err := d.GetRootNode(ctx, h, branch)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	if node == nil {
+		return nil, EntryInfo{}, NoSuchNameError{h.GetCanonicalPath()}
+	}
+	return node, ei, nil
+}
+
+// GetRootNode implements the KBFSOps interface for delegatedKBFSOps.
+func (d *delegatedKBFSOps) GetRootNode(
+	ctx context.Context, h *TlfHandle, branch BranchName) (
+	Node, EntryInfo, error) {
+	if err := d.checkRoot(h); err != nil {
+		return nil, EntryInfo{}, err
+	}
+	return d.wrapped.GetRootNode(ctx, h, branch)
+}
+
+// GetDirChildren implements the KBFSOps interface for
+// delegatedKBFSOps.
+func (d *delegatedKBFSOps) GetDirChildren(
+	ctx context.Context, dir Node) (map[string]EntryInfo, error) {
+	dirPath, err := d.checkNode(ctx, dir, true)
+	if err != nil {
+		return nil, err
+	}
+	children, err := d.wrapped.GetDirChildren(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	return d.filterChildren(dirPath, children), nil
+}
+
+func (d *delegatedKBFSOps) filterChildren(
+	dirPath string, children map[string]EntryInfo) map[string]EntryInfo {
+	for name := range children {
+		if !d.token.allows(dirPath+"/"+name, true) {
+			delete(children, name)
+		}
+	}
+	return children
+}
+
+// WalkTLF implements the KBFSOps interface for delegatedKBFSOps.
+// Subtrees that are out of scope are skipped.
+func (d *delegatedKBFSOps) WalkTLF(
+	ctx context.Context, dir Node, walkFn WalkTLFFunc) error {
+	dirPath, err := d.checkNode(ctx, dir, true)
+	if err != nil {
+		return err
+	}
+	return d.wrapped.WalkTLF(ctx, dir, func(
+		relPath string, de DirEntry) error {
+		if d.token.allows(dirPath+"/"+relPath, true) {
+			return walkFn(relPath, de)
+		}
+		if de.Type == Dir {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// Lookup implements the KBFSOps interface for delegatedKBFSOps.
+func (d *delegatedKBFSOps) Lookup(
+	ctx context.Context, dir Node, name string) (Node, EntryInfo, error) {
+	dirPath, err := d.checkNode(ctx, dir, true)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	if !d.token.allows(dirPath+"/"+name, true) {
+		return nil, EntryInfo{}, NoSuchNameError{name}
+	}
+	return d.wrapped.Lookup(ctx, dir, name)
+}
+
+// Stat implements the KBFSOps interface for delegatedKBFSOps.
+func (d *delegatedKBFSOps) Stat(
+	ctx context.Context, node Node) (EntryInfo, error) {
+	if _, err := d.checkNode(ctx, node, true); err != nil {
+		return EntryInfo{}, err
+	}
+	return d.wrapped.Stat(ctx, node)
+}
+
+// ReadFileAt implements the KBFSOps interface for delegatedKBFSOps.
+func (d *delegatedKBFSOps) ReadFileAt(
+	ctx context.Context, p string) ([]byte, error) {
+	if _, err := d.checkPath(ctx, p, false); err != nil {
+		return nil, err
+	}
+	return d.wrapped.ReadFileAt(ctx, p)
+}
+
+// WriteFileAt implements the KBFSOps interface for delegatedKBFSOps.
+func (d *delegatedKBFSOps) WriteFileAt(
+	ctx context.Context, p string, data []byte) error {
+	return WriteToReadonlyNodeError{p}
+}
+
+// StatAt implements the KBFSOps interface for delegatedKBFSOps.
+func (d *delegatedKBFSOps) StatAt(
+	ctx context.Context, p string) (EntryInfo, error) {
+	if _, err := d.checkPath(ctx, p, true); err != nil {
+		return EntryInfo{}, err
+	}
+	return d.wrapped.StatAt(ctx, p)
+}
+
+// StatMany implements the KBFSOps interface for delegatedKBFSOps.
+func (d *delegatedKBFSOps) StatMany(
+	ctx context.Context, paths []string) (map[string]DirEntry, error) {
+	for _, p := range paths {
+		_, _, parts, err := splitCanonicalPath(p)
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) == 0 {
+			if _, err := d.checkPath(ctx, p, true); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		cleaned := pathpkg.Clean(p)
+		dirPath, err := d.checkPath(ctx, pathpkg.Dir(cleaned), true)
+		if _, ok := errors.Cause(err).(NoSuchNameError); ok {
+			// StatMany leaves out missing entries anyway.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if !d.token.allows(dirPath+"/"+pathpkg.Base(cleaned), true) {
+			return nil, NoSuchNameError{p}
+		}
+	}
+	return d.wrapped.StatMany(ctx, paths)
+}
+
+// Watch implements the KBFSOps interface for delegatedKBFSOps.
+func (d *delegatedKBFSOps) Watch(
+	ctx context.Context, p string, recursive bool, filter WatchEventType,
+	fn WatchFunc) (unwatch func(), err error) {
+	if _, err := d.checkPath(ctx, p, false); err != nil {
+		return nil, err
+	}
+	return d.wrapped.Watch(ctx, p, recursive, filter, fn)
+}
+
+// ListAt implements the KBFSOps interface for delegatedKBFSOps.
+func (d *delegatedKBFSOps) ListAt(
+	ctx context.Context, p string) (map[string]EntryInfo, error) {
+	dirPath, err := d.checkPath(ctx, p, true)
+	if err != nil {
+		return nil, err
+	}
+	children, err := d.wrapped.ListAt(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	return d.filterChildren(dirPath, children), nil
+}
+
+// Read implements the KBFSOps interface for delegatedKBFSOps.
+func (d *delegatedKBFSOps) Read(
+	ctx context.Context, file Node, dest []byte, off int64) (int64, error) {
+	if err := d.token.checkExpiry(d.clock.Now()); err != nil {
+		return 0, err
+	}
+	return d.wrapped.Read(ctx, file, dest, off)
+}
+
+// ReadVec implements the KBFSOps interface for delegatedKBFSOps.
+func (d *delegatedKBFSOps) ReadVec(
+	ctx context.Context, file Node, vecs []IOVec) ([]int64, error) {
+	if err := d.token.checkExpiry(d.clock.Now()); err != nil {
+		return nil, err
+	}
+	return d.wrapped.ReadVec(ctx, file, vecs)
+}
+
+// GetUpdateHistory implements the KBFSOps interface for
+// delegatedKBFSOps.  The history names entries outside the token's
+// scope, so it isn't available.
+func (d *delegatedKBFSOps) GetUpdateHistory(
+	ctx context.Context, folderBranch FolderBranch) (
+	TLFUpdateHistory, error) {
+	return TLFUpdateHistory{}, errors.New(
+		"The update history isn't available with a delegation token")
+}
+
+// GetEditHistory implements the KBFSOps interface for
+// delegatedKBFSOps.  The history names entries outside the token's
+// scope, so it isn't available.
+func (d *delegatedKBFSOps) GetEditHistory(
+	ctx context.Context, folderBranch FolderBranch) (
+	keybase1.FSFolderEditHistory, error) {
+	return keybase1.FSFolderEditHistory{}, errors.New(
+		"The edit history isn't available with a delegation token")
+}
+
+// GetFavorites implements the KBFSOps interface for delegatedKBFSOps.
+// Only the TLFs leading to the token's paths are listed.
+func (d *delegatedKBFSOps) GetFavorites(ctx context.Context) (
+	[]Favorite, error) {
+	if err := d.token.checkExpiry(d.clock.Now()); err != nil {
+		return nil, err
+	}
+	favs, err := d.wrapped.GetFavorites(ctx)
+	if err != nil {
+		return nil, err
+	}
+	allowed := make([]Favorite, 0, len(favs))
+	for _, fav := range favs {
+		p := buildCanonicalPathForTlfName(
+			fav.Type, tlf.CanonicalName(fav.Name))
+		if d.token.allows(p, true) {
+			allowed = append(allowed, fav)
+		}
+	}
+	return allowed, nil
+}
+
+// RefreshCachedFavorites implements the KBFSOps interface for
+// delegatedKBFSOps.
+func (d *delegatedKBFSOps) RefreshCachedFavorites(ctx context.Context) {
+	d.wrapped.RefreshCachedFavorites(ctx)
+}
+
+// AddFavorite implements the KBFSOps interface for delegatedKBFSOps.
+func (d *delegatedKBFSOps) AddFavorite(
+	ctx context.Context, fav Favorite) error {
+	return WriteToReadonlyNodeError{fav.Name}
+}
+
+// DeleteFavorite implements the KBFSOps interface for
+// delegatedKBFSOps.
+func (d *delegatedKBFSOps) DeleteFavorite(
+	ctx context.Context, fav Favorite) error {
+	return WriteToReadonlyNodeError{fav.Name}
+}
+
+// ConfigureTlfs implements the KBFSOps interface for
+// delegatedKBFSOps.
+func (d *delegatedKBFSOps) ConfigureTlfs(
+	ctx context.Context, reqs []TlfConfigRequest) ([]error, error) {
+	return nil, WriteToReadonlyNodeError{"TLF configuration"}
+}
+
+// GetTLFID implements the KBFSOps interface for delegatedKBFSOps.
+func (d *delegatedKBFSOps) GetTLFID(
+	ctx context.Context, tlfHandle *TlfHandle) (tlf.ID, error) {
+	if err := d.checkRoot(tlfHandle); err != nil {
+		return tlf.NullID, err
+	}
+	return d.wrapped.GetTLFID(ctx, tlfHandle)
+}
+
+// GetTLFHandle implements the KBFSOps interface for delegatedKBFSOps.
+func (d *delegatedKBFSOps) GetTLFHandle(
+	ctx context.Context, node Node) (*TlfHandle, error) {
+	if _, err := d.checkNode(ctx, node, true); err != nil {
+		return nil, err
+	}
+	return d.wrapped.GetTLFHandle(ctx, node)
+}
+
+// GetAllocatedSize implements the KBFSOps interface for
+// delegatedKBFSOps.
+func (d *delegatedKBFSOps) GetAllocatedSize(
+	ctx context.Context, node Node) (uint64, error) {
+	if _, err := d.checkNode(ctx, node, true); err != nil {
+		return 0, err
+	}
+	return d.wrapped.GetAllocatedSize(ctx, node)
+}
+
+// GetFileBlockLayout implements the KBFSOps interface for
+// delegatedKBFSOps.
+func (d *delegatedKBFSOps) GetFileBlockLayout(
+	ctx context.Context, file Node) (FileBlockLayout, error) {
+	if _, err := d.checkNode(ctx, file, false); err != nil {
+		return FileBlockLayout{}, err
+	}
+	return d.wrapped.GetFileBlockLayout(ctx, file)
+}
+
+// CreateDir implements the KBFSOps interface for delegatedKBFSOps.
+func (d *delegatedKBFSOps) CreateDir(
+	ctx context.Context, dir Node, name string) (Node, EntryInfo, error) {
+	return nil, EntryInfo{}, WriteToReadonlyNodeError{name}
+}
+
+// CreateFile implements the KBFSOps interface for delegatedKBFSOps.
+func (d *delegatedKBFSOps) CreateFile(
+	ctx context.Context, dir Node, name string, isExec bool, excl Excl) (
+	Node, EntryInfo, error) {
+	return nil, EntryInfo{}, WriteToReadonlyNodeError{name}
+}
+
+// CreateFiles implements the KBFSOps interface for delegatedKBFSOps.
+func (d *delegatedKBFSOps) CreateFiles(
+	ctx context.Context, dir Node, files []NewFileInfo) (
+	[]Node, []EntryInfo, error) {
+	return nil, nil, WriteToReadonlyNodeError{dir.GetBasename()}
+}
+
+// InstantiateTemplate implements the KBFSOps interface for
+// delegatedKBFSOps.
+func (d *delegatedKBFSOps) InstantiateTemplate(
+	ctx context.Context, template Node, dir Node, name string) (
+	Node, EntryInfo, error) {
+	return nil, EntryInfo{}, WriteToReadonlyNodeError{name}
+}
+
+// CreateLink implements the KBFSOps interface for delegatedKBFSOps.
+func (d *delegatedKBFSOps) CreateLink(
+	ctx context.Context, dir Node, fromName string, toPath string) (
+	EntryInfo, error) {
+	return EntryInfo{}, WriteToReadonlyNodeError{fromName}
+}
+
+// RemoveDir implements the KBFSOps interface for delegatedKBFSOps.
+func (d *delegatedKBFSOps) RemoveDir(
+	ctx context.Context, dir Node, dirName string) error {
+	return WriteToReadonlyNodeError{dirName}
+}
+
+// RemoveEntry implements the KBFSOps interface for delegatedKBFSOps.
+func (d *delegatedKBFSOps) RemoveEntry(
+	ctx context.Context, dir Node, name string) error {
+	return WriteToReadonlyNodeError{name}
+}
+
+// Rename implements the KBFSOps interface for delegatedKBFSOps.
+func (d *delegatedKBFSOps) Rename(
+	ctx context.Context, oldParent Node, oldName string, newParent Node,
+	newName string) error {
+	return WriteToReadonlyNodeError{oldName}
+}
+
+// FetchFileRange implements the KBFSOps interface for
+// delegatedKBFSOps.
+func (d *delegatedKBFSOps) FetchFileRange(
+	ctx context.Context, file Node, off, length int64) (FileRange, error) {
+	if _, err := d.checkNode(ctx, file, false); err != nil {
+		return FileRange{}, err
+	}
+	return d.wrapped.FetchFileRange(ctx, file, off, length)
+}
+
+// GetLocalFileRanges implements the KBFSOps interface for
+// delegatedKBFSOps.
+func (d *delegatedKBFSOps) GetLocalFileRanges(
+	ctx context.Context, file Node) ([]FileRange, error) {
+	if _, err := d.checkNode(ctx, file, false); err != nil {
+		return nil, err
+	}
+	return d.wrapped.GetLocalFileRanges(ctx, file)
+}
+
+// Write implements the KBFSOps interface for delegatedKBFSOps.
+func (d *delegatedKBFSOps) Write(
+	ctx context.Context, file Node, data []byte, off int64) error {
+	return WriteToReadonlyNodeError{file.GetBasename()}
+}
+
+// WriteVec implements the KBFSOps interface for delegatedKBFSOps.
+func (d *delegatedKBFSOps) WriteVec(
+	ctx context.Context, file Node, vecs []IOVec) error {
+	return WriteToReadonlyNodeError{file.GetBasename()}
+}
+
+// WriteStream implements the KBFSOps interface for delegatedKBFSOps.
+func (d *delegatedKBFSOps) WriteStream(
+	ctx context.Context, file Node, r io.Reader, off int64) (int64, error) {
+	return 0, WriteToReadonlyNodeError{file.GetBasename()}
+}
+
+// CopyFileRange implements the KBFSOps interface for
+// delegatedKBFSOps.
+func (d *delegatedKBFSOps) CopyFileRange(
+	ctx context.Context, src, dst Node, srcOff, dstOff, length int64) (
+	int64, error) {
+	return 0, WriteToReadonlyNodeError{dst.GetBasename()}
+}
+
+// CloneFile implements the KBFSOps interface for delegatedKBFSOps.
+func (d *delegatedKBFSOps) CloneFile(
+	ctx context.Context, src Node, dstDir Node, name string) (
+	Node, EntryInfo, error) {
+	return nil, EntryInfo{}, WriteToReadonlyNodeError{name}
+}
+
+// Truncate implements the KBFSOps interface for delegatedKBFSOps.
+func (d *delegatedKBFSOps) Truncate(
+	ctx context.Context, file Node, size uint64) error {
+	return WriteToReadonlyNodeError{file.GetBasename()}
+}
+
+// SetEx implements the KBFSOps interface for delegatedKBFSOps.
+func (d *delegatedKBFSOps) SetEx(
+	ctx context.Context, file Node, ex bool) error {
+	return WriteToReadonlyNodeError{file.GetBasename()}
+}
+
+// SetExInSubtree implements the KBFSOps interface for
+// delegatedKBFSOps.
+func (d *delegatedKBFSOps) SetExInSubtree(
+	ctx context.Context, dir Node, ex bool) error {
+	return WriteToReadonlyNodeError{dir.GetBasename()}
+}
+
+// SetMtime implements the KBFSOps interface for delegatedKBFSOps.
+func (d *delegatedKBFSOps) SetMtime(
+	ctx context.Context, file Node, mtime *time.Time) error {
+	return WriteToReadonlyNodeError{file.GetBasename()}
+}
+
+// SetTimes implements the KBFSOps interface for delegatedKBFSOps.
+func (d *delegatedKBFSOps) SetTimes(
+	ctx context.Context, file Node, mtime time.Time,
+	ctime *time.Time) error {
+	return WriteToReadonlyNodeError{file.GetBasename()}
+}
+
+// SetTimesBatch implements the KBFSOps interface for
+// delegatedKBFSOps.
+func (d *delegatedKBFSOps) SetTimesBatch(
+	ctx context.Context, times []NodeTimes) error {
+	if len(times) == 0 {
+		return nil
+	}
+	return WriteToReadonlyNodeError{times[0].Node.GetBasename()}
+}
+
+// SyncAll implements the KBFSOps interface for delegatedKBFSOps.
+func (d *delegatedKBFSOps) SyncAll(
+	ctx context.Context, folderBranch FolderBranch) error {
+	return d.wrapped.SyncAll(ctx, folderBranch)
+}
+
+// SyncAllAsync implements the KBFSOps interface for
+// delegatedKBFSOps.
+func (d *delegatedKBFSOps) SyncAllAsync(
+	ctx context.Context, folderBranch FolderBranch) (SyncTicket, error) {
+	return d.wrapped.SyncAllAsync(ctx, folderBranch)
+}
+
+// Barrier implements the KBFSOps interface for delegatedKBFSOps.
+func (d *delegatedKBFSOps) Barrier(ctx context.Context, file Node) error {
+	return nil
+}
+
+// SetWriteThrough implements the KBFSOps interface for
+// delegatedKBFSOps.
+func (d *delegatedKBFSOps) SetWriteThrough(
+	ctx context.Context, file Node, writeThrough bool) error {
+	return WriteToReadonlyNodeError{file.GetBasename()}
+}
+
+// FolderStatus implements the KBFSOps interface for delegatedKBFSOps.
+func (d *delegatedKBFSOps) FolderStatus(
+	ctx context.Context, folderBranch FolderBranch) (
+	FolderBranchStatus, <-chan StatusUpdate, error) {
+	if err := d.token.checkExpiry(d.clock.Now()); err != nil {
+		return FolderBranchStatus{}, nil, err
+	}
+	return d.wrapped.FolderStatus(ctx, folderBranch)
+}
+
+// Status implements the KBFSOps interface for delegatedKBFSOps.
+func (d *delegatedKBFSOps) Status(ctx context.Context) (
+	KBFSStatus, <-chan StatusUpdate, error) {
+	return d.wrapped.Status(ctx)
+}
+
+// GetUnlinkedNodeStats implements the KBFSOps interface for
+// delegatedKBFSOps.
+func (d *delegatedKBFSOps) GetUnlinkedNodeStats(
+	ctx context.Context, folderBranch FolderBranch) (
+	UnlinkedNodeStats, error) {
+	return d.wrapped.GetUnlinkedNodeStats(ctx, folderBranch)
+}
+
+// SetTlfBlockSize implements the KBFSOps interface for
+// delegatedKBFSOps.
+func (d *delegatedKBFSOps) SetTlfBlockSize(
+	ctx context.Context, folderBranch FolderBranch, size int64) error {
+	return WriteToReadonlyNodeError{"TLF block size"}
+}
+
+// RevertToRevision implements the KBFSOps interface for
+// delegatedKBFSOps.  Even a dry run is refused, since it lists
+// paths that the token may not allow.
+func (d *delegatedKBFSOps) RevertToRevision(
+	ctx context.Context, folderBranch FolderBranch,
+	rev, expectedHead kbfsmd.Revision, dryRun bool) (TLFRevert, error) {
+	return TLFRevert{}, WriteToReadonlyNodeError{"TLF revert"}
+}
+
+// ReclaimUnlinkedNodes implements the KBFSOps interface for
+// delegatedKBFSOps.  It only frees local state.
+func (d *delegatedKBFSOps) ReclaimUnlinkedNodes(
+	ctx context.Context, folderBranch FolderBranch) (
+	UnlinkedNodeStats, error) {
+	return d.wrapped.ReclaimUnlinkedNodes(ctx, folderBranch)
+}
+
+// SubscribeSubtrees implements the KBFSOps interface for
+// delegatedKBFSOps.
+func (d *delegatedKBFSOps) SubscribeSubtrees(
+	ctx context.Context, folderBranch FolderBranch,
+	subtrees []string) error {
+	return d.wrapped.SubscribeSubtrees(ctx, folderBranch, subtrees)
+}
+
+// CancelSync implements the KBFSOps interface for delegatedKBFSOps.
+func (d *delegatedKBFSOps) CancelSync(ctx context.Context, file Node) error {
+	return nil
+}
+
+// UnstageForTesting implements the KBFSOps interface for
+// delegatedKBFSOps.
+func (d *delegatedKBFSOps) UnstageForTesting(
+	ctx context.Context, folderBranch FolderBranch) error {
+	return WriteToReadonlyNodeError{folderBranch.Tlf.String()}
+}
+
+// RequestRekey implements the KBFSOps interface for
+// delegatedKBFSOps.  The holder never rekeys.
+func (d *delegatedKBFSOps) RequestRekey(ctx context.Context, id tlf.ID) {}
+
+// SyncFromServer implements the KBFSOps interface for
+// delegatedKBFSOps.  It can't take a lock, since that's only needed
+// for writes.
+func (d *delegatedKBFSOps) SyncFromServer(
+	ctx context.Context, folderBranch FolderBranch,
+	lockBeforeGet *keybase1.LockID) error {
+	if lockBeforeGet != nil {
+		return WriteToReadonlyNodeError{folderBranch.Tlf.String()}
+	}
+	if err := d.token.checkExpiry(d.clock.Now()); err != nil {
+		return err
+	}
+	return d.wrapped.SyncFromServer(ctx, folderBranch, nil)
+}
+
+// GetNodeMetadata implements the KBFSOps interface for
+// delegatedKBFSOps.
+func (d *delegatedKBFSOps) GetNodeMetadata(
+	ctx context.Context, node Node) (NodeMetadata, error) {
+	if _, err := d.checkNode(ctx, node, true); err != nil {
+		return NodeMetadata{}, err
+	}
+	return d.wrapped.GetNodeMetadata(ctx, node)
+}
+
+// Shutdown implements the KBFSOps interface for delegatedKBFSOps.
+func (d *delegatedKBFSOps) Shutdown(ctx context.Context) error {
+	return d.wrapped.Shutdown(ctx)
+}
+
+// PushConnectionStatusChange implements the KBFSOps interface for
+// delegatedKBFSOps.
+func (d *delegatedKBFSOps) PushConnectionStatusChange(
+	service string, newStatus error) {
+	d.wrapped.PushConnectionStatusChange(service, newStatus)
+}
+
+// PushStatusChange implements the KBFSOps interface for
+// delegatedKBFSOps.
+func (d *delegatedKBFSOps) PushStatusChange() {
+	d.wrapped.PushStatusChange()
+}
+
+// ClearPrivateFolderMD implements the KBFSOps interface for
+// delegatedKBFSOps.
+func (d *delegatedKBFSOps) ClearPrivateFolderMD(ctx context.Context) {}
+
+// ForceFastForward implements the KBFSOps interface for
+// delegatedKBFSOps.
+func (d *delegatedKBFSOps) ForceFastForward(ctx context.Context) {
+	d.wrapped.ForceFastForward(ctx)
+}
+
+// TeamNameChanged implements the KBFSOps interface for
+// delegatedKBFSOps.
+func (d *delegatedKBFSOps) TeamNameChanged(
+	ctx context.Context, tid keybase1.TeamID) {
+	d.wrapped.TeamNameChanged(ctx, tid)
+}
+
+// TeamAbandoned implements the KBFSOps interface for
+// delegatedKBFSOps.
+func (d *delegatedKBFSOps) TeamAbandoned(
+	ctx context.Context, tid keybase1.TeamID) {
+	d.wrapped.TeamAbandoned(ctx, tid)
+}
+
+// MigrateToImplicitTeam implements the KBFSOps interface for
+// delegatedKBFSOps.
+func (d *delegatedKBFSOps) MigrateToImplicitTeam(
+	ctx context.Context, id tlf.ID) error {
+	return WriteToReadonlyNodeError{id.String()}
+}
+
+// KickoffAllOutstandingRekeys implements the KBFSOps interface for
+// delegatedKBFSOps.
+func (d *delegatedKBFSOps) KickoffAllOutstandingRekeys() error {
+	return WriteToReadonlyNodeError{"outstanding rekeys"}
+}
+
+// NewNotificationChannel implements the KBFSOps interface for
+// delegatedKBFSOps.
+func (d *delegatedKBFSOps) NewNotificationChannel(
+	ctx context.Context, handle *TlfHandle, convID chat1.ConversationID,
+	channelName string) {
+}
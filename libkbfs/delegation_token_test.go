@@ -0,0 +1,118 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	kbname "github.com/keybase/client/go/kbun"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDelegationToken(t *testing.T) {
+	var u1, u2 kbname.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsInitNoMocks(t, u1, u2)
+	defer kbfsTestShutdownNoMocks(t, config1, ctx, cancel)
+
+	clock := newTestClockNow()
+	config1.SetClock(clock)
+	config2 := ConfigAsUser(config1, u2)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	session2, err := config2.KBPKI().GetCurrentSession(ctx)
+	require.NoError(t, err)
+
+	t.Log("u1 makes a TLF that u2 can read, with two directories")
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, "u1#u2", tlf.Private)
+	kbfsOps1 := config1.KBFSOps()
+	for _, name := range []string{"a", "b"} {
+		dirNode, _, err := kbfsOps1.CreateDir(ctx, rootNode1, name)
+		require.NoError(t, err)
+		fileNode, _, err := kbfsOps1.CreateFile(
+			ctx, dirNode, "f", false, NoExcl)
+		require.NoError(t, err)
+		err = kbfsOps1.Write(ctx, fileNode, []byte(name), 0)
+		require.NoError(t, err)
+	}
+	err = kbfsOps1.SyncAll(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	t.Log("u1 gives u2 a token for just the first directory")
+	token, err := MintDelegationToken(ctx, config1, session2.UID,
+		[]string{"/keybase/private/u1#u2/a"}, time.Hour)
+	require.NoError(t, err)
+	buf, err := config1.Codec().Encode(token)
+	require.NoError(t, err)
+	var decoded DelegationToken
+	err = config1.Codec().Decode(buf, &decoded)
+	require.NoError(t, err)
+
+	t.Log("Tokens for someone else, or that have been changed, are rejected")
+	err = InstallDelegationToken(ctx, config1, decoded)
+	require.Error(t, err)
+	tampered := decoded
+	tampered.Paths = []string{"/keybase/private/u1#u2"}
+	err = InstallDelegationToken(ctx, config2, tampered)
+	require.Error(t, err)
+
+	err = InstallDelegationToken(ctx, config2, decoded)
+	require.NoError(t, err)
+
+	t.Log("u2 only sees the first directory")
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "u1#u2", tlf.Private)
+	kbfsOps2 := config2.KBFSOps()
+	children, err := kbfsOps2.GetDirChildren(ctx, rootNode2)
+	require.NoError(t, err)
+	require.Len(t, children, 1)
+	require.Contains(t, children, "a")
+	_, _, err = kbfsOps2.Lookup(ctx, rootNode2, "b")
+	require.IsType(t, NoSuchNameError{}, errors.Cause(err))
+	_, err = kbfsOps2.ReadFileAt(ctx, "/keybase/private/u1#u2/b/f")
+	require.IsType(t, NoSuchNameError{}, errors.Cause(err))
+	data, err := kbfsOps2.ReadFileAt(ctx, "/keybase/private/u1#u2/a/f")
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), data)
+
+	t.Log("u2 can't write, even in the first directory")
+	dirNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, dirNode2, "f")
+	require.NoError(t, err)
+	err = kbfsOps2.Write(ctx, fileNode2, []byte("x"), 0)
+	require.IsType(t, WriteToReadonlyNodeError{}, errors.Cause(err))
+	_, _, err = kbfsOps2.CreateFile(ctx, dirNode2, "g", false, NoExcl)
+	require.Error(t, err)
+	err = kbfsOps2.WriteFileAt(ctx, "/keybase/private/u1#u2/a/g", nil)
+	require.Error(t, err)
+
+	t.Log("u2 can't change favorites, and only sees the shared TLF")
+	err = kbfsOps2.AddFavorite(ctx, Favorite{"u2", tlf.Private})
+	require.IsType(t, WriteToReadonlyNodeError{}, errors.Cause(err))
+	favs, err := config2.KBFSOps().GetFavorites(ctx)
+	require.NoError(t, err)
+	for _, fav := range favs {
+		require.Equal(t, Favorite{"u1#u2", tlf.Private}, fav)
+	}
+	_, err = kbfsOps2.ConfigureTlfs(ctx, nil)
+	require.IsType(t, WriteToReadonlyNodeError{}, errors.Cause(err))
+	err = kbfsOps2.MigrateToImplicitTeam(
+		ctx, rootNode2.GetFolderBranch().Tlf)
+	require.IsType(t, WriteToReadonlyNodeError{}, errors.Cause(err))
+
+	t.Log("Nothing works once the token expires")
+	clock.Add(time.Hour)
+	buf = make([]byte, 1)
+	_, err = kbfsOps2.Read(ctx, fileNode2, buf, 0)
+	require.IsType(t, DelegationTokenExpiredError{}, errors.Cause(err))
+	_, _, err = kbfsOps2.Lookup(ctx, dirNode2, "f")
+	require.IsType(t, DelegationTokenExpiredError{}, errors.Cause(err))
+	_, err = config2.KBPKI().GetCurrentSession(ctx)
+	require.IsType(t, DelegationTokenExpiredError{}, errors.Cause(err))
+
+	// Shutting down needs the session.
+	clock.Add(-time.Hour)
+}
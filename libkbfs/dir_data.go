@@ -5,6 +5,9 @@
 package libkbfs
 
 import (
+	"fmt"
+	"hash/fnv"
+
 	"github.com/keybase/client/go/logger"
 	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/kbfs/kbfsblock"
@@ -63,6 +66,44 @@ var hiddenEntries = map[string]bool{
 	".kbfs_autogit": true,
 }
 
+// dirHashBucket returns the bucket that `name` belongs in, for a
+// directory sharded into `buckets` buckets.  This is part of the
+// HashedDirsDataVer format, and must never change.
+func dirHashBucket(name string, buckets int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(name))
+	return int(h.Sum32() % uint32(buckets))
+}
+
+// dirHashBucketPrefix returns the prefix of the offsets of all the
+// entries in the given bucket.  Fixed-width hex keeps the offsets in
+// bucket order.
+func dirHashBucketPrefix(bucket int) string {
+	return fmt.Sprintf("%08x", bucket)
+}
+
+// dirHashBucketOffset returns the offset of the first indirect
+// pointer of the given bucket.
+func dirHashBucketOffset(bucket int) StringOffset {
+	if bucket == 0 {
+		return ""
+	}
+	return StringOffset(dirHashBucketPrefix(bucket))
+}
+
+// offsetForName returns the offset under which the entry for `name`
+// is found in the directory with the given top block.  In a sharded
+// directory, that's the name prefixed by its bucket, so each bucket
+// covers its own range of offsets and can be split like any other
+// range of entries.
+func offsetForName(topBlock *DirBlock, name string) StringOffset {
+	if topBlock.IsInd && topBlock.HashBuckets > 0 {
+		bucket := dirHashBucket(name, topBlock.HashBuckets)
+		return StringOffset(dirHashBucketPrefix(bucket) + name)
+	}
+	return StringOffset(name)
+}
+
 func (dd *dirData) getTopBlock(ctx context.Context, rtype blockReqType) (
 	*DirBlock, error) {
 	topBlock, _, err := dd.getter(
@@ -136,7 +177,7 @@ func (dd *dirData) lookup(ctx context.Context, name string) (DirEntry, error) {
 		return DirEntry{}, err
 	}
 
-	off := StringOffset(name)
+	off := offsetForName(topBlock, name)
 	_, _, block, _, _, _, err := dd.tree.getBlockAtOffset(
 		ctx, topBlock, &off, blockLookup)
 	if err != nil {
@@ -193,12 +234,132 @@ func (dd *dirData) createIndirectBlock(ctx context.Context, dver DataVer) (
 	return dblock, nil
 }
 
+// isRightmostLeaf returns true if `parentBlocks` leads to the last
+// leaf block of an indirect directory.
+func isRightmostLeaf(parentBlocks []parentBlockAndChildIndex) bool {
+	if len(parentBlocks) == 0 {
+		return false
+	}
+	for _, pb := range parentBlocks {
+		if pb.childIndex != pb.pblock.NumIndirectPtrs()-1 {
+			return false
+		}
+	}
+	return true
+}
+
+// shardTopBlock replaces the direct top block of the directory with
+// an indirect one that shards its entries by name hash into
+// `buckets` new leaf blocks.  The number of buckets is fixed for the
+// life of the directory, but each bucket is split into more leaf
+// blocks as it grows.
+func (dd *dirData) shardTopBlock(
+	ctx context.Context, block *DirBlock, buckets int) error {
+	dd.tree.log.CDebugf(ctx, "Sharding dir %v into %d hash buckets",
+		dd.rootBlockPointer(), buckets)
+
+	topBlock := &DirBlock{
+		CommonBlock: CommonBlock{
+			IsInd: true,
+		},
+		IPtrs:       make([]IndirectDirPtr, 0, buckets),
+		HashBuckets: buckets,
+	}
+	leafs := make([]*DirBlock, buckets)
+	for i := range leafs {
+		newID, err := dd.tree.crypto.MakeTemporaryBlockID()
+		if err != nil {
+			return err
+		}
+		topBlock.IPtrs = append(topBlock.IPtrs, IndirectDirPtr{
+			BlockInfo: BlockInfo{
+				BlockPointer: BlockPointer{
+					ID:      newID,
+					KeyGen:  dd.tree.kmd.LatestKeyGeneration(),
+					DataVer: FirstValidDataVer,
+					Context: kbfsblock.MakeFirstContext(
+						dd.tree.chargedTo,
+						dd.rootBlockPointer().GetBlockType()),
+					DirectType: DirectBlock,
+				},
+				EncodedSize: 0,
+			},
+			Off: dirHashBucketOffset(i),
+		})
+		leafs[i] = NewDirBlock().(*DirBlock)
+	}
+	for name, de := range block.Children {
+		leafs[dirHashBucket(name, buckets)].Children[name] = de
+	}
+
+	for i, leaf := range leafs {
+		err := dd.tree.cacher(topBlock.IPtrs[i].BlockPointer, leaf)
+		if err != nil {
+			return err
+		}
+	}
+	return dd.tree.cacher(dd.rootBlockPointer(), topBlock)
+}
+
+// processModifiedBlock caches `block` and splits it if needed.
+// `newName`, if non-empty, is an entry that was just added to it.
 func (dd *dirData) processModifiedBlock(
 	ctx context.Context, ptr BlockPointer,
-	parentBlocks []parentBlockAndChildIndex, block *DirBlock) (
-	unrefs []BlockInfo, err error) {
+	parentBlocks []parentBlockAndChildIndex, block *DirBlock,
+	newName string) (unrefs []BlockInfo, err error) {
+	var shardedTop *DirBlock
+	if len(parentBlocks) > 0 &&
+		parentBlocks[0].pblock.(*DirBlock).HashBuckets > 0 {
+		shardedTop = parentBlocks[0].pblock.(*DirBlock)
+	}
+
 	newBlocks, newOffset := dd.tree.bsplit.SplitDirIfNeeded(block)
 
+	if len(newBlocks) > 1 && len(parentBlocks) == 0 {
+		if buckets := dd.tree.bsplit.DirHashBuckets(); buckets > 0 {
+			// Undo the split, and shard by hash instead.
+			for name, de := range newBlocks[1].Children {
+				block.Children[name] = de
+			}
+			return nil, dd.shardTopBlock(ctx, block, buckets)
+		}
+	}
+
+	if len(newBlocks) > 1 && newName != "" &&
+		isRightmostLeaf(parentBlocks) {
+		// If the new entry sorts after everything else in the last
+		// leaf, this is probably one of many in-order creates.
+		// Rather than splitting down the middle, which would leave a
+		// trail of half-full blocks, keep the old block full and
+		// start the new one with just the new entry.  That way the
+		// blocks on the left never need to be dirtied (and copied
+		// and re-encoded) again by later creates.
+		isAppend := true
+		for name := range newBlocks[1].Children {
+			if name > newName {
+				isAppend = false
+				break
+			}
+		}
+		if isAppend {
+			for name, de := range newBlocks[1].Children {
+				if name != newName {
+					newBlocks[0].Children[name] = de
+					delete(newBlocks[1].Children, name)
+				}
+			}
+			off := StringOffset(newName)
+			newOffset = &off
+		}
+	}
+
+	if len(newBlocks) > 1 && shardedTop != nil {
+		// All the entries in a leaf of a sharded directory are in the
+		// same bucket, so the new block starts within that bucket.
+		off := offsetForName(shardedTop, string(*newOffset))
+		newOffset = &off
+	}
+
 	err = dd.tree.cacher(ptr, block)
 	if err != nil {
 		return nil, err
@@ -233,6 +394,23 @@ func (dd *dirData) processModifiedBlock(
 			}
 		}
 
+		if shardedTop != nil && rightParents[0].pblock != shardedTop {
+			// `newRightBlock` added a level of indirection, so the
+			// new top block is the one that has to know about the
+			// buckets.
+			newTop := rightParents[0].pblock.(*DirBlock)
+			newTop.HashBuckets = shardedTop.HashBuckets
+			shardedTop.HashBuckets = 0
+			err = dd.tree.cacher(newTop.IPtrs[0].BlockPointer, shardedTop)
+			if err != nil {
+				return nil, err
+			}
+			err = dd.tree.cacher(dd.rootBlockPointer(), newTop)
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		// Cache the split block in place of the blank one made by
 		// `newRightBlock`.
 		pb := rightParents[len(rightParents)-1]
@@ -263,7 +441,7 @@ func (dd *dirData) addEntryHelper(
 		return nil, err
 	}
 
-	off := StringOffset(name)
+	off := offsetForName(topBlock, name)
 	ptr, parentBlocks, block, _, _, _, err := dd.tree.getBlockAtOffset(
 		ctx, topBlock, &off, blockWrite)
 	if err != nil {
@@ -280,7 +458,11 @@ func (dd *dirData) addEntryHelper(
 	}
 	dblock.Children[name] = newDe
 
-	return dd.processModifiedBlock(ctx, ptr, parentBlocks, dblock)
+	newName := name
+	if exists {
+		newName = ""
+	}
+	return dd.processModifiedBlock(ctx, ptr, parentBlocks, dblock, newName)
 }
 
 func (dd *dirData) addEntry(
@@ -308,7 +490,7 @@ func (dd *dirData) removeEntry(ctx context.Context, name string) (
 		return nil, err
 	}
 
-	off := StringOffset(name)
+	off := offsetForName(topBlock, name)
 	ptr, parentBlocks, block, _, _, _, err := dd.tree.getBlockAtOffset(
 		ctx, topBlock, &off, blockWrite)
 	if err != nil {
@@ -325,7 +507,7 @@ func (dd *dirData) removeEntry(ctx context.Context, name string) (
 	// For now, just leave the block empty, at its current place in
 	// the tree.  TODO: remove empty blocks all the way up the tree
 	// and shift parent pointers around as needed.
-	return dd.processModifiedBlock(ctx, ptr, parentBlocks, dblock)
+	return dd.processModifiedBlock(ctx, ptr, parentBlocks, dblock, "")
 }
 
 // ready, if given an indirect top-block, readies all the dirty child
@@ -336,7 +518,7 @@ func (dd *dirData) ready(ctx context.Context, id tlf.ID, bcache BlockCache,
 	dirtyBcache isDirtyProvider, bops BlockOps, bps *blockPutState,
 	topBlock *DirBlock) (map[BlockInfo]BlockPointer, error) {
 	return dd.tree.ready(
-		ctx, id, bcache, dirtyBcache, bops, bps, topBlock, nil)
+		ctx, id, bcache, dirtyBcache, bops, bps, topBlock, nil, nil)
 }
 
 // getDirtyChildPtrs returns a set of dirty child pointers (not the
@@ -19,6 +19,13 @@ import (
 )
 
 func setupDirDataTest(t *testing.T, maxPtrsPerBlock, numDirEntries int) (
+	*dirData, BlockCache, DirtyBlockCache) {
+	return setupDirDataTestWithHashBuckets(
+		t, maxPtrsPerBlock, numDirEntries, 0)
+}
+
+func setupDirDataTestWithHashBuckets(
+	t *testing.T, maxPtrsPerBlock, numDirEntries, hashBuckets int) (
 	*dirData, BlockCache, DirtyBlockCache) {
 	// Make a fake dir.
 	ptr := BlockPointer{
@@ -29,7 +36,8 @@ func setupDirDataTest(t *testing.T, maxPtrsPerBlock, numDirEntries int) (
 	dir := path{FolderBranch{Tlf: id}, []pathNode{{ptr, "dir"}}}
 	chargedTo := keybase1.MakeTestUID(1).AsUserOrTeam()
 	crypto := MakeCryptoCommon(kbfscodec.NewMsgpack())
-	bsplit := &BlockSplitterSimple{10, maxPtrsPerBlock, 10, numDirEntries}
+	bsplit := &BlockSplitterSimple{
+		10, maxPtrsPerBlock, 10, numDirEntries, hashBuckets}
 	kmd := emptyKeyMetadata{id, 1}
 
 	cleanCache := NewBlockCacheStandard(1<<10, 1<<20)
@@ -321,11 +329,11 @@ func testDirDataCheckLeafs(
 func testDirDataCleanCache(
 	dd *dirData, cleanBCache BlockCache, dirtyBCache DirtyBlockCache) {
 	dbc := dirtyBCache.(*DirtyBlockCacheStandard)
-	for id, block := range dbc.cache {
+	for id, entry := range dbc.cache {
 		ptr := BlockPointer{ID: id.id}
-		cleanBCache.Put(ptr, dd.tree.file.Tlf, block, TransientEntry)
+		cleanBCache.Put(ptr, dd.tree.file.Tlf, entry.block, TransientEntry)
 	}
-	dbc.cache = make(map[dirtyBlockID]Block)
+	dbc.cache = make(map[dirtyBlockID]dirtyBlockEntry)
 }
 
 func TestDirDataAddEntry(t *testing.T) {
@@ -392,8 +400,8 @@ func TestDirDataAddEntry(t *testing.T) {
 		{"a00", 2, true}, // "a00" and "a000"
 		{"a1", 2, true},  // "a1" and "a2"
 		{"b", 1, true},   // "b"
-		{"b1", 2, true},  // "b1" and "b2"
-		{"c", 1, true},   // "c"
+		{"b1", 1, true},  // "b1"
+		{"b2", 2, true},  // "b2" and "c"
 		{"d", 1, true},   // "d"
 		{"q", 2, true},   // "q" and "z"
 	}
@@ -424,6 +432,44 @@ func TestDirDataAddEntry(t *testing.T) {
 	require.Equal(t, NameExistsError{"a"}, err)
 }
 
+func TestDirDataAddEntryInOrder(t *testing.T) {
+	dd, cleanBcache, dirtyBcache := setupDirDataTest(t, 2, 2)
+	ctx := context.Background()
+	topBlock := NewDirBlock().(*DirBlock)
+	cleanBcache.Put(
+		dd.rootBlockPointer(), dd.tree.file.Tlf, topBlock, TransientEntry)
+
+	t.Log("The first split of a direct block is even")
+	addFakeDirDataEntry(t, ctx, dd, "a", 1)
+	addFakeDirDataEntry(t, ctx, dd, "b", 2)
+	addFakeDirDataEntry(t, ctx, dd, "c", 3)
+
+	t.Log("Appending to the last leaf leaves the full blocks alone")
+	addFakeDirDataEntry(t, ctx, dd, "d", 4)
+	addFakeDirDataEntry(t, ctx, dd, "e", 5)
+	addFakeDirDataEntry(t, ctx, dd, "f", 6)
+	expectedLeafs := []testDirDataLeaf{
+		{"", 1, true},  // "a"
+		{"b", 2, true}, // "b" and "c"
+		{"d", 2, true}, // "d" and "e"
+		{"f", 1, true}, // "f"
+	}
+	testDirDataCheckLeafs(t, dd, cleanBcache, dirtyBcache, expectedLeafs, 2, 2)
+
+	t.Log("Further appends only dirty the last leaf")
+	testDirDataCleanCache(dd, cleanBcache, dirtyBcache)
+	addFakeDirDataEntry(t, ctx, dd, "g", 7)
+	expectedLeafs = []testDirDataLeaf{
+		{"", 1, false},  // "a"
+		{"b", 2, false}, // "b" and "c"
+		{"d", 2, false}, // "d" and "e"
+		{"f", 2, true},  // "f" and "g"
+	}
+	testDirDataCheckLeafs(t, dd, cleanBcache, dirtyBcache, expectedLeafs, 2, 2)
+	testDirDataCheckLookup(t, ctx, dd, "e", 5)
+	testDirDataCheckLookup(t, ctx, dd, "g", 7)
+}
+
 func TestDirDataRemoveEntry(t *testing.T) {
 	dd, cleanBcache, dirtyBcache := setupDirDataTest(t, 2, 2)
 	ctx := context.Background()
@@ -465,8 +511,8 @@ func TestDirDataRemoveEntry(t *testing.T) {
 		{"a00", 2, false}, // "a00" and "a000"
 		{"a1", 2, false},  // "a1" and "a2"
 		{"b", 1, false},   // "b"
-		{"b1", 2, false},  // "b1" and "b2"
-		{"c", 0, true},    // now empty
+		{"b1", 1, false},  // "b1"
+		{"b2", 1, true},   // "b2", with "c" removed
 		{"d", 1, false},   // "d"
 		{"q", 2, false},   // "q" and "z"
 	}
@@ -519,8 +565,8 @@ func TestDirDataUpdateEntry(t *testing.T) {
 		{"a00", 2, false}, // "a00" and "a000"
 		{"a1", 2, false},  // "a1" and "a2"
 		{"b", 1, false},   // "b"
-		{"b1", 2, false},  // "b1" and "b2"
-		{"c", 1, true},    // "c"
+		{"b1", 1, false},  // "b1"
+		{"b2", 2, true},   // "b2" and "c"
 		{"d", 1, false},   // "d"
 		{"q", 2, false},   // "q" and "z"
 	}
@@ -534,3 +580,91 @@ func TestDirDataUpdateEntry(t *testing.T) {
 	require.Equal(t, NoSuchNameError{"foo"}, err)
 
 }
+
+func TestDirDataHashBuckets(t *testing.T) {
+	const buckets = 4
+	dd, cleanBcache, dirtyBcache := setupDirDataTestWithHashBuckets(
+		t, 2, 2, buckets)
+	ctx := context.Background()
+	topBlock := NewDirBlock().(*DirBlock)
+	cleanBcache.Put(
+		dd.rootBlockPointer(), dd.tree.file.Tlf, topBlock, TransientEntry)
+
+	t.Log("The first split shards the dir by hash")
+	addFakeDirDataEntry(t, ctx, dd, "a", 1)
+	addFakeDirDataEntry(t, ctx, dd, "b", 2)
+	addFakeDirDataEntry(t, ctx, dd, "c", 3)
+	cacheBlock, err := dirtyBcache.Get(
+		dd.tree.file.Tlf, dd.rootBlockPointer(), MasterBranch)
+	require.NoError(t, err)
+	topBlock = cacheBlock.(*DirBlock)
+	require.True(t, topBlock.IsIndirect())
+	require.Equal(t, buckets, topBlock.HashBuckets)
+	require.Equal(t, HashedDirsDataVer, topBlock.DataVersion())
+	require.Len(t, topBlock.IPtrs, buckets)
+
+	t.Log("Buckets split as they grow")
+	const numEntries = 40
+	for i := 3; i < numEntries; i++ {
+		addFakeDirDataEntry(t, ctx, dd, fmt.Sprintf("f%d", i), uint64(i+1))
+	}
+	cacheBlock, err = dirtyBcache.Get(
+		dd.tree.file.Tlf, dd.rootBlockPointer(), MasterBranch)
+	require.NoError(t, err)
+	topBlock = cacheBlock.(*DirBlock)
+	require.Equal(t, buckets, topBlock.HashBuckets)
+	total := 0
+	numLeaves := 0
+	var checkBlock func(block *DirBlock, start, end StringOffset)
+	checkBlock = func(block *DirBlock, start, end StringOffset) {
+		if block != topBlock {
+			require.Zero(t, block.HashBuckets)
+		}
+		if !block.IsInd {
+			numLeaves++
+			bucket := -1
+			for name := range block.Children {
+				if bucket < 0 {
+					bucket = dirHashBucket(name, buckets)
+				}
+				require.Equal(t, bucket, dirHashBucket(name, buckets))
+				off := offsetForName(topBlock, name)
+				require.False(t, off.Less(&start))
+				if end != "" {
+					require.True(t, off.Less(&end))
+				}
+				total++
+			}
+			return
+		}
+		for i, iptr := range block.IPtrs {
+			childEnd := end
+			if i+1 < len(block.IPtrs) {
+				childEnd = block.IPtrs[i+1].Off
+			}
+			cacheBlock, err := dirtyBcache.Get(
+				dd.tree.file.Tlf, iptr.BlockPointer, MasterBranch)
+			require.NoError(t, err)
+			checkBlock(cacheBlock.(*DirBlock), iptr.Off, childEnd)
+		}
+	}
+	checkBlock(topBlock, "", "")
+	require.Equal(t, numEntries, total)
+	require.True(t, numLeaves > buckets)
+	for i := 3; i < numEntries; i++ {
+		testDirDataCheckLookup(
+			t, ctx, dd, fmt.Sprintf("f%d", i), uint64(i+1))
+	}
+
+	t.Log("Lookups, removes and listings use the buckets")
+	testDirDataCheckLookup(t, ctx, dd, "a", 1)
+	testDirDataCheckLookup(t, ctx, dd, "c", 3)
+	testDirDataCheckLookup(t, ctx, dd, "f10", 11)
+	_, err = dd.removeEntry(ctx, "f10")
+	require.NoError(t, err)
+	_, err = dd.lookup(ctx, "f10")
+	require.Equal(t, NoSuchNameError{"f10"}, err)
+	children, err := dd.getChildren(ctx)
+	require.NoError(t, err)
+	require.Len(t, children, numEntries-1)
+}
@@ -21,8 +21,14 @@ type dirtyBlockID struct {
 	branch   BranchName
 }
 
+type dirtyBlockEntry struct {
+	tlfID tlf.ID
+	block Block
+}
+
 type dirtyReq struct {
 	respChan chan<- struct{}
+	tlfID    tlf.ID
 	bytes    int64
 	start    time.Time
 	deadline time.Time
@@ -144,13 +150,18 @@ type DirtyBlockCacheStandard struct {
 	isShutdown   bool
 
 	lock            sync.RWMutex
-	cache           map[dirtyBlockID]Block
+	cache           map[dirtyBlockID]dirtyBlockEntry
 	syncBufBytes    int64
 	waitBufBytes    int64
 	syncBufferCap   int64
 	ignoreSyncBytes int64 // these bytes have "timed out"
 	syncStarted     time.Time
 	resetter        *time.Timer
+
+	// Per-TLF accounting, used to give each TLF a fair share of the
+	// buffer when multiple TLFs are writing at the same time.
+	tlfWaitBufBytes map[tlf.ID]int64
+	tlfPendingReqs  map[tlf.ID]int
 }
 
 // NewDirtyBlockCacheStandard constructs a new BlockCacheStandard
@@ -166,11 +177,13 @@ func NewDirtyBlockCacheStandard(clock Clock,
 		requestsChan:       make(chan dirtyReq, 1000),
 		bytesDecreasedChan: make(chan struct{}, 1),
 		shutdownChan:       make(chan struct{}),
-		cache:              make(map[dirtyBlockID]Block),
+		cache:              make(map[dirtyBlockID]dirtyBlockEntry),
 		minSyncBufCap:      minSyncBufCap,
 		maxSyncBufCap:      maxSyncBufCap,
 		syncBufferCap:      startSyncBufCap,
 		resetBufferCapTime: resetBufferCapTimeDefault,
+		tlfWaitBufBytes:    make(map[tlf.ID]int64),
+		tlfPendingReqs:     make(map[tlf.ID]int),
 	}
 	d.reqWg.Add(1)
 	go d.processPermission()
@@ -181,7 +194,7 @@ func NewDirtyBlockCacheStandard(clock Clock,
 // put/get/delete requests; it cannot track dirty bytes.
 func simpleDirtyBlockCacheStandard() *DirtyBlockCacheStandard {
 	return &DirtyBlockCacheStandard{
-		cache: make(map[dirtyBlockID]Block),
+		cache: make(map[dirtyBlockID]dirtyBlockEntry),
 	}
 }
 
@@ -197,7 +210,7 @@ func (d *DirtyBlockCacheStandard) Get(_ tlf.ID, ptr BlockPointer,
 		}
 		d.lock.RLock()
 		defer d.lock.RUnlock()
-		return d.cache[dirtyID]
+		return d.cache[dirtyID].block
 	}()
 	if block != nil {
 		return block, nil
@@ -208,7 +221,7 @@ func (d *DirtyBlockCacheStandard) Get(_ tlf.ID, ptr BlockPointer,
 
 // Put implements the DirtyBlockCache interface for
 // DirtyBlockCacheStandard.
-func (d *DirtyBlockCacheStandard) Put(_ tlf.ID, ptr BlockPointer,
+func (d *DirtyBlockCacheStandard) Put(tlfID tlf.ID, ptr BlockPointer,
 	branch BranchName, block Block) error {
 	dirtyID := dirtyBlockID{
 		id:       ptr.ID,
@@ -218,7 +231,7 @@ func (d *DirtyBlockCacheStandard) Put(_ tlf.ID, ptr BlockPointer,
 
 	d.lock.Lock()
 	defer d.lock.Unlock()
-	d.cache[dirtyID] = block
+	d.cache[dirtyID] = dirtyBlockEntry{tlfID, block}
 	return nil
 }
 
@@ -262,6 +275,18 @@ func (d *DirtyBlockCacheStandard) IsAnyDirty(_ tlf.ID) bool {
 	return len(d.cache) > 0 || d.syncBufBytes > 0 || d.waitBufBytes > 0
 }
 
+// memoryUsage returns the estimated memory held by the dirty blocks
+// in this cache.
+func (d *DirtyBlockCacheStandard) memoryUsage() MemoryUsage {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	var usage MemoryUsage
+	for _, e := range d.cache {
+		usage.add(e.tlfID, int64(getCachedBlockSize(e.block)))
+	}
+	return usage
+}
+
 const backpressureSlack = 1 * time.Second
 
 // calcBackpressure returns how much longer a given request should be
@@ -306,7 +331,8 @@ func (d *DirtyBlockCacheStandard) calcBackpressure(start time.Time,
 	return totalBackpressure - timeSpentSoFar
 }
 
-func (d *DirtyBlockCacheStandard) acceptNewWrite(newBytes int64) bool {
+func (d *DirtyBlockCacheStandard) acceptNewWrite(
+	tlfID tlf.ID, newBytes int64) bool {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 	// Accept any write, as long as we're not already over the limits.
@@ -315,7 +341,8 @@ func (d *DirtyBlockCacheStandard) acceptNewWrite(newBytes int64) bool {
 	// sync.
 	canAccept := d.waitBufBytes < d.maxSyncBufCap*2
 	if canAccept {
-		d.waitBufBytes += newBytes
+		d.updateWaitBufLocked(tlfID, newBytes)
+		d.removePendingReqLocked(tlfID)
 	}
 
 	return canAccept
@@ -439,7 +466,7 @@ func (d *DirtyBlockCacheStandard) processPermission() {
 			// Apply any backpressure?
 			backpressure = d.calcBackpressure(currentReq.start,
 				currentReq.deadline)
-			if backpressure == 0 && d.acceptNewWrite(currentReq.bytes) {
+			if backpressure == 0 && d.acceptNewWrite(currentReq.tlfID, currentReq.bytes) {
 				// If we have an active request, and we have room in
 				// our buffers to deal with it, grant permission to
 				// the requestor by closing the response channel.
@@ -478,7 +505,7 @@ func (d *DirtyBlockCacheStandard) processPermission() {
 // RequestPermissionToDirty implements the DirtyBlockCache interface
 // for DirtyBlockCacheStandard.
 func (d *DirtyBlockCacheStandard) RequestPermissionToDirty(
-	ctx context.Context, _ tlf.ID, estimatedDirtyBytes int64) (
+	ctx context.Context, tlfID tlf.ID, estimatedDirtyBytes int64) (
 	DirtyPermChan, error) {
 	d.shutdownLock.RLock()
 	defer d.shutdownLock.RUnlock()
@@ -497,6 +524,13 @@ func (d *DirtyBlockCacheStandard) RequestPermissionToDirty(
 		return c, nil
 	}
 
+	// Let writes through right away if other TLFs are hogging the
+	// buffer, as long as this TLF is within its reserved share.
+	if d.grantReservedWrite(tlfID, estimatedDirtyBytes) {
+		close(c)
+		return c, nil
+	}
+
 	now := d.clock.Now()
 	deadline, ok := ctx.Deadline()
 	defaultDeadline := now.Add(backgroundTaskTimeout / 2)
@@ -505,15 +539,58 @@ func (d *DirtyBlockCacheStandard) RequestPermissionToDirty(
 		// never get close to a timeout in a background task.
 		deadline = defaultDeadline
 	}
-	req := dirtyReq{c, estimatedDirtyBytes, now, deadline}
+	req := dirtyReq{c, tlfID, estimatedDirtyBytes, now, deadline}
+	d.addPendingReq(tlfID)
 	select {
 	case d.requestsChan <- req:
 		return c, nil
 	case <-ctx.Done():
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		d.removePendingReqLocked(tlfID)
 		return nil, ctx.Err()
 	}
 }
 
+// grantReservedWrite charges the given bytes to the buffer and
+// returns true if the write can skip the shared request queue.  This
+// happens when other TLFs currently have dirty bytes or queued
+// requests, and the given TLF has no queued requests of its own (to
+// keep its writes in order) and its dirty bytes would stay within the
+// minimum sync buffer capacity.  That way one TLF's huge write can't
+// starve small writes to other TLFs.
+func (d *DirtyBlockCacheStandard) grantReservedWrite(
+	tlfID tlf.ID, bytes int64) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.tlfPendingReqs[tlfID] > 0 {
+		return false
+	}
+	tlfBytes := d.tlfWaitBufBytes[tlfID]
+	if tlfBytes+bytes > d.minSyncBufCap {
+		return false
+	}
+	othersBusy := d.waitBufBytes > tlfBytes || len(d.tlfPendingReqs) > 0
+	if !othersBusy {
+		return false
+	}
+	d.updateWaitBufLocked(tlfID, bytes)
+	return true
+}
+
+func (d *DirtyBlockCacheStandard) addPendingReq(tlfID tlf.ID) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.tlfPendingReqs[tlfID]++
+}
+
+func (d *DirtyBlockCacheStandard) removePendingReqLocked(tlfID tlf.ID) {
+	d.tlfPendingReqs[tlfID]--
+	if d.tlfPendingReqs[tlfID] <= 0 {
+		delete(d.tlfPendingReqs, tlfID)
+	}
+}
+
 func (d *DirtyBlockCacheStandard) signalDecreasedBytes() {
 	select {
 	case d.bytesDecreasedChan <- struct{}{}:
@@ -522,7 +599,18 @@ func (d *DirtyBlockCacheStandard) signalDecreasedBytes() {
 	}
 }
 
-func (d *DirtyBlockCacheStandard) updateWaitBufLocked(bytes int64) {
+func (d *DirtyBlockCacheStandard) updateWaitBufLocked(
+	tlfID tlf.ID, bytes int64) {
+	if d.tlfWaitBufBytes == nil {
+		d.tlfWaitBufBytes = make(map[tlf.ID]int64)
+	}
+	tlfBytes := d.tlfWaitBufBytes[tlfID] + bytes
+	if tlfBytes > 0 {
+		d.tlfWaitBufBytes[tlfID] = tlfBytes
+	} else {
+		delete(d.tlfWaitBufBytes, tlfID)
+	}
+
 	d.waitBufBytes += bytes
 	if d.waitBufBytes < 0 {
 		// It would be better if we didn't have this check, but it's
@@ -535,14 +623,14 @@ func (d *DirtyBlockCacheStandard) updateWaitBufLocked(bytes int64) {
 
 // UpdateUnsyncedBytes implements the DirtyBlockCache interface for
 // DirtyBlockCacheStandard.
-func (d *DirtyBlockCacheStandard) UpdateUnsyncedBytes(_ tlf.ID,
+func (d *DirtyBlockCacheStandard) UpdateUnsyncedBytes(tlfID tlf.ID,
 	newUnsyncedBytes int64, wasSyncing bool) {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 	if wasSyncing {
 		d.syncBufBytes += newUnsyncedBytes
 	} else {
-		d.updateWaitBufLocked(newUnsyncedBytes)
+		d.updateWaitBufLocked(tlfID, newUnsyncedBytes)
 	}
 	if newUnsyncedBytes < 0 {
 		d.signalDecreasedBytes()
@@ -551,24 +639,26 @@ func (d *DirtyBlockCacheStandard) UpdateUnsyncedBytes(_ tlf.ID,
 
 // UpdateSyncingBytes implements the DirtyBlockCache interface for
 // DirtyBlockCacheStandard.
-func (d *DirtyBlockCacheStandard) UpdateSyncingBytes(_ tlf.ID, size int64) {
+func (d *DirtyBlockCacheStandard) UpdateSyncingBytes(
+	tlfID tlf.ID, size int64) {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 	d.syncBufBytes += size
-	d.updateWaitBufLocked(-size)
+	d.updateWaitBufLocked(tlfID, -size)
 	d.signalDecreasedBytes()
 }
 
 // BlockSyncFinished implements the DirtyBlockCache interface for
 // DirtyBlockCacheStandard.
-func (d *DirtyBlockCacheStandard) BlockSyncFinished(_ tlf.ID, size int64) {
+func (d *DirtyBlockCacheStandard) BlockSyncFinished(
+	tlfID tlf.ID, size int64) {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 	if size > 0 {
 		d.syncBufBytes -= size
 	} else {
 		// The block will be retried, so put it back on the waitBuf
-		d.updateWaitBufLocked(-size)
+		d.updateWaitBufLocked(tlfID, -size)
 	}
 	if size > 0 {
 		d.signalDecreasedBytes()
@@ -656,7 +746,8 @@ func (d *DirtyBlockCacheStandard) Shutdown() error {
 	defer d.lock.Unlock()
 	// Clear out the remaining requests
 	for req := range d.requestsChan {
-		d.updateWaitBufLocked(req.bytes)
+		d.updateWaitBufLocked(req.tlfID, req.bytes)
+		d.removePendingReqLocked(req.tlfID)
 	}
 	if d.syncBufBytes != 0 || d.waitBufBytes != 0 || d.ignoreSyncBytes != 0 {
 		return fmt.Errorf("Unexpected dirty bytes leftover on shutdown: "+
@@ -665,3 +756,82 @@ func (d *DirtyBlockCacheStandard) Shutdown() error {
 	}
 	return nil
 }
+
+// emptyDirtyBlockCache is a DirtyBlockCache for modes that never
+// dirty any blocks.  It's always empty, and refuses to hold anything,
+// so that read paths can still check it.
+type emptyDirtyBlockCache struct{}
+
+var _ DirtyBlockCache = emptyDirtyBlockCache{}
+
+// IsDirty implements the DirtyBlockCache interface for
+// emptyDirtyBlockCache.
+func (emptyDirtyBlockCache) IsDirty(
+	_ tlf.ID, _ BlockPointer, _ BranchName) bool {
+	return false
+}
+
+// Get implements the DirtyBlockCache interface for
+// emptyDirtyBlockCache.
+func (emptyDirtyBlockCache) Get(
+	_ tlf.ID, ptr BlockPointer, _ BranchName) (Block, error) {
+	return nil, NoSuchBlockError{ptr.ID}
+}
+
+// Put implements the DirtyBlockCache interface for
+// emptyDirtyBlockCache.
+func (emptyDirtyBlockCache) Put(
+	_ tlf.ID, ptr BlockPointer, _ BranchName, _ Block) error {
+	return fmt.Errorf("Can't dirty block %v without a dirty block cache",
+		ptr)
+}
+
+// Delete implements the DirtyBlockCache interface for
+// emptyDirtyBlockCache.
+func (emptyDirtyBlockCache) Delete(
+	_ tlf.ID, _ BlockPointer, _ BranchName) error {
+	return nil
+}
+
+// IsAnyDirty implements the DirtyBlockCache interface for
+// emptyDirtyBlockCache.
+func (emptyDirtyBlockCache) IsAnyDirty(_ tlf.ID) bool {
+	return false
+}
+
+// RequestPermissionToDirty implements the DirtyBlockCache interface
+// for emptyDirtyBlockCache.
+func (emptyDirtyBlockCache) RequestPermissionToDirty(
+	_ context.Context, _ tlf.ID, estimatedDirtyBytes int64) (
+	DirtyPermChan, error) {
+	return nil, fmt.Errorf("Can't dirty %d bytes without a dirty "+
+		"block cache", estimatedDirtyBytes)
+}
+
+// UpdateUnsyncedBytes implements the DirtyBlockCache interface for
+// emptyDirtyBlockCache.
+func (emptyDirtyBlockCache) UpdateUnsyncedBytes(_ tlf.ID, _ int64, _ bool) {}
+
+// UpdateSyncingBytes implements the DirtyBlockCache interface for
+// emptyDirtyBlockCache.
+func (emptyDirtyBlockCache) UpdateSyncingBytes(_ tlf.ID, _ int64) {}
+
+// BlockSyncFinished implements the DirtyBlockCache interface for
+// emptyDirtyBlockCache.
+func (emptyDirtyBlockCache) BlockSyncFinished(_ tlf.ID, _ int64) {}
+
+// SyncFinished implements the DirtyBlockCache interface for
+// emptyDirtyBlockCache.
+func (emptyDirtyBlockCache) SyncFinished(_ tlf.ID, _ int64) {}
+
+// ShouldForceSync implements the DirtyBlockCache interface for
+// emptyDirtyBlockCache.
+func (emptyDirtyBlockCache) ShouldForceSync(_ tlf.ID) bool {
+	return false
+}
+
+// Shutdown implements the DirtyBlockCache interface for
+// emptyDirtyBlockCache.
+func (emptyDirtyBlockCache) Shutdown() error {
+	return nil
+}
@@ -210,6 +210,85 @@ func TestDirtyBcacheRequestPermission(t *testing.T) {
 	dirtyBcache.SyncFinished(id, 4*bufSize+2)
 }
 
+func TestDirtyBcacheRequestPermissionMultipleTLFs(t *testing.T) {
+	bufSize := int64(5)
+	dirtyBcache := NewDirtyBlockCacheStandard(&wallClock{}, logger.NewTestLogger(t),
+		bufSize, bufSize*2, bufSize)
+	defer dirtyBcache.Shutdown()
+	blockedChan := make(chan int64, 1)
+	dirtyBcache.blockedChanForTesting = blockedChan
+	ctx := context.Background()
+
+	// Fill up the buffer with a big write from one TLF.
+	id1 := tlf.FakeID(1, tlf.Private)
+	c1, err := dirtyBcache.RequestPermissionToDirty(ctx, id1, bufSize*2+1)
+	if err != nil {
+		t.Fatalf("Request permission error: %v", err)
+	}
+	<-c1
+	if blockedSize := <-blockedChan; blockedSize != -1 {
+		t.Fatalf("Wrong blocked size: %d", blockedSize)
+	}
+
+	// The next request from the same TLF should block.
+	c2, err := dirtyBcache.RequestPermissionToDirty(ctx, id1, bufSize)
+	if err != nil {
+		t.Fatalf("Request permission error: %v", err)
+	}
+	if blockedSize := <-blockedChan; blockedSize != bufSize {
+		t.Fatalf("Wrong blocked size: %d", blockedSize)
+	}
+
+	// But a small write from a different TLF gets through right
+	// away, up to its reserved share.
+	id2 := tlf.FakeID(2, tlf.Private)
+	c3, err := dirtyBcache.RequestPermissionToDirty(ctx, id2, bufSize-1)
+	if err != nil {
+		t.Fatalf("Request permission error: %v", err)
+	}
+	select {
+	case <-c3:
+	default:
+		t.Fatalf("Small write to another TLF was blocked")
+	}
+
+	// Writes beyond the reserved share go through the shared queue,
+	// behind the first TLF's request.
+	c4, err := dirtyBcache.RequestPermissionToDirty(ctx, id2, bufSize)
+	if err != nil {
+		t.Fatalf("Request permission error: %v", err)
+	}
+	select {
+	case <-c4:
+		t.Fatalf("Big write to another TLF should be blocked")
+	default:
+	}
+
+	// Sync everything, which should unblock the queued requests.
+	dirtyBcache.UpdateSyncingBytes(id1, 2*bufSize+1)
+	if blockedSize := <-blockedChan; blockedSize != -1 {
+		t.Fatalf("Wrong blocked size: %d", blockedSize)
+	}
+	<-c2
+	// The second TLF's request is next in line, but there are still
+	// too many unsynced bytes.
+	if blockedSize := <-blockedChan; blockedSize != bufSize {
+		t.Fatalf("Wrong blocked size: %d", blockedSize)
+	}
+	dirtyBcache.UpdateSyncingBytes(id1, bufSize)
+	dirtyBcache.UpdateSyncingBytes(id2, bufSize-1)
+	if blockedSize := <-blockedChan; blockedSize != -1 {
+		t.Fatalf("Wrong blocked size: %d", blockedSize)
+	}
+	<-c4
+
+	dirtyBcache.UpdateSyncingBytes(id2, bufSize)
+	dirtyBcache.BlockSyncFinished(id1, 3*bufSize+1)
+	dirtyBcache.BlockSyncFinished(id2, 2*bufSize-1)
+	dirtyBcache.SyncFinished(id1, 3*bufSize+1)
+	dirtyBcache.SyncFinished(id2, 2*bufSize-1)
+}
+
 func TestDirtyBcacheCalcBackpressure(t *testing.T) {
 	bufSize := int64(10)
 	clock, now := newTestClockAndTimeNow()
@@ -7,6 +7,7 @@ package libkbfs
 import (
 	"fmt"
 	"sync"
+	"time"
 )
 
 // dirtyBlockSyncState represents that state of a block with respect to
@@ -41,6 +42,26 @@ type dirtyBlockState struct {
 	orphaned bool
 }
 
+// earlyReadiedBlock is a complete dirty leaf block that was readied,
+// and whose put was started, before the file was synced.
+type earlyReadiedBlock struct {
+	info           BlockInfo
+	readyBlockData ReadyBlockData
+	// putDone is closed once the put finishes, after which putErr
+	// is safe to read.
+	putDone chan struct{}
+	putErr  error
+}
+
+func (erb *earlyReadiedBlock) isPut() bool {
+	select {
+	case <-erb.putDone:
+		return erb.putErr == nil
+	default:
+		return false
+	}
+}
+
 // dirtyFile represents a particular file that's been written to, but
 // has not yet completed syncing its dirty blocks to the server.
 type dirtyFile struct {
@@ -80,6 +101,28 @@ type dirtyFile struct {
 	// the channel on an outstanding Sync() completes.  If they
 	// receive an error, they should fail the write.
 	errListeners []chan<- error
+	// syncErr is the most recent error passed to the error
+	// listeners, if any.
+	syncErr *FileSyncError
+	// earlyReadied holds the dirty leaf blocks that have already been
+	// readied and put to the server ahead of the next sync, keyed by
+	// their dirty block pointers.  An entry is removed as soon as its
+	// block is dirtied again.
+	earlyReadied map[BlockPointer]*earlyReadiedBlock
+	// earlyReadyOff is the offset of the first leaf block that
+	// hasn't been looked at for an early put yet, or nil if none
+	// have been.  Every block before it was readied early at most
+	// once, even if it was dirtied again since then.
+	earlyReadyOff Offset
+	// splicedRefs holds the leaf blocks of other files that were
+	// spliced into this one by CopyFileRange, and that already have
+	// their new references on the server.  They're added to the MD
+	// by the next sync.
+	splicedRefs []BlockInfo
+	// blockSize is the block size recorded in the file's directory
+	// entry (see `EntryInfo.BlockSize`) by the last write or
+	// truncate, so that syncs split the dirty blocks the same way.
+	blockSize int64
 }
 
 func newDirtyFile(file path, dirtyBcache DirtyBlockCache) *dirtyFile {
@@ -87,6 +130,7 @@ func newDirtyFile(file path, dirtyBcache DirtyBlockCache) *dirtyFile {
 		path:            file,
 		dirtyBcache:     dirtyBcache,
 		fileBlockStates: make(map[BlockPointer]dirtyBlockState),
+		earlyReadied:    make(map[BlockPointer]*earlyReadiedBlock),
 	}
 }
 
@@ -96,6 +140,18 @@ func (df *dirtyFile) blockNeedsCopy(ptr BlockPointer) bool {
 	return df.fileBlockStates[ptr].copy == blockNeedsCopy
 }
 
+func (df *dirtyFile) setBlockSize(blockSize int64) {
+	df.lock.Lock()
+	defer df.lock.Unlock()
+	df.blockSize = blockSize
+}
+
+func (df *dirtyFile) getBlockSize() int64 {
+	df.lock.Lock()
+	defer df.lock.Unlock()
+	return df.blockSize
+}
+
 func (df *dirtyFile) updateNotYetSyncingBytes(newBytes int64) {
 	df.lock.Lock()
 	defer df.lock.Unlock()
@@ -210,8 +266,10 @@ func (df *dirtyFile) resetSyncingBlocksToDirty() {
 			// Re-dirty the unsynced bytes (but don't touch the total
 			// bytes).
 			df.dirtyBcache.BlockSyncFinished(df.path.Tlf, -state.syncSize)
+			df.notYetSyncingBytes += state.syncSize
 		} else if state.sync == blockSyncing {
 			df.dirtyBcache.UpdateSyncingBytes(df.path.Tlf, -state.syncSize)
+			df.notYetSyncingBytes += state.syncSize
 		}
 		if state.sync != blockNotSyncing {
 			state.copy = blockAlreadyCopied
@@ -300,10 +358,13 @@ func (df *dirtyFile) addErrListener(listener chan<- error) {
 	df.errListeners = append(df.errListeners, listener)
 }
 
-func (df *dirtyFile) notifyErrListeners(err error) {
+func (df *dirtyFile) notifyErrListeners(err error, now time.Time) {
 	df.lock.Lock()
 	listeners := df.errListeners
 	df.errListeners = nil
+	if err != nil {
+		df.syncErr = &FileSyncError{Error: err.Error(), Time: now}
+	}
 	df.lock.Unlock()
 	if err == nil {
 		return
@@ -313,6 +374,12 @@ func (df *dirtyFile) notifyErrListeners(err error) {
 	}
 }
 
+func (df *dirtyFile) getSyncErr() *FileSyncError {
+	df.lock.Lock()
+	defer df.lock.Unlock()
+	return df.syncErr
+}
+
 func (df *dirtyFile) setBlockOrphaned(ptr BlockPointer, orphaned bool) {
 	df.lock.Lock()
 	defer df.lock.Unlock()
@@ -339,3 +406,95 @@ func (df *dirtyFile) assimilateDeferredNewBytes() {
 	df.dirtyBcache.UpdateUnsyncedBytes(df.path.Tlf, df.deferredNewBytes, false)
 	df.deferredNewBytes = 0
 }
+
+func (df *dirtyFile) isEarlyReadied(ptr BlockPointer) bool {
+	df.lock.Lock()
+	defer df.lock.Unlock()
+	_, ok := df.earlyReadied[ptr]
+	return ok
+}
+
+func (df *dirtyFile) addEarlyReadied(
+	ptr BlockPointer, erb *earlyReadiedBlock) {
+	df.lock.Lock()
+	defer df.lock.Unlock()
+	df.earlyReadied[ptr] = erb
+}
+
+func (df *dirtyFile) getEarlyReadyOff() Offset {
+	df.lock.Lock()
+	defer df.lock.Unlock()
+	return df.earlyReadyOff
+}
+
+func (df *dirtyFile) setEarlyReadyOff(off Offset) {
+	df.lock.Lock()
+	defer df.lock.Unlock()
+	df.earlyReadyOff = off
+}
+
+// takeEarlyReadied removes and returns the early-readied version of
+// the given block, if any.
+func (df *dirtyFile) takeEarlyReadied(ptr BlockPointer) *earlyReadiedBlock {
+	df.lock.Lock()
+	defer df.lock.Unlock()
+	erb := df.earlyReadied[ptr]
+	delete(df.earlyReadied, ptr)
+	return erb
+}
+
+// takePutEarlyReadied removes and returns the early-readied version
+// of the given block, but only if its put has already succeeded.
+func (df *dirtyFile) takePutEarlyReadied(ptr BlockPointer) (
+	BlockInfo, ReadyBlockData, bool) {
+	df.lock.Lock()
+	defer df.lock.Unlock()
+	erb, ok := df.earlyReadied[ptr]
+	if !ok || !erb.isPut() {
+		return BlockInfo{}, ReadyBlockData{}, false
+	}
+	delete(df.earlyReadied, ptr)
+	return erb.info, erb.readyBlockData, true
+}
+
+// takeAllEarlyReadied removes and returns all the early-readied
+// blocks, and starts the next early puts over from the beginning of
+// the file.
+func (df *dirtyFile) takeAllEarlyReadied() []*earlyReadiedBlock {
+	df.lock.Lock()
+	defer df.lock.Unlock()
+	df.earlyReadyOff = nil
+	erbs := make([]*earlyReadiedBlock, 0, len(df.earlyReadied))
+	for ptr, erb := range df.earlyReadied {
+		erbs = append(erbs, erb)
+		delete(df.earlyReadied, ptr)
+	}
+	return erbs
+}
+
+func (df *dirtyFile) addSplicedRefs(infos []BlockInfo) {
+	df.lock.Lock()
+	defer df.lock.Unlock()
+	df.splicedRefs = append(df.splicedRefs, infos...)
+}
+
+// takeSplicedRefs removes and returns all the spliced-in leaf blocks.
+func (df *dirtyFile) takeSplicedRefs() []BlockInfo {
+	df.lock.Lock()
+	defer df.lock.Unlock()
+	infos := df.splicedRefs
+	df.splicedRefs = nil
+	return infos
+}
+
+// earlyPutsInProgress returns channels that will be closed once each
+// of the currently-outstanding early puts has finished.
+func (df *dirtyFile) earlyPutsInProgress() []<-chan struct{} {
+	df.lock.Lock()
+	defer df.lock.Unlock()
+	var chs []<-chan struct{}
+	for _, erb := range df.earlyReadied {
+		chs = append(chs, erb.putDone)
+	}
+	return chs
+}
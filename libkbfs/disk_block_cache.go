@@ -18,6 +18,7 @@ import (
 	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/kbfs/ioutil"
 	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfscodec"
 	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/kbfshash"
 	"github.com/keybase/kbfs/tlf"
@@ -41,6 +42,7 @@ const (
 	metaDbFilename                string = "diskCacheMetadata.leveldb"
 	tlfDbFilename                 string = "diskCacheTLF.leveldb"
 	versionFilename               string = "version"
+	cleanShutdownFilename         string = "cleanShutdown"
 	initialDiskCacheVersion       uint64 = 1
 	currentDiskCacheVersion       uint64 = initialDiskCacheVersion
 	syncCacheName                 string = "SyncBlockCache"
@@ -80,6 +82,11 @@ type DiskBlockCacheLocal struct {
 	shutdownCh chan struct{}
 
 	closer func()
+
+	// cleanShutdownPath is where the block counts are saved on
+	// shutdown, so that the next startup doesn't have to scan the
+	// metadata db for them.  If empty, they're always scanned.
+	cleanShutdownPath string
 }
 
 var _ DiskBlockCache = (*DiskBlockCacheLocal)(nil)
@@ -146,12 +153,30 @@ type DiskBlockCacheStatus struct {
 	SizeDeleted     MeterStatus
 }
 
+// diskBlockCacheTLFCounts is the number and size of the cached blocks
+// of one TLF.
+type diskBlockCacheTLFCounts struct {
+	TlfID tlf.ID
+	Count int
+	Size  uint64
+}
+
+// diskBlockCacheCleanShutdown is written to cleanShutdownPath when
+// the cache is shut down cleanly.
+type diskBlockCacheCleanShutdown struct {
+	NumBlocks int
+	CurrBytes uint64
+	TLFs      []diskBlockCacheTLFCounts
+}
+
 // newDiskBlockCacheStandardFromStorage creates a new *DiskBlockCacheStandard
 // with the passed-in storage.Storage interfaces as storage layers for each
-// cache.
+// cache.  If `cleanShutdownPath` is non-empty, the block counts are
+// saved there on shutdown and loaded from there on startup.
 func newDiskBlockCacheStandardFromStorage(
 	config diskBlockCacheConfig, cacheType diskLimitTrackerType,
-	blockStorage, metadataStorage, tlfStorage storage.Storage) (
+	blockStorage, metadataStorage, tlfStorage storage.Storage,
+	cleanShutdownPath string) (
 	cache *DiskBlockCacheLocal, err error) {
 	log := config.MakeLogger("KBC")
 	closers := make([]io.Closer, 0, 3)
@@ -197,34 +222,43 @@ func newDiskBlockCacheStandardFromStorage(
 	startedCh := make(chan struct{})
 	startErrCh := make(chan struct{})
 	cache = &DiskBlockCacheLocal{
-		config:           config,
-		maxBlockID:       maxBlockID.Bytes(),
-		cacheType:        cacheType,
-		tlfCounts:        map[tlf.ID]int{},
-		tlfSizes:         map[tlf.ID]uint64{},
-		hitMeter:         NewCountMeter(),
-		missMeter:        NewCountMeter(),
-		putMeter:         NewCountMeter(),
-		updateMeter:      NewCountMeter(),
-		evictCountMeter:  NewCountMeter(),
-		evictSizeMeter:   NewCountMeter(),
-		deleteCountMeter: NewCountMeter(),
-		deleteSizeMeter:  NewCountMeter(),
-		log:              log,
-		blockDb:          blockDb,
-		metaDb:           metaDb,
-		tlfDb:            tlfDb,
-		startedCh:        startedCh,
-		startErrCh:       startErrCh,
-		shutdownCh:       make(chan struct{}),
-		closer:           closer,
+		config:            config,
+		maxBlockID:        maxBlockID.Bytes(),
+		cacheType:         cacheType,
+		tlfCounts:         map[tlf.ID]int{},
+		tlfSizes:          map[tlf.ID]uint64{},
+		hitMeter:          NewCountMeter(),
+		missMeter:         NewCountMeter(),
+		putMeter:          NewCountMeter(),
+		updateMeter:       NewCountMeter(),
+		evictCountMeter:   NewCountMeter(),
+		evictSizeMeter:    NewCountMeter(),
+		deleteCountMeter:  NewCountMeter(),
+		deleteSizeMeter:   NewCountMeter(),
+		log:               log,
+		blockDb:           blockDb,
+		metaDb:            metaDb,
+		tlfDb:             tlfDb,
+		startedCh:         startedCh,
+		startErrCh:        startErrCh,
+		shutdownCh:        make(chan struct{}),
+		closer:            closer,
+		cleanShutdownPath: cleanShutdownPath,
 	}
 	// Sync the block counts asynchronously so syncing doesn't block init.
 	// Since this method blocks, any Get or Put requests to the disk block
 	// cache will block until this is done. The log will contain the beginning
 	// and end of this sync.
 	go func() {
-		err := cache.syncBlockCountsFromDb()
+		loaded, err := cache.loadBlockCountsFromCleanShutdown()
+		if err != nil {
+			log.Warning("Couldn't load the block counts saved on the "+
+				"last shutdown: %+v", err)
+			loaded = false
+		}
+		if !loaded {
+			err = cache.syncBlockCountsFromDb()
+		}
 		if err != nil {
 			close(startErrCh)
 			closer()
@@ -363,14 +397,15 @@ func newDiskBlockCacheStandard(config diskBlockCacheConfig,
 		}
 	}()
 	return newDiskBlockCacheStandardFromStorage(config, cacheType,
-		blockStorage, metadataStorage, tlfStorage)
+		blockStorage, metadataStorage, tlfStorage,
+		filepath.Join(versionPath, cleanShutdownFilename))
 }
 
 func newDiskBlockCacheStandardForTest(config diskBlockCacheConfig,
 	cacheType diskLimitTrackerType) (*DiskBlockCacheLocal, error) {
 	return newDiskBlockCacheStandardFromStorage(
 		config, cacheType, storage.NewMemStorage(),
-		storage.NewMemStorage(), storage.NewMemStorage())
+		storage.NewMemStorage(), storage.NewMemStorage(), "")
 }
 
 // WaitUntilStarted waits until this cache has started.
@@ -416,6 +451,77 @@ func (cache *DiskBlockCacheLocal) syncBlockCountsFromDb() error {
 	return nil
 }
 
+// loadBlockCountsFromCleanShutdown loads the block counts saved by
+// the last clean shutdown, if there was one, and returns whether it
+// did.  The saved counts are removed before anything else is done
+// with the cache, so that they aren't trusted again if this run
+// doesn't shut down cleanly.
+func (cache *DiskBlockCacheLocal) loadBlockCountsFromCleanShutdown() (
+	bool, error) {
+	if cache.cleanShutdownPath == "" {
+		return false, nil
+	}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	var cs diskBlockCacheCleanShutdown
+	err := kbfscodec.DeserializeFromFile(
+		cache.config.Codec(), cache.cleanShutdownPath, &cs)
+	if ioutil.IsNotExist(err) {
+		cache.log.Debug("No clean shutdown recorded; scanning block counts")
+		return false, nil
+	}
+	removeErr := ioutil.Remove(cache.cleanShutdownPath)
+	if removeErr != nil {
+		return false, removeErr
+	}
+	if err != nil {
+		return false, err
+	}
+
+	tlfCounts := make(map[tlf.ID]int, len(cs.TLFs))
+	tlfSizes := make(map[tlf.ID]uint64, len(cs.TLFs))
+	for _, c := range cs.TLFs {
+		tlfCounts[c.TlfID] = c.Count
+		tlfSizes[c.TlfID] = c.Size
+	}
+	cache.tlfCounts = tlfCounts
+	cache.numBlocks = cs.NumBlocks
+	cache.tlfSizes = tlfSizes
+	cache.currBytes = cs.CurrBytes
+	cache.log.Debug("Loaded block counts from the last clean shutdown: "+
+		"%d blocks, %d bytes", cs.NumBlocks, cs.CurrBytes)
+	return true, nil
+}
+
+// saveBlockCountsForCleanShutdownLocked saves the block counts to be
+// loaded on the next startup.  It must be called with the lock held,
+// after the dbs are closed.
+func (cache *DiskBlockCacheLocal) saveBlockCountsForCleanShutdownLocked(
+	ctx context.Context) {
+	if cache.cleanShutdownPath == "" {
+		return
+	}
+	cs := diskBlockCacheCleanShutdown{
+		NumBlocks: cache.numBlocks,
+		CurrBytes: cache.currBytes,
+		TLFs:      make([]diskBlockCacheTLFCounts, 0, len(cache.tlfCounts)),
+	}
+	for tlfID, count := range cache.tlfCounts {
+		cs.TLFs = append(cs.TLFs, diskBlockCacheTLFCounts{
+			TlfID: tlfID,
+			Count: count,
+			Size:  cache.tlfSizes[tlfID],
+		})
+	}
+	err := kbfscodec.SerializeToFile(
+		cache.config.Codec(), cs, cache.cleanShutdownPath)
+	if err != nil {
+		cache.log.CWarningf(ctx, "Couldn't save the block counts on "+
+			"shutdown: %+v", err)
+	}
+}
+
 // tlfKey generates a TLF cache key from a tlf.ID and a binary-encoded block
 // ID.
 func (*DiskBlockCacheLocal) tlfKey(tlfID tlf.ID, blockKey []byte) []byte {
@@ -562,6 +668,17 @@ func (cache *DiskBlockCacheLocal) Get(ctx context.Context, tlfID tlf.ID,
 	return buf, serverHalf, prefetchStatus, err
 }
 
+// numBlocksToEvictFor returns how many blocks to evict at a time to
+// make room for a block of `encodedLen` bytes.  Blocks of TLFs with
+// a larger block size need more of the default-sized blocks evicted.
+func numBlocksToEvictFor(encodedLen int64) int {
+	n := defaultNumBlocksToEvict
+	if encodedLen > MaxBlockSizeBytesDefault {
+		n = int(int64(n) * encodedLen / MaxBlockSizeBytesDefault)
+	}
+	return n
+}
+
 func (cache *DiskBlockCacheLocal) evictUntilBytesAvailable(
 	ctx context.Context, encodedLen int64) (hasEnoughSpace bool, err error) {
 	for i := 0; i < maxEvictionsPerPut; i++ {
@@ -582,7 +699,8 @@ func (cache *DiskBlockCacheLocal) evictUntilBytesAvailable(
 			return true, nil
 		}
 		cache.log.CDebugf(ctx, "Need more bytes. Available: %d", bytesAvailable)
-		numRemoved, _, err := cache.evictLocked(ctx, defaultNumBlocksToEvict)
+		numRemoved, _, err := cache.evictLocked(
+			ctx, numBlocksToEvictFor(encodedLen))
 		if err != nil {
 			return false, err
 		}
@@ -1023,6 +1141,7 @@ func (cache *DiskBlockCacheLocal) Shutdown(ctx context.Context) {
 	cache.blockDb = nil
 	cache.metaDb = nil
 	cache.tlfDb = nil
+	cache.saveBlockCountsForCleanShutdownLocked(ctx)
 	cache.config.DiskLimiter().onSimpleByteTrackerDisable(ctx,
 		cache.cacheType, int64(cache.currBytes))
 	cache.hitMeter.Shutdown()
@@ -6,15 +6,19 @@ package libkbfs
 
 import (
 	"math"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/ioutil"
 	"github.com/keybase/kbfs/kbfsblock"
 	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/tlf"
 	"github.com/stretchr/testify/require"
 	"github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/storage"
 	"github.com/syndtr/goleveldb/leveldb/util"
 	"golang.org/x/net/context"
 )
@@ -445,6 +449,68 @@ func TestDiskBlockCacheStaticLimit(t *testing.T) {
 	require.Equal(t, 1+numBlocks-int(defaultNumBlocksToEvict), standardCache.numBlocks)
 }
 
+func TestDiskBlockCacheCleanShutdown(t *testing.T) {
+	t.Parallel()
+	t.Log("Test that the block counts are saved on a clean shutdown and " +
+		"loaded on the next startup.")
+	cache, config := initDiskBlockCacheTest(t)
+	defer shutdownDiskBlockCacheTest(cache)
+	ctx := context.Background()
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "disk_block_cache")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+	path := filepath.Join(tempdir, cleanShutdownFilename)
+
+	newCache := func() *DiskBlockCacheLocal {
+		c, err := newDiskBlockCacheStandardFromStorage(
+			config, workingSetCacheLimitTrackerType,
+			storage.NewMemStorage(), storage.NewMemStorage(),
+			storage.NewMemStorage(), path)
+		require.NoError(t, err)
+		err = c.WaitUntilStarted()
+		require.NoError(t, err)
+		return c
+	}
+	standardCache := newCache()
+
+	t.Log("Seed the cache with some blocks.")
+	tlf1 := tlf.FakeID(0, tlf.Private)
+	tlf2 := tlf.FakeID(1, tlf.Public)
+	for _, tlfID := range []tlf.ID{tlf1, tlf1, tlf2} {
+		blockPtr, _, blockEncoded, serverHalf := setupBlockForDiskCache(
+			t, config)
+		err := standardCache.Put(
+			ctx, tlfID, blockPtr.ID, blockEncoded, serverHalf)
+		require.NoError(t, err)
+	}
+	numBlocks := standardCache.numBlocks
+	currBytes := standardCache.currBytes
+	tlfCounts := standardCache.tlfCounts
+	tlfSizes := standardCache.tlfSizes
+	require.Equal(t, 3, numBlocks)
+
+	standardCache.Shutdown(ctx)
+	_, err = ioutil.Stat(path)
+	require.NoError(t, err)
+
+	t.Log("Restart with empty storage, so the counts can only come from " +
+		"the clean shutdown.")
+	standardCache = newCache()
+	defer standardCache.Shutdown(ctx)
+	require.Equal(t, numBlocks, standardCache.numBlocks)
+	require.Equal(t, currBytes, standardCache.currBytes)
+	require.Equal(t, tlfCounts, standardCache.tlfCounts)
+	require.Equal(t, tlfSizes, standardCache.tlfSizes)
+
+	t.Log("The saved counts are removed once they're loaded.")
+	_, err = ioutil.Stat(path)
+	require.True(t, ioutil.IsNotExist(err))
+}
+
 func TestDiskBlockCacheDynamicLimit(t *testing.T) {
 	t.Parallel()
 	t.Log("Test that disk cache eviction works when we hit a dynamic limit.")
@@ -74,6 +74,12 @@ type diskJournal struct {
 
 	latestValid bool
 	latest      journalOrdinal
+
+	// earliestTorn and latestTorn are set when EARLIEST or LATEST
+	// exist but can't be parsed, which means a write to them was
+	// interrupted by a crash.  repair() rebuilds them.
+	earliestTorn bool
+	latestTorn   bool
 }
 
 // makeDiskJournal returns a new diskJournal for the given directory.
@@ -89,6 +95,8 @@ func makeDiskJournal(
 	earliest, err := j.readEarliestOrdinalFromDisk()
 	if ioutil.IsNotExist(err) {
 		// Continue with j.earliestValid = false.
+	} else if isTornJournalOrdinalError(err) {
+		j.earliestTorn = true
 	} else if err != nil {
 		return nil, err
 	} else {
@@ -99,6 +107,8 @@ func makeDiskJournal(
 	latest, err := j.readLatestOrdinalFromDisk()
 	if ioutil.IsNotExist(err) {
 		// Continue with j.latestValid = false.
+	} else if isTornJournalOrdinalError(err) {
+		j.latestTorn = true
 	} else if err != nil {
 		return nil, err
 	} else {
@@ -132,7 +142,27 @@ func (j diskJournal) readOrdinalFromDisk(path string) (journalOrdinal, error) {
 	if err != nil {
 		return 0, err
 	}
-	return makeJournalOrdinal(string(buf))
+	o, err := makeJournalOrdinal(string(buf))
+	if err != nil {
+		return 0, tornJournalOrdinalError{path, err}
+	}
+	return o, nil
+}
+
+// tornJournalOrdinalError is returned when an ordinal file exists but
+// can't be parsed.
+type tornJournalOrdinalError struct {
+	path string
+	err  error
+}
+
+func (e tornJournalOrdinalError) Error() string {
+	return fmt.Sprintf("Torn journal ordinal file %s: %v", e.path, e.err)
+}
+
+func isTornJournalOrdinalError(err error) bool {
+	_, ok := errors.Cause(err).(tornJournalOrdinalError)
+	return ok
 }
 
 func (j *diskJournal) writeOrdinalToDisk(path string, o journalOrdinal) error {
@@ -328,6 +358,213 @@ func (j *diskJournal) appendJournalEntry(
 	return next, nil
 }
 
+// diskJournalRepair describes the changes made by diskJournal.repair.
+type diskJournalRepair struct {
+	// rebuiltOrdinals is true if EARLIEST or LATEST were torn and
+	// had to be rebuilt from the entry files.
+	rebuiltOrdinals bool
+	// dropped is the number of entries removed from the end of the
+	// journal, starting with firstDropped, because they couldn't be
+	// read or failed the check.
+	dropped      uint64
+	firstDropped journalOrdinal
+	// droppedEntries holds the dropped entries that could still be
+	// decoded, in order.
+	droppedEntries []interface{}
+}
+
+func (r diskJournalRepair) repaired() bool {
+	return r.rebuiltOrdinals || r.dropped > 0
+}
+
+// rebuildOrdinals rewrites torn EARLIEST and LATEST files from the
+// entry files that exist in the journal directory.  Entries are only
+// ever appended after LATEST, so the live entries are the contiguous
+// run that ends at LATEST, or at the newest entry if LATEST can't be
+// trusted.
+//
+// EARLIEST is only overwritten by removeEarliest, after the earliest
+// entry was flushed, and before that entry is removed.  An earlier
+// removeEarliest may also have crashed before removing its entry,
+// leaving a stale one behind.  So when EARLIEST is torn, the leading
+// entries that `flushed` says were already flushed are removed.  If
+// `flushed` is nil or can't tell, they're kept, so their flush is
+// retried rather than lost; flushing an entry twice must then be
+// harmless.
+func (j *diskJournal) rebuildOrdinals(
+	flushed func(o journalOrdinal, entry interface{}) (bool, error)) error {
+	present := make(map[journalOrdinal]bool)
+	var maxOrdinal journalOrdinal
+	fileInfos, err := ioutil.ReadDir(j.dir)
+	if err != nil && !ioutil.IsNotExist(err) {
+		return err
+	}
+	for _, fi := range fileInfos {
+		o, err := makeJournalOrdinal(fi.Name())
+		if err != nil {
+			continue
+		}
+		if len(present) == 0 || o > maxOrdinal {
+			maxOrdinal = o
+		}
+		present[o] = true
+	}
+	if len(present) == 0 {
+		// There's nothing but the ordinals, which can only happen
+		// while appending to an empty journal.
+		return j.resetTornOrdinals()
+	}
+
+	var earliest, latest journalOrdinal
+	switch {
+	case j.latestTorn && j.earliestValid && present[j.earliest]:
+		earliest = j.earliest
+		latest = j.earliest
+		for present[latest+1] {
+			latest++
+		}
+	case j.earliestTorn && j.latestValid && present[j.latest]:
+		latest = j.latest
+	default:
+		latest = maxOrdinal
+	}
+	if !j.earliestValid || !present[j.earliest] {
+		earliest = latest
+		for earliest > 0 && present[earliest-1] {
+			earliest--
+		}
+		for flushed != nil && earliest < latest {
+			entry, err := j.readJournalEntry(earliest)
+			if err != nil {
+				// It can't be told apart, so keep it.
+				break
+			}
+			isFlushed, err := flushed(earliest, entry)
+			if err != nil {
+				return err
+			}
+			if !isFlushed {
+				break
+			}
+			err = ioutil.Remove(j.journalEntryPath(earliest))
+			if err != nil {
+				return err
+			}
+			earliest++
+		}
+	}
+
+	err = j.writeEarliestOrdinal(earliest)
+	if err != nil {
+		return err
+	}
+	err = j.writeLatestOrdinal(latest)
+	if err != nil {
+		return err
+	}
+	j.earliestTorn = false
+	j.latestTorn = false
+	return nil
+}
+
+// resetTornOrdinals removes torn EARLIEST and LATEST files from a
+// journal that has no entries, which leaves it empty.
+func (j *diskJournal) resetTornOrdinals() error {
+	for _, p := range []string{j.earliestPath(), j.latestPath()} {
+		err := ioutil.Remove(p)
+		if err != nil && !ioutil.IsNotExist(err) {
+			return err
+		}
+	}
+	j.earliestValid = false
+	j.earliest = journalOrdinal(0)
+	j.earliestTorn = false
+	j.latestValid = false
+	j.latest = journalOrdinal(0)
+	j.latestTorn = false
+	return nil
+}
+
+// repair makes the journal consistent after a crash may have left a
+// write to it incomplete.  Torn ordinal files are rebuilt (see
+// rebuildOrdinals, which is passed `flushed`); then each entry is
+// read and passed to `check`, if non-nil, and the journal is
+// truncated just before the first entry that is missing, can't be
+// decoded, or fails the check.  `flushed` and `check` should return
+// a non-nil error only for a real I/O failure, not for an invalid
+// entry.
+func (j *diskJournal) repair(
+	flushed func(o journalOrdinal, entry interface{}) (bool, error),
+	check func(o journalOrdinal, entry interface{}) (bool, error)) (
+	r diskJournalRepair, err error) {
+	if j.earliestTorn || j.latestTorn {
+		err := j.rebuildOrdinals(flushed)
+		if err != nil {
+			return diskJournalRepair{}, err
+		}
+		r.rebuiltOrdinals = true
+	}
+	if j.empty() {
+		return r, nil
+	}
+
+	for o := j.earliest; o <= j.latest; o++ {
+		valid, err := j.checkJournalEntry(o, check)
+		if err != nil {
+			return diskJournalRepair{}, err
+		}
+		if valid {
+			continue
+		}
+
+		latest := j.latest
+		r.firstDropped = o
+		r.dropped = uint64(latest - o + 1)
+		for do := o; do <= latest; do++ {
+			entry, err := j.readJournalEntry(do)
+			if err != nil {
+				continue
+			}
+			r.droppedEntries = append(r.droppedEntries, entry)
+		}
+		if o == j.earliest {
+			return r, j.clear()
+		}
+		err = j.writeLatestOrdinal(o - 1)
+		if err != nil {
+			return diskJournalRepair{}, err
+		}
+		for ; o <= latest; o++ {
+			err := ioutil.Remove(j.journalEntryPath(o))
+			if err != nil && !ioutil.IsNotExist(err) {
+				return diskJournalRepair{}, err
+			}
+		}
+		break
+	}
+	return r, nil
+}
+
+func (j diskJournal) checkJournalEntry(o journalOrdinal,
+	check func(o journalOrdinal, entry interface{}) (bool, error)) (
+	bool, error) {
+	buf, err := ioutil.ReadFile(j.journalEntryPath(o))
+	if ioutil.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	entry := reflect.New(j.entryType)
+	err = j.codec.Decode(buf, entry.Interface())
+	if err != nil {
+		return false, nil
+	}
+	if check == nil {
+		return true, nil
+	}
+	return check(o, entry.Elem().Interface())
+}
+
 // move moves the journal to the given directory, which should share
 // the same parent directory as the current journal directory.
 func (j *diskJournal) move(newDir string) (oldDir string, err error) {
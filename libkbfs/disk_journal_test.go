@@ -184,3 +184,162 @@ func TestDiskJournalMove(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, testJournalEntry{1}, entry)
 }
+
+func makeDiskJournalForRepairTest(t *testing.T, dir string, n int) {
+	codec := kbfscodec.NewMsgpack()
+	j, err := makeDiskJournal(
+		codec, dir, reflect.TypeOf(testJournalEntry{}))
+	require.NoError(t, err)
+	for i := 1; i <= n; i++ {
+		_, err := j.appendJournalEntry(nil, testJournalEntry{i})
+		require.NoError(t, err)
+	}
+}
+
+func requireRepairedDiskJournal(t *testing.T, dir string,
+	flushed, check func(o journalOrdinal, entry interface{}) (bool, error),
+	expectedRepair diskJournalRepair, expectedEntries ...int) {
+	codec := kbfscodec.NewMsgpack()
+	j, err := makeDiskJournal(
+		codec, dir, reflect.TypeOf(testJournalEntry{}))
+	require.NoError(t, err)
+	r, err := j.repair(flushed, check)
+	require.NoError(t, err)
+	require.Equal(t, expectedRepair, r)
+
+	if len(expectedEntries) == 0 {
+		require.True(t, j.empty())
+		return
+	}
+	require.Equal(t, uint64(len(expectedEntries)), j.length())
+	earliest, err := j.readEarliestOrdinal()
+	require.NoError(t, err)
+	for i, expected := range expectedEntries {
+		entry, err := j.readJournalEntry(earliest + journalOrdinal(i))
+		require.NoError(t, err)
+		require.Equal(t, testJournalEntry{expected}, entry)
+	}
+
+	// The repaired journal must be readable from scratch.
+	j2, err := makeDiskJournal(
+		codec, dir, reflect.TypeOf(testJournalEntry{}))
+	require.NoError(t, err)
+	require.Equal(t, j.length(), j2.length())
+}
+
+func TestDiskJournalRepair(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "disk_journal")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(tempdir)
+		assert.NoError(t, err)
+	}()
+
+	first := firstValidJournalOrdinal
+
+	// Nothing to repair.
+	dir := filepath.Join(tempdir, "clean")
+	makeDiskJournalForRepairTest(t, dir, 3)
+	requireRepairedDiskJournal(
+		t, dir, nil, nil, diskJournalRepair{}, 1, 2, 3)
+
+	// A torn LATEST is extended over the remaining entries.
+	dir = filepath.Join(tempdir, "torn_latest")
+	makeDiskJournalForRepairTest(t, dir, 3)
+	err = ioutil.WriteFile(
+		filepath.Join(dir, "LATEST"), []byte("00000"), 0600)
+	require.NoError(t, err)
+	requireRepairedDiskJournal(
+		t, dir, nil, nil, diskJournalRepair{rebuiltOrdinals: true}, 1, 2, 3)
+
+	// A torn EARLIEST means removeEarliest was interrupted, so the
+	// earliest entry is removed if it was flushed, and kept if
+	// that can't be told.
+	flushedUpTo := func(i int) func(journalOrdinal, interface{}) (
+		bool, error) {
+		return func(o journalOrdinal, entry interface{}) (bool, error) {
+			return entry.(testJournalEntry).I <= i, nil
+		}
+	}
+	dir = filepath.Join(tempdir, "torn_earliest")
+	makeDiskJournalForRepairTest(t, dir, 3)
+	err = ioutil.WriteFile(
+		filepath.Join(dir, "EARLIEST"), []byte("garbage"), 0600)
+	require.NoError(t, err)
+	requireRepairedDiskJournal(t, dir, flushedUpTo(1), nil,
+		diskJournalRepair{rebuiltOrdinals: true}, 2, 3)
+	dir = filepath.Join(tempdir, "torn_earliest_unknown")
+	makeDiskJournalForRepairTest(t, dir, 3)
+	err = ioutil.WriteFile(
+		filepath.Join(dir, "EARLIEST"), []byte("garbage"), 0600)
+	require.NoError(t, err)
+	requireRepairedDiskJournal(
+		t, dir, nil, nil, diskJournalRepair{rebuiltOrdinals: true}, 1, 2, 3)
+
+	// A stale entry left by an earlier interrupted removeEarliest
+	// is removed along with the one being removed.
+	dir = filepath.Join(tempdir, "torn_earliest_stale")
+	makeDiskJournalForRepairTest(t, dir, 4)
+	err = ioutil.WriteFile(
+		filepath.Join(dir, "EARLIEST"), []byte("garbage"), 0600)
+	require.NoError(t, err)
+	requireRepairedDiskJournal(t, dir, flushedUpTo(2), nil,
+		diskJournalRepair{rebuiltOrdinals: true}, 3, 4)
+
+	// Torn ordinals never wipe the entries, even if the entry
+	// LATEST names is missing, or LATEST is.
+	dir = filepath.Join(tempdir, "torn_earliest_missing_latest_entry")
+	makeDiskJournalForRepairTest(t, dir, 3)
+	err = ioutil.WriteFile(
+		filepath.Join(dir, "EARLIEST"), []byte("garbage"), 0600)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(
+		filepath.Join(dir, "LATEST"), []byte((first + 5).String()), 0600)
+	require.NoError(t, err)
+	requireRepairedDiskJournal(
+		t, dir, nil, nil, diskJournalRepair{rebuiltOrdinals: true}, 1, 2, 3)
+	dir = filepath.Join(tempdir, "torn_earliest_missing_latest")
+	makeDiskJournalForRepairTest(t, dir, 3)
+	err = ioutil.WriteFile(
+		filepath.Join(dir, "EARLIEST"), []byte("garbage"), 0600)
+	require.NoError(t, err)
+	err = ioutil.Remove(filepath.Join(dir, "LATEST"))
+	require.NoError(t, err)
+	requireRepairedDiskJournal(
+		t, dir, nil, nil, diskJournalRepair{rebuiltOrdinals: true}, 1, 2, 3)
+
+	// A torn last entry is dropped.
+	dir = filepath.Join(tempdir, "torn_entry")
+	makeDiskJournalForRepairTest(t, dir, 3)
+	err = ioutil.WriteFile(
+		filepath.Join(dir, (first+2).String()), []byte{0xc1}, 0600)
+	require.NoError(t, err)
+	requireRepairedDiskJournal(t, dir, nil, nil, diskJournalRepair{
+		dropped:      1,
+		firstDropped: first + 2,
+	}, 1, 2)
+
+	// Entries that fail the check are dropped along with every
+	// later entry.
+	dir = filepath.Join(tempdir, "failed_check")
+	makeDiskJournalForRepairTest(t, dir, 3)
+	check := func(o journalOrdinal, entry interface{}) (bool, error) {
+		return entry.(testJournalEntry).I != 2, nil
+	}
+	requireRepairedDiskJournal(t, dir, nil, check, diskJournalRepair{
+		dropped:      2,
+		firstDropped: first + 1,
+		droppedEntries: []interface{}{
+			testJournalEntry{2}, testJournalEntry{3}},
+	}, 1)
+
+	// If the earliest entry is torn, the journal is cleared.
+	dir = filepath.Join(tempdir, "torn_only_entry")
+	makeDiskJournalForRepairTest(t, dir, 1)
+	err = ioutil.Remove(filepath.Join(dir, first.String()))
+	require.NoError(t, err)
+	requireRepairedDiskJournal(t, dir, nil, nil, diskJournalRepair{
+		dropped:      1,
+		firstDropped: first,
+	})
+}
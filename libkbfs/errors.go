@@ -399,6 +399,38 @@ func (e BadDataError) Error() string {
 	return fmt.Sprintf("Bad data for block %v", e.ID)
 }
 
+// QuarantinedBlockError indicates that a block has repeatedly failed
+// decryption or verification, and has been quarantined so that it
+// isn't fetched again.
+type QuarantinedBlockError struct {
+	ID       kbfsblock.ID
+	Path     string
+	Revision kbfsmd.Revision
+	LastErr  string
+}
+
+// Error implements the error interface for QuarantinedBlockError
+func (e QuarantinedBlockError) Error() string {
+	return fmt.Sprintf("Block %v (path=%q, revision=%d) is quarantined "+
+		"after repeated decryption/verification failures: %s",
+		e.ID, e.Path, e.Revision, e.LastErr)
+}
+
+// DamagedSubtreeError indicates that a directory couldn't be read
+// because one of its blocks couldn't be fetched or verified.  The
+// directory and everything under it is unavailable, but the rest of
+// the TLF can still be used.
+type DamagedSubtreeError struct {
+	Path string
+	Err  error
+}
+
+// Error implements the error interface for DamagedSubtreeError
+func (e DamagedSubtreeError) Error() string {
+	return fmt.Sprintf("Directory %s is damaged and can't be read: %v",
+		e.Path, e.Err)
+}
+
 // NoSuchBlockError indicates that a block for the associated ID doesn't exist.
 type NoSuchBlockError struct {
 	ID kbfsblock.ID
@@ -806,6 +838,48 @@ func (e DirTooBigError) Error() string {
 		e.size, e.maxAllowedBytes)
 }
 
+// DirTooManyEntriesError indicates that the user tried to add an
+// entry to a directory that already has the maximum supported number
+// of entries.
+type DirTooManyEntriesError struct {
+	p                 path
+	numEntries        int
+	maxAllowedEntries int
+}
+
+// Error implements the error interface for DirTooManyEntriesError.
+func (e DirTooManyEntriesError) Error() string {
+	return fmt.Sprintf("Directory %s already has %d entries, which is "+
+		"the supported limit of %d entries", e.p, e.numEntries,
+		e.maxAllowedEntries)
+}
+
+// SymlinkDepthError indicates that resolving a path would require
+// following more symlinks than allowed.
+type SymlinkDepthError struct {
+	Link     string
+	MaxDepth int
+}
+
+// Error implements the error interface for SymlinkDepthError.
+func (e SymlinkDepthError) Error() string {
+	return fmt.Sprintf("Too many levels of symlinks at %s (max %d)",
+		e.Link, e.MaxDepth)
+}
+
+// SymlinkLoopError indicates that following a symlink led back to a
+// path that was already being resolved, so resolution would never
+// finish.
+type SymlinkLoopError struct {
+	Link string
+	Path string
+}
+
+// Error implements the error interface for SymlinkLoopError.
+func (e SymlinkLoopError) Error() string {
+	return fmt.Sprintf("Symlink %s loops back to %s", e.Link, e.Path)
+}
+
 // TlfNameNotCanonical indicates that a name isn't a canonical, and
 // that another (not necessarily canonical) name should be tried.
 type TlfNameNotCanonical struct {
@@ -1204,3 +1278,115 @@ func (e RevGarbageCollectedError) Error() string {
 	return fmt.Sprintf("Requested revision %d has already been garbage "+
 		"collected (last GC'd rev=%d)", e.rev, e.lastGCRev)
 }
+
+// TeamFileTooLargeError indicates that a write or truncate would
+// make a file bigger than the content policy of its team allows.
+type TeamFileTooLargeError struct {
+	Path    string
+	Size    uint64
+	MaxSize uint64
+}
+
+// Error implements the Error interface for TeamFileTooLargeError.
+func (e TeamFileTooLargeError) Error() string {
+	return fmt.Sprintf("File %s would have grown to %d bytes, which is over "+
+		"the team's limit of %d bytes", e.Path, e.Size, e.MaxSize)
+}
+
+// TeamBannedExtensionError indicates that an entry would be given a
+// name with an extension banned by the content policy of its team.
+type TeamBannedExtensionError struct {
+	Path string
+	Ext  string
+}
+
+// Error implements the Error interface for TeamBannedExtensionError.
+func (e TeamBannedExtensionError) Error() string {
+	return fmt.Sprintf("The team doesn't allow %s files like %s", e.Ext, e.Path)
+}
+
+// TeamReadOnlySubtreeError indicates that the content policy of a
+// team only allows some members to change entries in the subtree
+// containing Path.
+type TeamReadOnlySubtreeError struct {
+	Path         string
+	Subtree      string
+	MinWriteRole keybase1.TeamRole
+}
+
+// Error implements the Error interface for TeamReadOnlySubtreeError.
+func (e TeamReadOnlySubtreeError) Error() string {
+	if e.MinWriteRole == keybase1.TeamRole_NONE {
+		return fmt.Sprintf("Can't change %s: only some team members "+
+			"can change /%s", e.Path, e.Subtree)
+	}
+	return fmt.Sprintf("Can't change %s: only team members with role %s "+
+		"or higher (or listed writers) can change /%s",
+		e.Path, e.MinWriteRole, e.Subtree)
+}
+
+// InvalidTeamContentPolicyError indicates that the content policy
+// file of a team TLF couldn't be verified as signed by a team admin,
+// so only admins may change the TLF until one signs a new policy.
+type InvalidTeamContentPolicyError struct {
+	Err error
+}
+
+// Error implements the Error interface for InvalidTeamContentPolicyError.
+func (e InvalidTeamContentPolicyError) Error() string {
+	return fmt.Sprintf("The team content policy can't be verified, so "+
+		"only admins can change this folder: %v", e.Err)
+}
+
+// UnauthorizedSubtreeWriteError indicates that an MD revision
+// written by another device changed a subtree of a team TLF that the
+// team's content policy doesn't let its writer change.
+type UnauthorizedSubtreeWriteError struct {
+	Revision kbfsmd.Revision
+	Writer   keybase1.UID
+	Err      TeamReadOnlySubtreeError
+}
+
+// Error implements the Error interface for UnauthorizedSubtreeWriteError.
+func (e UnauthorizedSubtreeWriteError) Error() string {
+	return fmt.Sprintf("Revision %d by %s violates the team policy: %v",
+		e.Revision, e.Writer, e.Err)
+}
+
+// NoSuchSyncOutboxEntryError indicates that the sync outbox has no
+// entry with the given ID.
+type NoSuchSyncOutboxEntryError struct {
+	ID string
+}
+
+// Error implements the Error interface for NoSuchSyncOutboxEntryError.
+func (e NoSuchSyncOutboxEntryError) Error() string {
+	return fmt.Sprintf("No sync outbox entry with ID %s", e.ID)
+}
+
+// FolderCorruptionError indicates that an invariant about a TLF's
+// data was violated while operating on it, most likely because some
+// of that data is corrupt.  Once one is seen, the folder-branch is
+// marked degraded and refuses further writes, but other folders are
+// unaffected.
+type FolderCorruptionError struct {
+	Tlf tlf.ID
+	Err error
+}
+
+// Error implements the Error interface for FolderCorruptionError.
+func (e FolderCorruptionError) Error() string {
+	return fmt.Sprintf("Folder %s is degraded due to corruption: %v",
+		e.Tlf, e.Err)
+}
+
+// DelegationTokenExpiredError indicates that the delegation token
+// installed in a config has expired.
+type DelegationTokenExpiredError struct {
+	Expires time.Time
+}
+
+// Error implements the Error interface for DelegationTokenExpiredError.
+func (e DelegationTokenExpiredError) Error() string {
+	return fmt.Sprintf("The delegation token expired at %s", e.Expires)
+}
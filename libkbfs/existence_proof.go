@@ -0,0 +1,489 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"crypto/sha256"
+	"strings"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// ExistenceProofMD is one signed MD object in an ExistenceProof, as
+// encoded by the MD server.
+type ExistenceProofMD struct {
+	Version kbfsmd.MetadataVer
+	Buf     []byte
+}
+
+// ExistenceProofBlock is one encrypted block in an ExistenceProof,
+// as stored by the block server, along with the key that decrypts
+// it.  The key is unique to the block, so it can't decrypt any
+// other block of the TLF.
+type ExistenceProofBlock struct {
+	ID  kbfsblock.ID
+	Buf []byte
+	Key kbfscrypto.BlockCryptKey
+}
+
+// ExistenceProof is a self-contained bundle showing that a file had
+// certain contents at a revision of a TLF, which can be checked
+// offline with VerifyExistenceProof.  It holds the signed MD objects
+// from that revision through the head at the time it was made, each
+// linked to the one before it, and the encrypted blocks on the path
+// from the root of that revision to the end of the file.
+//
+// The proof holds no TLF crypt keys, only the key of each of its
+// blocks.  For a private or team TLF though, finding the root block
+// means decrypting the private metadata of the first MD object, which
+// needs the TLF crypt key of generation KeyGen.  Whoever checks such
+// a proof must get that key separately (see
+// GetExistenceProofTLFCryptKey), and it lets them read everything in
+// the TLF encrypted under that generation.
+type ExistenceProof struct {
+	TlfID    tlf.ID
+	Revision kbfsmd.Revision
+	// Path is the slash-separated path of the file, relative to the
+	// TLF root.
+	Path   string
+	KeyGen kbfsmd.KeyGen
+	MDs    []ExistenceProofMD
+	Blocks []ExistenceProofBlock
+}
+
+// ExistenceProofResult describes what a verified ExistenceProof
+// shows.  The proof can only show that the MD objects were signed by
+// the keys given here; whoever checks it must make sure, using
+// Keybase, that those keys belonged to writers of the TLF, and that
+// HeadRevision is really part of the TLF's history.
+type ExistenceProofResult struct {
+	TlfID    tlf.ID
+	Revision kbfsmd.Revision
+	Path     string
+	Size     uint64
+	// SHA256 is the hash of the file's contents.
+	SHA256 [sha256.Size]byte
+	// Mtime is in unix nanoseconds.
+	Mtime int64
+	// Writer is the user who last changed the TLF as of Revision,
+	// and WriterKey is the device key that signed it.
+	Writer    keybase1.UID
+	WriterKey kbfscrypto.VerifyingKey
+	// HeadRevision is the last revision in the proof's MD chain, and
+	// HeadWriterKey is the device key that signed it.
+	HeadRevision  kbfsmd.Revision
+	HeadWriterKey kbfscrypto.VerifyingKey
+}
+
+// existenceProofSource supplies the blocks, with their keys, and the
+// private metadata key needed to read a file for an ExistenceProof.
+type existenceProofSource interface {
+	getBlock(ctx context.Context, ptr BlockPointer) (
+		[]byte, kbfscrypto.BlockCryptKey, error)
+	getMDKey(ctx context.Context, keyGen kbfsmd.KeyGen) (
+		kbfscrypto.TLFCryptKey, error)
+}
+
+// existenceProofReader reads a file from the root of a revision,
+// verifying and decrypting each block it needs.  It's used both to
+// gather the blocks for a proof, and to check them.
+type existenceProofReader struct {
+	codec  kbfscodec.Codec
+	crypto cryptoPure
+	src    existenceProofSource
+}
+
+func (r existenceProofReader) getBlock(
+	ctx context.Context, ptr BlockPointer, block Block) error {
+	buf, key, err := r.src.getBlock(ctx, ptr)
+	if err != nil {
+		return err
+	}
+	if err := kbfsblock.VerifyID(buf, ptr.ID); err != nil {
+		return err
+	}
+	var encryptedBlock kbfscrypto.EncryptedBlock
+	if err := r.codec.Decode(buf, &encryptedBlock); err != nil {
+		return err
+	}
+	return r.crypto.DecryptBlock(encryptedBlock, key, block)
+}
+
+// lookup returns the entry `name` of the directory at `ptr`, looking
+// through all of its blocks if it's indirect.
+func (r existenceProofReader) lookup(
+	ctx context.Context, ptr BlockPointer, name string) (
+	de DirEntry, ok bool, err error) {
+	dblock := NewDirBlock().(*DirBlock)
+	if err := r.getBlock(ctx, ptr, dblock); err != nil {
+		return DirEntry{}, false, err
+	}
+	if !dblock.IsInd {
+		de, ok = dblock.Children[name]
+		return de, ok, nil
+	}
+	for _, iptr := range dblock.IPtrs {
+		de, ok, err = r.lookup(ctx, iptr.BlockPointer, name)
+		if err != nil || ok {
+			return de, ok, err
+		}
+	}
+	return DirEntry{}, false, nil
+}
+
+// readFileInto copies the contents of the file block at `ptr`, which
+// starts at `off` in the file, into `contents`.
+func (r existenceProofReader) readFileInto(
+	ctx context.Context, ptr BlockPointer, off int64, contents []byte) error {
+	fblock := NewFileBlock().(*FileBlock)
+	if err := r.getBlock(ctx, ptr, fblock); err != nil {
+		return err
+	}
+	if !fblock.IsInd {
+		if off < int64(len(contents)) {
+			copy(contents[off:], fblock.Contents)
+		}
+		return nil
+	}
+	for _, iptr := range fblock.IPtrs {
+		err := r.readFileInto(ctx, iptr.BlockPointer, int64(iptr.Off), contents)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readFile returns the entry and contents of the file at the
+// slash-separated path `p`, starting from the root directory `root`.
+func (r existenceProofReader) readFile(
+	ctx context.Context, root DirEntry, p string) (DirEntry, []byte, error) {
+	de := root
+	for _, name := range strings.Split(p, "/") {
+		if name == "" {
+			continue
+		}
+		if de.Type != Dir {
+			return DirEntry{}, nil, errors.Errorf("%s is not a directory", p)
+		}
+		var ok bool
+		var err error
+		de, ok, err = r.lookup(ctx, de.BlockPointer, name)
+		if err != nil {
+			return DirEntry{}, nil, err
+		}
+		if !ok {
+			return DirEntry{}, nil, NoSuchNameError{name}
+		}
+	}
+	if de.Type != File && de.Type != Exec {
+		return DirEntry{}, nil, errors.Errorf("%s is not a file", p)
+	}
+
+	contents := make([]byte, de.Size)
+	err := r.readFileInto(ctx, de.BlockPointer, 0, contents)
+	if err != nil {
+		return DirEntry{}, nil, err
+	}
+	return de, contents, nil
+}
+
+// readPrivateMetadata decrypts, if needed, and decodes the private
+// metadata of `md`.
+func (r existenceProofReader) readPrivateMetadata(
+	ctx context.Context, md kbfsmd.RootMetadata) (PrivateMetadata, error) {
+	var pmd PrivateMetadata
+	if md.TypeForKeying() == tlf.PublicKeying {
+		err := r.codec.Decode(md.GetSerializedPrivateMetadata(), &pmd)
+		return pmd, err
+	}
+
+	var encryptedPMD kbfscrypto.EncryptedPrivateMetadata
+	err := r.codec.Decode(md.GetSerializedPrivateMetadata(), &encryptedPMD)
+	if err != nil {
+		return PrivateMetadata{}, err
+	}
+	k, err := r.src.getMDKey(ctx, md.LatestKeyGeneration())
+	if err != nil {
+		return PrivateMetadata{}, err
+	}
+	return r.crypto.DecryptPrivateMetadata(encryptedPMD, k)
+}
+
+// existenceProofMaker is the existenceProofSource used to make a
+// proof; it records every block it fetches into the proof, along
+// with the block's unmasked key.
+type existenceProofMaker struct {
+	config Config
+	head   ImmutableRootMetadata
+	proof  *ExistenceProof
+	seen   map[kbfsblock.ID]bool
+	keys   map[kbfsmd.KeyGen]kbfscrypto.TLFCryptKey
+}
+
+func (m *existenceProofMaker) getBlock(
+	ctx context.Context, ptr BlockPointer) (
+	[]byte, kbfscrypto.BlockCryptKey, error) {
+	buf, serverHalf, err := m.config.BlockServer().Get(
+		ctx, m.proof.TlfID, ptr.ID, ptr.Context)
+	if err != nil {
+		return nil, kbfscrypto.BlockCryptKey{}, err
+	}
+	tlfCryptKey, err := m.getMDKey(ctx, ptr.KeyGen)
+	if err != nil {
+		return nil, kbfscrypto.BlockCryptKey{}, err
+	}
+	key := kbfscrypto.UnmaskBlockCryptKey(serverHalf, tlfCryptKey)
+	if !m.seen[ptr.ID] {
+		m.seen[ptr.ID] = true
+		m.proof.Blocks = append(m.proof.Blocks,
+			ExistenceProofBlock{ptr.ID, buf, key})
+	}
+	return buf, key, nil
+}
+
+func (m *existenceProofMaker) getMDKey(
+	ctx context.Context, keyGen kbfsmd.KeyGen) (
+	kbfscrypto.TLFCryptKey, error) {
+	if k, ok := m.keys[keyGen]; ok {
+		return k, nil
+	}
+	// The head has the keys of every generation.
+	k, err := m.config.KeyManager().GetTLFCryptKeyForBlockDecryption(
+		ctx, m.head, BlockPointer{KeyGen: keyGen})
+	if err != nil {
+		return kbfscrypto.TLFCryptKey{}, err
+	}
+	m.keys[keyGen] = k
+	return k, nil
+}
+
+// MakeExistenceProof returns a proof that the file at the
+// slash-separated path `p` of the TLF with handle `h` had the
+// contents it had at revision `rev`, which anyone can check with
+// VerifyExistenceProof without access to KBFS.  See ExistenceProof
+// for what the proof reveals.
+func MakeExistenceProof(ctx context.Context, config Config,
+	h *TlfHandle, rev kbfsmd.Revision, p string) (*ExistenceProof, error) {
+	tlfID := h.tlfID
+	if tlfID == tlf.NullID {
+		return nil, errors.Errorf("%s has no TLF ID", h.GetCanonicalPath())
+	}
+
+	// Only merged revisions that made it to the server can be
+	// proven, so get the signed MDs straight from there.
+	mdserver := config.MDServer()
+	headRmds, err := mdserver.GetForTLF(
+		ctx, tlfID, kbfsmd.NullBranchID, kbfsmd.Merged, nil)
+	if err != nil {
+		return nil, err
+	}
+	if headRmds == nil {
+		return nil, errors.Errorf("%s has no revisions", h.GetCanonicalPath())
+	}
+	headRev := headRmds.MD.RevisionNumber()
+	if rev < kbfsmd.RevisionInitial || rev > headRev {
+		return nil, errors.Errorf(
+			"Revision %d is not between %d and the head, %d",
+			rev, kbfsmd.RevisionInitial, headRev)
+	}
+
+	proof := &ExistenceProof{
+		TlfID:    tlfID,
+		Revision: rev,
+		Path:     strings.Trim(p, "/"),
+		KeyGen:   kbfsmd.PublicKeyGen,
+	}
+	codec := config.Codec()
+	for next := rev; next <= headRev; {
+		rmdses, err := mdserver.GetRange(ctx, tlfID, kbfsmd.NullBranchID,
+			kbfsmd.Merged, next, headRev, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(rmdses) == 0 {
+			return nil, errors.Errorf("Revision %d not found", next)
+		}
+		for _, rmds := range rmdses {
+			buf, err := kbfsmd.EncodeRootMetadataSigned(
+				codec, &rmds.RootMetadataSigned)
+			if err != nil {
+				return nil, err
+			}
+			proof.MDs = append(proof.MDs,
+				ExistenceProofMD{rmds.MD.Version(), buf})
+		}
+		next = rmdses[len(rmdses)-1].MD.RevisionNumber() + 1
+	}
+
+	head, err := getSingleMD(ctx, config, tlfID, kbfsmd.NullBranchID,
+		headRev, kbfsmd.Merged, nil)
+	if err != nil {
+		return nil, err
+	}
+	irmd, err := getSingleMD(ctx, config, tlfID, kbfsmd.NullBranchID,
+		rev, kbfsmd.Merged, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &existenceProofMaker{
+		config: config,
+		head:   head,
+		proof:  proof,
+		seen:   make(map[kbfsblock.ID]bool),
+		keys:   make(map[kbfsmd.KeyGen]kbfscrypto.TLFCryptKey),
+	}
+	if irmd.TypeForKeying() != tlf.PublicKeying {
+		proof.KeyGen = irmd.LatestKeyGeneration()
+	}
+	r := existenceProofReader{codec, config.Crypto(), m}
+	_, _, err = r.readFile(ctx, irmd.Data().Dir, proof.Path)
+	if err != nil {
+		return nil, err
+	}
+	return proof, nil
+}
+
+// GetExistenceProofTLFCryptKey returns the TLF crypt key needed to
+// check `proof`, if it's for a private or team TLF.  Only readers of
+// the TLF can get it.
+func GetExistenceProofTLFCryptKey(ctx context.Context, config Config,
+	proof *ExistenceProof) (kbfscrypto.TLFCryptKey, error) {
+	if proof.KeyGen < kbfsmd.FirstValidKeyGen {
+		return kbfscrypto.TLFCryptKey{}, errors.Errorf(
+			"A proof for a public TLF needs no key")
+	}
+	// The head has the keys of every generation.
+	head, err := config.MDOps().GetForTLF(ctx, proof.TlfID, nil)
+	if err != nil {
+		return kbfscrypto.TLFCryptKey{}, err
+	}
+	return config.KeyManager().GetTLFCryptKeyForBlockDecryption(
+		ctx, head, BlockPointer{KeyGen: proof.KeyGen})
+}
+
+// existenceProofChecker is the existenceProofSource used to verify a
+// proof; it only serves what's in the proof, and the TLF crypt key
+// given by whoever is checking it.
+type existenceProofChecker struct {
+	blocks      map[kbfsblock.ID]ExistenceProofBlock
+	keyGen      kbfsmd.KeyGen
+	tlfCryptKey *kbfscrypto.TLFCryptKey
+}
+
+func (c existenceProofChecker) getBlock(
+	_ context.Context, ptr BlockPointer) (
+	[]byte, kbfscrypto.BlockCryptKey, error) {
+	b, ok := c.blocks[ptr.ID]
+	if !ok {
+		return nil, kbfscrypto.BlockCryptKey{},
+			errors.Errorf("Block %v is missing from the proof", ptr)
+	}
+	return b.Buf, b.Key, nil
+}
+
+func (c existenceProofChecker) getMDKey(
+	_ context.Context, keyGen kbfsmd.KeyGen) (
+	kbfscrypto.TLFCryptKey, error) {
+	if keyGen != c.keyGen {
+		return kbfscrypto.TLFCryptKey{}, errors.Errorf(
+			"The proof is for key generation %d, not %d", c.keyGen, keyGen)
+	}
+	if c.tlfCryptKey == nil {
+		return kbfscrypto.TLFCryptKey{}, errors.Errorf(
+			"The TLF crypt key of generation %d is needed to check "+
+				"the proof", keyGen)
+	}
+	return *c.tlfCryptKey, nil
+}
+
+// VerifyExistenceProof checks `proof` without contacting any
+// servers, and returns what it shows.  It checks that every MD object
+// in the proof is correctly signed and is the successor of the one
+// before it, and that the file can be read from the first one using
+// only the blocks in the proof, each of which must match its ID.  For
+// a proof of a private or team TLF, `tlfCryptKey` must be the TLF
+// crypt key of generation proof.KeyGen; it's ignored otherwise.
+func VerifyExistenceProof(
+	ctx context.Context, codec kbfscodec.Codec, proof *ExistenceProof,
+	tlfCryptKey *kbfscrypto.TLFCryptKey) (ExistenceProofResult, error) {
+	if len(proof.MDs) == 0 {
+		return ExistenceProofResult{}, errors.New("The proof has no MDs")
+	}
+
+	var first, prev *kbfsmd.RootMetadataSigned
+	for i, pmd := range proof.MDs {
+		rmds, err := kbfsmd.DecodeRootMetadataSigned(
+			codec, proof.TlfID, pmd.Version, kbfsmd.ImplicitTeamsVer,
+			pmd.Buf)
+		if err != nil {
+			return ExistenceProofResult{}, err
+		}
+		md := rmds.MD
+		rev := proof.Revision + kbfsmd.Revision(i)
+		if md.TlfID() != proof.TlfID || md.RevisionNumber() != rev ||
+			md.MergedStatus() != kbfsmd.Merged {
+			return ExistenceProofResult{}, errors.Errorf(
+				"MD %d of the proof isn't merged revision %d of %s",
+				i, rev, proof.TlfID)
+		}
+		if err := rmds.VerifySignatures(codec); err != nil {
+			return ExistenceProofResult{}, err
+		}
+		if prev != nil {
+			prevID, err := kbfsmd.MakeID(codec, prev.MD)
+			if err != nil {
+				return ExistenceProofResult{}, err
+			}
+			if md.GetPrevRoot() != prevID {
+				return ExistenceProofResult{}, errors.Errorf(
+					"Revision %d doesn't follow revision %d",
+					rev, rev-1)
+			}
+		} else {
+			first = rmds
+		}
+		prev = rmds
+	}
+
+	c := existenceProofChecker{
+		blocks:      make(map[kbfsblock.ID]ExistenceProofBlock),
+		keyGen:      proof.KeyGen,
+		tlfCryptKey: tlfCryptKey,
+	}
+	for _, b := range proof.Blocks {
+		c.blocks[b.ID] = b
+	}
+	r := existenceProofReader{codec, MakeCryptoCommon(codec), c}
+	pmd, err := r.readPrivateMetadata(ctx, first.MD)
+	if err != nil {
+		return ExistenceProofResult{}, err
+	}
+	de, contents, err := r.readFile(ctx, pmd.Dir, proof.Path)
+	if err != nil {
+		return ExistenceProofResult{}, err
+	}
+
+	return ExistenceProofResult{
+		TlfID:         proof.TlfID,
+		Revision:      proof.Revision,
+		Path:          proof.Path,
+		Size:          de.Size,
+		SHA256:        sha256.Sum256(contents),
+		Mtime:         de.Mtime,
+		Writer:        first.MD.LastModifyingWriter(),
+		WriterKey:     first.WriterSigInfo.VerifyingKey,
+		HeadRevision:  prev.MD.RevisionNumber(),
+		HeadWriterKey: prev.SigInfo.VerifyingKey,
+	}, nil
+}
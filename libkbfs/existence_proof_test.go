@@ -0,0 +1,105 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	kbname "github.com/keybase/client/go/kbun"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExistenceProof(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, u1)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	t.Log("Write a file, then change it twice")
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	fileNode, _, err := kbfsOps.CreateFile(ctx, dirNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	data := []byte{1, 2, 3, 4, 5}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	md, _ := getOps(config, fb.Tlf).getHead(makeFBOLockState())
+	rev := md.Revision()
+	h := md.GetTlfHandle()
+
+	for i := byte(0); i < 2; i++ {
+		err = kbfsOps.Write(ctx, fileNode, []byte{6 + i}, 0)
+		require.NoError(t, err)
+		err = kbfsOps.SyncAll(ctx, fb)
+		require.NoError(t, err)
+	}
+
+	t.Log("Prove the original contents, and round-trip the proof")
+	proof, err := MakeExistenceProof(ctx, config, h, rev, "a/b")
+	require.NoError(t, err)
+	require.Len(t, proof.MDs, 3)
+	buf, err := config.Codec().Encode(proof)
+	require.NoError(t, err)
+	var decoded ExistenceProof
+	err = config.Codec().Decode(buf, &decoded)
+	require.NoError(t, err)
+
+	t.Log("The proof holds no TLF crypt key, so checking it needs one")
+	_, err = VerifyExistenceProof(ctx, config.Codec(), &decoded, nil)
+	require.Error(t, err)
+	key, err := GetExistenceProofTLFCryptKey(ctx, config, &decoded)
+	require.NoError(t, err)
+	res, err := VerifyExistenceProof(ctx, config.Codec(), &decoded, &key)
+	require.NoError(t, err)
+	require.Equal(t, fb.Tlf, res.TlfID)
+	require.Equal(t, rev, res.Revision)
+	require.Equal(t, rev+2, res.HeadRevision)
+	require.Equal(t, uint64(len(data)), res.Size)
+	require.Equal(t, sha256.Sum256(data), res.SHA256)
+	require.Equal(t, md.LastModifyingWriter(), res.Writer)
+
+	t.Log("A proof of a missing file can't be made")
+	_, err = MakeExistenceProof(ctx, config, h, rev, "a/c")
+	require.Error(t, err)
+
+	t.Log("Tampering with a block breaks the proof")
+	tampered := decoded
+	tampered.Blocks = append([]ExistenceProofBlock(nil), decoded.Blocks...)
+	last := len(tampered.Blocks) - 1
+	tampered.Blocks[last].Buf = append([]byte(nil), decoded.Blocks[last].Buf...)
+	tampered.Blocks[last].Buf[0] ^= 1
+	_, err = VerifyExistenceProof(ctx, config.Codec(), &tampered, &key)
+	require.Error(t, err)
+
+	t.Log("Breaking the MD chain breaks the proof")
+	tampered = decoded
+	tampered.MDs = []ExistenceProofMD{decoded.MDs[0], decoded.MDs[2]}
+	_, err = VerifyExistenceProof(ctx, config.Codec(), &tampered, &key)
+	require.Error(t, err)
+
+	t.Log("A proof for a public TLF needs no key")
+	pubRootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Public)
+	pubFb := pubRootNode.GetFolderBranch()
+	pubFileNode, _, err := kbfsOps.CreateFile(
+		ctx, pubRootNode, "c", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, pubFileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, pubFb)
+	require.NoError(t, err)
+	pubMD, _ := getOps(config, pubFb.Tlf).getHead(makeFBOLockState())
+	proof, err = MakeExistenceProof(
+		ctx, config, pubMD.GetTlfHandle(), pubMD.Revision(), "c")
+	require.NoError(t, err)
+	res, err = VerifyExistenceProof(ctx, config.Codec(), proof, nil)
+	require.NoError(t, err)
+	require.Equal(t, sha256.Sum256(data), res.SHA256)
+}
@@ -0,0 +1,495 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"math/rand"
+	pathpkg "path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// FaultKind is the kind of fault a FaultInjector injects into an
+// operation.
+type FaultKind int
+
+const (
+	// FaultLatency only delays the operation.
+	FaultLatency FaultKind = iota
+	// FaultRecoverable fails the operation, without performing it,
+	// with an error its caller is expected to recover from (e.g., an
+	// MD conflict, or a missing block reference).
+	FaultRecoverable
+	// FaultUnrecoverable fails the operation, without performing
+	// it, with a FaultInjectedError.
+	FaultUnrecoverable
+	// FaultPartial performs the operation, but then reports it as
+	// failed with a FaultInjectedError, as if the reply had been
+	// lost.
+	FaultPartial
+)
+
+func (k FaultKind) String() string {
+	switch k {
+	case FaultLatency:
+		return "latency"
+	case FaultRecoverable:
+		return "recoverable"
+	case FaultUnrecoverable:
+		return "unrecoverable"
+	case FaultPartial:
+		return "partial"
+	default:
+		return fmt.Sprintf("FaultKind(%d)", int(k))
+	}
+}
+
+// FaultRule describes which operations a FaultInjector should
+// inject a fault into.
+type FaultRule struct {
+	// Op is a path.Match pattern for the operations this rule
+	// applies to, in the form "<component>.<method>", e.g.
+	// "MDOps.Put" or "BlockOps.*".
+	Op string
+	// Kind is the kind of fault to inject.
+	Kind FaultKind
+	// Latency, if non-zero, delays the operation before the fault is
+	// applied.
+	Latency time.Duration
+	// Calls, if non-empty, lists which calls (counting from 1) of
+	// each matching operation get the fault.
+	Calls []int
+	// Probability is the chance that a matching call gets the fault
+	// when Calls is empty.  Zero means every matching call.
+	Probability float64
+}
+
+// FaultInjectedError is returned by operations failed by a
+// FaultInjector.
+type FaultInjectedError struct {
+	Op   string
+	Kind FaultKind
+}
+
+// Error implements the error interface for FaultInjectedError.
+func (e FaultInjectedError) Error() string {
+	return fmt.Sprintf("Injected %s fault into %s", e.Kind, e.Op)
+}
+
+// FaultInjector injects latencies and errors into the BlockOps,
+// MDOps, and DirtyBlockCache of a Config, according to a set of
+// rules that can be changed at any time.  It's meant for exercising
+// the sync and conflict resolution recovery paths against a real
+// deployment; see InstallFaultInjector.
+type FaultInjector struct {
+	log logger.Logger
+
+	lock  sync.Mutex
+	rules []FaultRule
+	calls map[string]int
+	rand  *rand.Rand
+}
+
+// NewFaultInjector returns a FaultInjector without any rules, whose
+// probabilistic faults are determined by `seed`.
+func NewFaultInjector(log logger.Logger, seed int64) *FaultInjector {
+	return &FaultInjector{
+		log:   log,
+		calls: make(map[string]int),
+		rand:  rand.New(rand.NewSource(seed)),
+	}
+}
+
+// SetRules replaces the injector's rules, and resets the call counts
+// used by scripted rules.
+func (fi *FaultInjector) SetRules(rules []FaultRule) {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	fi.rules = append([]FaultRule(nil), rules...)
+	fi.calls = make(map[string]int)
+}
+
+// match returns the first rule that injects a fault into this call
+// of `op`.
+func (fi *FaultInjector) match(op string) (rule FaultRule, ok bool) {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	fi.calls[op]++
+	call := fi.calls[op]
+	for _, r := range fi.rules {
+		if matched, _ := pathpkg.Match(r.Op, op); !matched {
+			continue
+		}
+		if len(r.Calls) > 0 {
+			for _, c := range r.Calls {
+				if c == call {
+					return r, true
+				}
+			}
+			continue
+		}
+		if r.Probability == 0 || fi.rand.Float64() < r.Probability {
+			return r, true
+		}
+	}
+	return FaultRule{}, false
+}
+
+// before is called before `op` is performed.  If it returns an
+// error, the operation must fail with it without being performed.
+// If it returns true, the operation must be failed with after()
+// once it's performed.
+func (fi *FaultInjector) before(ctx context.Context, op string) (
+	partial bool, err error) {
+	rule, ok := fi.match(op)
+	if !ok {
+		return false, nil
+	}
+	fi.log.CDebugf(ctx, "Injecting %s fault into %s (latency=%s)",
+		rule.Kind, op, rule.Latency)
+	if rule.Latency > 0 {
+		select {
+		case <-time.After(rule.Latency):
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+	switch rule.Kind {
+	case FaultRecoverable:
+		return false, recoverableFaultError(op)
+	case FaultUnrecoverable:
+		return false, FaultInjectedError{op, rule.Kind}
+	case FaultPartial:
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// after returns the error an operation should fail with, given the
+// outcome of before() and of the operation itself.
+func (fi *FaultInjector) after(op string, partial bool, err error) error {
+	if partial && err == nil {
+		return FaultInjectedError{op, FaultPartial}
+	}
+	return err
+}
+
+// recoverableFaultError returns an error that the callers of `op`
+// know how to recover from.
+func recoverableFaultError(op string) error {
+	injected := FaultInjectedError{op, FaultRecoverable}
+	switch {
+	case strings.HasPrefix(op, "MDOps.Put"):
+		return kbfsmd.ServerErrorConditionFailed{Err: injected}
+	case strings.HasPrefix(op, "BlockOps."):
+		return kbfsblock.ServerErrorBlockNonExistent{Msg: injected.Error()}
+	default:
+		return injected
+	}
+}
+
+// ParseFaultRules parses a fault injection spec: a semicolon-separated
+// list of rules, each made of an operation pattern followed by
+// colon-separated options.  The options are `kind=<kind>` (one of
+// "latency", "recoverable", "unrecoverable", or "partial"; defaults
+// to "unrecoverable"), `latency=<duration>`, `p=<probability>`, and
+// `calls=<n>[,<n>...]`, where each n may also be a range like "3-5".
+// For example:
+//
+//   BlockOps.Get:kind=latency:latency=2s:p=0.1;MDOps.Put:kind=partial:calls=2
+func ParseFaultRules(spec string) (rules []FaultRule, err error) {
+	for _, ruleSpec := range strings.Split(spec, ";") {
+		ruleSpec = strings.TrimSpace(ruleSpec)
+		if ruleSpec == "" {
+			continue
+		}
+		parts := strings.Split(ruleSpec, ":")
+		rule := FaultRule{Op: parts[0], Kind: FaultUnrecoverable}
+		if _, err := pathpkg.Match(rule.Op, ""); err != nil {
+			return nil, errors.Wrapf(err, "Bad operation %q", rule.Op)
+		}
+		for _, opt := range parts[1:] {
+			kv := strings.SplitN(opt, "=", 2)
+			if len(kv) != 2 {
+				return nil, errors.Errorf("Bad fault option %q", opt)
+			}
+			switch kv[0] {
+			case "kind":
+				rule.Kind, err = parseFaultKind(kv[1])
+			case "latency":
+				rule.Latency, err = time.ParseDuration(kv[1])
+			case "p":
+				rule.Probability, err = strconv.ParseFloat(kv[1], 64)
+				if err == nil &&
+					(rule.Probability < 0 || rule.Probability > 1) {
+					err = errors.Errorf(
+						"Probability %g is out of range", rule.Probability)
+				}
+			case "calls":
+				rule.Calls, err = parseFaultCalls(kv[1])
+			default:
+				err = errors.Errorf("Unknown fault option %q", kv[0])
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "Bad fault rule %q", ruleSpec)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseFaultKind(s string) (FaultKind, error) {
+	for _, k := range []FaultKind{
+		FaultLatency, FaultRecoverable, FaultUnrecoverable, FaultPartial} {
+		if s == k.String() {
+			return k, nil
+		}
+	}
+	return 0, errors.Errorf("Unknown fault kind %q", s)
+}
+
+func parseFaultCalls(s string) (calls []int, err error) {
+	for _, r := range strings.Split(s, ",") {
+		bounds := strings.SplitN(r, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, err = strconv.Atoi(bounds[1])
+			if err != nil {
+				return nil, err
+			}
+		}
+		if first < 1 || last < first {
+			return nil, errors.Errorf("Bad call range %q", r)
+		}
+		for c := first; c <= last; c++ {
+			calls = append(calls, c)
+		}
+	}
+	return calls, nil
+}
+
+// InstallFaultInjector wraps the BlockOps, MDOps, and DirtyBlockCache
+// of `config` so that they consult `fi` on every operation.  Since
+// the wrapped components no longer have their concrete types, status
+// reporting that depends on them (such as block retrieval status) is
+// unavailable while the injector is installed.  Resetting the caches
+// replaces the dirty block cache, and with it the injector.
+func InstallFaultInjector(config Config, fi *FaultInjector) {
+	config.SetBlockOps(faultyBlockOps{config.BlockOps(), fi})
+	config.SetMDOps(faultyMDOps{config.MDOps(), fi})
+	if dbc := config.DirtyBlockCache(); dbc != nil {
+		config.SetDirtyBlockCache(faultyDirtyBlockCache{dbc, fi})
+	}
+}
+
+type faultyBlockOps struct {
+	BlockOps
+	fi *FaultInjector
+}
+
+var _ BlockOps = faultyBlockOps{}
+
+func (b faultyBlockOps) Get(ctx context.Context, kmd KeyMetadata,
+	blockPtr BlockPointer, block Block, lifetime BlockCacheLifetime) error {
+	const op = "BlockOps.Get"
+	partial, err := b.fi.before(ctx, op)
+	if err != nil {
+		return err
+	}
+	err = b.BlockOps.Get(ctx, kmd, blockPtr, block, lifetime)
+	return b.fi.after(op, partial, err)
+}
+
+func (b faultyBlockOps) Ready(ctx context.Context, kmd KeyMetadata,
+	block Block) (id kbfsblock.ID, plainSize int,
+	readyBlockData ReadyBlockData, err error) {
+	const op = "BlockOps.Ready"
+	partial, err := b.fi.before(ctx, op)
+	if err != nil {
+		return kbfsblock.ID{}, 0, ReadyBlockData{}, err
+	}
+	id, plainSize, readyBlockData, err = b.BlockOps.Ready(ctx, kmd, block)
+	return id, plainSize, readyBlockData, b.fi.after(op, partial, err)
+}
+
+func (b faultyBlockOps) Delete(ctx context.Context, tlfID tlf.ID,
+	ptrs []BlockPointer) (liveCounts map[kbfsblock.ID]int, err error) {
+	const op = "BlockOps.Delete"
+	partial, err := b.fi.before(ctx, op)
+	if err != nil {
+		return nil, err
+	}
+	liveCounts, err = b.BlockOps.Delete(ctx, tlfID, ptrs)
+	return liveCounts, b.fi.after(op, partial, err)
+}
+
+func (b faultyBlockOps) Archive(ctx context.Context, tlfID tlf.ID,
+	ptrs []BlockPointer) error {
+	const op = "BlockOps.Archive"
+	partial, err := b.fi.before(ctx, op)
+	if err != nil {
+		return err
+	}
+	err = b.BlockOps.Archive(ctx, tlfID, ptrs)
+	return b.fi.after(op, partial, err)
+}
+
+type faultyMDOps struct {
+	MDOps
+	fi *FaultInjector
+}
+
+var _ MDOps = faultyMDOps{}
+
+func (m faultyMDOps) GetForTLF(ctx context.Context, id tlf.ID,
+	lockBeforeGet *keybase1.LockID) (ImmutableRootMetadata, error) {
+	const op = "MDOps.GetForTLF"
+	partial, err := m.fi.before(ctx, op)
+	if err != nil {
+		return ImmutableRootMetadata{}, err
+	}
+	irmd, err := m.MDOps.GetForTLF(ctx, id, lockBeforeGet)
+	return irmd, m.fi.after(op, partial, err)
+}
+
+func (m faultyMDOps) GetUnmergedForTLF(ctx context.Context, id tlf.ID,
+	bid kbfsmd.BranchID) (ImmutableRootMetadata, error) {
+	const op = "MDOps.GetUnmergedForTLF"
+	partial, err := m.fi.before(ctx, op)
+	if err != nil {
+		return ImmutableRootMetadata{}, err
+	}
+	irmd, err := m.MDOps.GetUnmergedForTLF(ctx, id, bid)
+	return irmd, m.fi.after(op, partial, err)
+}
+
+func (m faultyMDOps) GetRange(ctx context.Context, id tlf.ID,
+	start, stop kbfsmd.Revision, lockBeforeGet *keybase1.LockID) (
+	[]ImmutableRootMetadata, error) {
+	const op = "MDOps.GetRange"
+	partial, err := m.fi.before(ctx, op)
+	if err != nil {
+		return nil, err
+	}
+	irmds, err := m.MDOps.GetRange(ctx, id, start, stop, lockBeforeGet)
+	return irmds, m.fi.after(op, partial, err)
+}
+
+func (m faultyMDOps) GetUnmergedRange(ctx context.Context, id tlf.ID,
+	bid kbfsmd.BranchID, start, stop kbfsmd.Revision) (
+	[]ImmutableRootMetadata, error) {
+	const op = "MDOps.GetUnmergedRange"
+	partial, err := m.fi.before(ctx, op)
+	if err != nil {
+		return nil, err
+	}
+	irmds, err := m.MDOps.GetUnmergedRange(ctx, id, bid, start, stop)
+	return irmds, m.fi.after(op, partial, err)
+}
+
+func (m faultyMDOps) Put(ctx context.Context, rmd *RootMetadata,
+	verifyingKey kbfscrypto.VerifyingKey, lockContext *keybase1.LockContext,
+	priority keybase1.MDPriority) (ImmutableRootMetadata, error) {
+	const op = "MDOps.Put"
+	partial, err := m.fi.before(ctx, op)
+	if err != nil {
+		return ImmutableRootMetadata{}, err
+	}
+	irmd, err := m.MDOps.Put(ctx, rmd, verifyingKey, lockContext, priority)
+	return irmd, m.fi.after(op, partial, err)
+}
+
+func (m faultyMDOps) PutUnmerged(ctx context.Context, rmd *RootMetadata,
+	verifyingKey kbfscrypto.VerifyingKey) (ImmutableRootMetadata, error) {
+	const op = "MDOps.PutUnmerged"
+	partial, err := m.fi.before(ctx, op)
+	if err != nil {
+		return ImmutableRootMetadata{}, err
+	}
+	irmd, err := m.MDOps.PutUnmerged(ctx, rmd, verifyingKey)
+	return irmd, m.fi.after(op, partial, err)
+}
+
+func (m faultyMDOps) PruneBranch(
+	ctx context.Context, id tlf.ID, bid kbfsmd.BranchID) error {
+	const op = "MDOps.PruneBranch"
+	partial, err := m.fi.before(ctx, op)
+	if err != nil {
+		return err
+	}
+	err = m.MDOps.PruneBranch(ctx, id, bid)
+	return m.fi.after(op, partial, err)
+}
+
+func (m faultyMDOps) ResolveBranch(ctx context.Context, id tlf.ID,
+	bid kbfsmd.BranchID, blocksToDelete []kbfsblock.ID, rmd *RootMetadata,
+	verifyingKey kbfscrypto.VerifyingKey) (ImmutableRootMetadata, error) {
+	const op = "MDOps.ResolveBranch"
+	partial, err := m.fi.before(ctx, op)
+	if err != nil {
+		return ImmutableRootMetadata{}, err
+	}
+	irmd, err := m.MDOps.ResolveBranch(
+		ctx, id, bid, blocksToDelete, rmd, verifyingKey)
+	return irmd, m.fi.after(op, partial, err)
+}
+
+type faultyDirtyBlockCache struct {
+	DirtyBlockCache
+	fi *FaultInjector
+}
+
+var _ DirtyBlockCache = faultyDirtyBlockCache{}
+
+func (d faultyDirtyBlockCache) Get(tlfID tlf.ID, ptr BlockPointer,
+	branch BranchName) (Block, error) {
+	const op = "DirtyBlockCache.Get"
+	partial, err := d.fi.before(context.Background(), op)
+	if err != nil {
+		return nil, err
+	}
+	block, err := d.DirtyBlockCache.Get(tlfID, ptr, branch)
+	return block, d.fi.after(op, partial, err)
+}
+
+func (d faultyDirtyBlockCache) Put(tlfID tlf.ID, ptr BlockPointer,
+	branch BranchName, block Block) error {
+	const op = "DirtyBlockCache.Put"
+	partial, err := d.fi.before(context.Background(), op)
+	if err != nil {
+		return err
+	}
+	err = d.DirtyBlockCache.Put(tlfID, ptr, branch, block)
+	return d.fi.after(op, partial, err)
+}
+
+func (d faultyDirtyBlockCache) Delete(tlfID tlf.ID, ptr BlockPointer,
+	branch BranchName) error {
+	const op = "DirtyBlockCache.Delete"
+	partial, err := d.fi.before(context.Background(), op)
+	if err != nil {
+		return err
+	}
+	err = d.DirtyBlockCache.Delete(tlfID, ptr, branch)
+	return d.fi.after(op, partial, err)
+}
@@ -0,0 +1,91 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFaultRules(t *testing.T) {
+	rules, err := ParseFaultRules(
+		"BlockOps.*:kind=latency:latency=2s:p=0.5; MDOps.Put:calls=2,4-5")
+	require.NoError(t, err)
+	require.Equal(t, []FaultRule{
+		{
+			Op:          "BlockOps.*",
+			Kind:        FaultLatency,
+			Latency:     2 * time.Second,
+			Probability: 0.5,
+		},
+		{
+			Op:    "MDOps.Put",
+			Kind:  FaultUnrecoverable,
+			Calls: []int{2, 4, 5},
+		},
+	}, rules)
+
+	for _, bad := range []string{
+		"MDOps.Put:kind=sometimes",
+		"MDOps.Put:p=2",
+		"MDOps.Put:calls=3-1",
+		"MDOps.Put:latency",
+		"MDOps.Put:color=red",
+		"MDOps.[",
+	} {
+		_, err := ParseFaultRules(bad)
+		require.Error(t, err, bad)
+	}
+}
+
+func TestFaultInjectorMDOps(t *testing.T) {
+	ctx := BackgroundContextWithCancellationDelayer()
+	defer CleanupCancellationDelayer(ctx)
+	config := MakeTestConfigOrBust(t, "u1")
+	defer CheckConfigAndShutdown(ctx, t, config)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+
+	mdOps := config.MDOps()
+	defer config.SetMDOps(mdOps)
+	fi := NewFaultInjector(logger.NewTestLogger(t), 1)
+	config.SetMDOps(faultyMDOps{mdOps, fi})
+
+	t.Log("Fail only the second Put, in a way that's unrecoverable")
+	fi.SetRules([]FaultRule{{Op: "MDOps.Put", Kind: FaultUnrecoverable,
+		Calls: []int{2}}})
+	_, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "b")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.Equal(t, FaultInjectedError{"MDOps.Put", FaultUnrecoverable},
+		errors.Cause(err))
+
+	t.Log("A recoverable fault looks like a conflict")
+	fi.SetRules([]FaultRule{{Op: "MDOps.Put*", Kind: FaultRecoverable}})
+	_, err = fi.before(ctx, "MDOps.Put")
+	require.IsType(t, kbfsmd.ServerErrorConditionFailed{}, err)
+
+	t.Log("A partial fault performs the operation anyway")
+	fi.SetRules([]FaultRule{{Op: "MDOps.GetForTLF", Kind: FaultPartial}})
+	_, err = config.MDOps().GetForTLF(ctx, fb.Tlf, nil)
+	require.Equal(t, FaultInjectedError{"MDOps.GetForTLF", FaultPartial}, err)
+
+	t.Log("Without faults, the failed sync is retried successfully")
+	fi.SetRules(nil)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+}
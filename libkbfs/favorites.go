@@ -13,6 +13,10 @@ import (
 	"golang.org/x/net/context"
 )
 
+// maxParallelFavoriteChanges is the maximum number of favorite
+// adds and deletes a batch request has in flight at once.
+const maxParallelFavoriteChanges = 10
+
 type favToAdd struct {
 	Favorite
 
@@ -37,6 +41,9 @@ type favReq struct {
 	toAdd   []favToAdd
 	toDel   []Favorite
 	favs    chan<- []Favorite
+	// errs, if non-nil, collects the failures of individual adds and
+	// deletes, instead of failing the whole request on the first one.
+	errs map[Favorite]error
 
 	// Closed when the request is done.
 	done chan struct{}
@@ -121,6 +128,11 @@ func (f *Favorites) handleReq(req *favReq) (err error) {
 		}
 	}
 
+	if req.errs != nil {
+		f.handleBatch(req)
+		return nil
+	}
+
 	for _, fav := range req.toAdd {
 		if !fav.created && f.cache[fav.Favorite] {
 			continue
@@ -156,6 +168,73 @@ func (f *Favorites) handleReq(req *favReq) (err error) {
 	return nil
 }
 
+// handleBatch applies the adds and deletes of a batch request.  The
+// cached list was just refreshed for the request, so only the
+// changes that actually modify the list are sent, and they're sent
+// in parallel.  Each failure is recorded in `req.errs`.
+func (f *Favorites) handleBatch(req *favReq) {
+	type favChange struct {
+		fav    Favorite
+		folder keybase1.Folder
+		add    bool
+	}
+	var changes []favChange
+	for _, fav := range req.toAdd {
+		if !fav.created && f.cache[fav.Favorite] {
+			continue
+		}
+		changes = append(changes,
+			favChange{fav.Favorite, fav.ToKBFolder(), true})
+	}
+	for _, fav := range req.toDel {
+		if !f.cache[fav] {
+			continue
+		}
+		changes = append(changes,
+			favChange{fav, fav.ToKBFolder(false), false})
+	}
+
+	kbpki := f.config.KBPKI()
+	errs := make([]error, len(changes))
+	indices := make(chan int, len(changes))
+	for i := range changes {
+		indices <- i
+	}
+	close(indices)
+	numWorkers := len(changes)
+	if numWorkers > maxParallelFavoriteChanges {
+		numWorkers = maxParallelFavoriteChanges
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				if changes[i].add {
+					errs[i] = kbpki.FavoriteAdd(req.ctx, changes[i].folder)
+				} else {
+					errs[i] = kbpki.FavoriteDelete(req.ctx, changes[i].folder)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i, change := range changes {
+		switch {
+		case errs[i] != nil:
+			f.config.MakeLogger("").CDebugf(req.ctx,
+				"Failure changing favorite %v: %v", change.fav, errs[i])
+			req.errs[change.fav] = errs[i]
+		case change.add:
+			f.cache[change.fav] = true
+		default:
+			delete(f.cache, change.fav)
+		}
+	}
+}
+
 func (f *Favorites) loop() {
 	for req := range f.reqChan {
 		f.handleReq(req)
@@ -290,6 +369,32 @@ func (f *Favorites) Delete(ctx context.Context, fav Favorite) error {
 	})
 }
 
+// Batch adds and deletes many favorites in a single request.  The
+// cached list is refreshed once, and then only the favorites that
+// aren't in it yet are added, and only the ones that are in it are
+// deleted, with up to `maxParallelFavoriteChanges` RPCs in flight.
+// It returns the failures of individual favorites; the returned
+// error is only set if the whole request failed.
+func (f *Favorites) Batch(ctx context.Context, toAdd []favToAdd,
+	toDel []Favorite) (map[Favorite]error, error) {
+	if f.hasShutdown() {
+		return nil, ShutdownHappenedError{}
+	}
+	req := &favReq{
+		refresh: true,
+		ctx:     ctx,
+		toAdd:   toAdd,
+		toDel:   toDel,
+		errs:    make(map[Favorite]error),
+		done:    make(chan struct{}),
+	}
+	err := f.sendReq(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return req.errs, nil
+}
+
 // RefreshCache refreshes the cached list of favorites.
 func (f *Favorites) RefreshCache(ctx context.Context) {
 	if f.hasShutdown() {
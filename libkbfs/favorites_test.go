@@ -5,6 +5,7 @@
 package libkbfs
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/golang/mock/gomock"
@@ -190,3 +191,36 @@ func TestFavoritesListFailsDuringAddAsync(t *testing.T) {
 	f.AddAsync(ctx, fav1) // should work
 	<-c
 }
+
+func TestFavoritesBatch(t *testing.T) {
+	mockCtrl, config, ctx := favTestInit(t)
+	f := NewFavorites(config)
+	defer favTestShutdown(t, mockCtrl, config, f)
+
+	fav1 := favToAdd{Favorite{"test1", tlf.Public}, false}
+	fav2 := favToAdd{Favorite{"test2", tlf.Public}, false}
+	fav3 := favToAdd{Favorite{"test3", tlf.Public}, false}
+	fav4 := Favorite{"test4", tlf.Public}
+	fav5 := Favorite{"test5", tlf.Public}
+
+	// fav1 is already a favorite, so only fav2 and fav3 get added,
+	// and the failure of fav2 doesn't stop the rest of the batch.
+	// fav5 isn't a favorite, so deleting it doesn't need an RPC.
+	config.mockKbpki.EXPECT().FavoriteList(gomock.Any()).Return(
+		[]keybase1.Folder{fav1.ToKBFolder(), fav4.ToKBFolder(false)}, nil)
+	addErr := errors.New("add failed")
+	config.mockKbpki.EXPECT().FavoriteAdd(gomock.Any(), fav2.ToKBFolder()).
+		Return(addErr)
+	config.mockKbpki.EXPECT().FavoriteAdd(gomock.Any(), fav3.ToKBFolder()).
+		Return(nil)
+	config.mockKbpki.EXPECT().FavoriteDelete(
+		gomock.Any(), fav4.ToKBFolder(false)).Return(nil)
+	errs, err := f.Batch(
+		ctx, []favToAdd{fav1, fav2, fav3}, []Favorite{fav4, fav5})
+	if err != nil {
+		t.Fatalf("Couldn't batch favorites: %v", err)
+	}
+	if len(errs) != 1 || errs[fav2.Favorite] != addErr {
+		t.Fatalf("Unexpected batch errors: %v", errs)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"github.com/keybase/kbfs/kbfsblock"
+	"golang.org/x/net/context"
+)
+
+// FileBlockLayoutNode describes one block in the block tree of a
+// file.
+type FileBlockLayoutNode struct {
+	ID kbfsblock.ID
+	// RefNonce is set if the pointer to this block is a
+	// deduplicated reference to a block that was put before.
+	RefNonce string `json:",omitempty"`
+	// Off is the file offset of the first byte under this block.
+	Off int64
+	// Depth is 0 for the top block, and grows by one at each level
+	// of indirection.
+	Depth int
+	// EncodedSize is the size of the block on the server, or 0 if
+	// the block is dirty.
+	EncodedSize uint32
+	// DataSize is the number of file bytes spanned by a leaf block,
+	// taken from the offsets in its parent, so it includes any hole
+	// that follows the leaf's data.
+	DataSize int  `json:",omitempty"`
+	Dirty    bool `json:",omitempty"`
+	// Holes is set if the file has holes under this block.
+	Holes    bool                   `json:",omitempty"`
+	Children []*FileBlockLayoutNode `json:",omitempty"`
+}
+
+// FileBlockLayout describes the block tree of a file, as returned by
+// `KBFSOps.GetFileBlockLayout`.
+type FileBlockLayout struct {
+	Size uint64
+	// BlockSize is the block size recorded for the file, if any
+	// (see `EntryInfo.BlockSize`).
+	BlockSize int64 `json:",omitempty"`
+	// Depth is the number of levels of indirect blocks above the
+	// leaf blocks.
+	Depth     int
+	NumBlocks int
+	// NumDeduped is the number of blocks in the tree with a
+	// deduplicated pointer.
+	NumDeduped int
+	Root       *FileBlockLayoutNode
+}
+
+func (l *FileBlockLayout) addNode(ptr BlockPointer, off Int64Offset,
+	depth int, encodedSize uint32, holes bool) *FileBlockLayoutNode {
+	n := &FileBlockLayoutNode{
+		ID:          ptr.ID,
+		Off:         int64(off),
+		Depth:       depth,
+		EncodedSize: encodedSize,
+		Holes:       holes,
+	}
+	if nonce := ptr.GetRefNonce(); nonce != kbfsblock.ZeroRefNonce {
+		n.RefNonce = nonce.String()
+		l.NumDeduped++
+	}
+	l.NumBlocks++
+	return n
+}
+
+// fillLayoutNode fills in `n`, which describes the indirect block
+// `block` that covers the file up to offset `end`, and recursively
+// adds all of its children.  Only indirect blocks are fetched; the
+// leaves are described from the pointers to them, and `isDirty`
+// says whether they are dirty.
+func (fd *fileData) fillLayoutNode(ctx context.Context,
+	l *FileBlockLayout, n *FileBlockLayoutNode, block *FileBlock,
+	end int64, isDirty func(BlockPointer) bool) error {
+	for i, iptr := range block.IPtrs {
+		child := l.addNode(iptr.BlockPointer, iptr.Off, n.Depth+1,
+			iptr.EncodedSize, iptr.Holes)
+		n.Children = append(n.Children, child)
+		if child.Depth > l.Depth {
+			l.Depth = child.Depth
+		}
+		childEnd := end
+		if i+1 < len(block.IPtrs) {
+			childEnd = int64(block.IPtrs[i+1].Off)
+		}
+
+		// As in `blockTree.getBlocksForOffsetRange`, pointers with
+		// an unknown direct type predate multiple levels of
+		// indirection, and so point to leaves.
+		if iptr.DirectType != IndirectBlock {
+			child.Dirty = isDirty(iptr.BlockPointer)
+			child.DataSize = int(childEnd - child.Off)
+			continue
+		}
+
+		childBlock, childWasDirty, err := fd.getter(
+			ctx, fd.tree.kmd, iptr.BlockPointer, fd.tree.file, blockRead)
+		if err != nil {
+			return err
+		}
+		child.Dirty = childWasDirty
+		err = fd.fillLayoutNode(
+			ctx, l, child, childBlock, childEnd, isDirty)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getLayout returns the layout of the whole block tree of the file,
+// whose entry is `de`.  `isDirty` says whether a leaf block is
+// dirty.
+func (fd *fileData) getLayout(ctx context.Context, de DirEntry,
+	isDirty func(BlockPointer) bool) (FileBlockLayout, error) {
+	l := FileBlockLayout{
+		Size:      de.Size,
+		BlockSize: de.BlockSize,
+	}
+	topBlock, wasDirty, err := fd.getter(
+		ctx, fd.tree.kmd, fd.rootBlockPointer(), fd.tree.file, blockRead)
+	if err != nil {
+		return FileBlockLayout{}, err
+	}
+	l.Root = l.addNode(fd.rootBlockPointer(), 0, 0, de.EncodedSize, false)
+	l.Root.Dirty = wasDirty
+	if !topBlock.IsInd {
+		l.Root.DataSize = len(topBlock.Contents)
+		return l, nil
+	}
+	err = fd.fillLayoutNode(
+		ctx, &l, l.Root, topBlock, int64(de.Size), isDirty)
+	if err != nil {
+		return FileBlockLayout{}, err
+	}
+	return l, nil
+}
@@ -82,6 +82,35 @@ func (fd *fileData) getLeafBlocksForOffsetRange(ctx context.Context,
 	return pathsFromRoot, blocks, nextBlockOffset, nil
 }
 
+// getLeafForOffset returns the leaf block that holds `off`, along
+// with its pointer and the offset of its first byte.  If `off` is in
+// a hole, it returns the leaf before the hole.
+func (fd *fileData) getLeafForOffset(ctx context.Context, off Int64Offset) (
+	ptr BlockPointer, block *FileBlock, blockOff Int64Offset, err error) {
+	topBlock, _, err := fd.getter(ctx, fd.tree.kmd, fd.rootBlockPointer(),
+		fd.tree.file, blockRead)
+	if err != nil {
+		return zeroPtr, nil, 0, err
+	}
+	if !topBlock.IsInd {
+		return fd.rootBlockPointer(), topBlock, 0, nil
+	}
+
+	pfr, blockMap, _, err := fd.getLeafBlocksForOffsetRange(
+		ctx, fd.rootBlockPointer(), topBlock, off, off+1, false)
+	if err != nil {
+		return zeroPtr, nil, 0, err
+	}
+	if len(pfr) == 0 || len(pfr[0]) == 0 {
+		return zeroPtr, nil, 0, fmt.Errorf(
+			"No leaf found for offset %d in file %v",
+			off, fd.rootBlockPointer())
+	}
+	iptr := childFileIptr(pfr[0][len(pfr[0])-1])
+	return iptr.BlockPointer, blockMap[iptr.BlockPointer].(*FileBlock),
+		iptr.Off, nil
+}
+
 func childFileIptr(p parentBlockAndChildIndex) IndirectFilePtr {
 	fb := p.pblock.(*FileBlock)
 	return fb.IPtrs[p.childIndex]
@@ -233,6 +262,60 @@ func (fd *fileData) getByteSlicesInOffsetRange(ctx context.Context,
 	return bytes, nil
 }
 
+// fetchRange fetches the leaf blocks holding the data described by
+// the half-inclusive offset range `[startOff, endOff)` into the
+// caches, without copying out any of their data.  If `endOff` == -1,
+// it fetches to the end of the file.  It returns the block-aligned
+// range covered by the fetched blocks, which may be empty if the
+// range is past the end of the file.
+func (fd *fileData) fetchRange(ctx context.Context,
+	startOff, endOff Int64Offset) (FileRange, error) {
+	if startOff < 0 || endOff < -1 {
+		return FileRange{}, fmt.Errorf(
+			"Bad offset range [%d, %d)", startOff, endOff)
+	} else if endOff != -1 && endOff <= startOff {
+		return FileRange{}, nil
+	}
+
+	topBlock, _, err := fd.getter(ctx, fd.tree.kmd, fd.rootBlockPointer(),
+		fd.tree.file, blockRead)
+	if err != nil {
+		return FileRange{}, err
+	}
+	if !topBlock.IsInd {
+		if int64(startOff) >= int64(len(topBlock.Contents)) {
+			return FileRange{}, nil
+		}
+		return FileRange{Off: 0, Len: int64(len(topBlock.Contents))}, nil
+	}
+
+	pfr, blockMap, _, err := fd.getLeafBlocksForOffsetRange(
+		ctx, fd.rootBlockPointer(), topBlock, startOff, endOff, false)
+	if err != nil {
+		return FileRange{}, err
+	}
+	if len(pfr) == 0 {
+		return FileRange{}, nil
+	}
+	first, last := pfr[0], pfr[len(pfr)-1]
+	if len(first) == 0 || len(last) == 0 {
+		return FileRange{}, fmt.Errorf("Unexpected empty path to child for "+
+			"file %v", fd.rootBlockPointer())
+	}
+	firstIptr := childFileIptr(first[len(first)-1])
+	lastIptr := childFileIptr(last[len(last)-1])
+	lastBlock := blockMap[lastIptr.BlockPointer].(*FileBlock)
+	end := int64(lastIptr.Off) + int64(len(lastBlock.Contents))
+	if int64(startOff) >= end {
+		// Only the last block, which ends before the range starts.
+		return FileRange{}, nil
+	}
+	return FileRange{
+		Off: int64(firstIptr.Off),
+		Len: end - int64(firstIptr.Off),
+	}, nil
+}
+
 // The amount that the read timeout is smaller than the global one.
 const readTimeoutSmallerBy = 2 * time.Second
 
@@ -994,9 +1077,65 @@ func (fd *fileData) ready(ctx context.Context, id tlf.ID, bcache BlockCache,
 				return func() error { return df.setBlockSynced(ptr) }
 			}
 			return nil
+		}, func(ptr BlockPointer) (BlockInfo, ReadyBlockData, bool) {
+			if df == nil {
+				return BlockInfo{}, ReadyBlockData{}, false
+			}
+			return df.takePutEarlyReadied(ptr)
 		})
 }
 
+// getAllocatedSize estimates how many of the `size` logical bytes of
+// the file, whose top block is the indirect block `topBlock`, are
+// backed by data rather than holes, without fetching any leaf blocks
+// from the server.  Each leaf covers the range up to the next leaf's
+// offset, but its data can't be bigger than its encoded size, so the
+// smaller of the two is counted.  The result is thus rounded up to
+// the block padding for leaves that are followed by a hole.  Dirty
+// leaves have no encoded size yet, so their contents are measured
+// directly from the dirty block cache.
+func (fd *fileData) getAllocatedSize(ctx context.Context,
+	topBlock *FileBlock, size uint64) (uint64, error) {
+	pfr, err := fd.tree.getIndirectBlocksForOffsetRange(
+		ctx, topBlock, Int64Offset(0), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var allocated uint64
+	for i, p := range pfr {
+		if len(p) == 0 {
+			continue
+		}
+		iptr := childFileIptr(p[len(p)-1])
+		end := Int64Offset(size)
+		if i < len(pfr)-1 && len(pfr[i+1]) > 0 {
+			end = childFileIptr(pfr[i+1][len(pfr[i+1])-1]).Off
+		}
+		if end <= iptr.Off {
+			continue
+		}
+		extent := uint64(end - iptr.Off)
+
+		dataLen := uint64(iptr.EncodedSize)
+		if dataLen == 0 {
+			block, _, err := fd.getter(
+				ctx, fd.tree.kmd, iptr.BlockPointer, fd.tree.file, blockRead)
+			if err != nil {
+				return 0, err
+			}
+			dataLen = uint64(len(block.Contents))
+		}
+
+		if dataLen < extent {
+			allocated += dataLen
+		} else {
+			allocated += extent
+		}
+	}
+	return allocated, nil
+}
+
 func (fd *fileData) getIndirectFileBlockInfosWithTopBlock(
 	ctx context.Context, topBlock *FileBlock) ([]BlockInfo, error) {
 	return fd.tree.getIndirectBlockInfosWithTopBlock(ctx, topBlock)
@@ -1242,8 +1381,9 @@ func (fd *fileData) undupChildrenInCopy(ctx context.Context,
 			"Indirect file %v had no indirect blocks", fd.rootBlockPointer())
 	}
 
-	// If the number of leaf blocks (len(pfr)) is likely to represent
-	// a file greater than 2 GB, abort conflict resolution.  Until
+	// If the last leaf block starts past 2 GB, abort conflict
+	// resolution.  (The number of leaf blocks alone says little,
+	// since files can have blocks of different sizes.)  Until
 	// disk caching is ready, we'll have to help people deal with this
 	// on a case-by-case basis.  // TODO: once the disk-backed cache
 	// is ready, make sure we use it here for both the dirty block
@@ -1251,7 +1391,9 @@ func (fd *fileData) undupChildrenInCopy(ctx context.Context,
 	// so we avoid memory explosion in the case of journaling and
 	// multiple devices modifying the same large file or set of files.
 	// And then remove this check.
-	if len(pfr) > (2*1024*1024*1024)/MaxBlockSizeBytesDefault {
+	lastPath := pfr[len(pfr)-1]
+	_, lastOff := lastPath[len(lastPath)-1].childIPtr()
+	if off, ok := lastOff.(Int64Offset); ok && off > 2*1024*1024*1024 {
 		return nil, FileTooBigForCRError{fd.tree.file}
 	}
 
@@ -1269,7 +1411,7 @@ func (fd *fileData) undupChildrenInCopy(ctx context.Context,
 	}
 
 	newInfos, err := fd.tree.readyHelper(
-		ctx, fd.tree.file.Tlf, bcache, bops, bps, pfr, nil)
+		ctx, fd.tree.file.Tlf, bcache, bops, bps, pfr, nil, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -1306,7 +1448,7 @@ func (fd *fileData) readyNonLeafBlocksInCopy(ctx context.Context,
 	}
 
 	newInfos, err := fd.tree.readyHelper(
-		ctx, fd.tree.file.Tlf, bcache, bops, bps, pfr, nil)
+		ctx, fd.tree.file.Tlf, bcache, bops, bps, pfr, nil, nil)
 	if err != nil {
 		return nil, err
 	}
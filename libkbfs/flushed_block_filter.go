@@ -0,0 +1,101 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/keybase/kbfs/kbfsblock"
+)
+
+const (
+	// flushedBlockFilterBits is the size of each generation of a
+	// flushedBlockFilter (128 KiB).
+	flushedBlockFilterBits = 1 << 20
+	// flushedBlockFilterHashes is the number of bits set per block.
+	flushedBlockFilterHashes = 4
+	// flushedBlockFilterCapacity is the number of blocks added to a
+	// generation before it's rotated out.  With the sizes above,
+	// this keeps the false positive rate of the filter around 0.2%.
+	flushedBlockFilterCapacity = 50000
+)
+
+// flushedBlockFilter is a bounded bloom filter of the IDs of the
+// blocks a TLF journal has recently flushed to the server.  It keeps
+// two generations of the filter, and drops the older one once the
+// newer one fills up, so it remembers at least the last
+// `flushedBlockFilterCapacity` blocks.  Since it may report false
+// positives, callers must be able to recover when a block it claims
+// was flushed turns out not to be on the server.
+type flushedBlockFilter struct {
+	lock     sync.Mutex
+	curr     []byte
+	prev     []byte
+	numAdded int
+}
+
+func newFlushedBlockFilter() *flushedBlockFilter {
+	return &flushedBlockFilter{
+		curr: make([]byte, flushedBlockFilterBits/8),
+	}
+}
+
+// bitIndices returns the bits of the filter for `id`, using double
+// hashing to derive the different indices.
+func (f *flushedBlockFilter) bitIndices(
+	id kbfsblock.ID) [flushedBlockFilterHashes]uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(id.Bytes())
+	h1 := h.Sum64()
+	_, _ = h.Write([]byte{0})
+	h2 := h.Sum64() | 1
+	var indices [flushedBlockFilterHashes]uint64
+	for i := range indices {
+		indices[i] = (h1 + uint64(i)*h2) % flushedBlockFilterBits
+	}
+	return indices
+}
+
+func filterHasBits(
+	filter []byte, indices [flushedBlockFilterHashes]uint64) bool {
+	if filter == nil {
+		return false
+	}
+	for _, i := range indices {
+		if filter[i/8]&(1<<(i%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// add records that the block `id` was flushed.
+func (f *flushedBlockFilter) add(id kbfsblock.ID) {
+	indices := f.bitIndices(id)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if filterHasBits(f.curr, indices) {
+		return
+	}
+	if f.numAdded >= flushedBlockFilterCapacity {
+		f.prev = f.curr
+		f.curr = make([]byte, flushedBlockFilterBits/8)
+		f.numAdded = 0
+	}
+	for _, i := range indices {
+		f.curr[i/8] |= 1 << (i % 8)
+	}
+	f.numAdded++
+}
+
+// mayContain returns true if the block `id` was probably flushed
+// recently, and false if it definitely wasn't.
+func (f *flushedBlockFilter) mayContain(id kbfsblock.ID) bool {
+	indices := f.bitIndices(id)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return filterHasBits(f.curr, indices) || filterHasBits(f.prev, indices)
+}
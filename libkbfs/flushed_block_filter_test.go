@@ -0,0 +1,33 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlushedBlockFilter(t *testing.T) {
+	f := newFlushedBlockFilter()
+	id1 := kbfsblock.FakeID(1)
+	id2 := kbfsblock.FakeID(2)
+	require.False(t, f.mayContain(id1))
+
+	f.add(id1)
+	require.True(t, f.mayContain(id1))
+	require.False(t, f.mayContain(id2))
+
+	t.Log("Blocks survive one rotation, but not two")
+	f.numAdded = flushedBlockFilterCapacity
+	f.add(id2)
+	require.True(t, f.mayContain(id1))
+	require.True(t, f.mayContain(id2))
+	f.numAdded = flushedBlockFilterCapacity
+	f.add(kbfsblock.FakeID(3))
+	require.False(t, f.mayContain(id1))
+	require.True(t, f.mayContain(id2))
+}
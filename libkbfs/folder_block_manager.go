@@ -25,6 +25,8 @@ type fbmHelper interface {
 	getMostRecentFullyMergedMD(ctx context.Context) (
 		ImmutableRootMetadata, error)
 	finalizeGCOp(ctx context.Context, gco *GCOp) error
+	isRetentionLocked(ctx context.Context, md ImmutableRootMetadata) (
+		bool, error)
 }
 
 const (
@@ -123,7 +125,8 @@ func newFolderBlockManager(
 	appStateUpdater env.AppStateUpdater, config Config, fb FolderBranch,
 	bType branchType, helper fbmHelper) *folderBlockManager {
 	tlfStringFull := fb.Tlf.String()
-	log := config.MakeLogger(fmt.Sprintf("FBM %s", tlfStringFull[:8]))
+	log := logWithTlfID(config.MakeLogger(
+		fmt.Sprintf("FBM %s", tlfStringFull[:8])), fb.Tlf)
 	fbm := &folderBlockManager{
 		appStateUpdater: appStateUpdater,
 		config:          config,
@@ -403,6 +406,27 @@ func (fbm *folderBlockManager) forceQuotaReclamation() {
 	}
 }
 
+// moveToArchiveTier hints to the block server, if it has storage
+// tiers, that the blocks of the given just-archived pointers can be
+// moved to slower storage.  Since it's only a hint, failures are
+// just logged.
+func (fbm *folderBlockManager) moveToArchiveTier(
+	ctx context.Context, tlfID tlf.ID, ptrs []BlockPointer) {
+	tiered, ok := fbm.config.BlockServer().(blockServerTiered)
+	if !ok {
+		return
+	}
+	ids := make([]kbfsblock.ID, 0, len(ptrs))
+	for _, ptr := range ptrs {
+		ids = append(ids, ptr.ID)
+	}
+	err := tiered.SetBlockTiers(ctx, tlfID, ids, ArchiveBlockTier)
+	if err != nil {
+		fbm.log.CDebugf(ctx, "Couldn't move %d blocks to the archive "+
+			"tier: %+v", len(ids), err)
+	}
+}
+
 // doChunkedDowngrades sends batched archive or delete messages to the
 // block server for the given block pointers.  For deletes, it returns
 // a list of block IDs that no longer have any references.
@@ -441,6 +465,9 @@ func (fbm *folderBlockManager) doChunkedDowngrades(ctx context.Context,
 			fbm.log.CDebugf(ctx, "Downgrading chunk of %d pointers", len(chunk))
 			if archive {
 				res.err = bops.Archive(ctx, tlfID, chunk)
+				if res.err == nil {
+					fbm.moveToArchiveTier(ctx, tlfID, chunk)
+				}
 			} else {
 				var liveCounts map[kbfsblock.ID]int
 				liveCounts, res.err = bops.Delete(ctx, tlfID, chunk)
@@ -1076,6 +1103,17 @@ func (fbm *folderBlockManager) doReclamation(timer *time.Timer) (err error) {
 			head.GetTlfHandle().GetCanonicalPath())
 	}
 
+	// A retention lock means nothing in the TLF's history may ever
+	// be deleted.
+	retentionLocked, err := fbm.helper.isRetentionLocked(ctx, head)
+	if err != nil {
+		return err
+	}
+	if retentionLocked {
+		fbm.log.CDebugf(ctx, "Skipping QR for a retention-locked TLF")
+		return nil
+	}
+
 	if !fbm.isQRNecessary(ctx, head) {
 		// Nothing has changed since last time, or the current head is
 		// too new, so no need to do any QR.
@@ -1223,6 +1261,21 @@ func (fbm *folderBlockManager) reclaimQuotaInBackground() {
 				context.Background(), "Resuming QR while foregrounded")
 			continue
 		case <-timerChan:
+			// Don't compete with the user for bandwidth; wait until
+			// there's been no foreground activity for a while.
+			// Forced reclamations don't wait.
+			if wait := fbm.config.IdleTracker().untilIdle(); wait > 0 {
+				fbm.log.CDebugf(context.Background(),
+					"Deferring QR for %s until idle", wait)
+				timer.Reset(wait)
+				continue
+			}
+			if fbm.config.PowerMonitor().shouldPauseMaintenance() {
+				fbm.log.CDebugf(context.Background(),
+					"Skipping QR on battery or a metered network")
+				timer.Reset(fbm.config.Mode().QuotaReclamationPeriod())
+				continue
+			}
 			fbm.reclamationGroup.Add(1)
 		case <-fbm.forceReclamationChan:
 		}
@@ -818,3 +818,54 @@ func TestQuotaReclamationGCOpsForGCOps(t *testing.T) {
 		t.Fatalf("Last GCOp revision was unexpected: %d vs %d", g, e)
 	}
 }
+
+func TestFolderBlockManagerMovesArchivedBlocksToArchiveTier(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+	bserver, ok := config.BlockServer().(*BlockServerMemory)
+	if !ok {
+		t.Skip("Only the memory block server keeps track of tiers")
+	}
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, u1.String(), tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %+v", err)
+	}
+	err = kbfsOps.Write(ctx, fileNode, []byte{1}, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %+v", err)
+	}
+	err = kbfsOps.SyncAll(ctx, fb)
+	if err != nil {
+		t.Fatalf("Couldn't sync all: %+v", err)
+	}
+	ops := getOps(config, fb.Tlf)
+	oldPtr := ops.nodeCache.PathFromNode(fileNode).tailPointer()
+
+	// Overwrite the file, which archives its old block.
+	err = kbfsOps.Write(ctx, fileNode, []byte{2}, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %+v", err)
+	}
+	err = kbfsOps.SyncAll(ctx, fb)
+	if err != nil {
+		t.Fatalf("Couldn't sync all: %+v", err)
+	}
+	// Wait for outstanding archives
+	err = kbfsOps.SyncFromServer(ctx, fb, nil)
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %+v", err)
+	}
+	newPtr := ops.nodeCache.PathFromNode(fileNode).tailPointer()
+
+	if tier := bserver.blockTier(oldPtr.ID); tier != ArchiveBlockTier {
+		t.Fatalf("Old block is on the %s tier", tier)
+	}
+	if tier := bserver.blockTier(newPtr.ID); tier != HotBlockTier {
+		t.Fatalf("New block is on the %s tier", tier)
+	}
+}
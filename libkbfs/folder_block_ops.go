@@ -7,12 +7,18 @@ package libkbfs
 import (
 	"fmt"
 	"path/filepath"
+	"sort"
+	"sync"
 	"time"
 
+	lru "github.com/hashicorp/golang-lru"
 	"github.com/keybase/client/go/logger"
 	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/kbfs/kbfsblock"
 	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/kbfssync"
 	"github.com/keybase/kbfs/tlf"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
@@ -51,9 +57,24 @@ const (
 	// numBlockSizeWorkersMax is the max number of workers to use when
 	// fetching a set of block sizes.
 	numBlockSizeWorkersMax = 50
+	// numWalkDirWorkersMax is the max number of directories read in
+	// parallel when walking a subtree.
+	numWalkDirWorkersMax = 10
+	// numIOVecWorkersMax is the max number of vectors of a vectored
+	// read or write whose blocks are fetched in parallel.
+	numIOVecWorkersMax = 10
 	// truncateExtendCutoffPoint is the amount of data in extending
 	// truncate that will trigger the extending with a hole algorithm.
 	truncateExtendCutoffPoint = 128 * 1024
+	// fastForwardBatchSize is the number of node updates applied
+	// under one hold of the block lock during a fast-forward.
+	fastForwardBatchSize = 100
+	// parentIndexCapacity is the maximum number of block pointers
+	// whose parent directory is remembered, to speed up searches.
+	parentIndexCapacity = 100000
+	// allocatedSizesCapacity is the maximum number of clean files
+	// whose allocated size is remembered.
+	allocatedSizesCapacity = 10000
 )
 
 type mdToCleanIfUnused struct {
@@ -69,6 +90,8 @@ type syncInfo struct {
 	refBytes        uint64
 	unrefBytes      uint64
 	toCleanIfUnused []mdToCleanIfUnused
+	// dirtySince is when the file first became dirty.
+	dirtySince time.Time
 }
 
 func (si *syncInfo) DeepCopy(codec kbfscodec.Codec) (*syncInfo, error) {
@@ -76,6 +99,7 @@ func (si *syncInfo) DeepCopy(codec kbfscodec.Codec) (*syncInfo, error) {
 		oldInfo:    si.oldInfo,
 		refBytes:   si.refBytes,
 		unrefBytes: si.unrefBytes,
+		dirtySince: si.dirtySince,
 	}
 	newSi.unrefs = make([]BlockInfo, len(si.unrefs))
 	copy(newSi.unrefs, si.unrefs)
@@ -204,6 +228,10 @@ type folderBlockOps struct {
 	// Sync().  It is a blocking channel.
 	forceSyncChan chan<- struct{}
 
+	// earlyPuts tracks the background puts (and deletes) of blocks
+	// that were readied ahead of a sync.
+	earlyPuts kbfssync.RepeatedWaitGroup
+
 	// protects access to blocks in this folder and all fields
 	// below.
 	blockLock blockLock
@@ -220,6 +248,13 @@ type folderBlockOps struct {
 	// TLF.
 	dirtyDirs map[BlockPointer][]BlockInfo
 
+	// dirEntryCounts caches the number of entries of each directory
+	// checked against the entry limit, by the directory's pointer,
+	// so that filling a directory doesn't count all of its entries
+	// on every add.  Adds and removes in the cache keep it up to
+	// date, and it's reset along with the dirty directories.
+	dirEntryCounts map[BlockPointer]int
+
 	// dirtyRootDirEntry is a DirEntry representing the root of the
 	// TLF (to be copied into the RootMetadata on a sync).
 	dirtyRootDirEntry *DirEntry
@@ -236,6 +271,60 @@ type folderBlockOps struct {
 	// call PathFromNode() only under blockLock (see nodeCache
 	// comments in folder_branch_ops.go).
 	nodeCache NodeCache
+
+	// parentIndex maps a BlockPointer to the parentIndexEntry
+	// recording where it was last seen in the directory tree.  It is
+	// goroutine-safe, so it may be updated under a read lock on
+	// blockLock.
+	parentIndex *lru.Cache
+
+	// allocatedSizes maps the top BlockPointer of a clean, indirect
+	// file to its allocated size, so that getattr doesn't have to
+	// walk the file's indirect blocks every time.  It is
+	// goroutine-safe.
+	allocatedSizes *lru.Cache
+
+	// quarantine tracks the blocks that can't be decrypted or
+	// verified.  It is goroutine-safe.
+	quarantine blockQuarantine
+
+	// Count writes and truncates deferred until the end of a sync,
+	// blocks re-dirtied after a sync fails with a recoverable
+	// error, and syncs that will be retried because of one.
+	deferredWritesCounter MetricsCounter
+	redirtiesCounter      MetricsCounter
+	syncRetriesCounter    MetricsCounter
+
+	// damaged tracks the directories that couldn't be read because
+	// of the blocks in quarantine.  It is goroutine-safe.
+	damaged damagedSubtrees
+
+	// interest is the set of subtrees the client subscribed to (see
+	// `KBFSOps.SubscribeSubtrees`); nil means the whole TLF.
+	interest *subtreeInterest
+
+	// readRepairs tracks alternate references to file blocks, and
+	// the pointers that could only be read through them.  It is
+	// goroutine-safe.
+	readRepairs *blockReadRepairer
+
+	// sizedSplitters caches the block splitters for the block sizes
+	// recorded in file entries (see `EntryInfo.BlockSize`).
+	sizedSplitters map[int64]BlockSplitter
+
+	// syncCancelers maps each file with a sync in flight to the
+	// canceler of its sync batch (see `CancelSync`).
+	syncCancelers map[BlockRef]*syncCanceler
+}
+
+// parentIndexEntry records the directory block containing a pointer,
+// and the name of the pointer's entry in that directory.  Since
+// blocks are immutable, the entry never becomes wrong for that parent
+// pointer; the parent just might not be reachable from the current
+// root anymore.
+type parentIndexEntry struct {
+	parent BlockPointer
+	name   string
 }
 
 // Only exported methods of folderBlockOps should be used outside of this
@@ -359,8 +448,9 @@ func (fbo *folderBlockOps) getBlockHelperLocked(ctx context.Context,
 		// an on-demand request so that its downstream prefetches are triggered
 		// correctly according to the new on-demand fetch priority.
 		fbo.config.BlockOps().Prefetcher().ProcessBlockForPrefetch(ctx, ptr,
-			block, kmd, defaultOnDemandRequestPriority, lifetime,
-			prefetchStatus)
+			block, kmd, prefetchPriorityForTier(
+				defaultOnDemandRequestPriority, fbo.blockTier()),
+			lifetime, prefetchStatus)
 		return block, nil
 	}
 
@@ -368,10 +458,19 @@ func (fbo *folderBlockOps) getBlockHelperLocked(ctx context.Context,
 		return nil, err
 	}
 
+	tier := fbo.blockTier()
 	if notifyPath.isValidForNotification() {
-		fbo.config.Reporter().Notify(ctx, readNotification(notifyPath, false))
-		defer fbo.config.Reporter().Notify(ctx,
-			readNotification(notifyPath, true))
+		readNotifs := fbo.config.ReadNotifications()
+		if readNotifs.startRead(notifyPath) {
+			fbo.config.Reporter().Notify(
+				ctx, readNotification(notifyPath, false, tier))
+		}
+		defer func() {
+			if readNotifs.finishRead(notifyPath) {
+				fbo.config.Reporter().Notify(
+					ctx, readNotification(notifyPath, true, tier))
+			}
+		}()
 	}
 
 	// Unlock the blockLock while we wait for the network, only if
@@ -385,6 +484,17 @@ func (fbo *folderBlockOps) getBlockHelperLocked(ctx context.Context,
 	// goroutines may be operating on the data assuming they have the
 	// lock.
 	// fetch the block, and add to cache
+	if err := fbo.quarantine.check(ptr.ID); err != nil {
+		return nil, err
+	}
+
+	if notifyPath.isValid() {
+		ctx = ctxWithBlockTrafficPath(ctx, notifyPath.tlfRelativeString())
+	}
+	if tier != HotBlockTier {
+		ctx = ctxWithBlockTier(ctx, tier)
+	}
+
 	block := newBlock()
 	bops := fbo.config.BlockOps()
 	var err error
@@ -395,13 +505,160 @@ func (fbo *folderBlockOps) getBlockHelperLocked(ctx context.Context,
 	} else {
 		err = bops.Get(ctx, kmd, ptr, block, lifetime)
 	}
-	if err != nil {
+	if isReadRepairableError(err) {
+		err = fbo.getBlockFromAlternateRef(
+			ctx, lState, kmd, ptr, block, lifetime, notifyPath, rtype, err)
+	}
+	if isQuarantinableBlockError(err) {
+		fbo.recordBlockFailure(ctx, kmd, ptr, notifyPath, err)
+		return nil, err
+	} else if err != nil {
 		return nil, err
 	}
 
+	fbo.quarantine.recordSuccess(ptr.ID)
+	fbo.readRepairs.indexChildRefs(block)
 	return block, nil
 }
 
+// getBlockFromAlternateRef tries to fetch the block for `ptr`
+// through any other known reference to the same block ID, after
+// fetching it through `ptr` failed with `origErr`.  Since block IDs
+// are content hashes, the contents are guaranteed to be the same.
+// On success, if `ptr` is a leaf of an indirect file, it's recorded
+// so that a later sync can replace it with a new reference.
+// Otherwise `origErr` is returned.
+func (fbo *folderBlockOps) getBlockFromAlternateRef(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, ptr BlockPointer, block Block,
+	lifetime BlockCacheLifetime, notifyPath path, rtype blockReqType,
+	origErr error) error {
+	bops := fbo.config.BlockOps()
+	for _, alt := range fbo.readRepairs.alternates(ptr) {
+		var err error
+		if rtype != blockReadParallel && rtype != blockLookup {
+			fbo.blockLock.DoRUnlockedIfPossible(lState, func(*lockState) {
+				err = bops.Get(ctx, kmd, alt, block, lifetime)
+			})
+		} else {
+			err = bops.Get(ctx, kmd, alt, block, lifetime)
+		}
+		if err != nil {
+			fbo.log.CDebugf(ctx, "Couldn't get %v through alternate "+
+				"reference %v: %+v", ptr, alt, err)
+			continue
+		}
+
+		fbo.log.CWarningf(ctx, "Read %v through alternate reference %v "+
+			"after error: %+v", ptr, alt, origErr)
+		if _, isFile := block.(*FileBlock); isFile &&
+			notifyPath.isValid() && notifyPath.tailPointer() != ptr {
+			fbo.readRepairs.addRepair(notifyPath, ptr)
+		}
+		return nil
+	}
+	return origErr
+}
+
+// recordBlockFailure notes that `ptr` couldn't be decrypted or
+// verified, and logs the details if that caused it to be
+// quarantined.
+func (fbo *folderBlockOps) recordBlockFailure(ctx context.Context,
+	kmd KeyMetadata, ptr BlockPointer, p path, err error) {
+	var rev kbfsmd.Revision
+	if rmd, ok := kmd.(interface {
+		Revision() kbfsmd.Revision
+	}); ok {
+		rev = rmd.Revision()
+	}
+	if fbo.quarantine.recordFailure(ptr.ID, p, rev, err) {
+		fbo.log.CWarningf(ctx, "Quarantining block %v (path=%s, "+
+			"revision=%d) after repeated failures; last error: %+v",
+			ptr, p, rev, err)
+	}
+}
+
+// GetQuarantinedBlocks returns the blocks in this TLF that have been
+// quarantined because they can't be decrypted or verified.
+func (fbo *folderBlockOps) GetQuarantinedBlocks() []QuarantinedBlock {
+	return fbo.quarantine.list()
+}
+
+// GetDamagedSubtrees returns the directories in this TLF that
+// couldn't be read because their blocks can't be fetched or
+// verified.
+func (fbo *folderBlockOps) GetDamagedSubtrees() []DamagedSubtree {
+	return fbo.damaged.list()
+}
+
+// GetDamagedSubtree returns the damage recorded for the given
+// directory, or nil if it isn't known to be damaged.
+func (fbo *folderBlockOps) GetDamagedSubtree(dir path) *DamagedSubtree {
+	s, ok := fbo.damaged.get(dir)
+	if !ok {
+		return nil
+	}
+	return &s
+}
+
+// ForgetDamagedSubtrees forgets all the directories known to be
+// damaged.  It should be called whenever updates from other devices
+// are applied.
+func (fbo *folderBlockOps) ForgetDamagedSubtrees() {
+	fbo.damaged.reset()
+}
+
+// blockTier returns the storage tier that this folder-branch's blocks
+// are expected to come from when they aren't cached.  A branch
+// pinned to an old revision mostly reads blocks that recent
+// revisions don't reference anymore.
+func (fbo *folderBlockOps) blockTier() BlockTier {
+	if _, isRev := fbo.folderBranch.Branch.RevisionIfSpecified(); isRev {
+		return ArchiveBlockTier
+	}
+	return HotBlockTier
+}
+
+// SetSubtreeInterest replaces the set of subtrees whose nodes are
+// prefetched and reported to observers when they're updated.
+func (fbo *folderBlockOps) SetSubtreeInterest(
+	lState *lockState, si *subtreeInterest) {
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+	fbo.interest = si
+}
+
+// isInterestingLocked returns true if the node for `ptr`, if there
+// is one, is in one of the subscribed subtrees or is an ancestor of
+// one.  blockLock must be taken by the caller.
+func (fbo *folderBlockOps) isInterestingLocked(ptr BlockPointer) bool {
+	if fbo.interest == nil {
+		return true
+	}
+	node := fbo.nodeCache.Get(ptr.Ref())
+	if node == nil {
+		return true
+	}
+	return fbo.interest.includes(fbo.nodeCache.PathFromNode(node))
+}
+
+// FilterUninterestingChanges returns the given changes without the
+// ones for nodes outside of the subscribed subtrees.
+func (fbo *folderBlockOps) FilterUninterestingChanges(
+	lState *lockState, changes []NodeChange) []NodeChange {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+	if fbo.interest == nil {
+		return changes
+	}
+	var filtered []NodeChange
+	for _, change := range changes {
+		if fbo.interest.includes(fbo.nodeCache.PathFromNode(change.Node)) {
+			filtered = append(filtered, change)
+		}
+	}
+	return filtered
+}
+
 // getFileBlockHelperLocked retrieves the block pointed to by ptr,
 // which must be valid, either from an internal cache, the block
 // cache, or from the server. An error is returned if the retrieved
@@ -640,7 +897,8 @@ func (fbo *folderBlockOps) getFileBlockLocked(ctx context.Context,
 	fblock *FileBlock, wasDirty bool, err error) {
 	switch rtype {
 	case blockRead:
-		fbo.blockLock.AssertRLocked(lState)
+		// Reading under the write lock is fine too.
+		fbo.blockLock.AssertAnyLocked(lState)
 	case blockWrite:
 		fbo.blockLock.AssertLocked(lState)
 	case blockReadParallel:
@@ -712,6 +970,85 @@ func (fbo *folderBlockOps) GetIndirectFileBlockInfos(ctx context.Context,
 	return fbo.getIndirectFileBlockInfosLocked(ctx, lState, kmd, file)
 }
 
+// GetFileBlockLayout returns the layout of the block tree of `file`,
+// including any blocks that are still dirty.  It only fetches the
+// indirect blocks of the file.
+func (fbo *folderBlockOps) GetFileBlockLayout(ctx context.Context,
+	lState *lockState, kmd KeyMetadataWithRootDirEntry, file path) (
+	FileBlockLayout, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+
+	de, err := fbo.getEntryLocked(ctx, lState, kmd, file, true)
+	if err != nil {
+		return FileBlockLayout{}, err
+	}
+	if de.Type != File && de.Type != Exec {
+		return FileBlockLayout{}, NotFileError{file}
+	}
+	var id keybase1.UserOrTeamID // Data reads don't depend on the id.
+	fd := fbo.newFileData(lState, file, id, kmd)
+	dirtyBcache := fbo.config.DirtyBlockCache()
+	return fd.getLayout(ctx, de, func(ptr BlockPointer) bool {
+		return dirtyBcache.IsDirty(fbo.id(), ptr, file.Branch)
+	})
+}
+
+// GetAllocatedSize returns an estimate of the number of bytes of
+// `file` that aren't part of a hole (see
+// fileData.getAllocatedSize).  For anything but a file, it returns
+// the entry's size.
+func (fbo *folderBlockOps) GetAllocatedSize(ctx context.Context,
+	lState *lockState, kmd KeyMetadataWithRootDirEntry, file path) (
+	uint64, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+
+	de, err := fbo.getEntryLocked(ctx, lState, kmd, file, true)
+	if err != nil {
+		return 0, err
+	}
+	if de.Type != File && de.Type != Exec {
+		return de.Size, nil
+	}
+
+	// A clean file can't change without getting a new top block
+	// pointer, so its allocated size can be cached by that pointer.
+	// A dirty file's entry may still point to a direct block even
+	// after a truncate has made it indirect, so always check its
+	// top block.
+	dirty := fbo.config.DirtyBlockCache().IsDirty(
+		fbo.id(), file.tailPointer(), file.Branch)
+	if !dirty {
+		if de.BlockPointer.DirectType == DirectBlock {
+			// Only indirect files can have holes.
+			return de.Size, nil
+		}
+		if tmp, ok := fbo.allocatedSizes.Get(de.BlockPointer); ok {
+			return tmp.(uint64), nil
+		}
+	}
+
+	topBlock, err := fbo.getFileLocked(ctx, lState, kmd, file, blockRead)
+	if err != nil {
+		return 0, err
+	}
+	if !topBlock.IsInd {
+		return de.Size, nil
+	}
+
+	var id keybase1.UserOrTeamID // Data reads don't depend on the id.
+	fd := fbo.newFileData(lState, file, id, kmd)
+	allocated, err := fd.getAllocatedSize(ctx, topBlock, de.Size)
+	if err != nil {
+		return 0, err
+	}
+	if !dirty {
+		fbo.allocatedSizes.Add(de.BlockPointer, allocated)
+	}
+	return allocated, nil
+}
+
 // GetIndirectDirBlockInfos returns a list of BlockInfos for all
 // indirect blocks of the given directory. If the returned error is a
 // recoverable one (as determined by
@@ -791,6 +1128,24 @@ func (fbo *folderBlockOps) deepCopyFileLocked(
 	return fd.deepCopy(ctx, dataVer)
 }
 
+// DeepCopyCleanFile is like deepCopyFileLocked, but it takes the
+// block lock itself, and it refuses to copy a file with unsynced
+// writes, since the copy must only reference blocks that are
+// already on the server.
+func (fbo *folderBlockOps) DeepCopyCleanFile(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file path,
+	dirtyBcache DirtyBlockCache, dataVer DataVer) (
+	newTopPtr BlockPointer, allChildPtrs []BlockPointer, err error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+	if fbo.isDirtyLocked(lState, file) {
+		return BlockPointer{}, nil, errors.Errorf(
+			"%v has unsynced writes", file.tailPointer())
+	}
+	return fbo.deepCopyFileLocked(
+		ctx, lState, kmd, file, dirtyBcache, dataVer)
+}
+
 func (fbo *folderBlockOps) UndupChildrenInCopy(ctx context.Context,
 	lState *lockState, kmd KeyMetadata, file path, bps *blockPutState,
 	dirtyBcache DirtyBlockCache, topBlock *FileBlock) ([]BlockInfo, error) {
@@ -868,9 +1223,20 @@ func (fbo *folderBlockOps) getDirLocked(ctx context.Context,
 	// Get the block for the last element in the path.
 	dblock, err := fbo.getDirBlockHelperLocked(
 		ctx, lState, kmd, ptr, dir.Branch, dir, rtype)
-	if err != nil {
+	if isSubtreeDamageError(err) {
+		if fbo.damaged.record(dir, ptr, err, fbo.config.Clock().Now()) {
+			fbo.log.CWarningf(ctx, "Directory %s is damaged: %+v", dir, err)
+		}
+		if len(dir.path) == 1 {
+			// There's nothing left to serve if the root is damaged.
+			return nil, false, err
+		}
+		return nil, false, errors.WithStack(
+			DamagedSubtreeError{dir.String(), err})
+	} else if err != nil {
 		return nil, false, err
 	}
+	fbo.damaged.clear(dir)
 
 	wasDirty := fbo.config.DirtyBlockCache().IsDirty(fbo.id(), ptr, dir.Branch)
 	if rtype == blockWrite && !wasDirty {
@@ -922,7 +1288,7 @@ func (fbo *folderBlockOps) newDirDataLocked(lState *lockState,
 	dir path, chargedTo keybase1.UserOrTeamID, kmd KeyMetadata) *dirData {
 	fbo.blockLock.AssertAnyLocked(lState)
 	return newDirData(dir, chargedTo, fbo.config.Crypto(),
-		fbo.config.BlockSplitter(), kmd,
+		fbo.config.TlfBlockSplitter(fbo.id()), kmd,
 		func(ctx context.Context, kmd KeyMetadata, ptr BlockPointer,
 			dir path, rtype blockReqType) (*DirBlock, bool, error) {
 			lState := lState
@@ -947,7 +1313,7 @@ func (fbo *folderBlockOps) newDirDataWithLBCLocked(lState *lockState,
 	lbc localBcache) *dirData {
 	fbo.blockLock.AssertRLocked(lState)
 	return newDirData(dir, chargedTo, fbo.config.Crypto(),
-		fbo.config.BlockSplitter(), kmd,
+		fbo.config.TlfBlockSplitter(fbo.id()), kmd,
 		func(ctx context.Context, kmd KeyMetadata, ptr BlockPointer,
 			dir path, rtype blockReqType) (*DirBlock, bool, error) {
 			block, ok := lbc[ptr]
@@ -1093,21 +1459,71 @@ func (fbo *folderBlockOps) addDirEntryInCacheLocked(
 	}
 
 	undoDirtyFn := fbo.makeDirDirtyLocked(lState, dir.tailPointer(), unrefs)
+	fbo.addToDirEntryCountLocked(lState, dir.tailPointer(), 1)
 	return func() {
 		_, _ = dd.removeEntry(ctx, newName)
 		undoDirtyFn()
 		parentUndo()
+		fbo.addToDirEntryCountLocked(lState, dir.tailPointer(), -1)
 	}, nil
 }
 
+// addToDirEntryCountLocked adds `delta` to the cached number of
+// entries of the directory at `ptr`, if it has one.
+func (fbo *folderBlockOps) addToDirEntryCountLocked(
+	lState *lockState, ptr BlockPointer, delta int) {
+	fbo.blockLock.AssertLocked(lState)
+	if numEntries, ok := fbo.dirEntryCounts[ptr]; ok {
+		fbo.dirEntryCounts[ptr] = numEntries + delta
+	}
+}
+
+// checkDirEntriesLocked returns a DirTooManyEntriesError if `dir`
+// has no room for another entry.
+func (fbo *folderBlockOps) checkDirEntriesLocked(
+	ctx context.Context, lState *lockState, kmd KeyMetadataWithRootDirEntry,
+	dir path) error {
+	fbo.blockLock.AssertLocked(lState)
+	maxEntries := fbo.config.MaxDirEntries(fbo.id())
+	if maxEntries <= 0 {
+		return nil
+	}
+
+	ptr := dir.tailPointer()
+	numEntries, ok := fbo.dirEntryCounts[ptr]
+	if !ok {
+		chargedTo, err := fbo.getChargedToLocked(ctx, lState, kmd)
+		if err != nil {
+			return err
+		}
+		dd := fbo.newDirDataLocked(lState, dir, chargedTo, kmd)
+		children, err := dd.getChildren(ctx)
+		if err != nil {
+			return err
+		}
+		numEntries = len(children)
+		fbo.dirEntryCounts[ptr] = numEntries
+	}
+	if numEntries >= maxEntries {
+		return DirTooManyEntriesError{dir, numEntries, maxEntries}
+	}
+	return nil
+}
+
 // AddDirEntryInCache adds a brand new entry to the given directory
 // and updates the directory's own mtime and ctime.  It returns a
-// function that can be called if the change needs to be undone.
+// function that can be called if the change needs to be undone.  It
+// fails with a DirTooManyEntriesError if the directory is already
+// full.
 func (fbo *folderBlockOps) AddDirEntryInCache(
 	ctx context.Context, lState *lockState, kmd KeyMetadataWithRootDirEntry,
 	dir path, newName string, newDe DirEntry) (dirCacheUndoFn, error) {
 	fbo.blockLock.Lock(lState)
 	defer fbo.blockLock.Unlock(lState)
+	err := fbo.checkDirEntriesLocked(ctx, lState, kmd, dir)
+	if err != nil {
+		return nil, err
+	}
 	fn, err := fbo.addDirEntryInCacheLocked(
 		ctx, lState, kmd, dir, newName, newDe)
 	if err != nil {
@@ -1150,11 +1566,13 @@ func (fbo *folderBlockOps) removeDirEntryInCacheLocked(
 	}
 
 	undoDirtyFn := fbo.makeDirDirtyLocked(lState, dir.tailPointer(), unrefs)
+	fbo.addToDirEntryCountLocked(lState, dir.tailPointer(), -1)
 	return func() {
 		_, _ = dd.addEntry(ctx, oldName, oldDe)
 		undoDirtyFn()
 		parentUndo()
 		unlinkUndoFn()
+		fbo.addToDirEntryCountLocked(lState, dir.tailPointer(), 1)
 	}, nil
 }
 
@@ -1195,6 +1613,14 @@ func (fbo *folderBlockOps) RenameDirEntryInCache(
 		return nil, nil
 	}
 
+	if newParent.tailPointer() != oldParent.tailPointer() &&
+		!replacedDe.IsInitialized() {
+		err = fbo.checkDirEntriesLocked(ctx, lState, kmd, newParent)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	var undoReplace func()
 	if replacedDe.IsInitialized() {
 		undoReplace, err = fbo.removeDirEntryInCacheLocked(
@@ -1330,6 +1756,122 @@ func (fbo *folderBlockOps) SetAttrInDirEntryInCache(
 		ctx, lState, kmd, *p.parentPath(), p.tailName(), attr, newDe)
 }
 
+// SetExInSubtree walks the subtree rooted at `dir` and sets the
+// executable bit on (or clears it from) the cached entries of up to
+// `maxEntries` files whose type doesn't already match `ex`.  It
+// returns a setattr op for each changed file, the corresponding file
+// nodes, and a function that undoes all of the cache changes.  The
+// caller is responsible for putting the returned ops into an MD
+// revision.  If fewer than `maxEntries` ops are returned, the entire
+// subtree has been processed.
+func (fbo *folderBlockOps) SetExInSubtree(
+	ctx context.Context, lState *lockState, kmd KeyMetadataWithRootDirEntry,
+	dir Node, ex bool, maxEntries int) (
+	ops []*setAttrOp, nodes []Node, undoFn dirCacheUndoFn, err error) {
+	var undoFns []dirCacheUndoFn
+	undoFn = func(lState *lockState) {
+		for i := len(undoFns) - 1; i >= 0; i-- {
+			undoFns[i](lState)
+		}
+	}
+
+	fbo.blockLock.Lock(lState)
+	ops, nodes, undoFns, err = fbo.setExInSubtreeLocked(
+		ctx, lState, kmd, dir, ex, maxEntries)
+	fbo.blockLock.Unlock(lState)
+	if err != nil {
+		// The undo functions take the block lock themselves.
+		undoFn(lState)
+		return nil, nil, nil, err
+	}
+	return ops, nodes, undoFn, nil
+}
+
+func (fbo *folderBlockOps) setExInSubtreeLocked(
+	ctx context.Context, lState *lockState, kmd KeyMetadataWithRootDirEntry,
+	dir Node, ex bool, maxEntries int) (
+	ops []*setAttrOp, nodes []Node, undoFns []dirCacheUndoFn, err error) {
+	fbo.blockLock.AssertLocked(lState)
+
+	now := fbo.nowUnixNano()
+	toVisit := []Node{dir}
+	for len(toVisit) > 0 && len(ops) < maxEntries {
+		dirNode := toVisit[0]
+		toVisit = toVisit[1:]
+
+		dirPath := fbo.nodeCache.PathFromNode(dirNode)
+		if !dirPath.isValid() {
+			return ops, nodes, undoFns,
+				errors.WithStack(InvalidPathError{dirPath})
+		}
+		dd := fbo.newDirDataLocked(
+			lState, dirPath, keybase1.UserOrTeamID(""), kmd)
+		entries, err := dd.getEntries(ctx)
+		if err != nil {
+			return ops, nodes, undoFns, err
+		}
+
+		// Process the names in a stable order, so that repeated
+		// calls make forward progress through the same tree.
+		names := make([]string, 0, len(entries))
+		for name := range entries {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			de := entries[name]
+			switch {
+			case de.Type == Dir:
+				child, err := fbo.nodeCache.GetOrCreate(
+					de.BlockPointer, name, dirNode)
+				if err != nil {
+					return ops, nodes, undoFns, err
+				}
+				toVisit = append(toVisit, child)
+				continue
+			case ex && de.Type == File:
+				de.Type = Exec
+			case !ex && de.Type == Exec:
+				de.Type = File
+			default:
+				continue
+			}
+
+			if len(ops) >= maxEntries {
+				// Leave the rest for the next batch.
+				break
+			}
+
+			fileNode, err := fbo.nodeCache.GetOrCreate(
+				de.BlockPointer, name, dirNode)
+			if err != nil {
+				return ops, nodes, undoFns, err
+			}
+			de.Ctime = now
+
+			sao, err := newSetAttrOp(
+				name, dirPath.tailPointer(), exAttr, de.BlockPointer)
+			if err != nil {
+				return ops, nodes, undoFns, err
+			}
+			sao.AddSelfUpdate(dirPath.tailPointer())
+			sao.setFinalPath(dirPath.ChildPath(name, de.BlockPointer))
+
+			undo, err := fbo.setCachedAttrLocked(
+				ctx, lState, kmd, dirPath, name, exAttr, de)
+			if err != nil {
+				return ops, nodes, undoFns, err
+			}
+			undoFns = append(undoFns, undo)
+			ops = append(ops, sao)
+			nodes = append(nodes, fileNode)
+		}
+	}
+
+	return ops, nodes, undoFns, nil
+}
+
 // getDirtyDirLocked composes getDirLocked and
 // updateWithDirtyEntriesLocked. Note that a dirty dir means that it
 // has entries possibly pointing to dirty files, and/or that its
@@ -1379,6 +1921,103 @@ func (fbo *folderBlockOps) GetEntries(
 	return dd.getEntries(ctx)
 }
 
+// walkDirItem is a directory still to be read by WalkDir.
+type walkDirItem struct {
+	dir     path
+	relPath string
+}
+
+// walkOneDir calls `walkFn` for each entry of the given directory, in
+// name order, and returns the subdirectories that should be walked
+// next.
+func (fbo *folderBlockOps) walkOneDir(
+	ctx context.Context, kmd KeyMetadata, item walkDirItem,
+	walkFn WalkTLFFunc) ([]walkDirItem, error) {
+	entries, err := fbo.GetEntries(ctx, makeFBOLockState(), kmd, item.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var subdirs []walkDirItem
+	for _, name := range names {
+		de := entries[name]
+		relPath := name
+		if item.relPath != "" {
+			relPath = item.relPath + "/" + name
+		}
+		err := walkFn(relPath, de)
+		if err == filepath.SkipDir {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if de.Type == Dir {
+			subdirs = append(subdirs, walkDirItem{
+				dir:     item.dir.ChildPath(name, de.BlockPointer),
+				relPath: relPath,
+			})
+		}
+	}
+	return subdirs, nil
+}
+
+// WalkDir calls `walkFn` for every entry in the subtree under `dir`,
+// reading at most numWalkDirWorkersMax directories (and running
+// their callbacks) at once.  Each directory is read under its own
+// hold of blockLock, so writers aren't blocked for the whole walk.
+// Damaged subdirectories are skipped, and the first one found is
+// returned as a DamagedSubtreeError once the rest has been walked.
+func (fbo *folderBlockOps) WalkDir(ctx context.Context, kmd KeyMetadata,
+	dir path, walkFn WalkTLFFunc) error {
+	eg, groupCtx := errgroup.WithContext(ctx)
+	workerSlots := make(chan struct{}, numWalkDirWorkersMax)
+	var damagedLock sync.Mutex
+	var damagedErr error
+
+	var walk func(item walkDirItem) error
+	walk = func(item walkDirItem) error {
+		select {
+		case workerSlots <- struct{}{}:
+		case <-groupCtx.Done():
+			return groupCtx.Err()
+		}
+		subdirs, err := fbo.walkOneDir(groupCtx, kmd, item, walkFn)
+		<-workerSlots
+		if _, ok := errors.Cause(err).(DamagedSubtreeError); ok &&
+			item.relPath != "" {
+			// Keep walking the rest of the TLF, and report the
+			// damage once the walk is done.
+			damagedLock.Lock()
+			defer damagedLock.Unlock()
+			if damagedErr == nil {
+				damagedErr = err
+			}
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		for _, subdir := range subdirs {
+			subdir := subdir
+			eg.Go(func() error { return walk(subdir) })
+		}
+		return nil
+	}
+
+	eg.Go(func() error { return walk(walkDirItem{dir: dir}) })
+	err := eg.Wait()
+	if err != nil {
+		return err
+	}
+	return damagedErr
+}
+
 func (fbo *folderBlockOps) getEntryLocked(ctx context.Context,
 	lState *lockState, kmd KeyMetadataWithRootDirEntry, file path,
 	includeDeleted bool) (de DirEntry, err error) {
@@ -1490,6 +2129,35 @@ func (fbo *folderBlockOps) Lookup(
 	return node, de, nil
 }
 
+// LookupEntries returns the directory entries for the given names
+// in `dir`, all read under a single hold of blockLock.  Names that
+// don't exist are left out of the returned map.
+func (fbo *folderBlockOps) LookupEntries(
+	ctx context.Context, lState *lockState, kmd KeyMetadataWithRootDirEntry,
+	dir Node, names []string) (map[string]DirEntry, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+
+	dirPath := fbo.nodeCache.PathFromNode(dir)
+	if !dirPath.isValid() {
+		return nil, errors.WithStack(InvalidPathError{dirPath})
+	}
+
+	dd := fbo.newDirDataLocked(
+		lState, dirPath, keybase1.UserOrTeamID(""), kmd)
+	entries := make(map[string]DirEntry, len(names))
+	for _, name := range names {
+		de, err := dd.lookup(ctx, name)
+		if _, noExist := errors.Cause(err).(NoSuchNameError); noExist {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		entries[name] = de
+	}
+	return entries, nil
+}
+
 func (fbo *folderBlockOps) getOrCreateDirtyFileLocked(lState *lockState,
 	file path) *dirtyFile {
 	fbo.blockLock.AssertLocked(lState)
@@ -1511,6 +2179,10 @@ func (fbo *folderBlockOps) cacheBlockIfNotYetDirtyLocked(
 	fbo.blockLock.AssertLocked(lState)
 	df := fbo.getOrCreateDirtyFileLocked(lState, file)
 	needsCaching, isSyncing := df.setBlockDirty(ptr)
+	if erb := df.takeEarlyReadied(ptr); erb != nil {
+		// The early put no longer matches the block contents.
+		fbo.discardEarlyReadied(erb)
+	}
 
 	if needsCaching {
 		err := fbo.config.DirtyBlockCache().Put(fbo.id(), ptr, file.Branch,
@@ -1537,8 +2209,9 @@ func (fbo *folderBlockOps) getOrCreateSyncInfoLocked(
 			return nil, err
 		}
 		si = &syncInfo{
-			oldInfo: de.BlockInfo,
-			op:      so,
+			oldInfo:    de.BlockInfo,
+			op:         so,
+			dirtySince: fbo.config.Clock().Now(),
 		}
 		fbo.unrefCache[ref] = si
 	}
@@ -1557,21 +2230,56 @@ func (fbo *folderBlockOps) GetDirtyFileBlockRefs(lState *lockState) []BlockRef {
 	return dirtyRefs
 }
 
-// GetDirtyDirBlockRefs returns a list of references of all known dirty
-// directories.
-func (fbo *folderBlockOps) GetDirtyDirBlockRefs(lState *lockState) []BlockRef {
+// GetDirtySyncOp returns a copy of the sync op holding the writes
+// made to the dirty file with the given reference since it was last
+// synced, or nil if the file isn't dirty.
+func (fbo *folderBlockOps) GetDirtySyncOp(
+	lState *lockState, ref BlockRef) (*syncOp, error) {
 	fbo.blockLock.RLock(lState)
 	defer fbo.blockLock.RUnlock(lState)
-	var dirtyRefs []BlockRef
-	for ptr := range fbo.dirtyDirs {
-		dirtyRefs = append(dirtyRefs, ptr.Ref())
+	si, ok := fbo.unrefCache[ref]
+	if !ok || si.op == nil {
+		return nil, nil
 	}
-	return dirtyRefs
+	var syncOpCopy *syncOp
+	err := kbfscodec.Update(fbo.config.Codec(), &syncOpCopy, si.op)
+	if err != nil {
+		return nil, err
+	}
+	return syncOpCopy, nil
 }
 
-// getDirtyDirUnrefsLocked returns a list of block infos that need to be
-// unreferenced for the given directory.
-func (fbo *folderBlockOps) getDirtyDirUnrefsLocked(
+// GetOldestDirtyFileTime returns when the file that has been dirty
+// the longest first became dirty, or the zero time if there are no
+// dirty files.
+func (fbo *folderBlockOps) GetOldestDirtyFileTime(
+	lState *lockState) time.Time {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+	var oldest time.Time
+	for _, si := range fbo.unrefCache {
+		if oldest.IsZero() || si.dirtySince.Before(oldest) {
+			oldest = si.dirtySince
+		}
+	}
+	return oldest
+}
+
+// GetDirtyDirBlockRefs returns a list of references of all known dirty
+// directories.
+func (fbo *folderBlockOps) GetDirtyDirBlockRefs(lState *lockState) []BlockRef {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+	var dirtyRefs []BlockRef
+	for ptr := range fbo.dirtyDirs {
+		dirtyRefs = append(dirtyRefs, ptr.Ref())
+	}
+	return dirtyRefs
+}
+
+// getDirtyDirUnrefsLocked returns a list of block infos that need to be
+// unreferenced for the given directory.
+func (fbo *folderBlockOps) getDirtyDirUnrefsLocked(
 	lState *lockState, ptr BlockPointer) []BlockInfo {
 	fbo.blockLock.AssertRLocked(lState)
 	return fbo.dirtyDirs[ptr]
@@ -1622,7 +2330,12 @@ func (fbo *folderBlockOps) fixChildBlocksAfterRecoverableErrorLocked(
 		fbo.log.CWarningf(ctx, "Couldn't find uid during recovery: %v", err)
 		return
 	}
-	fd := fbo.newFileData(lState, file, chargedTo, kmd)
+	var blockSize int64
+	if df != nil {
+		blockSize = df.getBlockSize()
+	}
+	fd := fbo.newFileDataWithBlockSizeLocked(
+		ctx, lState, file, chargedTo, kmd, blockSize)
 
 	// If a copy of the top indirect block was made, we need to
 	// redirty all the sync'd blocks under their new IDs, so that
@@ -1654,6 +2367,8 @@ func (fbo *folderBlockOps) fixChildBlocksAfterRecoverableErrorLocked(
 		if err = fbo.cacheBlockIfNotYetDirtyLocked(
 			lState, newPtr, file, b); err != nil {
 			fbo.log.CWarningf(ctx, "Couldn't re-dirty %v: %v", newPtr, err)
+		} else {
+			fbo.redirtiesCounter.Inc(1)
 		}
 		fbo.log.CDebugf(ctx, "Deleting dirty ptr %v after recoverable error",
 			oldPtr)
@@ -1715,7 +2430,7 @@ func (fbo *folderBlockOps) newFileData(lState *lockState,
 	file path, chargedTo keybase1.UserOrTeamID, kmd KeyMetadata) *fileData {
 	fbo.blockLock.AssertAnyLocked(lState)
 	return newFileData(file, chargedTo, fbo.config.Crypto(),
-		fbo.config.BlockSplitter(), kmd,
+		fbo.config.TlfBlockSplitter(fbo.id()), kmd,
 		func(ctx context.Context, kmd KeyMetadata, ptr BlockPointer,
 			file path, rtype blockReqType) (*FileBlock, bool, error) {
 			lState := lState
@@ -1731,12 +2446,68 @@ func (fbo *folderBlockOps) newFileData(lState *lockState,
 		}, fbo.log)
 }
 
+// fileBlockSplitterLocked returns the block splitter to use for a
+// file whose directory entry records `blockSize`.
+func (fbo *folderBlockOps) fileBlockSplitterLocked(
+	ctx context.Context, lState *lockState, blockSize int64) BlockSplitter {
+	fbo.blockLock.AssertLocked(lState)
+	if blockSize == 0 {
+		return fbo.config.TlfBlockSplitter(fbo.id())
+	}
+	if bsplit, ok := fbo.sizedSplitters[blockSize]; ok {
+		return bsplit
+	}
+	bsplit, err := newSizedBlockSplitter(fbo.config, blockSize)
+	if err != nil {
+		// The size may have been recorded by a client that allows
+		// other sizes; just use the TLF's block size for new blocks.
+		fbo.log.CDebugf(ctx, "Ignoring block size %d: %+v", blockSize, err)
+		return fbo.config.TlfBlockSplitter(fbo.id())
+	}
+	if fbo.sizedSplitters == nil {
+		fbo.sizedSplitters = make(map[int64]BlockSplitter)
+	}
+	fbo.sizedSplitters[blockSize] = bsplit
+	return bsplit
+}
+
+// newFileDataWithBlockSizeLocked is like `newFileData`, but splits
+// blocks for a file whose directory entry records `blockSize`.  It
+// must be used whenever the file's blocks might be split.
+func (fbo *folderBlockOps) newFileDataWithBlockSizeLocked(
+	ctx context.Context, lState *lockState, file path,
+	chargedTo keybase1.UserOrTeamID, kmd KeyMetadata,
+	blockSize int64) *fileData {
+	fd := fbo.newFileData(lState, file, chargedTo, kmd)
+	fd.tree.bsplit = fbo.fileBlockSplitterLocked(ctx, lState, blockSize)
+	return fd
+}
+
+// maybeChooseBlockSize records an adaptive block size in `de`, if
+// the TLF uses them and the file doesn't have a block size yet, for
+// a write or truncate that grows the file to `newSize` bytes.
+func (fbo *folderBlockOps) maybeChooseBlockSize(
+	ctx context.Context, de *DirEntry, newSize uint64, isAppend bool) {
+	if de.BlockSize != 0 || !fbo.config.AdaptiveBlockSizes(fbo.id()) {
+		return
+	}
+	// A block size chosen for the whole TLF takes precedence.
+	if fbo.config.TlfBlockSplitter(fbo.id()) != fbo.config.BlockSplitter() {
+		return
+	}
+	de.BlockSize = adaptiveBlockSize(de.Size, newSize, isAppend)
+	if de.BlockSize != 0 {
+		fbo.log.CDebugf(ctx, "Chose a block size of %d for %v",
+			de.BlockSize, de.BlockPointer)
+	}
+}
+
 func (fbo *folderBlockOps) newFileDataWithCache(lState *lockState,
 	file path, chargedTo keybase1.UserOrTeamID, kmd KeyMetadata,
 	dirtyBcache DirtyBlockCache) *fileData {
 	fbo.blockLock.AssertAnyLocked(lState)
 	return newFileData(file, chargedTo, fbo.config.Crypto(),
-		fbo.config.BlockSplitter(), kmd,
+		fbo.config.TlfBlockSplitter(fbo.id()), kmd,
 		func(ctx context.Context, kmd KeyMetadata, ptr BlockPointer,
 			file path, rtype blockReqType) (*FileBlock, bool, error) {
 			block, err := dirtyBcache.Get(file.Tlf, ptr, file.Branch)
@@ -1773,6 +2544,590 @@ func (fbo *folderBlockOps) Read(
 	return fd.read(ctx, dest, Int64Offset(off))
 }
 
+// ReadAll returns the whole contents of the given file, or an error
+// if it's larger than `maxLen` bytes.
+func (fbo *folderBlockOps) ReadAll(
+	ctx context.Context, lState *lockState, kmd KeyMetadataWithRootDirEntry,
+	file path, maxLen int64) ([]byte, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+
+	de, err := fbo.getEntryLocked(ctx, lState, kmd, file, false)
+	if err != nil {
+		return nil, err
+	}
+	if int64(de.Size) > maxLen {
+		return nil, errors.Errorf("%v is %d bytes, more than the %d allowed",
+			file, de.Size, maxLen)
+	}
+
+	var id keybase1.UserOrTeamID // Data reads don't depend on the id.
+	fd := fbo.newFileData(lState, file, id, kmd)
+	buf := make([]byte, de.Size)
+	n, err := fd.read(ctx, buf, 0)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// newParallelFileDataLocked returns a fileData for reading `file`
+// from goroutines other than the one holding `blockLock`, which must
+// stay held, for reading or writing, for as long as it's used.
+func (fbo *folderBlockOps) newParallelFileDataLocked(lState *lockState,
+	file path, kmd KeyMetadata) *fileData {
+	fbo.blockLock.AssertAnyLocked(lState)
+	var id keybase1.UserOrTeamID // Data reads don't depend on the id.
+	return newFileData(file, id, fbo.config.Crypto(),
+		fbo.config.TlfBlockSplitter(fbo.id()), kmd,
+		func(ctx context.Context, kmd KeyMetadata, ptr BlockPointer,
+			file path, _ blockReqType) (*FileBlock, bool, error) {
+			return fbo.getFileBlockLocked(
+				ctx, nil, kmd, ptr, file, blockReadParallel)
+		},
+		func(ptr BlockPointer, block Block) error {
+			return errors.Errorf("Can't cache block %v from a parallel read",
+				ptr)
+		}, fbo.log)
+}
+
+// forEachIOVecLocked calls `fn` on each of `vecs`, at most
+// numIOVecWorkersMax at a time, with a fileData for `file` that may
+// be used from any goroutine.  The caller must hold `blockLock` for
+// the whole call.
+func (fbo *folderBlockOps) forEachIOVecLocked(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file path,
+	vecs []IOVec,
+	fn func(ctx context.Context, fd *fileData, i int, vec IOVec) error) error {
+	fd := fbo.newParallelFileDataLocked(lState, file, kmd)
+	eg, groupCtx := errgroup.WithContext(ctx)
+	workerSlots := make(chan struct{}, numIOVecWorkersMax)
+	for i, vec := range vecs {
+		i, vec := i, vec
+		eg.Go(func() error {
+			select {
+			case workerSlots <- struct{}{}:
+			case <-groupCtx.Done():
+				return groupCtx.Err()
+			}
+			defer func() { <-workerSlots }()
+			return fn(groupCtx, fd, i, vec)
+		})
+	}
+	return eg.Wait()
+}
+
+// ReadVec reads from the given file into each of the given buffers,
+// starting at the offset given with it, as if by one Read call per
+// buffer.  All the buffers are read from the same version of the
+// file, under a single hold of `blockLock`, and their blocks are
+// fetched in parallel.  It returns the number of bytes read into each
+// buffer.
+func (fbo *folderBlockOps) ReadVec(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file Node,
+	vecs []IOVec) ([]int64, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+
+	filePath := fbo.nodeCache.PathFromNode(file)
+
+	fbo.log.CDebugf(ctx, "Reading %d vectors from %v",
+		len(vecs), filePath.tailPointer())
+
+	ns := make([]int64, len(vecs))
+	err := fbo.forEachIOVecLocked(ctx, lState, kmd, filePath, vecs,
+		func(ctx context.Context, fd *fileData, i int, vec IOVec) error {
+			n, err := fd.read(ctx, vec.Buf, Int64Offset(vec.Off))
+			ns[i] = n
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+	return ns, nil
+}
+
+// ReadLeafForCopy returns the data of the given file from `off` to
+// the end of the leaf block that holds it, but no more than `maxLen`
+// bytes, or nil at the end of the file.  It's used by CopyFileRange
+// for the parts of a copy that can't be spliced in with
+// NewLeafRefsForCopy and SpliceLeavesForCopy.
+func (fbo *folderBlockOps) ReadLeafForCopy(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file Node,
+	off, maxLen int64) ([]byte, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+
+	filePath := fbo.nodeCache.PathFromNode(file)
+
+	var id keybase1.UserOrTeamID // Data reads don't depend on the id.
+	fd := fbo.newFileData(lState, filePath, id, kmd)
+	_, block, blockOff, err := fd.getLeafForOffset(ctx, Int64Offset(off))
+	if err != nil {
+		return nil, err
+	}
+
+	start := off - int64(blockOff)
+	if start >= int64(len(block.Contents)) {
+		// `off` is in a hole, or past the end of the file, so let a
+		// regular read fill in the zeroes.
+		n := maxLen
+		if n > MaxBlockSizeBytesDefault {
+			n = MaxBlockSizeBytesDefault
+		}
+		buf := make([]byte, n)
+		nRead, err := fd.read(ctx, buf, Int64Offset(off))
+		if err != nil {
+			return nil, err
+		}
+		if nRead == 0 {
+			return nil, nil
+		}
+		return buf[:nRead], nil
+	}
+
+	end := int64(len(block.Contents))
+	if end-start > maxLen {
+		end = start + maxLen
+	}
+	return append([]byte(nil), block.Contents[start:end]...), nil
+}
+
+// NewLeafRefsForCopy returns new references to the run of leaf
+// blocks of the given file that starts right at `off`, and that lie
+// entirely within `[off, off+maxLen)`, along with the offset where
+// the run ends.  As in deepCopyFileLocked, each returned pointer is
+// the leaf's pointer with a new ref nonce, so the leaf can be shared
+// by another file without being fetched.  The references aren't
+// added to the server yet.  Nothing is returned unless the file is
+// indirect and fully synced, since dirty leaves aren't on the server.
+func (fbo *folderBlockOps) NewLeafRefsForCopy(
+	ctx context.Context, lState *lockState, kmd KeyMetadataWithRootDirEntry,
+	file Node, off, maxLen int64) (
+	refs []IndirectFilePtr, end int64, err error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+
+	filePath := fbo.nodeCache.PathFromNode(file)
+	if fbo.config.DirtyBlockCache().IsDirty(
+		fbo.id(), filePath.tailPointer(), filePath.Branch) {
+		return nil, off, nil
+	}
+
+	topBlock, err := fbo.getFileLocked(
+		ctx, lState, kmd, filePath, blockRead)
+	if err != nil {
+		return nil, off, err
+	}
+	if !topBlock.IsInd {
+		return nil, off, nil
+	}
+
+	de, err := fbo.getEntryLocked(ctx, lState, kmd, filePath, false)
+	if err != nil {
+		return nil, off, err
+	}
+	endOff := off + maxLen
+	if endOff > int64(de.Size) {
+		endOff = int64(de.Size)
+	}
+	if off >= endOff {
+		return nil, off, nil
+	}
+
+	chargedTo, err := fbo.getChargedToLocked(ctx, lState, kmd)
+	if err != nil {
+		return nil, off, err
+	}
+	fd := fbo.newFileData(lState, filePath, chargedTo, kmd)
+	pfr, _, nextOff, err := fd.tree.getBlocksForOffsetRange(
+		ctx, filePath.tailPointer(), topBlock, Int64Offset(off),
+		Int64Offset(endOff), false, false)
+	if err != nil {
+		return nil, off, err
+	}
+
+	end = off
+	for i, p := range pfr {
+		if len(p) == 0 {
+			break
+		}
+		iptr := childFileIptr(p[len(p)-1])
+		if int64(iptr.Off) != end || iptr.EncodedSize == 0 {
+			break
+		}
+		leafEnd := int64(de.Size)
+		if i+1 < len(pfr) {
+			next := pfr[i+1]
+			leafEnd = int64(childFileIptr(next[len(next)-1]).Off)
+		} else if nextOff != nil {
+			leafEnd = int64(nextOff.(Int64Offset))
+		}
+		if leafEnd > endOff {
+			break
+		}
+
+		iptr.RefNonce, err = fbo.config.Crypto().MakeBlockRefNonce()
+		if err != nil {
+			return nil, off, err
+		}
+		iptr.SetWriter(chargedTo)
+		refs = append(refs, iptr)
+		end = leafEnd
+	}
+	return refs, end, nil
+}
+
+// SpliceLeavesForCopy appends the given leaf blocks, which must
+// already be referenced on the server, to the end of the given file,
+// whose size becomes `end` if all of them are spliced in.  The
+// offsets in `leaves` are relative to the file.  Only a direct file,
+// or one with a single level of indirect blocks, can take new
+// leaves, and only as many as its top block has room for.  It
+// returns how many leaves were spliced, which is 0 if the file
+// doesn't end at the first leaf's offset or is being synced.  The
+// new references are made part of the file's next sync.
+func (fbo *folderBlockOps) SpliceLeavesForCopy(
+	ctx context.Context, lState *lockState, kmd KeyMetadataWithRootDirEntry,
+	file Node, leaves []IndirectFilePtr, end int64) (
+	spliced int, err error) {
+	if len(leaves) == 0 {
+		return 0, nil
+	}
+	err = fbo.checkFileSize(file, uint64(end))
+	if err != nil {
+		return 0, err
+	}
+
+	if jServer, err := GetJournalServer(fbo.config); err == nil {
+		jServer.dirtyOpStart(fbo.id())
+		defer jServer.dirtyOpEnd(fbo.id())
+	}
+
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+
+	filePath, err := fbo.pathFromNodeForBlockWriteLocked(lState, file)
+	if err != nil {
+		return 0, err
+	}
+	de, err := fbo.getEntryLocked(ctx, lState, kmd, filePath, true)
+	if err != nil {
+		return 0, err
+	}
+	off := int64(leaves[0].Off)
+	if int64(de.Size) != off {
+		return 0, nil
+	}
+	df := fbo.getOrCreateDirtyFileLocked(lState, filePath)
+	if df.isBlockSyncing(filePath.tailPointer()) {
+		return 0, nil
+	}
+
+	si, err := fbo.getOrCreateSyncInfoLocked(lState, de)
+	if err != nil {
+		return 0, err
+	}
+	wasDirty := fbo.config.DirtyBlockCache().IsDirty(
+		fbo.id(), filePath.tailPointer(), filePath.Branch)
+	fblock, err := fbo.writeGetFileLocked(ctx, lState, kmd, filePath)
+	if err != nil {
+		return 0, err
+	}
+	chargedTo, err := fbo.getChargedToLocked(ctx, lState, kmd)
+	if err != nil {
+		return 0, err
+	}
+	fd := fbo.newFileDataWithBlockSizeLocked(
+		ctx, lState, filePath, chargedTo, kmd, de.BlockSize)
+	numPtrs := 0
+	switch {
+	case !fblock.IsInd && len(fblock.Contents) == 0:
+		// An empty file becomes an indirect one made up of only
+		// the new leaves.
+	case !fblock.IsInd:
+		// The existing data will become the first leaf.
+		numPtrs = 1
+	case fblock.IPtrs[0].DirectType != DirectBlock:
+		return 0, nil
+	default:
+		numPtrs = len(fblock.IPtrs)
+	}
+	// Leave room in the top block for one more leaf, so that the
+	// next leaf written to the file is a dirty child of this block.
+	// Otherwise the write would add a new level of indirection above
+	// a block with no dirty children, which a sync wouldn't ready.
+	room := fd.tree.bsplit.MaxPtrsPerBlock() - numPtrs - 1
+	if room <= 0 {
+		return 0, nil
+	} else if len(leaves) > room {
+		end = int64(leaves[room].Off)
+		leaves = leaves[:room]
+	}
+
+	switch {
+	case !fblock.IsInd && len(fblock.Contents) == 0:
+		fblock.IsInd = true
+		fblock.Contents = nil
+	case !fblock.IsInd:
+		// Move the data down into a new dirty leaf, as `write`
+		// does when a direct file outgrows its block.
+		oldBlock := fblock
+		fblock, err = fd.createIndirectBlock(
+			ctx, df, DefaultNewBlockDataVersion(false))
+		if err != nil {
+			return 0, err
+		}
+		err = fbo.cacheBlockIfNotYetDirtyLocked(
+			lState, fblock.IPtrs[0].BlockPointer, filePath, oldBlock)
+		if err != nil {
+			return 0, err
+		}
+		if !wasDirty {
+			df.updateNotYetSyncingBytes(int64(len(oldBlock.Contents)))
+		}
+	}
+
+	fbo.log.CDebugf(ctx, "Splicing %d leaves into %v at off=%d",
+		len(leaves), filePath.tailPointer(), off)
+	fblock.IPtrs = append(fblock.IPtrs, leaves...)
+	err = fbo.cacheBlockIfNotYetDirtyLocked(
+		lState, filePath.tailPointer(), filePath, fblock)
+	if err != nil {
+		return len(leaves), err
+	}
+	infos := make([]BlockInfo, len(leaves))
+	for i, leaf := range leaves {
+		infos[i] = leaf.BlockInfo
+	}
+	df.addSplicedRefs(infos)
+
+	newDe := de
+	newDe.Size = uint64(end)
+	newDe.EncodedSize = 0
+	now := fbo.nowUnixNano()
+	newDe.Mtime = now
+	newDe.Ctime = now
+	err = fbo.updateEntryLocked(ctx, lState, kmd, filePath, newDe, true)
+	if err != nil {
+		return len(leaves), err
+	}
+
+	latestWrite := si.op.addWrite(uint64(off), uint64(end-off))
+	fbo.observers.localChange(ctx, file, latestWrite)
+	return len(leaves), nil
+}
+
+// FetchRange fetches the blocks of the given file that hold the
+// given byte range into the caches, and returns the block-aligned
+// range that was fetched.  A negative `length` means to the end of
+// the file.
+func (fbo *folderBlockOps) FetchRange(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file Node,
+	off, length int64) (FileRange, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+
+	filePath := fbo.nodeCache.PathFromNode(file)
+
+	fbo.log.CDebugf(ctx, "Fetching range from %v", filePath.tailPointer())
+
+	endOff := Int64Offset(-1)
+	if length >= 0 {
+		endOff = Int64Offset(off + length)
+	}
+	var id keybase1.UserOrTeamID // Data reads don't depend on the id.
+	fd := fbo.newFileData(lState, filePath, id, kmd)
+	return fd.fetchRange(ctx, Int64Offset(off), endOff)
+}
+
+// getLocalFileBlockLocked returns the given file block if it's
+// available without contacting the server: in the dirty block cache,
+// the clean block cache, the journal, or the disk block cache.  It
+// returns nil if the block isn't available locally.
+func (fbo *folderBlockOps) getLocalFileBlockLocked(
+	ctx context.Context, lState *lockState, kmd KeyMetadata,
+	ptr BlockPointer, branch BranchName) (*FileBlock, error) {
+	fbo.blockLock.AssertAnyLocked(lState)
+
+	block, err := fbo.config.DirtyBlockCache().Get(fbo.id(), ptr, branch)
+	if fblock, ok := block.(*FileBlock); ok && err == nil {
+		return fblock, nil
+	}
+	block, err = fbo.config.BlockCache().Get(ptr)
+	if fblock, ok := block.(*FileBlock); ok && err == nil {
+		return fblock, nil
+	}
+
+	var buf []byte
+	var serverHalf kbfscrypto.BlockCryptKeyServerHalf
+	if jbs, ok := fbo.config.BlockServer().(journalBlockServer); ok {
+		data, sh, found, err := jbs.getBlockFromJournal(fbo.id(), ptr.ID)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			buf, serverHalf = data, sh
+		}
+	}
+	if buf == nil {
+		dbc := fbo.config.DiskBlockCache()
+		if dbc == nil {
+			return nil, nil
+		}
+		data, sh, _, err := dbc.Get(ctx, fbo.id(), ptr.ID)
+		if err != nil {
+			// Any disk cache error just means the block isn't
+			// available locally.
+			return nil, nil
+		}
+		buf, serverHalf = data, sh
+	}
+
+	fblock := NewFileBlock().(*FileBlock)
+	err = assembleBlock(ctx, fbo.config.keyGetter(), fbo.config.Codec(),
+		fbo.config.cryptoPure(), kmd, ptr, fblock, buf, serverHalf)
+	if err != nil {
+		return nil, err
+	}
+	return fblock, nil
+}
+
+// isFileBlockLocalLocked is like getLocalFileBlockLocked, but it
+// doesn't decode the block, so it's cheaper for leaf blocks whose
+// contents aren't needed.
+func (fbo *folderBlockOps) isFileBlockLocalLocked(
+	ctx context.Context, lState *lockState, ptr BlockPointer,
+	branch BranchName) (bool, error) {
+	fbo.blockLock.AssertAnyLocked(lState)
+
+	if _, err := fbo.config.DirtyBlockCache().Get(
+		fbo.id(), ptr, branch); err == nil {
+		return true, nil
+	}
+	if _, err := fbo.config.BlockCache().Get(ptr); err == nil {
+		return true, nil
+	}
+	if jbs, ok := fbo.config.BlockServer().(journalBlockServer); ok {
+		_, found, err := jbs.getBlockSizeFromJournal(fbo.id(), ptr.ID)
+		if err != nil {
+			return false, err
+		}
+		if found {
+			return true, nil
+		}
+	}
+	if dbc := fbo.config.DiskBlockCache(); dbc != nil {
+		if _, _, _, err := dbc.Get(ctx, fbo.id(), ptr.ID); err == nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// addFileRange appends `fr` to `ranges`, merging it with the last
+// range if they're adjacent.
+func addFileRange(ranges []FileRange, fr FileRange) []FileRange {
+	if fr.Len <= 0 {
+		return ranges
+	}
+	if len(ranges) > 0 && ranges[len(ranges)-1].End() == fr.Off {
+		ranges[len(ranges)-1].Len += fr.Len
+		return ranges
+	}
+	return append(ranges, fr)
+}
+
+// getLocalRangesLocked appends the ranges covered by the local
+// children of the indirect block `pblock`, which ends at `end`, to
+// `ranges`.  Since all the leaves of a file are at the same depth,
+// it only needs to decode one child of `pblock` to find out whether
+// its children are leaves; leaves are then only checked for
+// presence.
+func (fbo *folderBlockOps) getLocalRangesLocked(
+	ctx context.Context, lState *lockState, kmd KeyMetadata,
+	pblock *FileBlock, branch BranchName, end int64,
+	ranges []FileRange) ([]FileRange, error) {
+	childrenAreLeaves, known := false, false
+	for i, iptr := range pblock.IPtrs {
+		childEnd := end
+		if i < len(pblock.IPtrs)-1 {
+			childEnd = int64(pblock.IPtrs[i+1].Off)
+		}
+
+		if known && childrenAreLeaves {
+			local, err := fbo.isFileBlockLocalLocked(
+				ctx, lState, iptr.BlockPointer, branch)
+			if err != nil {
+				return nil, err
+			}
+			if !local {
+				continue
+			}
+		} else {
+			child, err := fbo.getLocalFileBlockLocked(
+				ctx, lState, kmd, iptr.BlockPointer, branch)
+			if err != nil {
+				return nil, err
+			}
+			if child == nil {
+				continue
+			}
+			known, childrenAreLeaves = true, !child.IsInd
+			if child.IsInd {
+				ranges, err = fbo.getLocalRangesLocked(
+					ctx, lState, kmd, child, branch, childEnd, ranges)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
+
+		// Any hole at the end of a leaf block reads as zeroes, so
+		// it's available as well.
+		ranges = addFileRange(ranges, FileRange{
+			Off: int64(iptr.Off),
+			Len: childEnd - int64(iptr.Off),
+		})
+	}
+	return ranges, nil
+}
+
+// GetLocalRanges returns the byte ranges of the given file that can
+// be read without contacting the server, in increasing order, with
+// adjacent ranges merged.
+func (fbo *folderBlockOps) GetLocalRanges(
+	ctx context.Context, lState *lockState, kmd KeyMetadataWithRootDirEntry,
+	file Node) ([]FileRange, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+
+	filePath := fbo.nodeCache.PathFromNode(file)
+	de, err := fbo.getEntryLocked(ctx, lState, kmd, filePath, true)
+	if err != nil {
+		return nil, err
+	}
+	size := int64(de.Size)
+	if size == 0 {
+		return nil, nil
+	}
+
+	topBlock, err := fbo.getLocalFileBlockLocked(
+		ctx, lState, kmd, filePath.tailPointer(), filePath.Branch)
+	if err != nil {
+		return nil, err
+	}
+	if topBlock == nil {
+		return nil, nil
+	}
+	if !topBlock.IsInd {
+		return []FileRange{{Off: 0, Len: size}}, nil
+	}
+	return fbo.getLocalRangesLocked(
+		ctx, lState, kmd, topBlock, filePath.Branch, size, nil)
+}
+
 func (fbo *folderBlockOps) maybeWaitOnDeferredWrites(
 	ctx context.Context, lState *lockState, file Node,
 	c DirtyPermChan) error {
@@ -1911,8 +3266,6 @@ func (fbo *folderBlockOps) writeDataLocked(
 		return WriteRange{}, nil, 0, err
 	}
 
-	fd := fbo.newFileData(lState, file, chargedTo, kmd)
-
 	dirtyBcache := fbo.config.DirtyBlockCache()
 	df := fbo.getOrCreateDirtyFileLocked(lState, file)
 	defer func() {
@@ -1945,6 +3298,13 @@ func (fbo *folderBlockOps) writeDataLocked(
 		return WriteRange{}, nil, 0, err
 	}
 
+	if end := uint64(off) + uint64(len(data)); end > de.Size {
+		fbo.maybeChooseBlockSize(ctx, &de, end, uint64(off) == de.Size)
+	}
+	df.setBlockSize(de.BlockSize)
+	fd := fbo.newFileDataWithBlockSizeLocked(
+		ctx, lState, file, chargedTo, kmd, de.BlockSize)
+
 	newDe, dirtyPtrs, unrefs, newlyDirtiedChildBytes, bytesExtended, err :=
 		fd.write(ctx, data, Int64Offset(off), fblock, de, df)
 	// Record the unrefs before checking the error so we remember the
@@ -1972,12 +3332,29 @@ func (fbo *folderBlockOps) writeDataLocked(
 	return latestWrite, dirtyPtrs, newlyDirtiedChildBytes, nil
 }
 
+// checkFileSize returns a FileTooBigError if `file` isn't allowed to
+// grow to `newSize` bytes.  It's cheaper to fail here than partway
+// through splitting the file's blocks.
+func (fbo *folderBlockOps) checkFileSize(file Node, newSize uint64) error {
+	maxBytes := fbo.config.MaxFileBytes(fbo.id())
+	if newSize <= maxBytes {
+		return nil
+	}
+	return FileTooBigError{
+		fbo.nodeCache.PathFromNode(file), int64(newSize), maxBytes}
+}
+
 // Write writes the given data to the given file. May block if there
 // is too much unflushed data; in that case, it will be unblocked by a
 // future sync.
 func (fbo *folderBlockOps) Write(
 	ctx context.Context, lState *lockState, kmd KeyMetadataWithRootDirEntry,
 	file Node, data []byte, off int64) error {
+	err := fbo.checkFileSize(file, uint64(off)+uint64(len(data)))
+	if err != nil {
+		return err
+	}
+
 	// If there is too much unflushed data, we should wait until some
 	// of it gets flush so our memory usage doesn't grow without
 	// bound.
@@ -1993,9 +3370,90 @@ func (fbo *folderBlockOps) Write(
 		return err
 	}
 
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+	return fbo.writeLocked(ctx, lState, kmd, file, data, off)
+}
+
+// WriteVec writes each of the given buffers to the given file,
+// starting at the offset given with it, as if by one Write call per
+// buffer in order.  The blocks the buffers touch are fetched in
+// parallel first, and then all the writes are made under a single
+// hold of `blockLock`.  Like Write, it may block if there is too much
+// unflushed data.
+func (fbo *folderBlockOps) WriteVec(
+	ctx context.Context, lState *lockState, kmd KeyMetadataWithRootDirEntry,
+	file Node, vecs []IOVec) error {
+	var total int64
+	var end uint64
+	for _, vec := range vecs {
+		total += int64(len(vec.Buf))
+		if vecEnd := uint64(vec.Off) + uint64(len(vec.Buf)); vecEnd > end {
+			end = vecEnd
+		}
+	}
+	err := fbo.checkFileSize(file, end)
+	if err != nil {
+		return err
+	}
+
+	// As in Write, wait for permission to dirty all the bytes at
+	// once.
+	c, err := fbo.config.DirtyBlockCache().RequestPermissionToDirty(ctx,
+		fbo.id(), total)
+	if err != nil {
+		return err
+	}
+	defer fbo.config.DirtyBlockCache().UpdateUnsyncedBytes(fbo.id(),
+		-total, false)
+	err = fbo.maybeWaitOnDeferredWrites(ctx, lState, file, c)
+	if err != nil {
+		return err
+	}
+
 	fbo.blockLock.Lock(lState)
 	defer fbo.blockLock.Unlock(lState)
 
+	filePath, err := fbo.pathFromNodeForBlockWriteLocked(lState, file)
+	if err != nil {
+		return err
+	}
+	fbo.log.CDebugf(ctx, "Writing %d vectors to %v",
+		len(vecs), filePath.tailPointer())
+
+	// Fetch the existing blocks under each vector into the cache, so
+	// the writes below don't have to fetch them one at a time.
+	err = fbo.forEachIOVecLocked(ctx, lState, kmd, filePath, vecs,
+		func(ctx context.Context, fd *fileData, _ int, vec IOVec) error {
+			if len(vec.Buf) == 0 {
+				return nil
+			}
+			_, err := fd.fetchRange(ctx, Int64Offset(vec.Off),
+				Int64Offset(vec.Off+int64(len(vec.Buf))))
+			return err
+		})
+	if err != nil {
+		return err
+	}
+
+	for _, vec := range vecs {
+		err := fbo.writeLocked(ctx, lState, kmd, file, vec.Buf, vec.Off)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeLocked writes the given data to the given file, deferring the
+// write if it touches blocks that are currently being synced.  The
+// caller must have already gotten permission to dirty `len(data)`
+// bytes.
+func (fbo *folderBlockOps) writeLocked(
+	ctx context.Context, lState *lockState, kmd KeyMetadataWithRootDirEntry,
+	file Node, data []byte, off int64) error {
+	fbo.blockLock.AssertLocked(lState)
+
 	filePath, err := fbo.pathFromNodeForBlockWriteLocked(lState, file)
 	if err != nil {
 		return err
@@ -2013,6 +3471,14 @@ func (fbo *folderBlockOps) Write(
 
 	fbo.observers.localChange(ctx, file, latestWrite)
 
+	if fbo.config.EarlyBlockUploadEnabled() && !fbo.doDeferWrite {
+		err = fbo.readyEarlyLocked(ctx, lState, kmd, filePath, off)
+		if err != nil {
+			// The blocks will still be readied during the sync.
+			fbo.log.CDebugf(ctx, "Couldn't ready blocks early: %+v", err)
+		}
+	}
+
 	if fbo.doDeferWrite {
 		// There's an ongoing sync, and this write altered dirty
 		// blocks that are in the process of syncing.  So, we have to
@@ -2026,6 +3492,7 @@ func (fbo *folderBlockOps) Write(
 		copy(dataCopy, data)
 		fbo.log.CDebugf(ctx, "Deferring a write to file %v off=%d len=%d",
 			filePath.tailPointer(), off, len(data))
+		fbo.deferredWritesCounter.Inc(1)
 		ds := fbo.deferred[filePath.tailRef()]
 		ds.dirtyDeletes = append(ds.dirtyDeletes, dirtyPtrs...)
 		ds.writes = append(ds.writes,
@@ -2036,17 +3503,209 @@ func (fbo *folderBlockOps) Write(
 				df := fbo.getOrCreateDirtyFileLocked(lState, filePath)
 				df.updateNotYetSyncingBytes(-newlyDirtiedChildBytes)
 
-				// Write the data again.  We know this won't be
-				// deferred, so no need to check the new ptrs.
-				_, _, _, err = fbo.writeDataLocked(
-					ctx, lState, kmd, f, dataCopy, off)
-				return err
-			})
-		ds.waitBytes += newlyDirtiedChildBytes
-		fbo.deferred[filePath.tailRef()] = ds
+				// Write the data again.  We know this won't be
+				// deferred, so no need to check the new ptrs.
+				_, _, _, err = fbo.writeDataLocked(
+					ctx, lState, kmd, f, dataCopy, off)
+				return err
+			})
+		ds.waitBytes += newlyDirtiedChildBytes
+		fbo.deferred[filePath.tailRef()] = ds
+	}
+
+	return nil
+}
+
+// TakeReadRepairs returns, and forgets, all the file block pointers
+// that could only be read through an alternate reference since the
+// last call.
+func (fbo *folderBlockOps) TakeReadRepairs() []readRepair {
+	return fbo.readRepairs.takeRepairs()
+}
+
+// RequeueReadRepair records `r` again, after an attempt to apply it
+// failed.
+func (fbo *folderBlockOps) RequeueReadRepair(r readRepair) {
+	fbo.readRepairs.addRepair(r.file, r.ptr)
+}
+
+// findFileBlockOffsetLocked returns the offset of the first byte of
+// `file` that lives under `ptr`, or false if `ptr` isn't part of
+// the file anymore.
+func (fbo *folderBlockOps) findFileBlockOffsetLocked(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file path,
+	ptr BlockPointer) (Int64Offset, bool, error) {
+	fbo.blockLock.AssertAnyLocked(lState)
+	if file.tailPointer() == ptr {
+		return 0, true, nil
+	}
+
+	topBlock, err := fbo.getFileLocked(ctx, lState, kmd, file, blockRead)
+	if err != nil {
+		return 0, false, err
+	}
+	if !topBlock.IsInd {
+		return 0, false, nil
+	}
+
+	var id keybase1.UserOrTeamID // Data reads don't depend on the id.
+	fd := fbo.newFileData(lState, file, id, kmd)
+	pfr, err := fd.tree.getIndirectBlocksForOffsetRange(
+		ctx, topBlock, topBlock.FirstOffset(), nil)
+	if err != nil {
+		return 0, false, err
+	}
+	seen := make(map[BlockPointer]bool)
+	for _, path := range pfr {
+		for _, pb := range path {
+			if seen[pb.childBlockPtr()] {
+				continue
+			}
+			for i := 0; i < pb.pblock.NumIndirectPtrs(); i++ {
+				info, off := pb.pblock.IndirectPtr(i)
+				seen[info.BlockPointer] = true
+				if info.BlockPointer == ptr {
+					return off.(Int64Offset), true, nil
+				}
+			}
+		}
+	}
+	return 0, false, nil
+}
+
+// NewRefForReadRepair returns a new reference to the block of
+// `ptr`, to replace `ptr` in its file with RereferenceForReadRepair.
+// The reference isn't added to the server yet.
+func (fbo *folderBlockOps) NewRefForReadRepair(
+	ctx context.Context, lState *lockState, kmd KeyMetadata,
+	ptr BlockPointer) (BlockPointer, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+
+	chargedTo, err := fbo.getChargedToLocked(ctx, lState, kmd)
+	if err != nil {
+		return BlockPointer{}, err
+	}
+	newPtr := ptr
+	newPtr.RefNonce, err = fbo.config.Crypto().MakeBlockRefNonce()
+	if err != nil {
+		return BlockPointer{}, err
+	}
+	newPtr.SetWriter(chargedTo)
+	return newPtr, nil
+}
+
+// RereferenceForReadRepair replaces the leaf pointer `ptr` in `file`
+// with `newPtr`, a new reference to the same block that must already
+// be on the server.  Like a leaf spliced in by SpliceLeavesForCopy,
+// the leaf itself is neither fetched nor readied again; only the
+// indirect blocks above it are dirtied, so that the next sync of the
+// file records the new reference and unreferences `ptr`.  It returns
+// false if `ptr` is no longer a leaf of the file, or if the file is
+// being synced.
+func (fbo *folderBlockOps) RereferenceForReadRepair(
+	ctx context.Context, lState *lockState, kmd KeyMetadataWithRootDirEntry,
+	file Node, ptr, newPtr BlockPointer) (bool, error) {
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+
+	filePath, err := fbo.pathFromNodeForBlockWriteLocked(lState, file)
+	if err != nil {
+		return false, err
+	}
+	if filePath.tailPointer() == ptr {
+		// The top block is readied again whenever the file is
+		// synced, so it can't be re-referenced.
+		return false, nil
+	}
+	df := fbo.getOrCreateDirtyFileLocked(lState, filePath)
+	if df.isBlockSyncing(filePath.tailPointer()) {
+		return false, nil
+	}
+
+	off, found, err := fbo.findFileBlockOffsetLocked(
+		ctx, lState, kmd, filePath, ptr)
+	if err != nil || !found {
+		return false, err
+	}
+
+	fblock, err := fbo.writeGetFileLocked(ctx, lState, kmd, filePath)
+	if err != nil {
+		return false, err
+	}
+	de, err := fbo.getEntryLocked(ctx, lState, kmd, filePath, true)
+	if err != nil {
+		return false, err
+	}
+	si, err := fbo.getOrCreateSyncInfoLocked(lState, de)
+	if err != nil {
+		return false, err
+	}
+
+	// Walk down to the parent of the leaf, getting each indirect
+	// block for writing.
+	var parentBlocks []parentBlockAndChildIndex
+	pblock := fblock
+	for {
+		i := len(pblock.IPtrs) - 1
+		for i > 0 && off < pblock.IPtrs[i].Off {
+			i--
+		}
+		parentBlocks = append(
+			parentBlocks, parentBlockAndChildIndex{pblock, i})
+		child := pblock.IPtrs[i]
+		if child.BlockPointer == ptr {
+			break
+		} else if child.DirectType != IndirectBlock {
+			return false, nil
+		}
+		pblock, _, err = fbo.getFileBlockLocked(
+			ctx, lState, kmd, child.BlockPointer, filePath, blockWrite)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	chargedTo, err := fbo.getChargedToLocked(ctx, lState, kmd)
+	if err != nil {
+		return false, err
+	}
+	fd := fbo.newFileDataWithBlockSizeLocked(
+		ctx, lState, filePath, chargedTo, kmd, de.BlockSize)
+	leafParent := parentBlocks[len(parentBlocks)-1]
+	leafParentPtr := filePath.tailPointer()
+	if len(parentBlocks) > 1 {
+		leafParentPtr = parentBlocks[len(parentBlocks)-2].childBlockPtr()
+	}
+	// Dirty the blocks above the leaf's parent.  The leaf's own
+	// entry keeps its encoded size, since the leaf isn't dirty.
+	_, unrefs, err := fd.tree.markParentsDirty(
+		parentBlocks[:len(parentBlocks)-1])
+	si.unrefs = append(si.unrefs, unrefs...)
+	if err != nil {
+		return false, err
 	}
 
-	return nil
+	fbo.log.CDebugf(ctx, "Replacing %v with %v at off=%d for read repair",
+		ptr, newPtr, off)
+	iptr := &leafParent.pblock.(*FileBlock).IPtrs[leafParent.childIndex]
+	oldInfo := iptr.BlockInfo
+	iptr.BlockPointer = newPtr
+	err = fbo.cacheBlockIfNotYetDirtyLocked(
+		lState, leafParentPtr, filePath, leafParent.pblock)
+	if err != nil {
+		return false, err
+	}
+	si.unrefs = append(si.unrefs, oldInfo)
+	df.addSplicedRefs([]BlockInfo{iptr.BlockInfo})
+
+	newDe := de
+	newDe.EncodedSize = 0
+	err = fbo.updateEntryLocked(ctx, lState, kmd, filePath, newDe, true)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
 // truncateExtendLocked is called by truncateLocked to extend a file and
@@ -2065,13 +3724,15 @@ func (fbo *folderBlockOps) truncateExtendLocked(
 		return WriteRange{}, nil, err
 	}
 
-	fd := fbo.newFileData(lState, file, chargedTo, kmd)
-
 	de, err := fbo.getEntryLocked(ctx, lState, kmd, file, true)
 	if err != nil {
 		return WriteRange{}, nil, err
 	}
+	fbo.maybeChooseBlockSize(ctx, &de, size, false)
 	df := fbo.getOrCreateDirtyFileLocked(lState, file)
+	df.setBlockSize(de.BlockSize)
+	fd := fbo.newFileDataWithBlockSizeLocked(
+		ctx, lState, file, chargedTo, kmd, de.BlockSize)
 	newDe, dirtyPtrs, err := fd.truncateExtend(
 		ctx, size, fblock, parentBlocks, de, df)
 	if err != nil {
@@ -2180,6 +3841,7 @@ func (fbo *folderBlockOps) truncateLocked(
 
 	// Update dirtied bytes and unrefs regardless of error.
 	df := fbo.getOrCreateDirtyFileLocked(lState, file)
+	df.setBlockSize(de.BlockSize)
 	df.updateNotYetSyncingBytes(newlyDirtiedChildBytes)
 
 	latestWrite := si.op.addTruncate(size)
@@ -2200,6 +3862,11 @@ func (fbo *folderBlockOps) truncateLocked(
 func (fbo *folderBlockOps) Truncate(
 	ctx context.Context, lState *lockState, kmd KeyMetadataWithRootDirEntry,
 	file Node, size uint64) error {
+	err := fbo.checkFileSize(file, size)
+	if err != nil {
+		return err
+	}
+
 	// If there is too much unflushed data, we should wait until some
 	// of it gets flush so our memory usage doesn't grow without
 	// bound.
@@ -2248,6 +3915,7 @@ func (fbo *folderBlockOps) Truncate(
 		// using the new file path.
 		fbo.log.CDebugf(ctx, "Deferring a truncate to file %v",
 			filePath.tailPointer())
+		fbo.deferredWritesCounter.Inc(1)
 		ds := fbo.deferred[filePath.tailRef()]
 		ds.dirtyDeletes = append(ds.dirtyDeletes, dirtyPtrs...)
 		ds.writes = append(ds.writes,
@@ -2276,6 +3944,11 @@ func (fbo *folderBlockOps) Truncate(
 func (fbo *folderBlockOps) IsDirty(lState *lockState, file path) bool {
 	fbo.blockLock.RLock(lState)
 	defer fbo.blockLock.RUnlock(lState)
+	return fbo.isDirtyLocked(lState, file)
+}
+
+func (fbo *folderBlockOps) isDirtyLocked(lState *lockState, file path) bool {
+	fbo.blockLock.AssertAnyLocked(lState)
 	// A dirty file should probably match all three of these, but
 	// check them individually just in case.
 	if fbo.config.DirtyBlockCache().IsDirty(
@@ -2338,6 +4011,7 @@ func (fbo *folderBlockOps) clearAllDirtyDirsLocked(
 		}
 	}
 	fbo.dirtyDirs = make(map[BlockPointer][]BlockInfo)
+	fbo.dirEntryCounts = make(map[BlockPointer]int)
 	fbo.dirtyRootDirEntry = nil
 }
 
@@ -2348,6 +4022,353 @@ func (fbo *folderBlockOps) ClearCacheInfo(lState *lockState, file path) error {
 	return fbo.clearCacheInfoLocked(lState, file)
 }
 
+// getFileDirtyPtrsLocked returns the pointers of all the blocks of
+// the given file that are still in the dirty block cache, along with
+// the number of data bytes they hold.
+func (fbo *folderBlockOps) getFileDirtyPtrsLocked(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file path) (
+	ptrs []BlockPointer, dirtyBytes int64, err error) {
+	fbo.blockLock.AssertAnyLocked(lState)
+	dirtyBcache := fbo.config.DirtyBlockCache()
+	block, err := dirtyBcache.Get(fbo.id(), file.tailPointer(), fbo.branch())
+	if err != nil {
+		// Not dirty, so there's nothing being held for this file.
+		return nil, 0, nil
+	}
+	topBlock, ok := block.(*FileBlock)
+	if !ok {
+		return nil, 0, nil
+	}
+
+	ptrs = []BlockPointer{file.tailPointer()}
+	dirtyBytes = int64(len(topBlock.Contents))
+	if !topBlock.IsInd {
+		return ptrs, dirtyBytes, nil
+	}
+
+	fd := fbo.newFileDataWithCache(
+		lState, file, keybase1.UserOrTeamID(""), kmd, dirtyBcache)
+	infos, err := fd.getIndirectFileBlockInfosWithTopBlock(ctx, topBlock)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, info := range infos {
+		block, err := dirtyBcache.Get(
+			fbo.id(), info.BlockPointer, fbo.branch())
+		if err != nil {
+			continue
+		}
+		ptrs = append(ptrs, info.BlockPointer)
+		if fblock, ok := block.(*FileBlock); ok {
+			dirtyBytes += int64(len(fblock.Contents))
+		}
+	}
+	return ptrs, dirtyBytes, nil
+}
+
+// discardFileDirtyStateLocked drops the dirty blocks, deferred
+// writes, and cached sync info of the given file, and returns the
+// number of dirty data bytes dropped.
+func (fbo *folderBlockOps) discardFileDirtyStateLocked(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file path) (
+	dirtyBytes int64, err error) {
+	fbo.blockLock.AssertLocked(lState)
+	ptrs, dirtyBytes, err := fbo.getFileDirtyPtrsLocked(
+		ctx, lState, kmd, file)
+	if err != nil {
+		return 0, err
+	}
+	dirtyBcache := fbo.config.DirtyBlockCache()
+	for _, ptr := range ptrs {
+		err := dirtyBcache.Delete(fbo.id(), ptr, fbo.branch())
+		if err != nil {
+			return 0, err
+		}
+	}
+	delete(fbo.deferred, file.tailRef())
+	err = fbo.clearCacheInfoLocked(lState, file)
+	if err != nil {
+		return 0, err
+	}
+	return dirtyBytes, nil
+}
+
+// GetUnlinkedNodeStats returns the number of nodes in the node cache
+// that have been unlinked but are still in use, along with the number
+// of dirty bytes they are holding onto.
+func (fbo *folderBlockOps) GetUnlinkedNodeStats(
+	ctx context.Context, lState *lockState, kmd KeyMetadata) (
+	stats UnlinkedNodeStats, err error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+
+	for _, n := range fbo.nodeCache.AllNodes() {
+		if !fbo.nodeCache.IsUnlinked(n) {
+			continue
+		}
+		stats.NumNodes++
+		file := fbo.nodeCache.PathFromNode(n)
+		_, dirtyBytes, err := fbo.getFileDirtyPtrsLocked(
+			ctx, lState, kmd, file)
+		if err != nil {
+			return UnlinkedNodeStats{}, err
+		}
+		stats.DirtyBytes += dirtyBytes
+	}
+	return stats, nil
+}
+
+// ReclaimUnlinkedNodes drops all the dirty state held for nodes that
+// have been unlinked, since that state can never be synced.  Nodes
+// that may still have open handles are skipped, since reads through
+// them must keep seeing the dirty data.  It returns the unlinked
+// nodes that were reclaimed, along with stats about what was
+// reclaimed.
+func (fbo *folderBlockOps) ReclaimUnlinkedNodes(
+	ctx context.Context, lState *lockState, kmd KeyMetadata) (
+	nodes []Node, stats UnlinkedNodeStats, err error) {
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+
+	for _, n := range fbo.nodeCache.AllNodes() {
+		if !fbo.nodeCache.IsUnlinked(n) || fbo.nodeCache.IsInUse(n) {
+			continue
+		}
+		file := fbo.nodeCache.PathFromNode(n)
+		dirtyBytes, err := fbo.discardFileDirtyStateLocked(
+			ctx, lState, kmd, file)
+		if err != nil {
+			return nil, UnlinkedNodeStats{}, err
+		}
+		nodes = append(nodes, n)
+		stats.NumNodes++
+		stats.DirtyBytes += dirtyBytes
+	}
+	return nodes, stats, nil
+}
+
+// ForgetUnlinkedFile drops the dirty state held for an unlinked
+// file, given its cached path, once the node cache has forgotten it.
+// It returns the number of dirty bytes dropped.
+func (fbo *folderBlockOps) ForgetUnlinkedFile(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file path) (
+	dirtyBytes int64, err error) {
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+
+	if fbo.nodeCache.Get(file.tailRef()) != nil {
+		// A new node was made for the same reference.
+		return 0, nil
+	}
+	return fbo.discardFileDirtyStateLocked(ctx, lState, kmd, file)
+}
+
+// DiscardDirtyState drops all the dirty state held for the linked
+// files and directories of the TLF, so that they go back to matching
+// the last synced revision.  The dirty state of unlinked files is
+// left for ReclaimUnlinkedNodes.  It returns the node changes that
+// invalidate whatever was dropped; for directories, these only name
+// the dirty entries.  Nodes created since the last sync are left in
+// the node cache, so the caller should fast-forward all nodes
+// afterward to unlink them, and then add the entries that reappeared.
+func (fbo *folderBlockOps) DiscardDirtyState(
+	ctx context.Context, lState *lockState, kmd KeyMetadata) (
+	changes []NodeChange, affectedNodeIDs []NodeID, err error) {
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+
+	for ref := range fbo.unrefCache {
+		n := fbo.nodeCache.Get(ref)
+		if n == nil || fbo.nodeCache.IsUnlinked(n) {
+			continue
+		}
+		file := fbo.nodeCache.PathFromNode(n)
+		_, err := fbo.discardFileDirtyStateLocked(ctx, lState, kmd, file)
+		if err != nil {
+			return nil, nil, err
+		}
+		changes = append(changes, NodeChange{
+			Node:        n,
+			FileUpdated: []WriteRange{{Len: 0, Off: 0}},
+		})
+		affectedNodeIDs = append(affectedNodeIDs, n.GetID())
+	}
+
+	for ptr := range fbo.dirtyDirs {
+		n := fbo.nodeCache.Get(ptr.Ref())
+		if n == nil || fbo.nodeCache.IsUnlinked(n) {
+			continue
+		}
+		dir := fbo.nodeCache.PathFromNode(n)
+		dd := fbo.newDirDataLocked(
+			lState, dir, keybase1.UserOrTeamID(""), kmd)
+		entries, err := dd.getEntries(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		change := NodeChange{Node: n}
+		for name := range entries {
+			change.DirUpdated = append(change.DirUpdated, name)
+		}
+		changes = append(changes, change)
+		affectedNodeIDs = append(affectedNodeIDs, n.GetID())
+	}
+	fbo.clearAllDirtyDirsLocked(ctx, lState, kmd)
+	return changes, affectedNodeIDs, nil
+}
+
+// dirtyFileHandoff holds the unsynced changes to one file, taken out
+// of its dirty state so that they can be replayed on top of another
+// version of the file.
+type dirtyFileHandoff struct {
+	node Node
+	// base is the pointer of the version of the file the changes
+	// were made to, and path is its TLF-relative path.
+	base BlockPointer
+	path string
+	// truncOff is the smallest size the file was truncated to, if
+	// `truncated` is set.
+	truncated bool
+	truncOff  uint64
+	// size is the size of the file after all the changes.
+	size uint64
+	// writes holds the ranges written since the last sync, and
+	// `data` holds their latest contents.
+	writes []WriteRange
+	data   [][]byte
+}
+
+// TakeDirtyFileHandoffs drops the dirty state of all the linked
+// files, and of all the directories, and returns the unsynced
+// changes to the files so that they can be replayed with
+// `ReplayDirtyFileHandoffs`.  Since directory changes are dropped,
+// the caller must make sure there are no unsynced directory ops.
+// Writes can't be deferred here, since the caller must also keep
+// syncs from running.
+func (fbo *folderBlockOps) TakeDirtyFileHandoffs(
+	ctx context.Context, lState *lockState,
+	kmd KeyMetadataWithRootDirEntry) (
+	handoffs []dirtyFileHandoff, err error) {
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+
+	for ref, si := range fbo.unrefCache {
+		n := fbo.nodeCache.Get(ref)
+		if n == nil || fbo.nodeCache.IsUnlinked(n) {
+			continue
+		}
+		file := fbo.nodeCache.PathFromNode(n)
+		de, err := fbo.getEntryLocked(ctx, lState, kmd, file, true)
+		if err != nil {
+			return nil, err
+		}
+
+		h := dirtyFileHandoff{
+			node: n,
+			base: file.tailPointer(),
+			path: file.tlfRelativeString(),
+			size: de.Size,
+		}
+		for _, w := range si.op.Writes {
+			if w.isTruncate() && (!h.truncated || w.Off < h.truncOff) {
+				h.truncated = true
+				h.truncOff = w.Off
+			}
+		}
+		var id keybase1.UserOrTeamID // Data reads don't depend on the id.
+		fd := fbo.newFileData(lState, file, id, kmd)
+		for _, w := range si.op.collapseWriteRange(nil) {
+			if w.isTruncate() || w.Off >= de.Size {
+				continue
+			}
+			end := w.End()
+			if end > de.Size {
+				end = de.Size
+			}
+			data := make([]byte, end-w.Off)
+			nRead, err := fd.read(ctx, data, Int64Offset(w.Off))
+			if err != nil {
+				return nil, err
+			}
+			h.writes = append(h.writes, WriteRange{Off: w.Off, Len: end - w.Off})
+			h.data = append(h.data, data[:nRead])
+		}
+		handoffs = append(handoffs, h)
+	}
+
+	for _, h := range handoffs {
+		_, err := fbo.discardFileDirtyStateLocked(
+			ctx, lState, kmd, fbo.nodeCache.PathFromNode(h.node))
+		if err != nil {
+			return nil, err
+		}
+	}
+	fbo.clearAllDirtyDirsLocked(ctx, lState, kmd)
+	return handoffs, nil
+}
+
+// ReplayDirtyFileHandoffs redoes the changes in `handoffs` on top of
+// the current versions of their files.  It returns the handoffs that
+// weren't replayed, because their node now refers to a different
+// file than the changes were made to (e.g., because CR renamed the
+// unmerged version to a conflicted copy), or because replaying them
+// failed, and the nodes that were dirtied.
+func (fbo *folderBlockOps) ReplayDirtyFileHandoffs(
+	ctx context.Context, lState *lockState,
+	kmd KeyMetadataWithRootDirEntry, handoffs []dirtyFileHandoff) (
+	failed []dirtyFileHandoff, dirtied []Node) {
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+
+	for _, h := range handoffs {
+		if fbo.nodeCache.IsUnlinked(h.node) {
+			fbo.log.CDebugf(ctx, "Dropping the unsynced changes to "+
+				"unlinked node %s", h.node.GetID())
+			continue
+		}
+		file := fbo.nodeCache.PathFromNode(h.node)
+		if file.tailPointer().ID != h.base.ID {
+			fbo.log.CDebugf(ctx, "Node %s now refers to %v instead of %v",
+				h.node.GetID(), file.tailPointer(), h.base)
+			failed = append(failed, h)
+			continue
+		}
+		dirtied = append(dirtied, h.node)
+		err := fbo.replayDirtyFileHandoffLocked(ctx, lState, kmd, file, h)
+		if err != nil {
+			fbo.log.CWarningf(ctx, "Couldn't replay the unsynced "+
+				"changes to node %s: %+v", h.node.GetID(), err)
+			failed = append(failed, h)
+		}
+	}
+	return failed, dirtied
+}
+
+func (fbo *folderBlockOps) replayDirtyFileHandoffLocked(
+	ctx context.Context, lState *lockState,
+	kmd KeyMetadataWithRootDirEntry, file path, h dirtyFileHandoff) error {
+	if h.truncated {
+		_, _, _, err := fbo.truncateLocked(ctx, lState, kmd, file, h.truncOff)
+		if err != nil {
+			return err
+		}
+	}
+	for i, w := range h.writes {
+		_, _, _, err := fbo.writeDataLocked(
+			ctx, lState, kmd, file, h.data[i], int64(w.Off))
+		if err != nil {
+			return err
+		}
+	}
+	if h.truncated {
+		_, _, _, err := fbo.truncateLocked(ctx, lState, kmd, file, h.size)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // revertSyncInfoAfterRecoverableError updates the saved sync info to
 // include all the blocks from before the error, except for those that
 // have encountered recoverable block errors themselves.
@@ -2466,6 +4487,12 @@ type fileSyncState struct {
 	// would need a DirtyBlockCache.Delete.
 	redirtyOnRecoverableError map[BlockPointer]BlockPointer
 
+	// splicedRefs holds the leaves spliced in from other files that
+	// this sync added to the MD.  The sync info forgets them on a
+	// recoverable error, so they're handed back to the dirty file
+	// for the retry.
+	splicedRefs []BlockInfo
+
 	// If si is non-nil, its updated state will be reset on
 	// error. Also, if the error is recoverable, it will be
 	// reverted to savedSi.
@@ -2562,7 +4589,8 @@ func (fbo *folderBlockOps) startSyncWrite(ctx context.Context,
 
 	dirtyBcache := fbo.config.DirtyBlockCache()
 	df := fbo.getOrCreateDirtyFileLocked(lState, file)
-	fd := fbo.newFileData(lState, file, chargedTo, md.ReadOnly())
+	fd := fbo.newFileDataWithBlockSizeLocked(
+		ctx, lState, file, chargedTo, md.ReadOnly(), df.getBlockSize())
 
 	// Note: below we add possibly updated file blocks as "unref" and
 	// "ref" blocks.  This is fine, since conflict resolution or
@@ -2582,6 +4610,10 @@ func (fbo *folderBlockOps) startSyncWrite(ctx context.Context,
 	// Ready all children blocks, if any.
 	oldPtrs, err := fd.ready(ctx, fbo.id(), fbo.config.BlockCache(),
 		fbo.config.DirtyBlockCache(), fbo.config.BlockOps(), si.bps, fblock, df)
+	// Any early puts that weren't used by the sync are now useless.
+	for _, erb := range df.takeAllEarlyReadied() {
+		fbo.discardEarlyReadied(erb)
+	}
 	if err != nil {
 		return nil, nil, syncState, nil, err
 	}
@@ -2610,6 +4642,16 @@ func (fbo *folderBlockOps) startSyncWrite(ctx context.Context,
 		syncState.redirtyOnRecoverableError[newInfo.BlockPointer] = oldPtr
 	}
 
+	// Leaves spliced in from other files already have their new
+	// references on the server, so they only need to be recorded in
+	// the MD.
+	syncState.splicedRefs = df.takeSplicedRefs()
+	for _, info := range syncState.splicedRefs {
+		syncState.newIndirectFileBlockPtrs = append(
+			syncState.newIndirectFileBlockPtrs, info.BlockPointer)
+		md.AddRefBlock(info)
+	}
+
 	err = df.setBlockSyncing(file.tailPointer())
 	if err != nil {
 		return nil, nil, syncState, nil, err
@@ -2687,13 +4729,66 @@ func (fbo *folderBlockOps) mergeDirtyEntryWithLBC(
 	return nil
 }
 
+// syncCanceler aborts a batch of file syncs in flight, on behalf of
+// `CancelSync`.
+type syncCanceler struct {
+	cancel context.CancelFunc
+	// canceled is set, under blockLock, once `CancelSync` has
+	// aborted the batch.
+	canceled bool
+	// putsDone is set, under blockLock, once the block puts of the
+	// batch are over.  After that, the batch can't be canceled.
+	putsDone bool
+}
+
+// newSyncCanceler returns a child of `ctx` under which the block
+// puts of a batch of file syncs can be run, and the canceler to pass
+// to StartSync() for each of those files.  Only the puts, which are
+// what can get stuck, are canceled; the caller must call
+// `SyncPutsDone` once they're over, and `sc.cancel` once the batch
+// is done.
+func newSyncCanceler(ctx context.Context) (
+	context.Context, *syncCanceler) {
+	ctx, cancel := context.WithCancel(ctx)
+	return ctx, &syncCanceler{cancel: cancel}
+}
+
+// SyncPutsDone marks the block puts of the batch with canceler `sc`
+// as over, so that `CancelSync` leaves the rest of the batch alone.
+func (fbo *folderBlockOps) SyncPutsDone(lState *lockState, sc *syncCanceler) {
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+	sc.putsDone = true
+}
+
+// CancelSync aborts the block puts of the in-flight sync of the
+// given file, if there is one, and returns true if so.  All the
+// files are synced in one batch, so this aborts the syncs of the
+// other files in the batch too; CleanupSyncState() backs them all
+// out as if they had hit a recoverable block error, so they remain
+// dirty and will be synced again from scratch later.
+func (fbo *folderBlockOps) CancelSync(lState *lockState, file Node) bool {
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+	filePath := fbo.nodeCache.PathFromNode(file)
+	sc, ok := fbo.syncCancelers[filePath.tailRef()]
+	if !ok || sc.putsDone {
+		return false
+	}
+	sc.canceled = true
+	sc.cancel()
+	return true
+}
+
 // StartSync starts a sync for the given file. It returns the new
 // FileBlock which has the readied top-level block which includes all
-// writes since the last sync. Must be used with CleanupSyncState()
-// and UpdatePointers/FinishSyncLocked() like so:
+// writes since the last sync. `sc` is the canceler of the batch the
+// sync belongs to (see `newSyncCanceler`). Must be used with
+// CleanupSyncState() and
+// UpdatePointers/FinishSyncLocked() like so:
 //
 // 	fblock, bps, lbc, syncState, err :=
-//		...fbo.StartSync(ctx, lState, md, uid, file)
+//		...fbo.StartSync(ctx, lState, md, file, sc)
 //	defer func() {
 //		...fbo.CleanupSyncState(
 //			ctx, lState, md, file, ..., syncState, err)
@@ -2708,13 +4803,26 @@ func (fbo *folderBlockOps) mergeDirtyEntryWithLBC(
 //      ...fbo.FinishSyncLocked(ctx, lState, file, ..., syncState)
 //  })
 func (fbo *folderBlockOps) StartSync(ctx context.Context,
-	lState *lockState, md *RootMetadata, file path) (
+	lState *lockState, md *RootMetadata, file path, sc *syncCanceler) (
 	fblock *FileBlock, bps *blockPutState, dirtyDe *DirEntry,
 	syncState fileSyncState, err error) {
 	if jServer, err := GetJournalServer(fbo.config); err == nil {
 		jServer.dirtyOpStart(fbo.id())
 	}
 
+	func() {
+		fbo.blockLock.Lock(lState)
+		defer fbo.blockLock.Unlock(lState)
+		fbo.syncCancelers[file.tailRef()] = sc
+	}()
+
+	// Give any early puts a chance to finish, so the sync can use
+	// them instead of putting those blocks again.
+	err = fbo.waitForEarlyPuts(ctx, lState, file)
+	if err != nil {
+		return nil, nil, nil, syncState, err
+	}
+
 	fblock, bps, syncState, dirtyDe, err = fbo.startSyncWrite(
 		ctx, lState, md, file)
 	if err != nil {
@@ -2725,6 +4833,142 @@ func (fbo *folderBlockOps) StartSync(ctx context.Context,
 	return fblock, bps, dirtyDe, syncState, err
 }
 
+// readyEarlyLocked readies, and starts putting to the server, the
+// dirty leaf blocks of the given file that end at or before `off`,
+// the start of the latest write.  For a file under a long sequential
+// write, those blocks are complete, so this spreads the upload out
+// over the course of the write rather than leaving it all for the
+// next sync.  If one of these blocks is dirtied again before the
+// sync, its early put is thrown away.
+func (fbo *folderBlockOps) readyEarlyLocked(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file path,
+	off int64) error {
+	fbo.blockLock.AssertLocked(lState)
+	fblock, err := fbo.getFileLocked(ctx, lState, kmd, file, blockWrite)
+	if err != nil {
+		return err
+	}
+	if !fblock.IsInd {
+		return nil
+	}
+
+	chargedTo, err := fbo.getChargedToLocked(ctx, lState, kmd)
+	if err != nil {
+		return err
+	}
+	df := fbo.getOrCreateDirtyFileLocked(lState, file)
+	fd := fbo.newFileDataWithBlockSizeLocked(
+		ctx, lState, file, chargedTo, kmd, df.getBlockSize())
+	dirtyBcache := fbo.config.DirtyBlockCache()
+	tlfName := kmd.GetTlfHandle().GetCanonicalName()
+
+	// Pick up where the last early put of this file left off, so
+	// that a long sequential write only looks at each block once,
+	// rather than walking all of the file's dirty blocks on every
+	// write.
+	writeOff := Int64Offset(off)
+	currOff := df.getEarlyReadyOff()
+	if currOff == nil {
+		currOff = fblock.FirstOffset()
+	}
+	for ; currOff != nil; df.setEarlyReadyOff(currOff) {
+		ptr, _, block, nextBlockOff, _, err :=
+			fd.tree.getNextDirtyBlockAtOffset(
+				ctx, fblock, currOff, blockWrite, dirtyBcache)
+		if err != nil {
+			return err
+		}
+		if block == nil || nextBlockOff == nil ||
+			writeOff.Less(nextBlockOff) {
+			// No more complete dirty blocks before the write.
+			return nil
+		}
+		currOff = nextBlockOff
+
+		if df.isEarlyReadied(ptr) || df.isBlockSyncing(ptr) {
+			continue
+		}
+
+		info, _, readyBlockData, err := ReadyBlock(
+			ctx, fbo.config.BlockCache(), fbo.config.BlockOps(),
+			fbo.config.Crypto(), kmd, block, chargedTo,
+			file.tailPointer().GetBlockType())
+		if err != nil {
+			return err
+		}
+		erb := &earlyReadiedBlock{
+			info:           info,
+			readyBlockData: readyBlockData,
+			putDone:        make(chan struct{}),
+		}
+		df.addEarlyReadied(ptr, erb)
+		fbo.log.CDebugf(ctx, "Putting block %v of file %v early as %v",
+			ptr, file.tailPointer(), info.BlockPointer)
+
+		fbo.earlyPuts.Add(1)
+		go func() {
+			defer fbo.earlyPuts.Done()
+			defer close(erb.putDone)
+			ctx := CtxWithRandomIDReplayable(
+				context.Background(), CtxFBOIDKey, CtxFBOOpID, fbo.log)
+			erb.putErr = PutBlockCheckLimitErrs(
+				ctx, fbo.config.BlockServer(), fbo.config.Reporter(),
+				fbo.id(), erb.info.BlockPointer, erb.readyBlockData, tlfName)
+			if erb.putErr != nil {
+				fbo.log.CDebugf(ctx, "Early put of %v failed: %+v",
+					erb.info.BlockPointer, erb.putErr)
+			}
+		}()
+	}
+	return nil
+}
+
+// discardEarlyReadied deletes the block of an early put that won't
+// be used by a sync, once the put has finished.
+func (fbo *folderBlockOps) discardEarlyReadied(erb *earlyReadiedBlock) {
+	fbo.earlyPuts.Add(1)
+	go func() {
+		defer fbo.earlyPuts.Done()
+		<-erb.putDone
+		if erb.putErr != nil {
+			return
+		}
+		ctx := CtxWithRandomIDReplayable(
+			context.Background(), CtxFBOIDKey, CtxFBOOpID, fbo.log)
+		fbo.log.CDebugf(ctx, "Deleting unused early put %v",
+			erb.info.BlockPointer)
+		_, err := fbo.config.BlockOps().Delete(
+			ctx, fbo.id(), []BlockPointer{erb.info.BlockPointer})
+		if err != nil {
+			fbo.log.CDebugf(ctx, "Couldn't delete %v: %+v",
+				erb.info.BlockPointer, err)
+		}
+	}()
+}
+
+// waitForEarlyPuts waits for any outstanding early puts for the given
+// file to finish.
+func (fbo *folderBlockOps) waitForEarlyPuts(
+	ctx context.Context, lState *lockState, file path) error {
+	var chs []<-chan struct{}
+	func() {
+		fbo.blockLock.RLock(lState)
+		defer fbo.blockLock.RUnlock(lState)
+		df := fbo.dirtyFiles[file.tailPointer()]
+		if df != nil {
+			chs = df.earlyPutsInProgress()
+		}
+	}()
+	for _, ch := range chs {
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
 // Does any clean-up for a sync of the given file, given an error
 // (which may be nil) that happens during or after StartSync() and
 // before FinishSync(). blocksToRemove may be nil.
@@ -2736,16 +4980,27 @@ func (fbo *folderBlockOps) CleanupSyncState(
 		defer jServer.dirtyOpEnd(fbo.id())
 	}
 
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+
+	sc := fbo.syncCancelers[file.tailRef()]
+	delete(fbo.syncCancelers, file.tailRef())
 	if err == nil {
 		return
 	}
 
-	fbo.blockLock.Lock(lState)
-	defer fbo.blockLock.Unlock(lState)
+	// A sync aborted by `CancelSync` is backed out just like one that
+	// hit a recoverable block error, so that it can be retried from
+	// scratch later, and so the writers waiting on it don't see the
+	// cancellation as a failure.
+	recoverable := isRecoverableBlockError(err) ||
+		(sc != nil && sc.canceled)
 
 	// Notify error listeners before we reset the dirty blocks and
 	// permissions to be granted.
-	fbo.notifyErrListenersLocked(lState, file.tailPointer(), err)
+	if !recoverable {
+		fbo.notifyErrListenersLocked(lState, file.tailPointer(), err)
+	}
 
 	// If there was an error, we need to back out any changes that
 	// might have been filled into the sync op, because it could
@@ -2758,10 +5013,16 @@ func (fbo *folderBlockOps) CleanupSyncState(
 		result.si.toCleanIfUnused = append(result.si.toCleanIfUnused,
 			mdToCleanIfUnused{md, result.si.bps.DeepCopy()})
 	}
-	if isRecoverableBlockError(err) {
+	if recoverable {
+		if isRecoverableBlockError(err) {
+			fbo.syncRetriesCounter.Inc(1)
+		}
 		if result.si != nil {
 			fbo.revertSyncInfoAfterRecoverableError(blocksToRemove, result)
 		}
+		if df := fbo.dirtyFiles[file.tailPointer()]; df != nil {
+			df.addSplicedRefs(result.splicedRefs)
+		}
 		if result.fblock != nil {
 			result.fblock.Set(result.savedFblock)
 			fbo.fixChildBlocksAfterRecoverableErrorLocked(
@@ -2805,6 +5066,44 @@ func (fbo *folderBlockOps) CleanupSyncState(
 	}
 }
 
+// MarkBlocksPutForRetry records that the blocks in `put` made it to
+// the server during a sync of `files` that then failed
+// unrecoverably.  Those files keep their readied blocks for the
+// retry of the sync (see `CleanupSyncState`), and marking them as
+// already put saves the retry from uploading them again, which
+// matters on flaky links where the remote block server can't tell
+// us which blocks it already has.  (A journaled TLF gets the same
+// effect from its journal's record of the blocks it holds.)
+// Blocks that turn out to be unused by the retry are still cleaned
+// up through `syncInfo.toCleanIfUnused`.
+func (fbo *folderBlockOps) MarkBlocksPutForRetry(
+	ctx context.Context, lState *lockState, files []path,
+	put map[BlockPointer]bool) {
+	if len(put) == 0 {
+		return
+	}
+
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+	numMarked := 0
+	for _, file := range files {
+		si, ok := fbo.unrefCache[file.tailRef()]
+		if !ok || si.bps == nil {
+			continue
+		}
+		for i, bs := range si.bps.blockStates {
+			if put[bs.blockPtr] && !bs.alreadyPut {
+				si.bps.blockStates[i].alreadyPut = true
+				numMarked++
+			}
+		}
+	}
+	if numMarked > 0 {
+		fbo.log.CDebugf(ctx, "Marked %d blocks from the failed sync as "+
+			"already put, for the retry", numMarked)
+	}
+}
+
 // cleanUpUnusedBlocks cleans up the blocks from any previous failed
 // sync attempts.
 func (fbo *folderBlockOps) cleanUpUnusedBlocks(ctx context.Context,
@@ -2973,8 +5272,21 @@ func (fbo *folderBlockOps) notifyErrListenersLocked(lState *lockState,
 	}
 	df := fbo.dirtyFiles[ptr]
 	if df != nil {
-		df.notifyErrListeners(err)
+		df.notifyErrListeners(err, fbo.config.Clock().Now())
+	}
+}
+
+// GetSyncError returns the most recent unrecoverable error that kept
+// the given dirty file from being synced, or nil if there was none.
+func (fbo *folderBlockOps) GetSyncError(
+	lState *lockState, file path) *FileSyncError {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+	df := fbo.dirtyFiles[file.tailPointer()]
+	if df == nil {
+		return nil
 	}
+	return df.getSyncErr()
 }
 
 type searchWithOutOfDateCacheError struct {
@@ -3020,20 +5332,23 @@ func (fbo *folderBlockOps) searchForNodesInDirLocked(ctx context.Context,
 		return 0, searchWithOutOfDateCacheError{}
 	}
 
+	fbo.indexDirEntriesLocked(lState, currDir.tailPointer(), entries)
+
 	if numNodesFoundSoFar >= len(nodeMap) {
 		return 0, nil
 	}
 
 	numNodesFound := 0
 	for name, de := range entries {
-		if _, ok := nodeMap[de.BlockPointer]; ok {
+		if n, ok := nodeMap[de.BlockPointer]; ok && n == nil {
 			childPath := currDir.ChildPath(name, de.BlockPointer)
 			// make a node for every pathnode
 			n := rootNode
 			for i, pn := range childPath.path[1:] {
 				if !pn.BlockPointer.IsValid() {
-					// Temporary debugging output for KBFS-1764 -- the
-					// GetOrCreate call below will panic.
+					// Debugging output for KBFS-1764 -- the
+					// GetOrCreate call below will fail, and the
+					// folder will be marked degraded.
 					fbo.log.CDebugf(ctx, "Invalid block pointer, path=%s, "+
 						"path.path=%v (index %d), name=%s, de=%#v, "+
 						"nodeMap=%v, newPtrs=%v, kmd=%#v",
@@ -3058,7 +5373,13 @@ func (fbo *folderBlockOps) searchForNodesInDirLocked(ctx context.Context,
 			n, err := fbo.searchForNodesInDirLocked(ctx, lState, cache,
 				newPtrs, kmd, rootNode, childPath, nodeMap,
 				numNodesFoundSoFar+numNodesFound)
-			if err != nil {
+			if _, ok := errors.Cause(err).(DamagedSubtreeError); ok {
+				// Nodes under a damaged directory can't be found,
+				// but that shouldn't stop the search for the rest.
+				fbo.log.CDebugf(ctx, "Skipping damaged subtree %s: %+v",
+					childPath, err)
+				continue
+			} else if err != nil {
 				return 0, err
 			}
 			numNodesFound += n
@@ -3071,6 +5392,78 @@ func (fbo *folderBlockOps) searchForNodesInDirLocked(ctx context.Context,
 	return numNodesFound, nil
 }
 
+// indexDirEntriesLocked records the given entries of the directory
+// `dirPtr` in the parent index.  Entries of dirty directories aren't
+// indexed, since they don't match the immutable block yet.
+func (fbo *folderBlockOps) indexDirEntriesLocked(lState *lockState,
+	dirPtr BlockPointer, entries map[string]DirEntry) {
+	fbo.blockLock.AssertAnyLocked(lState)
+	if _, ok := fbo.dirtyDirs[dirPtr]; ok {
+		return
+	}
+	for name, de := range entries {
+		fbo.parentIndex.Add(
+			de.BlockPointer, parentIndexEntry{parent: dirPtr, name: name})
+	}
+}
+
+// indexUpdatesLocked carries parent index entries forward across
+// the given updates: if both a pointer and its parent were updated by
+// the same operation, the new pointer lives under the new parent with
+// the same name.
+func (fbo *folderBlockOps) indexUpdatesLocked(
+	lState *lockState, updates []blockUpdate) {
+	fbo.blockLock.AssertLocked(lState)
+	newPtrs := make(map[BlockPointer]BlockPointer, len(updates))
+	for _, update := range updates {
+		newPtrs[update.Unref] = update.Ref
+	}
+	for _, update := range updates {
+		tmp, ok := fbo.parentIndex.Peek(update.Unref)
+		if !ok {
+			continue
+		}
+		e := tmp.(parentIndexEntry)
+		newParent, ok := newPtrs[e.parent]
+		if !ok {
+			continue
+		}
+		fbo.parentIndex.Add(
+			update.Ref, parentIndexEntry{parent: newParent, name: e.name})
+	}
+}
+
+// searchParentIndex tries to resolve `ptr` to a node by following
+// the parent index up to `rootPtr`.  It returns a nil node if the
+// chain of parents doesn't reach the root.
+func (fbo *folderBlockOps) searchParentIndex(cache NodeCache,
+	rootNode Node, rootPtr BlockPointer, ptr BlockPointer) (Node, error) {
+	var chain []pathNode
+	for curr := ptr; curr != rootPtr; {
+		// Guard against cycles from stale entries.
+		if len(chain) > fbo.parentIndex.Len() {
+			return nil, nil
+		}
+		tmp, ok := fbo.parentIndex.Get(curr)
+		if !ok {
+			return nil, nil
+		}
+		e := tmp.(parentIndexEntry)
+		chain = append(chain, pathNode{BlockPointer: curr, Name: e.name})
+		curr = e.parent
+	}
+
+	n := rootNode
+	for i := len(chain) - 1; i >= 0; i-- {
+		var err error
+		n, err = cache.GetOrCreate(chain[i].BlockPointer, chain[i].Name, n)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
 func (fbo *folderBlockOps) trySearchWithCacheLocked(ctx context.Context,
 	lState *lockState, cache NodeCache, ptrs []BlockPointer,
 	newPtrs map[BlockPointer]bool, kmd KeyMetadata, rootPtr BlockPointer) (
@@ -3152,6 +5545,28 @@ func (fbo *folderBlockOps) trySearchWithCacheLocked(ctx context.Context,
 			rootPtr, rootPath)
 	}
 
+	// Resolve what we can from the parent index, and only walk the
+	// updated directories for whatever remains.
+	for ptr, n := range nodeMap {
+		if n != nil {
+			continue
+		}
+		n, err := fbo.searchParentIndex(cache, node, rootPtr, ptr)
+		if err != nil {
+			return nil, err
+		}
+		if n != nil {
+			nodeMap[ptr] = n
+			numNodesFound++
+		}
+	}
+	if numNodesFound >= len(nodeMap) {
+		if rootPtr != cache.PathFromNode(node).tailPointer() {
+			return nil, searchWithOutOfDateCacheError{}
+		}
+		return nodeMap, nil
+	}
+
 	_, err := fbo.searchForNodesInDirLocked(ctx, lState, cache, newPtrs,
 		kmd, node, rootPath, nodeMap, numNodesFound)
 	if err != nil {
@@ -3271,11 +5686,38 @@ func (fbo *folderBlockOps) getDeferredWriteCountForTest(lState *lockState) int {
 	return writes
 }
 
+// getDeferredWriteCounts returns the number of writes and truncates
+// waiting to be replayed once the current sync finishes, keyed by the
+// path of the file they belong to.
+func (fbo *folderBlockOps) getDeferredWriteCounts(
+	lState *lockState) map[string]int {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+	counts := make(map[string]int, len(fbo.deferred))
+	for ref, ds := range fbo.deferred {
+		if len(ds.writes) == 0 {
+			continue
+		}
+		name := ref.String()
+		if n := fbo.nodeCache.Get(ref); n != nil {
+			name = fbo.nodeCache.PathFromNode(n).String()
+		}
+		counts[name] += len(ds.writes)
+	}
+	return counts
+}
+
 func (fbo *folderBlockOps) updatePointer(kmd KeyMetadata, oldPtr BlockPointer, newPtr BlockPointer, shouldPrefetch bool) NodeID {
 	updatedNode := fbo.nodeCache.UpdatePointer(oldPtr.Ref(), newPtr)
 	if updatedNode == nil || oldPtr.ID == newPtr.ID {
 		return nil
 	}
+	if !fbo.isInterestingLocked(newPtr) {
+		// Keep the node up to date, but don't spend anything on
+		// fetching or reporting changes nobody subscribed to.
+		fbo.config.BlockOps().Prefetcher().CancelPrefetch(oldPtr.ID)
+		return nil
+	}
 
 	// Only prefetch if the updated pointer is a new block ID.
 	// TODO: Remove this comment when we're done debugging because it'll be everywhere.
@@ -3309,6 +5751,7 @@ func (fbo *folderBlockOps) UpdatePointers(kmd KeyMetadata, lState *lockState,
 	affectedNodeIDs []NodeID, err error) {
 	fbo.blockLock.Lock(lState)
 	defer fbo.blockLock.Unlock(lState)
+	fbo.indexUpdatesLocked(lState, op.allUpdates())
 	for _, update := range op.allUpdates() {
 		updatedNode := fbo.updatePointer(
 			kmd, update.Unref, update.Ref, shouldPrefetch)
@@ -3406,37 +5849,12 @@ func (fbo *folderBlockOps) fastForwardDirAndChildrenLocked(ctx context.Context,
 	return changes, affectedNodeIDs, nil
 }
 
-// FastForwardAllNodes attempts to update the block pointers
-// associated with nodes in the cache by searching for their paths in
-// the current version of the TLF.  If it can't find a corresponding
-// node, it assumes it's been deleted and unlinks it.  Returns the set
-// of node changes that resulted.  If there are no nodes, it returns a
-// nil error because there's nothing to be done.
-func (fbo *folderBlockOps) FastForwardAllNodes(ctx context.Context,
-	lState *lockState, md ReadOnlyRootMetadata) (
-	changes []NodeChange, affectedNodeIDs []NodeID, err error) {
-	if fbo.nodeCache == nil {
-		// Nothing needs to be done!
-		return nil, nil, nil
-	}
-
-	// Take a hard lock through this whole process.  TODO: is there
-	// any way to relax this?  It could lead to file system operation
-	// timeouts, even on reads, if we hold it too long.
-	fbo.blockLock.Lock(lState)
-	defer fbo.blockLock.Unlock(lState)
-
-	nodes := fbo.nodeCache.AllNodes()
-	if len(nodes) == 0 {
-		// Nothing needs to be done!
-		return nil, nil, nil
-	}
-	fbo.log.CDebugf(ctx, "Fast-forwarding %d nodes", len(nodes))
-	defer func() { fbo.log.CDebugf(ctx, "Fast-forward complete: %v", err) }()
-
-	// Build a "tree" representation for each interesting path prefix.
-	children := make(map[string]map[pathNode]bool)
-	var rootPath path
+// buildFastForwardTree returns, for each path prefix of the given
+// nodes, the set of child path nodes under it, along with the path of
+// the TLF root if it's among the nodes.
+func (fbo *folderBlockOps) buildFastForwardTree(nodes []Node) (
+	children map[string]map[pathNode]bool, rootPath path) {
+	children = make(map[string]map[pathNode]bool)
 	for _, n := range nodes {
 		p := fbo.nodeCache.PathFromNode(n)
 		if len(p.path) == 1 {
@@ -3455,7 +5873,17 @@ func (fbo *folderBlockOps) FastForwardAllNodes(ctx context.Context,
 			prevPath = filepath.Join(prevPath, pn.Name)
 		}
 	}
+	return children, rootPath
+}
 
+// fastForwardNodesLocked fast-forwards the given nodes, which must
+// include the root node, in one pass while holding blockLock.
+func (fbo *folderBlockOps) fastForwardNodesLocked(ctx context.Context,
+	lState *lockState, md ReadOnlyRootMetadata, nodes []Node) (
+	changes []NodeChange, affectedNodeIDs []NodeID, err error) {
+	fbo.blockLock.AssertLocked(lState)
+
+	children, rootPath := fbo.buildFastForwardTree(nodes)
 	if !rootPath.isValid() {
 		return nil, nil, errors.New("Couldn't find the root path")
 	}
@@ -3494,6 +5922,339 @@ func (fbo *folderBlockOps) FastForwardAllNodes(ctx context.Context,
 	return changes, affectedNodeIDs, nil
 }
 
+// fastForwardUpdate is a change to one cached node, found while
+// planning a fast-forward.
+type fastForwardUpdate struct {
+	oldPtr BlockPointer
+	// newPtr is the pointer of the node in the new head.  It's
+	// unset if the node no longer exists and must be unlinked.
+	newPtr   BlockPointer
+	prefetch bool
+	isDir    bool
+	// dirUpdated lists the names of the cached children of a
+	// directory.
+	dirUpdated []string
+}
+
+// planFastForwardDir returns the updates for the cached children of
+// `currDir` (which has the pointers of the new head), and for all
+// their cached descendants.  It holds blockLock for reading only
+// while it reads the entries of each directory.
+func (fbo *folderBlockOps) planFastForwardDir(ctx context.Context,
+	lState *lockState, currDir path, children map[string]map[pathNode]bool,
+	kmd KeyMetadataWithRootDirEntry) (
+	updates []fastForwardUpdate, err error) {
+	prefix := currDir.String()
+	childPNs := children[prefix]
+	delete(children, prefix)
+	if len(childPNs) == 0 {
+		return nil, nil
+	}
+
+	entries, err := func() (map[string]DirEntry, error) {
+		fbo.blockLock.RLock(lState)
+		defer fbo.blockLock.RUnlock(lState)
+		chargedTo, err := fbo.getChargedToLocked(ctx, lState, kmd)
+		if err != nil {
+			return nil, err
+		}
+		dd := fbo.newDirDataLocked(lState, currDir, chargedTo, kmd)
+		return dd.getEntries(ctx)
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	for child := range childPNs {
+		entry, ok := entries[child.Name]
+		if !ok {
+			updates = append(updates, fastForwardUpdate{
+				oldPtr: child.BlockPointer,
+			})
+			continue
+		}
+
+		update := fastForwardUpdate{
+			oldPtr:   child.BlockPointer,
+			newPtr:   entry.BlockPointer,
+			prefetch: true,
+			isDir:    entry.Type == Dir,
+		}
+		if !update.isDir {
+			updates = append(updates, update)
+			continue
+		}
+
+		childPath := currDir.ChildPath(child.Name, entry.BlockPointer)
+		for subchild := range children[childPath.String()] {
+			update.dirUpdated = append(update.dirUpdated, subchild.Name)
+		}
+		updates = append(updates, update)
+
+		childUpdates, err := fbo.planFastForwardDir(
+			ctx, lState, childPath, children, kmd)
+		if err != nil {
+			return nil, err
+		}
+		updates = append(updates, childUpdates...)
+	}
+	return updates, nil
+}
+
+// applyFastForwardUpdatesLocked applies planned fast-forward updates
+// to the node cache, and returns the resulting node changes.
+func (fbo *folderBlockOps) applyFastForwardUpdatesLocked(
+	ctx context.Context, lState *lockState, md ReadOnlyRootMetadata,
+	updates []fastForwardUpdate) (
+	changes []NodeChange, affectedNodeIDs []NodeID) {
+	fbo.blockLock.AssertLocked(lState)
+
+	for _, u := range updates {
+		if !u.newPtr.IsValid() {
+			fbo.unlinkDuringFastForwardLocked(ctx, lState, md, u.oldPtr.Ref())
+			continue
+		}
+
+		fbo.log.CDebugf(ctx, "Fast-forwarding %v -> %v", u.oldPtr, u.newPtr)
+		fbo.updatePointer(md, u.oldPtr, u.newPtr, u.prefetch)
+		node := fbo.nodeCache.Get(u.newPtr.Ref())
+		if node == nil || !fbo.isInterestingLocked(u.newPtr) {
+			continue
+		}
+		if u.isDir {
+			changes = append(changes, NodeChange{
+				Node:       node,
+				DirUpdated: u.dirUpdated,
+			})
+		} else {
+			// File -- invalidate the entire file contents.
+			changes = append(changes, NodeChange{
+				Node:        node,
+				FileUpdated: []WriteRange{{Len: 0, Off: 0}},
+			})
+		}
+		affectedNodeIDs = append(affectedNodeIDs, node.GetID())
+	}
+	return changes, affectedNodeIDs
+}
+
+// FastForwardAllNodes attempts to update the block pointers
+// associated with nodes in the cache by searching for their paths in
+// the current version of the TLF.  If it can't find a corresponding
+// node, it assumes it's been deleted and unlinks it.  Returns the set
+// of node changes that resulted.  If there are no nodes, it returns a
+// nil error because there's nothing to be done.
+//
+// It first finds all the updates while holding blockLock only for
+// reading, one directory at a time, so that other operations can
+// proceed while the new directory blocks are fetched.  It then
+// applies the updates in batches of `fastForwardBatchSize`, taking
+// blockLock for writing for each batch.  Finally, any nodes created
+// while blockLock wasn't held are fast-forwarded under a single
+// write lock.
+func (fbo *folderBlockOps) FastForwardAllNodes(ctx context.Context,
+	lState *lockState, md ReadOnlyRootMetadata) (
+	changes []NodeChange, affectedNodeIDs []NodeID, err error) {
+	if fbo.nodeCache == nil {
+		// Nothing needs to be done!
+		return nil, nil, nil
+	}
+
+	var nodes []Node
+	var children map[string]map[pathNode]bool
+	var rootPath path
+	func() {
+		fbo.blockLock.RLock(lState)
+		defer fbo.blockLock.RUnlock(lState)
+		nodes = fbo.nodeCache.AllNodes()
+		children, rootPath = fbo.buildFastForwardTree(nodes)
+	}()
+	if len(nodes) == 0 {
+		// Nothing needs to be done!
+		return nil, nil, nil
+	}
+	fbo.log.CDebugf(ctx, "Fast-forwarding %d nodes", len(nodes))
+	defer func() { fbo.log.CDebugf(ctx, "Fast-forward complete: %v", err) }()
+
+	if !rootPath.isValid() {
+		return nil, nil, errors.New("Couldn't find the root path")
+	}
+
+	fbo.log.CDebugf(ctx, "Fast-forwarding root %v -> %v",
+		rootPath.path[0].BlockPointer, md.data.Dir.BlockPointer)
+	rootUpdate := fastForwardUpdate{
+		oldPtr: rootPath.path[0].BlockPointer,
+		newPtr: md.data.Dir.BlockPointer,
+		isDir:  true,
+	}
+	for child := range children[rootPath.String()] {
+		rootUpdate.dirUpdated = append(rootUpdate.dirUpdated, child.Name)
+	}
+	newRootPath := path{
+		FolderBranch: rootPath.FolderBranch,
+		path: []pathNode{{
+			BlockPointer: md.data.Dir.BlockPointer,
+			Name:         rootPath.path[0].Name,
+		}},
+	}
+	childUpdates, err := fbo.planFastForwardDir(
+		ctx, lState, newRootPath, children, md)
+	if err != nil {
+		return nil, nil, err
+	}
+	updates := append([]fastForwardUpdate{rootUpdate}, childUpdates...)
+	// Unlink any children that remain.
+	for _, childPNs := range children {
+		for child := range childPNs {
+			updates = append(updates, fastForwardUpdate{
+				oldPtr: child.BlockPointer,
+			})
+		}
+	}
+
+	for len(updates) > 0 {
+		batch := updates
+		if len(batch) > fastForwardBatchSize {
+			batch = batch[:fastForwardBatchSize]
+		}
+		updates = updates[len(batch):]
+		func() {
+			fbo.blockLock.Lock(lState)
+			defer fbo.blockLock.Unlock(lState)
+			batchChanges, batchNodeIDs := fbo.applyFastForwardUpdatesLocked(
+				ctx, lState, md, batch)
+			changes = append(changes, batchChanges...)
+			affectedNodeIDs = append(affectedNodeIDs, batchNodeIDs...)
+		}()
+	}
+
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+	known := make(map[NodeID]bool, len(nodes))
+	for _, n := range nodes {
+		known[n.GetID()] = true
+	}
+	var lateNodes []Node
+	for _, n := range fbo.nodeCache.AllNodes() {
+		if !known[n.GetID()] {
+			lateNodes = append(lateNodes, n)
+		}
+	}
+	if len(lateNodes) == 0 {
+		return changes, affectedNodeIDs, nil
+	}
+	fbo.log.CDebugf(ctx, "Fast-forwarding %d nodes created during the "+
+		"fast-forward", len(lateNodes))
+	if rootNode := fbo.nodeCache.Get(
+		md.data.Dir.BlockPointer.Ref()); rootNode != nil {
+		lateNodes = append(lateNodes, rootNode)
+	}
+	lateChanges, lateNodeIDs, err := fbo.fastForwardNodesLocked(
+		ctx, lState, md, lateNodes)
+	if err != nil {
+		return nil, nil, err
+	}
+	changes = append(changes, lateChanges...)
+	affectedNodeIDs = append(affectedNodeIDs, lateNodeIDs...)
+	return changes, affectedNodeIDs, nil
+}
+
+// RevalidateNodes checks the cached path of each of the given nodes
+// against the directory tree of `kmd`, and returns an update for the
+// first component of each path that diverges from it.  Components
+// that no longer exist yield an update with an unset new pointer.
+// Unlinked nodes, and nodes whose root isn't the root of `kmd`, are
+// skipped.  blockLock is
+// held for reading only while each directory is read.
+func (fbo *folderBlockOps) RevalidateNodes(ctx context.Context,
+	lState *lockState, kmd KeyMetadataWithRootDirEntry, nodes []Node) (
+	[]fastForwardUpdate, error) {
+	rootPtr := kmd.GetRootDirEntry().BlockPointer
+	entriesByDir := make(map[BlockPointer]map[string]DirEntry)
+	seen := make(map[BlockPointer]bool)
+	var updates []fastForwardUpdate
+	for _, n := range nodes {
+		update, err := func() (*fastForwardUpdate, error) {
+			fbo.blockLock.RLock(lState)
+			defer fbo.blockLock.RUnlock(lState)
+			if fbo.nodeCache.IsUnlinked(n) {
+				return nil, nil
+			}
+			p := fbo.nodeCache.PathFromNode(n)
+			if !p.isValid() || p.path[0].BlockPointer != rootPtr {
+				return nil, nil
+			}
+			chargedTo, err := fbo.getChargedToLocked(ctx, lState, kmd)
+			if err != nil {
+				return nil, err
+			}
+			for i := 0; i < len(p.path)-1; i++ {
+				dirPtr := p.path[i].BlockPointer
+				entries, ok := entriesByDir[dirPtr]
+				if !ok {
+					dir := path{
+						FolderBranch: p.FolderBranch,
+						path:         p.path[:i+1],
+					}
+					dd := fbo.newDirDataLocked(lState, dir, chargedTo, kmd)
+					entries, err = dd.getEntries(ctx)
+					if err != nil {
+						return nil, err
+					}
+					entriesByDir[dirPtr] = entries
+				}
+
+				child := p.path[i+1]
+				de, ok := entries[child.Name]
+				if ok && de.BlockPointer == child.BlockPointer {
+					continue
+				}
+				// Nothing below a diverging component can be checked.
+				update := &fastForwardUpdate{oldPtr: child.BlockPointer}
+				if ok {
+					update.newPtr = de.BlockPointer
+					update.isDir = de.Type == Dir
+				}
+				return update, nil
+			}
+			return nil, nil
+		}()
+		if err != nil {
+			return nil, err
+		}
+		if update != nil && !seen[update.oldPtr] {
+			seen[update.oldPtr] = true
+			updates = append(updates, *update)
+		}
+	}
+	return updates, nil
+}
+
+// ApplyRevalidationUpdates applies the updates found by
+// RevalidateNodes to the node cache, skipping any node whose pointer
+// has changed since.  It returns the resulting node changes.
+func (fbo *folderBlockOps) ApplyRevalidationUpdates(ctx context.Context,
+	lState *lockState, md ReadOnlyRootMetadata, updates []fastForwardUpdate) (
+	changes []NodeChange, affectedNodeIDs []NodeID) {
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+	current := make([]fastForwardUpdate, 0, len(updates))
+	for _, u := range updates {
+		if fbo.nodeCache.Get(u.oldPtr.Ref()) == nil {
+			continue
+		}
+		if u.newPtr.IsValid() {
+			fbo.log.CDebugf(ctx, "Revalidation: %v is now %v",
+				u.oldPtr, u.newPtr)
+		} else {
+			fbo.log.CDebugf(ctx, "Revalidation: %v no longer exists",
+				u.oldPtr)
+		}
+		current = append(current, u)
+	}
+	return fbo.applyFastForwardUpdatesLocked(ctx, lState, md, current)
+}
+
 type chainsPathPopulator interface {
 	populateChainPaths(context.Context, logger.Logger, *crChains, bool) error
 }
@@ -6,13 +6,17 @@ package libkbfs
 
 import (
 	"fmt"
+	"io"
+	"math/rand"
 	"os"
 	"reflect"
+	"runtime/debug"
 	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	lru "github.com/hashicorp/golang-lru"
 	"github.com/keybase/backoff"
 	kbname "github.com/keybase/client/go/kbun"
 	"github.com/keybase/client/go/libkb"
@@ -87,8 +91,6 @@ const (
 	maxMDsAtATime = 10
 	// Cap the number of times we retry after a recoverable error
 	maxRetriesOnRecoverableErrors = 10
-	// When the number of dirty bytes exceeds this level, force a sync.
-	dirtyBytesThreshold = maxParallelBlockPuts * MaxBlockSizeBytesDefault
 	// The timeout for any background task.
 	backgroundTaskTimeout = 1 * time.Minute
 	// If it's been more than this long since our last update, check
@@ -97,6 +99,20 @@ const (
 	// If there are more than this many new revisions, fast forward
 	// rather than downloading them all.
 	fastForwardRevThresh = 50
+	// The max number of directory ops put into a single MD revision
+	// during a recursive or batched operation.
+	maxDirOpsPerBatch = 1000
+	// CopyFileRange syncs the TLF each time it has copied this many
+	// blocks since the last sync (see `streamBlockBytes`).
+	writeStreamSyncBlocks = 8
+	// How often the background revalidator checks a sample of the
+	// cached nodes against the current head.
+	revalidatePeriod = 10 * time.Minute
+	// The max number of cached nodes checked in each revalidation.
+	revalidateSampleSize = 20
+	// How often the background freshness checker makes sure a synced
+	// TLF's cached blocks match its latest known revision.
+	freshnessCheckPeriod = 15 * time.Minute
 )
 
 type fboMutexLevel mutexLevel
@@ -145,22 +161,78 @@ func makeFBOLockState() *lockState {
 }
 
 // blockLock is just like a sync.RWMutex, but with an extra operation
-// (DoRUnlockedIfPossible).
+// (DoRUnlockedIfPossible).  If `profiler` is enabled, it records how
+// long each caller waits for and holds the lock.
 type blockLock struct {
 	leveledRWMutex
 	locked bool
+
+	profiler *LockProfiler
+	// writeHold is protected by the write lock itself; readHolds
+	// is protected by holdsLock.
+	writeHold lockHold
+	holdsLock sync.Mutex
+	readHolds map[*lockState]lockHold
 }
 
 func (bl *blockLock) Lock(lState *lockState) {
+	if !bl.profiler.Enabled() {
+		bl.leveledRWMutex.Lock(lState)
+		bl.locked = true
+		bl.writeHold = lockHold{}
+		return
+	}
+	op := lockCallerOp(1)
+	start := bl.profiler.startWait(op)
 	bl.leveledRWMutex.Lock(lState)
 	bl.locked = true
+	bl.writeHold = lockHold{op, bl.profiler.endWait(op, start)}
 }
 
 func (bl *blockLock) Unlock(lState *lockState) {
+	if bl.writeHold.op != "" {
+		bl.profiler.recordHold(bl.writeHold.op, bl.writeHold.start)
+		bl.writeHold = lockHold{}
+	}
 	bl.locked = false
 	bl.leveledRWMutex.Unlock(lState)
 }
 
+func (bl *blockLock) RLock(lState *lockState) {
+	if !bl.profiler.Enabled() || lState == nil {
+		bl.leveledRWMutex.RLock(lState)
+		return
+	}
+	op := lockCallerOp(1)
+	start := bl.profiler.startWait(op)
+	bl.leveledRWMutex.RLock(lState)
+	hold := lockHold{op, bl.profiler.endWait(op, start)}
+	bl.holdsLock.Lock()
+	defer bl.holdsLock.Unlock()
+	if bl.readHolds == nil {
+		bl.readHolds = make(map[*lockState]lockHold)
+	}
+	bl.readHolds[lState] = hold
+}
+
+func (bl *blockLock) RUnlock(lState *lockState) {
+	// A hold recorded just before the profiler was disabled is left
+	// in readHolds; there are at most as many of those as there were
+	// readers at the time.
+	if !bl.profiler.Enabled() || lState == nil {
+		bl.leveledRWMutex.RUnlock(lState)
+		return
+	}
+	bl.holdsLock.Lock()
+	hold, ok := bl.readHolds[lState]
+	delete(bl.readHolds, lState)
+	bl.holdsLock.Unlock()
+	if ok {
+		bl.profiler.recordHold(hold.op, hold.start)
+	}
+	bl.leveledRWMutex.RUnlock(lState)
+}
+
 // DoRUnlockedIfPossible must be called when r- or w-locked. If
 // r-locked, r-unlocks, runs the given function, and r-locks after
 // it's done. Otherwise, just runs the given function.
@@ -249,6 +321,11 @@ type editChannelActivity struct {
 // blocks, so we can't just reuse the blocks that were modified during
 // the sync.)
 type folderBranchOps struct {
+	// lastUsed is set atomically by KBFSOpsStandard whenever this
+	// folder branch is accessed, and must be the first field for
+	// 64-bit atomic alignment.
+	lastUsed uint64
+
 	config       Config
 	folderBranch FolderBranch
 	unmergedBID  kbfsmd.BranchID // protected by mdWriterLock
@@ -259,12 +336,21 @@ type folderBranchOps struct {
 	// should only be taken in the following order to avoid deadlock:
 	mdWriterLock leveledMutex // taken by any method making MD modifications
 	dirOps       []cachedDirOp
-
-	// protects access to head, headStatus, latestMergedRevision,
-	// and hasBeenCleared.
+	// The share link block references to remove from the block
+	// server once the dirOp that removed each link's record is
+	// synced; protected by mdWriterLock.
+	shareLinkRevocations map[op]kbfsblock.ContextMap
+	// When syncs started failing for being over quota, or zero if
+	// the last one didn't; protected by mdWriterLock.
+	overQuotaSince time.Time
+
+	// protects access to head, headStatus, blockSize,
+	// latestMergedRevision, and hasBeenCleared.
 	headLock   leveledRWMutex
 	head       ImmutableRootMetadata
 	headStatus headTrustStatus
+	// blockSize is the TLF block size last applied from the head.
+	blockSize int64
 	// latestMergedRevision tracks the latest heard merged revision on server
 	latestMergedRevision kbfsmd.Revision
 	// Has this folder ever been cleared?
@@ -302,6 +388,15 @@ type folderBranchOps struct {
 	identifyDone bool
 	identifyTime time.Time
 
+	// The cached content policy of this team TLF, and the version of
+	// the policy file it was read from.  A policy file that can't be
+	// verified isn't cached, but it's only reported once.
+	teamPolicyLock        sync.Mutex
+	teamPolicyLoaded      bool
+	teamPolicyKey         teamPolicyKey
+	teamPolicy            TeamContentPolicy
+	teamPolicyReportedKey teamPolicyKey
+
 	// The current status summary for this folder
 	status *folderBranchStatusKeeper
 
@@ -351,9 +446,24 @@ type folderBranchOps struct {
 	mdFlushes          kbfssync.RepeatedWaitGroup
 	forcedFastForwards kbfssync.RepeatedWaitGroup
 	merkleFetches      kbfssync.RepeatedWaitGroup
+	forgottenNodes     kbfssync.RepeatedWaitGroup
 	editActivity       kbfssync.RepeatedWaitGroup
+	asyncSyncs         kbfssync.RepeatedWaitGroup
 	launchEditMonitor  sync.Once
 
+	// Protects the ticket of the most recent SyncAllAsync call.
+	syncTicketLock sync.Mutex
+	lastSyncTicket SyncTicket
+
+	// Protects the set of write-through files.
+	writeThroughLock  sync.RWMutex
+	writeThroughNodes map[NodeID]bool
+
+	watches *folderWatches
+	// watchReporters tracks the goroutine reporting watch events,
+	// if any, so that shutdown can wait for it.
+	watchReporters kbfssync.RepeatedWaitGroup
+
 	muLastGetHead sync.Mutex
 	// We record a timestamp everytime getHead or getTrustedHead is called, and
 	// use this as a heuristic for whether user is actively using KBFS. If user
@@ -400,8 +510,8 @@ func newFolderBranchOps(
 	tlfStringFull := fb.Tlf.String()
 	// Shorten the TLF ID for the module name.  8 characters should be
 	// unique enough for a local node.
-	log := config.MakeLogger(fmt.Sprintf("FBO %s%s", tlfStringFull[:8],
-		branchSuffix))
+	log := logWithTlfID(config.MakeLogger(fmt.Sprintf("FBO %s%s",
+		tlfStringFull[:8], branchSuffix)), fb.Tlf)
 	// But print it out once in full, just in case.
 	log.CInfof(ctx, "Created new folder-branch for %s", tlfStringFull)
 
@@ -413,6 +523,17 @@ func newFolderBranchOps(
 
 	forceSyncChan := make(chan struct{})
 
+	parentIndex, err := lru.New(parentIndexCapacity)
+	if err != nil {
+		panic(err)
+	}
+	allocatedSizes, err := lru.New(allocatedSizesCapacity)
+	if err != nil {
+		panic(err)
+	}
+
+	sink := metricsSinkOrNull(config)
+
 	fbo := &folderBranchOps{
 		config:       config,
 		folderBranch: fb,
@@ -430,12 +551,23 @@ func newFolderBranchOps(
 			forceSyncChan: forceSyncChan,
 			blockLock: blockLock{
 				leveledRWMutex: blockLockMu,
+				profiler:       config.BlockLockProfiler(),
 			},
-			dirtyFiles: make(map[BlockPointer]*dirtyFile),
-			deferred:   make(map[BlockRef]deferredState),
-			unrefCache: make(map[BlockRef]*syncInfo),
-			dirtyDirs:  make(map[BlockPointer][]BlockInfo),
-			nodeCache:  nodeCache,
+			dirtyFiles:     make(map[BlockPointer]*dirtyFile),
+			deferred:       make(map[BlockRef]deferredState),
+			unrefCache:     make(map[BlockRef]*syncInfo),
+			dirtyDirs:      make(map[BlockPointer][]BlockInfo),
+			dirEntryCounts: make(map[BlockPointer]int),
+			nodeCache:      nodeCache,
+			parentIndex:    parentIndex,
+			allocatedSizes: allocatedSizes,
+			readRepairs:    newBlockReadRepairer(),
+			syncCancelers:  make(map[BlockRef]*syncCanceler),
+			deferredWritesCounter: sink.Counter(
+				"FolderBlockOps.DeferredWrites"),
+			redirtiesCounter: sink.Counter("FolderBlockOps.Redirties"),
+			syncRetriesCounter: sink.Counter(
+				"FolderBlockOps.SyncRetries"),
 		},
 		nodeCache:       nodeCache,
 		log:             traceLogger{log},
@@ -446,6 +578,7 @@ func newFolderBranchOps(
 		syncNeededChan:  make(chan struct{}, 1),
 		editHistory:     kbfsedits.NewTlfHistory(),
 		editChannels:    make(chan editChannelActivity, 100),
+		watches:         newFolderWatches(),
 	}
 	fbo.prepper = folderUpdatePrepper{
 		config:       config,
@@ -456,8 +589,15 @@ func newFolderBranchOps(
 	fbo.cr = NewConflictResolver(config, fbo)
 	fbo.fbm = newFolderBlockManager(appStateUpdater, config, fb, bType, fbo)
 	fbo.rekeyFSM = NewRekeyFSM(fbo)
+	if nodeCache != nil {
+		nodeCache.SetUnlinkedForgetHandler(fbo.forgetUnlinkedNode)
+	}
 	if config.DoBackgroundFlushes() && bType == standard {
 		go fbo.backgroundFlusher()
+		if nodeCache != nil {
+			go fbo.backgroundRevalidator()
+		}
+		go fbo.backgroundFreshnessChecker()
 	}
 
 	return fbo
@@ -501,6 +641,9 @@ func (fbo *folderBranchOps) Shutdown(ctx context.Context) error {
 
 	close(fbo.shutdownChan)
 	fbo.merkleFetches.Wait(ctx)
+	fbo.forgottenNodes.Wait(ctx)
+	fbo.watchReporters.Wait(ctx)
+	fbo.blocks.earlyPuts.Wait(ctx)
 	fbo.cr.Shutdown()
 	fbo.fbm.shutdown()
 	fbo.rekeyFSM.Shutdown()
@@ -539,6 +682,11 @@ func (fbo *folderBranchOps) AddFavorite(ctx context.Context,
 	return errors.New("AddFavorite is not supported by folderBranchOps")
 }
 
+func (fbo *folderBranchOps) ConfigureTlfs(ctx context.Context,
+	reqs []TlfConfigRequest) ([]error, error) {
+	return nil, errors.New("ConfigureTlfs is not supported by folderBranchOps")
+}
+
 func (fbo *folderBranchOps) addToFavorites(ctx context.Context,
 	favorites *Favorites, created bool) (err error) {
 	lState := makeFBOLockState()
@@ -875,9 +1023,15 @@ func (fbo *folderBranchOps) setHeadLocked(
 	}
 
 	fbo.head = md
+	fbo.applyBlockSizeLocked(ctx, lState, md)
 	if isFirstHead && headStatus == headTrusted {
 		fbo.headStatus = headTrusted
 	}
+	if !isFirstHead && md.MergedStatus() == kbfsmd.Merged &&
+		fbo.watches.queue(md) {
+		fbo.watchReporters.Add(1)
+		go fbo.reportWatchEvents()
+	}
 	fbo.status.setRootMetadata(md)
 	if isFirstHead {
 		// Start registering for updates right away, using this MD
@@ -1660,6 +1814,31 @@ func (fbo *folderBranchOps) GetRootNode(
 	return nil, EntryInfo{}, errors.New("GetRootNode is not supported by folderBranchOps")
 }
 
+func (fbo *folderBranchOps) ReadFileAt(
+	ctx context.Context, p string) ([]byte, error) {
+	return nil, errors.New("ReadFileAt is not supported by folderBranchOps")
+}
+
+func (fbo *folderBranchOps) WriteFileAt(
+	ctx context.Context, p string, data []byte) error {
+	return errors.New("WriteFileAt is not supported by folderBranchOps")
+}
+
+func (fbo *folderBranchOps) StatAt(
+	ctx context.Context, p string) (EntryInfo, error) {
+	return EntryInfo{}, errors.New("StatAt is not supported by folderBranchOps")
+}
+
+func (fbo *folderBranchOps) ListAt(
+	ctx context.Context, p string) (map[string]EntryInfo, error) {
+	return nil, errors.New("ListAt is not supported by folderBranchOps")
+}
+
+func (fbo *folderBranchOps) StatMany(
+	ctx context.Context, paths []string) (map[string]DirEntry, error) {
+	return nil, errors.New("StatMany is not supported by folderBranchOps")
+}
+
 func (fbo *folderBranchOps) checkNode(node Node) error {
 	fb := node.GetFolderBranch()
 	if fb != fbo.folderBranch {
@@ -1668,17 +1847,74 @@ func (fbo *folderBranchOps) checkNode(node Node) error {
 	return nil
 }
 
+// isCorruptionError returns true if `err` means that some of the
+// folder's data violates an invariant, rather than that it couldn't
+// be fetched or that this client is too old to understand it.
+func isCorruptionError(err error) bool {
+	switch errors.Cause(err).(type) {
+	case InvalidDataVersionError, InvalidBlockRefError,
+		FolderCorruptionError:
+		return true
+	default:
+		return false
+	}
+}
+
+// markDegraded marks this folder-branch as degraded because of
+// `err`, and returns `err` as a FolderCorruptionError.
+func (fbo *folderBranchOps) markDegraded(
+	ctx context.Context, err error) error {
+	if _, ok := errors.Cause(err).(FolderCorruptionError); !ok {
+		err = errors.WithStack(FolderCorruptionError{fbo.id(), err})
+	}
+	fbo.log.CWarningf(ctx, "Marking folder degraded: %+v", err)
+	fbo.status.setDegraded(err)
+	return err
+}
+
+// recoverCorruption must be deferred directly by functions that
+// operate on the folder's data.  It turns a panic, or a returned
+// corruption error, into a FolderCorruptionError in `*err` and marks
+// the folder-branch degraded, so that a single corrupt folder can't
+// take down the whole process.  Any locks held when the panic
+// happened must be released by defers for this to be safe.
+func (fbo *folderBranchOps) recoverCorruption(
+	ctx context.Context, err *error) {
+	if r := recover(); r != nil {
+		fbo.log.CErrorf(ctx, "Recovered from panic: %v\n%s",
+			r, debug.Stack())
+		*err = fbo.markDegraded(ctx, errors.Errorf("panic: %v", r))
+	} else if isCorruptionError(*err) {
+		*err = fbo.markDegraded(ctx, *err)
+	}
+}
+
+// runUnlessCanceled is like the package-level runUnlessCanceled, but
+// recovers from corruption in `fn` using recoverCorruption.
+func (fbo *folderBranchOps) runUnlessCanceled(
+	ctx context.Context, fn func() error) error {
+	return runUnlessCanceled(ctx, func() (err error) {
+		defer fbo.recoverCorruption(ctx, &err)
+		return fn()
+	})
+}
+
 func (fbo *folderBranchOps) checkNodeForWrite(
 	ctx context.Context, node Node) error {
 	err := fbo.checkNode(node)
 	if err != nil {
 		return err
 	}
-	if !node.Readonly(ctx) {
+	// Don't risk compounding any corruption that's been found.
+	if err := fbo.status.getDegraded(); err != nil {
+		return err
+	}
+	if !node.Readonly(ctx) && fbo.config.Mode().DirtyBlockCacheEnabled() {
 		return nil
 	}
 
-	// This is a read-only node, so reject the write.
+	// This is a read-only node, or there's no dirty block cache to
+	// hold the write, so reject it.
 	p, err := fbo.pathFromNodeForRead(node)
 	if err != nil {
 		return err
@@ -1686,6 +1922,269 @@ func (fbo *folderBranchOps) checkNodeForWrite(
 	return WriteToReadonlyNodeError{p.String()}
 }
 
+// teamPolicyKey identifies the version of the policy file that a
+// cached team content policy was read from.
+type teamPolicyKey struct {
+	exists bool
+	ptr    BlockPointer
+	size   uint64
+	mtime  int64
+}
+
+// getTeamContentPolicy returns the content policy of this TLF as of
+// `md`, if it belongs to a team.  The policy is cached until its file
+// changes.  A policy file that can't be verified as signed by a
+// current device of a team admin is reported, and until an admin
+// signs a new one, the TLF is treated as if its policy made the whole
+// thing admin-only and retention-locked.
+func (fbo *folderBranchOps) getTeamContentPolicy(
+	ctx context.Context, lState *lockState, md KeyMetadataWithRootDirEntry) (
+	TeamContentPolicy, error) {
+	h := md.GetTlfHandle()
+	if h.Type() != tlf.SingleTeam {
+		return TeamContentPolicy{}, nil
+	}
+
+	rootPath := path{fbo.folderBranch, []pathNode{{
+		md.GetRootDirEntry().BlockPointer,
+		string(h.GetCanonicalName())}}}
+	filePath := rootPath.ChildPathNoPtr(teamContentPolicyFileName)
+	de, err := fbo.blocks.GetEntry(ctx, lState, md, filePath)
+	var key teamPolicyKey
+	switch errors.Cause(err).(type) {
+	case nil:
+		key = teamPolicyKey{true, de.BlockPointer, de.Size, de.Mtime}
+	case NoSuchNameError:
+	default:
+		return TeamContentPolicy{}, err
+	}
+
+	fbo.teamPolicyLock.Lock()
+	defer fbo.teamPolicyLock.Unlock()
+	if fbo.teamPolicyLoaded && fbo.teamPolicyKey == key {
+		return fbo.teamPolicy, nil
+	}
+
+	var policy TeamContentPolicy
+	if key.exists {
+		tid, err := h.FirstResolvedWriter().AsTeam()
+		if err != nil {
+			return TeamContentPolicy{}, err
+		}
+		buf, err := fbo.blocks.ReadAll(ctx, lState, md,
+			rootPath.ChildPath(teamContentPolicyFileName, de.BlockPointer),
+			maxTeamContentPolicyBytes)
+		if err != nil {
+			return TeamContentPolicy{}, err
+		}
+		policy, err = decodeTeamContentPolicy(
+			ctx, fbo.config, tid, fbo.id(), buf)
+		if err != nil {
+			// The verification may have failed for a transient
+			// reason, so check again next time.
+			fbo.log.CWarningf(ctx, "Restricting the TLF to admins, since "+
+				"its team content policy can't be verified: %+v", err)
+			if fbo.teamPolicyReportedKey != key {
+				fbo.config.Reporter().ReportErr(ctx, h.GetCanonicalName(),
+					h.Type(), ReadMode, InvalidTeamContentPolicyError{err})
+				fbo.teamPolicyReportedKey = key
+			}
+			return restrictedTeamContentPolicy, nil
+		}
+	}
+	fbo.teamPolicyKey = key
+	fbo.teamPolicy = policy
+	fbo.teamPolicyLoaded = true
+	return policy, nil
+}
+
+// isRetentionLocked implements the fbmHelper interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) isRetentionLocked(
+	ctx context.Context, md ImmutableRootMetadata) (bool, error) {
+	policy, err := fbo.getTeamContentPolicy(ctx, makeFBOLockState(), md)
+	if err != nil {
+		return false, err
+	}
+	return policy.RetentionLock, nil
+}
+
+// checkTeamContentPolicy returns an error if the content policy of
+// the team that owns this TLF doesn't let the current user change
+// the entry at `p`.  If `named` is true, the change gives the entry
+// its name, so the name's extension is checked too; if `size` is
+// non-zero, it's the size the file will have after the change.
+func (fbo *folderBranchOps) checkTeamContentPolicy(
+	ctx context.Context, lState *lockState, md KeyMetadataWithRootDirEntry,
+	p path, named bool, size uint64) error {
+	policy, err := fbo.getTeamContentPolicy(ctx, lState, md)
+	if err != nil {
+		return err
+	}
+	if policy.isEmpty() {
+		return nil
+	}
+	tid, err := md.GetTlfHandle().FirstResolvedWriter().AsTeam()
+	if err != nil {
+		return err
+	}
+	session, err := fbo.config.KBPKI().GetCurrentSession(ctx)
+	if err != nil {
+		return err
+	}
+	role, err := fbo.config.KBPKI().GetTeamRole(ctx, tid, session.UID)
+	if err != nil {
+		return err
+	}
+
+	relPath := p.tlfRelativeString()
+	if err := policy.checkSubtrees(relPath, session.UID, role); err != nil {
+		return err
+	}
+	if named {
+		if err := policy.checkName(relPath); err != nil {
+			return err
+		}
+	}
+	if size > 0 {
+		return policy.checkSize(relPath, size)
+	}
+	return nil
+}
+
+// getEntryAtRelPath returns the entry at the slash-separated,
+// TLF-relative `relPath` in `md`, and false if there isn't one.
+func (fbo *folderBranchOps) getEntryAtRelPath(
+	ctx context.Context, lState *lockState, md ImmutableRootMetadata,
+	relPath string) (DirEntry, bool, error) {
+	de := md.data.Dir
+	if relPath == "" {
+		return de, true, nil
+	}
+	p := path{fbo.folderBranch, []pathNode{{
+		de.BlockPointer, string(md.GetTlfHandle().GetCanonicalName())}}}
+	for _, name := range strings.Split(relPath, "/") {
+		if de.Type != Dir {
+			return DirEntry{}, false, nil
+		}
+		var err error
+		de, err = fbo.blocks.GetEntry(
+			ctx, lState, md.ReadOnly(), p.ChildPathNoPtr(name))
+		if _, ok := errors.Cause(err).(NoSuchNameError); ok {
+			return DirEntry{}, false, nil
+		} else if err != nil {
+			return DirEntry{}, false, err
+		}
+		p = p.ChildPath(name, de.BlockPointer)
+	}
+	return de, true, nil
+}
+
+// checkTeamSubtreeWriters returns an error if `rmd`, written by
+// another device on top of `prevMD`, changes a subtree of this team
+// TLF that the team's content policy doesn't let its writer change.
+// Any change within a subtree changes the entry of its root, so only
+// the roots need to be compared.
+func (fbo *folderBranchOps) checkTeamSubtreeWriters(
+	ctx context.Context, lState *lockState,
+	prevMD, rmd ImmutableRootMetadata) error {
+	h := rmd.GetTlfHandle()
+	if h.Type() != tlf.SingleTeam || rmd.IsWriterMetadataCopiedSet() ||
+		prevMD == (ImmutableRootMetadata{}) {
+		return nil
+	}
+	policy, err := fbo.getTeamContentPolicy(ctx, lState, prevMD)
+	if err != nil {
+		return err
+	}
+	if policy.isEmpty() {
+		return nil
+	}
+	tid, err := h.FirstResolvedWriter().AsTeam()
+	if err != nil {
+		return err
+	}
+	writer := rmd.LastModifyingWriter()
+	role, err := fbo.config.KBPKI().GetTeamRole(ctx, tid, writer)
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range policy.ReadOnlySubtrees {
+		if rule.allows(writer, role) {
+			continue
+		}
+		subtree := strings.Trim(rule.Path, "/")
+		prevDe, prevOk, err := fbo.getEntryAtRelPath(
+			ctx, lState, prevMD, subtree)
+		if err != nil {
+			return err
+		}
+		de, ok, err := fbo.getEntryAtRelPath(ctx, lState, rmd, subtree)
+		if err != nil {
+			return err
+		}
+		if ok == prevOk && (!ok || (de.BlockPointer == prevDe.BlockPointer &&
+			de.Ctime == prevDe.Ctime)) {
+			continue
+		}
+		return UnauthorizedSubtreeWriteError{
+			rmd.Revision(), writer,
+			TeamReadOnlySubtreeError{subtree, subtree, rule.MinWriteRole}}
+	}
+	return nil
+}
+
+// checkMergedMDUpdates checks the given merged MDs, in order, against
+// the team's subtree write rules, each one against the revision
+// before it, starting from the current merged head.  It returns the
+// MDs before the first one that can't be applied, along with the
+// reason: an UnauthorizedSubtreeWriteError if it breaks the rules, a
+// kbfsmd.MDRevisionMismatch if there's a gap before it, or whatever
+// error kept it from being checked.  In the latter two cases the
+// caller should retry later; no revision is ever applied without
+// being checked.  The check may fetch blocks, so the caller must not
+// hold headLock.
+func (fbo *folderBranchOps) checkMergedMDUpdates(ctx context.Context,
+	lState *lockState, rmds []ImmutableRootMetadata) (
+	[]ImmutableRootMetadata, error) {
+	prevMD := func() ImmutableRootMetadata {
+		fbo.headLock.RLock(lState)
+		defer fbo.headLock.RUnlock(lState)
+		return fbo.head
+	}()
+	if prevMD == (ImmutableRootMetadata{}) ||
+		prevMD.MergedStatus() != kbfsmd.Merged {
+		// Unmerged heads don't take merged updates anyway.
+		return rmds, nil
+	}
+	for i, rmd := range rmds {
+		if rmd.Revision() <= prevMD.Revision() {
+			continue
+		} else if rmd.Revision() != prevMD.Revision()+1 {
+			// There's nothing to compare this one against.
+			return rmds[:i], kbfsmd.MDRevisionMismatch{
+				Rev: rmd.Revision(), Curr: prevMD.Revision()}
+		}
+		err := fbo.checkTeamSubtreeWriters(ctx, lState, prevMD, rmd)
+		if _, ok := err.(UnauthorizedSubtreeWriteError); ok {
+			fbo.log.CWarningf(ctx, "Rejecting revision %d: %v",
+				rmd.Revision(), err)
+			h := rmd.GetTlfHandle()
+			fbo.config.Reporter().ReportErr(ctx, h.GetCanonicalName(),
+				h.Type(), ReadMode, err)
+			return rmds[:i], err
+		} else if err != nil {
+			fbo.log.CDebugf(ctx, "Couldn't check revision %d against "+
+				"the team policy; stopping before it: %+v",
+				rmd.Revision(), err)
+			return rmds[:i], err
+		}
+		prevMD = rmd
+	}
+	return rmds, nil
+}
+
 // SetInitialHeadFromServer sets the head to the given
 // ImmutableRootMetadata, which must be retrieved from the MD server.
 func (fbo *folderBranchOps) SetInitialHeadFromServer(
@@ -1726,7 +2225,7 @@ func (fbo *folderBranchOps) SetInitialHeadFromServer(
 		return nil
 	}
 
-	return runUnlessCanceled(ctx, func() error {
+	return fbo.runUnlessCanceled(ctx, func() error {
 		if md.TlfID() != fbo.id() {
 			return WrongOpsError{
 				fbo.folderBranch, FolderBranch{md.TlfID(), MasterBranch}}
@@ -1801,7 +2300,7 @@ func (fbo *folderBranchOps) SetInitialHeadToNew(
 		return err
 	}
 
-	return runUnlessCanceled(ctx, func() error {
+	return fbo.runUnlessCanceled(ctx, func() error {
 		// New heads can only be set for the MasterBranch.
 		fb := FolderBranch{rmd.TlfID(), MasterBranch}
 		if fb != fbo.folderBranch {
@@ -1935,7 +2434,7 @@ func (fbo *folderBranchOps) GetDirChildren(ctx context.Context, dir Node) (
 	}
 
 	var retChildren map[string]EntryInfo
-	err = runUnlessCanceled(ctx, func() error {
+	err = fbo.runUnlessCanceled(ctx, func() error {
 		retChildren, err = fbo.getDirChildren(ctx, dir)
 		return err
 	})
@@ -1951,7 +2450,7 @@ func (fbo *folderBranchOps) GetDirChildren(ctx context.Context, dir Node) (
 		}
 
 		fbo.log.CDebugf(ctx, "Retrying GetDirChildren of an empty directory")
-		err = runUnlessCanceled(ctx, func() error {
+		err = fbo.runUnlessCanceled(ctx, func() error {
 			retChildren, err = fbo.getDirChildren(ctx, dir)
 			return err
 		})
@@ -1960,9 +2459,44 @@ func (fbo *folderBranchOps) GetDirChildren(ctx context.Context, dir Node) (
 		}
 	}
 
+	fbo.noteAccess(dir)
 	return retChildren, nil
 }
 
+// WalkTLF implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) WalkTLF(
+	ctx context.Context, dir Node, walkFn WalkTLFFunc) (err error) {
+	fbo.log.CDebugf(ctx, "WalkTLF %s", getNodeIDStr(dir))
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "WalkTLF %s done: %+v",
+			getNodeIDStr(dir), err)
+	}()
+
+	err = fbo.checkNode(dir)
+	if err != nil {
+		return err
+	}
+
+	dirPath, err := fbo.pathFromNodeForRead(dir)
+	if err != nil {
+		return err
+	}
+
+	if fbo.nodeCache.IsUnlinked(dir) {
+		fbo.log.CDebugf(ctx, "Nothing to walk in unlinked directory %v",
+			dirPath.tailPointer())
+		return nil
+	}
+
+	lState := makeFBOLockState()
+	md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+	if err != nil {
+		return err
+	}
+
+	return fbo.blocks.WalkDir(ctx, md.ReadOnly(), dirPath, walkFn)
+}
+
 func (fbo *folderBranchOps) processMissedLookup(
 	ctx context.Context, dir Node, name string, missErr error) (
 	node Node, ei EntryInfo, err error) {
@@ -2038,7 +2572,7 @@ func (fbo *folderBranchOps) Lookup(ctx context.Context, dir Node, name string) (
 	// `node`, so use a new param for that.
 	var n Node
 	var de DirEntry
-	err = runUnlessCanceled(ctx, func() error {
+	err = fbo.runUnlessCanceled(ctx, func() error {
 		var err error
 		n, de, err = fbo.lookup(ctx, dir, name)
 		return err
@@ -2058,7 +2592,7 @@ func (fbo *folderBranchOps) Lookup(ctx context.Context, dir Node, name string) (
 		}
 
 		fbo.log.CDebugf(ctx, "Retrying lookup of an empty directory")
-		err = runUnlessCanceled(ctx, func() error {
+		err = fbo.runUnlessCanceled(ctx, func() error {
 			var err error
 			n, de, err = fbo.lookup(ctx, dir, name)
 			return err
@@ -2102,6 +2636,35 @@ func (fbo *folderBranchOps) statEntry(ctx context.Context, node Node) (
 		ctx, lState, md.ReadOnly(), nodePath)
 }
 
+// statEntries returns the directory entries for the given names in
+// `dir`, leaving out any that don't exist.
+func (fbo *folderBranchOps) statEntries(
+	ctx context.Context, dir Node, names []string) (
+	entries map[string]DirEntry, err error) {
+	fbo.log.CDebugf(ctx, "StatEntries %s (%d names)",
+		getNodeIDStr(dir), len(names))
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "StatEntries %s done: %+v",
+			getNodeIDStr(dir), err)
+	}()
+
+	err = fbo.checkNode(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if fbo.nodeCache.IsUnlinked(dir) {
+		return nil, nil
+	}
+
+	lState := makeFBOLockState()
+	md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+	if err != nil {
+		return nil, err
+	}
+	return fbo.blocks.LookupEntries(ctx, lState, md.ReadOnly(), dir, names)
+}
+
 var zeroPtr BlockPointer
 
 type blockState struct {
@@ -2110,6 +2673,12 @@ type blockState struct {
 	readyBlockData ReadyBlockData
 	syncedCb       func() error
 	oldPtr         BlockPointer
+	// alreadyPut is true if the block was put to the server before
+	// the sync started (see folderBlockOps.readyEarlyLocked).
+	alreadyPut bool
+	// trafficPath is the TLF-relative path the block belongs to, for
+	// the block traffic log, if known.
+	trafficPath string
 }
 
 func (fbo *folderBranchOps) Stat(ctx context.Context, node Node) (
@@ -2121,7 +2690,7 @@ func (fbo *folderBranchOps) Stat(ctx context.Context, node Node) (
 	}()
 
 	var de DirEntry
-	err = runUnlessCanceled(ctx, func() error {
+	err = fbo.runUnlessCanceled(ctx, func() error {
 		de, err = fbo.statEntry(ctx, node)
 		return err
 	})
@@ -2131,6 +2700,80 @@ func (fbo *folderBranchOps) Stat(ctx context.Context, node Node) (
 	return de.EntryInfo, nil
 }
 
+// GetAllocatedSize implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) GetAllocatedSize(ctx context.Context, node Node) (
+	size uint64, err error) {
+	fbo.log.CDebugf(ctx, "GetAllocatedSize %s", getNodeIDStr(node))
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "GetAllocatedSize %s done: %d %+v",
+			getNodeIDStr(node), size, err)
+	}()
+
+	err = fbo.checkNode(node)
+	if err != nil {
+		return 0, err
+	}
+
+	err = fbo.runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+		nodePath, err := fbo.pathFromNodeForRead(node)
+		if err != nil {
+			return err
+		}
+
+		md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+		if err != nil {
+			return err
+		}
+
+		size, err = fbo.blocks.GetAllocatedSize(
+			ctx, lState, md.ReadOnly(), nodePath)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// GetFileBlockLayout implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) GetFileBlockLayout(ctx context.Context,
+	file Node) (layout FileBlockLayout, err error) {
+	fbo.log.CDebugf(ctx, "GetFileBlockLayout %s", getNodeIDStr(file))
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "GetFileBlockLayout %s done: %+v",
+			getNodeIDStr(file), err)
+	}()
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return FileBlockLayout{}, err
+	}
+
+	err = fbo.runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+		filePath, err := fbo.pathFromNodeForRead(file)
+		if err != nil {
+			return err
+		}
+
+		md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+		if err != nil {
+			return err
+		}
+
+		layout, err = fbo.blocks.GetFileBlockLayout(
+			ctx, lState, md.ReadOnly(), filePath)
+		return err
+	})
+	if err != nil {
+		return FileBlockLayout{}, err
+	}
+	return layout, nil
+}
+
 func (fbo *folderBranchOps) GetNodeMetadata(ctx context.Context, node Node) (
 	res NodeMetadata, err error) {
 	fbo.log.CDebugf(ctx, "GetNodeMetadata %s", getNodeIDStr(node))
@@ -2140,7 +2783,7 @@ func (fbo *folderBranchOps) GetNodeMetadata(ctx context.Context, node Node) (
 	}()
 
 	var de DirEntry
-	err = runUnlessCanceled(ctx, func() error {
+	err = fbo.runUnlessCanceled(ctx, func() error {
 		de, err = fbo.statEntry(ctx, node)
 		return err
 	})
@@ -2169,6 +2812,14 @@ func (fbo *folderBranchOps) GetNodeMetadata(ctx context.Context, node Node) (
 	prefetchStatus := fbo.config.PrefetchStatus(ctx, fbo.id(),
 		res.BlockInfo.BlockPointer)
 	res.PrefetchStatus = prefetchStatus.String()
+	if de.Type != Dir {
+		res.SyncError = fbo.blocks.GetSyncError(
+			makeFBOLockState(), fbo.nodeCache.PathFromNode(node))
+	} else {
+		res.Damaged = fbo.blocks.GetDamagedSubtree(
+			fbo.nodeCache.PathFromNode(node))
+	}
+	res.Atime = fbo.nodeCache.Atime(node)
 	return res, nil
 }
 
@@ -2192,7 +2843,7 @@ func (bps *blockPutState) addNewBlock(
 	blockPtr BlockPointer, block Block,
 	readyBlockData ReadyBlockData, syncedCb func() error) {
 	bps.blockStates = append(bps.blockStates,
-		blockState{blockPtr, block, readyBlockData, syncedCb, zeroPtr})
+		blockState{blockPtr, block, readyBlockData, syncedCb, zeroPtr, false, ""})
 }
 
 // saveOldPtr stores the given BlockPointer as the old (pre-readied)
@@ -2201,12 +2852,26 @@ func (bps *blockPutState) saveOldPtr(oldPtr BlockPointer) {
 	bps.blockStates[len(bps.blockStates)-1].oldPtr = oldPtr
 }
 
-func (bps *blockPutState) mergeOtherBps(other *blockPutState) {
-	bps.blockStates = append(bps.blockStates, other.blockStates...)
+// markAlreadyPut records that the most recent blockState was already
+// put to the server, and so doesn't need to be put again.
+func (bps *blockPutState) markAlreadyPut() {
+	bps.blockStates[len(bps.blockStates)-1].alreadyPut = true
 }
 
-func (bps *blockPutState) removeOtherBps(other *blockPutState) {
-	if len(other.blockStates) == 0 {
+// setTrafficPath records that all the blocks in `bps` belong to the
+// entry at the TLF-relative path `relPath`.
+func (bps *blockPutState) setTrafficPath(relPath string) {
+	for i := range bps.blockStates {
+		bps.blockStates[i].trafficPath = relPath
+	}
+}
+
+func (bps *blockPutState) mergeOtherBps(other *blockPutState) {
+	bps.blockStates = append(bps.blockStates, other.blockStates...)
+}
+
+func (bps *blockPutState) removeOtherBps(other *blockPutState) {
+	if len(other.blockStates) == 0 {
 		return
 	}
 
@@ -2268,8 +2933,9 @@ func (fbo *folderBranchOps) finalizeBlocks(
 	for _, blockState := range bps.blockStates {
 		newPtr := blockState.blockPtr
 		// only cache this block if we made a brand new block, not if
-		// we just incref'd some other block.
-		if !newPtr.IsFirstRef() {
+		// we just incref'd some other block.  Conflict resolution may
+		// also have dropped the plaintext of blocks over its budget.
+		if !newPtr.IsFirstRef() || blockState.block == nil {
 			continue
 		}
 		if err := bcache.Put(newPtr, fbo.id(), blockState.block,
@@ -2334,7 +3000,7 @@ func (fbo *folderBranchOps) sendEditNotifications(
 }
 
 func (fbo *folderBranchOps) makeEditNotifications(
-	ctx context.Context, rmd ImmutableRootMetadata) (
+	ctx context.Context, rmd ImmutableRootMetadata, populatePaths bool) (
 	edits []kbfsedits.NotificationMessage, err error) {
 	if rmd.IsWriterMetadataCopiedSet() {
 		return nil, nil
@@ -2344,16 +3010,17 @@ func (fbo *folderBranchOps) makeEditNotifications(
 		return nil, nil
 	}
 
-	// If this MD is coming from the journal or from the conflict
-	// resolver, the final paths will not be set on the ops.  Use
-	// crChains to set them.
+	// If this MD is coming from the journal, from the conflict
+	// resolver, or from another device, the final paths will not be
+	// set on the ops.  Use crChains to set them.
 	ops := pathSortedOps(rmd.data.Changes.Ops)
 
 	isResolution := false
 	if len(ops) > 0 {
 		_, isResolution = ops[0].(*resolutionOp)
 	}
-	if isResolution || TLFJournalEnabled(fbo.config, fbo.id()) {
+	if populatePaths || isResolution ||
+		TLFJournalEnabled(fbo.config, fbo.id()) {
 		chains, err := newCRChainsForIRMDs(
 			ctx, fbo.config.Codec(), []ImmutableRootMetadata{rmd},
 			&fbo.blocks, true)
@@ -2402,7 +3069,7 @@ func (fbo *folderBranchOps) handleEditNotifications(
 		return nil
 	}
 
-	edits, err := fbo.makeEditNotifications(ctx, rmd)
+	edits, err := fbo.makeEditNotifications(ctx, rmd, false)
 	if err != nil {
 		return err
 	}
@@ -2423,7 +3090,7 @@ func (fbo *folderBranchOps) handleUnflushedEditNotifications(
 		return nil
 	}
 
-	edits, err := fbo.makeEditNotifications(ctx, rmd)
+	edits, err := fbo.makeEditNotifications(ctx, rmd, false)
 	if err != nil {
 		return err
 	}
@@ -2943,6 +3610,18 @@ func (fbo *folderBranchOps) checkForUnlinkedDir(dir Node) error {
 func (fbo *folderBranchOps) createEntryLocked(
 	ctx context.Context, lState *lockState, dir Node, name string,
 	entryType EntryType, excl Excl) (childNode Node, de DirEntry, err error) {
+	return fbo.createEntryMaybeSyncLocked(
+		ctx, lState, dir, name, entryType, excl, true)
+}
+
+// createEntryMaybeSyncLocked is like createEntryLocked, but if
+// `syncDirUpdate` is false and `excl` is `NoExcl`, it leaves the new
+// entry in the batch of pending dir ops without signaling the
+// background flusher, so the caller can sync many entries at once.
+func (fbo *folderBranchOps) createEntryMaybeSyncLocked(
+	ctx context.Context, lState *lockState, dir Node, name string,
+	entryType EntryType, excl Excl, syncDirUpdate bool) (
+	childNode Node, de DirEntry, err error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
 	if err := checkDisallowedPrefixes(ctx, name); err != nil {
@@ -2974,6 +3653,12 @@ func (fbo *folderBranchOps) createEntryLocked(
 		return nil, DirEntry{}, err
 	}
 
+	err = fbo.checkTeamContentPolicy(
+		ctx, lState, md, dirPath.ChildPathNoPtr(name), true, 0)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+
 	// does name already exist?
 	_, err = fbo.blocks.GetEntry(
 		ctx, lState, md.ReadOnly(), dirPath.ChildPathNoPtr(name))
@@ -3144,7 +3829,7 @@ func (fbo *folderBranchOps) createEntryLocked(
 		} else if err != nil {
 			return nil, DirEntry{}, err
 		}
-	} else {
+	} else if syncDirUpdate {
 		err = fbo.syncDirUpdateOrSignal(ctx, lState)
 		if err != nil {
 			return nil, DirEntry{}, err
@@ -3254,7 +3939,7 @@ func (fbo *folderBranchOps) doMDWriteWithRetry(ctx context.Context,
 
 func (fbo *folderBranchOps) doMDWriteWithRetryUnlessCanceled(
 	ctx context.Context, fn func(lState *lockState) error) error {
-	return runUnlessCanceled(ctx, func() error {
+	return fbo.runUnlessCanceled(ctx, func() error {
 		lState := makeFBOLockState()
 		return fbo.doMDWriteWithRetry(ctx, lState, fn)
 	})
@@ -3292,6 +3977,50 @@ func (fbo *folderBranchOps) CreateDir(
 	return retNode, retEntryInfo, nil
 }
 
+// newFileEntryType returns the type of a new file to be created in
+// `dir`, given whether the creator asked for it to be executable and
+// the configured `NewFileExecMode` for this TLF.
+func (fbo *folderBranchOps) newFileEntryType(
+	ctx context.Context, dir Node, isExec bool) (EntryType, error) {
+	switch fbo.config.NewFileExecMode(fbo.id()) {
+	case NewFileExecNever:
+		isExec = false
+	case NewFileExecAlways:
+		isExec = true
+	case NewFileExecInherit:
+		if isExec {
+			break
+		}
+		lState := makeFBOLockState()
+		md, err := fbo.getMDForRead(ctx, lState, mdReadNoIdentify)
+		if err != nil {
+			return File, err
+		}
+		dirPath := fbo.nodeCache.PathFromNode(dir)
+		entries, err := fbo.blocks.GetEntries(
+			ctx, lState, md.ReadOnly(), dirPath)
+		if err != nil {
+			return File, err
+		}
+		sawExec := false
+		isExec = true
+		for _, de := range entries {
+			switch de.Type {
+			case File:
+				isExec = false
+			case Exec:
+				sawExec = true
+			}
+		}
+		isExec = isExec && sawExec
+	}
+
+	if isExec {
+		return Exec, nil
+	}
+	return File, nil
+}
+
 func (fbo *folderBranchOps) CreateFile(
 	ctx context.Context, dir Node, path string, isExec bool, excl Excl) (
 	n Node, ei EntryInfo, err error) {
@@ -3309,11 +4038,9 @@ func (fbo *folderBranchOps) CreateFile(
 		return nil, EntryInfo{}, err
 	}
 
-	var entryType EntryType
-	if isExec {
-		entryType = Exec
-	} else {
-		entryType = File
+	entryType, err := fbo.newFileEntryType(ctx, dir, isExec)
+	if err != nil {
+		return nil, EntryInfo{}, err
 	}
 
 	// If journaling is turned on, an exclusive create may end up on a
@@ -3347,6 +4074,333 @@ func (fbo *folderBranchOps) CreateFile(
 	return retNode, retEntryInfo, nil
 }
 
+// createFilesBatchLocked creates all the given files in `dir`,
+// leaving them in the batch of pending dir ops.
+func (fbo *folderBranchOps) createFilesBatchLocked(
+	ctx context.Context, lState *lockState, dir Node, files []NewFileInfo,
+	entryTypes []EntryType) (nodes []Node, eis []EntryInfo, err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	// Check the sizes up front, since the data is only written
+	// after all the entries are created.
+	md, err := fbo.getMDForWriteLockedForFilename(ctx, lState, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, f := range files {
+		err := fbo.checkTeamContentPolicy(ctx, lState, md,
+			dirPath.ChildPathNoPtr(f.Name), false, uint64(len(f.Data)))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for i, f := range files {
+		node, de, err := fbo.createEntryMaybeSyncLocked(
+			ctx, lState, dir, f.Name, entryTypes[i], NoExcl, false)
+		if err != nil {
+			return nodes, eis, err
+		}
+		nodes = append(nodes, node)
+		eis = append(eis, de.EntryInfo)
+	}
+	return nodes, eis, nil
+}
+
+// createFilesBatch creates the given files in `dir` in a single pass
+// under the MD writer lock, writes their initial contents, and then
+// syncs all of them together in one MD revision.
+func (fbo *folderBranchOps) createFilesBatch(
+	ctx context.Context, dir Node, files []NewFileInfo) (
+	nodes []Node, eis []EntryInfo, err error) {
+	entryTypes := make([]EntryType, len(files))
+	for i, f := range files {
+		entryTypes[i], err = fbo.newFileEntryType(ctx, dir, f.IsExec)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	defer func() {
+		if err != nil {
+			// Let the background flusher take care of any entries
+			// that were created before the error.
+			fbo.signalWrite()
+		}
+	}()
+
+	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			// Only keep the results of an attempt that created
+			// every file, so that a retry can't mix the nodes of
+			// two attempts.
+			attemptNodes, attemptEIs, err := fbo.createFilesBatchLocked(
+				ctx, lState, dir, files, entryTypes)
+			if err != nil {
+				return err
+			}
+			nodes, eis = attemptNodes, attemptEIs
+			return nil
+		})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Write the data without holding the MD writer lock, since the
+	// dirty block cache might make us wait for a sync.
+	lState := makeFBOLockState()
+	md, err := fbo.getMDForRead(ctx, lState, mdReadNeedIdentify)
+	if err != nil {
+		return nodes, eis, err
+	}
+	for i, f := range files {
+		if len(f.Data) == 0 {
+			continue
+		}
+		err = fbo.blocks.Write(
+			ctx, lState, md.ReadOnly(), nodes[i], f.Data, 0)
+		if err != nil {
+			return nodes, eis, err
+		}
+		fbo.status.addDirtyNode(nodes[i])
+		eis[i].Size = uint64(len(f.Data))
+	}
+
+	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			return fbo.syncAllLocked(ctx, lState, NoExcl)
+		})
+	if err != nil {
+		return nodes, eis, err
+	}
+	return nodes, eis, nil
+}
+
+// CreateFiles implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) CreateFiles(
+	ctx context.Context, dir Node, files []NewFileInfo) (
+	nodes []Node, eis []EntryInfo, err error) {
+	fbo.log.CDebugf(ctx, "CreateFiles %s: %d file(s)",
+		getNodeIDStr(dir), len(files))
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "CreateFiles %s: %d file(s) done, "+
+			"%d created: %+v", getNodeIDStr(dir), len(files), len(nodes), err)
+	}()
+
+	err = fbo.checkNodeForWrite(ctx, dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for len(files) > 0 {
+		batch := files
+		if len(batch) > maxDirOpsPerBatch {
+			batch = batch[:maxDirOpsPerBatch]
+		}
+		files = files[len(batch):]
+		batchNodes, batchEIs, err := fbo.createFilesBatch(ctx, dir, batch)
+		nodes = append(nodes, batchNodes...)
+		eis = append(eis, batchEIs...)
+		if err != nil {
+			return nodes, eis, err
+		}
+	}
+	return nodes, eis, nil
+}
+
+// templateEntry is an entry of a template subtree, as read by
+// InstantiateTemplate.
+type templateEntry struct {
+	name     string
+	ei       EntryInfo
+	node     Node // for files
+	children []templateEntry
+}
+
+// readTemplate reads the entries of the template directory `dir`,
+// recursively, without reading the contents of its files.
+// `numEntries` counts the entries read so far, which is limited to
+// maxDirOpsPerBatch.
+func (fbo *folderBranchOps) readTemplate(
+	ctx context.Context, dir Node, numEntries *int) (
+	[]templateEntry, error) {
+	children, err := fbo.GetDirChildren(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	entries := make([]templateEntry, 0, len(names))
+	for _, name := range names {
+		*numEntries++
+		if *numEntries > maxDirOpsPerBatch {
+			return nil, errors.Errorf(
+				"Template has more than %d entries", maxDirOpsPerBatch)
+		}
+
+		te := templateEntry{name: name, ei: children[name]}
+		if te.ei.Type == Sym {
+			entries = append(entries, te)
+			continue
+		}
+		child, _, err := fbo.Lookup(ctx, dir, name)
+		if err != nil {
+			return nil, err
+		}
+		if te.ei.Type == Dir {
+			te.children, err = fbo.readTemplate(ctx, child, numEntries)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			te.node = child
+		}
+		entries = append(entries, te)
+	}
+	return entries, nil
+}
+
+// templateFile is a file created by InstantiateTemplate, along with
+// the template file whose contents are still to be copied into it.
+type templateFile struct {
+	node Node
+	src  Node
+	size int64
+}
+
+// createTemplateLocked creates copies of the given template entries
+// under `dir`, leaving them all in the batch of pending dir ops.  It
+// appends the created files that need contents to `files`.
+func (fbo *folderBranchOps) createTemplateLocked(
+	ctx context.Context, lState *lockState, dir Node,
+	entries []templateEntry, files *[]templateFile) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	for _, te := range entries {
+		if te.ei.Type == Sym {
+			_, err := fbo.createLinkMaybeSyncLocked(
+				ctx, lState, dir, te.name, te.ei.SymPath, false)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		node, _, err := fbo.createEntryMaybeSyncLocked(
+			ctx, lState, dir, te.name, te.ei.Type, NoExcl, false)
+		if err != nil {
+			return err
+		}
+		if te.ei.Type == Dir {
+			err = fbo.createTemplateLocked(
+				ctx, lState, node, te.children, files)
+			if err != nil {
+				return err
+			}
+		} else if te.ei.Size > 0 {
+			md, err := fbo.getMDForWriteLockedForFilename(ctx, lState, "")
+			if err != nil {
+				return err
+			}
+			err = fbo.checkTeamContentPolicy(ctx, lState, md,
+				fbo.nodeCache.PathFromNode(node), false, te.ei.Size)
+			if err != nil {
+				return err
+			}
+			*files = append(*files,
+				templateFile{node, te.node, int64(te.ei.Size)})
+		}
+	}
+	return nil
+}
+
+// InstantiateTemplate implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) InstantiateTemplate(
+	ctx context.Context, template Node, dir Node, name string) (
+	node Node, ei EntryInfo, err error) {
+	fbo.log.CDebugf(ctx, "InstantiateTemplate %s -> %s %s",
+		getNodeIDStr(template), getNodeIDStr(dir), name)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "InstantiateTemplate %s -> %s %s "+
+			"done: %+v", getNodeIDStr(template), getNodeIDStr(dir),
+			name, err)
+	}()
+
+	err = fbo.checkNode(template)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	err = fbo.checkNodeForWrite(ctx, dir)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+
+	// Read the structure of the whole template first; the file
+	// contents are copied over once the entries exist.
+	numEntries := 0
+	entries, err := fbo.readTemplate(ctx, template, &numEntries)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+
+	defer func() {
+		if err != nil && node != nil {
+			// Let the background flusher take care of any entries
+			// that were created before the error.
+			fbo.signalWrite()
+		}
+	}()
+
+	var de DirEntry
+	var files []templateFile
+	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) (err error) {
+			files = nil
+			node, de, err = fbo.createEntryMaybeSyncLocked(
+				ctx, lState, dir, name, Dir, NoExcl, false)
+			if err != nil {
+				return err
+			}
+			return fbo.createTemplateLocked(
+				ctx, lState, node, entries, &files)
+		})
+	if err != nil {
+		return node, EntryInfo{}, err
+	}
+
+	// Copy the contents without holding the MD writer lock, since
+	// the dirty block cache might make us wait for a sync.  As in
+	// CopyFileRange, the leaf blocks of indirect files are shared
+	// with the template rather than read, and the rest is copied
+	// one block at a time, so the template is never held in memory
+	// all at once.  Only a large template needs syncs along the way.
+	for _, f := range files {
+		_, _, err = fbo.copyFileRangeNoFinalSync(
+			ctx, f.src, f.node, 0, 0, f.size)
+		if err != nil {
+			return node, EntryInfo{}, err
+		}
+	}
+
+	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			return fbo.syncAllLocked(ctx, lState, NoExcl)
+		})
+	if err != nil {
+		return node, EntryInfo{}, err
+	}
+	return node, de.EntryInfo, nil
+}
+
 // notifyAndSyncOrSignal caches an op in memory and dirties the
 // relevant node, and then sends a notification for it.  If batching
 // is on, it signals the write; otherwise it syncs the change.  It
@@ -3355,6 +4409,17 @@ func (fbo *folderBranchOps) CreateFile(
 func (fbo *folderBranchOps) notifyAndSyncOrSignal(
 	ctx context.Context, lState *lockState, undoFn dirCacheUndoFn,
 	nodesToDirty []Node, op op, md ReadOnlyRootMetadata) (err error) {
+	return fbo.notifyAndMaybeSyncOrSignal(
+		ctx, lState, undoFn, nodesToDirty, op, md, true)
+}
+
+// notifyAndMaybeSyncOrSignal is like notifyAndSyncOrSignal, but if
+// `syncDirUpdate` is false, it leaves the op in the batch of pending
+// dir ops without syncing or signaling.
+func (fbo *folderBranchOps) notifyAndMaybeSyncOrSignal(
+	ctx context.Context, lState *lockState, undoFn dirCacheUndoFn,
+	nodesToDirty []Node, op op, md ReadOnlyRootMetadata,
+	syncDirUpdate bool) (err error) {
 	fbo.dirOps = append(fbo.dirOps, cachedDirOp{op, nodesToDirty})
 	var addedNodes []Node
 	for _, n := range nodesToDirty {
@@ -3384,12 +4449,25 @@ func (fbo *folderBranchOps) notifyAndSyncOrSignal(
 		return err
 	}
 
+	if !syncDirUpdate {
+		return nil
+	}
 	return fbo.syncDirUpdateOrSignal(ctx, lState)
 }
 
 func (fbo *folderBranchOps) createLinkLocked(
 	ctx context.Context, lState *lockState, dir Node, fromName string,
 	toPath string) (DirEntry, error) {
+	return fbo.createLinkMaybeSyncLocked(
+		ctx, lState, dir, fromName, toPath, true)
+}
+
+// createLinkMaybeSyncLocked is like createLinkLocked, but if
+// `syncDirUpdate` is false, it leaves the new link in the batch of
+// pending dir ops, as in createEntryMaybeSyncLocked.
+func (fbo *folderBranchOps) createLinkMaybeSyncLocked(
+	ctx context.Context, lState *lockState, dir Node, fromName string,
+	toPath string, syncDirUpdate bool) (DirEntry, error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
 	if err := checkDisallowedPrefixes(ctx, fromName); err != nil {
@@ -3416,6 +4494,12 @@ func (fbo *folderBranchOps) createLinkLocked(
 		return DirEntry{}, err
 	}
 
+	err = fbo.checkTeamContentPolicy(
+		ctx, lState, md, dirPath.ChildPathNoPtr(fromName), true, 0)
+	if err != nil {
+		return DirEntry{}, err
+	}
+
 	// TODO: validate inputs
 
 	// does name already exist?
@@ -3462,8 +4546,9 @@ func (fbo *folderBranchOps) createLinkLocked(
 		return DirEntry{}, err
 	}
 
-	err = fbo.notifyAndSyncOrSignal(
-		ctx, lState, dirCacheUndoFn, []Node{dir}, co, md.ReadOnly())
+	err = fbo.notifyAndMaybeSyncOrSignal(
+		ctx, lState, dirCacheUndoFn, []Node{dir}, co, md.ReadOnly(),
+		syncDirUpdate)
 	if err != nil {
 		return DirEntry{}, err
 	}
@@ -3503,8 +4588,8 @@ func (fbo *folderBranchOps) CreateLink(
 // unrefEntry modifies md to unreference all relevant blocks for the
 // given entry.
 func (fbo *folderBranchOps) unrefEntryLocked(ctx context.Context,
-	lState *lockState, kmd KeyMetadata, ro op, dir path, de DirEntry,
-	name string) error {
+	lState *lockState, kmd KeyMetadataWithRootDirEntry, ro op, dir path,
+	de DirEntry, name string) error {
 	fbo.mdWriterLock.AssertLocked(lState)
 	if de.Type == Sym {
 		return nil
@@ -3534,6 +4619,15 @@ func (fbo *folderBranchOps) unrefEntryLocked(ctx context.Context,
 		for _, blockInfo := range blockInfos {
 			unrefsToAdd[blockInfo.BlockPointer] = true
 		}
+
+		// The copy made for a share link goes away with its record.
+		if len(dir.path) == 2 && dir.tailName() == shareLinksDirName {
+			err := fbo.addShareLinkRevocationLocked(
+				ctx, lState, kmd, ro, dir, name, de)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
 	// Any referenced blocks that were unreferenced since the last
@@ -3555,54 +4649,217 @@ func (fbo *folderBranchOps) unrefEntryLocked(ctx context.Context,
 	return nil
 }
 
-func (fbo *folderBranchOps) removeEntryLocked(ctx context.Context,
-	lState *lockState, md ReadOnlyRootMetadata, dir Node, dirPath path,
-	name string) error {
+// readShareLinkLocked reads and decodes the share link record
+// `name` in `dir`.  It returns false, with no error, if the record
+// isn't a valid one signed by the link's minter.
+func (fbo *folderBranchOps) readShareLinkLocked(
+	ctx context.Context, lState *lockState, kmd KeyMetadataWithRootDirEntry,
+	dir path, name string, de DirEntry) (ShareLink, bool, error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
-	if err := fbo.checkForUnlinkedDir(dir); err != nil {
-		return err
+	buf, err := fbo.blocks.ReadAll(
+		ctx, lState, kmd, dir.ChildPath(name, de.BlockPointer),
+		int64(de.Size))
+	if err != nil {
+		return ShareLink{}, false, err
 	}
-
-	// make sure the entry exists
-	de, err := fbo.blocks.GetEntry(
-		ctx, lState, md, dirPath.ChildPathNoPtr(name))
-	if _, notExists := errors.Cause(err).(NoSuchNameError); notExists {
-		return NoSuchNameError{name}
-	} else if err != nil {
-		return err
+	link, err := decodeShareLink(ctx, fbo.config, fbo.id(), name, buf)
+	if err != nil {
+		fbo.log.CWarningf(ctx, "Ignoring share link record %s: %+v",
+			name, err)
+		return ShareLink{}, false, nil
 	}
+	return link, true, nil
+}
 
-	parentPtr := dirPath.tailPointer()
-	ro, err := newRmOp(name, parentPtr, de.Type)
-	if err != nil {
+// addShareLinkRevocationLocked arranges for the copy of the share
+// link recorded as `name` in `dir` to be removed from the block
+// server once `o`, which removes the record, is synced.  A record
+// that isn't signed by its link's minter is removed without
+// touching any blocks, and so are the blocks that the rest of the
+// TLF still references.
+func (fbo *folderBranchOps) addShareLinkRevocationLocked(
+	ctx context.Context, lState *lockState, kmd KeyMetadataWithRootDirEntry,
+	o op, dir path, name string, de DirEntry) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	link, ok, err := fbo.readShareLinkLocked(ctx, lState, kmd, dir, name, de)
+	if err != nil || !ok {
 		return err
 	}
-	ro.setFinalPath(dirPath)
-	ro.AddSelfUpdate(parentPtr)
-	err = fbo.unrefEntryLocked(ctx, lState, md, ro, dirPath, de, name)
+	contexts := make(kbfsblock.ContextMap, len(link.Blocks))
+	for _, b := range link.Blocks {
+		// Each block has just the one context, so this also drops
+		// any repeats.
+		contexts[b.ID] = []kbfsblock.Context{b.Context}
+	}
+	err = fbo.dropLiveShareLinkBlocksLocked(
+		ctx, lState, kmd, dir, name, contexts)
 	if err != nil {
 		return err
 	}
+	if len(contexts) == 0 {
+		return nil
+	}
 
-	dirCacheUndoFn, err := fbo.blocks.RemoveDirEntryInCache(
-		ctx, lState, md.ReadOnly(), dirPath, name, de)
-	if err != nil {
-		return err
+	if fbo.shareLinkRevocations == nil {
+		fbo.shareLinkRevocations = make(map[op]kbfsblock.ContextMap)
 	}
-	if de.Type == Dir {
-		removedNode := fbo.nodeCache.Get(de.BlockPointer.Ref())
-		if removedNode != nil {
-			// If it was a dirty directory, the removed node no longer
-			// counts as dirty (it will never be sync'd). Note that
-			// removed files will still be synced since any data
-			// written to them via a handle stays in memory until the
-			// sync actually happens.
-			removed := fbo.status.rmDirtyNode(removedNode)
-			if removed {
-				oldUndoFn := dirCacheUndoFn
-				dirCacheUndoFn = func(lState *lockState) {
-					oldUndoFn(lState)
+	fbo.shareLinkRevocations[o] = contexts
+	return nil
+}
+
+// dropLiveShareLinkBlocksLocked deletes from `contexts` every block
+// that the TLF still references, whether from its tree, including
+// any unsynced changes, or from a valid share link record in
+// `linksDir` other than `name`, so that revoking a link can never
+// free anything else.  It walks the whole TLF, which is slow for a
+// big one, but links are rarely revoked.
+func (fbo *folderBranchOps) dropLiveShareLinkBlocksLocked(
+	ctx context.Context, lState *lockState, kmd KeyMetadataWithRootDirEntry,
+	linksDir path, name string, contexts kbfsblock.ContextMap) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	dirs := []path{*linksDir.parentPath()}
+	for len(dirs) > 0 && len(contexts) > 0 {
+		dir := dirs[len(dirs)-1]
+		dirs = dirs[:len(dirs)-1]
+		delete(contexts, dir.tailPointer().ID)
+		infos, err := fbo.blocks.GetIndirectDirBlockInfos(
+			ctx, lState, kmd, dir)
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			delete(contexts, info.ID)
+		}
+
+		entries, err := fbo.blocks.GetEntries(ctx, lState, kmd, dir)
+		if err != nil {
+			return err
+		}
+		isLinksDir := dir.tailPointer() == linksDir.tailPointer()
+		for childName, de := range entries {
+			child := dir.ChildPath(childName, de.BlockPointer)
+			switch de.Type {
+			case Sym:
+				continue
+			case Dir:
+				dirs = append(dirs, child)
+				continue
+			}
+
+			delete(contexts, de.BlockPointer.ID)
+			infos, err := fbo.blocks.GetIndirectFileBlockInfos(
+				ctx, lState, kmd, child)
+			if err != nil {
+				return err
+			}
+			for _, info := range infos {
+				delete(contexts, info.ID)
+			}
+			if !isLinksDir || childName == name {
+				continue
+			}
+			link, ok, err := fbo.readShareLinkLocked(
+				ctx, lState, kmd, dir, childName, de)
+			if err != nil {
+				return err
+			}
+			if ok {
+				for _, b := range link.Blocks {
+					delete(contexts, b.ID)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// revokeShareLinksLocked removes from the block server the share
+// link blocks of the records removed by the dirOps that were just
+// synced.  If that fails, the blocks are left behind, but the
+// records are gone either way.
+func (fbo *folderBranchOps) revokeShareLinksLocked(
+	ctx context.Context, lState *lockState) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	revocations := fbo.shareLinkRevocations
+	fbo.shareLinkRevocations = nil
+	contexts := make(kbfsblock.ContextMap)
+	for _, dop := range fbo.dirOps {
+		for id, idContexts := range revocations[dop.dirOp] {
+			contexts[id] = idContexts
+		}
+	}
+	if len(contexts) == 0 {
+		return
+	}
+
+	fbo.log.CDebugf(ctx, "Removing %d block(s) of revoked share links",
+		len(contexts))
+	_, err := fbo.config.BlockServer().RemoveBlockReferences(
+		ctx, fbo.id(), contexts)
+	if err != nil {
+		fbo.log.CWarningf(ctx, "Couldn't remove the blocks of revoked "+
+			"share links: %+v", err)
+	}
+}
+
+func (fbo *folderBranchOps) removeEntryLocked(ctx context.Context,
+	lState *lockState, md ReadOnlyRootMetadata, dir Node, dirPath path,
+	name string) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	if err := fbo.checkForUnlinkedDir(dir); err != nil {
+		return err
+	}
+
+	err := fbo.checkTeamContentPolicy(
+		ctx, lState, md, dirPath.ChildPathNoPtr(name), false, 0)
+	if err != nil {
+		return err
+	}
+
+	// make sure the entry exists
+	de, err := fbo.blocks.GetEntry(
+		ctx, lState, md, dirPath.ChildPathNoPtr(name))
+	if _, notExists := errors.Cause(err).(NoSuchNameError); notExists {
+		return NoSuchNameError{name}
+	} else if err != nil {
+		return err
+	}
+
+	parentPtr := dirPath.tailPointer()
+	ro, err := newRmOp(name, parentPtr, de.Type)
+	if err != nil {
+		return err
+	}
+	ro.setFinalPath(dirPath)
+	ro.AddSelfUpdate(parentPtr)
+	err = fbo.unrefEntryLocked(ctx, lState, md, ro, dirPath, de, name)
+	if err != nil {
+		return err
+	}
+
+	dirCacheUndoFn, err := fbo.blocks.RemoveDirEntryInCache(
+		ctx, lState, md.ReadOnly(), dirPath, name, de)
+	if err != nil {
+		return err
+	}
+	if de.Type == Dir {
+		removedNode := fbo.nodeCache.Get(de.BlockPointer.Ref())
+		if removedNode != nil {
+			// If it was a dirty directory, the removed node no longer
+			// counts as dirty (it will never be sync'd). Note that
+			// removed files will still be synced since any data
+			// written to them via a handle stays in memory until the
+			// sync actually happens.
+			removed := fbo.status.rmDirtyNode(removedNode)
+			if removed {
+				oldUndoFn := dirCacheUndoFn
+				dirCacheUndoFn = func(lState *lockState) {
+					oldUndoFn(lState)
 					fbo.status.addDirtyNode(removedNode)
 				}
 			}
@@ -3750,6 +5007,17 @@ func (fbo *folderBranchOps) renameLocked(
 		return err
 	}
 
+	err = fbo.checkTeamContentPolicy(ctx, lState, md,
+		oldParentPath.ChildPathNoPtr(oldName), false, 0)
+	if err != nil {
+		return err
+	}
+	err = fbo.checkTeamContentPolicy(ctx, lState, md,
+		newParentPath.ChildPathNoPtr(newName), true, 0)
+	if err != nil {
+		return err
+	}
+
 	newDe, replacedDe, ro, err := fbo.blocks.PrepRename(
 		ctx, lState, md.ReadOnly(), oldParentPath, oldName, newParentPath,
 		newName)
@@ -3905,7 +5173,7 @@ func (fbo *folderBranchOps) Read(
 	// outlast this function call, and end up in a read/write race
 	// with the caller.
 	var bytesRead int64
-	err = runUnlessCanceled(ctx, func() error {
+	err = fbo.runUnlessCanceled(ctx, func() error {
 		lState := makeFBOLockState()
 
 		// verify we have permission to read
@@ -3923,9 +5191,124 @@ func (fbo *folderBranchOps) Read(
 	if err != nil {
 		return 0, err
 	}
+	if len(dest) > 0 {
+		fbo.noteAccess(file)
+	}
+	return bytesRead, nil
+}
+
+// noteAccess records the current time as the atime of `node`, if
+// atimes are being tracked.
+func (fbo *folderBranchOps) noteAccess(node Node) {
+	if fbo.config.TimestampMode() != TimestampsPOSIXWithAtime {
+		return
+	}
+	fbo.nodeCache.SetAtime(node, fbo.config.Clock().Now())
+}
+
+// FetchFileRange implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) FetchFileRange(
+	ctx context.Context, file Node, off, length int64) (
+	fetched FileRange, err error) {
+	fbo.log.CDebugf(ctx, "FetchFileRange %s %d %d", getNodeIDStr(file),
+		off, length)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "FetchFileRange %s %d %d (fetched=%v) "+
+			"done: %+v", getNodeIDStr(file), off, length, fetched, err)
+	}()
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return FileRange{}, err
+	}
+
+	// As in Read, don't let the goroutine write directly to the
+	// return variable.
+	var fr FileRange
+	err = fbo.runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+
+		// verify we have permission to read
+		md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+		if err != nil {
+			return err
+		}
+
+		fr, err = fbo.blocks.FetchRange(
+			ctx, lState, md.ReadOnly(), file, off, length)
+		return err
+	})
+	if err != nil {
+		return FileRange{}, err
+	}
+	return fr, nil
+}
+
+// ReadVec implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) ReadVec(
+	ctx context.Context, file Node, vecs []IOVec) (ns []int64, err error) {
+	fbo.log.CDebugf(ctx, "ReadVec %s %d", getNodeIDStr(file), len(vecs))
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "ReadVec %s %d done: %+v",
+			getNodeIDStr(file), len(vecs), err)
+	}()
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return nil, err
+	}
+
+	// As in Read, don't let the goroutine write directly to the
+	// return variable.
+	var bytesRead []int64
+	err = fbo.runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+
+		// verify we have permission to read
+		md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+		if err != nil {
+			return err
+		}
+
+		bytesRead, err = fbo.blocks.ReadVec(
+			ctx, lState, md.ReadOnly(), file, vecs)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, vec := range vecs {
+		if len(vec.Buf) > 0 {
+			fbo.noteAccess(file)
+			break
+		}
+	}
 	return bytesRead, nil
 }
 
+// GetLocalFileRanges implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) GetLocalFileRanges(
+	ctx context.Context, file Node) (ranges []FileRange, err error) {
+	fbo.log.CDebugf(ctx, "GetLocalFileRanges %s", getNodeIDStr(file))
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "GetLocalFileRanges %s (%d ranges) "+
+			"done: %+v", getNodeIDStr(file), len(ranges), err)
+	}()
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return nil, err
+	}
+
+	lState := makeFBOLockState()
+	md, err := fbo.getMDForReadNoIdentify(ctx, lState)
+	if err != nil {
+		return nil, err
+	}
+	return fbo.blocks.GetLocalRanges(ctx, lState, md.ReadOnly(), file)
+}
+
 func (fbo *folderBranchOps) Write(
 	ctx context.Context, file Node, data []byte, off int64) (err error) {
 	fbo.log.CDebugf(ctx, "Write %s %d %d", getNodeIDStr(file),
@@ -3939,8 +5322,23 @@ func (fbo *folderBranchOps) Write(
 	if err != nil {
 		return err
 	}
+	if len(data) == 0 && fbo.config.TimestampMode().strict() {
+		// POSIX only updates the times for non-empty writes.
+		return nil
+	}
+
+	err = fbo.writeUnchecked(ctx, file, data, off)
+	if err != nil {
+		return err
+	}
+	return fbo.maybeWriteThrough(ctx, file)
+}
 
-	return runUnlessCanceled(ctx, func() error {
+// writeUnchecked writes `data` into the dirty blocks of `file`,
+// assuming the caller has already checked that it may write to it.
+func (fbo *folderBranchOps) writeUnchecked(
+	ctx context.Context, file Node, data []byte, off int64) error {
+	return fbo.runUnlessCanceled(ctx, func() error {
 		lState := makeFBOLockState()
 
 		// Get the MD for reading.  We won't modify it; we'll track the
@@ -3951,6 +5349,16 @@ func (fbo *folderBranchOps) Write(
 			return err
 		}
 
+		filePath, err := fbo.pathFromNodeForRead(file)
+		if err != nil {
+			return err
+		}
+		err = fbo.checkTeamContentPolicy(ctx, lState, md, filePath,
+			false, uint64(off)+uint64(len(data)))
+		if err != nil {
+			return err
+		}
+
 		err = fbo.blocks.Write(
 			ctx, lState, md.ReadOnly(), file, data, off)
 		if err != nil {
@@ -3963,12 +5371,13 @@ func (fbo *folderBranchOps) Write(
 	})
 }
 
-func (fbo *folderBranchOps) Truncate(
-	ctx context.Context, file Node, size uint64) (err error) {
-	fbo.log.CDebugf(ctx, "Truncate %s %d", getNodeIDStr(file), size)
+// WriteVec implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) WriteVec(
+	ctx context.Context, file Node, vecs []IOVec) (err error) {
+	fbo.log.CDebugf(ctx, "WriteVec %s %d", getNodeIDStr(file), len(vecs))
 	defer func() {
-		fbo.deferLog.CDebugf(ctx, "Truncate %s %d done: %+v",
-			getNodeIDStr(file), size, err)
+		fbo.deferLog.CDebugf(ctx, "WriteVec %s %d done: %+v",
+			getNodeIDStr(file), len(vecs), err)
 	}()
 
 	err = fbo.checkNodeForWrite(ctx, file)
@@ -3976,19 +5385,43 @@ func (fbo *folderBranchOps) Truncate(
 		return err
 	}
 
-	return runUnlessCanceled(ctx, func() error {
+	var end uint64
+	nonEmpty := make([]IOVec, 0, len(vecs))
+	for _, vec := range vecs {
+		if len(vec.Buf) == 0 && fbo.config.TimestampMode().strict() {
+			// POSIX only updates the times for non-empty writes.
+			continue
+		}
+		nonEmpty = append(nonEmpty, vec)
+		if vecEnd := uint64(vec.Off) + uint64(len(vec.Buf)); vecEnd > end {
+			end = vecEnd
+		}
+	}
+	if len(nonEmpty) == 0 {
+		return nil
+	}
+
+	err = fbo.runUnlessCanceled(ctx, func() error {
 		lState := makeFBOLockState()
 
-		// Get the MD for reading.  We won't modify it; we'll track the
-		// unref changes on the side, and put them into the MD during the
-		// sync.
+		// As in writeUnchecked, the MD is only read.
 		md, err := fbo.getMDForRead(ctx, lState, mdReadNeedIdentify)
 		if err != nil {
 			return err
 		}
 
-		err = fbo.blocks.Truncate(
-			ctx, lState, md.ReadOnly(), file, size)
+		filePath, err := fbo.pathFromNodeForRead(file)
+		if err != nil {
+			return err
+		}
+		err = fbo.checkTeamContentPolicy(
+			ctx, lState, md, filePath, false, end)
+		if err != nil {
+			return err
+		}
+
+		err = fbo.blocks.WriteVec(
+			ctx, lState, md.ReadOnly(), file, nonEmpty)
 		if err != nil {
 			return err
 		}
@@ -3997,339 +5430,1200 @@ func (fbo *folderBranchOps) Truncate(
 		fbo.signalWrite()
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	return fbo.maybeWriteThrough(ctx, file)
 }
 
-func (fbo *folderBranchOps) setExLocked(
-	ctx context.Context, lState *lockState, file Node, ex bool) (err error) {
-	fbo.mdWriterLock.AssertLocked(lState)
+// streamBlockBytes returns the size of the blocks that streamed
+// writes into this TLF are likely to fill, which is never less than
+// the default block size.
+func (fbo *folderBranchOps) streamBlockBytes() int64 {
+	lState := makeFBOLockState()
+	fbo.headLock.RLock(lState)
+	size := fbo.blockSize
+	fbo.headLock.RUnlock(lState)
+	if size == 0 && fbo.config.AdaptiveBlockSizes(fbo.id()) {
+		// Appended files get the largest adaptive size.
+		size = maxTlfBlockSizeBytes
+	}
+	if size < MaxBlockSizeBytesDefault {
+		size = MaxBlockSizeBytesDefault
+	}
+	return size
+}
 
-	filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
+// WriteStream implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) WriteStream(
+	ctx context.Context, file Node, r io.Reader, off int64) (
+	written int64, err error) {
+	fbo.log.CDebugf(ctx, "WriteStream %s %d", getNodeIDStr(file), off)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "WriteStream %s %d done: %d %+v",
+			getNodeIDStr(file), off, written, err)
+	}()
+
+	err = fbo.checkNodeForWrite(ctx, file)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	if !filePath.hasValidParent() {
-		return InvalidParentPathError{filePath}
+	// Only one chunk is held here at a time.  Each write waits for
+	// permission to dirty its blocks, as Write does, so once the
+	// dirty block cache fills up the background syncer flushes the
+	// TLF and the stream waits for it, rather than the data piling
+	// up in memory.
+	buf := make([]byte, fbo.streamBlockBytes())
+	for {
+		n, readErr := io.ReadFull(r, buf)
+		if n > 0 {
+			err = fbo.writeUnchecked(ctx, file, buf[:n], off+written)
+			if err != nil {
+				return written, err
+			}
+			written += int64(n)
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		} else if readErr != nil {
+			return written, readErr
+		}
 	}
+	return written, nil
+}
 
-	// Verify we have permission to write (no need to make a successor yet).
-	md, err := fbo.getMDForWriteLockedForFilename(ctx, lState, "")
+// CopyFileRange implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) CopyFileRange(ctx context.Context, src, dst Node,
+	srcOff, dstOff, length int64) (copied int64, err error) {
+	fbo.log.CDebugf(ctx, "CopyFileRange %s %d -> %s %d, %d",
+		getNodeIDStr(src), srcOff, getNodeIDStr(dst), dstOff, length)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "CopyFileRange %s %d -> %s %d done: "+
+			"%d %+v", getNodeIDStr(src), srcOff, getNodeIDStr(dst), dstOff,
+			copied, err)
+	}()
+
+	err = fbo.checkNode(src)
 	if err != nil {
-		return
+		return 0, err
 	}
-
-	de, err := fbo.blocks.GetEntryEvenIfDeleted(
-		ctx, lState, md.ReadOnly(), filePath)
+	err = fbo.checkNodeForWrite(ctx, dst)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	if srcOff < 0 || dstOff < 0 || length < 0 {
+		return 0, errors.Errorf("Bad copy range: %d -> %d, %d",
+			srcOff, dstOff, length)
+	}
+	if src.GetID() == dst.GetID() &&
+		srcOff < dstOff+length && dstOff < srcOff+length {
+		return 0, errors.Errorf("Overlapping copy within %s",
+			getNodeIDStr(src))
 	}
 
-	// If the file is a symlink, do nothing (to match ext4
-	// behavior).
-	if de.Type == Sym || de.Type == Dir {
-		fbo.log.CDebugf(ctx, "Ignoring setex on type %s", de.Type)
-		return nil
+	return fbo.copyFileRangeUnchecked(ctx, src, dst, srcOff, dstOff, length)
+}
+
+// copyFileRangeUnchecked copies a range of `src` into `dst`, like
+// CopyFileRange, without checking the nodes or the range, and syncs
+// the result.
+func (fbo *folderBranchOps) copyFileRangeUnchecked(
+	ctx context.Context, src, dst Node, srcOff, dstOff, length int64) (
+	copied int64, err error) {
+	copied, dirty, err := fbo.copyFileRangeNoFinalSync(
+		ctx, src, dst, srcOff, dstOff, length)
+	if err != nil {
+		return copied, err
+	}
+	if dirty {
+		err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+			func(lState *lockState) error {
+				return fbo.syncAllLocked(ctx, lState, NoExcl)
+			})
+		if err != nil {
+			return copied, err
+		}
+	}
+	if copied > 0 {
+		fbo.noteAccess(src)
 	}
+	return copied, nil
+}
 
-	if ex && (de.Type == File) {
-		de.Type = Exec
-	} else if !ex && (de.Type == Exec) {
-		de.Type = File
-	} else {
-		// Treating this as a no-op, without updating the ctime, is a
-		// POSIX violation, but it's an important optimization to keep
-		// permissions-preserving rsyncs fast.
-		fbo.log.CDebugf(ctx, "Ignoring no-op setex")
-		return nil
+// copyFileRangeNoFinalSync copies a range of `src` into `dst` like
+// copyFileRangeUnchecked, but only syncs along the way when the
+// dirty data piles up.  It returns whether the copy left unsynced
+// changes behind, which the caller must sync.
+func (fbo *folderBranchOps) copyFileRangeNoFinalSync(
+	ctx context.Context, src, dst Node, srcOff, dstOff, length int64) (
+	copied int64, dirty bool, err error) {
+	syncAll := func() error {
+		return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+			func(lState *lockState) error {
+				return fbo.syncAllLocked(ctx, lState, NoExcl)
+			})
 	}
 
-	de.Ctime = fbo.nowUnixNano()
+	// Whole leaves of `src` are spliced onto the end of `dst` as new
+	// references, without fetching them.  The rest is copied one
+	// leaf of `src` at a time, which also brings the copy back to
+	// the start of a leaf of `src` after an unaligned `srcOff`.  Sync
+	// regularly so the dirty blocks don't pile up.
+	syncBytes := writeStreamSyncBlocks * fbo.streamBlockBytes()
+	var unsynced int64
+	for copied < length {
+		n, err := fbo.spliceLeavesForCopy(
+			ctx, src, dst, srcOff+copied, dstOff+copied, length-copied)
+		if err != nil {
+			return copied, dirty, err
+		}
+		if n > 0 {
+			copied += n
+			dirty = true
+			continue
+		}
 
-	parentPtr := filePath.parentPath().tailPointer()
-	sao, err := newSetAttrOp(filePath.tailName(), parentPtr,
-		exAttr, filePath.tailPointer())
-	if err != nil {
+		var data []byte
+		err = fbo.runUnlessCanceled(ctx, func() error {
+			lState := makeFBOLockState()
+
+			// verify we have permission to read
+			md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+			if err != nil {
+				return err
+			}
+
+			data, err = fbo.blocks.ReadLeafForCopy(ctx, lState,
+				md.ReadOnly(), src, srcOff+copied, length-copied)
+			return err
+		})
+		if err != nil {
+			return copied, dirty, err
+		}
+		if len(data) == 0 {
+			break
+		}
+
+		err = fbo.writeUnchecked(ctx, dst, data, dstOff+copied)
+		if err != nil {
+			return copied, dirty, err
+		}
+		copied += int64(len(data))
+		unsynced += int64(len(data))
+		dirty = true
+
+		if unsynced >= syncBytes ||
+			fbo.config.DirtyBlockCache().ShouldForceSync(fbo.id()) {
+			fbo.log.CDebugf(ctx, "Syncing after %d copied bytes", copied)
+			err = syncAll()
+			if err != nil {
+				return copied, dirty, err
+			}
+			unsynced = 0
+			dirty = false
+		}
+	}
+	return copied, dirty, nil
+}
+
+// spliceLeavesForCopy splices the whole, synced leaves of `src` that
+// start at `srcOff` onto the end of `dst`, if `dst` ends at `dstOff`,
+// and returns the number of bytes spliced.  Each leaf gets a new
+// reference on the server first, so that `dst` can be read before
+// it's synced.  A leaf the server can't reference yet, like one
+// still in the journal, ends the splice, and the caller copies it
+// instead.
+func (fbo *folderBranchOps) spliceLeavesForCopy(
+	ctx context.Context, src, dst Node, srcOff, dstOff, maxLen int64) (
+	int64, error) {
+	var md ImmutableRootMetadata
+	var refs []IndirectFilePtr
+	var end int64
+	err := fbo.runUnlessCanceled(ctx, func() (err error) {
+		lState := makeFBOLockState()
+		md, err = fbo.getMDForReadNeedIdentify(ctx, lState)
+		if err != nil {
+			return err
+		}
+		refs, end, err = fbo.blocks.NewLeafRefsForCopy(
+			ctx, lState, md.ReadOnly(), src, srcOff, maxLen)
 		return err
+	})
+	if err != nil || len(refs) == 0 {
+		return 0, err
 	}
-	sao.AddSelfUpdate(parentPtr)
 
-	// If the node has been unlinked, we can safely ignore this setex.
-	if fbo.nodeCache.IsUnlinked(file) {
-		fbo.log.CDebugf(ctx, "Skipping setex for a removed file %v",
-			filePath.tailPointer())
-		fbo.blocks.UpdateCachedEntryAttributesOnRemovedFile(
-			ctx, lState, md.ReadOnly(), sao, filePath, de)
-		return nil
+	bserv := fbo.config.BlockServer()
+	tlfName := md.GetTlfHandle().GetCanonicalName()
+	for i, ref := range refs {
+		err := PutBlockCheckLimitErrs(ctx, bserv, fbo.config.Reporter(),
+			fbo.id(), ref.BlockPointer, ReadyBlockData{}, tlfName)
+		if isRecoverableBlockError(err) {
+			fbo.log.CDebugf(ctx, "Can't reference %v for a copy: %+v",
+				ref.BlockPointer, err)
+			if i == 0 {
+				return 0, nil
+			}
+			end = int64(refs[i].Off)
+			refs = refs[:i]
+			break
+		} else if err != nil {
+			fbo.deleteRefsForCopy(ctx, refs[:i])
+			return 0, err
+		}
 	}
 
-	sao.setFinalPath(filePath)
+	// Move the leaves over to where they go in `dst`.
+	shift := dstOff - srcOff
+	for i := range refs {
+		refs[i].Off += Int64Offset(shift)
+	}
+	var spliced int
+	err = fbo.runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+		md, err := fbo.getMDForRead(ctx, lState, mdReadNeedIdentify)
+		if err != nil {
+			return err
+		}
+		filePath, err := fbo.pathFromNodeForRead(dst)
+		if err != nil {
+			return err
+		}
+		err = fbo.checkTeamContentPolicy(ctx, lState, md, filePath,
+			false, uint64(end+shift))
+		if err != nil {
+			return err
+		}
 
-	dirCacheUndoFn, err := fbo.blocks.SetAttrInDirEntryInCache(
-		ctx, lState, md, filePath, de, sao.Attr)
-	if err != nil {
+		spliced, err = fbo.blocks.SpliceLeavesForCopy(
+			ctx, lState, md.ReadOnly(), dst, refs, end+shift)
+		if spliced > 0 {
+			fbo.status.addDirtyNode(dst)
+			fbo.signalWrite()
+		}
 		return err
+	})
+	fbo.deleteRefsForCopy(ctx, refs[spliced:])
+	if err != nil || spliced == 0 {
+		return 0, err
 	}
-	return fbo.notifyAndSyncOrSignal(
-		ctx, lState, dirCacheUndoFn, []Node{file}, sao, md.ReadOnly())
+	if spliced < len(refs) {
+		end = int64(refs[spliced].Off) - shift
+	}
+	return end - srcOff, nil
 }
 
-func (fbo *folderBranchOps) SetEx(
-	ctx context.Context, file Node, ex bool) (err error) {
-	fbo.log.CDebugf(ctx, "SetEx %s %t", getNodeIDStr(file), ex)
-	defer func() {
-		fbo.deferLog.CDebugf(ctx, "SetEx %s %t done: %+v",
-			getNodeIDStr(file), ex, err)
-	}()
-
-	err = fbo.checkNodeForWrite(ctx, file)
-	if err != nil {
+// deleteRefsForCopy removes the references made by
+// spliceLeavesForCopy for leaves that didn't make it into the copy.
+func (fbo *folderBranchOps) deleteRefsForCopy(
+	ctx context.Context, refs []IndirectFilePtr) {
+	if len(refs) == 0 {
 		return
 	}
-
-	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
-		func(lState *lockState) error {
-			return fbo.setExLocked(ctx, lState, file, ex)
-		})
+	ptrs := make([]BlockPointer, len(refs))
+	for i, ref := range refs {
+		ptrs[i] = ref.BlockPointer
+	}
+	_, err := fbo.config.BlockOps().Delete(ctx, fbo.id(), ptrs)
+	if err != nil {
+		fbo.log.CDebugf(ctx, "Couldn't delete unused references "+
+			"for a copy: %+v", err)
+	}
 }
 
-func (fbo *folderBranchOps) setMtimeLocked(
-	ctx context.Context, lState *lockState, file Node,
-	mtime *time.Time) error {
+// cloneFileLocked creates `name` in `dstDir` as a copy of `src`, in a
+// single createOp.  Like conflict resolution, it deep-copies the
+// block tree of `src`: the clone gets new indirect blocks, and new
+// references to the leaf blocks of `src`, so the data itself is
+// neither read nor uploaded again.  Nothing appears under `name`
+// unless the whole MD write succeeds.
+func (fbo *folderBranchOps) cloneFileLocked(
+	ctx context.Context, lState *lockState, src Node, dstDir Node,
+	name string) (err error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
-	filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
+	if err := checkDisallowedPrefixes(ctx, name); err != nil {
+		return err
+	}
+	if uint32(len(name)) > fbo.config.MaxNameBytes() {
+		return NameTooLongError{name, fbo.config.MaxNameBytes()}
+	}
+	if err := fbo.checkForUnlinkedDir(dstDir); err != nil {
+		return err
+	}
+
+	// The clone gets its own revision, so flush everything that's
+	// buffered first, including any pending writes to `src`.
+	err = fbo.syncAllLocked(ctx, lState, NoExcl)
 	if err != nil {
 		return err
 	}
 
-	if !filePath.hasValidParent() {
-		return InvalidParentPathError{filePath}
+	filename, err := fbo.canonicalPath(ctx, dstDir, name)
+	if err != nil {
+		return err
+	}
+	md, err := fbo.getSuccessorMDForWriteLockedForFilename(
+		ctx, lState, filename)
+	if err != nil {
+		return err
+	}
+	dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dstDir)
+	if err != nil {
+		return err
+	}
+	srcPath, err := fbo.pathFromNodeForMDWriteLocked(lState, src)
+	if err != nil {
+		return err
+	}
+	srcDe, err := fbo.blocks.GetEntry(ctx, lState, md.ReadOnly(), srcPath)
+	if err != nil {
+		return err
+	}
+	if srcDe.Type != File && srcDe.Type != Exec {
+		return NotFileError{srcPath}
 	}
 
-	// Verify we have permission to write (no need to make a successor yet).
-	md, err := fbo.getMDForWriteLockedForFilename(ctx, lState, "")
+	err = fbo.checkTeamContentPolicy(
+		ctx, lState, md, dirPath.ChildPathNoPtr(name), true, srcDe.Size)
+	if err != nil {
+		return err
+	}
+	_, err = fbo.blocks.GetEntry(
+		ctx, lState, md.ReadOnly(), dirPath.ChildPathNoPtr(name))
+	if err == nil {
+		return NameExistsError{name}
+	} else if _, notExists := errors.Cause(err).(NoSuchNameError); !notExists {
+		return err
+	}
+	err = fbo.checkNewDirSize(ctx, lState, md.ReadOnly(), dirPath, name)
 	if err != nil {
 		return err
 	}
 
-	de, err := fbo.blocks.GetEntryEvenIfDeleted(
-		ctx, lState, md.ReadOnly(), filePath)
+	co, err := newCreateOp(name, dirPath.tailPointer(), srcDe.Type)
 	if err != nil {
 		return err
 	}
-	de.Mtime = mtime.UnixNano()
-	// setting the mtime counts as changing the file MD, so must set ctime too
-	de.Ctime = fbo.nowUnixNano()
+	co.setFinalPath(dirPath)
+	md.AddOp(co)
 
-	parentPtr := filePath.parentPath().tailPointer()
-	sao, err := newSetAttrOp(filePath.tailName(), parentPtr,
-		mtimeAttr, filePath.tailPointer())
+	// Simple dirty bcaches don't need to be shut down.
+	dirtyBcache := simpleDirtyBlockCacheStandard()
+	newTopPtr, _, err := fbo.blocks.DeepCopyCleanFile(
+		ctx, lState, md.ReadOnly(), srcPath, dirtyBcache,
+		fbo.config.DataVersion())
 	if err != nil {
 		return err
 	}
-	sao.AddSelfUpdate(parentPtr)
+	block, err := dirtyBcache.Get(fbo.id(), newTopPtr, fbo.branch())
+	if err != nil {
+		return err
+	}
+	fblock, isFileBlock := block.(*FileBlock)
+	if !isFileBlock {
+		return NotFileBlockError{newTopPtr, fbo.branch(), srcPath}
+	}
 
-	// If the node has been unlinked, we can safely ignore this
-	// setmtime.
-	if fbo.nodeCache.IsUnlinked(file) {
-		fbo.log.CDebugf(ctx, "Skipping setmtime for a removed file %v",
-			filePath.tailPointer())
-		fbo.blocks.UpdateCachedEntryAttributesOnRemovedFile(
-			ctx, lState, md.ReadOnly(), sao, filePath, de)
-		return nil
+	bps := newBlockPutState(1)
+	defer func() {
+		if err != nil {
+			fbo.fbm.cleanUpBlockState(md.ReadOnly(), bps, blockDeleteOnMDFail)
+		}
+	}()
+
+	// Ready the copied indirect blocks the same way the prepper does
+	// for conflict resolution.
+	if fblock.IsInd {
+		newPath := dirPath.ChildPath(name, newTopPtr)
+		// The journal can only add new references to blocks that
+		// are already on the server, so if any block of `src` is
+		// still waiting in the journal, fetch each block and ready
+		// it instead.
+		undup := false
+		if TLFJournalEnabled(fbo.config, fbo.id()) {
+			undup, err = fbo.hasUnflushedBlocks(
+				ctx, lState, md.ReadOnly(), srcPath)
+			if err != nil {
+				return err
+			}
+		}
+		var infos []BlockInfo
+		if undup {
+			infos, err = fbo.blocks.UndupChildrenInCopy(
+				ctx, lState, md.ReadOnly(), newPath, bps, dirtyBcache,
+				fblock)
+			if err != nil {
+				return err
+			}
+		} else {
+			_, err = fbo.blocks.ReadyNonLeafBlocksInCopy(
+				ctx, lState, md.ReadOnly(), newPath, bps, dirtyBcache,
+				fblock)
+			if err != nil {
+				return err
+			}
+
+			infos, err = fbo.blocks.GetIndirectFileBlockInfosWithTopBlock(
+				ctx, lState, md.ReadOnly(), newPath, fblock)
+			if err != nil {
+				return err
+			}
+
+			for _, info := range infos {
+				// The indirect blocks were already added to `bps`,
+				// so only add the new leaf references.
+				if info.RefNonce != kbfsblock.ZeroRefNonce {
+					bps.addNewBlock(
+						info.BlockPointer, nil, ReadyBlockData{}, nil)
+				}
+			}
+		}
+		for _, info := range infos {
+			md.AddRefBlock(info)
+		}
 	}
 
-	sao.setFinalPath(filePath)
+	chargedTo, err := chargedToForTLF(
+		ctx, fbo.config.KBPKI(), fbo.config.KBPKI(), md.GetTlfHandle())
+	if err != nil {
+		return err
+	}
+	_, _, dirBps, err := fbo.prepper.prepUpdateForPath(
+		ctx, lState, chargedTo, md, fblock, newTopPtr, dirPath, name,
+		srcDe.Type, srcDe.Size, true, true, zeroPtr, make(localBcache))
+	if err != nil {
+		return err
+	}
+	bps.mergeOtherBps(dirBps)
 
-	dirCacheUndoFn, err := fbo.blocks.SetAttrInDirEntryInCache(
-		ctx, lState, md.ReadOnly(), filePath, de, sao.Attr)
+	if !fbo.config.BlockSplitter().ShouldEmbedBlockChanges(
+		&md.data.Changes) {
+		err = fbo.prepper.unembedBlockChanges(
+			ctx, bps, md, &md.data.Changes, chargedTo)
+		if err != nil {
+			return err
+		}
+	}
+
+	ptrsToDelete, err := doBlockPuts(ctx, fbo.config.BlockServer(),
+		fbo.config.BlockCache(), fbo.config.Reporter(), fbo.log,
+		fbo.deferLog, md.TlfID(), md.GetTlfHandle().GetCanonicalName(), *bps)
 	if err != nil {
 		return err
 	}
-	return fbo.notifyAndSyncOrSignal(
-		ctx, lState, dirCacheUndoFn, []Node{file}, sao, md.ReadOnly())
+	if len(ptrsToDelete) > 0 {
+		return errors.Errorf("Unexpected pointers to delete after "+
+			"putting the blocks of a clone: %v", ptrsToDelete)
+	}
+
+	return fbo.finalizeMDWriteLocked(ctx, lState, md, bps, NoExcl,
+		func(md ImmutableRootMetadata) error {
+			return fbo.notifyBatchLocked(ctx, lState, md)
+		})
 }
 
-func (fbo *folderBranchOps) SetMtime(
-	ctx context.Context, file Node, mtime *time.Time) (err error) {
-	fbo.log.CDebugf(ctx, "SetMtime %s %v", getNodeIDStr(file), mtime)
+// hasUnflushedBlocks returns whether any of the indirect or leaf
+// blocks of `file` are still waiting in the journal.
+func (fbo *folderBranchOps) hasUnflushedBlocks(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file path) (
+	bool, error) {
+	infos, err := fbo.blocks.GetIndirectFileBlockInfos(
+		ctx, lState, kmd, file)
+	if err != nil {
+		return false, err
+	}
+	bserv := fbo.config.BlockServer()
+	for _, info := range infos {
+		unflushed, err := bserv.IsUnflushed(ctx, fbo.id(), info.ID)
+		if err != nil {
+			return false, err
+		}
+		if unflushed {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// CloneFile implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) CloneFile(
+	ctx context.Context, src Node, dstDir Node, name string) (
+	node Node, ei EntryInfo, err error) {
+	fbo.log.CDebugf(ctx, "CloneFile %s -> %s %s",
+		getNodeIDStr(src), getNodeIDStr(dstDir), name)
 	defer func() {
-		fbo.deferLog.CDebugf(ctx, "SetMtime %s %v done: %+v",
-			getNodeIDStr(file), mtime, err)
+		fbo.deferLog.CDebugf(ctx, "CloneFile %s -> %s %s done: %+v",
+			getNodeIDStr(src), getNodeIDStr(dstDir), name, err)
 	}()
 
-	if mtime == nil {
-		// Can happen on some OSes (e.g. OSX) when trying to set the atime only
-		return nil
+	err = fbo.checkNode(src)
+	if err != nil {
+		return nil, EntryInfo{}, err
 	}
-
-	err = fbo.checkNodeForWrite(ctx, file)
+	err = fbo.checkNodeForWrite(ctx, dstDir)
 	if err != nil {
-		return
+		return nil, EntryInfo{}, err
 	}
 
-	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
 		func(lState *lockState) error {
-			return fbo.setMtimeLocked(ctx, lState, file, mtime)
+			return fbo.cloneFileLocked(ctx, lState, src, dstDir, name)
 		})
-}
-
-type cleanupFn func(context.Context, *lockState, []BlockPointer, error)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
 
-// startSyncLocked readies the blocks and other state needed to sync a
-// single file.  It returns:
-//
-// * `doSync`: Whether or not the sync should actually happen.
-// * `stillDirty`: Whether the file should still be considered dirty when
-//   this function returns.  (That is, if `doSync` is false, and `stillDirty`
-//   is true, then the file has outstanding changes but the sync was vetoed for
-//   some other reason.)
-// * `fblock`: the root file block for the file being sync'd.
-// * `lbc`: A local block cache consisting of a dirtied version of the parent
-//   directory for this file.
-// * `bps`: All the blocks that need to be put to the server.
-// * `syncState`: Must be passed to the `FinishSyncLocked` call after the
-//   update completes.
-// * `cleanupFn`: A function that, if non-nil, must be called after the sync
-//   is done.  `cleanupFn` should be passed the set of bad blocks that couldn't
-//   be sync'd (if any), and the error.
-// * `err`: The best, greatest return value, everyone says it's absolutely
-//   stunning.
-func (fbo *folderBranchOps) startSyncLocked(ctx context.Context,
-	lState *lockState, md *RootMetadata, node Node, file path) (
-	doSync, stillDirty bool, fblock *FileBlock, dirtyDe *DirEntry,
-	bps *blockPutState, syncState fileSyncState,
-	cleanup cleanupFn, err error) {
-	fbo.mdWriterLock.AssertLocked(lState)
+	return fbo.Lookup(ctx, dstDir, name)
+}
 
-	// if the cache for this file isn't dirty, we're done
-	if !fbo.blocks.IsDirty(lState, file) {
-		return false, false, nil, nil, nil, fileSyncState{}, nil, nil
+func (fbo *folderBranchOps) Truncate(
+	ctx context.Context, file Node, size uint64) (err error) {
+	fbo.log.CDebugf(ctx, "Truncate %s %d", getNodeIDStr(file), size)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "Truncate %s %d done: %+v",
+			getNodeIDStr(file), size, err)
+	}()
+
+	err = fbo.checkNodeForWrite(ctx, file)
+	if err != nil {
+		return err
 	}
 
-	// If the MD doesn't match the MD expected by the path, that
-	// implies we are using a cached path, which implies the node has
-	// been unlinked.  In that case, we can safely ignore this sync.
-	if fbo.nodeCache.IsUnlinked(node) {
-		fbo.log.CDebugf(ctx, "Skipping sync for a removed file %v",
-			file.tailPointer())
-		// Removing the cached info here is a little sketchy,
-		// since there's no guarantee that this sync comes
-		// from closing the file, and we still want to serve
-		// stat calls accurately if the user still has an open
-		// handle to this file.
-		//
-		// Note in particular that if a file just had a dirty
-		// directory entry cached (due to an attribute change on a
-		// removed file, for example), this will clear that attribute
-		// change.  If there's still an open file handle, the user
-		// won't be able to see the change anymore.
-		//
-		// TODO: Hook this in with the node cache GC logic to be
-		// perfectly accurate (but at the same time, we'd then have to
-		// fix up the intentional panic in the background flusher to
-		// be more tolerant of long-lived dirty, removed files).
-		err := fbo.blocks.ClearCacheInfo(lState, file)
+	return fbo.runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+
+		// Get the MD for reading.  We won't modify it; we'll track the
+		// unref changes on the side, and put them into the MD during the
+		// sync.
+		md, err := fbo.getMDForRead(ctx, lState, mdReadNeedIdentify)
 		if err != nil {
-			return false, false, nil, nil, nil, fileSyncState{}, nil, err
+			return err
 		}
-		fbo.status.rmDirtyNode(node)
-		return false, true, nil, nil, nil, fileSyncState{}, nil, nil
-	}
 
-	if file.isValidForNotification() {
-		// notify the daemon that a write is being performed
-		fbo.config.Reporter().Notify(ctx, writeNotification(file, false))
-		defer fbo.config.Reporter().Notify(ctx, writeNotification(file, true))
+		filePath, err := fbo.pathFromNodeForRead(file)
+		if err != nil {
+			return err
+		}
+		err = fbo.checkTeamContentPolicy(
+			ctx, lState, md, filePath, false, size)
+		if err != nil {
+			return err
+		}
+
+		if fbo.config.TimestampMode().strict() {
+			de, err := fbo.blocks.GetEntry(
+				ctx, lState, md.ReadOnly(), filePath)
+			if err != nil {
+				return err
+			}
+			if de.Size == size {
+				// The blocks won't change, but POSIX still
+				// requires new times.
+				now := fbo.config.Clock().Now()
+				return fbo.SetMtime(ctx, file, &now)
+			}
+		}
+
+		err = fbo.blocks.Truncate(
+			ctx, lState, md.ReadOnly(), file, size)
+		if err != nil {
+			return err
+		}
+
+		fbo.status.addDirtyNode(file)
+		fbo.signalWrite()
+		return fbo.maybeWriteThrough(ctx, file)
+	})
+}
+
+func (fbo *folderBranchOps) setExLocked(
+	ctx context.Context, lState *lockState, file Node, ex bool) (err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
+	if err != nil {
+		return err
 	}
 
-	fblock, bps, dirtyDe, syncState, err =
-		fbo.blocks.StartSync(ctx, lState, md, file)
-	cleanup = func(ctx context.Context, lState *lockState,
-		blocksToRemove []BlockPointer, err error) {
-		fbo.blocks.CleanupSyncState(
-			ctx, lState, md.ReadOnly(), file, blocksToRemove, syncState, err)
+	if !filePath.hasValidParent() {
+		return InvalidParentPathError{filePath}
 	}
+
+	// Verify we have permission to write (no need to make a successor yet).
+	md, err := fbo.getMDForWriteLockedForFilename(ctx, lState, "")
 	if err != nil {
-		return false, true, nil, nil, nil, fileSyncState{}, cleanup, err
+		return
 	}
 
-	return true, true, fblock, dirtyDe, bps, syncState, cleanup, nil
-}
+	err = fbo.checkTeamContentPolicy(
+		ctx, lState, md, filePath, false, 0)
+	if err != nil {
+		return err
+	}
 
-func addSelfUpdatesAndParent(
-	p path, op op, parentsToAddChainsFor map[BlockPointer]bool) {
-	for i, pn := range p.path {
-		if i == len(p.path)-1 {
-			op.AddSelfUpdate(pn.BlockPointer)
-		} else {
-			parentsToAddChainsFor[pn.BlockPointer] = true
-		}
+	de, err := fbo.blocks.GetEntryEvenIfDeleted(
+		ctx, lState, md.ReadOnly(), filePath)
+	if err != nil {
+		return err
 	}
-}
 
-func (fbo *folderBranchOps) syncAllLocked(
-	ctx context.Context, lState *lockState, excl Excl) (err error) {
-	fbo.mdWriterLock.AssertLocked(lState)
+	// If the file is a symlink, do nothing (to match ext4
+	// behavior).
+	if de.Type == Sym || de.Type == Dir {
+		fbo.log.CDebugf(ctx, "Ignoring setex on type %s", de.Type)
+		return nil
+	}
 
-	dirtyFiles := fbo.blocks.GetDirtyFileBlockRefs(lState)
-	dirtyDirs := fbo.blocks.GetDirtyDirBlockRefs(lState)
-	if len(dirtyFiles) == 0 && len(dirtyDirs) == 0 {
+	if ex && (de.Type == File) {
+		de.Type = Exec
+	} else if !ex && (de.Type == Exec) {
+		de.Type = File
+	} else if !fbo.config.TimestampMode().strict() {
+		// Treating this as a no-op, without updating the ctime, is a
+		// POSIX violation, but it's an important optimization to keep
+		// permissions-preserving rsyncs fast.
+		fbo.log.CDebugf(ctx, "Ignoring no-op setex")
 		return nil
 	}
 
-	ctx = fbo.config.MaybeStartTrace(ctx, "FBO.SyncAll",
-		fmt.Sprintf("%d files, %d dirs", len(dirtyFiles), len(dirtyDirs)))
-	defer func() { fbo.config.MaybeFinishTrace(ctx, err) }()
+	de.Ctime = fbo.nowUnixNano()
 
-	// Verify we have permission to write.  We do this after the dirty
-	// check because otherwise readers who call syncAll would get an
-	// error.
-	md, err := fbo.getSuccessorMDForWriteLocked(ctx, lState)
+	parentPtr := filePath.parentPath().tailPointer()
+	sao, err := newSetAttrOp(filePath.tailName(), parentPtr,
+		exAttr, filePath.tailPointer())
 	if err != nil {
 		return err
 	}
+	sao.AddSelfUpdate(parentPtr)
 
-	bps := newBlockPutState(0)
-	resolvedPaths := make(map[BlockPointer]path)
-	lbc := make(localBcache)
+	// If the node has been unlinked, we can safely ignore this setex.
+	if fbo.nodeCache.IsUnlinked(file) {
+		fbo.log.CDebugf(ctx, "Skipping setex for a removed file %v",
+			filePath.tailPointer())
+		fbo.blocks.UpdateCachedEntryAttributesOnRemovedFile(
+			ctx, lState, md.ReadOnly(), sao, filePath, de)
+		return nil
+	}
 
-	var cleanups []func(context.Context, *lockState, error)
+	sao.setFinalPath(filePath)
+
+	dirCacheUndoFn, err := fbo.blocks.SetAttrInDirEntryInCache(
+		ctx, lState, md, filePath, de, sao.Attr)
+	if err != nil {
+		return err
+	}
+	return fbo.notifyAndSyncOrSignal(
+		ctx, lState, dirCacheUndoFn, []Node{file}, sao, md.ReadOnly())
+}
+
+func (fbo *folderBranchOps) SetEx(
+	ctx context.Context, file Node, ex bool) (err error) {
+	fbo.log.CDebugf(ctx, "SetEx %s %t", getNodeIDStr(file), ex)
 	defer func() {
-		for _, cf := range cleanups {
-			cf(ctx, lState, err)
-		}
+		fbo.deferLog.CDebugf(ctx, "SetEx %s %t done: %+v",
+			getNodeIDStr(file), ex, err)
 	}()
 
-	fbo.log.LazyTrace(ctx, "Syncing %d dir(s)", len(dirtyDirs))
+	err = fbo.checkNodeForWrite(ctx, file)
+	if err != nil {
+		return
+	}
 
-	// Get the most up-to-date mtime and ctime in the root block.
-	rootDe, err := fbo.blocks.GetEntry(ctx, lState, md.ReadOnly(), path{})
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			return fbo.setExLocked(ctx, lState, file, ex)
+		})
+}
+
+// setExInSubtreeBatchLocked changes the executable bit on up to
+// `maxDirOpsPerBatch` files under `dir`, and syncs all the
+// resulting setattr ops in a single MD revision.  It returns true if
+// there are no more files left to change.
+func (fbo *folderBranchOps) setExInSubtreeBatchLocked(
+	ctx context.Context, lState *lockState, dir Node, ex bool) (
+	done bool, err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	if err := fbo.checkForUnlinkedDir(dir); err != nil {
+		return false, err
+	}
+
+	// Verify we have permission to write (no need to make a successor yet).
+	md, err := fbo.getMDForWriteLockedForFilename(ctx, lState, "")
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	// First prep all the directories.
-	fbo.log.CDebugf(ctx, "Syncing %d dir(s)", len(dirtyDirs))
-	for _, ref := range dirtyDirs {
-		node := fbo.nodeCache.Get(ref)
-		if node == nil {
-			continue
-		}
+	saos, nodes, undoFn, err := fbo.blocks.SetExInSubtree(
+		ctx, lState, md, dir, ex, maxDirOpsPerBatch)
+	if err != nil {
+		return false, err
+	}
+	if len(saos) == 0 {
+		return true, nil
+	}
+	fbo.log.CDebugf(ctx, "Setting ex=%t on %d file(s) under %s",
+		ex, len(saos), getNodeIDStr(dir))
 
-		dir := fbo.nodeCache.PathFromNode(node)
-		dblock, err := fbo.blocks.GetDirtyDir(ctx, lState, md, dir, blockWrite)
+	numDirOps := len(fbo.dirOps)
+	var addedNodes []Node
+	defer func() {
 		if err != nil {
-			return err
+			for _, n := range addedNodes {
+				fbo.status.rmDirtyNode(n)
+			}
+			fbo.dirOps = fbo.dirOps[:numDirOps]
+			undoFn(lState)
 		}
+	}()
 
-		lbc[dir.tailPointer()] = dblock.DeepCopy()
-		if !fbo.nodeCache.IsUnlinked(node) {
-			resolvedPaths[dir.tailPointer()] = dir
+	for i, sao := range saos {
+		fbo.dirOps = append(fbo.dirOps, cachedDirOp{sao, []Node{nodes[i]}})
+		if fbo.status.addDirtyNode(nodes[i]) {
+			addedNodes = append(addedNodes, nodes[i])
+		}
+		err = fbo.notifyOneOp(ctx, lState, sao, md.ReadOnly(), false)
+		if err != nil {
+			return false, err
 		}
+	}
 
-		// Add the parent directory of this dirty directory to the
-		// `lbc`, to reflect the updated mtime/ctimes of the dirty
+	// Sync all the changes now, rather than waiting for the
+	// background flusher, to keep each revision bounded.
+	err = fbo.syncAllLocked(ctx, lState, NoExcl)
+	if err != nil {
+		return false, err
+	}
+	return len(saos) < maxDirOpsPerBatch, nil
+}
+
+// SetExInSubtree implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) SetExInSubtree(
+	ctx context.Context, dir Node, ex bool) (err error) {
+	fbo.log.CDebugf(ctx, "SetExInSubtree %s %t", getNodeIDStr(dir), ex)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "SetExInSubtree %s %t done: %+v",
+			getNodeIDStr(dir), ex, err)
+	}()
+
+	err = fbo.checkNodeForWrite(ctx, dir)
+	if err != nil {
+		return err
+	}
+
+	// Release the write lock between batches, so that other writers
+	// can make progress during a big recursive change.
+	for done := false; !done; {
+		err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+			func(lState *lockState) (err error) {
+				done, err = fbo.setExInSubtreeBatchLocked(
+					ctx, lState, dir, ex)
+				return err
+			})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prepSetTimesLocked sets the mtime of `file` in the dir entry
+// cache, and returns the corresponding setattr op, which has not yet
+// been added to the list of pending dir ops.  If `ctime` is nil, the
+// ctime is set to the current time; otherwise it is recorded as
+// given, so that restored files can keep their original change
+// times, unless timestamps follow POSIX strictly.  If `file` has been unlinked, the change is applied only to
+// the cached unlinked entry, and a nil op is returned.
+func (fbo *folderBranchOps) prepSetTimesLocked(
+	ctx context.Context, lState *lockState, md ImmutableRootMetadata,
+	file Node, mtime time.Time, ctime *time.Time) (
+	*setAttrOp, dirCacheUndoFn, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !filePath.hasValidParent() {
+		return nil, nil, InvalidParentPathError{filePath}
+	}
+
+	err = fbo.checkTeamContentPolicy(
+		ctx, lState, md, filePath, false, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	de, err := fbo.blocks.GetEntryEvenIfDeleted(
+		ctx, lState, md.ReadOnly(), filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	de.Mtime = mtime.UnixNano()
+	if ctime != nil && !fbo.config.TimestampMode().strict() {
+		de.Ctime = ctime.UnixNano()
+	} else {
+		// setting the mtime counts as changing the file MD, so must
+		// set ctime too
+		de.Ctime = fbo.nowUnixNano()
+	}
+
+	parentPtr := filePath.parentPath().tailPointer()
+	sao, err := newSetAttrOp(filePath.tailName(), parentPtr,
+		mtimeAttr, filePath.tailPointer())
+	if err != nil {
+		return nil, nil, err
+	}
+	sao.AddSelfUpdate(parentPtr)
+
+	// If the node has been unlinked, we can safely ignore this
+	// setmtime.
+	if fbo.nodeCache.IsUnlinked(file) {
+		fbo.log.CDebugf(ctx, "Skipping setmtime for a removed file %v",
+			filePath.tailPointer())
+		fbo.blocks.UpdateCachedEntryAttributesOnRemovedFile(
+			ctx, lState, md.ReadOnly(), sao, filePath, de)
+		return nil, nil, nil
+	}
+
+	sao.setFinalPath(filePath)
+
+	dirCacheUndoFn, err := fbo.blocks.SetAttrInDirEntryInCache(
+		ctx, lState, md.ReadOnly(), filePath, de, sao.Attr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sao, dirCacheUndoFn, nil
+}
+
+func (fbo *folderBranchOps) setTimesLocked(
+	ctx context.Context, lState *lockState, file Node,
+	mtime time.Time, ctime *time.Time) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	// Verify we have permission to write (no need to make a successor yet).
+	md, err := fbo.getMDForWriteLockedForFilename(ctx, lState, "")
+	if err != nil {
+		return err
+	}
+
+	sao, dirCacheUndoFn, err := fbo.prepSetTimesLocked(
+		ctx, lState, md, file, mtime, ctime)
+	if err != nil {
+		return err
+	}
+	if sao == nil {
+		return nil
+	}
+	return fbo.notifyAndSyncOrSignal(
+		ctx, lState, dirCacheUndoFn, []Node{file}, sao, md.ReadOnly())
+}
+
+func (fbo *folderBranchOps) SetMtime(
+	ctx context.Context, file Node, mtime *time.Time) (err error) {
+	fbo.log.CDebugf(ctx, "SetMtime %s %v", getNodeIDStr(file), mtime)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "SetMtime %s %v done: %+v",
+			getNodeIDStr(file), mtime, err)
+	}()
+
+	if mtime == nil {
+		// Can happen on some OSes (e.g. OSX) when trying to set the atime only
+		return nil
+	}
+
+	err = fbo.checkNodeForWrite(ctx, file)
+	if err != nil {
+		return
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			return fbo.setTimesLocked(ctx, lState, file, *mtime, nil)
+		})
+}
+
+// SetTimes implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) SetTimes(
+	ctx context.Context, file Node, mtime time.Time, ctime *time.Time) (
+	err error) {
+	fbo.log.CDebugf(ctx, "SetTimes %s %v %v", getNodeIDStr(file), mtime, ctime)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "SetTimes %s %v %v done: %+v",
+			getNodeIDStr(file), mtime, ctime, err)
+	}()
+
+	err = fbo.checkNodeForWrite(ctx, file)
+	if err != nil {
+		return err
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			return fbo.setTimesLocked(ctx, lState, file, mtime, ctime)
+		})
+}
+
+// setTimesBatchLocked sets the times on all the given nodes, and
+// syncs the resulting setattr ops in a single MD revision.
+func (fbo *folderBranchOps) setTimesBatchLocked(
+	ctx context.Context, lState *lockState, times []NodeTimes) (err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	// Verify we have permission to write (no need to make a successor yet).
+	md, err := fbo.getMDForWriteLockedForFilename(ctx, lState, "")
+	if err != nil {
+		return err
+	}
+
+	numDirOps := len(fbo.dirOps)
+	var addedNodes []Node
+	var undoFns []dirCacheUndoFn
+	defer func() {
+		if err != nil {
+			for _, n := range addedNodes {
+				fbo.status.rmDirtyNode(n)
+			}
+			fbo.dirOps = fbo.dirOps[:numDirOps]
+			for i := len(undoFns) - 1; i >= 0; i-- {
+				undoFns[i](lState)
+			}
+		}
+	}()
+
+	for _, nt := range times {
+		sao, undoFn, err := fbo.prepSetTimesLocked(
+			ctx, lState, md, nt.Node, nt.Mtime, nt.Ctime)
+		if err != nil {
+			return err
+		}
+		if sao == nil {
+			continue
+		}
+		undoFns = append(undoFns, undoFn)
+		fbo.dirOps = append(fbo.dirOps, cachedDirOp{sao, []Node{nt.Node}})
+		if fbo.status.addDirtyNode(nt.Node) {
+			addedNodes = append(addedNodes, nt.Node)
+		}
+		err = fbo.notifyOneOp(ctx, lState, sao, md.ReadOnly(), false)
+		if err != nil {
+			return err
+		}
+	}
+
+	return fbo.syncAllLocked(ctx, lState, NoExcl)
+}
+
+// SetTimesBatch implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) SetTimesBatch(
+	ctx context.Context, times []NodeTimes) (err error) {
+	fbo.log.CDebugf(ctx, "SetTimesBatch for %d node(s)", len(times))
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "SetTimesBatch for %d node(s) done: %+v",
+			len(times), err)
+	}()
+
+	for _, nt := range times {
+		err = fbo.checkNodeForWrite(ctx, nt.Node)
+		if err != nil {
+			return err
+		}
+	}
+
+	for len(times) > 0 {
+		batch := times
+		if len(batch) > maxDirOpsPerBatch {
+			batch = batch[:maxDirOpsPerBatch]
+		}
+		times = times[len(batch):]
+		err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+			func(lState *lockState) error {
+				return fbo.setTimesBatchLocked(ctx, lState, batch)
+			})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type cleanupFn func(context.Context, *lockState, []BlockPointer, error)
+
+// startSyncLocked readies the blocks and other state needed to sync a
+// single file.  It returns:
+//
+// * `doSync`: Whether or not the sync should actually happen.
+// * `stillDirty`: Whether the file should still be considered dirty when
+//   this function returns.  (That is, if `doSync` is false, and `stillDirty`
+//   is true, then the file has outstanding changes but the sync was vetoed for
+//   some other reason.)
+// * `fblock`: the root file block for the file being sync'd.
+// * `lbc`: A local block cache consisting of a dirtied version of the parent
+//   directory for this file.
+// * `bps`: All the blocks that need to be put to the server.
+// * `syncState`: Must be passed to the `FinishSyncLocked` call after the
+//   update completes.
+// * `cleanupFn`: A function that, if non-nil, must be called after the sync
+//   is done.  `cleanupFn` should be passed the set of bad blocks that couldn't
+//   be sync'd (if any), and the error.
+// * `err`: The best, greatest return value, everyone says it's absolutely
+//   stunning.
+//
+// `sc` is the canceler of the sync batch.
+func (fbo *folderBranchOps) startSyncLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, node Node, file path,
+	sc *syncCanceler) (
+	doSync, stillDirty bool, fblock *FileBlock, dirtyDe *DirEntry,
+	bps *blockPutState, syncState fileSyncState,
+	cleanup cleanupFn, err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	// if the cache for this file isn't dirty, we're done
+	if !fbo.blocks.IsDirty(lState, file) {
+		return false, false, nil, nil, nil, fileSyncState{}, nil, nil
+	}
+
+	// If the MD doesn't match the MD expected by the path, that
+	// implies we are using a cached path, which implies the node has
+	// been unlinked.  In that case, we can safely ignore this sync.
+	if fbo.nodeCache.IsUnlinked(node) {
+		fbo.log.CDebugf(ctx, "Skipping sync for a removed file %v",
+			file.tailPointer())
+		// Removing the cached info here is a little sketchy,
+		// since there's no guarantee that this sync comes
+		// from closing the file, and we still want to serve
+		// stat calls accurately if the user still has an open
+		// handle to this file.
+		//
+		// Note in particular that if a file just had a dirty
+		// directory entry cached (due to an attribute change on a
+		// removed file, for example), this will clear that attribute
+		// change.  If there's still an open file handle, the user
+		// won't be able to see the change anymore.
+		//
+		// TODO: Hook this in with the node cache GC logic to be
+		// perfectly accurate (but at the same time, we'd then have to
+		// fix up the intentional panic in the background flusher to
+		// be more tolerant of long-lived dirty, removed files).
+		err := fbo.blocks.ClearCacheInfo(lState, file)
+		if err != nil {
+			return false, false, nil, nil, nil, fileSyncState{}, nil, err
+		}
+		fbo.status.rmDirtyNode(node)
+		return false, true, nil, nil, nil, fileSyncState{}, nil, nil
+	}
+
+	if file.isValidForNotification() {
+		// notify the daemon that a write is being performed
+		fbo.config.Reporter().Notify(ctx, writeNotification(file, false))
+		defer fbo.config.Reporter().Notify(ctx, writeNotification(file, true))
+	}
+
+	fblock, bps, dirtyDe, syncState, err =
+		fbo.blocks.StartSync(ctx, lState, md, file, sc)
+	cleanup = func(ctx context.Context, lState *lockState,
+		blocksToRemove []BlockPointer, err error) {
+		fbo.blocks.CleanupSyncState(
+			ctx, lState, md.ReadOnly(), file, blocksToRemove, syncState, err)
+	}
+	if err != nil {
+		return false, true, nil, nil, nil, fileSyncState{}, cleanup, err
+	}
+
+	return true, true, fblock, dirtyDe, bps, syncState, cleanup, nil
+}
+
+func addSelfUpdatesAndParent(
+	p path, op op, parentsToAddChainsFor map[BlockPointer]bool) {
+	for i, pn := range p.path {
+		if i == len(p.path)-1 {
+			op.AddSelfUpdate(pn.BlockPointer)
+		} else {
+			parentsToAddChainsFor[pn.BlockPointer] = true
+		}
+	}
+}
+
+func (fbo *folderBranchOps) syncAllLocked(
+	ctx context.Context, lState *lockState, excl Excl) (err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	dirtyFiles := fbo.blocks.GetDirtyFileBlockRefs(lState)
+	dirtyDirs := fbo.blocks.GetDirtyDirBlockRefs(lState)
+	if len(dirtyFiles) == 0 && len(dirtyDirs) == 0 {
+		return nil
+	}
+
+	ctx = fbo.config.MaybeStartTrace(ctx, "FBO.SyncAll",
+		fmt.Sprintf("%d files, %d dirs", len(dirtyFiles), len(dirtyDirs)))
+	defer func() { fbo.config.MaybeFinishTrace(ctx, err) }()
+
+	// Let `CancelSync` abort the block puts of the batch.
+	putCtx, sc := newSyncCanceler(ctx)
+	defer sc.cancel()
+
+	defer func() {
+		if !fbo.isSyncOutboxErrorLocked(lState, err) {
+			return
+		}
+		outboxErr := fbo.moveDirtyStateToOutboxLocked(ctx, lState, err)
+		if outboxErr != nil {
+			fbo.log.CWarningf(ctx, "Couldn't move dirty state to the "+
+				"sync outbox: %+v", outboxErr)
+		}
+	}()
+
+	// Verify we have permission to write.  We do this after the dirty
+	// check because otherwise readers who call syncAll would get an
+	// error.
+	md, err := fbo.getSuccessorMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+
+	bps := newBlockPutState(0)
+	resolvedPaths := make(map[BlockPointer]path)
+	lbc := make(localBcache)
+
+	var cleanups []func(context.Context, *lockState, error)
+	defer func() {
+		for _, cf := range cleanups {
+			cf(ctx, lState, err)
+		}
+	}()
+
+	fbo.log.LazyTrace(ctx, "Syncing %d dir(s)", len(dirtyDirs))
+
+	// Get the most up-to-date mtime and ctime in the root block.
+	rootDe, err := fbo.blocks.GetEntry(ctx, lState, md.ReadOnly(), path{})
+	if err != nil {
+		return err
+	}
+
+	// First prep all the directories.
+	fbo.log.CDebugf(ctx, "Syncing %d dir(s)", len(dirtyDirs))
+	for _, ref := range dirtyDirs {
+		node := fbo.nodeCache.Get(ref)
+		if node == nil {
+			continue
+		}
+
+		dir := fbo.nodeCache.PathFromNode(node)
+		dblock, err := fbo.blocks.GetDirtyDir(ctx, lState, md, dir, blockWrite)
+		if err != nil {
+			return err
+		}
+
+		lbc[dir.tailPointer()] = dblock.DeepCopy()
+		if !fbo.nodeCache.IsUnlinked(node) {
+			resolvedPaths[dir.tailPointer()] = dir
+		}
+
+		// Add the parent directory of this dirty directory to the
+		// `lbc`, to reflect the updated mtime/ctimes of the dirty
 		// directory.
 		if dir.hasValidParent() {
 			parentPath := dir.parentPath()
@@ -4343,376 +6637,1177 @@ func (fbo *folderBranchOps) syncAllLocked(
 			}
 		}
 
-		// On a successful sync, clean up the cached entries and the
-		// dirty blocks.  TODO: avoid closures by saving `dir` and
-		// `node` in a list for deferred processing.
-		cleanups = append(cleanups,
-			func(ctx context.Context, lState *lockState, err error) {
-				if err != nil {
-					return
-				}
+		// On a successful sync, clean up the cached entries and the
+		// dirty blocks.  TODO: avoid closures by saving `dir` and
+		// `node` in a list for deferred processing.
+		cleanups = append(cleanups,
+			func(ctx context.Context, lState *lockState, err error) {
+				if err != nil {
+					return
+				}
+				fbo.status.rmDirtyNode(node)
+			})
+	}
+	defer func() {
+		// If the sync is successful, we can clear out all buffered
+		// directory operations.
+		if err == nil {
+			fbo.revokeShareLinksLocked(ctx, lState)
+			fbo.dirOps = nil
+		}
+	}()
+
+	fbo.log.LazyTrace(ctx, "Processing %d op(s)", len(fbo.dirOps))
+
+	newBlocks := make(map[BlockPointer]bool)
+	fileBlocks := make(fileBlockMap)
+	parentsToAddChainsFor := make(map[BlockPointer]bool)
+	for _, dop := range fbo.dirOps {
+		// Copy the op before modifying it, in case there's an error
+		// and we have to retry with the original ops.
+		newOp := dop.dirOp.deepCopy()
+		md.AddOp(newOp)
+
+		// Add "updates" for all the op updates, and make chains for
+		// the rest of the parent directories, so they're treated like
+		// updates during the prepping.
+		for _, n := range dop.nodes {
+			p := fbo.nodeCache.PathFromNode(n)
+			if _, ok := newOp.(*setAttrOp); ok {
+				// For a setattr, the node is the file, but that
+				// doesn't get updated, so use the current parent
+				// node.
+				p = *p.parentPath()
+			}
+
+			addSelfUpdatesAndParent(p, newOp, parentsToAddChainsFor)
+		}
+
+		var ref BlockRef
+		switch realOp := newOp.(type) {
+		case *createOp:
+			if realOp.Type == Sym {
+				continue
+			}
+
+			// New files and directories explicitly need
+			// pointer-updating, because the sync process will turn
+			// them into simple refs and will forget about the local,
+			// temporary ID.
+			newNode := dop.nodes[1]
+			newPath := fbo.nodeCache.PathFromNode(newNode)
+			newPointer := newPath.tailPointer()
+			newBlocks[newPointer] = true
+
+			if realOp.Type != Dir {
+				continue
+			}
+
+			dblock, ok := lbc[newPointer]
+			if !ok {
+				// New directories that aren't otherwise dirty need to
+				// be added to both the `lbc` and `resolvedPaths` so
+				// they are properly synced, and removed from the
+				// dirty block list.
+				dblock, err = fbo.blocks.GetDirtyDir(
+					ctx, lState, md, newPath, blockWrite)
+				if err != nil {
+					return err
+				}
+				lbc[newPointer] = dblock.DeepCopy()
+				if !fbo.nodeCache.IsUnlinked(newNode) {
+					resolvedPaths[newPointer] = newPath
+				}
+				// TODO: avoid closures by saving `newPath` and
+				// `newNode` in a list for deferred processing.
+				cleanups = append(cleanups,
+					func(ctx context.Context, lState *lockState, err error) {
+						if err != nil {
+							return
+						}
+						fbo.status.rmDirtyNode(newNode)
+						fbo.config.DirtyBlockCache().Delete(
+							fbo.id(), newPointer, fbo.branch())
+					})
+			}
+
+			if len(dblock.Children) > 0 || len(dblock.IPtrs) > 0 {
+				continue
+			}
+
+			// If the directory is empty, we need to explicitly clean
+			// up its entry after syncing.
+			ref = newPath.tailRef()
+		case *renameOp:
+			ref = realOp.Renamed.Ref()
+		case *setAttrOp:
+			ref = realOp.File.Ref()
+		default:
+			continue
+		}
+
+		// For create, rename and setattr ops, the target will have a
+		// dirty entry, but may not have any outstanding operations on
+		// it, so it needs to be cleaned up manually.
+		defer func() {
+			if err != nil {
+				return
+			}
+			node := fbo.nodeCache.Get(ref)
+			if node != nil {
+				fbo.status.rmDirtyNode(node)
+			}
+		}()
+	}
+
+	var blocksToRemove []BlockPointer
+	// TODO: find a way to avoid so many dynamic closure dispatches.
+	var afterUpdateFns []func() error
+
+	afterUpdateFns = append(afterUpdateFns, func() error {
+		// Any new files or directories need their pointers explicitly
+		// updated, because the sync will be treating them as a new
+		// ref, and not an update.
+		for _, bs := range bps.blockStates {
+			if newBlocks[bs.oldPtr] {
+				fbo.blocks.updatePointer(
+					md.ReadOnly(), bs.oldPtr, bs.blockPtr, false)
+			}
+		}
+		return nil
+	})
+
+	fbo.log.LazyTrace(ctx, "Syncing %d file(s)", len(dirtyFiles))
+
+	fbo.log.CDebugf(ctx, "Syncing %d file(s)", len(dirtyFiles))
+	fileSyncBlocks := newBlockPutState(1)
+	var syncedFiles []path
+	for _, ref := range dirtyFiles {
+		node := fbo.nodeCache.Get(ref)
+		if node == nil {
+			continue
+		}
+		file := fbo.nodeCache.PathFromNode(node)
+		fbo.log.CDebugf(ctx, "Syncing file %v (%s)", ref, file)
+
+		// Start the sync for this dirty file.
+		doSync, stillDirty, fblock, dirtyDe, newBps, syncState, cleanup, err :=
+			fbo.startSyncLocked(ctx, lState, md, node, file, sc)
+		if cleanup != nil {
+			// Note: This passes the same `blocksToRemove` into each
+			// cleanup function.  That's ok, as only the ones
+			// pertaining to a particular syncing file will be acted
+			// on.
+			cleanups = append(cleanups,
+				func(ctx context.Context, lState *lockState, err error) {
+					cleanup(ctx, lState, blocksToRemove, err)
+				})
+		}
+		if err != nil {
+			return err
+		}
+		if !doSync {
+			if !stillDirty {
+				fbo.status.rmDirtyNode(node)
+			}
+			continue
+		}
+
+		// Merge the per-file sync info into the batch sync info.
+		newBps.setTrafficPath(file.tlfRelativeString())
+		bps.mergeOtherBps(newBps)
+		fileSyncBlocks.mergeOtherBps(newBps)
+		syncedFiles = append(syncedFiles, file)
+		resolvedPaths[file.tailPointer()] = file
+		parent := file.parentPath().tailPointer()
+		if _, ok := fileBlocks[parent]; !ok {
+			fileBlocks[parent] = make(map[string]*FileBlock)
+		}
+		fileBlocks[parent][file.tailName()] = fblock
+
+		// Collect its `afterUpdateFn` along with all the others, so
+		// they all get invoked under the same lock, to avoid any
+		// weird races.
+		afterUpdateFns = append(afterUpdateFns, func() error {
+			// This will be called after the node cache is updated, so
+			// this newPath will be correct.
+			newPath := fbo.nodeCache.PathFromNode(node)
+			stillDirty, err := fbo.blocks.FinishSyncLocked(
+				ctx, lState, file, newPath, md.ReadOnly(), syncState, fbo.fbm)
+			if !stillDirty {
 				fbo.status.rmDirtyNode(node)
-			})
+			}
+			return err
+		})
+
+		// Add an "update" for all the parent directory updates, and
+		// make a chain for the file itself, so they're treated like
+		// updates during the prepping.
+		lastOp := md.Data().Changes.Ops[len(md.Data().Changes.Ops)-1]
+		addSelfUpdatesAndParent(file, lastOp, parentsToAddChainsFor)
+
+		// Update the combined local block cache with this file's
+		// dirty entry.
+		if dirtyDe != nil {
+			fbo.blocks.mergeDirtyEntryWithLBC(
+				ctx, lState, file, md, lbc, *dirtyDe)
+		}
+	}
+
+	session, err := fbo.config.KBPKI().GetCurrentSession(ctx)
+	if err != nil {
+		return err
+	}
+
+	tempIRMD := ImmutableRootMetadata{
+		ReadOnlyRootMetadata:   md.ReadOnly(),
+		lastWriterVerifyingKey: session.VerifyingKey,
+	}
+
+	fbo.log.LazyTrace(ctx, "Prepping update")
+
+	// Create a set of chains for this batch, a succinct summary of
+	// the file and directory blocks that need to change during this
+	// sync.
+	syncChains, err := newCRChains(
+		ctx, fbo.config.Codec(), []chainMetadata{tempIRMD}, &fbo.blocks, false)
+	if err != nil {
+		return err
+	}
+	for ptr := range parentsToAddChainsFor {
+		syncChains.addNoopChain(ptr)
+	}
+
+	// All originals never made it to the server, so don't unmerged
+	// them.
+	syncChains.doNotUnrefPointers = syncChains.createdOriginals
+	head, _ := fbo.getHead(lState)
+	dummyHeadChains := newCRChainsEmpty()
+	dummyHeadChains.mostRecentChainMDInfo = head
+
+	// Squash the batch of updates together into a set of blocks and
+	// ready `md` for putting to the server.
+	md.AddOp(newResolutionOp())
+	_, newBps, blocksToDelete, err := fbo.prepper.prepUpdateForPaths(
+		ctx, lState, md, syncChains, dummyHeadChains, tempIRMD, head,
+		resolvedPaths, lbc, fileBlocks, fbo.config.DirtyBlockCache(),
+		prepFolderDontCopyIndirectFileBlocks)
+	if err != nil {
+		return err
+	}
+	if len(blocksToDelete) > 0 {
+		return errors.Errorf("Unexpectedly found unflushed blocks to delete "+
+			"during syncAllLocked: %v", blocksToDelete)
+	}
+	bps.mergeOtherBps(newBps)
+
+	defer func() {
+		if err != nil {
+			// Remove any blocks that are covered by file syncs --
+			// those might get reused upon sync retry.  All other
+			// blocks are fair game for cleanup though.
+			bps.removeOtherBps(fileSyncBlocks)
+			fbo.fbm.cleanUpBlockState(md.ReadOnly(), bps, blockDeleteOnMDFail)
+		}
+	}()
+
+	// Remember which of the file blocks make it to the server.  If
+	// the sync then fails unrecoverably, the files keep those blocks
+	// for the retry, which can then skip uploading them again.
+	var filePutsLock sync.Mutex
+	filePuts := make(map[BlockPointer]bool)
+	fileBlockPtrs := make(map[BlockPointer]bool)
+	for _, bs := range fileSyncBlocks.blockStates {
+		fileBlockPtrs[bs.blockPtr] = true
+	}
+	for i, bs := range bps.blockStates {
+		if !fileBlockPtrs[bs.blockPtr] {
+			continue
+		}
+		ptr, syncedCb := bs.blockPtr, bs.syncedCb
+		bps.blockStates[i].syncedCb = func() error {
+			filePutsLock.Lock()
+			filePuts[ptr] = true
+			filePutsLock.Unlock()
+			if syncedCb != nil {
+				return syncedCb()
+			}
+			return nil
+		}
 	}
 	defer func() {
-		// If the sync is successful, we can clear out all buffered
-		// directory operations.
-		if err == nil {
-			fbo.dirOps = nil
+		if err == nil || isRecoverableBlockError(err) {
+			return
 		}
+		filePutsLock.Lock()
+		defer filePutsLock.Unlock()
+		fbo.blocks.MarkBlocksPutForRetry(ctx, lState, syncedFiles, filePuts)
 	}()
 
-	fbo.log.LazyTrace(ctx, "Processing %d op(s)", len(fbo.dirOps))
+	// Put all the blocks.
+	blocksToRemove, err = doBlockPuts(putCtx, fbo.config.BlockServer(),
+		fbo.config.BlockCache(), fbo.config.Reporter(), fbo.log, fbo.deferLog, md.TlfID(),
+		md.GetTlfHandle().GetCanonicalName(), *bps)
+	fbo.blocks.SyncPutsDone(lState, sc)
+	if err != nil {
+		return err
+	}
+
+	// Call this under the same blockLock as when the pointers are
+	// updated, so there's never any point in time where a read or
+	// write might slip in after the pointers are updated, but before
+	// the deferred writes are re-applied.
+	afterUpdateFn := func() error {
+		// Clear the dirty directories before the afterUpdateFns start
+		// replaying deferred writes, so we don't lose the deferred
+		// write state when we clear.
+		fbo.blocks.clearAllDirtyDirsLocked(ctx, lState, md)
+		var errs []error
+		for _, auf := range afterUpdateFns {
+			err := auf()
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if len(errs) == 1 {
+			return errs[0]
+		} else if len(errs) > 1 {
+			return errors.Errorf("Got errors %+v", errs)
+		}
+		return nil
+	}
+
+	// Set the root directory entry times to their updated values,
+	// since the prepper doesn't do it for blocks that aren't in the
+	// `lbc`.
+	md.data.Dir.Mtime = rootDe.Mtime
+	md.data.Dir.Ctime = rootDe.Ctime
+
+	return fbo.finalizeMDWriteLocked(ctx, lState, md, bps, excl,
+		func(md ImmutableRootMetadata) error {
+			// Just update the pointers using the resolutionOp, all
+			// the ops have already been notified.
+			affectedNodeIDs, err := fbo.blocks.UpdatePointers(
+				md, lState, md.data.Changes.Ops[0], false, afterUpdateFn)
+			if err != nil {
+				return err
+			}
+
+			fbo.observers.batchChanges(ctx, nil, affectedNodeIDs)
+			return nil
+		})
+}
+
+func (fbo *folderBranchOps) syncAllUnlocked(
+	ctx context.Context, lState *lockState) error {
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
+
+	select {
+	case <-ctx.Done():
+		// We've already been canceled, possibly because we're a CR
+		// and a write just called cr.ForceCancel.  Don't allow the
+		// SyncAll to complete, because if no other writes happen
+		// we'll get stuck forever (see KBFS-2505).  Instead, wait for
+		// the next `SyncAll` to trigger.
+		return ctx.Err()
+	default:
+	}
+
+	return fbo.syncAllLocked(ctx, lState, NoExcl)
+}
+
+// SyncAll implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) SyncAll(
+	ctx context.Context, folderBranch FolderBranch) (err error) {
+	fbo.log.CDebugf(ctx, "SyncAll")
+	defer func() { fbo.deferLog.CDebugf(ctx, "SyncAll done: %+v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	fbo.applyReadRepairs(ctx)
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			return fbo.syncAllLocked(ctx, lState, NoExcl)
+		})
+}
+
+// applyReadRepairs replaces the file leaf pointers that could only be
+// read through an alternate reference with new references to the
+// same blocks, so that the upcoming sync records them.  Reads alone
+// never cause a sync, so the repairs wait until there's something
+// else to sync.  Failures are only logged, and the repair is retried
+// on a later sync, since the data is still readable either way.
+func (fbo *folderBranchOps) applyReadRepairs(ctx context.Context) {
+	lState := makeFBOLockState()
+	if len(fbo.blocks.GetDirtyFileBlockRefs(lState)) == 0 &&
+		len(fbo.blocks.GetDirtyDirBlockRefs(lState)) == 0 {
+		return
+	}
+	repairs := fbo.blocks.TakeReadRepairs()
+	if len(repairs) == 0 {
+		return
+	}
+
+	md, err := fbo.getMDForRead(ctx, lState, mdReadNoIdentify)
+	if err != nil {
+		fbo.log.CDebugf(ctx, "Couldn't get MD for read repairs: %+v", err)
+		for _, r := range repairs {
+			fbo.blocks.RequeueReadRepair(r)
+		}
+		return
+	}
+	tlfName := md.GetTlfHandle().GetCanonicalName()
+
+	for _, r := range repairs {
+		file := fbo.nodeCache.Get(r.file.tailRef())
+		if file == nil {
+			fbo.log.CDebugf(ctx, "Skipping read repair of %v; file %s "+
+				"is no longer cached", r.ptr, r.file)
+			continue
+		}
+		if err := fbo.checkNodeForWrite(ctx, file); err != nil {
+			fbo.log.CDebugf(ctx, "Skipping read repair of %v: %+v",
+				r.ptr, err)
+			continue
+		}
+
+		newPtr, err := fbo.blocks.NewRefForReadRepair(
+			ctx, lState, md.ReadOnly(), r.ptr)
+		if err != nil {
+			fbo.log.CDebugf(ctx, "Couldn't repair %v: %+v", r.ptr, err)
+			fbo.blocks.RequeueReadRepair(r)
+			continue
+		}
+		err = PutBlockCheckLimitErrs(ctx, fbo.config.BlockServer(),
+			fbo.config.Reporter(), fbo.id(), newPtr, ReadyBlockData{},
+			tlfName)
+		if isRecoverableBlockError(err) {
+			// The block can't take any more references, so trying
+			// again later won't help.
+			fbo.log.CDebugf(ctx, "Giving up on read repair of %v: %+v",
+				r.ptr, err)
+			continue
+		} else if err != nil {
+			fbo.log.CDebugf(ctx, "Couldn't reference %v for read repair: "+
+				"%+v", r.ptr, err)
+			fbo.blocks.RequeueReadRepair(r)
+			continue
+		}
+
+		repaired, err := fbo.blocks.RereferenceForReadRepair(
+			ctx, lState, md.ReadOnly(), file, r.ptr, newPtr)
+		if err != nil {
+			// The file may already point to `newPtr`, so the new
+			// reference can't be deleted.
+			fbo.log.CDebugf(ctx, "Couldn't repair %v: %+v", r.ptr, err)
+			fbo.blocks.RequeueReadRepair(r)
+			continue
+		} else if !repaired {
+			_, err := fbo.config.BlockOps().Delete(
+				ctx, fbo.id(), []BlockPointer{newPtr})
+			if err != nil {
+				fbo.log.CDebugf(ctx, "Couldn't delete unused reference "+
+					"%v: %+v", newPtr, err)
+			}
+			continue
+		}
+		fbo.status.addDirtyNode(file)
+	}
+}
+
+// SyncAllAsync implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) SyncAllAsync(
+	ctx context.Context, folderBranch FolderBranch) (
+	ticket SyncTicket, err error) {
+	fbo.log.CDebugf(ctx, "SyncAllAsync")
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "SyncAllAsync done: %d %+v", ticket, err)
+	}()
+
+	if folderBranch != fbo.folderBranch {
+		return 0, WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	fbo.syncTicketLock.Lock()
+	fbo.lastSyncTicket++
+	ticket = fbo.lastSyncTicket
+	fbo.syncTicketLock.Unlock()
+	fbo.asyncSyncs.Add(1)
+	go func() {
+		defer fbo.asyncSyncs.Done()
+		err := fbo.runUnlessShutdown(func(ctx context.Context) error {
+			fbo.log.CDebugf(ctx, "Starting async sync %d", ticket)
+			return fbo.SyncAll(ctx, folderBranch)
+		})
+
+		ctx, cancelFunc := fbo.newCtxWithFBOID()
+		defer cancelFunc()
+		fbo.log.CDebugf(ctx, "Async sync %d done: %+v", ticket, err)
+		fbo.observers.syncAllDone(ctx, ticket, err)
+	}()
+	return ticket, nil
+}
+
+// isFileDirtyLocked returns whether the given file has any unsynced
+// writes, or any unsynced directory ops involving it.
+func (fbo *folderBranchOps) isFileDirtyLocked(
+	lState *lockState, file Node) bool {
+	fbo.mdWriterLock.AssertLocked(lState)
 
-	newBlocks := make(map[BlockPointer]bool)
-	fileBlocks := make(fileBlockMap)
-	parentsToAddChainsFor := make(map[BlockPointer]bool)
+	if fbo.blocks.IsDirty(lState, fbo.nodeCache.PathFromNode(file)) {
+		return true
+	}
 	for _, dop := range fbo.dirOps {
-		// Copy the op before modifying it, in case there's an error
-		// and we have to retry with the original ops.
-		newOp := dop.dirOp.deepCopy()
-		md.AddOp(newOp)
-
-		// Add "updates" for all the op updates, and make chains for
-		// the rest of the parent directories, so they're treated like
-		// updates during the prepping.
 		for _, n := range dop.nodes {
-			p := fbo.nodeCache.PathFromNode(n)
-			if _, ok := newOp.(*setAttrOp); ok {
-				// For a setattr, the node is the file, but that
-				// doesn't get updated, so use the current parent
-				// node.
-				p = *p.parentPath()
+			if n.GetID() == file.GetID() {
+				return true
 			}
-
-			addSelfUpdatesAndParent(p, newOp, parentsToAddChainsFor)
 		}
+	}
+	return false
+}
 
-		var ref BlockRef
-		switch realOp := newOp.(type) {
-		case *createOp:
-			if realOp.Type == Sym {
-				continue
-			}
+// Barrier implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) Barrier(ctx context.Context, file Node) (
+	err error) {
+	fbo.log.CDebugf(ctx, "Barrier %s", getNodeIDStr(file))
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "Barrier %s done: %+v",
+			getNodeIDStr(file), err)
+	}()
 
-			// New files and directories explicitly need
-			// pointer-updating, because the sync process will turn
-			// them into simple refs and will forget about the local,
-			// temporary ID.
-			newNode := dop.nodes[1]
-			newPath := fbo.nodeCache.PathFromNode(newNode)
-			newPointer := newPath.tailPointer()
-			newBlocks[newPointer] = true
+	err = fbo.checkNode(file)
+	if err != nil {
+		return err
+	}
 
-			if realOp.Type != Dir {
-				continue
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			// Any earlier sync of this file has already finished,
+			// since we hold the writer lock, so there's nothing to
+			// do unless the file has been changed since.
+			if !fbo.isFileDirtyLocked(lState, file) {
+				fbo.log.CDebugf(ctx, "File is already synced")
+				return nil
 			}
+			// Syncing a single file isn't possible while other
+			// dirty files may depend on the same directory ops, so
+			// sync everything.  With the journal enabled, this only
+			// waits for the new revision to be written to the
+			// journal.
+			return fbo.syncAllLocked(ctx, lState, NoExcl)
+		})
+}
 
-			dblock, ok := lbc[newPointer]
-			if !ok {
-				// New directories that aren't otherwise dirty need to
-				// be added to both the `lbc` and `resolvedPaths` so
-				// they are properly synced, and removed from the
-				// dirty block list.
-				dblock, err = fbo.blocks.GetDirtyDir(
-					ctx, lState, md, newPath, blockWrite)
-				if err != nil {
-					return err
-				}
-				lbc[newPointer] = dblock.DeepCopy()
-				if !fbo.nodeCache.IsUnlinked(newNode) {
-					resolvedPaths[newPointer] = newPath
-				}
-				// TODO: avoid closures by saving `newPath` and
-				// `newNode` in a list for deferred processing.
-				cleanups = append(cleanups,
-					func(ctx context.Context, lState *lockState, err error) {
-						if err != nil {
-							return
-						}
-						fbo.status.rmDirtyNode(newNode)
-						fbo.config.DirtyBlockCache().Delete(
-							fbo.id(), newPointer, fbo.branch())
-					})
-			}
+// SetWriteThrough implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) SetWriteThrough(
+	ctx context.Context, file Node, writeThrough bool) (err error) {
+	fbo.log.CDebugf(ctx, "SetWriteThrough %s %t",
+		getNodeIDStr(file), writeThrough)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "SetWriteThrough %s %t done: %+v",
+			getNodeIDStr(file), writeThrough, err)
+	}()
 
-			if len(dblock.Children) > 0 || len(dblock.IPtrs) > 0 {
-				continue
-			}
+	err = fbo.checkNode(file)
+	if err != nil {
+		return err
+	}
 
-			// If the directory is empty, we need to explicitly clean
-			// up its entry after syncing.
-			ref = newPath.tailRef()
-		case *renameOp:
-			ref = realOp.Renamed.Ref()
-		case *setAttrOp:
-			ref = realOp.File.Ref()
-		default:
-			continue
+	fbo.writeThroughLock.Lock()
+	defer fbo.writeThroughLock.Unlock()
+	if writeThrough {
+		if fbo.writeThroughNodes == nil {
+			fbo.writeThroughNodes = make(map[NodeID]bool)
 		}
+		fbo.writeThroughNodes[file.GetID()] = true
+	} else {
+		delete(fbo.writeThroughNodes, file.GetID())
+	}
+	return nil
+}
 
-		// For create, rename and setattr ops, the target will have a
-		// dirty entry, but may not have any outstanding operations on
-		// it, so it needs to be cleaned up manually.
-		defer func() {
-			if err != nil {
-				return
-			}
-			node := fbo.nodeCache.Get(ref)
-			if node != nil {
-				fbo.status.rmDirtyNode(node)
-			}
-		}()
+// maybeWriteThrough writes the changes to `file` to the journal (or
+// the servers) right away, if it is a write-through file.
+func (fbo *folderBranchOps) maybeWriteThrough(
+	ctx context.Context, file Node) error {
+	fbo.writeThroughLock.RLock()
+	writeThrough := fbo.writeThroughNodes[file.GetID()]
+	fbo.writeThroughLock.RUnlock()
+	if !writeThrough {
+		return nil
 	}
+	return fbo.Barrier(ctx, file)
+}
 
-	var blocksToRemove []BlockPointer
-	// TODO: find a way to avoid so many dynamic closure dispatches.
-	var afterUpdateFns []func() error
+func (fbo *folderBranchOps) FolderStatus(
+	ctx context.Context, folderBranch FolderBranch) (
+	fbs FolderBranchStatus, updateChan <-chan StatusUpdate, err error) {
+	fbo.log.CDebugf(ctx, "Status")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Status done: %+v", err) }()
 
-	afterUpdateFns = append(afterUpdateFns, func() error {
-		// Any new files or directories need their pointers explicitly
-		// updated, because the sync will be treating them as a new
-		// ref, and not an update.
-		for _, bs := range bps.blockStates {
-			if newBlocks[bs.oldPtr] {
-				fbo.blocks.updatePointer(
-					md.ReadOnly(), bs.oldPtr, bs.blockPtr, false)
-			}
+	if folderBranch != fbo.folderBranch {
+		return FolderBranchStatus{}, nil,
+			WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	fbs, updateChan, err = fbo.status.getStatus(ctx, &fbo.blocks)
+	if err != nil {
+		return FolderBranchStatus{}, nil, err
+	}
+
+	lState := makeFBOLockState()
+	if md, _ := fbo.getHead(lState); md != (ImmutableRootMetadata{}) {
+		fbs.UnlinkedNodes, err = fbo.blocks.GetUnlinkedNodeStats(
+			ctx, lState, md)
+		if err != nil {
+			// The error is ignored here so that the other fields can
+			// still be returned.
+			fbo.log.CDebugf(ctx, "Couldn't get unlinked node stats: %+v",
+				err)
 		}
+	}
+	return fbs, updateChan, nil
+}
+
+// GetUnlinkedNodeStats implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) GetUnlinkedNodeStats(
+	ctx context.Context, folderBranch FolderBranch) (
+	stats UnlinkedNodeStats, err error) {
+	if folderBranch != fbo.folderBranch {
+		return UnlinkedNodeStats{}, WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	lState := makeFBOLockState()
+	md, _ := fbo.getHead(lState)
+	if md == (ImmutableRootMetadata{}) {
+		// No nodes can exist without a head.
+		return UnlinkedNodeStats{}, nil
+	}
+	return fbo.blocks.GetUnlinkedNodeStats(ctx, lState, md)
+}
+
+// applyBlockSizeLocked makes the block size recorded in `md` the
+// one used for new file blocks in this TLF, so that a size set by
+// another device or writer takes effect as soon as its MD arrives.
+func (fbo *folderBranchOps) applyBlockSizeLocked(
+	ctx context.Context, lState *lockState, md ImmutableRootMetadata) {
+	fbo.headLock.AssertLocked(lState)
+	// Archived views of older revisions share the TLF ID, and must
+	// not override the current size.
+	if fbo.bType != standard || !md.IsReadable() ||
+		md.data.BlockSize == fbo.blockSize {
+		return
+	}
+	err := setTlfMaxBlockSize(fbo.config, fbo.id(), md.data.BlockSize)
+	if err != nil {
+		fbo.log.CDebugf(ctx, "Ignoring TLF block size %d: %+v",
+			md.data.BlockSize, err)
+		return
+	}
+	fbo.log.CDebugf(ctx, "Using a TLF block size of %d", md.data.BlockSize)
+	fbo.blockSize = md.data.BlockSize
+}
+
+func (fbo *folderBranchOps) setTlfBlockSizeLocked(
+	ctx context.Context, lState *lockState, size int64) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	md, err := fbo.getSuccessorMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+	if md.data.BlockSize == size {
 		return nil
-	})
+	}
+	md.data.BlockSize = size
+	md.AddOp(newResolutionOp())
 
-	fbo.log.LazyTrace(ctx, "Syncing %d file(s)", len(dirtyFiles))
+	bps, err := fbo.maybeUnembedAndPutBlocks(ctx, md)
+	if err != nil {
+		return err
+	}
 
-	fbo.log.CDebugf(ctx, "Syncing %d file(s)", len(dirtyFiles))
-	fileSyncBlocks := newBlockPutState(1)
-	for _, ref := range dirtyFiles {
-		node := fbo.nodeCache.Get(ref)
-		if node == nil {
-			continue
-		}
-		file := fbo.nodeCache.PathFromNode(node)
-		fbo.log.CDebugf(ctx, "Syncing file %v (%s)", ref, file)
+	return fbo.finalizeMDWriteLocked(ctx, lState, md, bps, NoExcl,
+		func(md ImmutableRootMetadata) error {
+			return fbo.notifyBatchLocked(ctx, lState, md)
+		})
+}
 
-		// Start the sync for this dirty file.
-		doSync, stillDirty, fblock, dirtyDe, newBps, syncState, cleanup, err :=
-			fbo.startSyncLocked(ctx, lState, md, node, file)
-		if cleanup != nil {
-			// Note: This passes the same `blocksToRemove` into each
-			// cleanup function.  That's ok, as only the ones
-			// pertaining to a particular syncing file will be acted
-			// on.
-			cleanups = append(cleanups,
-				func(ctx context.Context, lState *lockState, err error) {
-					cleanup(ctx, lState, blocksToRemove, err)
-				})
-		}
+// SetTlfBlockSize implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) SetTlfBlockSize(
+	ctx context.Context, folderBranch FolderBranch, size int64) (err error) {
+	fbo.log.CDebugf(ctx, "SetTlfBlockSize %d", size)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "SetTlfBlockSize %d done: %+v", size, err)
+	}()
+
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+	if size != 0 {
+		// Check the size before writing it anywhere.
+		_, err = newSizedBlockSplitter(fbo.config, size)
 		if err != nil {
 			return err
 		}
-		if !doSync {
-			if !stillDirty {
-				fbo.status.rmDirtyNode(node)
-			}
-			continue
-		}
+	}
 
-		// Merge the per-file sync info into the batch sync info.
-		bps.mergeOtherBps(newBps)
-		fileSyncBlocks.mergeOtherBps(newBps)
-		resolvedPaths[file.tailPointer()] = file
-		parent := file.parentPath().tailPointer()
-		if _, ok := fileBlocks[parent]; !ok {
-			fileBlocks[parent] = make(map[string]*FileBlock)
-		}
-		fileBlocks[parent][file.tailName()] = fblock
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			return fbo.setTlfBlockSizeLocked(ctx, lState, size)
+		})
+}
 
-		// Collect its `afterUpdateFn` along with all the others, so
-		// they all get invoked under the same lock, to avoid any
-		// weird races.
-		afterUpdateFns = append(afterUpdateFns, func() error {
-			// This will be called after the node cache is updated, so
-			// this newPath will be correct.
-			newPath := fbo.nodeCache.PathFromNode(node)
-			stillDirty, err := fbo.blocks.FinishSyncLocked(
-				ctx, lState, file, newPath, md.ReadOnly(), syncState, fbo.fbm)
-			if !stillDirty {
-				fbo.status.rmDirtyNode(node)
+func (fbo *folderBranchOps) revertToRevisionLocked(
+	ctx context.Context, lState *lockState,
+	rev, expectedHead kbfsmd.Revision, dryRun bool) (
+	revert TLFRevert, err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	head, err := fbo.getMDForWriteLockedForFilename(ctx, lState, "")
+	if err != nil {
+		return TLFRevert{}, err
+	}
+	tlfPath := head.GetTlfHandle().GetCanonicalPath()
+	switch {
+	case fbo.isUnmergedLocked(lState):
+		return TLFRevert{}, errors.Errorf(
+			"Can't revert %s while it has unmerged changes", tlfPath)
+	case fbo.blocks.GetState(lState) != cleanState || len(fbo.dirOps) > 0:
+		return TLFRevert{}, errors.Errorf(
+			"Can't revert %s while it has unsynced changes", tlfPath)
+	case expectedHead != kbfsmd.RevisionUninitialized &&
+		head.Revision() != expectedHead:
+		return TLFRevert{}, errors.Errorf(
+			"The head of %s is revision %d, not %d",
+			tlfPath, head.Revision(), expectedHead)
+	case rev < kbfsmd.RevisionInitial || rev >= head.Revision():
+		return TLFRevert{}, errors.Errorf(
+			"Revision %d is not earlier than the head (%d) of %s",
+			rev, head.Revision(), tlfPath)
+	case rev <= head.data.LastGCRevision:
+		return TLFRevert{}, errors.Errorf(
+			"Revision %d of %s has been garbage-collected (up to %d)",
+			rev, tlfPath, head.data.LastGCRevision)
+	}
+
+	oldMD, err := getSingleMD(ctx, fbo.config, fbo.id(), kbfsmd.NullBranchID,
+		rev, kbfsmd.Merged, nil)
+	if err != nil {
+		return TLFRevert{}, err
+	}
+
+	tr := &tlfReverter{
+		fbo:    fbo,
+		lState: lState,
+		head:   head,
+		oldMD:  oldMD,
+	}
+	if !dryRun {
+		tr.md, err = fbo.getSuccessorMDForWriteLocked(ctx, lState)
+		if err != nil {
+			return TLFRevert{}, err
+		}
+		tr.md.AddOp(newResolutionOp())
+		tr.chargedTo, err = chargedToForTLF(ctx, fbo.config.KBPKI(),
+			fbo.config.KBPKI(), tr.md.GetTlfHandle())
+		if err != nil {
+			return TLFRevert{}, err
+		}
+		tr.bps = newBlockPutState(1)
+		defer func() {
+			if err != nil {
+				fbo.fbm.cleanUpBlockState(
+					tr.md.ReadOnly(), tr.bps, blockDeleteOnMDFail)
+				tr.deleteRefs(ctx)
 			}
-			return err
-		})
+		}()
+	}
 
-		// Add an "update" for all the parent directory updates, and
-		// make a chain for the file itself, so they're treated like
-		// updates during the prepping.
-		lastOp := md.Data().Changes.Ops[len(md.Data().Changes.Ops)-1]
-		addSelfUpdatesAndParent(file, lastOp, parentsToAddChainsFor)
+	changed, err := tr.revertRoot(ctx)
+	if err != nil {
+		return TLFRevert{}, err
+	}
+	revert = TLFRevert{
+		FromRevision: head.Revision(),
+		ToRevision:   rev,
+		Changes:      tr.changes,
+	}
+	if dryRun || !changed {
+		return revert, nil
+	}
 
-		// Update the combined local block cache with this file's
-		// dirty entry.
-		if dirtyDe != nil {
-			fbo.blocks.mergeDirtyEntryWithLBC(
-				ctx, lState, file, md, lbc, *dirtyDe)
+	if !fbo.config.BlockSplitter().ShouldEmbedBlockChanges(
+		&tr.md.data.Changes) {
+		err = fbo.prepper.unembedBlockChanges(
+			ctx, tr.bps, tr.md, &tr.md.data.Changes, tr.chargedTo)
+		if err != nil {
+			return TLFRevert{}, err
 		}
 	}
 
-	session, err := fbo.config.KBPKI().GetCurrentSession(ctx)
+	ptrsToDelete, err := doBlockPuts(ctx, fbo.config.BlockServer(),
+		fbo.config.BlockCache(), fbo.config.Reporter(), fbo.log,
+		fbo.deferLog, tr.md.TlfID(), tr.md.GetTlfHandle().GetCanonicalName(),
+		*tr.bps)
 	if err != nil {
-		return err
+		return TLFRevert{}, err
+	}
+	if len(ptrsToDelete) > 0 {
+		return TLFRevert{}, errors.Errorf("Unexpected pointers to delete "+
+			"after putting the blocks of a revert: %v", ptrsToDelete)
 	}
 
-	tempIRMD := ImmutableRootMetadata{
-		ReadOnlyRootMetadata:   md.ReadOnly(),
-		lastWriterVerifyingKey: session.VerifyingKey,
+	err = fbo.finalizeMDWriteLocked(ctx, lState, tr.md, tr.bps, NoExcl,
+		func(md ImmutableRootMetadata) error {
+			return fbo.notifyBatchLocked(ctx, lState, md)
+		})
+	if err != nil {
+		return TLFRevert{}, err
 	}
+	return revert, nil
+}
 
-	fbo.log.LazyTrace(ctx, "Prepping update")
+// RevertToRevision implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) RevertToRevision(
+	ctx context.Context, folderBranch FolderBranch,
+	rev, expectedHead kbfsmd.Revision, dryRun bool) (
+	revert TLFRevert, err error) {
+	fbo.log.CDebugf(ctx, "RevertToRevision %d (expected head %d, "+
+		"dry run %t)", rev, expectedHead, dryRun)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "RevertToRevision %d done: %+v", rev, err)
+	}()
 
-	// Create a set of chains for this batch, a succinct summary of
-	// the file and directory blocks that need to change during this
-	// sync.
-	syncChains, err := newCRChains(
-		ctx, fbo.config.Codec(), []chainMetadata{tempIRMD}, &fbo.blocks, false)
+	if folderBranch != fbo.folderBranch {
+		return TLFRevert{}, WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) (err error) {
+			revert, err = fbo.revertToRevisionLocked(
+				ctx, lState, rev, expectedHead, dryRun)
+			return err
+		})
 	if err != nil {
-		return err
+		return TLFRevert{}, err
 	}
-	for ptr := range parentsToAddChainsFor {
-		syncChains.addNoopChain(ptr)
+	return revert, nil
+}
+
+// ReclaimUnlinkedNodes implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) ReclaimUnlinkedNodes(
+	ctx context.Context, folderBranch FolderBranch) (
+	stats UnlinkedNodeStats, err error) {
+	fbo.log.CDebugf(ctx, "ReclaimUnlinkedNodes")
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "ReclaimUnlinkedNodes done: %+v (%+v)",
+			stats, err)
+	}()
+
+	if folderBranch != fbo.folderBranch {
+		return UnlinkedNodeStats{}, WrongOpsError{fbo.folderBranch, folderBranch}
 	}
 
-	// All originals never made it to the server, so don't unmerged
-	// them.
-	syncChains.doNotUnrefPointers = syncChains.createdOriginals
-	head, _ := fbo.getHead(lState)
-	dummyHeadChains := newCRChainsEmpty()
-	dummyHeadChains.mostRecentChainMDInfo = head
+	lState := makeFBOLockState()
+	// Keep syncs from racing with the dirty state being dropped.
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
 
-	// Squash the batch of updates together into a set of blocks and
-	// ready `md` for putting to the server.
-	md.AddOp(newResolutionOp())
-	_, newBps, blocksToDelete, err := fbo.prepper.prepUpdateForPaths(
-		ctx, lState, md, syncChains, dummyHeadChains, tempIRMD, head,
-		resolvedPaths, lbc, fileBlocks, fbo.config.DirtyBlockCache(),
-		prepFolderDontCopyIndirectFileBlocks)
+	md, _ := fbo.getHead(lState)
+	if md == (ImmutableRootMetadata{}) {
+		return UnlinkedNodeStats{}, nil
+	}
+	nodes, stats, err := fbo.blocks.ReclaimUnlinkedNodes(ctx, lState, md)
 	if err != nil {
-		return err
+		return UnlinkedNodeStats{}, err
 	}
-	if len(blocksToDelete) > 0 {
-		return errors.Errorf("Unexpectedly found unflushed blocks to delete "+
-			"during syncAllLocked: %v", blocksToDelete)
+	for _, n := range nodes {
+		fbo.status.rmDirtyNode(n)
 	}
-	bps.mergeOtherBps(newBps)
+	return stats, nil
+}
 
-	defer func() {
+// forgetUnlinkedNode drops, in the background, the dirty state of an
+// unlinked file once the node cache has forgotten it, since there
+// are no handles left that could read or sync it.
+func (fbo *folderBranchOps) forgetUnlinkedNode(file path) {
+	select {
+	case <-fbo.shutdownChan:
+		return
+	default:
+	}
+
+	fbo.forgottenNodes.Add(1)
+	go func() {
+		defer fbo.forgottenNodes.Done()
+		ctx := fbo.ctxWithFBOID(context.Background())
+		lState := makeFBOLockState()
+		// Keep syncs from racing with the dirty state being dropped.
+		fbo.mdWriterLock.Lock(lState)
+		defer fbo.mdWriterLock.Unlock(lState)
+
+		md, _ := fbo.getHead(lState)
+		if md == (ImmutableRootMetadata{}) {
+			return
+		}
+		dirtyBytes, err := fbo.blocks.ForgetUnlinkedFile(
+			ctx, lState, md, file)
 		if err != nil {
-			// Remove any blocks that are covered by file syncs --
-			// those might get reused upon sync retry.  All other
-			// blocks are fair game for cleanup though.
-			bps.removeOtherBps(fileSyncBlocks)
-			fbo.fbm.cleanUpBlockState(md.ReadOnly(), bps, blockDeleteOnMDFail)
+			fbo.log.CWarningf(ctx, "Couldn't drop the dirty state of "+
+				"forgotten file %v: %+v", file.tailPointer(), err)
+			return
+		}
+		if dirtyBytes > 0 {
+			fbo.log.CDebugf(ctx, "Dropped %d dirty bytes of forgotten "+
+				"file %v", dirtyBytes, file.tailPointer())
 		}
 	}()
+}
 
-	// Put all the blocks.
-	blocksToRemove, err = doBlockPuts(ctx, fbo.config.BlockServer(),
-		fbo.config.BlockCache(), fbo.config.Reporter(), fbo.log, fbo.deferLog, md.TlfID(),
-		md.GetTlfHandle().GetCanonicalName(), *bps)
-	if err != nil {
-		return err
+// SubscribeSubtrees implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) SubscribeSubtrees(
+	ctx context.Context, folderBranch FolderBranch, subtrees []string) (
+	err error) {
+	fbo.log.CDebugf(ctx, "SubscribeSubtrees %v", subtrees)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "SubscribeSubtrees done: %+v", err)
+	}()
+
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
 	}
 
-	// Call this under the same blockLock as when the pointers are
-	// updated, so there's never any point in time where a read or
-	// write might slip in after the pointers are updated, but before
-	// the deferred writes are re-applied.
-	afterUpdateFn := func() error {
-		// Clear the dirty directories before the afterUpdateFns start
-		// replaying deferred writes, so we don't lose the deferred
-		// write state when we clear.
-		fbo.blocks.clearAllDirtyDirsLocked(ctx, lState, md)
-		var errs []error
-		for _, auf := range afterUpdateFns {
-			err := auf()
-			if err != nil {
-				errs = append(errs, err)
-			}
-		}
-		if len(errs) == 1 {
-			return errs[0]
-		} else if len(errs) > 1 {
-			return errors.Errorf("Got errors %+v", errs)
-		}
-		return nil
+	si, err := newSubtreeInterest(subtrees)
+	if err != nil {
+		return err
 	}
+	fbo.blocks.SetSubtreeInterest(makeFBOLockState(), si)
+	return nil
+}
 
-	// Set the root directory entry times to their updated values,
-	// since the prepper doesn't do it for blocks that aren't in the
-	// `lbc`.
-	md.data.Dir.Mtime = rootDe.Mtime
-	md.data.Dir.Ctime = rootDe.Ctime
+// CancelSync implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) CancelSync(ctx context.Context, file Node) (
+	err error) {
+	fbo.log.CDebugf(ctx, "CancelSync %s", getNodeIDStr(file))
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "CancelSync %s done: %+v",
+			getNodeIDStr(file), err)
+	}()
 
-	return fbo.finalizeMDWriteLocked(ctx, lState, md, bps, excl,
-		func(md ImmutableRootMetadata) error {
-			// Just update the pointers using the resolutionOp, all
-			// the ops have already been notified.
-			affectedNodeIDs, err := fbo.blocks.UpdatePointers(
-				md, lState, md.data.Changes.Ops[0], false, afterUpdateFn)
-			if err != nil {
-				return err
-			}
+	err = fbo.checkNode(file)
+	if err != nil {
+		return err
+	}
 
-			fbo.observers.batchChanges(ctx, nil, affectedNodeIDs)
-			return nil
-		})
+	// Don't take mdWriterLock, since it's held for the whole sync.
+	if !fbo.blocks.CancelSync(makeFBOLockState(), file) {
+		fbo.log.CDebugf(ctx, "No sync in flight for %s",
+			getNodeIDStr(file))
+	}
+	return nil
 }
 
-func (fbo *folderBranchOps) syncAllUnlocked(
-	ctx context.Context, lState *lockState) error {
-	fbo.mdWriterLock.Lock(lState)
-	defer fbo.mdWriterLock.Unlock(lState)
+// readyFileForOutbox reads the full (possibly dirty) contents of
+// the given file one block's worth at a time, and saves each block,
+// readied with the TLF's current key, under the outbox entry `id`.
+// It returns the size of the file and the number of blocks saved.
+func (fbo *folderBranchOps) readyFileForOutbox(
+	ctx context.Context, lState *lockState, md ReadOnlyRootMetadata,
+	file Node, outbox *SyncOutbox, id string) (
+	size int64, numBlocks int, err error) {
+	buf := make([]byte, syncOutboxBlockSize)
+	for {
+		n, err := fbo.blocks.Read(ctx, lState, md, file, buf, size)
+		if err != nil {
+			return 0, 0, err
+		}
+		if n == 0 {
+			return size, numBlocks, nil
+		}
+		err = fbo.putSyncOutboxBlock(
+			ctx, md, outbox, id, numBlocks, size, buf[:n])
+		if err != nil {
+			return 0, 0, err
+		}
+		size += n
+		numBlocks++
+	}
+}
 
-	select {
-	case <-ctx.Done():
-		// We've already been canceled, possibly because we're a CR
-		// and a write just called cr.ForceCancel.  Don't allow the
-		// SyncAll to complete, because if no other writes happen
-		// we'll get stuck forever (see KBFS-2505).  Instead, wait for
-		// the next `SyncAll` to trigger.
-		return ctx.Err()
-	default:
+// putSyncOutboxBlock readies `data`, which starts at `off` in its
+// file, and stores it as block `i` of outbox entry `id`.
+func (fbo *folderBranchOps) putSyncOutboxBlock(
+	ctx context.Context, md ReadOnlyRootMetadata, outbox *SyncOutbox,
+	id string, i int, off int64, data []byte) error {
+	fblock := NewFileBlock().(*FileBlock)
+	fblock.Contents = data
+	blockID, _, readyBlockData, err :=
+		fbo.config.BlockOps().Ready(ctx, md, fblock)
+	if err != nil {
+		return err
 	}
+	return outbox.putBlock(id, i, syncOutboxBlock{
+		Off:        off,
+		ID:         blockID,
+		KeyGen:     md.LatestKeyGeneration(),
+		DataVer:    fblock.DataVersion(),
+		Buf:        readyBlockData.buf,
+		ServerHalf: readyBlockData.serverHalf,
+	})
+}
 
-	return fbo.syncAllLocked(ctx, lState, NoExcl)
+// isSyncOutboxErrorLocked returns true if the dirty state should be
+// moved into the sync outbox after a sync failed with `err`.  On top
+// of the errors that retrying can't fix, that includes being over
+// quota, once every sync has failed that way for
+// `syncOutboxOverQuotaThreshold`.
+func (fbo *folderBranchOps) isSyncOutboxErrorLocked(
+	lState *lockState, err error) bool {
+	fbo.mdWriterLock.AssertLocked(lState)
+	if err == nil {
+		fbo.overQuotaSince = time.Time{}
+		return false
+	}
+	if !isOverQuotaSyncError(err) {
+		return isSyncOutboxError(err)
+	}
+	now := fbo.config.Clock().Now()
+	if fbo.overQuotaSince.IsZero() {
+		fbo.overQuotaSince = now
+	}
+	return now.Sub(fbo.overQuotaSince) >= syncOutboxOverQuotaThreshold
 }
 
-// SyncAll implements the KBFSOps interface for folderBranchOps.
-func (fbo *folderBranchOps) SyncAll(
-	ctx context.Context, folderBranch FolderBranch) (err error) {
-	fbo.log.CDebugf(ctx, "SyncAll")
-	defer func() { fbo.deferLog.CDebugf(ctx, "SyncAll done: %+v", err) }()
+// moveDirtyStateToOutboxLocked saves the contents of every dirty
+// file, readied with the TLF's key, in the sync outbox along with
+// the file's dirty op, and then drops all the dirty state of the
+// TLF.  It's called when a sync fails with an error that retrying
+// won't fix, so that the data doesn't stay dirty (and keep failing
+// to sync) until the process exits.  Nothing is dropped unless
+// everything was saved first.
+func (fbo *folderBranchOps) moveDirtyStateToOutboxLocked(
+	ctx context.Context, lState *lockState, syncErr error) (err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
 
-	if folderBranch != fbo.folderBranch {
-		return WrongOpsError{fbo.folderBranch, folderBranch}
+	outbox := fbo.config.SyncOutbox()
+	if outbox == nil {
+		return nil
+	}
+	md, _ := fbo.getHead(lState)
+	if md == (ImmutableRootMetadata{}) {
+		return nil
 	}
+	h := md.GetTlfHandle()
 
-	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
-		func(lState *lockState) error {
-			return fbo.syncAllLocked(ctx, lState, NoExcl)
+	var added []string
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, id := range added {
+			if abandonErr := outbox.abandon(id); abandonErr != nil {
+				fbo.log.CDebugf(ctx, "Couldn't abandon outbox entry %s: %+v",
+					id, abandonErr)
+			}
+		}
+	}()
+	for _, ref := range fbo.blocks.GetDirtyFileBlockRefs(lState) {
+		file := fbo.nodeCache.Get(ref)
+		if file == nil || fbo.nodeCache.IsUnlinked(file) {
+			continue
+		}
+		op, err := fbo.blocks.GetDirtySyncOp(lState, ref)
+		if err != nil {
+			return err
+		}
+		id, err := outbox.newEntryID()
+		if err != nil {
+			return err
+		}
+		added = append(added, id)
+		size, numBlocks, err := fbo.readyFileForOutbox(
+			ctx, lState, md.ReadOnly(), file, outbox, id)
+		if err != nil {
+			return err
+		}
+		_, err = outbox.add(SyncOutboxEntry{
+			ID:        id,
+			TlfID:     fbo.id(),
+			TlfName:   h.GetCanonicalName(),
+			TlfType:   h.Type(),
+			Path:      fbo.nodeCache.PathFromNode(file).tlfRelativeString(),
+			Size:      size,
+			Err:       syncErr.Error(),
+			NumBlocks: numBlocks,
+			Op:        op,
 		})
-}
+		if err != nil {
+			return err
+		}
+	}
 
-func (fbo *folderBranchOps) FolderStatus(
-	ctx context.Context, folderBranch FolderBranch) (
-	fbs FolderBranchStatus, updateChan <-chan StatusUpdate, err error) {
-	fbo.log.CDebugf(ctx, "Status")
-	defer func() { fbo.deferLog.CDebugf(ctx, "Status done: %+v", err) }()
+	changes, affectedNodeIDs, err := fbo.blocks.DiscardDirtyState(
+		ctx, lState, md.ReadOnly())
+	if err != nil {
+		return err
+	}
+	fbo.dirOps = nil
+	fbo.shareLinkRevocations = nil
+	for _, change := range changes {
+		fbo.status.rmDirtyNode(change.Node)
+	}
+	fbo.log.CWarningf(ctx, "Moved %d dirty file(s) to the sync outbox "+
+		"after sync error: %+v", len(added), syncErr)
 
-	if folderBranch != fbo.folderBranch {
-		return FolderBranchStatus{}, nil,
-			WrongOpsError{fbo.folderBranch, folderBranch}
+	ffChanges, ffNodeIDs, err := fbo.blocks.FastForwardAllNodes(
+		ctx, lState, md.ReadOnly())
+	if err != nil {
+		// The outbox has the data now, so don't undo the move.
+		fbo.log.CDebugf(ctx, "Couldn't fast-forward after dropping "+
+			"dirty state: %+v", err)
 	}
 
-	return fbo.status.getStatus(ctx, &fbo.blocks)
+	// Entries removed since the last sync are back now.
+	for i, change := range changes {
+		if change.FileUpdated != nil ||
+			fbo.nodeCache.IsUnlinked(change.Node) {
+			continue
+		}
+		entries, err := fbo.blocks.GetEntries(ctx, lState, md.ReadOnly(),
+			fbo.nodeCache.PathFromNode(change.Node))
+		if err != nil {
+			fbo.log.CDebugf(ctx, "Couldn't get entries of %v: %+v",
+				change.Node.GetID(), err)
+			continue
+		}
+		dirty := make(map[string]bool, len(change.DirUpdated))
+		for _, name := range change.DirUpdated {
+			dirty[name] = true
+		}
+		for name := range entries {
+			if !dirty[name] {
+				changes[i].DirUpdated = append(changes[i].DirUpdated, name)
+			}
+		}
+	}
+	changes = append(changes, ffChanges...)
+	affectedNodeIDs = append(affectedNodeIDs, ffNodeIDs...)
+	if len(changes) > 0 {
+		fbo.observers.batchChanges(ctx, changes, affectedNodeIDs)
+	}
+	return nil
 }
 
 func (fbo *folderBranchOps) Status(
@@ -4737,6 +7832,109 @@ func (fbo *folderBranchOps) UnregisterFromChanges(obs Observer) error {
 	return nil
 }
 
+func (fbo *folderBranchOps) Watch(
+	ctx context.Context, p string, recursive bool, filter WatchEventType,
+	fn WatchFunc) (unwatch func(), err error) {
+	return nil, errors.New("Watch is not supported by folderBranchOps")
+}
+
+// watchNode registers `fn` to be called for changes to the entries
+// in the directory `dir` (or anywhere under it, if `recursive` is
+// true) whose types are in `filter`.  The watch is on the path of
+// `dir` at the time of the call, and is not moved if `dir` is later
+// renamed.  It returns a function that removes the watch.
+func (fbo *folderBranchOps) watchNode(
+	ctx context.Context, dir Node, recursive bool, filter WatchEventType,
+	fn WatchFunc) (unwatch func(), err error) {
+	fbo.log.CDebugf(ctx, "Watch %s (recursive=%t, filter=%d)",
+		getNodeIDStr(dir), recursive, filter)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "Watch %s done: %+v",
+			getNodeIDStr(dir), err)
+	}()
+
+	err = fbo.checkNode(dir)
+	if err != nil {
+		return nil, err
+	}
+	dirPath, err := fbo.pathFromNodeForRead(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	id := fbo.watches.add(folderWatch{
+		dirPath:   dirPath.CanonicalPathString(),
+		recursive: recursive,
+		filter:    filter,
+		fn:        fn,
+	})
+	return func() { fbo.watches.remove(id) }, nil
+}
+
+// reportWatchEvents reports the changes in each queued merged
+// revision to the matching watches, in order, until there are no
+// more queued revisions.
+func (fbo *folderBranchOps) reportWatchEvents() {
+	defer fbo.watchReporters.Done()
+	ctx, cancelFunc := fbo.newCtxWithFBOID()
+	defer cancelFunc()
+	go func() {
+		select {
+		case <-fbo.shutdownChan:
+			cancelFunc()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		md, lastDropped, ok := fbo.watches.next()
+		if !ok {
+			return
+		}
+		if lastDropped != kbfsmd.RevisionUninitialized {
+			fbo.log.CDebugf(ctx, "Dropped watch events up to revision %d",
+				lastDropped)
+			event := WatchEvent{Type: WatchOverflow, Revision: lastDropped}
+			for _, fn := range fbo.watches.all() {
+				fn(event)
+			}
+		}
+		edits, err := fbo.makeEditNotifications(ctx, md, true)
+		if err != nil {
+			fbo.log.CWarningf(ctx, "Couldn't make watch events for "+
+				"revision %d: %+v", md.Revision(), err)
+			continue
+		}
+		// A file created in this revision also gets a modify
+		// notification for its initial contents, which the create
+		// already covers.
+		created := make(map[string]bool)
+		for _, edit := range edits {
+			event, ok := makeWatchEvent(edit)
+			if !ok {
+				continue
+			}
+			switch event.Type {
+			case WatchCreate:
+				created[event.Path] = true
+			case WatchModify:
+				if created[event.Path] {
+					continue
+				}
+			}
+			for _, fn := range fbo.watches.matching(event) {
+				fn(event)
+			}
+		}
+	}
+}
+
 // notifyBatchLocked sends out a notification for all the ops in md.
 func (fbo *folderBranchOps) notifyBatchLocked(
 	ctx context.Context, lState *lockState, md ImmutableRootMetadata) error {
@@ -5096,6 +8294,7 @@ func (fbo *folderBranchOps) notifyOneOpLocked(ctx context.Context,
 		}
 	}
 
+	changes = fbo.blocks.FilterUninterestingChanges(lState, changes)
 	if len(changes) > 0 || len(affectedNodeIDs) > 0 {
 		fbo.observers.batchChanges(ctx, changes, affectedNodeIDs)
 	}
@@ -5197,6 +8396,18 @@ func (fbo *folderBranchOps) applyMDUpdatesLocked(ctx context.Context,
 		return errors.WithStack(NoUpdatesWhileDirtyError{})
 	}
 
+	return fbo.applyMergedMDUpdatesLocked(ctx, lState, rmds)
+}
+
+// applyMergedMDUpdatesLocked sets each of the given merged MDs as the
+// new head in turn, notifying observers of their operations.  The
+// caller must hold both mdWriterLock and headLock, and must have
+// already checked that the TLF is merged and clean.
+func (fbo *folderBranchOps) applyMergedMDUpdatesLocked(ctx context.Context,
+	lState *lockState, rmds []ImmutableRootMetadata) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+	fbo.headLock.AssertLocked(lState)
+
 	appliedRevs := make([]ImmutableRootMetadata, 0, len(rmds))
 	for _, rmd := range rmds {
 		// check that we're applying the expected MD revision
@@ -5236,6 +8447,11 @@ func (fbo *folderBranchOps) applyMDUpdatesLocked(ctx context.Context,
 		}
 		appliedRevs = append(appliedRevs, rmd)
 	}
+	if len(appliedRevs) > 0 {
+		// Other devices may have removed or replaced the damaged
+		// directories.
+		fbo.blocks.ForgetDamagedSubtrees()
+	}
 	return nil
 }
 
@@ -5344,11 +8560,13 @@ func (fbo *folderBranchOps) getAndApplyMDUpdates(ctx context.Context,
 		return err
 	}
 
+	// Validate the updates before taking any locks to apply them.
+	rmds, checkErr := fbo.checkMergedMDUpdates(ctx, lState, rmds)
 	err = applyFunc(ctx, lState, rmds)
 	if err != nil {
 		return err
 	}
-	return nil
+	return checkErr
 }
 
 func (fbo *folderBranchOps) getAndApplyNewestUnmergedHead(ctx context.Context,
@@ -5544,7 +8762,7 @@ func (fbo *folderBranchOps) UnstageForTesting(
 		return WrongOpsError{fbo.folderBranch, folderBranch}
 	}
 
-	return runUnlessCanceled(ctx, func() error {
+	return fbo.runUnlessCanceled(ctx, func() error {
 		lState := makeFBOLockState()
 
 		if !fbo.isUnmerged(lState) {
@@ -5915,6 +9133,7 @@ func (fbo *folderBranchOps) doFastForwardLocked(ctx context.Context,
 	if err != nil {
 		return err
 	}
+	changes = fbo.blocks.FilterUninterestingChanges(lState, changes)
 
 	err = fbo.setHeadSuccessorLocked(ctx, lState, currHead, true /*rebase*/)
 	if err != nil {
@@ -5929,6 +9148,33 @@ func (fbo *folderBranchOps) doFastForwardLocked(ctx context.Context,
 	return nil
 }
 
+// getCachedMergedMDsLocked returns all the merged MDs between the
+// current head and `currHead` (inclusive), if every intermediate
+// revision is available in the MD cache.  Otherwise it returns nil.
+func (fbo *folderBranchOps) getCachedMergedMDsLocked(ctx context.Context,
+	lState *lockState, currHead ImmutableRootMetadata) []ImmutableRootMetadata {
+	fbo.headLock.AssertAnyLocked(lState)
+
+	if fbo.head == (ImmutableRootMetadata{}) {
+		return nil
+	}
+	start := fbo.getCurrMDRevisionLocked(lState) + 1
+	if currHead.Revision() < start {
+		return nil
+	}
+	rmds := make([]ImmutableRootMetadata, 0, currHead.Revision()-start+1)
+	for rev := start; rev < currHead.Revision(); rev++ {
+		rmd, err := fbo.config.MDCache().Get(
+			fbo.id(), rev, kbfsmd.NullBranchID)
+		if err != nil {
+			fbo.log.CDebugf(ctx, "Revision %d isn't cached: %+v", rev, err)
+			return nil
+		}
+		rmds = append(rmds, rmd)
+	}
+	return append(rmds, currHead)
+}
+
 func (fbo *folderBranchOps) maybeFastForward(ctx context.Context,
 	lState *lockState, lastUpdate time.Time, currUpdate time.Time) (
 	fastForwardDone bool, err error) {
@@ -5969,12 +9215,58 @@ func (fbo *folderBranchOps) maybeFastForward(ctx context.Context,
 		return false, nil
 	}
 
+	if currHead.Revision() <
+		fbo.getLatestMergedRevision(lState)+fastForwardRevThresh {
+		// Might as well fetch all the revisions.
+		return false, nil
+	}
+
+	// If all the intermediate revisions are still cached, apply them
+	// one by one instead, so that only the nodes that actually
+	// changed get invalidated.  Check them before taking headLock;
+	// the head can't change while we hold mdWriterLock.
+	rmds := func() []ImmutableRootMetadata {
+		fbo.headLock.RLock(lState)
+		defer fbo.headLock.RUnlock(lState)
+		return fbo.getCachedMergedMDsLocked(ctx, lState, currHead)
+	}()
+	if rmds != nil {
+		rmds, err = fbo.checkMergedMDUpdates(ctx, lState, rmds)
+		if err != nil {
+			return false, err
+		}
+	} else if currHead.GetTlfHandle().Type() == tlf.SingleTeam {
+		// Jumping straight to the new head would skip checking the
+		// intermediate revisions against the team's subtree write
+		// rules, so if there are any rules, fetch all the revisions
+		// instead.
+		head := func() ImmutableRootMetadata {
+			fbo.headLock.RLock(lState)
+			defer fbo.headLock.RUnlock(lState)
+			return fbo.head
+		}()
+		if head != (ImmutableRootMetadata{}) {
+			policy, err := fbo.getTeamContentPolicy(ctx, lState, head)
+			if err != nil {
+				return false, err
+			}
+			if !policy.isEmpty() {
+				return false, nil
+			}
+		}
+	}
+
 	fbo.headLock.Lock(lState)
 	defer fbo.headLock.Unlock(lState)
 
-	if currHead.Revision() < fbo.latestMergedRevision+fastForwardRevThresh {
-		// Might as well fetch all the revisions.
-		return false, nil
+	if rmds != nil {
+		fbo.log.CDebugf(ctx, "Applying %d cached revisions instead of "+
+			"fast-forwarding", len(rmds))
+		err = fbo.applyMergedMDUpdatesLocked(ctx, lState, rmds)
+		if err != nil {
+			return false, err
+		}
+		return true, nil
 	}
 
 	err = fbo.doFastForwardLocked(ctx, lState, currHead)
@@ -6218,7 +9510,11 @@ func (fbo *folderBranchOps) waitForAndProcessUpdates(
 				return currUpdate, nil
 			}
 
-			err = fbo.getAndApplyMDUpdates(ctx, lState, nil, fbo.applyMDUpdates)
+			err = func() (err error) {
+				defer fbo.recoverCorruption(ctx, &err)
+				return fbo.getAndApplyMDUpdates(
+					ctx, lState, nil, fbo.applyMDUpdates)
+			}()
 			if err != nil {
 				fbo.log.CDebugf(ctx, "Got an error while applying "+
 					"updates: %v", err)
@@ -6246,13 +9542,52 @@ func (fbo *folderBranchOps) getCachedDirOpsCount(lState *lockState) int {
 	return len(fbo.dirOps)
 }
 
+// dirtyFileAgeTimer returns a channel that fires when the oldest
+// dirty file exceeds the configured maximum dirty age, along with a
+// function to stop the timer.  If there is no age limit or no dirty
+// file, the returned channel is nil.  If the limit has already been
+// exceeded, `expired` is true.  To avoid retrying a failing sync in a
+// tight loop, the timer never fires sooner than one max age after
+// `lastForced`, the time of the last sync forced by this limit.
+func (fbo *folderBranchOps) dirtyFileAgeTimer(
+	lState *lockState, lastForced time.Time) (
+	c <-chan time.Time, stop func(), expired bool) {
+	stop = func() {}
+	maxAge := fbo.config.DirtyFileMaxAge()
+	if maxAge <= 0 {
+		return nil, stop, false
+	}
+	oldest := fbo.blocks.GetOldestDirtyFileTime(lState)
+	if oldest.IsZero() {
+		return nil, stop, false
+	}
+	deadline := oldest.Add(maxAge)
+	if retry := lastForced.Add(maxAge); retry.After(deadline) {
+		deadline = retry
+	}
+	wait := deadline.Sub(fbo.config.Clock().Now())
+	if wait <= 0 {
+		return nil, stop, true
+	}
+	timer := time.NewTimer(wait)
+	return timer.C, func() { timer.Stop() }, false
+}
+
 func (fbo *folderBranchOps) backgroundFlusher() {
 	lState := makeFBOLockState()
 	var prevDirtyFileMap map[BlockRef]bool
 	sameDirtyFileCount := 0
+	var lastAgeForcedSync time.Time
 	for {
+		ageC, stopAgeTimer, ageExpired :=
+			fbo.dirtyFileAgeTimer(lState, lastAgeForcedSync)
+		ageForced := ageExpired
 		doSelect := true
-		if fbo.blocks.GetState(lState) == dirtyState &&
+		if ageExpired {
+			// A file has been dirty for too long, so sync it now
+			// regardless of how much is batched up.
+			doSelect = false
+		} else if fbo.blocks.GetState(lState) == dirtyState &&
 			fbo.config.DirtyBlockCache().ShouldForceSync(fbo.id()) &&
 			sameDirtyFileCount < 10 {
 			// We have dirty files, and the system has a full buffer,
@@ -6275,10 +9610,26 @@ func (fbo *folderBranchOps) backgroundFlusher() {
 				}
 			case <-fbo.forceSyncChan:
 				doWait = false
+			case <-ageC:
+				ageForced = true
+				doWait = false
 			case <-fbo.shutdownChan:
+				stopAgeTimer()
 				return
 			}
 
+			if doWait {
+				// The write that woke us up may have dirtied a new
+				// file, so reset the age timer.
+				stopAgeTimer()
+				ageC, stopAgeTimer, ageExpired =
+					fbo.dirtyFileAgeTimer(lState, lastAgeForcedSync)
+				if ageExpired {
+					ageForced = true
+					doWait = false
+				}
+			}
+
 			if doWait {
 				timer := time.NewTimer(fbo.config.BGFlushPeriod())
 				// Loop until either a tick's worth of time passes,
@@ -6296,12 +9647,20 @@ func (fbo *folderBranchOps) backgroundFlusher() {
 						}
 					case <-fbo.forceSyncChan:
 						break loop
+					case <-ageC:
+						ageForced = true
+						break loop
 					case <-fbo.shutdownChan:
+						stopAgeTimer()
 						return
 					}
 				}
 			}
 		}
+		stopAgeTimer()
+		if ageForced {
+			lastAgeForcedSync = fbo.config.Clock().Now()
+		}
 
 		dirtyFiles := fbo.blocks.GetDirtyFileBlockRefs(lState)
 		dirOpsCount := fbo.getCachedDirOpsCount(lState)
@@ -6359,6 +9718,159 @@ func (fbo *folderBranchOps) backgroundFlusher() {
 	}
 }
 
+// backgroundRevalidator periodically checks a sample of the cached
+// nodes against the current head, to heal any divergence between the
+// node cache and the real directory tree (e.g., after a missed
+// invalidation).
+func (fbo *folderBranchOps) backgroundRevalidator() {
+	ticker := time.NewTicker(revalidatePeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-fbo.shutdownChan:
+			return
+		}
+
+		// Scrubbing the node cache can wait until the user is idle,
+		// and the device isn't on battery or a metered network.
+		if !fbo.config.IdleTracker().IsIdle() ||
+			fbo.config.PowerMonitor().shouldPauseMaintenance() {
+			continue
+		}
+
+		err := fbo.runUnlessShutdown(func(ctx context.Context) error {
+			return fbo.revalidateNodeSample(ctx, makeFBOLockState())
+		})
+		if _, ok := err.(ShutdownHappenedError); ok {
+			return
+		} else if err != nil {
+			fbo.log.CDebugf(nil, "Couldn't revalidate nodes: %+v", err)
+		}
+	}
+}
+
+// revalidateNodeSample checks up to `revalidateSampleSize` random
+// cached nodes against the current head, and fixes up any of them
+// that have diverged from it.
+func (fbo *folderBranchOps) revalidateNodeSample(
+	ctx context.Context, lState *lockState) error {
+	if fbo.isUnmerged(lState) ||
+		fbo.blocks.GetState(lState) != cleanState {
+		return nil
+	}
+	md, _ := fbo.getHead(lState)
+	if md == (ImmutableRootMetadata{}) {
+		return nil
+	}
+
+	nodes := fbo.nodeCache.AllNodes()
+	if len(nodes) > revalidateSampleSize {
+		sample := make([]Node, 0, revalidateSampleSize)
+		for _, i := range rand.Perm(len(nodes))[:revalidateSampleSize] {
+			sample = append(sample, nodes[i])
+		}
+		nodes = sample
+	}
+	updates, err := fbo.blocks.RevalidateNodes(ctx, lState, md, nodes)
+	if err != nil {
+		return err
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
+	fbo.headLock.Lock(lState)
+	defer fbo.headLock.Unlock(lState)
+	// Only apply the fixes if nothing has changed since they were
+	// computed.
+	if fbo.head.mdID != md.mdID || fbo.isUnmergedLocked(lState) ||
+		fbo.blocks.GetState(lState) != cleanState {
+		fbo.log.CDebugf(ctx, "Head changed during revalidation; "+
+			"ignoring %d corrections", len(updates))
+		return nil
+	}
+
+	fbo.log.CDebugf(ctx, "Revalidation found %d diverged nodes",
+		len(updates))
+	changes, affectedNodeIDs := fbo.blocks.ApplyRevalidationUpdates(
+		ctx, lState, md.ReadOnly(), updates)
+	if len(changes) > 0 {
+		fbo.observers.batchChanges(ctx, changes, affectedNodeIDs)
+	}
+	return nil
+}
+
+func (fbo *folderBranchOps) backgroundFreshnessChecker() {
+	ticker := time.NewTicker(freshnessCheckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-fbo.shutdownChan:
+			return
+		}
+
+		// Only synced TLFs are expected to be fully cached, and
+		// refreshing them can wait until the device isn't on
+		// battery or a metered network.
+		if !fbo.config.IsSyncedTlf(fbo.id()) ||
+			fbo.config.PowerMonitor().shouldPauseMaintenance() {
+			continue
+		}
+
+		err := fbo.runUnlessShutdown(func(ctx context.Context) error {
+			return fbo.checkFreshness(ctx, makeFBOLockState())
+		})
+		if _, ok := err.(ShutdownHappenedError); ok {
+			return
+		} else if err != nil {
+			fbo.log.CDebugf(nil, "Couldn't check freshness: %+v", err)
+		}
+	}
+}
+
+// checkFreshness compares the locally-cached blocks against the
+// latest known revision of the TLF.  If the whole tree under the
+// current root has been synced, and there's no newer revision on the
+// server, it records the current time as the last time the folder
+// was fully fresh.  Otherwise it kicks off a new deep prefetch of the
+// current root, to pull in whatever is missing or stale.
+func (fbo *folderBranchOps) checkFreshness(
+	ctx context.Context, lState *lockState) error {
+	md, _ := fbo.getHead(lState)
+	if md == (ImmutableRootMetadata{}) || !md.IsReadable() {
+		return nil
+	}
+
+	if latest := fbo.getLatestMergedRevision(lState); md.Revision() < latest {
+		// The update loop is already fetching the newer
+		// revisions, and the prefetch will follow the new head.
+		fbo.log.CDebugf(ctx, "Head revision %d is behind the latest "+
+			"revision %d; not fresh", md.Revision(), latest)
+		return nil
+	}
+
+	rootPtr := md.data.Dir.BlockPointer
+	status := fbo.config.PrefetchStatus(ctx, fbo.id(), rootPtr)
+	if status == FinishedPrefetch {
+		fbo.status.setLastFullyFresh(fbo.config.Clock().Now())
+		return nil
+	}
+
+	// Use a fresh context so the prefetch outlives this check.
+	prefetchCtx := fbo.ctxWithFBOID(context.Background())
+	fbo.log.CDebugf(ctx, "Root block %v of revision %d isn't fully "+
+		"synced (%s); refreshing it with FBOID=%s", rootPtr,
+		md.Revision(), status, prefetchCtx.Value(CtxFBOIDKey))
+	_ = fbo.config.BlockOps().BlockRetriever().Request(prefetchCtx,
+		defaultOnDemandRequestPriority, md, rootPtr, &DirBlock{},
+		TransientEntry)
+	return nil
+}
+
 func (fbo *folderBranchOps) blockUnmergedWrites(lState *lockState) {
 	fbo.mdWriterLock.Lock(lState)
 }
@@ -6369,29 +9881,30 @@ func (fbo *folderBranchOps) unblockUnmergedWrites(lState *lockState) {
 
 func (fbo *folderBranchOps) finalizeResolutionLocked(ctx context.Context,
 	lState *lockState, md *RootMetadata, bps *blockPutState,
-	newOps []op, blocksToDelete []kbfsblock.ID) error {
+	newOps []op, blocksToDelete []kbfsblock.ID) (err error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
 	// Put the blocks into the cache so that, even if we fail below,
 	// future attempts may reuse the blocks.
-	err := fbo.finalizeBlocks(ctx, bps)
+	err = fbo.finalizeBlocks(ctx, bps)
 	if err != nil {
 		return err
 	}
 
-	// Last chance to get pre-empted.
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	default:
+	// Last chance to get pre-empted.  Local writes made after this
+	// are handed off to the resolved branch below.
+	err = fbo.cr.beginCommit(ctx)
+	if err != nil {
+		return err
 	}
-
 	session, err := fbo.config.KBPKI().GetCurrentSession(ctx)
 	if err != nil {
+		fbo.cr.endCommit()
 		return err
 	}
 	irmd, err := fbo.config.MDOps().ResolveBranch(ctx, fbo.id(), fbo.unmergedBID,
 		blocksToDelete, md, session.VerifyingKey)
+	fbo.cr.endCommit()
 	doUnmergedPut := isRevisionConflict(err)
 	if doUnmergedPut {
 		fbo.log.CDebugf(ctx, "Got a conflict after resolution; aborting CR")
@@ -6408,6 +9921,20 @@ func (fbo *folderBranchOps) finalizeResolutionLocked(ctx context.Context,
 
 	md.loadCachedBlockChanges(ctx, bps, fbo.log)
 
+	// Files may have been written since CR synced them, and their
+	// dirty state is keyed by the unmerged pointers that the nodes
+	// are about to leave behind.  Hand those writes off to the
+	// resolved versions of the files, rather than losing them.
+	// The resolution is committed now, so nothing here should fail
+	// it.
+	handoffs, takeErr := fbo.takeDirtyFileHandoffsLocked(ctx, lState)
+	if takeErr != nil {
+		fbo.log.CWarningf(ctx, "Couldn't take the dirty files to hand "+
+			"off after conflict resolution: %+v", takeErr)
+	} else if len(handoffs) > 0 {
+		defer fbo.replayDirtyFileHandoffsLocked(ctx, lState, handoffs)
+	}
+
 	// Set the head to the new MD.
 	fbo.headLock.Lock(lState)
 	defer fbo.headLock.Unlock(lState)
@@ -6460,6 +9987,127 @@ func (fbo *folderBranchOps) finalizeResolutionLocked(ctx context.Context,
 	return nil
 }
 
+// takeDirtyFileHandoffsLocked takes the unsynced changes out of all
+// the dirty files of the current head, so they can be replayed with
+// `replayDirtyFileHandoffsLocked` once the head changes.  If there
+// are unsynced directory ops, whose dirty state can't be handed off,
+// it leaves everything in place and returns no handoffs.
+func (fbo *folderBranchOps) takeDirtyFileHandoffsLocked(
+	ctx context.Context, lState *lockState) ([]dirtyFileHandoff, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+	if len(fbo.blocks.GetDirtyFileBlockRefs(lState)) == 0 {
+		return nil, nil
+	}
+	if len(fbo.dirOps) > 0 {
+		fbo.log.CDebugf(ctx, "Not handing off dirty files with %d "+
+			"unsynced directory ops", len(fbo.dirOps))
+		return nil, nil
+	}
+	md, _ := fbo.getHead(lState)
+	if md == (ImmutableRootMetadata{}) {
+		return nil, nil
+	}
+	handoffs, err := fbo.blocks.TakeDirtyFileHandoffs(
+		ctx, lState, md.ReadOnly())
+	if err != nil {
+		return nil, err
+	}
+	fbo.log.CDebugf(ctx, "Handing off %d dirty file(s)", len(handoffs))
+	return handoffs, nil
+}
+
+// replayDirtyFileHandoffsLocked replays `handoffs` on top of the
+// current head, and marks their files dirty again.  The changes that
+// can't be replayed are moved to the sync outbox instead.
+func (fbo *folderBranchOps) replayDirtyFileHandoffsLocked(
+	ctx context.Context, lState *lockState, handoffs []dirtyFileHandoff) {
+	fbo.mdWriterLock.AssertLocked(lState)
+	md, _ := fbo.getHead(lState)
+	failed, dirtied := fbo.blocks.ReplayDirtyFileHandoffs(
+		ctx, lState, md.ReadOnly(), handoffs)
+	for _, n := range dirtied {
+		fbo.status.addDirtyNode(n)
+	}
+	if len(dirtied) > 0 {
+		fbo.signalWrite()
+	}
+	if len(failed) == 0 {
+		return
+	}
+	for _, h := range failed {
+		fbo.status.rmDirtyNode(h.node)
+	}
+	err := fbo.moveDirtyFileHandoffsToOutboxLocked(ctx, lState, md, failed)
+	if err != nil {
+		fbo.log.CWarningf(ctx, "Couldn't move %d dirty file(s) handed off "+
+			"during conflict resolution to the sync outbox: %+v",
+			len(failed), err)
+	}
+}
+
+// moveDirtyFileHandoffsToOutboxLocked saves the changes in
+// `handoffs` in the sync outbox, one entry per file, holding just
+// the written ranges.
+func (fbo *folderBranchOps) moveDirtyFileHandoffsToOutboxLocked(
+	ctx context.Context, lState *lockState, md ImmutableRootMetadata,
+	handoffs []dirtyFileHandoff) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+	outbox := fbo.config.SyncOutbox()
+	if outbox == nil {
+		return errors.New("No sync outbox")
+	}
+	h := md.GetTlfHandle()
+	for _, handoff := range handoffs {
+		op, err := newSyncOp(handoff.base)
+		if err != nil {
+			return err
+		}
+		if handoff.truncated {
+			op.addTruncate(handoff.truncOff)
+		}
+		id, err := outbox.newEntryID()
+		if err != nil {
+			return err
+		}
+		numBlocks := 0
+		for i, w := range handoff.writes {
+			op.addWrite(w.Off, w.Len)
+			data := handoff.data[i]
+			for off := 0; off < len(data); off += syncOutboxBlockSize {
+				end := off + syncOutboxBlockSize
+				if end > len(data) {
+					end = len(data)
+				}
+				err := fbo.putSyncOutboxBlock(ctx, md.ReadOnly(), outbox, id,
+					numBlocks, int64(w.Off)+int64(off), data[off:end])
+				if err != nil {
+					_ = outbox.abandon(id)
+					return err
+				}
+				numBlocks++
+			}
+		}
+		_, err = outbox.add(SyncOutboxEntry{
+			ID:        id,
+			TlfID:     fbo.id(),
+			TlfName:   h.GetCanonicalName(),
+			TlfType:   h.Type(),
+			Path:      handoff.path,
+			Size:      int64(handoff.size),
+			Err:       "The file changed during conflict resolution",
+			NumBlocks: numBlocks,
+			Op:        op,
+		})
+		if err != nil {
+			_ = outbox.abandon(id)
+			return err
+		}
+		fbo.log.CWarningf(ctx, "Moved the unsynced changes to node %s to "+
+			"sync outbox entry %s", handoff.node.GetID(), id)
+	}
+	return nil
+}
+
 // finalizeResolution caches all the blocks, and writes the new MD to
 // the merged branch, failing if there is a conflict.  It also sends
 // out the given newOps notifications locally.  This is used for
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"reflect"
 	"sync"
+	"time"
 
 	kbname "github.com/keybase/client/go/kbun"
 	"github.com/keybase/kbfs/kbfsmd"
@@ -43,6 +44,23 @@ type FolderBranchStatus struct {
 	// They do not represent unstaged changes in your local instance.
 	DirtyPaths []string
 
+	// DeferredWrites counts the writes and truncates, per file path,
+	// that arrived during a sync and will be replayed once it's done.
+	DeferredWrites map[string]int `json:",omitempty"`
+
+	// QuarantinedBlocks lists the blocks that repeatedly failed
+	// decryption or verification, and are no longer fetched.
+	QuarantinedBlocks []QuarantinedBlock `json:",omitempty"`
+
+	// DamagedSubtrees lists the directories that can't be read
+	// because their blocks can't be fetched or verified.  Everything
+	// outside of them is still available.
+	DamagedSubtrees []DamagedSubtree `json:",omitempty"`
+
+	// UnlinkedNodes describes the nodes that have been removed, but
+	// are still being held open.
+	UnlinkedNodes UnlinkedNodeStats
+
 	// If we're in the staged state, these summaries show the
 	// diverging operations per-file
 	Unmerged []*crChainSummary
@@ -50,7 +68,23 @@ type FolderBranchStatus struct {
 
 	Journal *TLFJournalStatus `json:",omitempty"`
 
+	// FullyVerified is false if verifying any of this folder's MD
+	// relied on something that couldn't be checked, such as writer
+	// keys that were only verified from the local cache while
+	// offline.  VerificationAssumptions lists what was assumed.
+	FullyVerified           bool
+	VerificationAssumptions []string `json:",omitempty"`
+
 	PermanentErr string `json:",omitempty"`
+
+	// Degraded describes the corruption that caused this folder to
+	// stop accepting writes, if any.
+	Degraded string `json:",omitempty"`
+
+	// LastFullyFresh is, for synced folders, the last time every
+	// block of the latest known revision was found in the local
+	// cache.  It's the zero time if that has never been confirmed.
+	LastFullyFresh time.Time
 }
 
 // KBFSStatus represents the content of the top-level status file. It is
@@ -68,6 +102,9 @@ type KBFSStatus struct {
 	FailingServices map[string]error
 	JournalServer   *JournalServerStatus            `json:",omitempty"`
 	DiskCacheStatus map[string]DiskBlockCacheStatus `json:",omitempty"`
+	BlockRetrieval  *BlockRetrievalStatus           `json:",omitempty"`
+	RekeyQueue      *RekeyQueueStatus               `json:",omitempty"`
+	PrefetchBudget  *PrefetchBudgetStatus           `json:",omitempty"`
 }
 
 // StatusUpdate is a dummy type used to indicate status has been updated.
@@ -83,6 +120,8 @@ type folderBranchStatusKeeper struct {
 	dataMutex  sync.Mutex
 	md         ImmutableRootMetadata
 	permErr    error
+	degraded   error
+	lastFresh  time.Time
 	dirtyNodes map[NodeID]Node
 	unmerged   []*crChainSummary
 	merged     []*crChainSummary
@@ -142,6 +181,34 @@ func (fbsk *folderBranchStatusKeeper) setPermErr(err error) {
 	fbsk.signalChangeLocked()
 }
 
+// setDegraded records `err` as the reason the folder-branch is
+// degraded, unless it already is.  It returns the recorded reason.
+func (fbsk *folderBranchStatusKeeper) setDegraded(err error) error {
+	fbsk.dataMutex.Lock()
+	defer fbsk.dataMutex.Unlock()
+	if fbsk.degraded != nil {
+		return fbsk.degraded
+	}
+	fbsk.degraded = err
+	fbsk.signalChangeLocked()
+	return err
+}
+
+func (fbsk *folderBranchStatusKeeper) getDegraded() error {
+	fbsk.dataMutex.Lock()
+	defer fbsk.dataMutex.Unlock()
+	return fbsk.degraded
+}
+
+// setLastFullyFresh records `t` as the last time the folder-branch
+// was confirmed to be fully synced to the local cache.
+func (fbsk *folderBranchStatusKeeper) setLastFullyFresh(t time.Time) {
+	fbsk.dataMutex.Lock()
+	defer fbsk.dataMutex.Unlock()
+	fbsk.lastFresh = t
+	fbsk.signalChangeLocked()
+}
+
 func (fbsk *folderBranchStatusKeeper) addNode(m map[NodeID]Node, n Node) bool {
 	fbsk.dataMutex.Lock()
 	defer fbsk.dataMutex.Unlock()
@@ -219,6 +286,9 @@ func (fbsk *folderBranchStatusKeeper) getStatusWithoutJournaling(
 			fbsk.md.Data().Dir.BlockPointer)
 		fbs.PrefetchStatus = prefetchStatus.String()
 		fbs.RootBlockID = fbsk.md.Data().Dir.BlockPointer.ID.String()
+		fbs.VerificationAssumptions =
+			fbsk.config.mdVerifier().getAssumptions(fbsk.md.TlfID())
+		fbs.FullyVerified = len(fbs.VerificationAssumptions) == 0
 
 		if fbsk.quotaUsage == nil {
 			loggerSuffix := fmt.Sprintf("status-%s", fbsk.md.TlfID())
@@ -263,6 +333,10 @@ func (fbsk *folderBranchStatusKeeper) getStatusWithoutJournaling(
 	if fbsk.permErr != nil {
 		fbs.PermanentErr = fbsk.permErr.Error()
 	}
+	if fbsk.degraded != nil {
+		fbs.Degraded = fbsk.degraded.Error()
+	}
+	fbs.LastFullyFresh = fbsk.lastFresh
 
 	return fbs, fbsk.updateChan, tlfID, nil
 }
@@ -282,6 +356,15 @@ func (fbsk *folderBranchStatusKeeper) getStatus(ctx context.Context,
 		return fbs, ch, nil
 	}
 
+	if blocks != nil {
+		deferred := blocks.getDeferredWriteCounts(makeFBOLockState())
+		if len(deferred) > 0 {
+			fbs.DeferredWrites = deferred
+		}
+		fbs.QuarantinedBlocks = blocks.GetQuarantinedBlocks()
+		fbs.DamagedSubtrees = blocks.GetDamagedSubtrees()
+	}
+
 	// Fetch journal info without holding any locks, to avoid possible
 	// deadlocks with folderBlockOps.
 
@@ -28,6 +28,10 @@ type folderUpdatePrepper struct {
 
 	cacheLock   sync.Mutex
 	cachedInfos map[BlockPointer]BlockInfo
+
+	// budget, if non-nil, limits how much readied block data the
+	// current conflict resolution keeps in memory.
+	budget *crBlockBudget
 }
 
 func (fup *folderUpdatePrepper) id() tlf.ID {
@@ -53,6 +57,20 @@ func (fup *folderUpdatePrepper) readyBlockMultiple(ctx context.Context,
 		return
 	}
 
+	// The plaintext of unembedded block changes is needed again once
+	// the MD is put, so only data blocks count against the budget.
+	if fup.budget != nil && bType != keybase1.BlockType_MD {
+		var drop bool
+		readyBlockData, drop, err = fup.budget.admit(
+			ctx, info.BlockPointer, readyBlockData)
+		if err != nil {
+			return BlockInfo{}, 0, err
+		}
+		if drop {
+			currBlock = nil
+		}
+	}
+
 	bps.addNewBlock(info.BlockPointer, currBlock, readyBlockData, nil)
 	return
 }
@@ -110,7 +128,8 @@ func (fup *folderUpdatePrepper) unembedBlockChanges(
 
 	df := newDirtyFile(file, dirtyBcache)
 	fd := newFileData(file, chargedTo, fup.config.cryptoPure(),
-		fup.config.BlockSplitter(), md.ReadOnly(), getter, cacher, fup.log)
+		fup.config.TlfBlockSplitter(fup.id()), md.ReadOnly(), getter, cacher,
+		fup.log)
 
 	// Write all the data.
 	_, _, _, _, _, err = fd.write(ctx, buf, 0, block, DirEntry{}, df)
@@ -185,14 +204,15 @@ func (idwl isDirtyWithLBC) IsDirty(
 // serialized revision numbers must implement their own locking around
 // their instance.
 //
-// entryType must not be Sym.
+// entryType must not be Sym.  If the entry doesn't exist yet and
+// is a file, it's created with the given size.
 //
 // TODO: deal with multiple nodes for indirect blocks
 func (fup *folderUpdatePrepper) prepUpdateForPath(
 	ctx context.Context, lState *lockState, chargedTo keybase1.UserOrTeamID,
 	md *RootMetadata, newBlock Block, newBlockPtr BlockPointer, dir path,
-	name string, entryType EntryType, mtime bool, ctime bool,
-	stopAt BlockPointer, lbc localBcache) (
+	name string, entryType EntryType, newFileSize uint64, mtime bool,
+	ctime bool, stopAt BlockPointer, lbc localBcache) (
 	path, DirEntry, *blockPutState, error) {
 	// now ready each dblock and write the DirEntry for the next one
 	// in the path
@@ -278,15 +298,15 @@ func (fup *folderUpdatePrepper) prepUpdateForPath(
 					return path{}, DirEntry{}, nil, NoSuchNameError{currName}
 				}
 
-				// If this is a file, the size should be 0. (TODO:
-				// Ensure this.) If this is a directory, the size will
-				// be filled in below.  The times will be filled in
-				// below as well, since we should only be creating a
-				// new directory entry when doSetTime is true.
+				// If this is a file, the caller knows its size.  If
+				// this is a directory, the size will be filled in
+				// below.  The times will be filled in below as well,
+				// since we should only be creating a new directory
+				// entry when doSetTime is true.
 				de = DirEntry{
 					EntryInfo: EntryInfo{
 						Type: entryType,
-						Size: 0,
+						Size: newFileSize,
 					},
 				}
 				// If we're creating a new directory entry, the
@@ -491,7 +511,7 @@ func (fup *folderUpdatePrepper) prepTree(ctx context.Context, lState *lockState,
 		_, _, bps, err := fup.prepUpdateForPath(
 			ctx, lState, chargedTo, newMD, block, node.ptr,
 			*node.mergedPath.parentPath(), node.mergedPath.tailName(),
-			entryType, false, false, stopAt, lbc)
+			entryType, 0, false, false, stopAt, lbc)
 		if err != nil {
 			return nil, err
 		}
@@ -539,10 +559,12 @@ func (fup *folderUpdatePrepper) updateResolutionUsageLockedCache(
 	md.SetDiskUsage(mostRecentMergedMD.DiskUsage())
 	md.SetMDDiskUsage(mostRecentMergedMD.MDDiskUsage())
 
-	localBlocks := make(map[BlockPointer]Block)
+	localSizes := make(map[BlockPointer]uint32)
 	for _, bs := range bps.blockStates {
 		if bs.block != nil {
-			localBlocks[bs.blockPtr] = bs.block
+			localSizes[bs.blockPtr] = bs.block.GetEncodedSize()
+		} else if size, ok := fup.budget.droppedSize(bs.blockPtr); ok {
+			localSizes[bs.blockPtr] = uint32(size)
 		}
 	}
 
@@ -550,8 +572,8 @@ func (fup *folderUpdatePrepper) updateResolutionUsageLockedCache(
 	refPtrsToFetch := make([]BlockPointer, 0, len(refs))
 	var refSum uint64
 	for ptr := range refs {
-		if block, ok := localBlocks[ptr]; ok {
-			refSum += uint64(block.GetEncodedSize())
+		if size, ok := localSizes[ptr]; ok {
+			refSum += uint64(size)
 		} else {
 			refPtrsToFetch = append(refPtrsToFetch, ptr)
 		}
@@ -0,0 +1,174 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	pathpkg "path"
+	"strings"
+	"sync"
+
+	"github.com/keybase/kbfs/kbfsedits"
+	"github.com/keybase/kbfs/kbfsmd"
+)
+
+// folderWatch is a single path watch registered on a TLF.
+type folderWatch struct {
+	dirPath   string
+	recursive bool
+	filter    WatchEventType
+	fn        WatchFunc
+}
+
+func (fw folderWatch) matchesPath(p string) bool {
+	if p == "" {
+		return false
+	}
+	if fw.recursive {
+		return strings.HasPrefix(p, fw.dirPath+"/")
+	}
+	return pathpkg.Dir(p) == fw.dirPath
+}
+
+func (fw folderWatch) matches(event WatchEvent) bool {
+	return fw.filter&event.Type != 0 &&
+		(fw.matchesPath(event.Path) || fw.matchesPath(event.OldPath))
+}
+
+// maxPendingWatchRevisions is the most revisions that can be queued
+// for reporting to the watches of a TLF.  Older ones are dropped
+// beyond that, and a WatchOverflow is reported instead.
+const maxPendingWatchRevisions = 100
+
+// folderWatches holds the path watches registered on a TLF, along
+// with the merged revisions that still need to be reported to them.
+// It is goroutine-safe.
+type folderWatches struct {
+	lock    sync.Mutex
+	lastID  uint64
+	watches map[uint64]folderWatch
+	pending []ImmutableRootMetadata
+	// lastDropped is the last revision dropped from `pending` since
+	// the last overflow was reported, if any.
+	lastDropped kbfsmd.Revision
+	running     bool
+}
+
+func newFolderWatches() *folderWatches {
+	return &folderWatches{watches: make(map[uint64]folderWatch)}
+}
+
+func (fws *folderWatches) add(fw folderWatch) uint64 {
+	fws.lock.Lock()
+	defer fws.lock.Unlock()
+	fws.lastID++
+	fws.watches[fws.lastID] = fw
+	return fws.lastID
+}
+
+func (fws *folderWatches) remove(id uint64) {
+	fws.lock.Lock()
+	defer fws.lock.Unlock()
+	delete(fws.watches, id)
+}
+
+// queue records a new revision to report, if there are any watches.
+// It returns true if the caller needs to start a goroutine to report
+// it, because none is running.
+func (fws *folderWatches) queue(md ImmutableRootMetadata) bool {
+	fws.lock.Lock()
+	defer fws.lock.Unlock()
+	if len(fws.watches) == 0 {
+		return false
+	}
+	fws.pending = append(fws.pending, md)
+	if len(fws.pending) > maxPendingWatchRevisions {
+		fws.lastDropped = fws.pending[0].Revision()
+		fws.pending = fws.pending[1:]
+	}
+	if fws.running {
+		return false
+	}
+	fws.running = true
+	return true
+}
+
+// next returns the oldest revision still to be reported, along with
+// the last revision dropped before it, if any, which must be reported
+// as an overflow first.  If there are none, it returns false, and the
+// reporting goroutine must exit.
+func (fws *folderWatches) next() (
+	md ImmutableRootMetadata, lastDropped kbfsmd.Revision, ok bool) {
+	fws.lock.Lock()
+	defer fws.lock.Unlock()
+	if len(fws.pending) == 0 || len(fws.watches) == 0 {
+		fws.pending = nil
+		fws.lastDropped = kbfsmd.RevisionUninitialized
+		fws.running = false
+		return ImmutableRootMetadata{}, kbfsmd.RevisionUninitialized, false
+	}
+	md = fws.pending[0]
+	fws.pending = fws.pending[1:]
+	lastDropped = fws.lastDropped
+	fws.lastDropped = kbfsmd.RevisionUninitialized
+	return md, lastDropped, true
+}
+
+// all returns the callbacks of all the watches.
+func (fws *folderWatches) all() []WatchFunc {
+	fws.lock.Lock()
+	defer fws.lock.Unlock()
+	fns := make([]WatchFunc, 0, len(fws.watches))
+	for _, fw := range fws.watches {
+		fns = append(fns, fw.fn)
+	}
+	return fns
+}
+
+// matching returns the callbacks of all the watches matching `event`.
+func (fws *folderWatches) matching(event WatchEvent) []WatchFunc {
+	fws.lock.Lock()
+	defer fws.lock.Unlock()
+	var fns []WatchFunc
+	for _, fw := range fws.watches {
+		if fw.matches(event) {
+			fns = append(fns, fw.fn)
+		}
+	}
+	return fns
+}
+
+// makeWatchEvent converts an edit notification into a WatchEvent.
+// It returns false for notifications that can't be watched.
+func makeWatchEvent(edit kbfsedits.NotificationMessage) (WatchEvent, bool) {
+	event := WatchEvent{
+		Path:     edit.Filename,
+		Revision: edit.Revision,
+		Writer:   edit.UID,
+	}
+	switch edit.Type {
+	case kbfsedits.NotificationCreate:
+		event.Type = WatchCreate
+	case kbfsedits.NotificationModify:
+		event.Type = WatchModify
+	case kbfsedits.NotificationRename:
+		event.Type = WatchRename
+		if edit.Params != nil {
+			event.OldPath = edit.Params.OldFilename
+		}
+	case kbfsedits.NotificationDelete:
+		event.Type = WatchDelete
+	default:
+		return WatchEvent{}, false
+	}
+	switch edit.FileType {
+	case kbfsedits.EntryTypeDir:
+		event.EntryType = Dir
+	case kbfsedits.EntryTypeSym:
+		event.EntryType = Sym
+	default:
+		event.EntryType = File
+	}
+	return event, true
+}
@@ -0,0 +1,93 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// defaultIdleThreshold is how long KBFS must go without any
+	// foreground operations before it's considered idle.
+	defaultIdleThreshold = 5 * time.Minute
+)
+
+// IdleTracker keeps track of when the last foreground operation
+// happened, so that heavy background maintenance (quota reclamation,
+// node revalidation, and deep prefetching of synced TLFs) can wait
+// until the user isn't actively using KBFS.  A nil IdleTracker, or
+// one with a zero threshold, always reports that KBFS is idle.
+type IdleTracker struct {
+	clocks clockGetter
+
+	lock         sync.RWMutex
+	threshold    time.Duration
+	lastActivity time.Time
+}
+
+// NewIdleTracker returns a new IdleTracker that uses the clock from
+// `clocks`, and which starts out idle.
+func NewIdleTracker(clocks clockGetter) *IdleTracker {
+	return &IdleTracker{
+		clocks:    clocks,
+		threshold: defaultIdleThreshold,
+	}
+}
+
+// SetThreshold sets how long KBFS must go without foreground
+// operations before it's considered idle.  A zero threshold disables
+// idle detection entirely.
+func (it *IdleTracker) SetThreshold(threshold time.Duration) {
+	it.lock.Lock()
+	defer it.lock.Unlock()
+	it.threshold = threshold
+}
+
+// Threshold returns the current idle threshold.
+func (it *IdleTracker) Threshold() time.Duration {
+	if it == nil {
+		return 0
+	}
+	it.lock.RLock()
+	defer it.lock.RUnlock()
+	return it.threshold
+}
+
+// NoteActivity records that a foreground operation just happened.
+func (it *IdleTracker) NoteActivity() {
+	if it == nil {
+		return
+	}
+	now := it.clocks.Clock().Now()
+	it.lock.Lock()
+	defer it.lock.Unlock()
+	it.lastActivity = now
+}
+
+// untilIdle returns how much longer KBFS needs to go without
+// foreground activity to be considered idle, or 0 if it's idle now.
+func (it *IdleTracker) untilIdle() time.Duration {
+	if it == nil {
+		return 0
+	}
+	now := it.clocks.Clock().Now()
+	it.lock.RLock()
+	defer it.lock.RUnlock()
+	if it.threshold == 0 || it.lastActivity.IsZero() {
+		return 0
+	}
+	remaining := it.threshold - now.Sub(it.lastActivity)
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// IsIdle returns true if there hasn't been any foreground activity
+// within the idle threshold.
+func (it *IdleTracker) IsIdle() bool {
+	return it.untilIdle() == 0
+}
@@ -0,0 +1,64 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdleTracker(t *testing.T) {
+	cg := newTestClockGetter()
+	clock := cg.TestClock()
+	now := clock.Now()
+	it := NewIdleTracker(cg)
+	it.SetThreshold(time.Minute)
+
+	t.Log("A fresh tracker is idle")
+	require.True(t, it.IsIdle())
+
+	t.Log("Foreground activity makes it busy until the threshold passes")
+	it.NoteActivity()
+	require.False(t, it.IsIdle())
+	require.Equal(t, time.Minute, it.untilIdle())
+	clock.Set(now.Add(40 * time.Second))
+	require.False(t, it.IsIdle())
+	require.Equal(t, 20*time.Second, it.untilIdle())
+	clock.Set(now.Add(time.Minute))
+	require.True(t, it.IsIdle())
+
+	t.Log("A zero threshold disables idle detection")
+	it.NoteActivity()
+	require.False(t, it.IsIdle())
+	it.SetThreshold(0)
+	require.True(t, it.IsIdle())
+
+	t.Log("A nil tracker is always idle")
+	var nilTracker *IdleTracker
+	nilTracker.NoteActivity()
+	require.True(t, nilTracker.IsIdle())
+}
+
+func TestKBFSOpsIdleActivity(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "alice")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	config.IdleTracker().SetThreshold(time.Hour)
+
+	t.Log("Getting a root node and background work leave KBFS idle")
+	rootNode := GetRootNodeOrBust(ctx, t, config, "alice", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	kbfsOps.RequestRekey(ctx, rootNode.GetFolderBranch().Tlf)
+	err := kbfsOps.SyncFromServer(ctx, rootNode.GetFolderBranch(), nil)
+	require.NoError(t, err)
+	require.True(t, config.IdleTracker().IsIdle())
+
+	t.Log("An operation on a node is foreground activity")
+	_, err = kbfsOps.GetDirChildren(ctx, rootNode)
+	require.NoError(t, err)
+	require.False(t, config.IdleTracker().IsIdle())
+}
@@ -9,6 +9,7 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -21,6 +22,8 @@ import (
 	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/go-framed-msgpack-rpc/rpc"
 	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"golang.org/x/time/rate"
 )
 
 const (
@@ -36,6 +39,9 @@ const (
 	// InitConstrainedString is for when KBFS will use constrained
 	// resources.
 	InitConstrainedString = "constrained"
+	// InitViewerString is for when KBFS will only be used to read
+	// data (e.g., on a kiosk or gateway).
+	InitViewerString = "viewer"
 )
 
 // AdditionalProtocolCreator creates an additional protocol.
@@ -63,6 +69,69 @@ type InitParams struct {
 	// zero, the capacity is set using getDefaultBlockCacheCapacity().
 	CleanBlockCacheCapacity uint64
 
+	// If non-zero, limits how long directory and file blocks,
+	// respectively, are served from the clean block cache.
+	DirBlockCacheTTL  time.Duration
+	FileBlockCacheTTL time.Duration
+
+	// If non-zero, limits the number of simultaneous network block
+	// fetches for any single TLF.
+	MaxBlockFetchesPerTlf int
+
+	// If non-zero, limits how many folder rekeys can be started per
+	// second.
+	RekeysPerSecond float64
+
+	// A comma-separated list of host:port addresses of the current
+	// user's other devices, which are asked for blocks from their
+	// disk caches before the block server.
+	BlockPeers string
+
+	// If non-empty, the address on which to serve this device's disk
+	// block cache to the current user's other devices.
+	BlockPeerListenAddr string
+
+	// If non-empty, a base URL from which to read the blocks of
+	// public TLFs before trying the block server.
+	PublicBlockURL string
+
+	// If true, complete blocks of large files being written are put
+	// to the server before the file is synced.
+	EarlyBlockUpload bool
+
+	// If non-empty, a spec (see ParseFaultRules) for faults to inject
+	// into block and MD operations, for resilience testing.
+	FaultInjection string
+
+	// If non-empty, the file to which every KBFSOps call is logged
+	// (see OpLogRecorder), so it can be replayed later.
+	OpLogFile string
+
+	// If non-empty, a file holding an encoded DelegationToken, which
+	// restricts this instance to reading the paths it grants.
+	DelegationTokenFile string
+
+	// If non-empty, a comma-separated list of extra sinks (see
+	// ParseNotificationSinks) that notifications and reported
+	// errors are sent to, in addition to the keybase service.
+	NotificationSinks string
+
+	// If non-empty, per-module log levels, like
+	// "blockops=debug,cr=warning" (see LogLevels.Set).
+	LogLevels string
+
+	// If non-empty, the file to which log messages are written as
+	// structured JSON, instead of the usual log output.
+	JSONLogFile string
+
+	// How long to keep log messages of every level in memory, per
+	// TLF, for retrieval over RPC after a bug.  If zero, they aren't
+	// kept.
+	DebugLogBufferDuration time.Duration
+
+	// The maximum number of log messages kept in memory per TLF.
+	DebugLogBufferEntries int
+
 	// Fake local user name.
 	LocalUser string
 
@@ -108,11 +177,79 @@ type InitParams struct {
 	// before syncing a set of changes on a TLF to the servers.
 	BGFlushPeriod time.Duration
 
+	// DirtyFileMaxAge indicates how long a file may stay dirty
+	// before it is synced to the servers, even if its batch hasn't
+	// filled up.  Zero means there is no limit.
+	DirtyFileMaxAge time.Duration
+
+	// MaxFileBytes, if non-zero, limits the size of any file that
+	// can be written, below what the data version supports.
+	MaxFileBytes uint64
+
+	// MaxDirEntries, if non-zero, limits the number of entries in
+	// any single directory.
+	MaxDirEntries int
+
+	// MaxSymlinkDepth is the maximum number of symlinks followed
+	// while resolving a single path.
+	MaxSymlinkDepth int
+
+	// DirHashBuckets is the number of hash buckets the entries of a
+	// large directory are sharded into, or 0 to split directories by
+	// name only.
+	DirHashBuckets int
+
+	// CRBlockBudget is the most bytes of readied blocks conflict
+	// resolution keeps in memory, or 0 for no limit.
+	CRBlockBudget int64
+
+	// IdleThreshold is how long KBFS must go without foreground
+	// operations before heavy background maintenance, like quota
+	// reclamation, is allowed to run.  Zero disables the wait.
+	IdleThreshold time.Duration
+
+	// PowerAware, if true, makes KBFS reduce prefetching, delay
+	// journal flushes, and pause background maintenance while the
+	// device is on battery power or a metered network, according to
+	// the default power policy.
+	PowerAware bool
+
+	// PrefetchBudget caps how many bytes the prefetcher may
+	// download per hour and per day during this session.  Zero
+	// limits mean no cap.
+	PrefetchBudget PrefetchBudgetLimits
+
+	// ReadNotificationInterval is the minimum time between two
+	// read notifications for the same file.  Zero only aggregates
+	// notifications for overlapping reads.
+	ReadNotificationInterval time.Duration
+
 	// BGFlushDirOpBatchSize indicates how many directory operations
 	// in a TLF should be batched together in a single background
 	// flush.
 	BGFlushDirOpBatchSize int
 
+	// NewFileExecMode describes how the exec bit is chosen for newly
+	// created files, unless overridden for a particular TLF.
+	NewFileExecMode NewFileExecMode
+
+	// OrderedWrites, if true, makes every sync commit all of a
+	// TLF's pending changes together in a single revision, unless
+	// overridden for a particular TLF.
+	OrderedWrites bool
+
+	// AdaptiveBlockSizes, if true, chooses the block size of each
+	// new file based on how it's written, unless overridden for a
+	// particular TLF.
+	AdaptiveBlockSizes bool
+
+	// FsyncMode describes when an fsync through a mount returns.
+	FsyncMode FsyncMode
+
+	// TimestampMode describes how strictly file and directory times
+	// follow POSIX.
+	TimestampMode TimestampMode
+
 	// Mode describes how KBFS should initialize itself.
 	Mode string
 }
@@ -189,10 +326,17 @@ func DefaultInitParams(ctx Context) InitParams {
 		TLFJournalBackgroundWorkStatus: TLFJournalBackgroundWorkEnabled,
 		StorageRoot:                    ctx.GetDataDir(),
 		BGFlushPeriod:                  bgFlushPeriodDefault,
+		DirtyFileMaxAge:                dirtyFileMaxAgeDefault,
+		MaxSymlinkDepth:                maxSymlinkDepthDefault,
+		CRBlockBudget:                  crBlockBudgetDefault,
+		IdleThreshold:                  defaultIdleThreshold,
+		PowerAware:                     true,
 		BGFlushDirOpBatchSize:          bgFlushDirOpBatchSizeDefault,
 		EnableJournal:                  BoolForString(journalEnv),
 		DiskCacheMode:                  DiskCacheModeLocal,
 		Mode:                           InitDefaultString,
+		DebugLogBufferDuration:         debugLogBufferDurationDefault,
+		DebugLogBufferEntries:          debugLogBufferEntriesDefault,
 	}
 }
 
@@ -238,6 +382,77 @@ func AddFlagsWithDefaults(
 		defaultParams.CleanBlockCacheCapacity,
 		"If non-zero, specify the capacity of clean block cache. If zero, "+
 			"the capacity is set based on system RAM.")
+	flags.DurationVar(&params.DirBlockCacheTTL, "dir-block-cache-ttl",
+		defaultParams.DirBlockCacheTTL,
+		"If non-zero, how long directory blocks may be served from the "+
+			"clean block cache before being fetched again.")
+	flags.DurationVar(&params.FileBlockCacheTTL, "file-block-cache-ttl",
+		defaultParams.FileBlockCacheTTL,
+		"If non-zero, how long file blocks may be served from the "+
+			"clean block cache before being fetched again.")
+	flags.IntVar(&params.MaxBlockFetchesPerTlf, "block-fetches-per-tlf",
+		defaultParams.MaxBlockFetchesPerTlf,
+		"If non-zero, limits the number of blocks that can be fetched "+
+			"at once for a single folder, so that one folder can't tie "+
+			"up all the block fetch workers.")
+	flags.Float64Var(&params.RekeysPerSecond, "rekey-rate",
+		defaultParams.RekeysPerSecond,
+		"If non-zero, limits how many folders can start being rekeyed "+
+			"each second, e.g. after a device is revoked.")
+	flags.StringVar(&params.BlockPeers, "block-peers",
+		defaultParams.BlockPeers,
+		"Comma-separated host:port addresses of your other devices on "+
+			"the local network, to fetch cached blocks from.")
+	flags.StringVar(&params.BlockPeerListenAddr, "block-peer-listen",
+		defaultParams.BlockPeerListenAddr,
+		"If non-empty, the address on which to serve cached blocks to "+
+			"your other devices on the local network.")
+	flags.StringVar(&params.PublicBlockURL, "public-block-url",
+		defaultParams.PublicBlockURL,
+		"If non-empty, a base URL (such as a CDN) from which to read "+
+			"blocks of public folders before trying the block server.")
+	flags.BoolVar(&params.EarlyBlockUpload, "early-block-upload",
+		defaultParams.EarlyBlockUpload,
+		"Upload complete blocks of large files while they are still "+
+			"being written, rather than waiting for the sync.")
+	flags.StringVar(&params.FaultInjection, "fault-injection",
+		defaultParams.FaultInjection,
+		"If non-empty, inject faults into block and metadata operations "+
+			"according to the given rules, e.g. "+
+			"\"MDOps.Put:kind=partial:calls=2;BlockOps.*:kind=latency:latency=1s:p=0.1\". "+
+			"For testing only.")
+	flags.StringVar(&params.OpLogFile, "op-log-file",
+		defaultParams.OpLogFile,
+		"If non-empty, append a log of all filesystem operations "+
+			"(without file contents) to this file, for later replay.")
+	flags.StringVar(&params.DelegationTokenFile, "delegation-token-file",
+		defaultParams.DelegationTokenFile,
+		"If non-empty, a delegation token (see \"kbfstool "+
+			"mint-delegation\") restricting this instance to reading "+
+			"the paths it grants, until it expires.")
+	flags.StringVar(&params.NotificationSinks, "notification-sinks",
+		defaultParams.NotificationSinks,
+		"Comma-separated extra destinations for KBFS notifications and "+
+			"errors, e.g. \"webhook:https://example.com/kbfs,"+
+			"socket:/run/kbfs-events.sock,syslog:kbfs\".")
+	flags.StringVar(&params.LogLevels, "log-levels",
+		defaultParams.LogLevels,
+		"Comma-separated minimum log levels per module, e.g. "+
+			"\"blockops=debug,mdops=info,cr=warning,journal=error\". "+
+			"Use \"all\" to set the level for every module.")
+	flags.StringVar(&params.JSONLogFile, "json-log-file",
+		defaultParams.JSONLogFile,
+		"If non-empty, append log messages to this file as JSON "+
+			"objects, including TLF, op, block, and revision fields, "+
+			"instead of writing them to the usual log.")
+	flags.DurationVar(&params.DebugLogBufferDuration,
+		"debug-log-buffer-duration", defaultParams.DebugLogBufferDuration,
+		"How long to keep verbose log messages in memory for each folder, "+
+			"for retrieval with \"kbfstool debug-log\". 0 disables it.")
+	flags.IntVar(&params.DebugLogBufferEntries, "debug-log-buffer-entries",
+		defaultParams.DebugLogBufferEntries,
+		"The maximum number of verbose log messages to keep in memory "+
+			"for each folder.")
 	flags.StringVar(&params.StorageRoot, "storage-root",
 		defaultParams.StorageRoot, "Specifies where Keybase will store its "+
 			"local databases for the journal and disk cache.")
@@ -259,18 +474,91 @@ func AddFlagsWithDefaults(
 		defaultParams.BGFlushPeriod,
 		"The amount of time to wait before syncing data in a TLF, if the "+
 			"batch size doesn't fill up.")
+	flags.DurationVar(&params.DirtyFileMaxAge, "dirty-file-max-age",
+		defaultParams.DirtyFileMaxAge,
+		"The longest a file may have unsynced data before it is synced, "+
+			"or 0 for no limit.")
+	flags.Uint64Var(&params.MaxFileBytes, "max-file-bytes",
+		defaultParams.MaxFileBytes,
+		"The largest file size that may be written, or 0 for the largest "+
+			"size supported by the data version.")
+	flags.IntVar(&params.MaxDirEntries, "max-dir-entries",
+		defaultParams.MaxDirEntries,
+		"The most entries a single directory may have, or 0 for no limit.")
+	flags.IntVar(&params.MaxSymlinkDepth, "max-symlink-depth",
+		defaultParams.MaxSymlinkDepth,
+		"The most symlinks that may be followed while resolving a path.")
+	flags.IntVar(&params.DirHashBuckets, "dir-hash-buckets",
+		defaultParams.DirHashBuckets,
+		"The number of hash buckets large directories are sharded into, "+
+			"or 0 to split directories by name only.")
+	flags.Int64Var(&params.CRBlockBudget, "cr-block-budget",
+		defaultParams.CRBlockBudget,
+		"The most bytes of blocks conflict resolution keeps in memory "+
+			"before spilling them to the disk cache, or 0 for no limit.")
+	flags.DurationVar(&params.IdleThreshold, "idle-threshold",
+		defaultParams.IdleThreshold,
+		"How long to wait after the last foreground operation before "+
+			"running heavy background maintenance, or 0 to never wait.")
+	flags.BoolVar(&params.PowerAware, "power-aware",
+		defaultParams.PowerAware,
+		"Scale back background work on battery power or a metered network.")
+	flags.Int64Var(&params.PrefetchBudget.PerHour, "prefetch-budget-hourly",
+		defaultParams.PrefetchBudget.PerHour,
+		"The most bytes the prefetcher may download in an hour, or 0 for "+
+			"no limit.")
+	flags.Int64Var(&params.PrefetchBudget.PerDay, "prefetch-budget-daily",
+		defaultParams.PrefetchBudget.PerDay,
+		"The most bytes the prefetcher may download in a day, or 0 for "+
+			"no limit.")
+	flags.DurationVar(&params.ReadNotificationInterval,
+		"read-notification-interval", defaultParams.ReadNotificationInterval,
+		"The minimum time between read notifications for the same file, "+
+			"or 0 to only aggregate overlapping reads.")
 	flags.IntVar((*int)(&params.BGFlushDirOpBatchSize), "sync-batch-size",
 		int(defaultParams.BGFlushDirOpBatchSize),
 		"The number of unflushed directory operations in a TLF that will "+
 			"trigger an immediate data sync.")
 
+	params.NewFileExecMode = defaultParams.NewFileExecMode
+	flags.Var(&params.NewFileExecMode, "new-file-exec-mode",
+		"Sets how the exec bit is chosen for new files: 'request' honors "+
+			"the creator's mode, 'never' and 'always' force it off or on, "+
+			"and 'inherit' also sets it when all existing files in the "+
+			"parent directory are executable.")
+
+	flags.BoolVar(&params.OrderedWrites, "ordered-writes",
+		defaultParams.OrderedWrites,
+		"Make every sync commit all of a TLF's pending changes "+
+			"together, so that e.g. a manifest written after its "+
+			"data file never becomes visible before it.")
+
+	flags.BoolVar(&params.AdaptiveBlockSizes, "adaptive-block-sizes",
+		defaultParams.AdaptiveBlockSizes,
+		"Choose the block size of each new file based on how it's "+
+			"written: large blocks for files written as a stream, and "+
+			"small ones for files written at random offsets.")
+
+	params.FsyncMode = defaultParams.FsyncMode
+	flags.Var(&params.FsyncMode, "fsync-mode",
+		"Sets when an fsync returns: 'journal' once the data is in the "+
+			"local journal (if enabled), or 'server' once the journal has "+
+			"flushed it to the servers.")
+
+	params.TimestampMode = defaultParams.TimestampMode
+	flags.Var(&params.TimestampMode, "timestamp-mode",
+		"Sets how strictly file times follow POSIX: 'relaxed' skips some "+
+			"costly updates, 'posix' follows it for mtimes and ctimes, "+
+			"and 'posix-atime' also tracks atimes in memory.")
+
 	flags.IntVar((*int)(&params.MetadataVersion), "md-version",
 		int(defaultParams.MetadataVersion),
 		"Metadata version to use when creating new metadata")
 	flags.StringVar(&params.Mode, "mode", defaultParams.Mode,
 		fmt.Sprintf("Overall initialization mode for KBFS, indicating how "+
-			"heavy-weight it can be (%s, %s, %s or %s)", InitDefaultString,
-			InitMinimalString, InitSingleOpString, InitConstrainedString))
+			"heavy-weight it can be (%s, %s, %s, %s or %s)",
+			InitDefaultString, InitMinimalString, InitSingleOpString,
+			InitConstrainedString, InitViewerString))
 
 	return &params
 }
@@ -567,6 +855,9 @@ func doInit(
 	case InitConstrainedString:
 		log.CDebugf(ctx, "Initializing in constrained mode")
 		mode = InitConstrained
+	case InitViewerString:
+		log.CDebugf(ctx, "Initializing in viewer mode")
+		mode = InitViewer
 	default:
 		return nil, fmt.Errorf("Unexpected mode: %s", params.Mode)
 	}
@@ -588,6 +879,43 @@ func doInit(
 			return lg
 		}, params.StorageRoot, params.DiskCacheMode, kbCtx)
 
+	if params.LogLevels != "" {
+		if err := config.LogLevels().Set(params.LogLevels); err != nil {
+			return nil, err
+		}
+	}
+	if params.DebugLogBufferDuration > 0 {
+		if params.DebugLogBufferEntries <= 0 {
+			return nil, fmt.Errorf("Illegal debug log buffer size: %d",
+				params.DebugLogBufferEntries)
+		}
+		config.LogLevels().SetDebugBuffer(NewDebugLogBuffer(
+			config.Clock(), params.DebugLogBufferDuration,
+			params.DebugLogBufferEntries))
+	}
+	if params.JSONLogFile != "" {
+		f, err := os.OpenFile(params.JSONLogFile,
+			os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		log.CDebugf(ctx, "Writing JSON logs to %s", params.JSONLogFile)
+		config.LogLevels().SetJSONOutput(f)
+	}
+
+	if mode == InitViewer {
+		// Nothing is ever dirtied in viewer mode, so give the memory
+		// the dirty block cache would have used to the clean one, and
+		// don't redo identifies as often.
+		if params.CleanBlockCacheCapacity == 0 {
+			params.CleanBlockCacheCapacity = viewerCleanBlockCacheFactor *
+				getDefaultCleanBlockCacheCapacity()
+		}
+		if params.TLFValidDuration == tlfValidDurationDefault {
+			params.TLFValidDuration = viewerTLFValidDuration
+		}
+	}
+
 	if params.CleanBlockCacheCapacity > 0 {
 		log.CDebugf(
 			ctx, "overriding default clean block cache capacity from %d to %d",
@@ -597,30 +925,70 @@ func doInit(
 			params.CleanBlockCacheCapacity)
 	}
 
+	if bcache, ok := config.BlockCache().(*BlockCacheStandard); ok &&
+		(params.DirBlockCacheTTL > 0 || params.FileBlockCacheTTL > 0) {
+		log.CDebugf(ctx, "Limiting clean block cache lifetimes to %s "+
+			"for directories and %s for files", params.DirBlockCacheTTL,
+			params.FileBlockCacheTTL)
+		bcache.SetDefaultLifetimePolicy(BlockCacheLifetimePolicy{
+			DirBlockTTL:  params.DirBlockCacheTTL,
+			FileBlockTTL: params.FileBlockCacheTTL,
+		})
+	}
+
 	workers := config.Mode().BlockWorkers()
 	prefetchWorkers := config.Mode().PrefetchWorkers()
-	config.SetBlockOps(NewBlockOpsStandard(config, workers, prefetchWorkers))
+	bops := NewBlockOpsStandard(config, workers, prefetchWorkers)
+	if params.MaxBlockFetchesPerTlf > 0 {
+		log.CDebugf(ctx, "Limiting block fetches to %d per TLF",
+			params.MaxBlockFetchesPerTlf)
+		bops.SetMaxFetchesPerTlf(params.MaxBlockFetchesPerTlf)
+	}
+	config.SetBlockOps(bops)
+	config.SetEarlyBlockUploadEnabled(params.EarlyBlockUpload)
+
+	if rkq, ok := config.RekeyQueue().(*RekeyQueueStandard); ok &&
+		params.RekeysPerSecond > 0 {
+		log.CDebugf(ctx, "Limiting rekeys to %g per second",
+			params.RekeysPerSecond)
+		rkq.SetRateLimit(rate.Limit(params.RekeysPerSecond))
+	}
 
 	bsplitter, err := NewBlockSplitterSimple(MaxBlockSizeBytesDefault, 8*1024,
 		config.Codec())
 	if err != nil {
 		return nil, err
 	}
+	if params.DirHashBuckets > 0 {
+		bsplitter.SetDirHashBuckets(params.DirHashBuckets)
+	}
 	config.SetBlockSplitter(bsplitter)
 
-	if registry := config.MetricsRegistry(); registry != nil {
+	if sink := config.MetricsSink(); sink != nil {
 		keyCache := config.KeyCache()
-		keyCache = NewKeyCacheMeasured(keyCache, registry)
+		keyCache = NewKeyCacheMeasured(keyCache, sink)
 		config.SetKeyCache(keyCache)
 
 		keyBundleCache := config.KeyBundleCache()
-		keyBundleCache = NewKeyBundleCacheMeasured(keyBundleCache, registry)
+		keyBundleCache = NewKeyBundleCacheMeasured(keyBundleCache, sink)
 		config.SetKeyBundleCache(keyBundleCache)
 	}
 
 	config.SetMetadataVersion(kbfsmd.MetadataVer(params.MetadataVersion))
 	config.SetTLFValidDuration(params.TLFValidDuration)
 	config.SetBGFlushPeriod(params.BGFlushPeriod)
+	config.SetDirtyFileMaxAge(params.DirtyFileMaxAge)
+	config.SetMaxFileBytes(tlf.NullID, params.MaxFileBytes)
+	config.SetMaxDirEntries(tlf.NullID, params.MaxDirEntries)
+	config.SetMaxSymlinkDepth(params.MaxSymlinkDepth)
+	config.SetCRBlockBudget(params.CRBlockBudget)
+	config.IdleTracker().SetThreshold(params.IdleThreshold)
+	if !params.PowerAware {
+		config.PowerMonitor().SetPolicy(PowerPolicy{})
+	}
+	config.PrefetchBudget().SetLimits(params.PrefetchBudget)
+	config.ReadNotifications().SetAggregationInterval(
+		params.ReadNotificationInterval)
 
 	kbfsLog := config.MakeLogger("")
 
@@ -651,12 +1019,21 @@ func doInit(
 	config.SetKeyManager(NewKeyManagerStandard(config))
 	config.SetMDOps(NewMDOpsStandard(config))
 
-	if registry := config.MetricsRegistry(); registry != nil {
-		service = NewKeybaseServiceMeasured(service, registry)
+	if sink := config.MetricsSink(); sink != nil {
+		service = NewKeybaseServiceMeasured(service, sink)
 	}
 	config.SetKeybaseService(service)
 
 	config.SetReporter(NewReporterKBPKI(config, 10, 1000))
+	if params.NotificationSinks != "" {
+		sinks, err := ParseNotificationSinks(params.NotificationSinks)
+		if err != nil {
+			return nil, err
+		}
+		for _, sink := range sinks {
+			AddNotificationSink(config, sink)
+		}
+	}
 
 	// Initialize Crypto client (needed for MD and Block servers).
 	crypto, err := keybaseServiceCn.NewCrypto(config, params, kbCtx, kbfsLog)
@@ -679,8 +1056,8 @@ func doInit(
 	if err != nil {
 		return nil, fmt.Errorf("problem creating key server: %+v", err)
 	}
-	if registry := config.MetricsRegistry(); registry != nil {
-		keyServer = NewKeyServerMeasured(keyServer, registry)
+	if sink := config.MetricsSink(); sink != nil {
+		keyServer = NewKeyServerMeasured(keyServer, sink)
 	}
 	config.SetKeyServer(keyServer)
 
@@ -690,10 +1067,48 @@ func doInit(
 	if err != nil {
 		return nil, fmt.Errorf("cannot open block database: %+v", err)
 	}
-	if registry := config.MetricsRegistry(); registry != nil {
-		bserv = NewBlockServerMeasured(bserv, registry)
+	if sink := config.MetricsSink(); sink != nil {
+		bserv = NewBlockServerMeasured(bserv, sink)
+	}
+	trafficLog := config.BlockTrafficLog()
+	if params.StorageRoot != "" {
+		err := trafficLog.Load(config.Codec(),
+			filepath.Join(params.StorageRoot, blockTrafficLogFilename))
+		if err != nil {
+			log.CWarningf(ctx, "Couldn't load the block traffic log: %+v",
+				err)
+		}
+	}
+	bserv = NewBlockServerTrafficLogged(bserv, trafficLog)
+	if params.BlockPeers != "" || params.BlockPeerListenAddr != "" {
+		var peers []string
+		for _, peer := range strings.Split(params.BlockPeers, ",") {
+			if peer = strings.TrimSpace(peer); peer != "" {
+				peers = append(peers, peer)
+			}
+		}
+		peerBserv, err := NewBlockServerPeers(config, bserv, peers)
+		if err != nil {
+			log.CWarningf(ctx, "Couldn't set up block peers: %+v", err)
+		} else {
+			if params.BlockPeerListenAddr != "" {
+				_, err := peerBserv.Listen(params.BlockPeerListenAddr)
+				if err != nil {
+					log.CWarningf(ctx,
+						"Couldn't serve blocks to peers: %+v", err)
+				}
+			}
+			bserv = peerBserv
+		}
 	}
 	config.SetBlockServer(bserv)
+	if params.PublicBlockURL != "" {
+		log.CDebugf(ctx, "Reading public blocks from %s first",
+			params.PublicBlockURL)
+		config.SetPublicBlockFetcher(
+			NewBlockFetcherHTTP(
+				config.Codec(), config.Clock(), params.PublicBlockURL))
+	}
 
 	err = config.MakeDiskBlockCacheIfNotExists()
 	if err != nil {
@@ -742,6 +1157,14 @@ func doInit(
 		log.CDebugf(ctx, "Journaling enabled")
 	}
 
+	if params.StorageRoot != "" {
+		err = config.SyncOutbox().Load(
+			filepath.Join(params.StorageRoot, syncOutboxDirname))
+		if err != nil {
+			log.CWarningf(ctx, "Couldn't load the sync outbox: %+v", err)
+		}
+	}
+
 	if params.BGFlushDirOpBatchSize < 1 {
 		return nil, fmt.Errorf(
 			"Illegal sync batch size: %d", params.BGFlushDirOpBatchSize)
@@ -750,6 +1173,58 @@ func doInit(
 		params.BGFlushDirOpBatchSize)
 	config.SetBGFlushDirOpBatchSize(params.BGFlushDirOpBatchSize)
 
+	config.SetNewFileExecMode(tlf.NullID, params.NewFileExecMode)
+	config.SetOrderedWrites(tlf.NullID, params.OrderedWrites)
+	config.SetAdaptiveBlockSizes(tlf.NullID, params.AdaptiveBlockSizes)
+	config.SetFsyncMode(params.FsyncMode)
+	config.SetTimestampMode(params.TimestampMode)
+
+	if params.FaultInjection != "" {
+		rules, err := ParseFaultRules(params.FaultInjection)
+		if err != nil {
+			return nil, err
+		}
+		log.CWarningf(ctx, "Injecting faults: %s", params.FaultInjection)
+		fi := NewFaultInjector(
+			config.MakeLogger("FI"), config.Clock().Now().UnixNano())
+		fi.SetRules(rules)
+		InstallFaultInjector(config, fi)
+	}
+
+	if params.OpLogFile != "" {
+		f, err := os.OpenFile(params.OpLogFile,
+			os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		recorder, err := NewOpLogRecorder(config, f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		log.CDebugf(ctx, "Recording ops to %s", params.OpLogFile)
+		config.SetKBFSOps(recorder)
+	}
+
+	// This must come after the op log recorder is installed.
+	if params.DelegationTokenFile != "" {
+		buf, err := ioutil.ReadFile(params.DelegationTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		var token DelegationToken
+		err = config.Codec().Decode(buf, &token)
+		if err != nil {
+			return nil, err
+		}
+		err = InstallDelegationToken(ctx, config, token)
+		if err != nil {
+			return nil, err
+		}
+		log.CDebugf(ctx, "Restricted to reading %v until %s",
+			token.Paths, time.Unix(0, token.Expires))
+	}
+
 	return config, nil
 }
 
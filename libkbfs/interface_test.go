@@ -55,14 +55,16 @@ func (cg *testClockGetter) TestClock() *TestClock {
 }
 
 type testSyncedTlfGetterSetter struct {
-	syncedTlfs map[tlf.ID]bool
+	syncedTlfs         map[tlf.ID]bool
+	metadataSyncedTlfs map[tlf.ID]bool
 }
 
 var _ syncedTlfGetterSetter = (*testSyncedTlfGetterSetter)(nil)
 
 func newTestSyncedTlfGetterSetter() *testSyncedTlfGetterSetter {
 	return &testSyncedTlfGetterSetter{
-		syncedTlfs: make(map[tlf.ID]bool),
+		syncedTlfs:         make(map[tlf.ID]bool),
+		metadataSyncedTlfs: make(map[tlf.ID]bool),
 	}
 }
 
@@ -76,6 +78,16 @@ func (t *testSyncedTlfGetterSetter) SetTlfSyncState(tlfID tlf.ID,
 	return nil
 }
 
+func (t *testSyncedTlfGetterSetter) IsMetadataSyncedTlf(tlfID tlf.ID) bool {
+	return t.metadataSyncedTlfs[tlfID]
+}
+
+func (t *testSyncedTlfGetterSetter) SetTlfMetadataSyncState(tlfID tlf.ID,
+	isSynced bool) error {
+	t.metadataSyncedTlfs[tlfID] = isSynced
+	return nil
+}
+
 type testInitModeGetter struct {
 	mode InitModeType
 }
@@ -89,3 +101,33 @@ func (t testInitModeGetter) Mode() InitMode {
 func (t testInitModeGetter) IsTestMode() bool {
 	return true
 }
+
+type testIdleTrackerGetter struct {
+	tracker *IdleTracker
+}
+
+var _ idleTrackerGetter = (*testIdleTrackerGetter)(nil)
+
+func (t testIdleTrackerGetter) IdleTracker() *IdleTracker {
+	return t.tracker
+}
+
+type testPowerMonitorGetter struct {
+	monitor *PowerMonitor
+}
+
+var _ powerMonitorGetter = (*testPowerMonitorGetter)(nil)
+
+func (t testPowerMonitorGetter) PowerMonitor() *PowerMonitor {
+	return t.monitor
+}
+
+type testPrefetchBudgetGetter struct {
+	budget *PrefetchBudget
+}
+
+var _ prefetchBudgetGetter = (*testPrefetchBudgetGetter)(nil)
+
+func (t testPrefetchBudgetGetter) PrefetchBudget() *PrefetchBudget {
+	return t.budget
+}
@@ -5,6 +5,7 @@
 package libkbfs
 
 import (
+	"io"
 	"time"
 
 	kbname "github.com/keybase/client/go/kbun"
@@ -46,6 +47,14 @@ type blockServerGetter interface {
 	BlockServer() BlockServer
 }
 
+type publicBlockFetcherGetter interface {
+	PublicBlockFetcher() BlockFetcher
+}
+
+type mdVerifierGetter interface {
+	mdVerifier() *mdVerifier
+}
+
 type cryptoPureGetter interface {
 	cryptoPure() cryptoPure
 }
@@ -85,12 +94,26 @@ type diskLimiterGetter interface {
 type syncedTlfGetterSetter interface {
 	IsSyncedTlf(tlfID tlf.ID) bool
 	SetTlfSyncState(tlfID tlf.ID, isSynced bool) error
+	IsMetadataSyncedTlf(tlfID tlf.ID) bool
+	SetTlfMetadataSyncState(tlfID tlf.ID, isSynced bool) error
 }
 
 type blockRetrieverGetter interface {
 	BlockRetriever() BlockRetriever
 }
 
+type idleTrackerGetter interface {
+	IdleTracker() *IdleTracker
+}
+
+type powerMonitorGetter interface {
+	PowerMonitor() *PowerMonitor
+}
+
+type prefetchBudgetGetter interface {
+	PrefetchBudget() *PrefetchBudget
+}
+
 // Offset is a generic representation of an offset to an indirect
 // pointer within an indirect Block.
 type Offset interface {
@@ -277,6 +300,13 @@ type KBFSOps interface {
 	// the local cache.  Idempotent, so it succeeds even if the folder
 	// isn't favorited.
 	DeleteFavorite(ctx context.Context, fav Favorite) error
+	// ConfigureTlfs applies each request in `reqs` to its TLF,
+	// batching all the favorites changes together.  Each failure is
+	// reported at the index of its request in the returned slice,
+	// and doesn't stop the others from being applied.  The returned
+	// error is only set if the batch couldn't be attempted at all.
+	ConfigureTlfs(ctx context.Context, reqs []TlfConfigRequest) (
+		[]error, error)
 
 	// GetTLFCryptKeys gets crypt key of all generations as well as
 	// TLF ID for tlfHandle. The returned keys (the keys slice) are ordered by
@@ -310,6 +340,13 @@ type KBFSOps interface {
 	// permission for the top-level folder.  This is a remote-access
 	// operation.
 	GetDirChildren(ctx context.Context, dir Node) (map[string]EntryInfo, error)
+	// WalkTLF calls `walkFn` for every entry in the subtree rooted
+	// at `dir` (not including `dir` itself), reading up to a fixed
+	// number of directories in parallel, if the logged-in user has
+	// read permission for the top-level folder.  The walk sees each
+	// directory as of the time it is read.  This is a remote-access
+	// operation.
+	WalkTLF(ctx context.Context, dir Node, walkFn WalkTLFFunc) error
 	// Lookup returns the Node and entry info associated with a
 	// given name in a directory, if the logged-in user has read
 	// permissions to the top-level folder.  The returned Node is nil
@@ -319,6 +356,61 @@ type KBFSOps interface {
 	// given Node, if the logged-in user has read permissions to the
 	// top-level folder.  This is a remote-access operation.
 	Stat(ctx context.Context, node Node) (EntryInfo, error)
+	// GetAllocatedSize returns an estimate of how many bytes of the
+	// given file's logical size are backed by data, rather than
+	// being part of a hole left by extending the file.  It is rounded
+	// up to the padded size of the file's blocks.  For anything but
+	// a file, it's the same as the entry's size.  This is a
+	// remote-access operation.
+	GetAllocatedSize(ctx context.Context, node Node) (uint64, error)
+	// GetFileBlockLayout returns the layout of the block tree of the
+	// given file, including any dirty blocks, which is useful when
+	// debugging the performance of a specific large file.  This is
+	// a remote-access operation.
+	GetFileBlockLayout(ctx context.Context, file Node) (
+		FileBlockLayout, error)
+	// ReadFileAt returns the full contents of the file at the given
+	// canonical path (e.g., "/keybase/private/alice/dir/file"),
+	// following any symlinks, if the logged-in user has read
+	// permission for the top-level folder.  Like the other *At
+	// methods, it looks up and drops all the needed nodes itself,
+	// so the caller never has to deal with a Node.  This is a
+	// remote-access operation.
+	ReadFileAt(ctx context.Context, p string) ([]byte, error)
+	// WriteFileAt replaces the contents of the file at the given
+	// canonical path with `data`, creating the file (and the
+	// top-level folder) if needed, and syncs it, if the logged-in
+	// user has write permission for the top-level folder.  The
+	// parent directory must already exist.  This is a remote-sync
+	// operation.
+	WriteFileAt(ctx context.Context, p string, data []byte) error
+	// StatAt returns the entry info for the given canonical path,
+	// following any symlinks, if the logged-in user has read
+	// permission for the top-level folder.  This is a remote-access
+	// operation.
+	StatAt(ctx context.Context, p string) (EntryInfo, error)
+	// StatMany returns the directory entries for many canonical
+	// paths at once, keyed by path, if the logged-in user has read
+	// permission for their top-level folders.  Each parent directory
+	// is resolved once (following symlinks) and read in a single
+	// pass, but symlinks in the final component are returned as
+	// is.  Paths that don't exist are left out of the result.  This
+	// is a remote-access operation.
+	StatMany(ctx context.Context, paths []string) (map[string]DirEntry, error)
+	// Watch registers `fn` to be called for every change, of one of
+	// the types in `filter`, to the entries of the directory at the
+	// given canonical path (or anywhere under it, if `recursive` is
+	// true), whether made locally or by another device.  Each event
+	// carries the MD revision and the writer that made the change.
+	// The watch is on the path, not the directory, so it doesn't
+	// follow later renames of the directory.  It returns a function
+	// that removes the watch.
+	Watch(ctx context.Context, p string, recursive bool,
+		filter WatchEventType, fn WatchFunc) (unwatch func(), err error)
+	// ListAt returns the children of the directory at the given
+	// canonical path, following any symlinks, as in GetDirChildren.
+	// This is a remote-access operation.
+	ListAt(ctx context.Context, p string) (map[string]EntryInfo, error)
 	// CreateDir creates a new subdirectory under the given node, if
 	// the logged-in user has write permission to the top-level
 	// folder.  Returns the new Node for the created subdirectory, and
@@ -335,6 +427,35 @@ type KBFSOps interface {
 	// This is a remote-sync operation.
 	CreateFile(ctx context.Context, dir Node, name string, isExec bool, excl Excl) (
 		Node, EntryInfo, error)
+	// CreateFiles creates many new files, with optional initial
+	// contents, under the given node, if the logged-in user has
+	// write permission to the top-level folder.  The files are
+	// created in large batches, each made in a single pass under the
+	// folder's write lock and synced in a single revision, which is
+	// much faster than creating and writing them one at a time.  On
+	// an error, it returns the nodes and entry infos of the batches
+	// that were created before it; any files created in the failed
+	// batch will still be synced eventually.  The FUSE and Dokan
+	// layers don't use this, since the kernel hands them one create
+	// at a time and needs each new node right away; those creates
+	// are batched by the background flusher instead.  This is a
+	// remote-sync operation.
+	CreateFiles(ctx context.Context, dir Node, files []NewFileInfo) (
+		[]Node, []EntryInfo, error)
+	// InstantiateTemplate creates a new subdirectory `name` under
+	// `dir` holding a copy of the whole subtree under `template`,
+	// which must be in the same top-level folder, if the logged-in
+	// user has write permission to that folder.  The new entries and
+	// their contents are synced together in a single revision, unless
+	// the contents are too large to stay dirty until the end.  As in
+	// CopyFileRange, the leaf blocks of the template's files are
+	// shared with the copies where possible, rather than read and
+	// uploaded again.  Templates are meant for scaffolding trees, and
+	// are limited to a single batch of entries.  Returns the new
+	// Node for the created subdirectory, and its new entry info.
+	// This is a remote-sync operation.
+	InstantiateTemplate(ctx context.Context, template Node, dir Node,
+		name string) (Node, EntryInfo, error)
 	// CreateLink creates a new symlink under the given node, if the
 	// logged-in user has write permission to the top-level folder.
 	// Returns the new entry info for the created symlink.  This
@@ -372,6 +493,31 @@ type KBFSOps interface {
 	// that means EOF has been reached. This is a remote-access
 	// operation.
 	Read(ctx context.Context, file Node, dest []byte, off int64) (int64, error)
+	// FetchFileRange fetches the blocks of the file at the given node
+	// that hold the byte range `[off, off+length)` into the local
+	// block caches (including the disk cache, if enabled), without
+	// reading any of the rest of the file, so that later reads of
+	// that range don't block on the network.  A negative length
+	// means to the end of the file.  It returns the block-aligned
+	// range that is now cached, which covers the requested range
+	// except past the end of the file.  This is a remote-access
+	// operation.
+	FetchFileRange(ctx context.Context, file Node, off, length int64) (
+		FileRange, error)
+	// ReadVec is like calling Read once for each of the given
+	// buffers, at the offset given with it, except that all the
+	// buffers are read from the same version of the file, and their
+	// blocks are fetched in parallel.  It returns the number of
+	// bytes read into each buffer.  This is a remote-access
+	// operation.
+	ReadVec(ctx context.Context, file Node, vecs []IOVec) ([]int64, error)
+	// GetLocalFileRanges returns the byte ranges of the file at the
+	// given node that can currently be read without contacting the
+	// server, because their blocks are dirty, in the block cache, in
+	// the journal, or in the disk cache.  The ranges are sorted and
+	// don't overlap.  It never fetches any blocks, so it doesn't
+	// block on the network.
+	GetLocalFileRanges(ctx context.Context, file Node) ([]FileRange, error)
 	// Write modifies the file at the given node, by writing the given
 	// buffer at the given offset within the file, if the logged-in
 	// user has write permission to the top-level folder.  It
@@ -382,6 +528,45 @@ type KBFSOps interface {
 	// the necessary blocks have been locally cached.  This is a
 	// remote-access operation.
 	Write(ctx context.Context, file Node, data []byte, off int64) error
+	// WriteVec is like calling Write once for each of the given
+	// buffers in order, at the offset given with it, except that the
+	// blocks they touch are fetched in parallel, and no other
+	// operation on the file can come between the writes.  This is a
+	// remote-access operation.
+	WriteVec(ctx context.Context, file Node, vecs []IOVec) error
+	// WriteStream writes everything read from `r` into the file at
+	// the given node, starting at the given offset, as in Write.  It
+	// pulls the data from `r` a block at a time, so callers don't
+	// need to chunk it themselves, and memory use stays bounded no
+	// matter how much data there is: like Write, it waits for the
+	// background syncer whenever the dirty block cache is full.  As
+	// with Write, the data isn't synced when it returns.  It returns
+	// the number of bytes written, which may be non-zero even on
+	// error.  This is a remote-access operation.
+	WriteStream(ctx context.Context, file Node, r io.Reader, off int64) (
+		int64, error)
+	// CopyFileRange copies `length` bytes of the file at node `src`,
+	// starting at `srcOff`, into the file at node `dst` at `dstOff`,
+	// as if by reading them and writing them with WriteStream, and
+	// returns the number of bytes copied, which is short only if
+	// `src` ends first.  Both files must be in the same TLF, and the
+	// ranges can't overlap if they are the same file.  Whole, synced
+	// leaf blocks of `src` that land at the end of `dst` are shared
+	// with `dst` through new block references, without being read
+	// or uploaded again; only the rest is copied byte by byte.  This
+	// is a remote-sync operation.
+	CopyFileRange(ctx context.Context, src, dst Node,
+		srcOff, dstOff, length int64) (int64, error)
+	// CloneFile creates a new file named `name` under `dstDir`, with
+	// the same type and contents as the file at node `src`, if the
+	// logged-in user has write permission to the top-level folder.
+	// Both must be in the same TLF.  The clone gets its own indirect
+	// blocks, but shares all of its leaf blocks with `src`, so it
+	// takes up little extra space.  Later writes to either file don't
+	// affect the other.  It fails if `name` already exists.  This is
+	// a remote-sync operation.
+	CloneFile(ctx context.Context, src Node, dstDir Node, name string) (
+		Node, EntryInfo, error)
 	// Truncate modifies the file at the given node, by either
 	// shrinking or extending its size to match the given size, if the
 	// logged-in user has write permission to the top-level folder.
@@ -395,11 +580,28 @@ type KBFSOps interface {
 	// permissions to the top-level folder.  This is a remote-sync
 	// operation.
 	SetEx(ctx context.Context, file Node, ex bool) error
+	// SetExInSubtree turns on or off the executable bit on every
+	// file under the directory represented by the given node, if
+	// the logged-in user has write permissions to the top-level
+	// folder.  The changes are made in a series of bounded MD
+	// revisions.  This is a remote-sync operation.
+	SetExInSubtree(ctx context.Context, dir Node, ex bool) error
 	// SetMtime sets the modification time on the file represented by
 	// a given node, if the logged-in user has write permissions to
 	// the top-level folder.  If mtime is nil, it is a noop.  This is
 	// a remote-sync operation.
 	SetMtime(ctx context.Context, file Node, mtime *time.Time) error
+	// SetTimes sets the modification time on the file represented by
+	// a given node, like SetMtime.  If ctime is non-nil, it is
+	// recorded as the file's change time instead of the current
+	// time, so that backup and restore tools can preserve
+	// timestamps faithfully.  This is a remote-sync operation.
+	SetTimes(ctx context.Context, file Node, mtime time.Time,
+		ctime *time.Time) error
+	// SetTimesBatch sets the times on many nodes at once, as in
+	// SetTimes, using as few MD revisions as possible.  This is a
+	// remote-sync operation.
+	SetTimesBatch(ctx context.Context, times []NodeTimes) error
 	// SyncAll flushes all outstanding writes and truncates for any
 	// dirty files to the KBFS servers within the given folder, if the
 	// logged-in user has write permissions to the top-level folder.
@@ -407,6 +609,32 @@ type KBFSOps interface {
 	// modifications done via multiple file handles.  This is a
 	// remote-sync operation.
 	SyncAll(ctx context.Context, folderBranch FolderBranch) error
+	// SyncAllAsync starts a SyncAll of the given folder in the
+	// background, and returns immediately with a ticket identifying
+	// it.  When the sync finishes, every SyncObserver registered for
+	// the folder is told the ticket and the result.
+	SyncAllAsync(ctx context.Context, folderBranch FolderBranch) (
+		SyncTicket, error)
+	// Barrier guarantees that all writes to the given file made
+	// before the call have been written to the TLF journal, if it's
+	// enabled, once it returns, ahead of any later writes.  Barrier
+	// doesn't wait for them to be flushed to the KBFS servers.  The
+	// journal files aren't fsynced, so the writes survive a crash of
+	// this process, but not necessarily of the whole machine.  If
+	// the journal is disabled, they are synced to the servers.  If
+	// the file has no unsynced changes, it returns immediately
+	// without creating a new revision.  If it does, other dirty files
+	// in the same folder are synced along with it.  This is a
+	// remote-sync operation if the journal is disabled.
+	Barrier(ctx context.Context, file Node) error
+	// SetWriteThrough marks the given file as write-through (or
+	// not).  Each Write or Truncate to a write-through file doesn't
+	// return until the change is in the journal (or on the servers),
+	// as if Barrier were called right after it, rather than being
+	// buffered for a background sync.  This is meant for small files
+	// that must not lose updates, like lockfiles.  The setting lasts
+	// as long as the node is in use.
+	SetWriteThrough(ctx context.Context, file Node, writeThrough bool) error
 	// FolderStatus returns the status of a particular folder/branch, along
 	// with a channel that will be closed when the status has been
 	// updated (to eliminate the need for polling this method).
@@ -420,6 +648,50 @@ type KBFSOps interface {
 	// KBFSStatus can be non-empty even if there is an error.
 	Status(ctx context.Context) (
 		KBFSStatus, <-chan StatusUpdate, error)
+	// GetUnlinkedNodeStats returns the number of nodes in the given
+	// folder-branch that have been unlinked but are still in use,
+	// and the number of dirty bytes they hold.
+	GetUnlinkedNodeStats(ctx context.Context, folderBranch FolderBranch) (
+		UnlinkedNodeStats, error)
+	// SetTlfBlockSize records in the MD of the given folder-branch
+	// the size to aim for when encoding new file blocks, e.g. so
+	// that a TLF holding large media files uses fewer, larger
+	// blocks.  Files written before keep their existing blocks.  A
+	// `size` of 0 reverts the TLF to the default block size.
+	SetTlfBlockSize(ctx context.Context, folderBranch FolderBranch,
+		size int64) error
+	// RevertToRevision restores the tree of the given folder-branch
+	// to its state as of the earlier revision `rev`, in a single new
+	// revision, or only lists the changes that would be made if
+	// `dryRun` is true.  If `expectedHead` isn't
+	// kbfsmd.RevisionUninitialized, it must be the current head
+	// revision.  See `RevertTLF`.
+	RevertToRevision(ctx context.Context, folderBranch FolderBranch,
+		rev, expectedHead kbfsmd.Revision, dryRun bool) (TLFRevert, error)
+	// ReclaimUnlinkedNodes drops the dirty data held by unlinked
+	// nodes in the given folder-branch, since it can never be
+	// synced.  Nodes that may still have open handles are skipped;
+	// their dirty data is dropped once the node cache forgets them.
+	// It returns what was reclaimed.
+	ReclaimUnlinkedNodes(ctx context.Context, folderBranch FolderBranch) (
+		UnlinkedNodeStats, error)
+	// SubscribeSubtrees limits the MD update processing of the given
+	// folder-branch to the given subtrees, each a slash-separated
+	// path relative to the TLF root, and to their ancestors.  Cached
+	// nodes outside of them are still kept up to date, but their new
+	// blocks aren't prefetched during updates and fast-forwards, and
+	// observers aren't told about changes to them, so anything
+	// caching their contents may go stale.  An empty list, or one
+	// that includes the root, subscribes to the whole folder again.
+	SubscribeSubtrees(ctx context.Context, folderBranch FolderBranch,
+		subtrees []string) error
+	// CancelSync aborts the sync of the given file, if one is in
+	// flight, for when it's stuck.  The file stays dirty, and any
+	// writes waiting on the sync are unblocked.  Since dirty files
+	// are synced together, the other files syncing with it are
+	// aborted too, and will be synced again later.  It returns nil
+	// if there was no sync to cancel.
+	CancelSync(ctx context.Context, file Node) error
 	// UnstageForTesting clears out this device's staged state, if
 	// any, and fast-forwards to the current head of this
 	// folder-branch.
@@ -743,6 +1015,12 @@ type teamRootIDGetter interface {
 		keybase1.TeamID, error)
 }
 
+type teamRoleGetter interface {
+	// GetTeamRole returns the role of `uid` in the given team.
+	GetTeamRole(ctx context.Context, tid keybase1.TeamID,
+		uid keybase1.UID) (keybase1.TeamRole, error)
+}
+
 // KBPKI interacts with the Keybase daemon to fetch user info.
 type KBPKI interface {
 	CurrentSessionGetter
@@ -753,6 +1031,7 @@ type KBPKI interface {
 	teamMembershipChecker
 	teamKeysGetter
 	teamRootIDGetter
+	teamRoleGetter
 	gitMetadataPutter
 
 	// HasVerifyingKey returns nil if the given user has the given
@@ -1684,6 +1963,16 @@ type mdServerLocal interface {
 	setKbfsMerkleRoot(treeID keybase1.MerkleTreeID, root *kbfsmd.MerkleRoot)
 }
 
+// BlockFetcher gets opaque data blocks from somewhere other than
+// the block server, such as a CDN-style cache of public blocks.
+type BlockFetcher interface {
+	// Get gets the (encrypted) block data associated with the given
+	// block ID and context, along with its server half.
+	Get(ctx context.Context, tlfID tlf.ID, id kbfsblock.ID,
+		context kbfsblock.Context) (
+		[]byte, kbfscrypto.BlockCryptKeyServerHalf, error)
+}
+
 // BlockServer gets and puts opaque data blocks.  The instantiation
 // should be able to fetch session/user details via KBPKI.  On a
 // put/delete, the server is reponsible for: 1) checking that the ID
@@ -1788,6 +2077,29 @@ type blockServerLocal interface {
 		map[kbfsblock.ID]blockRefMap, error)
 }
 
+// blockServerTiered is implemented by block servers that can move
+// blocks to a slower, cheaper storage tier.
+type blockServerTiered interface {
+	// SetBlockTiers asks the server to keep the given blocks of the
+	// given TLF on `tier`.  It's only a hint: a server never moves a
+	// block that still has a non-archived reference to the archive
+	// tier, and moves it back once it gets a new one.
+	SetBlockTiers(ctx context.Context, tlfID tlf.ID, ids []kbfsblock.ID,
+		tier BlockTier) error
+}
+
+// blockExistenceChecker is implemented by block servers that can
+// cheaply tell which blocks they already have.  The remote block
+// server can't, short of fetching each block, so only the journal
+// does.
+type blockExistenceChecker interface {
+	// getExistingBlocks returns which of the given blocks of the
+	// given TLF the server already has, with live references
+	// matching all their contexts.
+	getExistingBlocks(ctx context.Context, tlfID tlf.ID,
+		contexts kbfsblock.ContextMap) (map[kbfsblock.ID]bool, error)
+}
+
 // BlockSplitter decides when a file block needs to be split
 type BlockSplitter interface {
 	// CopyUntilSplit copies data into the block until we reach the
@@ -1818,6 +2130,12 @@ type BlockSplitter interface {
 	// returns a one-element slice containing `block`.  If a split is
 	// needed, it returns a non-nil offset for the new block.
 	SplitDirIfNeeded(block *DirBlock) ([]*DirBlock, *StringOffset)
+
+	// DirHashBuckets returns the number of fixed buckets that a
+	// directory's entries should be sharded into, by name hash, when
+	// it first needs to be split.  If it returns 0, directories are
+	// split into ranges of names instead.
+	DirHashBuckets() int
 }
 
 // KeyServer fetches/writes server-side key halves from/to the key server.
@@ -1882,6 +2200,15 @@ type Observer interface {
 	TlfHandleChange(ctx context.Context, newHandle *TlfHandle)
 }
 
+// SyncObserver is an Observer that also wants to hear when the syncs
+// started by KBFSOps.SyncAllAsync finish.
+type SyncObserver interface {
+	Observer
+	// SyncAllDone announces that the sync identified by `ticket` has
+	// finished, successfully if `err` is nil.
+	SyncAllDone(ctx context.Context, ticket SyncTicket, err error)
+}
+
 // Notifier notifies registrants of directory changes
 type Notifier interface {
 	// RegisterForChanges declares that the given Observer wants to
@@ -2004,9 +2331,11 @@ type Config interface {
 	logMaker
 	blockCacher
 	blockServerGetter
+	publicBlockFetcherGetter
 	codecGetter
 	cryptoPureGetter
 	keyGetterGetter
+	mdVerifierGetter
 	cryptoGetter
 	chatGetter
 	signerGetter
@@ -2017,6 +2346,9 @@ type Config interface {
 	diskLimiterGetter
 	syncedTlfGetterSetter
 	initModeGetter
+	idleTrackerGetter
+	powerMonitorGetter
+	prefetchBudgetGetter
 	Tracer
 	KBFSOps() KBFSOps
 	SetKBFSOps(KBFSOps)
@@ -2047,12 +2379,23 @@ type Config interface {
 	MDServer() MDServer
 	SetMDServer(MDServer)
 	SetBlockServer(BlockServer)
+	// SetPublicBlockFetcher sets an alternate source for the blocks
+	// of public TLFs, tried before the block server.  If nil, public
+	// blocks come only from the block server.
+	SetPublicBlockFetcher(BlockFetcher)
 	KeyServer() KeyServer
 	SetKeyServer(KeyServer)
 	KeybaseService() KeybaseService
 	SetKeybaseService(KeybaseService)
 	BlockSplitter() BlockSplitter
 	SetBlockSplitter(BlockSplitter)
+	// TlfBlockSplitter returns the block splitter for the data of
+	// the given TLF, which is `BlockSplitter()` unless the TLF has
+	// its own.
+	TlfBlockSplitter(tlfID tlf.ID) BlockSplitter
+	// SetTlfBlockSplitter gives the given TLF its own block
+	// splitter, or reverts it to the default one if `b` is nil.
+	SetTlfBlockSplitter(tlfID tlf.ID, b BlockSplitter)
 	Notifier() Notifier
 	SetNotifier(Notifier)
 	SetClock(Clock)
@@ -2075,6 +2418,38 @@ type Config interface {
 	// MaxDirBytes indicates the maximum supported plaintext size of a
 	// directory in bytes.
 	MaxDirBytes() uint64
+	// MaxFileBytes indicates the maximum supported plaintext size of
+	// a file in the given TLF, in bytes.  Unless overridden, it is
+	// the largest size the current data version can address.
+	MaxFileBytes(tlfID tlf.ID) uint64
+	// SetMaxFileBytes overrides the maximum supported plaintext size
+	// of a file in the given TLF.  Zero restores the data version's
+	// own limit.  If `tlfID` is `tlf.NullID`, it sets the default
+	// for all TLFs without their own setting.
+	SetMaxFileBytes(tlfID tlf.ID, maxBytes uint64)
+	// MaxDirEntries indicates the maximum number of entries allowed
+	// in a single directory of the given TLF.  Zero means there is
+	// no limit beyond MaxDirBytes.
+	MaxDirEntries(tlfID tlf.ID) int
+	// SetMaxDirEntries sets the maximum number of entries allowed in
+	// a single directory of the given TLF.  If `tlfID` is
+	// `tlf.NullID`, it sets the default for all TLFs without their
+	// own setting.
+	SetMaxDirEntries(tlfID tlf.ID, maxEntries int)
+	// MaxSymlinkDepth indicates the maximum number of symlinks that
+	// may be followed while resolving a single path.
+	MaxSymlinkDepth() int
+	// SetMaxSymlinkDepth sets the maximum number of symlinks that may
+	// be followed while resolving a single path.
+	SetMaxSymlinkDepth(depth int)
+	// CRBlockBudget is the most bytes of readied blocks that
+	// conflict resolution keeps in memory; the rest are spilled to
+	// the disk block cache until they can be put.  Zero means there
+	// is no limit.
+	CRBlockBudget() int64
+	// SetCRBlockBudget sets the most bytes of readied blocks that
+	// conflict resolution keeps in memory.
+	SetCRBlockBudget(budget int64)
 	// DoBackgroundFlushes says whether we should periodically try to
 	// flush dirty files, even without a sync from the user.  Should
 	// be true except for during some testing.
@@ -2116,6 +2491,23 @@ type Config interface {
 	// objects, which is to use the default registry.
 	MetricsRegistry() metrics.Registry
 	SetMetricsRegistry(metrics.Registry)
+	// MetricsSink is where KBFS records its metrics.  If none has
+	// been set, it's backed by MetricsRegistry, and may be nil in
+	// the same way.
+	MetricsSink() MetricsSink
+	SetMetricsSink(MetricsSink)
+
+	// BlockTrafficLog returns the log of the block traffic between
+	// this device and the block server.
+	BlockTrafficLog() *BlockTrafficLog
+
+	// ReadNotifications returns the filter that decides which read
+	// notifications are sent to the Reporter.
+	ReadNotifications() *ReadNotificationFilter
+
+	// SyncOutbox returns the outbox holding the contents of files
+	// that couldn't be synced.
+	SyncOutbox() *SyncOutbox
 
 	// SetTraceOptions set the options for tracing (via x/net/trace).
 	SetTraceOptions(enabled bool)
@@ -2132,12 +2524,69 @@ type Config interface {
 	// background flushes.
 	SetBGFlushDirOpBatchSize(s int)
 
+	// NewFileExecMode returns how the exec bit is chosen for new
+	// files in the given TLF.
+	NewFileExecMode(tlfID tlf.ID) NewFileExecMode
+	// SetNewFileExecMode sets how the exec bit is chosen for new
+	// files in the given TLF.  If `tlfID` is `tlf.NullID`, it sets
+	// the default for all TLFs without their own setting.
+	SetNewFileExecMode(tlfID tlf.ID, mode NewFileExecMode)
+	// OrderedWrites returns whether every sync of the given TLF
+	// commits all of its pending changes together, in a single
+	// revision, so no change becomes visible before an earlier one.
+	OrderedWrites(tlfID tlf.ID) bool
+	// SetOrderedWrites sets whether every sync of the given TLF
+	// commits all of its pending changes together, in a single
+	// revision.  If `tlfID` is `tlf.NullID`, it sets the default for
+	// all TLFs without their own setting.
+	SetOrderedWrites(tlfID tlf.ID, ordered bool)
+	// AdaptiveBlockSizes returns whether files in the given TLF get
+	// their block size chosen based on how they're written.
+	AdaptiveBlockSizes(tlfID tlf.ID) bool
+	// SetAdaptiveBlockSizes sets whether files in the given TLF get
+	// their block size chosen based on how they're written.  If
+	// `tlfID` is `tlf.NullID`, it sets the default for all TLFs
+	// without their own setting.
+	SetAdaptiveBlockSizes(tlfID tlf.ID, adaptive bool)
+	// BlockLockProfiler returns the profiler shared by the block
+	// locks of all TLFs, which can be enabled to diagnose lock
+	// contention.
+	BlockLockProfiler() *LockProfiler
+	// EarlyBlockUploadEnabled returns whether complete blocks of
+	// files under a sequential write should be readied and put to
+	// the server before the file is synced.
+	EarlyBlockUploadEnabled() bool
+	// SetEarlyBlockUploadEnabled sets whether complete blocks of
+	// files under a sequential write should be readied and put to
+	// the server before the file is synced.
+	SetEarlyBlockUploadEnabled(enabled bool)
+	// FsyncMode returns when an fsync of a file through a mount
+	// returns: once the data is in the journal, or once it's on the
+	// servers.
+	FsyncMode() FsyncMode
+	// SetFsyncMode sets when an fsync of a file through a mount
+	// returns.
+	SetFsyncMode(mode FsyncMode)
+	// TimestampMode returns how strictly file and directory times
+	// follow POSIX.
+	TimestampMode() TimestampMode
+	// SetTimestampMode sets how strictly file and directory times
+	// follow POSIX.
+	SetTimestampMode(mode TimestampMode)
+
 	// BGFlushPeriod returns how long to wait for a batch to fill up
 	// before syncing a set of changes to the servers.
 	BGFlushPeriod() time.Duration
 	// SetBGFlushPeriod sets how long to wait for a batch to fill up
 	// before syncing a set of changes to the servers.
 	SetBGFlushPeriod(p time.Duration)
+	// DirtyFileMaxAge returns how long a file may stay dirty before
+	// the background flusher syncs it, regardless of how much dirty
+	// data there is.  A zero duration means there is no limit.
+	DirtyFileMaxAge() time.Duration
+	// SetDirtyFileMaxAge sets how long a file may stay dirty before
+	// the background flusher syncs it.
+	SetDirtyFileMaxAge(age time.Duration)
 
 	// Shutdown is called to free config resources.
 	Shutdown(context.Context) error
@@ -2204,6 +2653,12 @@ type NodeCache interface {
 	// UpdateUnlinkedDirEntry modifies a cached directory entry for a
 	// node that has already been unlinked.
 	UpdateUnlinkedDirEntry(node Node, newDe DirEntry)
+	// SetAtime records the last access time of a node.  It's kept
+	// only in memory, for as long as the node is.
+	SetAtime(node Node, atime time.Time)
+	// Atime returns the last access time recorded for a node, or
+	// the zero time if there is none.
+	Atime(node Node) time.Time
 	// PathFromNode creates the path up to a given Node.
 	PathFromNode(node Node) path
 	// AllNodes returns the complete set of nodes currently in the cache.
@@ -2211,6 +2666,15 @@ type NodeCache interface {
 	// AddRootWrapper adds a new wrapper function that will be applied
 	// whenever a root Node is created.
 	AddRootWrapper(func(Node) Node)
+	// IsInUse returns whether any Node other than `node` is still
+	// held for the same reference, i.e. whether some handle to it
+	// may still be open.
+	IsInUse(node Node) bool
+	// SetUnlinkedForgetHandler sets a function that is called with
+	// the cached path of an unlinked node, once the last Node for it
+	// has been garbage-collected.  It is called without any locks
+	// held, from the finalizer goroutine, so it must not block.
+	SetUnlinkedForgetHandler(func(path))
 }
 
 // fileBlockDeepCopier fetches a file block, makes a deep copy of it
@@ -16,13 +16,24 @@ var _ BlockCache = journalBlockCache{}
 // CheckForKnownPtr implements BlockCache.
 func (j journalBlockCache) CheckForKnownPtr(
 	tlfID tlf.ID, block *FileBlock) (BlockPointer, error) {
-	_, ok := j.jServer.getTLFJournal(tlfID, nil)
+	tlfJournal, ok := j.jServer.getTLFJournal(tlfID, nil)
 	if !ok {
 		return j.BlockCache.CheckForKnownPtr(tlfID, block)
 	}
 
-	// Temporarily disable de-duping for the journal server until
-	// KBFS-1149 is fixed. (See also
-	// journalBlockServer.AddReference.)
-	return BlockPointer{}, nil
+	// Temporarily disable de-duping against blocks in the journal
+	// until KBFS-1149 is fixed, but allow it against blocks that
+	// have already been flushed to the server.  (See also
+	// journalBlockServer.AddBlockReference.)
+	ptr, err := j.BlockCache.CheckForKnownPtr(tlfID, block)
+	if err != nil || !ptr.IsInitialized() {
+		return BlockPointer{}, err
+	}
+	flushed, err := tlfJournal.wasBlockFlushed(ptr.ID)
+	if err != nil || !flushed {
+		// On error (e.g., if the journal is disabled), just don't
+		// dedup.
+		return BlockPointer{}, nil
+	}
+	return ptr, nil
 }
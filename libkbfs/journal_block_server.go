@@ -19,6 +19,8 @@ type journalBlockServer struct {
 }
 
 var _ BlockServer = journalBlockServer{}
+var _ blockServerTiered = journalBlockServer{}
+var _ blockExistenceChecker = journalBlockServer{}
 
 func (j journalBlockServer) getBlockFromJournal(
 	tlfID tlf.ID, id kbfsblock.ID) (
@@ -102,6 +104,8 @@ func (j journalBlockServer) Put(
 		err := tlfJournal.putBlockData(ctx, id, context, buf, serverHalf)
 		switch e := errors.Cause(err).(type) {
 		case nil:
+			j.jServer.config.BlockTrafficLog().recordJournaled(
+				ctx, tlfID, len(buf))
 			usedQuotaBytes, quotaBytes := tlfJournal.getQuotaInfo()
 			return j.jServer.maybeReturnOverQuotaError(
 				usedQuotaBytes, quotaBytes)
@@ -132,7 +136,24 @@ func (j journalBlockServer) AddBlockReference(
 			// journalBlockCache.CheckForBlockPtr, since
 			// CheckForBlockPtr may be called before journaling is
 			// turned on for a TLF.
-			return kbfsblock.ServerErrorBlockNonExistent{}
+			//
+			// A block that isn't waiting in the journal has been
+			// flushed already, or never went through the journal at
+			// all, so it can only take a reference on the server.
+			unflushed, err := tlfJournal.isBlockUnflushed(id)
+			switch errors.Cause(err).(type) {
+			case nil:
+				if unflushed {
+					return kbfsblock.ServerErrorBlockNonExistent{}
+				}
+				return j.addFlushedBlockReference(
+					ctx, tlfJournal, tlfID, id, context)
+			case errTLFJournalDisabled:
+				return j.BlockServer.AddBlockReference(
+					ctx, tlfID, id, context)
+			default:
+				return translateToBlockServerError(err)
+			}
 		}
 
 		defer func() {
@@ -152,6 +173,44 @@ func (j journalBlockServer) AddBlockReference(
 	return j.BlockServer.AddBlockReference(ctx, tlfID, id, context)
 }
 
+// addFlushedBlockReference adds a reference to a block that's
+// already on the server, rather than waiting in `tlfJournal`.  The
+// reference goes straight to the server, so that if the block isn't
+// there after all, or has been archived since, it fails right away
+// and the caller can put a fresh copy instead.  It's then
+// recorded in the journal, so that it's removed from the server again
+// if the revision that uses it is dropped.
+func (j journalBlockServer) addFlushedBlockReference(
+	ctx context.Context, tlfJournal *tlfJournal, tlfID tlf.ID,
+	id kbfsblock.ID, context kbfsblock.Context) error {
+	err := j.BlockServer.AddBlockReference(ctx, tlfID, id, context)
+	if err != nil {
+		// The filter may have been wrong, or the server may be
+		// unreachable; either way, the caller can recover by
+		// putting a fresh copy of the block to the journal.
+		j.jServer.log.CDebugf(ctx, "Couldn't add a reference to "+
+			"flushed block %s: %+v", id, err)
+		return kbfsblock.ServerErrorBlockNonExistent{}
+	}
+
+	err = tlfJournal.addFlushedBlockReference(ctx, id, context)
+	switch errors.Cause(err).(type) {
+	case nil:
+		return nil
+	case errTLFJournalDisabled:
+		// Without the journal, the reference belongs on the server.
+		return nil
+	default:
+		contexts := kbfsblock.ContextMap{id: {context}}
+		if _, rmErr := j.BlockServer.RemoveBlockReferences(
+			ctx, tlfID, contexts); rmErr != nil {
+			j.jServer.log.CDebugf(ctx, "Couldn't remove the reference "+
+				"to flushed block %s: %+v", id, rmErr)
+		}
+		return translateToBlockServerError(err)
+	}
+}
+
 func (j journalBlockServer) RemoveBlockReferences(
 	ctx context.Context, tlfID tlf.ID,
 	contexts kbfsblock.ContextMap) (
@@ -185,6 +244,39 @@ func (j journalBlockServer) ArchiveBlockReferences(
 	return j.BlockServer.ArchiveBlockReferences(ctx, tlfID, contexts)
 }
 
+// SetBlockTiers implements the blockServerTiered interface for
+// journalBlockServer.
+func (j journalBlockServer) SetBlockTiers(ctx context.Context,
+	tlfID tlf.ID, ids []kbfsblock.ID, tier BlockTier) error {
+	// Like archives, tier changes go straight to the server, since
+	// they're only ever made for blocks flushed long ago.
+	if tiered, ok := j.BlockServer.(blockServerTiered); ok {
+		return tiered.SetBlockTiers(ctx, tlfID, ids, tier)
+	}
+	return nil
+}
+
+// getExistingBlocks implements the blockExistenceChecker interface
+// for journalBlockServer.  Only blocks in the journal count; without
+// a journal for `tlfID`, it reports none.
+func (j journalBlockServer) getExistingBlocks(ctx context.Context,
+	tlfID tlf.ID, contexts kbfsblock.ContextMap) (
+	existing map[kbfsblock.ID]bool, err error) {
+	j.jServer.log.LazyTrace(ctx, "jBServer: getExistingBlocks %d", len(contexts))
+	defer func() {
+		j.jServer.deferLog.LazyTrace(ctx, "jBServer: getExistingBlocks %d done (err=%v)", len(contexts), err)
+	}()
+
+	tlfJournal, ok := j.jServer.getTLFJournal(tlfID, nil)
+	if !ok {
+		return nil, nil
+	}
+	defer func() {
+		err = translateToBlockServerError(err)
+	}()
+	return tlfJournal.getExistingBlocks(contexts)
+}
+
 func (j journalBlockServer) IsUnflushed(ctx context.Context, tlfID tlf.ID,
 	id kbfsblock.ID) (isLocal bool, err error) {
 	j.jServer.log.LazyTrace(ctx, "jBServer: IsUnflushed %s", id)
@@ -7,11 +7,13 @@ package libkbfs
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/kbfs/ioutil"
 	"github.com/keybase/kbfs/kbfsblock"
 	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/kbfsmd"
 	"github.com/keybase/kbfs/tlf"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -130,3 +132,130 @@ func TestJournalBlockServerPutGetAddReference(t *testing.T) {
 	require.Equal(t, data, buf)
 	require.Equal(t, serverHalf, key)
 }
+
+func TestJournalBlockServerAddReferenceToFlushedBlock(t *testing.T) {
+	tempdir, ctx, cancel, config, jServer := setupJournalBlockServerTest(t)
+	defer teardownJournalBlockServerTest(t, tempdir, ctx, cancel, config)
+
+	tlfID := tlf.FakeID(2, tlf.Private)
+	err := jServer.Enable(ctx, tlfID, nil, TLFJournalBackgroundWorkPaused)
+	require.NoError(t, err)
+
+	// Leave references to blocks in the journal disabled.
+	blockServer := jServer.blockServer()
+	require.False(t, blockServer.enableAddBlockReference)
+
+	uid1 := keybase1.MakeTestUID(1)
+	bCtx := kbfsblock.MakeFirstContext(
+		uid1.AsUserOrTeam(), keybase1.BlockType_DATA)
+	data := []byte{1, 2, 3, 4}
+	bID, err := kbfsblock.MakePermanentID(data)
+	require.NoError(t, err)
+	serverHalf, err := kbfscrypto.MakeRandomBlockCryptKeyServerHalf()
+	require.NoError(t, err)
+	err = blockServer.Put(ctx, tlfID, bID, bCtx, data, serverHalf)
+	require.NoError(t, err)
+
+	uid2 := keybase1.MakeTestUID(2)
+	nonce, err := kbfsblock.MakeRefNonce()
+	require.NoError(t, err)
+	bCtx2 := kbfsblock.MakeContext(
+		uid1.AsUserOrTeam(), uid2.AsUserOrTeam(), nonce,
+		keybase1.BlockType_DATA)
+
+	t.Log("A block still in the journal can't get new references")
+	err = blockServer.AddBlockReference(ctx, tlfID, bID, bCtx2)
+	require.IsType(t, kbfsblock.ServerErrorBlockNonExistent{}, err)
+
+	t.Log("Once it's flushed, new references go straight to the server")
+	err = jServer.Flush(ctx, tlfID)
+	require.NoError(t, err)
+	err = blockServer.AddBlockReference(ctx, tlfID, bID, bCtx2)
+	require.NoError(t, err)
+	buf, key, err := jServer.delegateBlockServer.Get(ctx, tlfID, bID, bCtx2)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+	require.Equal(t, serverHalf, key)
+	err = jServer.Flush(ctx, tlfID)
+	require.NoError(t, err)
+
+	t.Log("A reference is taken back if its revision is dropped")
+	nonce3, err := kbfsblock.MakeRefNonce()
+	require.NoError(t, err)
+	bCtx3 := kbfsblock.MakeContext(
+		uid1.AsUserOrTeam(), uid2.AsUserOrTeam(), nonce3,
+		keybase1.BlockType_DATA)
+	err = blockServer.AddBlockReference(ctx, tlfID, bID, bCtx3)
+	require.NoError(t, err)
+	tlfJournal, ok := jServer.getTLFJournal(tlfID, nil)
+	require.True(t, ok)
+	_, err = tlfJournal.blockJournal.ignoreBlocksAndMDRevMarkers(
+		ctx, []kbfsblock.ID{bID}, kbfsmd.RevisionInitial)
+	require.NoError(t, err)
+	err = jServer.Flush(ctx, tlfID)
+	require.NoError(t, err)
+	_, _, err = jServer.delegateBlockServer.Get(ctx, tlfID, bID, bCtx3)
+	require.Error(t, err)
+	_, _, err = jServer.delegateBlockServer.Get(ctx, tlfID, bID, bCtx2)
+	require.NoError(t, err)
+
+	t.Log("So can a block that never went through the journal")
+	data2 := []byte{5, 6, 7, 8}
+	bID2, err := kbfsblock.MakePermanentID(data2)
+	require.NoError(t, err)
+	err = jServer.delegateBlockServer.Put(
+		ctx, tlfID, bID2, bCtx, data2, serverHalf)
+	require.NoError(t, err)
+	err = blockServer.AddBlockReference(ctx, tlfID, bID2, bCtx2)
+	require.NoError(t, err)
+	_, _, err = jServer.delegateBlockServer.Get(ctx, tlfID, bID2, bCtx2)
+	require.NoError(t, err)
+
+	t.Log("A block archived since it was flushed can't get new references")
+	err = jServer.delegateBlockServer.ArchiveBlockReferences(ctx, tlfID,
+		kbfsblock.ContextMap{bID: {bCtx, bCtx2}})
+	require.NoError(t, err)
+	err = blockServer.AddBlockReference(ctx, tlfID, bID, bCtx3)
+	require.IsType(t, kbfsblock.ServerErrorBlockNonExistent{}, err)
+}
+
+func TestJournalBlockServerTrafficLog(t *testing.T) {
+	tempdir, ctx, cancel, config, jServer := setupJournalBlockServerTest(t)
+	defer teardownJournalBlockServerTest(t, tempdir, ctx, cancel, config)
+
+	trafficLog := config.BlockTrafficLog()
+	jServer.delegateBlockServer = NewBlockServerTrafficLogged(
+		jServer.delegateBlockServer, trafficLog)
+	tlfID := tlf.FakeID(2, tlf.Private)
+	err := jServer.Enable(ctx, tlfID, nil, TLFJournalBackgroundWorkPaused)
+	require.NoError(t, err)
+
+	t.Log("A journaled put is counted against its path")
+	uid1 := keybase1.MakeTestUID(1)
+	bCtx := kbfsblock.MakeFirstContext(
+		uid1.AsUserOrTeam(), keybase1.BlockType_DATA)
+	data := []byte{1, 2, 3, 4}
+	bID, err := kbfsblock.MakePermanentID(data)
+	require.NoError(t, err)
+	serverHalf, err := kbfscrypto.MakeRandomBlockCryptKeyServerHalf()
+	require.NoError(t, err)
+	err = config.BlockServer().Put(ctxWithBlockTrafficPath(ctx, "a/b"),
+		tlfID, bID, bCtx, data, serverHalf)
+	require.NoError(t, err)
+	since := config.Clock().Now()
+	expected := []BlockTrafficSummary{{
+		Day:   time.Unix(blockTrafficDay(since), 0).UTC(),
+		TlfID: tlfID,
+		Path:  "a/b",
+		BlockTrafficStats: BlockTrafficStats{
+			BlocksUploaded: 1,
+			BytesUploaded:  int64(len(data)),
+		},
+	}}
+	require.Equal(t, expected, trafficLog.Summarize(since, tlfID, "", 10))
+
+	t.Log("Flushing it doesn't count it again")
+	err = jServer.Flush(ctx, tlfID)
+	require.NoError(t, err)
+	require.Equal(t, expected, trafficLog.Summarize(since, tlfID, "", 10))
+}
@@ -1002,3 +1002,47 @@ func TestJournalQuotaStatusForGitBlocks(t *testing.T) {
 	require.Equal(
 		t, int64(2000), bs.JournalTrackerStatus.QuotaStatus.QuotaBytes)
 }
+
+func TestJournalServerFsyncAll(t *testing.T) {
+	tempdir, ctx, cancel, config, _, jServer := setupJournalServerTest(t)
+	defer teardownJournalServerTest(t, tempdir, ctx, cancel, config)
+	jServer.EnableAuto(ctx)
+	// Syncing needs a cancellation delayer.
+	ctx, err := NewContextWithCancellationDelayer(NewContextReplayable(
+		ctx, func(c context.Context) context.Context { return c }))
+	require.NoError(t, err)
+	defer CleanupCancellationDelayer(ctx)
+
+	rootNode := GetRootNodeOrBust(
+		ctx, t, config, "test_user1", tlf.Private)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	err = jServer.Wait(ctx, fb.Tlf)
+	require.NoError(t, err)
+
+	t.Log("By default, fsync returns once the data is in the journal")
+	require.Equal(t, FsyncJournalDurable, config.FsyncMode())
+	jServer.PauseBackgroundWork(ctx, fb.Tlf)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1}, 0)
+	require.NoError(t, err)
+	err = FsyncAll(ctx, config, fb, config.MakeLogger(""))
+	require.NoError(t, err)
+	status, err := jServer.JournalStatus(fb.Tlf)
+	require.NoError(t, err)
+	require.NotEqual(t, kbfsmd.RevisionUninitialized, status.RevisionEnd)
+
+	t.Log("In server mode, fsync waits for the journal to flush")
+	jServer.ResumeBackgroundWork(ctx, fb.Tlf)
+	config.SetFsyncMode(FsyncServerDurable)
+	err = kbfsOps.Write(ctx, fileNode, []byte{2}, 1)
+	require.NoError(t, err)
+	err = FsyncAll(ctx, config, fb, config.MakeLogger(""))
+	require.NoError(t, err)
+	status, err = jServer.JournalStatus(fb.Tlf)
+	require.NoError(t, err)
+	require.Equal(t, kbfsmd.RevisionUninitialized, status.RevisionEnd)
+}
@@ -48,6 +48,23 @@ func WaitForTLFJournal(ctx context.Context, config Config, tlfID tlf.ID,
 	return nil
 }
 
+// FsyncAll syncs all the dirty data in the given folder branch, for
+// an fsync through a mount.  Depending on config.FsyncMode(), it
+// returns once the data is in the TLF journal, or waits for the
+// journal to flush it to the servers.  If journaling is disabled for
+// the TLF, the sync itself puts the data on the servers.
+func FsyncAll(ctx context.Context, config Config,
+	folderBranch FolderBranch, log logger.Logger) error {
+	err := config.KBFSOps().SyncAll(ctx, folderBranch)
+	if err != nil {
+		return err
+	}
+	if config.FsyncMode() != FsyncServerDurable {
+		return nil
+	}
+	return WaitForTLFJournal(ctx, config, folderBranch.Tlf, log)
+}
+
 // FillInJournalStatusUnflushedPaths adds the unflushed paths to the
 // given journal status.
 func FillInJournalStatusUnflushedPaths(ctx context.Context, config Config,
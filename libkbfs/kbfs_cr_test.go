@@ -1300,7 +1300,7 @@ func TestCRSyncParallelBlocksErrorCleanup(t *testing.T) {
 	// make the unembedded size large, so we don't create thousands of
 	// unembedded block change blocks.
 	blockSize := int64(5)
-	bsplit := &BlockSplitterSimple{blockSize, 2, 100 * 1024, 0}
+	bsplit := &BlockSplitterSimple{blockSize, 2, 100 * 1024, 0, 0}
 	config1.SetBlockSplitter(bsplit)
 
 	// create and write to a file
@@ -1525,6 +1525,229 @@ func TestCRCanceledAfterNewOperation(t *testing.T) {
 	}
 }
 
+// Tests that CR still succeeds when its readied blocks don't fit in
+// the block budget, and get spilled to the disk block cache.
+func TestCRSpillsBlocksOverBudget(t *testing.T) {
+	// simulate two users
+	var userName1, userName2 kbname.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	// The config shuts the cache down.
+	cache, _ := initDiskBlockCacheTest(t)
+	config2.diskBlockCache = cache
+	config2.SetCRBlockBudget(1)
+	bsplitter, err := NewBlockSplitterSimple(20, 8*1024, config2.Codec())
+	require.NoError(t, err)
+	config2.SetBlockSplitter(bsplitter)
+
+	name := userName1.String() + "," + userName2.String()
+
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, tlf.Private)
+	kbfsOps1 := config1.KBFSOps()
+	fb := rootNode1.GetFolderBranch()
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, tlf.Private)
+	kbfsOps2 := config2.KBFSOps()
+
+	t.Log("Make user 2 unmerged")
+	c, err := DisableUpdatesForTesting(config2, fb)
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, fb)
+	require.NoError(t, err)
+
+	_, _, err = kbfsOps1.CreateFile(ctx, rootNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	bNode2, _, err := kbfsOps2.CreateFile(ctx, rootNode2, "b", false, NoExcl)
+	require.NoError(t, err)
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	err = kbfsOps2.Write(ctx, bNode2, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps2.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	t.Log("Resolve with every readied block spilled")
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2, fb)
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServer(ctx, fb, nil)
+	require.NoError(t, err)
+
+	ops2 := getOps(config2, fb.Tlf)
+	require.False(t, ops2.isUnmerged(makeFBOLockState()))
+	head, _ := ops2.getHead(makeFBOLockState())
+	_, _, _, err = cache.Get(
+		ctx, fb.Tlf, head.data.Dir.BlockPointer.ID)
+	require.NoError(t, err)
+
+	t.Log("User 1 sees the resolved file")
+	err = kbfsOps1.SyncFromServer(ctx, fb, nil)
+	require.NoError(t, err)
+	bNode1, _, err := kbfsOps1.Lookup(ctx, rootNode1, "b")
+	require.NoError(t, err)
+	buf := make([]byte, len(data)+1)
+	n, err := kbfsOps1.Read(ctx, bNode1, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, data, buf[:n])
+}
+
+// Tests that writes made while CR is finishing up are handed off to
+// the resolved version of the file, instead of being lost.
+// crHandOffDirtyWritesSetup has user 2 make an unmerged write to
+// file "a", after `conflictFn` has user 1 make a merged change, and
+// then stalls CR right before it finishes, to write some more to
+// "a".  It returns the data written by user 2.
+func crHandOffDirtyWritesSetup(
+	ctx context.Context, t *testing.T, config1, config2 Config, name string,
+	conflictFn func(rootNode, aNode1 Node)) (
+	rootNode, aNode2 Node, expected []byte) {
+	// create and write to a file
+	rootNode = GetRootNodeOrBust(ctx, t, config1, name, tlf.Private)
+	kbfsOps1 := config1.KBFSOps()
+	aNode1, _, err := kbfsOps1.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps1.Write(ctx, aNode1, []byte{1, 2, 3, 4, 5}, 0)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, aNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	// look it up on user2
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, tlf.Private)
+	fb := rootNode2.GetFolderBranch()
+	kbfsOps2 := config2.KBFSOps()
+	aNode2, _, err = kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	// disable updates and CR on user 2
+	c, err := DisableUpdatesForTesting(config2, fb)
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, fb)
+	require.NoError(t, err)
+
+	conflictFn(rootNode, aNode1)
+
+	// User 2 writes to the file, making the branch unmerged.
+	data2 := []byte{5, 4, 3, 2, 1}
+	err = kbfsOps2.Write(ctx, aNode2, data2, 0)
+	require.NoError(t, err)
+	err = kbfsOps2.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	// Stall CR right before it finishes, and write some more.
+	onPutStalledCh, putUnstallCh, putCtx :=
+		StallMDOp(context.Background(), config2, StallableMDResolveBranch, 1)
+	c <- struct{}{}
+	err = RestartCRForTesting(putCtx, config2, fb)
+	require.NoError(t, err)
+	<-onPutStalledCh
+	moreData := []byte{6, 7}
+	err = kbfsOps2.Write(ctx, aNode2, moreData, int64(len(data2)))
+	require.NoError(t, err)
+	close(putUnstallCh)
+	err = getOps(config2, fb.Tlf).cr.Wait(ctx)
+	require.NoError(t, err)
+	require.False(t, getOps(config2, fb.Tlf).isUnmerged(makeFBOLockState()))
+
+	return rootNode, aNode2, append(append([]byte{}, data2...), moreData...)
+}
+
+func TestCRHandsOffDirtyWrites(t *testing.T) {
+	// simulate two users
+	var userName1, userName2 kbname.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+	config1.MDServer().DisableRekeyUpdatesForTesting()
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	_, err := config2.KBPKI().GetCurrentSession(context.Background())
+	require.NoError(t, err)
+	config2.MDServer().DisableRekeyUpdatesForTesting()
+	name := userName1.String() + "," + userName2.String()
+
+	t.Log("User 1 makes a non-conflicting change to another file")
+	kbfsOps1 := config1.KBFSOps()
+	rootNode, aNode2, expected := crHandOffDirtyWritesSetup(
+		ctx, t, config1, config2, name, func(rootNode, _ Node) {
+			_, _, err := kbfsOps1.CreateFile(
+				ctx, rootNode, "b", false, NoExcl)
+			require.NoError(t, err)
+			err = kbfsOps1.SyncAll(ctx, rootNode.GetFolderBranch())
+			require.NoError(t, err)
+		})
+
+	t.Log("The unsynced write survived the resolution")
+	kbfsOps2 := config2.KBFSOps()
+	buf := make([]byte, len(expected)+1)
+	n, err := kbfsOps2.Read(ctx, aNode2, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, expected, buf[:n])
+	require.Empty(t, config2.SyncOutbox().List())
+
+	t.Log("And it syncs")
+	err = kbfsOps2.SyncAll(ctx, aNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps1.SyncFromServer(ctx, rootNode.GetFolderBranch(), nil)
+	require.NoError(t, err)
+	aNode1, _, err := kbfsOps1.Lookup(ctx, rootNode, "a")
+	require.NoError(t, err)
+	n, err = kbfsOps1.Read(ctx, aNode1, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, expected, buf[:n])
+}
+
+func TestCRMovesConflictedDirtyWritesToOutbox(t *testing.T) {
+	// simulate two users
+	var userName1, userName2 kbname.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+	config1.MDServer().DisableRekeyUpdatesForTesting()
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	_, err := config2.KBPKI().GetCurrentSession(context.Background())
+	require.NoError(t, err)
+	config2.MDServer().DisableRekeyUpdatesForTesting()
+	name := userName1.String() + "," + userName2.String()
+
+	t.Log("User 1 truncates the same file, creating a conflict")
+	kbfsOps1 := config1.KBFSOps()
+	_, aNode2, expected := crHandOffDirtyWritesSetup(
+		ctx, t, config1, config2, name, func(_, aNode1 Node) {
+			err := kbfsOps1.Truncate(ctx, aNode1, 0)
+			require.NoError(t, err)
+			err = kbfsOps1.SyncAll(ctx, aNode1.GetFolderBranch())
+			require.NoError(t, err)
+		})
+
+	t.Log("The node now refers to the merged file, so the unsynced " +
+		"write went to the sync outbox instead")
+	kbfsOps2 := config2.KBFSOps()
+	buf := make([]byte, len(expected)+1)
+	n, err := kbfsOps2.Read(ctx, aNode2, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte{}, buf[:n])
+	entries := config2.SyncOutbox().List()
+	require.Len(t, entries, 1)
+	require.Equal(t, "a", entries[0].Path)
+	require.Equal(t, int64(len(expected)), entries[0].Size)
+	require.NotNil(t, entries[0].Op)
+
+	t.Log("Nothing is left dirty")
+	err = kbfsOps2.SyncAll(ctx, aNode2.GetFolderBranch())
+	require.NoError(t, err)
+	status, _, err := kbfsOps2.FolderStatus(ctx, aNode2.GetFolderBranch())
+	require.NoError(t, err)
+	require.Empty(t, status.DirtyPaths)
+}
+
 // Tests that if a user gets /too/ unmerged, they will have their
 // unmerged writes blocked.
 func TestBasicCRBlockUnmergedWrites(t *testing.T) {
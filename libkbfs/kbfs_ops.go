@@ -6,7 +6,11 @@ package libkbfs
 
 import (
 	"fmt"
+	"io"
+	pathpkg "path"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/keybase/client/go/logger"
@@ -22,10 +26,18 @@ import (
 	"golang.org/x/net/context"
 )
 
+// maxParallelTlfConfigs is the maximum number of TLFs that
+// ConfigureTlfs configures at once.
+const maxParallelTlfConfigs = 10
+
 // KBFSOpsStandard implements the KBFSOps interface, and is go-routine
 // safe by forwarding requests to individual per-folder-branch
 // handlers that are go-routine-safe.
 type KBFSOpsStandard struct {
+	// useCounter is incremented on every folder access, and must be
+	// the first field for 64-bit atomic alignment.
+	useCounter uint64
+
 	appStateUpdater env.AppStateUpdater
 	config          Config
 	log             logger.Logger
@@ -53,6 +65,27 @@ type KBFSOpsStandard struct {
 
 var _ KBFSOps = (*KBFSOpsStandard)(nil)
 
+// kbfsOpsWrapper is implemented by the KBFSOps implementations that
+// wrap another one, like OpLogRecorder.
+type kbfsOpsWrapper interface {
+	wrappedKBFSOps() KBFSOps
+}
+
+// standardKBFSOps returns the KBFSOpsStandard under any wrappers of
+// `ops`, if there is one.
+func standardKBFSOps(ops KBFSOps) (*KBFSOpsStandard, bool) {
+	for {
+		switch o := ops.(type) {
+		case *KBFSOpsStandard:
+			return o, true
+		case kbfsOpsWrapper:
+			ops = o.wrappedKBFSOps()
+		default:
+			return nil, false
+		}
+	}
+}
+
 const longOperationDebugDumpDuration = time.Minute
 
 // NewKBFSOpsStandard constructs a new KBFSOpsStandard object.
@@ -313,6 +346,152 @@ func (fs *KBFSOpsStandard) DeleteFavorite(ctx context.Context,
 	return nil
 }
 
+// configureTlf applies the sync policy and block size of `req` to
+// the TLF that it names.
+func (fs *KBFSOpsStandard) configureTlf(
+	ctx context.Context, req TlfConfigRequest) error {
+	var full, metadata bool
+	switch req.SyncPolicy {
+	case TlfSyncPolicyUnchanged, TlfSyncPolicyNone:
+	case TlfSyncPolicyMetadata:
+		metadata = true
+	case TlfSyncPolicyFull:
+		full = true
+	default:
+		return errors.Errorf("Unknown sync policy %d", req.SyncPolicy)
+	}
+	if req.SyncPolicy == TlfSyncPolicyUnchanged && req.MaxBlockSize == 0 {
+		return nil
+	}
+
+	fav := req.Favorite
+	if req.MaxBlockSize == 0 {
+		// The sync policy only needs the TLF ID, so skip resolving
+		// the handle and fetching the MD of TLFs that are already
+		// open.
+		if ops := fs.getOpsByFav(fav); ops != nil {
+			return fs.setTlfSyncPolicy(ops.id(), full, metadata)
+		}
+	}
+
+	h, err := GetHandleFromFolderNameAndType(
+		ctx, fs.config.KBPKI(), fs.config.MDOps(), fav.Name, fav.Type)
+	if err != nil {
+		return err
+	}
+	if req.MaxBlockSize == 0 && h.TlfID() != tlf.NullID {
+		return fs.setTlfSyncPolicy(h.TlfID(), full, metadata)
+	}
+	rmd, err := fs.getMDByHandle(ctx, h, FavoritesOpNoChange)
+	if err != nil {
+		return err
+	}
+	if rmd == (ImmutableRootMetadata{}) {
+		return errors.Errorf("%s doesn't exist", h.GetCanonicalPath())
+	}
+
+	if req.MaxBlockSize != 0 {
+		size := req.MaxBlockSize
+		if size < 0 {
+			size = 0
+		}
+		fb := FolderBranch{Tlf: rmd.TlfID(), Branch: MasterBranch}
+		ops := fs.getOpsByHandle(ctx, h, fb, FavoritesOpNoChange)
+		err = ops.SetTlfBlockSize(ctx, fb, size)
+		if err != nil {
+			return err
+		}
+	}
+
+	if req.SyncPolicy == TlfSyncPolicyUnchanged {
+		return nil
+	}
+	return fs.setTlfSyncPolicy(rmd.TlfID(), full, metadata)
+}
+
+func (fs *KBFSOpsStandard) setTlfSyncPolicy(
+	tlfID tlf.ID, full, metadata bool) error {
+	err := fs.config.SetTlfSyncState(tlfID, full)
+	if err != nil {
+		return err
+	}
+	return fs.config.SetTlfMetadataSyncState(tlfID, metadata)
+}
+
+// ConfigureTlfs implements the KBFSOps interface for KBFSOpsStandard.
+func (fs *KBFSOpsStandard) ConfigureTlfs(
+	ctx context.Context, reqs []TlfConfigRequest) ([]error, error) {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	errs := make([]error, len(reqs))
+	var toAdd []favToAdd
+	var toDel []Favorite
+	// favIndices holds the indices of the requests that change the
+	// favorites list.
+	var favIndices []int
+	for i, req := range reqs {
+		switch req.FavoritesOp {
+		case 0, FavoritesOpNoChange:
+		case FavoritesOpAdd, FavoritesOpAddNewlyCreated:
+			toAdd = append(toAdd, favToAdd{
+				Favorite: req.Favorite,
+				created:  req.FavoritesOp == FavoritesOpAddNewlyCreated,
+			})
+			favIndices = append(favIndices, i)
+		case FavoritesOpRemove:
+			toDel = append(toDel, req.Favorite)
+			favIndices = append(favIndices, i)
+		default:
+			errs[i] = InvalidFavoritesOpError{}
+		}
+	}
+
+	if len(toAdd) > 0 || len(toDel) > 0 {
+		_, err := fs.config.KBPKI().GetCurrentSession(ctx)
+		if err != nil {
+			return nil, err
+		}
+		favErrs, err := fs.favs.Batch(ctx, toAdd, toDel)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range favIndices {
+			errs[i] = favErrs[reqs[i].Favorite]
+		}
+	}
+
+	// Configure the TLFs in parallel, since each one may need its
+	// own handle resolution and MD fetch.
+	indices := make(chan int, len(reqs))
+	for i := range reqs {
+		if errs[i] == nil {
+			indices <- i
+		}
+	}
+	close(indices)
+	numWorkers := len(indices)
+	if numWorkers > maxParallelTlfConfigs {
+		numWorkers = maxParallelTlfConfigs
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < numWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				errs[i] = fs.configureTlf(ctx, reqs[i])
+				if errs[i] != nil {
+					fs.log.CDebugf(ctx, "Couldn't configure %v: %+v",
+						reqs[i].Favorite, errs[i])
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return errs, nil
+}
+
 func (fs *KBFSOpsStandard) getOpsNoAdd(
 	ctx context.Context, fb FolderBranch) *folderBranchOps {
 	if fb == (FolderBranch{}) {
@@ -322,6 +501,7 @@ func (fs *KBFSOpsStandard) getOpsNoAdd(
 	fs.opsLock.RLock()
 	if ops, ok := fs.ops[fb]; ok {
 		fs.opsLock.RUnlock()
+		fs.noteUsed(ops)
 		return ops
 	}
 
@@ -338,9 +518,32 @@ func (fs *KBFSOpsStandard) getOpsNoAdd(
 		ops = newFolderBranchOps(ctx, fs.appStateUpdater, fs.config, fb, bType)
 		fs.ops[fb] = ops
 	}
+	fs.noteUsed(ops)
 	return ops
 }
 
+// noteUsed marks `ops` as the most recently used folder branch.
+func (fs *KBFSOpsStandard) noteUsed(ops *folderBranchOps) {
+	atomic.StoreUint64(&ops.lastUsed, atomic.AddUint64(&fs.useCounter, 1))
+}
+
+// tlfLastUsed returns a number that is higher the more recently any
+// branch of the given TLF was used, or 0 if it hasn't been used
+// since this process started.
+func (fs *KBFSOpsStandard) tlfLastUsed(id tlf.ID) (lastUsed uint64) {
+	fs.opsLock.RLock()
+	defer fs.opsLock.RUnlock()
+	for fb, ops := range fs.ops {
+		if fb.Tlf != id {
+			continue
+		}
+		if used := atomic.LoadUint64(&ops.lastUsed); used > lastUsed {
+			lastUsed = used
+		}
+	}
+	return lastUsed
+}
+
 func (fs *KBFSOpsStandard) getOpsIfExists(
 	ctx context.Context, fb FolderBranch) *folderBranchOps {
 	if fb == (FolderBranch{}) {
@@ -365,9 +568,37 @@ func (fs *KBFSOpsStandard) getOps(ctx context.Context,
 
 func (fs *KBFSOpsStandard) getOpsByNode(ctx context.Context,
 	node Node) *folderBranchOps {
+	// Operations on nodes come from the user's file system calls,
+	// so they reset the idle timer for background maintenance.
+	// Background work like rekeys, favorites and journal flushes
+	// doesn't go through nodes.
+	if ctx.Value(CtxBackgroundSyncKey) == nil {
+		fs.config.IdleTracker().NoteActivity()
+	}
 	return fs.getOps(ctx, node.GetFolderBranch(), FavoritesOpAdd)
 }
 
+// nodeCacheMemoryUsage returns the estimated memory held by the node
+// caches of all the open TLFs.
+func (fs *KBFSOpsStandard) nodeCacheMemoryUsage() MemoryUsage {
+	fs.opsLock.RLock()
+	defer fs.opsLock.RUnlock()
+	var usage MemoryUsage
+	for fb, ops := range fs.ops {
+		if ncs, ok := ops.nodeCache.(*nodeCacheStandard); ok {
+			usage.add(fb.Tlf, ncs.memoryUsage())
+		}
+	}
+	return usage
+}
+
+// nodePath returns the full path of `node`, starting with the name of
+// its TLF.
+func (fs *KBFSOpsStandard) nodePath(ctx context.Context, node Node) path {
+	ops := fs.getOpsNoAdd(ctx, node.GetFolderBranch())
+	return ops.nodeCache.PathFromNode(node)
+}
+
 func (fs *KBFSOpsStandard) getOpsByHandle(ctx context.Context,
 	handle *TlfHandle, fb FolderBranch, fop FavoritesOp) *folderBranchOps {
 	ops := fs.getOpsNoAdd(ctx, fb)
@@ -663,8 +894,11 @@ func (fs *KBFSOpsStandard) getMaybeCreateRootNode(
 
 	mdops := fs.config.MDOps()
 	var md ImmutableRootMetadata
-	// Check for an unmerged MD first if necessary.
-	if fs.config.Mode().UnmergedTLFsEnabled() {
+	// Check for an unmerged MD first if necessary.  Archived
+	// revisions are always merged, even if this device is currently
+	// on an unmerged branch.
+	_, isRevBranch := branch.RevisionIfSpecified()
+	if fs.config.Mode().UnmergedTLFsEnabled() && !isRevBranch {
 		md, err = mdops.GetUnmergedForTLF(ctx, h.tlfID, kbfsmd.NullBranchID)
 		if err != nil {
 			return nil, EntryInfo{}, err
@@ -770,6 +1004,16 @@ func (fs *KBFSOpsStandard) GetDirChildren(ctx context.Context, dir Node) (
 	return ops.GetDirChildren(ctx, dir)
 }
 
+// WalkTLF implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) WalkTLF(
+	ctx context.Context, dir Node, walkFn WalkTLFFunc) error {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	ops := fs.getOpsByNode(ctx, dir)
+	return ops.WalkTLF(ctx, dir, walkFn)
+}
+
 // Lookup implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) Lookup(ctx context.Context, dir Node, name string) (
 	Node, EntryInfo, error) {
@@ -790,6 +1034,284 @@ func (fs *KBFSOpsStandard) Stat(ctx context.Context, node Node) (
 	return ops.Stat(ctx, node)
 }
 
+// GetAllocatedSize implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetAllocatedSize(ctx context.Context, node Node) (
+	uint64, error) {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	ops := fs.getOpsByNode(ctx, node)
+	return ops.GetAllocatedSize(ctx, node)
+}
+
+// GetFileBlockLayout implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) GetFileBlockLayout(ctx context.Context,
+	file Node) (FileBlockLayout, error) {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.GetFileBlockLayout(ctx, file)
+}
+
+// splitCanonicalPath splits a canonical path like
+// "/keybase/private/alice/dir/file" into its TLF type, TLF name, and
+// the path components within the TLF.
+func splitCanonicalPath(p string) (
+	t tlf.Type, tlfName string, parts []string, err error) {
+	prefix := "/" + string(KeybasePathType) + "/"
+	cleaned := pathpkg.Clean(p)
+	if !strings.HasPrefix(cleaned, prefix) {
+		return tlf.Unknown, "", nil, errors.Errorf(
+			"%q is not a canonical KBFS path", p)
+	}
+	elems := strings.Split(strings.TrimPrefix(cleaned, prefix), "/")
+	if len(elems) < 2 {
+		return tlf.Unknown, "", nil, errors.Errorf(
+			"%q is not within a TLF", p)
+	}
+	switch PathType(elems[0]) {
+	case PrivatePathType:
+		t = tlf.Private
+	case PublicPathType:
+		t = tlf.Public
+	case SingleTeamPathType:
+		t = tlf.SingleTeam
+	default:
+		return tlf.Unknown, "", nil, errors.Errorf(
+			"Bad path type in %q", p)
+	}
+	return t, elems[1], elems[2:], nil
+}
+
+// resolveCanonicalPath looks up the node and entry info for the
+// given canonical path, following any symlinks along the way
+// according to the symlink policy of the config.  If `create` is
+// true, the TLF is created if needed, and a missing final component
+// is returned as a nil node, along with its parent and name, so
+// that the caller can create it.
+func (fs *KBFSOpsStandard) resolveCanonicalPath(
+	ctx context.Context, p string, create bool) (
+	parent Node, name string, node Node, ei EntryInfo, err error) {
+	sr := NewSymlinkResolver(fs.config)
+outer:
+	for {
+		t, tlfName, parts, err := splitCanonicalPath(p)
+		if err != nil {
+			return nil, "", nil, EntryInfo{}, err
+		}
+		h, err := GetHandleFromFolderNameAndType(
+			ctx, fs.config.KBPKI(), fs.config.MDOps(), tlfName, t)
+		if err != nil {
+			return nil, "", nil, EntryInfo{}, err
+		}
+		if create {
+			node, ei, err = fs.GetOrCreateRootNode(ctx, h, MasterBranch)
+		} else {
+			node, ei, err = fs.GetRootNode(ctx, h, MasterBranch)
+		}
+		if err != nil {
+			return nil, "", nil, EntryInfo{}, err
+		}
+		if node == nil {
+			return nil, "", nil, EntryInfo{}, NoSuchNameError{p}
+		}
+
+		parent, name = nil, ""
+		for i, part := range parts {
+			parent, name = node, part
+			node, ei, err = fs.Lookup(ctx, parent, name)
+			if create && i == len(parts)-1 {
+				if _, ok := errors.Cause(err).(NoSuchNameError); ok {
+					return parent, name, nil, EntryInfo{}, nil
+				}
+			}
+			if err != nil {
+				return nil, "", nil, EntryInfo{}, err
+			}
+			if ei.Type != Sym {
+				continue
+			}
+
+			dirPath := buildCanonicalPathForTlfType(
+				t, append([]string{tlfName}, parts[:i]...)...)
+			newPath := ei.SymPath
+			if !pathpkg.IsAbs(newPath) {
+				newPath = pathpkg.Join(dirPath, newPath)
+			}
+			newPath = pathpkg.Join(
+				append([]string{newPath}, parts[i+1:]...)...)
+			err = sr.Follow(pathpkg.Join(dirPath, name), newPath)
+			if err != nil {
+				return nil, "", nil, EntryInfo{}, err
+			}
+			p = newPath
+			continue outer
+		}
+		return parent, name, node, ei, nil
+	}
+}
+
+// ReadFileAt implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) ReadFileAt(ctx context.Context, p string) (
+	[]byte, error) {
+	_, _, node, ei, err := fs.resolveCanonicalPath(ctx, p, false)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, ei.Size)
+	var off int64
+	for off < int64(len(buf)) {
+		n, err := fs.Read(ctx, node, buf[off:], off)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			break
+		}
+		off += n
+	}
+	return buf[:off], nil
+}
+
+// WriteFileAt implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) WriteFileAt(
+	ctx context.Context, p string, data []byte) error {
+	parent, name, node, _, err := fs.resolveCanonicalPath(ctx, p, true)
+	if err != nil {
+		return err
+	}
+
+	if node == nil {
+		node, _, err = fs.CreateFile(ctx, parent, name, false, NoExcl)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = fs.Truncate(ctx, node, 0)
+		if err != nil {
+			return err
+		}
+	}
+	err = fs.Write(ctx, node, data, 0)
+	if err != nil {
+		return err
+	}
+	return fs.SyncAll(ctx, node.GetFolderBranch())
+}
+
+// StatAt implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) StatAt(ctx context.Context, p string) (
+	EntryInfo, error) {
+	_, _, _, ei, err := fs.resolveCanonicalPath(ctx, p, false)
+	return ei, err
+}
+
+// ListAt implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) ListAt(ctx context.Context, p string) (
+	map[string]EntryInfo, error) {
+	_, _, node, _, err := fs.resolveCanonicalPath(ctx, p, false)
+	if err != nil {
+		return nil, err
+	}
+	return fs.GetDirChildren(ctx, node)
+}
+
+// StatMany implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) StatMany(ctx context.Context, paths []string) (
+	map[string]DirEntry, error) {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	isMissing := func(err error) bool {
+		_, ok := errors.Cause(err).(NoSuchNameError)
+		return ok
+	}
+
+	// Group the paths by parent directory, so each directory is
+	// resolved once and read in a single pass.
+	type nameAndPath struct {
+		name, p string
+	}
+	byDir := make(map[string][]nameAndPath)
+	entries := make(map[string]DirEntry, len(paths))
+	for _, p := range paths {
+		_, _, parts, err := splitCanonicalPath(p)
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) > 0 {
+			cleaned := pathpkg.Clean(p)
+			dir := pathpkg.Dir(cleaned)
+			byDir[dir] = append(
+				byDir[dir], nameAndPath{pathpkg.Base(cleaned), p})
+			continue
+		}
+
+		// TLF roots have no parent directory to read.
+		_, _, node, _, err := fs.resolveCanonicalPath(ctx, p, false)
+		if isMissing(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		de, err := fs.getOpsByNode(ctx, node).statEntry(ctx, node)
+		if err != nil {
+			return nil, err
+		}
+		entries[p] = de
+	}
+
+	for dir, nps := range byDir {
+		_, _, node, ei, err := fs.resolveCanonicalPath(ctx, dir, false)
+		if isMissing(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if ei.Type != Dir {
+			continue
+		}
+
+		names := make([]string, len(nps))
+		for i, np := range nps {
+			names[i] = np.name
+		}
+		dirEntries, err := fs.getOpsByNode(ctx, node).statEntries(
+			ctx, node, names)
+		if err != nil {
+			return nil, err
+		}
+		for _, np := range nps {
+			if de, ok := dirEntries[np.name]; ok {
+				entries[np.p] = de
+			}
+		}
+	}
+	return entries, nil
+}
+
+// Watch implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) Watch(
+	ctx context.Context, p string, recursive bool, filter WatchEventType,
+	fn WatchFunc) (unwatch func(), err error) {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	_, _, node, ei, err := fs.resolveCanonicalPath(ctx, p, false)
+	if err != nil {
+		return nil, err
+	}
+	if ei.Type != Dir {
+		return nil, errors.Errorf("%s is not a directory", p)
+	}
+
+	ops := fs.getOpsByNode(ctx, node)
+	return ops.watchNode(ctx, node, recursive, filter, fn)
+}
+
 // CreateDir implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) CreateDir(
 	ctx context.Context, dir Node, name string) (Node, EntryInfo, error) {
@@ -811,6 +1333,29 @@ func (fs *KBFSOpsStandard) CreateFile(
 	return ops.CreateFile(ctx, dir, name, isExec, excl)
 }
 
+// CreateFiles implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) CreateFiles(
+	ctx context.Context, dir Node, files []NewFileInfo) (
+	[]Node, []EntryInfo, error) {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	ops := fs.getOpsByNode(ctx, dir)
+	return ops.CreateFiles(ctx, dir, files)
+}
+
+// InstantiateTemplate implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) InstantiateTemplate(
+	ctx context.Context, template Node, dir Node, name string) (
+	Node, EntryInfo, error) {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	ops := fs.getOpsByNode(ctx, dir)
+	return ops.InstantiateTemplate(ctx, template, dir, name)
+}
+
 // CreateLink implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) CreateLink(
 	ctx context.Context, dir Node, fromName string, toPath string) (
@@ -872,6 +1417,37 @@ func (fs *KBFSOpsStandard) Read(
 	return ops.Read(ctx, file, dest, off)
 }
 
+// FetchFileRange implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) FetchFileRange(
+	ctx context.Context, file Node, off, length int64) (FileRange, error) {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.FetchFileRange(ctx, file, off, length)
+}
+
+// ReadVec implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) ReadVec(
+	ctx context.Context, file Node, vecs []IOVec) ([]int64, error) {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.ReadVec(ctx, file, vecs)
+}
+
+// GetLocalFileRanges implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetLocalFileRanges(
+	ctx context.Context, file Node) ([]FileRange, error) {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.GetLocalFileRanges(ctx, file)
+}
+
 // Write implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) Write(
 	ctx context.Context, file Node, data []byte, off int64) error {
@@ -882,6 +1458,47 @@ func (fs *KBFSOpsStandard) Write(
 	return ops.Write(ctx, file, data, off)
 }
 
+// WriteVec implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) WriteVec(
+	ctx context.Context, file Node, vecs []IOVec) error {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.WriteVec(ctx, file, vecs)
+}
+
+// WriteStream implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) WriteStream(
+	ctx context.Context, file Node, r io.Reader, off int64) (int64, error) {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.WriteStream(ctx, file, r, off)
+}
+
+// CopyFileRange implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) CopyFileRange(ctx context.Context, src, dst Node,
+	srcOff, dstOff, length int64) (int64, error) {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	ops := fs.getOpsByNode(ctx, dst)
+	return ops.CopyFileRange(ctx, src, dst, srcOff, dstOff, length)
+}
+
+// CloneFile implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) CloneFile(
+	ctx context.Context, src Node, dstDir Node, name string) (
+	Node, EntryInfo, error) {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	ops := fs.getOpsByNode(ctx, dstDir)
+	return ops.CloneFile(ctx, src, dstDir, name)
+}
+
 // Truncate implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) Truncate(
 	ctx context.Context, file Node, size uint64) error {
@@ -902,6 +1519,16 @@ func (fs *KBFSOpsStandard) SetEx(
 	return ops.SetEx(ctx, file, ex)
 }
 
+// SetExInSubtree implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) SetExInSubtree(
+	ctx context.Context, dir Node, ex bool) error {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	ops := fs.getOpsByNode(ctx, dir)
+	return ops.SetExInSubtree(ctx, dir, ex)
+}
+
 // SetMtime implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) SetMtime(
 	ctx context.Context, file Node, mtime *time.Time) error {
@@ -912,6 +1539,42 @@ func (fs *KBFSOpsStandard) SetMtime(
 	return ops.SetMtime(ctx, file, mtime)
 }
 
+// SetTimes implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) SetTimes(
+	ctx context.Context, file Node, mtime time.Time, ctime *time.Time) error {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.SetTimes(ctx, file, mtime, ctime)
+}
+
+// SetTimesBatch implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) SetTimesBatch(
+	ctx context.Context, times []NodeTimes) error {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	// Each folder branch syncs its own changes, so split up the
+	// batch by folder, preserving the original order.
+	var opsList []*folderBranchOps
+	byOps := make(map[*folderBranchOps][]NodeTimes)
+	for _, nt := range times {
+		ops := fs.getOpsByNode(ctx, nt.Node)
+		if _, ok := byOps[ops]; !ok {
+			opsList = append(opsList, ops)
+		}
+		byOps[ops] = append(byOps[ops], nt)
+	}
+	for _, ops := range opsList {
+		err := ops.SetTimesBatch(ctx, byOps[ops])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // SyncAll implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) SyncAll(
 	ctx context.Context, folderBranch FolderBranch) error {
@@ -922,6 +1585,35 @@ func (fs *KBFSOpsStandard) SyncAll(
 	return ops.SyncAll(ctx, folderBranch)
 }
 
+// SyncAllAsync implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) SyncAllAsync(
+	ctx context.Context, folderBranch FolderBranch) (SyncTicket, error) {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	ops := fs.getOps(ctx, folderBranch, FavoritesOpAdd)
+	return ops.SyncAllAsync(ctx, folderBranch)
+}
+
+// Barrier implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) Barrier(ctx context.Context, file Node) error {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.Barrier(ctx, file)
+}
+
+// SetWriteThrough implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) SetWriteThrough(
+	ctx context.Context, file Node, writeThrough bool) error {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.SetWriteThrough(ctx, file, writeThrough)
+}
+
 // FolderStatus implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) FolderStatus(
 	ctx context.Context, folderBranch FolderBranch) (
@@ -982,6 +1674,25 @@ func (fs *KBFSOpsStandard) Status(ctx context.Context) (
 		dbcStatus = dbc.Status(ctx)
 	}
 
+	var brStatus *BlockRetrievalStatus
+	if bops, ok := fs.config.BlockOps().(*BlockOpsStandard); ok {
+		status := bops.RetrievalStatus()
+		brStatus = &status
+	}
+
+	var rkqStatus *RekeyQueueStatus
+	if rkq, ok := fs.config.RekeyQueue().(*RekeyQueueStandard); ok {
+		status := rkq.Status()
+		rkqStatus = &status
+	}
+
+	var pbStatus *PrefetchBudgetStatus
+	if budget := fs.config.PrefetchBudget(); budget.Limits() !=
+		(PrefetchBudgetLimits{}) {
+		status := budget.Status()
+		pbStatus = &status
+	}
+
 	return KBFSStatus{
 		CurrentUser:     session.Name.String(),
 		IsConnected:     fs.config.MDServer().IsConnected(),
@@ -994,9 +1705,79 @@ func (fs *KBFSOpsStandard) Status(ctx context.Context) (
 		FailingServices: failures,
 		JournalServer:   jServerStatus,
 		DiskCacheStatus: dbcStatus,
+		BlockRetrieval:  brStatus,
+		RekeyQueue:      rkqStatus,
+		PrefetchBudget:  pbStatus,
 	}, ch, err
 }
 
+// GetUnlinkedNodeStats implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) GetUnlinkedNodeStats(
+	ctx context.Context, folderBranch FolderBranch) (
+	UnlinkedNodeStats, error) {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	ops := fs.getOps(ctx, folderBranch, FavoritesOpNoChange)
+	return ops.GetUnlinkedNodeStats(ctx, folderBranch)
+}
+
+// SetTlfBlockSize implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) SetTlfBlockSize(
+	ctx context.Context, folderBranch FolderBranch, size int64) error {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	ops := fs.getOps(ctx, folderBranch, FavoritesOpNoChange)
+	return ops.SetTlfBlockSize(ctx, folderBranch, size)
+}
+
+// RevertToRevision implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) RevertToRevision(
+	ctx context.Context, folderBranch FolderBranch,
+	rev, expectedHead kbfsmd.Revision, dryRun bool) (TLFRevert, error) {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	ops := fs.getOps(ctx, folderBranch, FavoritesOpNoChange)
+	return ops.RevertToRevision(ctx, folderBranch, rev, expectedHead, dryRun)
+}
+
+// ReclaimUnlinkedNodes implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) ReclaimUnlinkedNodes(
+	ctx context.Context, folderBranch FolderBranch) (
+	UnlinkedNodeStats, error) {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	ops := fs.getOps(ctx, folderBranch, FavoritesOpNoChange)
+	return ops.ReclaimUnlinkedNodes(ctx, folderBranch)
+}
+
+// SubscribeSubtrees implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) SubscribeSubtrees(
+	ctx context.Context, folderBranch FolderBranch, subtrees []string) error {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	ops := fs.getOps(ctx, folderBranch, FavoritesOpNoChange)
+	return ops.SubscribeSubtrees(ctx, folderBranch, subtrees)
+}
+
+// CancelSync implements the KBFSOps interface for KBFSOpsStandard.
+func (fs *KBFSOpsStandard) CancelSync(ctx context.Context, file Node) error {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.CancelSync(ctx, file)
+}
+
 // UnstageForTesting implements the KBFSOps interface for KBFSOpsStandard
 // TODO: remove once we have automatic conflict resolution
 func (fs *KBFSOpsStandard) UnstageForTesting(
@@ -1045,7 +1045,7 @@ func TestKBFSOpsConcurWriteDuringSyncMultiBlocks(t *testing.T) {
 	// make the unembedded size large, so we don't create thousands of
 	// unembedded block change blocks.
 	blockSize := int64(5)
-	bsplit := &BlockSplitterSimple{blockSize, 2, 100 * 1024, 0}
+	bsplit := &BlockSplitterSimple{blockSize, 2, 100 * 1024, 0, 0}
 	config.SetBlockSplitter(bsplit)
 
 	// create and write to a file
@@ -1242,7 +1242,7 @@ func TestKBFSOpsConcurWriteParallelBlocksCanceled(t *testing.T) {
 	// make the unembedded size large, so we don't create thousands of
 	// unembedded block change blocks.
 	blockSize := int64(5)
-	bsplit := &BlockSplitterSimple{blockSize, 2, 100 * 1024, 0}
+	bsplit := &BlockSplitterSimple{blockSize, 2, 100 * 1024, 0, 0}
 	config.SetBlockSplitter(bsplit)
 
 	// create and write to a file
@@ -1395,7 +1395,7 @@ func TestKBFSOpsConcurWriteParallelBlocksError(t *testing.T) {
 	// make the unembedded size large, so we don't create thousands of
 	// unembedded block change blocks.
 	blockSize := int64(5)
-	bsplit := &BlockSplitterSimple{blockSize, 2, 100 * 1024, 0}
+	bsplit := &BlockSplitterSimple{blockSize, 2, 100 * 1024, 0, 0}
 	config.SetBlockSplitter(bsplit)
 
 	// create and write to a file
@@ -7,7 +7,13 @@ package libkbfs
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
 	"testing"
 	"time"
 
@@ -16,6 +22,7 @@ import (
 	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/go-codec/codec"
 	"github.com/keybase/kbfs/env"
+	"github.com/keybase/kbfs/ioutil"
 	"github.com/keybase/kbfs/kbfsblock"
 	"github.com/keybase/kbfs/kbfscodec"
 	"github.com/keybase/kbfs/kbfscrypto"
@@ -123,7 +130,9 @@ func kbfsOpsInit(t *testing.T) (mockCtrl *gomock.Controller,
 	// Ignore BlockRetriever calls
 	brc := &testBlockRetrievalConfig{nil, newTestLogMaker(t),
 		config.BlockCache(), nil, newTestDiskBlockCacheGetter(t, nil),
-		newTestSyncedTlfGetterSetter(), testInitModeGetter{InitDefault}}
+		newTestSyncedTlfGetterSetter(), testInitModeGetter{InitDefault},
+		testIdleTrackerGetter{}, testPowerMonitorGetter{},
+		testPrefetchBudgetGetter{}}
 	brq := newBlockRetrievalQueue(0, 0, brc)
 	config.mockBops.EXPECT().BlockRetriever().AnyTimes().Return(brq)
 	// Ignore Prefetcher calls
@@ -3041,6 +3050,48 @@ func TestKBFSOpsBackgroundFlush(t *testing.T) {
 	}
 }
 
+// Tests that the background flusher syncs a dirty file once it
+// exceeds the max dirty age, even if the batch period hasn't passed.
+func TestKBFSOpsBackgroundFlushDirtyFileMaxAge(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "alice")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	config.noBGFlush = true
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "alice", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	nodeA, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	ops := getOps(config, fb.Tlf)
+	oldPtr := ops.nodeCache.PathFromNode(nodeA).tailPointer()
+	err = kbfsOps.Write(ctx, nodeA, []byte{1}, 0)
+	require.NoError(t, err)
+	lState := makeFBOLockState()
+	require.False(t, ops.blocks.GetOldestDirtyFileTime(lState).IsZero())
+
+	staller := NewNaïveStaller(config)
+	staller.StallMDOp(StallableMDAfterPut, 1, false)
+
+	t.Log("Only the age limit can trigger a sync before the batch period")
+	config.SetBGFlushPeriod(1 * time.Hour)
+	config.SetDirtyFileMaxAge(10 * time.Millisecond)
+	go ops.backgroundFlusher()
+
+	staller.WaitForStallMDOp(StallableMDAfterPut)
+	staller.UnstallOneMDOp(StallableMDAfterPut)
+
+	// Do our own SyncAll now to ensure we wait for the bg flusher to
+	// finish.
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	newPtr := ops.nodeCache.PathFromNode(nodeA).tailPointer()
+	require.NotEqual(t, oldPtr, newPtr)
+	require.True(t, ops.blocks.GetOldestDirtyFileTime(lState).IsZero())
+}
+
 func TestKBFSOpsWriteRenameStat(t *testing.T) {
 	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
 	// TODO: Use kbfsTestShutdownNoMocks.
@@ -3180,7 +3231,7 @@ func TestKBFSOpsMultiBlockSyncWithArchivedBlock(t *testing.T) {
 	// make the unembedded size large, so we don't create thousands of
 	// unembedded block change blocks.
 	blockSize := int64(5)
-	bsplit := &BlockSplitterSimple{blockSize, 2, 100 * 1024, 0}
+	bsplit := &BlockSplitterSimple{blockSize, 2, 100 * 1024, 0, 0}
 	config.SetBlockSplitter(bsplit)
 
 	// create a file.
@@ -3633,6 +3684,42 @@ func TestKBFSOpsReadonlyNodes(t *testing.T) {
 	require.IsType(t, WriteToReadonlyNodeError{}, errors.Cause(err))
 }
 
+func TestKBFSOpsViewerMode(t *testing.T) {
+	config1, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1", "u2")
+	defer kbfsTestShutdownNoMocks(t, config1, ctx, cancel)
+
+	t.Log("u1 writes a file to a shared folder")
+	name := "u1,u2"
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, tlf.Private)
+	kbfsOps1 := config1.KBFSOps()
+	fileNode1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := []byte{1, 2, 3, 4, 5}
+	err = kbfsOps1.Write(ctx, fileNode1, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	t.Log("u2 reads it back in viewer mode")
+	config2 := ConfigAsUserWithMode(config1, "u2", InitViewer)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, tlf.Private)
+	kbfsOps2 := config2.KBFSOps()
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	gotData := make([]byte, len(data))
+	n, err := kbfsOps2.Read(ctx, fileNode2, gotData, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, gotData)
+
+	t.Log("Writes in viewer mode are rejected")
+	err = kbfsOps2.Write(ctx, fileNode2, data, 0)
+	require.IsType(t, WriteToReadonlyNodeError{}, errors.Cause(err))
+	_, _, err = kbfsOps2.CreateDir(ctx, rootNode2, "b")
+	require.IsType(t, WriteToReadonlyNodeError{}, errors.Cause(err))
+}
+
 type wrappedAutocreateNode struct {
 	Node
 	et      EntryType
@@ -3819,3 +3906,2480 @@ func TestKBFSOpsArchiveBranchType(t *testing.T) {
 	require.Equal(t, archiveFB, rootNodeArchived.GetFolderBranch())
 	require.True(t, rootNodeArchived.Readonly(ctx))
 }
+
+func TestKBFSOpsSetExInSubtree(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+
+	t.Log("Create a small tree with files, a subdir, and a symlink")
+	dirA, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, dirA, "f1", false, NoExcl)
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, dirA, "f2", true, NoExcl)
+	require.NoError(t, err)
+	dirB, _, err := kbfsOps.CreateDir(ctx, dirA, "b")
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, dirB, "f3", false, NoExcl)
+	require.NoError(t, err)
+	_, err = kbfsOps.CreateLink(ctx, dirB, "s", "f3")
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "outside", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	checkTypes := func(fileType EntryType) {
+		eis, err := kbfsOps.GetDirChildren(ctx, dirA)
+		require.NoError(t, err)
+		require.Equal(t, fileType, eis["f1"].Type)
+		require.Equal(t, fileType, eis["f2"].Type)
+		require.Equal(t, Dir, eis["b"].Type)
+		eis, err = kbfsOps.GetDirChildren(ctx, dirB)
+		require.NoError(t, err)
+		require.Equal(t, fileType, eis["f3"].Type)
+		require.Equal(t, Sym, eis["s"].Type)
+		eis, err = kbfsOps.GetDirChildren(ctx, rootNode)
+		require.NoError(t, err)
+		require.Equal(t, File, eis["outside"].Type)
+	}
+
+	t.Log("Set the exec bit recursively")
+	err = kbfsOps.SetExInSubtree(ctx, dirA, true)
+	require.NoError(t, err)
+	checkTypes(Exec)
+
+	t.Log("The changes should already be synced")
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	require.Len(t, ops.blocks.GetDirtyDirBlockRefs(lState), 0)
+
+	t.Log("Clearing the bit recursively")
+	err = kbfsOps.SetExInSubtree(ctx, dirA, false)
+	require.NoError(t, err)
+	checkTypes(File)
+}
+
+func TestKBFSOpsNewFileExecMode(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	tlfID := rootNode.GetFolderBranch().Tlf
+
+	t.Log("By default, the requested exec bit is honored")
+	_, ei, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	require.Equal(t, File, ei.Type)
+	_, ei, err = kbfsOps.CreateFile(ctx, rootNode, "b", true, NoExcl)
+	require.NoError(t, err)
+	require.Equal(t, Exec, ei.Type)
+
+	t.Log("A per-TLF override wins over the default")
+	config.SetNewFileExecMode(tlf.NullID, NewFileExecNever)
+	config.SetNewFileExecMode(tlfID, NewFileExecAlways)
+	_, ei, err = kbfsOps.CreateFile(ctx, rootNode, "c", false, NoExcl)
+	require.NoError(t, err)
+	require.Equal(t, Exec, ei.Type)
+
+	config.SetNewFileExecMode(tlfID, NewFileExecNever)
+	_, ei, err = kbfsOps.CreateFile(ctx, rootNode, "d", true, NoExcl)
+	require.NoError(t, err)
+	require.Equal(t, File, ei.Type)
+
+	t.Log("Inherit the exec bit from a directory of executables")
+	config.SetNewFileExecMode(tlfID, NewFileExecInherit)
+	binNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "bin")
+	require.NoError(t, err)
+	firstNode, ei, err := kbfsOps.CreateFile(
+		ctx, binNode, "first", false, NoExcl)
+	require.NoError(t, err)
+	require.Equal(t, File, ei.Type)
+	err = kbfsOps.SetEx(ctx, firstNode, true)
+	require.NoError(t, err)
+	_, ei, err = kbfsOps.CreateFile(ctx, binNode, "second", false, NoExcl)
+	require.NoError(t, err)
+	require.Equal(t, Exec, ei.Type)
+
+	t.Log("Mixed directories don't pass on the exec bit")
+	_, ei, err = kbfsOps.CreateFile(ctx, rootNode, "e", false, NoExcl)
+	require.NoError(t, err)
+	require.Equal(t, File, ei.Type)
+
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+}
+
+func TestNewFileExecModeSet(t *testing.T) {
+	var m NewFileExecMode
+	for _, expected := range []NewFileExecMode{
+		NewFileExecFromRequest, NewFileExecNever, NewFileExecAlways,
+		NewFileExecInherit} {
+		require.NoError(t, m.Set(expected.String()))
+		require.Equal(t, expected, m)
+	}
+	require.Error(t, m.Set("bogus"))
+	require.Equal(t, NewFileExecInherit, m)
+}
+
+func TestFsyncModeSet(t *testing.T) {
+	var m FsyncMode
+	for _, expected := range []FsyncMode{
+		FsyncJournalDurable, FsyncServerDurable} {
+		require.NoError(t, m.Set(expected.String()))
+		require.Equal(t, expected, m)
+	}
+	require.Error(t, m.Set("bogus"))
+	require.Equal(t, FsyncServerDurable, m)
+}
+
+func TestKBFSOpsSetTimesPreservesCtime(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+
+	aNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	bNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	cNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "c", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	t.Log("Set a single file's times far in the past")
+	mtime := time.Date(1999, time.January, 1, 0, 0, 0, 0, time.UTC)
+	ctime := mtime.Add(time.Hour)
+	err = kbfsOps.SetTimes(ctx, aNode, mtime, &ctime)
+	require.NoError(t, err)
+	ei, err := kbfsOps.Stat(ctx, aNode)
+	require.NoError(t, err)
+	require.Equal(t, mtime.UnixNano(), ei.Mtime)
+	require.Equal(t, ctime.UnixNano(), ei.Ctime)
+
+	t.Log("Set times on several files in one batch")
+	mtime2 := mtime.Add(24 * time.Hour)
+	err = kbfsOps.SetTimesBatch(ctx, []NodeTimes{
+		{Node: bNode, Mtime: mtime2, Ctime: &ctime},
+		{Node: cNode, Mtime: mtime2},
+	})
+	require.NoError(t, err)
+	ei, err = kbfsOps.Stat(ctx, bNode)
+	require.NoError(t, err)
+	require.Equal(t, mtime2.UnixNano(), ei.Mtime)
+	require.Equal(t, ctime.UnixNano(), ei.Ctime)
+	ei, err = kbfsOps.Stat(ctx, cNode)
+	require.NoError(t, err)
+	require.Equal(t, mtime2.UnixNano(), ei.Mtime)
+	require.NotEqual(t, ctime.UnixNano(), ei.Ctime)
+
+	t.Log("The batch should already be synced")
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	require.Len(t, ops.blocks.GetDirtyDirBlockRefs(lState), 0)
+}
+
+func TestKBFSOpsWriteStream(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	startRev := ops.getCurrMDRevision(makeFBOLockState())
+	go ops.backgroundFlusher()
+
+	t.Log("Stream more data than fits in the dirty block cache")
+	data := make([]byte, 4*ops.streamBlockBytes()+100)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+	n, err := kbfsOps.WriteStream(ctx, fileNode, bytes.NewReader(data), 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+
+	t.Log("The background flusher made room partway through")
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	lState := makeFBOLockState()
+	require.Len(t, ops.blocks.GetDirtyFileBlockRefs(lState), 0)
+	require.True(t, ops.getCurrMDRevision(lState) >= startRev+2)
+
+	ei, err := kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(data)), ei.Size)
+	buf := make([]byte, len(data))
+	readN, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), readN)
+	require.True(t, bytes.Equal(data, buf))
+}
+
+func TestKBFSOpsSetTlfBlockSize(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, fb.Tlf)
+
+	t.Log("Start a second device before the size is set")
+	config2 := ConfigAsUser(config, u1)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "u1", tlf.Private)
+	kbfsOps2 := config2.KBFSOps()
+
+	t.Log("Out-of-range sizes are rejected")
+	err := kbfsOps.SetTlfBlockSize(ctx, fb, 1<<10)
+	require.Error(t, err)
+
+	t.Log("The size is recorded in the MD and used right away")
+	err = kbfsOps.SetTlfBlockSize(ctx, fb, 64<<10)
+	require.NoError(t, err)
+	head, _ := ops.getHead(makeFBOLockState())
+	require.Equal(t, int64(64<<10), head.data.BlockSize)
+	bsplit, ok := config.TlfBlockSplitter(fb.Tlf).(*BlockSplitterSimple)
+	require.True(t, ok)
+	require.NotEqual(t, config.BlockSplitter(), bsplit)
+
+	t.Log("Later revisions keep the size")
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	head, _ = ops.getHead(makeFBOLockState())
+	require.Equal(t, int64(64<<10), head.data.BlockSize)
+
+	t.Log("The other device picks the size up from the MD")
+	err = kbfsOps2.SyncFromServer(ctx, rootNode2.GetFolderBranch(), nil)
+	require.NoError(t, err)
+	bsplit2, ok := config2.TlfBlockSplitter(fb.Tlf).(*BlockSplitterSimple)
+	require.True(t, ok)
+	require.Equal(t, bsplit.maxSize, bsplit2.maxSize)
+
+	t.Log("A zero size reverts both devices to the default")
+	err = kbfsOps.SetTlfBlockSize(ctx, fb, 0)
+	require.NoError(t, err)
+	require.Equal(t, config.BlockSplitter(), config.TlfBlockSplitter(fb.Tlf))
+	err = kbfsOps2.SyncFromServer(ctx, rootNode2.GetFolderBranch(), nil)
+	require.NoError(t, err)
+	require.Equal(t, config2.BlockSplitter(), config2.TlfBlockSplitter(fb.Tlf))
+}
+
+func TestKBFSOpsFetchFileRange(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+
+	// Use the smallest possible block size.
+	bsplitter, err := NewBlockSplitterSimple(20, 8*1024, config.Codec())
+	require.NoError(t, err)
+	config.SetBlockSplitter(bsplitter)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := make([]byte, 200)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	t.Log("Fetch a range of the file from a fresh device")
+	config2 := ConfigAsUser(config, u1)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	kbfsOps2 := config2.KBFSOps()
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "u1", tlf.Private)
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	fr, err := kbfsOps2.FetchFileRange(ctx, fileNode2, 100, 10)
+	require.NoError(t, err)
+	require.True(t, fr.Off <= 100)
+	require.True(t, fr.End() >= 110)
+	require.True(t, fr.Len < int64(len(data)))
+
+	buf := make([]byte, 10)
+	n, err := kbfsOps2.Read(ctx, fileNode2, buf, 100)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(buf)), n)
+	require.Equal(t, data[100:110], buf)
+
+	t.Log("A negative length fetches to the end of the file")
+	fr, err = kbfsOps2.FetchFileRange(ctx, fileNode2, 0, -1)
+	require.NoError(t, err)
+	require.Equal(t, FileRange{Off: 0, Len: int64(len(data))}, fr)
+
+	t.Log("Nothing is fetched past the end of the file")
+	fr, err = kbfsOps2.FetchFileRange(ctx, fileNode2, 1000, 10)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), fr.Len)
+}
+
+func TestKBFSOpsReadWriteVec(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+
+	// Use the smallest possible block size.
+	bsplitter, err := NewBlockSplitterSimple(20, 8*1024, config.Codec())
+	require.NoError(t, err)
+	config.SetBlockSplitter(bsplitter)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := make([]byte, 200)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	t.Log("Read several ranges of the file from a fresh device")
+	config2 := ConfigAsUser(config, u1)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	kbfsOps2 := config2.KBFSOps()
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "u1", tlf.Private)
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	vecs := []IOVec{
+		{Off: 150, Buf: make([]byte, 10)},
+		{Off: 5, Buf: make([]byte, 30)},
+		{Off: 190, Buf: make([]byte, 20)},
+	}
+	ns, err := kbfsOps2.ReadVec(ctx, fileNode2, vecs)
+	require.NoError(t, err)
+	require.Equal(t, []int64{10, 30, 10}, ns)
+	require.Equal(t, data[150:160], vecs[0].Buf)
+	require.Equal(t, data[5:35], vecs[1].Buf)
+	require.Equal(t, data[190:200], vecs[2].Buf[:10])
+
+	t.Log("Write several ranges, one of which extends the file")
+	err = kbfsOps2.WriteVec(ctx, fileNode2, []IOVec{
+		{Off: 40, Buf: []byte{1, 2, 3}},
+		{Off: 195, Buf: []byte{4, 5, 6, 7, 8, 9, 10}},
+		{Off: 41, Buf: []byte{11}},
+	})
+	require.NoError(t, err)
+	err = kbfsOps2.SyncAll(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	copy(data[40:], []byte{1, 11, 3})
+	data = append(data[:195], 4, 5, 6, 7, 8, 9, 10)
+
+	err = kbfsOps.SyncFromServer(ctx, rootNode.GetFolderBranch(), nil)
+	require.NoError(t, err)
+	buf := make([]byte, len(data))
+	n, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, buf)
+}
+
+func TestKBFSOpsCopyFileRange(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+
+	// Use the smallest possible block size.
+	bsplitter, err := NewBlockSplitterSimple(20, 8*1024, config.Codec())
+	require.NoError(t, err)
+	config.SetBlockSplitter(bsplitter)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	srcNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := make([]byte, 200)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	err = kbfsOps.Write(ctx, srcNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	bserverLocal, ok := config.BlockServer().(blockServerLocal)
+	require.True(t, ok)
+	preCopyRefs, err := bserverLocal.getAllRefsForTest(ctx, fb.Tlf)
+	require.NoError(t, err)
+
+	t.Log("Copy the whole file into a new one")
+	dstNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	n, err := kbfsOps.CopyFileRange(ctx, srcNode, dstNode, 0, 0, 1000)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	buf := make([]byte, len(data))
+	n, err = kbfsOps.Read(ctx, dstNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, buf)
+
+	t.Log("The copy shares the leaf blocks of the original")
+	postCopyRefs, err := bserverLocal.getAllRefsForTest(ctx, fb.Tlf)
+	require.NoError(t, err)
+	shared := 0
+	for id, refs := range postCopyRefs {
+		if oldRefs, ok := preCopyRefs[id]; ok && len(refs) > len(oldRefs) {
+			shared++
+		}
+	}
+	require.True(t, shared > 1, "Only %d blocks shared", shared)
+
+	t.Log("Copy an unaligned range into the middle of the copy")
+	n, err = kbfsOps.CopyFileRange(ctx, srcNode, dstNode, 5, 100, 50)
+	require.NoError(t, err)
+	require.Equal(t, int64(50), n)
+	copy(data[100:150], data[5:55])
+	n, err = kbfsOps.Read(ctx, dstNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, buf)
+
+	t.Log("Overlapping ranges of the same file are rejected")
+	_, err = kbfsOps.CopyFileRange(ctx, srcNode, srcNode, 0, 10, 20)
+	require.Error(t, err)
+}
+
+// enableJournalForKBFSOpsTest turns on journaling, with background
+// flushing, for all the TLFs of `config`.  It returns the journal
+// server, and a function that removes the journal directory, to be
+// deferred before shutting down `config`.
+func enableJournalForKBFSOpsTest(ctx context.Context, t *testing.T,
+	config *ConfigLocal) (*JournalServer, func()) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "kbfs_ops_journal")
+	require.NoError(t, err)
+	cleanup := func() {
+		err := ioutil.RemoveAll(tempdir)
+		assert.NoError(t, err)
+	}
+	err = config.EnableDiskLimiter(tempdir)
+	require.NoError(t, err)
+	err = config.EnableJournaling(
+		ctx, tempdir, TLFJournalBackgroundWorkEnabled)
+	require.NoError(t, err)
+	jServer, err := GetJournalServer(config)
+	require.NoError(t, err)
+	jServer.EnableAuto(ctx)
+	return jServer, cleanup
+}
+
+func testKBFSOpsCopyFileRangeSplicesLeaves(t *testing.T, journal bool) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+	bserver := config.BlockServer()
+
+	// Use a block size with room for a few pointers per block.
+	bsplitter, err := NewBlockSplitterSimple(1024, 8*1024, config.Codec())
+	require.NoError(t, err)
+	require.True(t, bsplitter.MaxPtrsPerBlock() > 5)
+	config.SetBlockSplitter(bsplitter)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	srcNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	leafSize := int(bsplitter.maxSize)
+	data := make([]byte, 3*leafSize+10)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	err = kbfsOps.Write(ctx, srcNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	var jServer *JournalServer
+	if journal {
+		// The leaves were put before the journal was on, so it
+		// doesn't know about them.
+		var cleanup func()
+		jServer, cleanup = enableJournalForKBFSOpsTest(ctx, t, config)
+		defer cleanup()
+		err = jServer.Enable(
+			ctx, fb.Tlf, nil, TLFJournalBackgroundWorkEnabled)
+		require.NoError(t, err)
+	}
+
+	bserverLocal, ok := bserver.(blockServerLocal)
+	require.True(t, ok)
+	countNewRefs := func(oldRefs map[kbfsblock.ID]blockRefMap) int {
+		newRefs, err := bserverLocal.getAllRefsForTest(ctx, fb.Tlf)
+		require.NoError(t, err)
+		n := 0
+		for id, refs := range newRefs {
+			if old, ok := oldRefs[id]; ok && len(refs) > len(old) {
+				n++
+			}
+		}
+		return n
+	}
+	checkCopy := func(dst Node, srcOff int) {
+		buf := make([]byte, len(data)-srcOff)
+		n, err := kbfsOps.Read(ctx, dst, buf, 0)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(buf)), n)
+		require.Equal(t, data[srcOff:], buf)
+	}
+
+	t.Log("A whole-file copy gets new references to all four leaves")
+	preCopyRefs, err := bserverLocal.getAllRefsForTest(ctx, fb.Tlf)
+	require.NoError(t, err)
+	dstNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	n, err := kbfsOps.CopyFileRange(
+		ctx, srcNode, dstNode, 0, 0, int64(len(data)))
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	checkCopy(dstNode, 0)
+	require.Equal(t, 4, countNewRefs(preCopyRefs))
+
+	t.Log("An unaligned copy copies the first partial leaf, " +
+		"and splices the rest")
+	preCopyRefs, err = bserverLocal.getAllRefsForTest(ctx, fb.Tlf)
+	require.NoError(t, err)
+	dstNode2, _, err := kbfsOps.CreateFile(ctx, rootNode, "c", false, NoExcl)
+	require.NoError(t, err)
+	n, err = kbfsOps.CopyFileRange(
+		ctx, srcNode, dstNode2, 5, 0, int64(len(data)))
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)-5), n)
+	checkCopy(dstNode2, 5)
+	require.Equal(t, 3, countNewRefs(preCopyRefs))
+
+	t.Log("Unsynced writes to the source make it into the copy")
+	err = kbfsOps.Write(ctx, srcNode, []byte{1, 2, 3}, int64(leafSize))
+	require.NoError(t, err)
+	copy(data[leafSize:], []byte{1, 2, 3})
+	dstNode3, _, err := kbfsOps.CreateFile(ctx, rootNode, "d", false, NoExcl)
+	require.NoError(t, err)
+	n, err = kbfsOps.CopyFileRange(
+		ctx, srcNode, dstNode3, 0, 0, int64(len(data)))
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	checkCopy(dstNode3, 0)
+	if journal {
+		err = jServer.Wait(ctx, fb.Tlf)
+		require.NoError(t, err)
+		err = getOps(config, fb.Tlf).fbm.waitForArchives(ctx)
+		require.NoError(t, err)
+	}
+}
+
+func TestKBFSOpsCopyFileRangeSplicesLeaves(t *testing.T) {
+	testKBFSOpsCopyFileRangeSplicesLeaves(t, false)
+}
+
+func TestKBFSOpsCopyFileRangeSplicesLeavesJournal(t *testing.T) {
+	testKBFSOpsCopyFileRangeSplicesLeaves(t, true)
+}
+
+func testKBFSOpsReadRepairRereferencesLeaf(t *testing.T, journal bool) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+
+	// Use a block size with room for a few pointers per block.
+	bsplitter, err := NewBlockSplitterSimple(1024, 8*1024, config.Codec())
+	require.NoError(t, err)
+	config.SetBlockSplitter(bsplitter)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	ops := getOps(config, fb.Tlf)
+	srcNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := make([]byte, 3*int(bsplitter.maxSize)+10)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	err = kbfsOps.Write(ctx, srcNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	dstNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	_, err = kbfsOps.CopyFileRange(
+		ctx, srcNode, dstNode, 0, 0, int64(len(data)))
+	require.NoError(t, err)
+
+	getLeaf := func(node Node) BlockPointer {
+		topPtr := ops.nodeCache.PathFromNode(node).tailPointer()
+		block, err := config.BlockCache().Get(topPtr)
+		require.NoError(t, err)
+		fblock := block.(*FileBlock)
+		require.True(t, fblock.IsInd)
+		return fblock.IPtrs[1].BlockPointer
+	}
+	checkRead := func(node Node) {
+		buf := make([]byte, len(data))
+		n, err := kbfsOps.Read(ctx, node, buf, 0)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(data)), n)
+		require.Equal(t, data, buf)
+	}
+
+	var jServer *JournalServer
+	if journal {
+		var cleanup func()
+		jServer, cleanup = enableJournalForKBFSOpsTest(ctx, t, config)
+		defer cleanup()
+		err = jServer.Enable(
+			ctx, fb.Tlf, nil, TLFJournalBackgroundWorkEnabled)
+		require.NoError(t, err)
+	}
+
+	t.Log("Break the copy's reference to its second leaf")
+	broken := getLeaf(dstNode)
+	require.False(t, broken.IsFirstRef())
+	alt := getLeaf(srcNode)
+	require.Equal(t, broken.ID, alt.ID)
+	_, err = config.BlockServer().RemoveBlockReferences(ctx, fb.Tlf,
+		kbfsblock.ContextMap{broken.ID: {broken.Context}})
+	require.NoError(t, err)
+	config.ResetCaches()
+
+	t.Log("The copy is read through the original's reference")
+	// Reading the original would put the shared leaf in the cache,
+	// so just make its reference known.
+	ops.blocks.readRepairs.addRef(alt)
+	checkRead(dstNode)
+
+	t.Log("Reads alone don't cause a sync")
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, broken, getLeaf(dstNode))
+
+	t.Log("The next real sync re-references the leaf")
+	otherNode, _, err := kbfsOps.CreateFile(
+		ctx, rootNode, "c", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, otherNode, []byte{1}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	repaired := getLeaf(dstNode)
+	require.Equal(t, broken.ID, repaired.ID)
+	require.NotEqual(t, broken.RefNonce, repaired.RefNonce)
+	_, _, err = config.BlockServer().Get(
+		ctx, fb.Tlf, repaired.ID, repaired.Context)
+	require.NoError(t, err)
+	checkRead(dstNode)
+	if journal {
+		err = jServer.Wait(ctx, fb.Tlf)
+		require.NoError(t, err)
+	}
+
+	// Avoid checking state, since the broken reference was removed
+	// behind the journal's back.
+	config.MDServer().Shutdown()
+}
+
+func TestKBFSOpsReadRepairRereferencesLeaf(t *testing.T) {
+	testKBFSOpsReadRepairRereferencesLeaf(t, false)
+}
+
+func TestKBFSOpsReadRepairRereferencesLeafJournal(t *testing.T) {
+	testKBFSOpsReadRepairRereferencesLeaf(t, true)
+}
+
+func TestKBFSOpsCloneFile(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+
+	// Use the smallest possible block size.
+	bsplitter, err := NewBlockSplitterSimple(20, 8*1024, config.Codec())
+	require.NoError(t, err)
+	config.SetBlockSplitter(bsplitter)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	srcNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", true, NoExcl)
+	require.NoError(t, err)
+	data := make([]byte, 200)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	err = kbfsOps.Write(ctx, srcNode, data, 0)
+	require.NoError(t, err)
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	bserverLocal, ok := config.BlockServer().(blockServerLocal)
+	require.True(t, ok)
+	preCloneRefs, err := bserverLocal.getAllRefsForTest(ctx, fb.Tlf)
+	require.NoError(t, err)
+
+	preCloneMD, err := config.MDOps().GetForTLF(ctx, fb.Tlf, nil)
+	require.NoError(t, err)
+
+	t.Log("Clone the file into a subdirectory")
+	cloneNode, ei, err := kbfsOps.CloneFile(ctx, srcNode, dirNode, "b")
+	require.NoError(t, err)
+	require.Equal(t, Exec, ei.Type)
+
+	t.Log("The clone was made by a single create op")
+	postCloneMD, err := config.MDOps().GetForTLF(ctx, fb.Tlf, nil)
+	require.NoError(t, err)
+	require.Equal(t, preCloneMD.Revision()+1, postCloneMD.Revision())
+	require.Len(t, postCloneMD.data.Changes.Ops, 1)
+	require.IsType(t, &createOp{}, postCloneMD.data.Changes.Ops[0])
+	require.Equal(t, uint64(len(data)), ei.Size)
+	buf := make([]byte, len(data))
+	n, err := kbfsOps.Read(ctx, cloneNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, buf)
+
+	t.Log("The clone shares the leaf blocks of the original")
+	postCloneRefs, err := bserverLocal.getAllRefsForTest(ctx, fb.Tlf)
+	require.NoError(t, err)
+	shared := 0
+	for id, refs := range postCloneRefs {
+		if oldRefs, ok := preCloneRefs[id]; ok && len(refs) > len(oldRefs) {
+			shared++
+		}
+	}
+	require.True(t, shared > 1, "Only %d blocks shared", shared)
+
+	t.Log("Writes to the clone don't change the original")
+	err = kbfsOps.Write(ctx, cloneNode, []byte{0, 0, 0}, 50)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	n, err = kbfsOps.Read(ctx, srcNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, buf)
+
+	t.Log("Empty files can be cloned, but not onto existing names")
+	emptyNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "c", false, NoExcl)
+	require.NoError(t, err)
+	_, ei, err = kbfsOps.CloneFile(ctx, emptyNode, rootNode, "e")
+	require.NoError(t, err)
+	require.Equal(t, File, ei.Type)
+	require.Equal(t, uint64(0), ei.Size)
+	_, _, err = kbfsOps.CloneFile(ctx, srcNode, dirNode, "b")
+	require.IsType(t, NameExistsError{}, errors.Cause(err))
+	_, _, err = kbfsOps.CloneFile(ctx, dirNode, rootNode, "f")
+	require.IsType(t, NotFileError{}, errors.Cause(err))
+
+	t.Log("A clone that fails to reference the leaves leaves no entry")
+	config.SetBlockServer(failAddRefBlockServer{config.BlockServer()})
+	_, _, err = kbfsOps.CloneFile(ctx, srcNode, rootNode, "g")
+	require.Error(t, err)
+	config.SetBlockServer(bserverLocal)
+	_, _, err = kbfsOps.Lookup(ctx, rootNode, "g")
+	require.IsType(t, NoSuchNameError{}, errors.Cause(err))
+}
+
+func TestKBFSOpsCloneFileJournal(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+
+	// Use the smallest possible block size.
+	bsplitter, err := NewBlockSplitterSimple(20, 8*1024, config.Codec())
+	require.NoError(t, err)
+	config.SetBlockSplitter(bsplitter)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	srcNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := make([]byte, 200)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	err = kbfsOps.Write(ctx, srcNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	bserverLocal, ok := config.BlockServer().(blockServerLocal)
+	require.True(t, ok)
+	preCloneRefs, err := bserverLocal.getAllRefsForTest(ctx, fb.Tlf)
+	require.NoError(t, err)
+
+	t.Log("Turn on the journal, which doesn't know about the leaves")
+	jServer, cleanup := enableJournalForKBFSOpsTest(ctx, t, config)
+	defer cleanup()
+	err = jServer.Enable(ctx, fb.Tlf, nil, TLFJournalBackgroundWorkEnabled)
+	require.NoError(t, err)
+
+	t.Log("The clone still shares the leaf blocks of the original")
+	cloneNode, _, err := kbfsOps.CloneFile(ctx, srcNode, rootNode, "b")
+	require.NoError(t, err)
+	buf := make([]byte, len(data))
+	n, err := kbfsOps.Read(ctx, cloneNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, buf)
+	err = jServer.Wait(ctx, fb.Tlf)
+	require.NoError(t, err)
+	postCloneRefs, err := bserverLocal.getAllRefsForTest(ctx, fb.Tlf)
+	require.NoError(t, err)
+	shared := 0
+	for id, refs := range postCloneRefs {
+		if oldRefs, ok := preCloneRefs[id]; ok && len(refs) > len(oldRefs) {
+			shared++
+		}
+	}
+	require.True(t, shared > 1, "Only %d blocks shared", shared)
+	err = getOps(config, fb.Tlf).fbm.waitForArchives(ctx)
+	require.NoError(t, err)
+}
+
+// failAddRefBlockServer fails every attempt to add a block reference.
+type failAddRefBlockServer struct {
+	BlockServer
+}
+
+func (b failAddRefBlockServer) AddBlockReference(
+	ctx context.Context, tlfID tlf.ID, id kbfsblock.ID,
+	context kbfsblock.Context) error {
+	return errors.New("fake add reference failure")
+}
+
+func TestKBFSOpsGetLocalFileRanges(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+
+	// Use the smallest possible block size.
+	bsplitter, err := NewBlockSplitterSimple(20, 8*1024, config.Codec())
+	require.NoError(t, err)
+	config.SetBlockSplitter(bsplitter)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	ranges, err := kbfsOps.GetLocalFileRanges(ctx, fileNode)
+	require.NoError(t, err)
+	require.Len(t, ranges, 0)
+
+	t.Log("Dirty data is all local")
+	data := make([]byte, 200)
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	ranges, err = kbfsOps.GetLocalFileRanges(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, []FileRange{{Off: 0, Len: int64(len(data))}}, ranges)
+
+	t.Log("Synced data is still in the block cache")
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	ranges, err = kbfsOps.GetLocalFileRanges(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, []FileRange{{Off: 0, Len: int64(len(data))}}, ranges)
+
+	t.Log("A fresh device only has the ranges it fetched")
+	config2 := ConfigAsUser(config, u1)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	kbfsOps2 := config2.KBFSOps()
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "u1", tlf.Private)
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	fr, err := kbfsOps2.FetchFileRange(ctx, fileNode2, 100, 10)
+	require.NoError(t, err)
+	ranges, err = kbfsOps2.GetLocalFileRanges(ctx, fileNode2)
+	require.NoError(t, err)
+	covered := false
+	for _, r := range ranges {
+		if r.Off <= fr.Off && r.End() >= fr.End() {
+			covered = true
+		}
+	}
+	require.True(t, covered, "%v not covered by %v", fr, ranges)
+}
+
+func TestKBFSOpsBarrier(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	aNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	bNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	startRev := ops.getCurrMDRevision(lState)
+
+	t.Log("A barrier on a clean file doesn't make a revision")
+	err = kbfsOps.Write(ctx, bNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Barrier(ctx, aNode)
+	require.NoError(t, err)
+	require.Equal(t, startRev, ops.getCurrMDRevision(lState))
+	require.Len(t, ops.blocks.GetDirtyFileBlockRefs(lState), 1)
+
+	t.Log("A barrier on a dirty file syncs it")
+	err = kbfsOps.Write(ctx, aNode, []byte{4, 5, 6}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Barrier(ctx, aNode)
+	require.NoError(t, err)
+	require.Equal(t, startRev+1, ops.getCurrMDRevision(lState))
+	require.Len(t, ops.blocks.GetDirtyFileBlockRefs(lState), 0)
+	ei, err := kbfsOps.Stat(ctx, aNode)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), ei.Size)
+}
+
+func TestKBFSOpsCreateFiles(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "x")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	startRev := ops.getCurrMDRevision(makeFBOLockState())
+
+	t.Log("Create a bunch of small files in one call")
+	var files []NewFileInfo
+	for i := 0; i < 20; i++ {
+		files = append(files, NewFileInfo{
+			Name:   fmt.Sprintf("f%d", i),
+			IsExec: i%2 == 0,
+			Data:   []byte(fmt.Sprintf("data%d", i)),
+		})
+	}
+	files = append(files, NewFileInfo{Name: "empty"})
+	nodes, eis, err := kbfsOps.CreateFiles(ctx, dirNode, files)
+	require.NoError(t, err)
+	require.Len(t, nodes, len(files))
+	require.Len(t, eis, len(files))
+
+	t.Log("All the files should be synced in a single revision")
+	require.Equal(t, startRev+1, ops.getCurrMDRevision(makeFBOLockState()))
+	require.Len(t, ops.blocks.GetDirtyDirBlockRefs(makeFBOLockState()), 0)
+
+	children, err := kbfsOps.GetDirChildren(ctx, dirNode)
+	require.NoError(t, err)
+	require.Len(t, children, len(files))
+	for i, f := range files {
+		expectedType := File
+		if f.IsExec {
+			expectedType = Exec
+		}
+		require.Equal(t, expectedType, children[f.Name].Type)
+		require.Equal(t, uint64(len(f.Data)), children[f.Name].Size)
+		buf := make([]byte, len(f.Data))
+		n, err := kbfsOps.Read(ctx, nodes[i], buf, 0)
+		require.NoError(t, err)
+		require.Equal(t, string(f.Data), string(buf[:n]))
+	}
+
+	t.Log("A name collision stops the batch")
+	_, _, err = kbfsOps.CreateFiles(ctx, dirNode, []NewFileInfo{
+		{Name: "new"}, {Name: "f1"}})
+	require.Error(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	children, err = kbfsOps.GetDirChildren(ctx, dirNode)
+	require.NoError(t, err)
+	require.Contains(t, children, "new")
+}
+
+func TestKBFSOpsReclaimUnlinkedNodes(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	t.Log("Write to the file, and remove it while it's still dirty")
+	data := []byte{1, 2, 3, 4, 5}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.RemoveEntry(ctx, rootNode, "a")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	stats, err := kbfsOps.GetUnlinkedNodeStats(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, UnlinkedNodeStats{1, int64(len(data))}, stats)
+	status, _, err := kbfsOps.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, stats, status.UnlinkedNodes)
+
+	t.Log("The open node can still read the dirty data")
+	buf := make([]byte, len(data))
+	n, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, data, buf[:n])
+
+	t.Log("Reclaiming skips the node while it's still in use")
+	reclaimed, err := kbfsOps.ReclaimUnlinkedNodes(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, UnlinkedNodeStats{}, reclaimed)
+	n, err = kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, data, buf[:n])
+
+	t.Log("The dirty data is dropped once the node is forgotten")
+	filePtr := fileNode.(*nodeStandard).core.pathNode.BlockPointer
+	fileNode = nil
+	for {
+		runtime.GC()
+		stats, err = kbfsOps.GetUnlinkedNodeStats(ctx, fb)
+		require.NoError(t, err)
+		if stats == (UnlinkedNodeStats{}) &&
+			!config.DirtyBlockCache().IsDirty(fb.Tlf, filePtr, fb.Branch) {
+			break
+		}
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-ctx.Done():
+			t.Fatal(ctx.Err())
+		}
+	}
+}
+
+type blockServerPutErr struct {
+	BlockServer
+	err error
+}
+
+func (bspe blockServerPutErr) Put(ctx context.Context, tlfID tlf.ID,
+	id kbfsblock.ID, context kbfsblock.Context, buf []byte,
+	serverHalf kbfscrypto.BlockCryptKeyServerHalf) error {
+	return bspe.err
+}
+
+func TestKBFSOpsSyncErrorInNodeMetadata(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+	config.SetClock(newTestClockNow())
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	md, err := kbfsOps.GetNodeMetadata(ctx, fileNode)
+	require.NoError(t, err)
+	require.Nil(t, md.SyncError)
+
+	t.Log("A failed sync leaves its error on the dirty file")
+	realBserv := config.BlockServer()
+	putErr := errors.New("put failed")
+	config.SetBlockServer(blockServerPutErr{realBserv, putErr})
+	syncErr := kbfsOps.SyncAll(ctx, fb)
+	require.Equal(t, putErr, errors.Cause(syncErr))
+	md, err = kbfsOps.GetNodeMetadata(ctx, fileNode)
+	require.NoError(t, err)
+	require.NotNil(t, md.SyncError)
+	require.Equal(t, syncErr.Error(), md.SyncError.Error)
+	require.Equal(t, config.Clock().Now(), md.SyncError.Time)
+
+	t.Log("A successful sync clears it")
+	config.SetBlockServer(realBserv)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	md, err = kbfsOps.GetNodeMetadata(ctx, fileNode)
+	require.NoError(t, err)
+	require.Nil(t, md.SyncError)
+}
+
+func TestKBFSOpsOrderedWrites(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+	config.SetOrderedWrites(tlf.NullID, true)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	names := []string{"e", "d", "c", "b", "a"}
+	nodes := make(map[string]Node)
+	for _, name := range names {
+		n, _, err := kbfsOps.CreateFile(ctx, rootNode, name, false, NoExcl)
+		require.NoError(t, err)
+		nodes[name] = n
+	}
+	err := kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	headRev := func() kbfsmd.Revision {
+		md, _ := getOps(config, fb.Tlf).getHead(makeFBOLockState())
+		return md.Revision()
+	}
+	rev := headRev()
+
+	t.Log("Write all the files, rewriting one at the end")
+	for _, name := range names {
+		err = kbfsOps.Write(ctx, nodes[name], []byte(name), 0)
+		require.NoError(t, err)
+	}
+	err = kbfsOps.Write(ctx, nodes["c"], []byte("cc"), 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	t.Log("All the writes were committed together in one revision")
+	require.Equal(t, rev+1, headRev())
+	md, _ := getOps(config, fb.Tlf).getHead(makeFBOLockState())
+	synced := make(map[string]bool)
+	for _, op := range md.data.Changes.Ops {
+		if sop, ok := op.(*syncOp); ok {
+			synced[sop.getFinalPath().tailName()] = true
+		}
+	}
+	require.Len(t, synced, len(names))
+}
+
+func TestKBFSOpsPOSIXTimestamps(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+	clock := newTestClockNow()
+	config.SetClock(clock)
+	config.SetTimestampMode(TimestampsPOSIXWithAtime)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	requireTimes := func(mtime, ctime time.Time) {
+		ei, err := kbfsOps.Stat(ctx, fileNode)
+		require.NoError(t, err)
+		require.Equal(t, mtime.UnixNano(), ei.Mtime)
+		require.Equal(t, ctime.UnixNano(), ei.Ctime)
+	}
+	written := clock.Now()
+	requireTimes(written, written)
+
+	t.Log("Zero-length writes don't change the times")
+	clock.Add(time.Minute)
+	err = kbfsOps.Write(ctx, fileNode, nil, 0)
+	require.NoError(t, err)
+	requireTimes(written, written)
+
+	t.Log("Same-size truncates do")
+	clock.Add(time.Minute)
+	err = kbfsOps.Truncate(ctx, fileNode, 2)
+	require.NoError(t, err)
+	truncated := clock.Now()
+	requireTimes(truncated, truncated)
+
+	t.Log("So do no-op setexes, for the ctime")
+	clock.Add(time.Minute)
+	err = kbfsOps.SetEx(ctx, fileNode, false)
+	require.NoError(t, err)
+	requireTimes(truncated, clock.Now())
+
+	t.Log("A requested ctime is ignored")
+	clock.Add(time.Minute)
+	err = kbfsOps.SetTimes(ctx, fileNode, written, &written)
+	require.NoError(t, err)
+	requireTimes(written, clock.Now())
+
+	t.Log("Reads update the atime")
+	md, err := kbfsOps.GetNodeMetadata(ctx, fileNode)
+	require.NoError(t, err)
+	require.True(t, md.Atime.IsZero())
+	clock.Add(time.Minute)
+	_, err = kbfsOps.Read(ctx, fileNode, make([]byte, 2), 0)
+	require.NoError(t, err)
+	md, err = kbfsOps.GetNodeMetadata(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, clock.Now(), md.Atime)
+}
+
+func TestKBFSOpsEarlyBlockUpload(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+	config.SetEarlyBlockUploadEnabled(true)
+	<-config.BlockOps().TogglePrefetcher(false)
+
+	// Use the smallest possible block size.
+	bsplitter, err := NewBlockSplitterSimple(20, 8*1024, config.Codec())
+	require.NoError(t, err)
+	config.SetBlockSplitter(bsplitter)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	t.Log("Write the file sequentially, so earlier blocks get put early")
+	var data []byte
+	for i := 0; i < 20; i++ {
+		chunk := make([]byte, 50)
+		for j := range chunk {
+			chunk[j] = byte(i)
+		}
+		err = kbfsOps.Write(ctx, fileNode, chunk, int64(len(data)))
+		require.NoError(t, err)
+		data = append(data, chunk...)
+	}
+	ops := getOps(config, fb.Tlf)
+	filePtr := fileNode.(*nodeStandard).core.pathNode.BlockPointer
+	numEarly := func() int {
+		lState := makeFBOLockState()
+		ops.blocks.blockLock.RLock(lState)
+		defer ops.blocks.blockLock.RUnlock(lState)
+		df := ops.blocks.dirtyFiles[filePtr]
+		require.NotNil(t, df)
+		df.lock.Lock()
+		defer df.lock.Unlock()
+		return len(df.earlyReadied)
+	}
+	early := numEarly()
+	require.True(t, early > 0)
+
+	t.Log("Overwriting an early block invalidates its early put")
+	err = kbfsOps.Write(ctx, fileNode, []byte{42}, 0)
+	require.NoError(t, err)
+	data[0] = 42
+	require.Equal(t, early-1, numEarly())
+
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	err = ops.blocks.earlyPuts.Wait(ctx)
+	require.NoError(t, err)
+
+	t.Log("Read the file back from the server")
+	config.ResetCaches()
+	fileNode, _, err = kbfsOps.Lookup(ctx, rootNode, "a")
+	require.NoError(t, err)
+	buf := make([]byte, len(data))
+	n, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, data, buf[:n])
+}
+
+func TestKBFSOpsFastForwardAllNodesInBatches(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, u1)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, "u1", tlf.Private)
+	kbfsOps1 := config1.KBFSOps()
+	fb := rootNode1.GetFolderBranch()
+
+	t.Log("Cache more nodes than fit in one fast-forward batch")
+	dirNode1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "a")
+	require.NoError(t, err)
+	var fileNodes1 []Node
+	for i := 0; i < fastForwardBatchSize+10; i++ {
+		n, _, err := kbfsOps1.CreateFile(
+			ctx, dirNode1, fmt.Sprintf("f%d", i), false, NoExcl)
+		require.NoError(t, err)
+		fileNodes1 = append(fileNodes1, n)
+	}
+	goneNode1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "gone")
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	c, err := DisableUpdatesForTesting(config1, fb)
+	require.NoError(t, err)
+	defer func() { c <- struct{}{} }()
+
+	t.Log("Change the TLF from another device")
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "u1", tlf.Private)
+	kbfsOps2 := config2.KBFSOps()
+	dirNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, dirNode2, "f0")
+	require.NoError(t, err)
+	err = kbfsOps2.Write(ctx, fileNode2, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps2.RemoveDir(ctx, rootNode2, "gone")
+	require.NoError(t, err)
+	err = kbfsOps2.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	t.Log("Fast-forward the first device's nodes to the new head")
+	md, err := config1.MDOps().GetForTLF(ctx, fb.Tlf, nil)
+	require.NoError(t, err)
+	ops := getOps(config1, fb.Tlf)
+	lState := makeFBOLockState()
+	ops.mdWriterLock.Lock(lState)
+	changes, affectedNodeIDs, err := ops.blocks.FastForwardAllNodes(
+		ctx, lState, md.ReadOnlyRootMetadata)
+	ops.mdWriterLock.Unlock(lState)
+	require.NoError(t, err)
+	// The root, the dir and all its files.
+	require.Len(t, changes, len(fileNodes1)+2)
+	require.Len(t, affectedNodeIDs, len(fileNodes1)+2)
+
+	require.Equal(t, md.data.Dir.BlockPointer,
+		rootNode1.(*nodeStandard).core.pathNode.BlockPointer)
+	require.Equal(t, fileNode2.(*nodeStandard).core.pathNode.BlockPointer,
+		fileNodes1[0].(*nodeStandard).core.pathNode.BlockPointer)
+	require.True(t, ops.nodeCache.IsUnlinked(goneNode1))
+	require.False(t, ops.nodeCache.IsUnlinked(dirNode1))
+}
+
+func TestKBFSOpsApplyCachedRevisionsInsteadOfFastForward(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, u1)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, "u1", tlf.Private)
+	kbfsOps1 := config1.KBFSOps()
+	fb := rootNode1.GetFolderBranch()
+	fileNode1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	c, err := DisableUpdatesForTesting(config1, fb)
+	require.NoError(t, err)
+	defer func() { c <- struct{}{} }()
+
+	t.Log("Make two new revisions from another device")
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "u1", tlf.Private)
+	kbfsOps2 := config2.KBFSOps()
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		err = kbfsOps2.Write(ctx, fileNode2, []byte{byte(i)}, int64(i))
+		require.NoError(t, err)
+		err = kbfsOps2.SyncAll(ctx, fb)
+		require.NoError(t, err)
+	}
+
+	ops := getOps(config1, fb.Tlf)
+	lState := makeFBOLockState()
+	currHead, err := config1.MDOps().GetForTLF(ctx, fb.Tlf, nil)
+	require.NoError(t, err)
+	getCached := func() []ImmutableRootMetadata {
+		ops.mdWriterLock.Lock(lState)
+		defer ops.mdWriterLock.Unlock(lState)
+		ops.headLock.Lock(lState)
+		defer ops.headLock.Unlock(lState)
+		return ops.getCachedMergedMDsLocked(ctx, lState, currHead)
+	}
+
+	t.Log("The intermediate revision isn't cached yet")
+	startRev := ops.getCurrMDRevision(lState) + 1
+	require.Nil(t, getCached())
+
+	t.Log("Once it's cached, all revisions are applied in order")
+	_, err = getMergedMDUpdates(ctx, config1, fb.Tlf, startRev, nil)
+	require.NoError(t, err)
+	rmds := getCached()
+	require.Len(t, rmds, 2)
+	require.Equal(t, startRev, rmds[0].Revision())
+	require.Equal(t, currHead.Revision(), rmds[1].Revision())
+
+	func() {
+		ops.mdWriterLock.Lock(lState)
+		defer ops.mdWriterLock.Unlock(lState)
+		ops.headLock.Lock(lState)
+		defer ops.headLock.Unlock(lState)
+		err = ops.applyMergedMDUpdatesLocked(ctx, lState, rmds)
+	}()
+	require.NoError(t, err)
+	require.Equal(t, currHead.Revision(), ops.getCurrMDRevision(lState))
+	require.Equal(t, fileNode2.(*nodeStandard).core.pathNode.BlockPointer,
+		fileNode1.(*nodeStandard).core.pathNode.BlockPointer)
+}
+
+func TestKBFSOpsSearchForNodesUsesParentIndex(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	fileNode, _, err := kbfsOps.CreateFile(ctx, dirNode, "f", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	ops := getOps(config, fb.Tlf)
+	lState := makeFBOLockState()
+	ptrOf := func(n Node) BlockPointer {
+		return n.(*nodeStandard).core.pathNode.BlockPointer
+	}
+	search := func(newPtrs map[BlockPointer]bool) Node {
+		md, _ := ops.getHead(lState)
+		filePtr := ptrOf(fileNode)
+		nodeMap, _, err := ops.blocks.SearchForNodes(
+			ctx, ops.nodeCache, []BlockPointer{filePtr}, newPtrs, md,
+			md.data.Dir.BlockPointer)
+		require.NoError(t, err)
+		return nodeMap[filePtr]
+	}
+
+	t.Log("Without updated dirs, a search can't find an unindexed file")
+	ops.blocks.parentIndex.Purge()
+	require.Nil(t, search(nil))
+
+	t.Log("Walking the updated dirs indexes their entries")
+	require.Equal(t, fileNode, search(
+		map[BlockPointer]bool{ptrOf(dirNode): true}))
+	require.Equal(t, fileNode, search(nil))
+
+	t.Log("The index follows the pointers through a sync")
+	err = kbfsOps.Write(ctx, fileNode, []byte{1}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, fileNode, search(nil))
+}
+
+func TestKBFSOpsRevalidateNodes(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	t.Log("Simulate missed invalidations in the node cache")
+	ops := getOps(config, fb.Tlf)
+	lState := makeFBOLockState()
+	filePtr := fileNode.(*nodeStandard).core.pathNode.BlockPointer
+	stalePtr := makeRandomBlockPointer(t)
+	ops.nodeCache.UpdatePointer(filePtr.Ref(), stalePtr)
+	ghostNode, err := ops.nodeCache.GetOrCreate(
+		makeRandomBlockPointer(t), "ghost", rootNode)
+	require.NoError(t, err)
+
+	t.Log("Revalidation heals both nodes")
+	err = ops.revalidateNodeSample(ctx, lState)
+	require.NoError(t, err)
+	require.Equal(t, filePtr,
+		fileNode.(*nodeStandard).core.pathNode.BlockPointer)
+	require.True(t, ops.nodeCache.IsUnlinked(ghostNode))
+	require.False(t, ops.nodeCache.IsUnlinked(fileNode))
+
+	t.Log("A consistent cache needs no corrections")
+	md, _ := ops.getHead(lState)
+	updates, err := ops.blocks.RevalidateNodes(
+		ctx, lState, md, ops.nodeCache.AllNodes())
+	require.NoError(t, err)
+	require.Len(t, updates, 0)
+}
+
+func TestKBFSOpsCheckFreshness(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+	clock, now := newTestClockAndTimeNow()
+	config.SetClock(clock)
+	<-config.BlockOps().TogglePrefetcher(false)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	_, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	ops := getOps(config, fb.Tlf)
+	lState := makeFBOLockState()
+	md, _ := ops.getHead(lState)
+	rootPtr := md.data.Dir.BlockPointer
+	block, _, _, err := config.BlockCache().GetWithPrefetch(rootPtr)
+	require.NoError(t, err)
+
+	t.Log("A root that hasn't been fully synced isn't fresh")
+	err = config.BlockCache().PutWithPrefetch(
+		rootPtr, fb.Tlf, block, TransientEntry, NoPrefetch)
+	require.NoError(t, err)
+	err = ops.checkFreshness(ctx, lState)
+	require.NoError(t, err)
+	// Wait for the refresh of the root to finish.
+	ch := config.BlockOps().BlockRetriever().Request(ctx,
+		defaultOnDemandRequestPriority, md, rootPtr, &DirBlock{},
+		TransientEntry)
+	require.NoError(t, <-ch)
+	status, _, err := kbfsOps.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	require.True(t, status.LastFullyFresh.IsZero())
+
+	t.Log("Once it's fully synced, the check time is reported")
+	err = config.BlockCache().PutWithPrefetch(
+		rootPtr, fb.Tlf, block, TransientEntry, FinishedPrefetch)
+	require.NoError(t, err)
+	err = ops.checkFreshness(ctx, lState)
+	require.NoError(t, err)
+	status, _, err = kbfsOps.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	require.True(t, now.Equal(status.LastFullyFresh))
+}
+
+func TestKBFSOpsCancelSync(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+	config.noBGFlush = true
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	t.Log("Canceling when no sync is in flight is a no-op")
+	err = kbfsOps.CancelSync(ctx, fileNode)
+	require.NoError(t, err)
+
+	t.Log("Start a sync that gets stuck putting blocks")
+	err = kbfsOps.Write(ctx, fileNode, []byte{1}, 0)
+	require.NoError(t, err)
+	bserv := config.BlockServer()
+	onPutStalledCh, putUnstallCh, putCtx :=
+		StallBlockOp(ctx, config, StallableBlockPut, 1)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- kbfsOps.SyncAll(putCtx, fb)
+	}()
+	select {
+	case <-onPutStalledCh:
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	}
+	err = kbfsOps.Write(ctx, fileNode, []byte{2}, 1)
+	require.NoError(t, err)
+
+	t.Log("Cancel it")
+	err = kbfsOps.CancelSync(ctx, fileNode)
+	require.NoError(t, err)
+	close(putUnstallCh)
+	err = <-errChan
+	require.Equal(t, context.Canceled, errors.Cause(err))
+	// The state checker needs the local block server at shutdown.
+	config.SetBlockServer(bserv)
+
+	t.Log("The file is still dirty, with both writes")
+	ops := getOps(config, fb.Tlf)
+	lState := makeFBOLockState()
+	require.True(t, ops.blocks.IsDirty(
+		lState, ops.nodeCache.PathFromNode(fileNode)))
+	data := make([]byte, 2)
+	_, err = kbfsOps.Read(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2}, data)
+
+	t.Log("The next syncs go through")
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	// Like after a recoverable block error, the write deferred
+	// during the canceled sync is only replayed once the retried
+	// sync is done, so it takes one more.
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	require.False(t, ops.blocks.IsDirty(
+		lState, ops.nodeCache.PathFromNode(fileNode)))
+	require.Len(t, ops.blocks.syncCancelers, 0)
+
+	config2 := ConfigAsUser(config, u1)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "u1", tlf.Private)
+	fileNode2, _, err := config2.KBFSOps().Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	data = make([]byte, 2)
+	_, err = config2.KBFSOps().Read(ctx, fileNode2, data, 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2}, data)
+}
+
+type testSyncObserver struct {
+	c chan<- error
+}
+
+func (t *testSyncObserver) LocalChange(ctx context.Context, node Node,
+	write WriteRange) {
+	// ignore
+}
+
+func (t *testSyncObserver) BatchChanges(ctx context.Context,
+	changes []NodeChange, allAffectedNodeIDs []NodeID) {
+	// ignore
+}
+
+func (t *testSyncObserver) TlfHandleChange(ctx context.Context,
+	newHandle *TlfHandle) {
+	// ignore
+}
+
+func (t *testSyncObserver) SyncAllDone(ctx context.Context,
+	ticket SyncTicket, err error) {
+	t.c <- err
+}
+
+func TestKBFSOpsSyncAllAsync(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	c := make(chan error, 1)
+	obs := &testSyncObserver{c}
+	err := config.Notifier().RegisterForChanges([]FolderBranch{fb}, obs)
+	require.NoError(t, err)
+	defer func() {
+		err := config.Notifier().UnregisterFromChanges(
+			[]FolderBranch{fb}, obs)
+		require.NoError(t, err)
+	}()
+
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+
+	t.Log("Each async sync gets a new ticket and reports its result")
+	ticket1, err := kbfsOps.SyncAllAsync(ctx, fb)
+	require.NoError(t, err)
+	require.NoError(t, <-c)
+	ticket2, err := kbfsOps.SyncAllAsync(ctx, fb)
+	require.NoError(t, err)
+	require.NoError(t, <-c)
+	require.True(t, ticket2 > ticket1)
+
+	ops := getOps(config, fb.Tlf)
+	err = ops.asyncSyncs.Wait(ctx)
+	require.NoError(t, err)
+	lState := makeFBOLockState()
+	require.Equal(t, cleanState, ops.blocks.GetState(lState))
+}
+
+func TestKBFSOpsWriteThrough(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	lockNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "lock", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	ops := getOps(config, fb.Tlf)
+	lState := makeFBOLockState()
+	isDirty := func() bool {
+		ops.mdWriterLock.Lock(lState)
+		defer ops.mdWriterLock.Unlock(lState)
+		return ops.isFileDirtyLocked(lState, lockNode)
+	}
+
+	t.Log("Writes are buffered by default")
+	err = kbfsOps.Write(ctx, lockNode, []byte{1}, 0)
+	require.NoError(t, err)
+	require.True(t, isDirty())
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	t.Log("Writes and truncates to a write-through file are synced")
+	err = kbfsOps.SetWriteThrough(ctx, lockNode, true)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, lockNode, []byte{2, 3}, 0)
+	require.NoError(t, err)
+	require.False(t, isDirty())
+	err = kbfsOps.Truncate(ctx, lockNode, 1)
+	require.NoError(t, err)
+	require.False(t, isDirty())
+
+	t.Log("Turning it off buffers writes again")
+	err = kbfsOps.SetWriteThrough(ctx, lockNode, false)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, lockNode, []byte{4}, 0)
+	require.NoError(t, err)
+	require.True(t, isDirty())
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+}
+
+func TestKBFSOpsWalkTLF(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	aNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	bNode, _, err := kbfsOps.CreateDir(ctx, aNode, "b")
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, bNode, "c", false, NoExcl)
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "e", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	walk := func(dir Node, skip string) []string {
+		var lock sync.Mutex
+		var paths []string
+		err := kbfsOps.WalkTLF(ctx, dir,
+			func(relPath string, de DirEntry) error {
+				lock.Lock()
+				defer lock.Unlock()
+				paths = append(paths, relPath)
+				if relPath == skip {
+					return filepath.SkipDir
+				}
+				return nil
+			})
+		require.NoError(t, err)
+		sort.Strings(paths)
+		return paths
+	}
+
+	t.Log("Walk the whole TLF")
+	require.Equal(t, []string{"a", "a/b", "a/b/c", "d", "e"},
+		walk(rootNode, ""))
+
+	t.Log("Walk a subtree")
+	require.Equal(t, []string{"b", "b/c"}, walk(aNode, ""))
+
+	t.Log("Skip a directory")
+	require.Equal(t, []string{"a", "a/b", "d", "e"}, walk(rootNode, "a/b"))
+
+	t.Log("Errors from the callback stop the walk")
+	errStop := errors.New("stop")
+	err = kbfsOps.WalkTLF(ctx, rootNode,
+		func(relPath string, de DirEntry) error {
+			return errStop
+		})
+	require.Equal(t, errStop, errors.Cause(err))
+}
+
+func TestKBFSOpsGetAllocatedSize(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	data := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+
+	t.Log("A file without holes is fully allocated")
+	aNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, aNode, data, 0)
+	require.NoError(t, err)
+	allocated, err := kbfsOps.GetAllocatedSize(ctx, aNode)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(data)), allocated)
+
+	t.Log("Extending a file with a truncate leaves a hole")
+	bNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, bNode, data, 0)
+	require.NoError(t, err)
+	const size = 1 << 20
+	err = kbfsOps.Truncate(ctx, bNode, size)
+	require.NoError(t, err)
+	allocated, err = kbfsOps.GetAllocatedSize(ctx, bNode)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(data)), allocated)
+
+	t.Log("Once synced, the estimate is rounded up to the block padding")
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	allocated, err = kbfsOps.GetAllocatedSize(ctx, bNode)
+	require.NoError(t, err)
+	require.True(t, allocated >= uint64(len(data)))
+	require.True(t, allocated < 64*1024, "allocated=%d", allocated)
+	ei, err := kbfsOps.Stat(ctx, bNode)
+	require.NoError(t, err)
+	require.Equal(t, uint64(size), ei.Size)
+
+	t.Log("The clean file's estimate is cached")
+	ops := getOps(config, fb.Tlf)
+	require.Equal(t, 1, ops.blocks.allocatedSizes.Len())
+	allocated2, err := kbfsOps.GetAllocatedSize(ctx, bNode)
+	require.NoError(t, err)
+	require.Equal(t, allocated, allocated2)
+}
+
+func TestKBFSOpsFileAndDirLimits(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	require.Equal(t, uint64(math.MaxInt64), config.MaxFileBytes(fb.Tlf))
+
+	t.Log("Writes and truncates past the file limit fail early")
+	config.SetMaxFileBytes(fb.Tlf, 10)
+	aNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, aNode, make([]byte, 10), 0)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, aNode, []byte{1}, 10)
+	_, ok := errors.Cause(err).(FileTooBigError)
+	require.True(t, ok, "err=%+v", err)
+	err = kbfsOps.Truncate(ctx, aNode, 11)
+	_, ok = errors.Cause(err).(FileTooBigError)
+	require.True(t, ok, "err=%+v", err)
+	ei, err := kbfsOps.Stat(ctx, aNode)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), ei.Size)
+
+	t.Log("New entries past the directory limit fail")
+	config.SetMaxDirEntries(fb.Tlf, 2)
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl)
+	_, ok = errors.Cause(err).(DirTooManyEntriesError)
+	require.True(t, ok, "err=%+v", err)
+	t.Log("Renames within a full directory are still allowed")
+	err = kbfsOps.Rename(ctx, rootNode, "a", rootNode, "b")
+	require.NoError(t, err)
+
+	t.Log("Moving an entry into a full directory fails")
+	_, _, err = kbfsOps.CreateFile(ctx, dirNode, "c", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Rename(ctx, dirNode, "c", rootNode, "c")
+	_, ok = errors.Cause(err).(DirTooManyEntriesError)
+	require.True(t, ok, "err=%+v", err)
+
+	t.Log("Removing an entry makes room again")
+	err = kbfsOps.RemoveEntry(ctx, rootNode, "b")
+	require.NoError(t, err)
+	err = kbfsOps.Rename(ctx, dirNode, "c", rootNode, "c")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	t.Log("The limits only apply to their own TLF")
+	rootNode2 := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Public)
+	for _, name := range []string{"a", "b", "c"} {
+		_, _, err = kbfsOps.CreateFile(ctx, rootNode2, name, false, NoExcl)
+		require.NoError(t, err)
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+}
+
+func TestKBFSOpsPathAccess(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+
+	kbfsOps := config.KBFSOps()
+	root := "/keybase/private/u1"
+
+	t.Log("Writing a new file creates the TLF and the file")
+	err := kbfsOps.WriteFileAt(ctx, root+"/a", []byte{1, 2, 3})
+	require.NoError(t, err)
+	data, err := kbfsOps.ReadFileAt(ctx, root+"/a")
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2, 3}, data)
+
+	t.Log("Rewriting a file replaces its contents")
+	err = kbfsOps.WriteFileAt(ctx, root+"/a", []byte{4})
+	require.NoError(t, err)
+	ei, err := kbfsOps.StatAt(ctx, root+"/a")
+	require.NoError(t, err)
+	require.Equal(t, File, ei.Type)
+	require.Equal(t, uint64(1), ei.Size)
+
+	t.Log("Paths through symlinks are followed")
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	_, err = kbfsOps.CreateLink(ctx, dirNode, "up", "..")
+	require.NoError(t, err)
+	err = kbfsOps.WriteFileAt(ctx, root+"/d/up/d/b", []byte{5})
+	require.NoError(t, err)
+	children, err := kbfsOps.ListAt(ctx, root+"/d")
+	require.NoError(t, err)
+	require.Len(t, children, 2)
+	require.Equal(t, Sym, children["up"].Type)
+	require.Equal(t, File, children["b"].Type)
+	data, err = kbfsOps.ReadFileAt(ctx, root+"/d/up/a")
+	require.NoError(t, err)
+	require.Equal(t, []byte{4}, data)
+
+	t.Log("Missing entries and bad paths fail")
+	_, err = kbfsOps.StatAt(ctx, root+"/missing")
+	_, ok := errors.Cause(err).(NoSuchNameError)
+	require.True(t, ok, "err=%+v", err)
+	_, err = kbfsOps.StatAt(ctx, "/keybase/private")
+	require.Error(t, err)
+	_, err = kbfsOps.StatAt(ctx, "/tmp/u1/a")
+	require.Error(t, err)
+}
+
+func TestKBFSOpsStatMany(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+
+	kbfsOps := config.KBFSOps()
+	root := "/keybase/private/u1"
+	err := kbfsOps.WriteFileAt(ctx, root+"/a", []byte{1})
+	require.NoError(t, err)
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	_, err = kbfsOps.CreateLink(ctx, rootNode, "l", "d")
+	require.NoError(t, err)
+	err = kbfsOps.WriteFileAt(ctx, root+"/d/b", []byte{2, 3})
+	require.NoError(t, err)
+
+	paths := []string{
+		root,
+		root + "/a",
+		root + "/l",
+		root + "/d/b",
+		root + "/l/b",
+		root + "/missing",
+		root + "/missing/c",
+		root + "/a/c",
+	}
+	entries, err := kbfsOps.StatMany(ctx, paths)
+	require.NoError(t, err)
+	require.Len(t, entries, 5)
+	require.Equal(t, Dir, entries[root].Type)
+	require.Equal(t, File, entries[root+"/a"].Type)
+	require.Equal(t, Sym, entries[root+"/l"].Type)
+	require.Equal(t, "d", entries[root+"/l"].SymPath)
+	require.Equal(t, uint64(2), entries[root+"/d/b"].Size)
+	require.Equal(t, entries[root+"/d/b"], entries[root+"/l/b"])
+}
+
+func TestKBFSOpsWatch(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+
+	kbfsOps := config.KBFSOps()
+	root := "/keybase/private/u1"
+	err := kbfsOps.WriteFileAt(ctx, root+"/a", nil)
+	require.NoError(t, err)
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	fb := rootNode.GetFolderBranch()
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	session, err := config.KBPKI().GetCurrentSession(ctx)
+	require.NoError(t, err)
+
+	topCh := make(chan WatchEvent, 10)
+	unwatchTop, err := kbfsOps.Watch(
+		ctx, root, false, WatchCreate|WatchDelete,
+		func(event WatchEvent) { topCh <- event })
+	require.NoError(t, err)
+	allCh := make(chan WatchEvent, 10)
+	unwatchAll, err := kbfsOps.Watch(
+		ctx, root, true, WatchAllEvents,
+		func(event WatchEvent) { allCh <- event })
+	require.NoError(t, err)
+	defer unwatchAll()
+
+	waitForEvent := func(ch chan WatchEvent, eventType WatchEventType,
+		p string) WatchEvent {
+		select {
+		case event := <-ch:
+			require.Equal(t, eventType, event.Type)
+			require.Equal(t, p, event.Path)
+			require.Equal(t, session.UID, event.Writer)
+			return event
+		case <-ctx.Done():
+			t.Fatal(ctx.Err())
+		}
+		return WatchEvent{}
+	}
+
+	t.Log("Creates in the directory reach both watches")
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	topEvent := waitForEvent(topCh, WatchCreate, root+"/b")
+	allEvent := waitForEvent(allCh, WatchCreate, root+"/b")
+	require.Equal(t, topEvent, allEvent)
+	require.Equal(t, File, allEvent.EntryType)
+
+	t.Log("Changes in subdirectories reach only the recursive watch")
+	_, _, err = kbfsOps.CreateFile(ctx, dirNode, "c", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	createEvent := waitForEvent(allCh, WatchCreate, root+"/d/c")
+	err = kbfsOps.WriteFileAt(ctx, root+"/d/c", []byte{1})
+	require.NoError(t, err)
+	modifyEvent := waitForEvent(allCh, WatchModify, root+"/d/c")
+	require.True(t, modifyEvent.Revision > createEvent.Revision)
+	err = kbfsOps.Rename(ctx, rootNode, "a", dirNode, "e")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	renameEvent := waitForEvent(allCh, WatchRename, root+"/d/e")
+	require.Equal(t, root+"/a", renameEvent.OldPath)
+
+	t.Log("Removed watches get no more events")
+	unwatchTop()
+	err = kbfsOps.RemoveEntry(ctx, rootNode, "b")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	waitForEvent(allCh, WatchDelete, root+"/b")
+	require.Len(t, topCh, 0)
+}
+
+func TestKBFSOpsInstantiateTemplate(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+
+	// Use a block size with room for a few pointers per block.
+	bsplitter, err := NewBlockSplitterSimple(1024, 8*1024, config.Codec())
+	require.NoError(t, err)
+	config.SetBlockSplitter(bsplitter)
+
+	t.Log("Make a template with a file, a big file, an exec file, " +
+		"and a symlink")
+	kbfsOps := config.KBFSOps()
+	root := "/keybase/private/u1"
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	tmplNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "tmpl")
+	require.NoError(t, err)
+	err = kbfsOps.WriteFileAt(ctx, root+"/tmpl/a", []byte{1, 2, 3})
+	require.NoError(t, err)
+	bigData := make([]byte, 3*int(bsplitter.maxSize)+10)
+	for i := range bigData {
+		bigData[i] = byte(i)
+	}
+	err = kbfsOps.WriteFileAt(ctx, root+"/tmpl/big", bigData)
+	require.NoError(t, err)
+	subNode, _, err := kbfsOps.CreateDir(ctx, tmplNode, "sub")
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFiles(ctx, subNode, []NewFileInfo{
+		{Name: "b", IsExec: true, Data: []byte{4}},
+	})
+	require.NoError(t, err)
+	_, err = kbfsOps.CreateLink(ctx, tmplNode, "l", "a")
+	require.NoError(t, err)
+
+	bserverLocal, ok := config.BlockServer().(blockServerLocal)
+	require.True(t, ok)
+	fb := rootNode.GetFolderBranch()
+	preRefs, err := bserverLocal.getAllRefsForTest(ctx, fb.Tlf)
+	require.NoError(t, err)
+
+	t.Log("Instantiate it in a single revision")
+	ops := getOps(config, fb.Tlf)
+	lState := makeFBOLockState()
+	oldRev := ops.getCurrMDRevision(lState)
+	projNode, ei, err := kbfsOps.InstantiateTemplate(
+		ctx, tmplNode, rootNode, "proj")
+	require.NoError(t, err)
+	require.Equal(t, Dir, ei.Type)
+	require.Equal(t, oldRev+1, ops.getCurrMDRevision(lState))
+
+	data, err := kbfsOps.ReadFileAt(ctx, root+"/proj/l")
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2, 3}, data)
+	ei, err = kbfsOps.StatAt(ctx, root+"/proj/sub/b")
+	require.NoError(t, err)
+	require.Equal(t, Exec, ei.Type)
+	require.Equal(t, uint64(1), ei.Size)
+
+	t.Log("The file blocks are deduplicated against the template")
+	tmplA, _, err := kbfsOps.Lookup(ctx, tmplNode, "a")
+	require.NoError(t, err)
+	projA, _, err := kbfsOps.Lookup(ctx, projNode, "a")
+	require.NoError(t, err)
+	tmplDe, err := ops.statEntry(ctx, tmplA)
+	require.NoError(t, err)
+	projDe, err := ops.statEntry(ctx, projA)
+	require.NoError(t, err)
+	require.Equal(t, tmplDe.ID, projDe.ID)
+	require.NotEqual(t, tmplDe.RefNonce, projDe.RefNonce)
+
+	t.Log("The leaves of the big file are shared with the template")
+	data, err = kbfsOps.ReadFileAt(ctx, root+"/proj/big")
+	require.NoError(t, err)
+	require.Equal(t, bigData, data)
+	postRefs, err := bserverLocal.getAllRefsForTest(ctx, fb.Tlf)
+	require.NoError(t, err)
+	shared := 0
+	for id, refs := range postRefs {
+		if oldRefs, ok := preRefs[id]; ok && len(refs) > len(oldRefs) {
+			shared++
+		}
+	}
+	require.True(t, shared > 2, "Only %d blocks shared", shared)
+
+	t.Log("Instantiating over an existing name fails")
+	_, _, err = kbfsOps.InstantiateTemplate(ctx, tmplNode, rootNode, "proj")
+	_, ok = errors.Cause(err).(NameExistsError)
+	require.True(t, ok, "err=%+v", err)
+}
+
+type failingPutMDOps struct {
+	MDOps
+	putErr error
+}
+
+func (mdops *failingPutMDOps) Put(ctx context.Context, rmd *RootMetadata,
+	verifyingKey kbfscrypto.VerifyingKey,
+	lockContext *keybase1.LockContext, priority keybase1.MDPriority) (
+	ImmutableRootMetadata, error) {
+	if mdops.putErr != nil {
+		return ImmutableRootMetadata{}, mdops.putErr
+	}
+	return mdops.MDOps.Put(ctx, rmd, verifyingKey, lockContext, priority)
+}
+
+// recordingPutBlockServer records the IDs of put blocks, and, like
+// the remote block server, never reports any existing blocks.
+type recordingPutBlockServer struct {
+	BlockServer
+
+	lock sync.Mutex
+	puts map[kbfsblock.ID]int
+}
+
+func (b *recordingPutBlockServer) Put(
+	ctx context.Context, tlfID tlf.ID, id kbfsblock.ID,
+	context kbfsblock.Context, buf []byte,
+	serverHalf kbfscrypto.BlockCryptKeyServerHalf) error {
+	b.lock.Lock()
+	b.puts[id]++
+	b.lock.Unlock()
+	return b.BlockServer.Put(ctx, tlfID, id, context, buf, serverHalf)
+}
+
+func (b *recordingPutBlockServer) takePuts() map[kbfsblock.ID]int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	puts := b.puts
+	b.puts = make(map[kbfsblock.ID]int)
+	return puts
+}
+
+func TestKBFSOpsSyncRetryReusesPutBlocks(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	// Use the smallest possible block size.
+	bsplitter, err := NewBlockSplitterSimple(20, 8*1024, config.Codec())
+	require.NoError(t, err)
+	config.SetBlockSplitter(bsplitter)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	bserv := &recordingPutBlockServer{
+		BlockServer: config.BlockServer(),
+		puts:        make(map[kbfsblock.ID]int),
+	}
+	config.SetBlockServer(bserv)
+	// The state checker needs the local block server at shutdown.
+	defer config.SetBlockServer(bserv.BlockServer)
+	mdops := &failingPutMDOps{MDOps: config.MDOps()}
+	config.SetMDOps(mdops)
+
+	t.Log("Write a multi-block file, and fail the MD put of its sync")
+	data := make([]byte, 200)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	mdops.putErr = errors.New("fake MD put failure")
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.Equal(t, mdops.putErr, errors.Cause(err))
+	failedPuts := bserv.takePuts()
+	require.True(t, len(failedPuts) > 1)
+
+	t.Log("The retry doesn't upload the file's blocks again")
+	mdops.putErr = nil
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	retryPuts := bserv.takePuts()
+	require.NotEmpty(t, retryPuts)
+	for id := range retryPuts {
+		require.Zero(t, failedPuts[id], "block %s put twice", id)
+	}
+
+	buf := make([]byte, len(data))
+	n, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, buf)
+}
+
+func TestKBFSOpsAdaptiveBlockSizes(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+	config.SetAdaptiveBlockSizes(tlf.NullID, true)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	ops := getOps(config, fb.Tlf)
+	numChildBlocks := func(n Node) int {
+		lState := makeFBOLockState()
+		md, _ := ops.getHead(lState)
+		infos, err := ops.blocks.GetIndirectFileBlockInfos(
+			ctx, lState, md, ops.nodeCache.PathFromNode(n))
+		require.NoError(t, err)
+		return len(infos)
+	}
+
+	t.Log("A file written by appending gets large blocks")
+	streamNode, _, err := kbfsOps.CreateFile(
+		ctx, rootNode, "stream", false, NoExcl)
+	require.NoError(t, err)
+	chunk := make([]byte, minTlfBlockSizeBytes)
+	for i := 0; i < 4; i++ {
+		err = kbfsOps.Write(ctx, streamNode, chunk, int64(i*len(chunk)))
+		require.NoError(t, err)
+	}
+
+	t.Log("A file written past its end gets small blocks")
+	randomNode, _, err := kbfsOps.CreateFile(
+		ctx, rootNode, "random", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, randomNode, chunk, int64(2*len(chunk)))
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, randomNode, chunk, 0)
+	require.NoError(t, err)
+
+	t.Log("A small file doesn't get a block size")
+	smallNode, _, err := kbfsOps.CreateFile(
+		ctx, rootNode, "small", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, smallNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	t.Log("The block sizes are recorded in the synced entries")
+	ei, err := kbfsOps.Stat(ctx, streamNode)
+	require.NoError(t, err)
+	require.Equal(t, int64(maxTlfBlockSizeBytes), ei.BlockSize)
+	require.Equal(t, 0, numChildBlocks(streamNode))
+	ei, err = kbfsOps.Stat(ctx, randomNode)
+	require.NoError(t, err)
+	require.Equal(t, int64(minTlfBlockSizeBytes), ei.BlockSize)
+	require.NotEqual(t, 0, numChildBlocks(randomNode))
+	ei, err = kbfsOps.Stat(ctx, smallNode)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), ei.BlockSize)
+
+	t.Log("Later appends keep the file's block size")
+	err = kbfsOps.Write(ctx, streamNode, chunk, int64(4*len(chunk)))
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	ei, err = kbfsOps.Stat(ctx, streamNode)
+	require.NoError(t, err)
+	require.Equal(t, int64(maxTlfBlockSizeBytes), ei.BlockSize)
+	require.Equal(t, uint64(5*len(chunk)), ei.Size)
+	require.Equal(t, 0, numChildBlocks(streamNode))
+}
+
+func TestKBFSOpsGetFileBlockLayout(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := make([]byte, 4*minTlfBlockSizeBytes)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+
+	checkLayout := func(dirty bool) {
+		layout, err := kbfsOps.GetFileBlockLayout(ctx, fileNode)
+		require.NoError(t, err)
+		require.Equal(t, uint64(len(data)), layout.Size)
+		require.Equal(t, 1, layout.Depth)
+		require.Equal(t, 1+len(layout.Root.Children), layout.NumBlocks)
+		require.Equal(t, dirty, layout.Root.Dirty)
+		var total int
+		var off int64
+		for _, child := range layout.Root.Children {
+			require.Equal(t, 1, child.Depth)
+			require.Equal(t, off, child.Off)
+			require.Equal(t, dirty, child.Dirty)
+			if !dirty {
+				require.NotZero(t, child.EncodedSize)
+			}
+			total += child.DataSize
+			off += int64(child.DataSize)
+		}
+		require.Equal(t, len(data), total)
+	}
+
+	t.Log("The layout includes dirty blocks")
+	checkLayout(true)
+
+	t.Log("And synced ones")
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	checkLayout(false)
+
+	t.Log("A fresh device doesn't fetch the leaf blocks")
+	config2 := ConfigAsUser(config, u1)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	<-config2.BlockOps().TogglePrefetcher(false)
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "u1", tlf.Private)
+	fileNode2, _, err := config2.KBFSOps().Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	layout2, err := config2.KBFSOps().GetFileBlockLayout(ctx, fileNode2)
+	require.NoError(t, err)
+	require.NotEmpty(t, layout2.Root.Children)
+	for _, child := range layout2.Root.Children {
+		require.NotZero(t, child.DataSize)
+		_, err := config2.BlockCache().Get(BlockPointer{ID: child.ID})
+		require.Error(t, err)
+	}
+
+	t.Log("Directories don't have a file layout")
+	_, err = kbfsOps.GetFileBlockLayout(ctx, rootNode)
+	require.IsType(t, NotFileError{}, errors.Cause(err))
+}
+
+func TestKBFSOpsCorruptionDegradesOnlyThatFolder(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	aNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, aNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	t.Log("Corrupt the entry for the file in the cached root block")
+	ops := getOps(config, fb.Tlf)
+	rootPtr := ops.nodeCache.PathFromNode(rootNode).tailPointer()
+	block, err := config.BlockCache().Get(rootPtr)
+	require.NoError(t, err)
+	dblock := block.(*DirBlock)
+	origDe := dblock.Children["a"]
+	// Put the original entry back for the state checker at shutdown.
+	defer func() { dblock.Children["a"] = origDe }()
+	de := origDe
+	de.ID = kbfsblock.FakeID(42)
+	de.DataVer = FirstValidDataVer - 1
+	dblock.Children["a"] = de
+
+	t.Log("Reading the file fails with a corruption error")
+	bNode, _, err := kbfsOps.Lookup(ctx, rootNode, "a")
+	require.NoError(t, err)
+	buf := make([]byte, 3)
+	_, err = kbfsOps.Read(ctx, bNode, buf, 0)
+	require.IsType(t, FolderCorruptionError{}, errors.Cause(err))
+	status, _, err := kbfsOps.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	require.NotEmpty(t, status.Degraded)
+
+	t.Log("The degraded folder refuses writes")
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl)
+	require.IsType(t, FolderCorruptionError{}, errors.Cause(err))
+
+	t.Log("Other folders are still usable")
+	pubRootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Public)
+	_, _, err = kbfsOps.CreateFile(ctx, pubRootNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, pubRootNode.GetFolderBranch())
+	require.NoError(t, err)
+	status, _, err = kbfsOps.FolderStatus(ctx, pubRootNode.GetFolderBranch())
+	require.NoError(t, err)
+	require.Empty(t, status.Degraded)
+}
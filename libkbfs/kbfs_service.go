@@ -60,6 +60,7 @@ func (eu KBFSErrorUnwrapper) UnwrapError(arg interface{}) (appError error,
 type kbfsServiceConfig interface {
 	diskBlockCacheGetter
 	logMaker
+	logLevelsGetter
 }
 
 // KBFSService represents a running KBFS service.
@@ -110,6 +111,7 @@ func (k *KBFSService) registerProtocols(
 	// TODO: fill in with actual protocols.
 	protocols := []rpc.Protocol{
 		kbgitkbfs.DiskBlockCacheProtocol(NewDiskBlockCacheService(k.config)),
+		kbgitkbfs.DebugLogProtocol(NewDebugLogService(k.config)),
 	}
 	for _, proto := range protocols {
 		if err := srv.Register(proto); err != nil {
@@ -371,6 +371,19 @@ func (k *KBPKIClient) GetTeamRootID(ctx context.Context, tid keybase1.TeamID) (
 	return teamInfo.RootID, nil
 }
 
+// GetTeamRole implements the KBPKI interface for KBPKIClient.
+func (k *KBPKIClient) GetTeamRole(
+	ctx context.Context, tid keybase1.TeamID, uid keybase1.UID) (
+	keybase1.TeamRole, error) {
+	teamInfo, err := k.serviceOwner.KeybaseService().LoadTeamPlusKeys(
+		ctx, tid, tlf.Unknown, kbfsmd.UnspecifiedKeyGen, keybase1.UserVersion{},
+		kbfscrypto.VerifyingKey{}, keybase1.TeamRole_NONE)
+	if err != nil {
+		return keybase1.TeamRole_NONE, err
+	}
+	return teamRole(teamInfo, uid), nil
+}
+
 // CreateTeamTLF implements the KBPKI interface for KBPKIClient.
 func (k *KBPKIClient) CreateTeamTLF(
 	ctx context.Context, teamID keybase1.TeamID, tlfID tlf.ID) error {
@@ -8,29 +8,28 @@ import (
 	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/kbfsmd"
 	"github.com/keybase/kbfs/tlf"
-	metrics "github.com/rcrowley/go-metrics"
 )
 
 // KeyCacheMeasured delegates to another KeyCache instance but
 // also keeps track of stats.
 type KeyCacheMeasured struct {
 	delegate      KeyCache
-	getTimer      metrics.Timer
-	putTimer      metrics.Timer
-	hitCountMeter metrics.Meter
+	getTimer      MetricsTimer
+	putTimer      MetricsTimer
+	hitCountMeter MetricsMeter
 }
 
 var _ KeyCache = KeyCacheMeasured{}
 
 // NewKeyCacheMeasured creates and returns a new KeyCacheMeasured
-// instance with the given delegate and registry.
-func NewKeyCacheMeasured(delegate KeyCache, r metrics.Registry) KeyCacheMeasured {
-	getTimer := metrics.GetOrRegisterTimer("KeyCache.GetTLFCryptKey", r)
-	putTimer := metrics.GetOrRegisterTimer("KeyCache.PutTLFCryptKey", r)
+// instance with the given delegate and metrics sink.
+func NewKeyCacheMeasured(delegate KeyCache, r MetricsSink) KeyCacheMeasured {
+	getTimer := r.Timer("KeyCache.GetTLFCryptKey")
+	putTimer := r.Timer("KeyCache.PutTLFCryptKey")
 	// TODO: Implement RatioGauge (
 	// http://metrics.dropwizard.io/3.1.0/manual/core/#ratio-gauges
 	// ) so we can actually display a hit ratio.
-	hitCountMeter := metrics.GetOrRegisterMeter("KeyCache.HitCount", r)
+	hitCountMeter := r.Meter("KeyCache.HitCount")
 	return KeyCacheMeasured{
 		delegate:      delegate,
 		getTimer:      getTimer,
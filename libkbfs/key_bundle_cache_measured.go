@@ -6,36 +6,35 @@ package libkbfs
 
 import (
 	"github.com/keybase/kbfs/kbfsmd"
-	metrics "github.com/rcrowley/go-metrics"
 )
 
 // KeyBundleCacheMeasured delegates to another KeyBundleCache instance but
 // also keeps track of stats.
 type KeyBundleCacheMeasured struct {
 	delegate                      kbfsmd.KeyBundleCache
-	getReaderBundleTimer          metrics.Timer
-	getWriterBundleTimer          metrics.Timer
-	putReaderBundleTimer          metrics.Timer
-	putWriterBundleTimer          metrics.Timer
-	hitReaderBundleCountMeter     metrics.Meter
-	hitWriterBundleCountMeter     metrics.Meter
-	attemptReaderBundleCountMeter metrics.Meter
-	attemptWriterBundleCountMeter metrics.Meter
+	getReaderBundleTimer          MetricsTimer
+	getWriterBundleTimer          MetricsTimer
+	putReaderBundleTimer          MetricsTimer
+	putWriterBundleTimer          MetricsTimer
+	hitReaderBundleCountMeter     MetricsMeter
+	hitWriterBundleCountMeter     MetricsMeter
+	attemptReaderBundleCountMeter MetricsMeter
+	attemptWriterBundleCountMeter MetricsMeter
 }
 
 var _ kbfsmd.KeyBundleCache = KeyBundleCacheMeasured{}
 
 // NewKeyBundleCacheMeasured creates and returns a new KeyBundleCacheMeasured
-// instance with the given delegate and registry.
-func NewKeyBundleCacheMeasured(delegate kbfsmd.KeyBundleCache, r metrics.Registry) KeyBundleCacheMeasured {
-	getReaderBundleTimer := metrics.GetOrRegisterTimer("KeyBundleCache.GetTLFReaderKeyBundle", r)
-	putReaderBundleTimer := metrics.GetOrRegisterTimer("KeyBundleCache.PutTLFReaderKeyBundle", r)
-	getWriterBundleTimer := metrics.GetOrRegisterTimer("KeyBundleCache.GetTLFWriterKeyBundle", r)
-	putWriterBundleTimer := metrics.GetOrRegisterTimer("KeyBundleCache.PutTLFWriterKeyBundle", r)
-	hitReaderBundleCountMeter := metrics.GetOrRegisterMeter("KeyBundleCache.TLFReaderKeyBundleHitCount", r)
-	hitWriterBundleCountMeter := metrics.GetOrRegisterMeter("KeyBundleCache.TLFWriterKeyBundleHitCount", r)
-	attemptReaderBundleCountMeter := metrics.GetOrRegisterMeter("KeyBundleCache.TLFReaderKeyBundleAttemptCount", r)
-	attemptWriterBundleCountMeter := metrics.GetOrRegisterMeter("KeyBundleCache.TLFWriterKeyBundleAttemptCount", r)
+// instance with the given delegate and metrics sink.
+func NewKeyBundleCacheMeasured(delegate kbfsmd.KeyBundleCache, r MetricsSink) KeyBundleCacheMeasured {
+	getReaderBundleTimer := r.Timer("KeyBundleCache.GetTLFReaderKeyBundle")
+	putReaderBundleTimer := r.Timer("KeyBundleCache.PutTLFReaderKeyBundle")
+	getWriterBundleTimer := r.Timer("KeyBundleCache.GetTLFWriterKeyBundle")
+	putWriterBundleTimer := r.Timer("KeyBundleCache.PutTLFWriterKeyBundle")
+	hitReaderBundleCountMeter := r.Meter("KeyBundleCache.TLFReaderKeyBundleHitCount")
+	hitWriterBundleCountMeter := r.Meter("KeyBundleCache.TLFWriterKeyBundleHitCount")
+	attemptReaderBundleCountMeter := r.Meter("KeyBundleCache.TLFReaderKeyBundleAttemptCount")
+	attemptWriterBundleCountMeter := r.Meter("KeyBundleCache.TLFWriterKeyBundleAttemptCount")
 	return KeyBundleCacheMeasured{
 		delegate:                      delegate,
 		getReaderBundleTimer:          getReaderBundleTimer,
@@ -8,7 +8,6 @@ import (
 	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/kbfsmd"
-	metrics "github.com/rcrowley/go-metrics"
 	"golang.org/x/net/context"
 )
 
@@ -16,19 +15,19 @@ import (
 // also keeps track of stats.
 type KeyServerMeasured struct {
 	delegate    KeyServer
-	getTimer    metrics.Timer
-	putTimer    metrics.Timer
-	deleteTimer metrics.Timer
+	getTimer    MetricsTimer
+	putTimer    MetricsTimer
+	deleteTimer MetricsTimer
 }
 
 var _ KeyServer = KeyServerMeasured{}
 
 // NewKeyServerMeasured creates and returns a new KeyServerMeasured
-// instance with the given delegate and registry.
-func NewKeyServerMeasured(delegate KeyServer, r metrics.Registry) KeyServerMeasured {
-	getTimer := metrics.GetOrRegisterTimer("KeyServer.GetTLFCryptKeyServerHalf", r)
-	putTimer := metrics.GetOrRegisterTimer("KeyServer.PutTLFCryptKeyServerHalves", r)
-	deleteTimer := metrics.GetOrRegisterTimer("KeyServer.DeleteTLFCryptKeyServerHalf", r)
+// instance with the given delegate and metrics sink.
+func NewKeyServerMeasured(delegate KeyServer, r MetricsSink) KeyServerMeasured {
+	getTimer := r.Timer("KeyServer.GetTLFCryptKeyServerHalf")
+	putTimer := r.Timer("KeyServer.PutTLFCryptKeyServerHalves")
+	deleteTimer := r.Timer("KeyServer.DeleteTLFCryptKeyServerHalf")
 	return KeyServerMeasured{
 		delegate:    delegate,
 		getTimer:    getTimer,
@@ -810,6 +810,28 @@ func (k *KeybaseDaemonLocal) addTeamReaderForTest(
 	return nil
 }
 
+func (k *KeybaseDaemonLocal) addTeamAdminForTest(
+	tid keybase1.TeamID, uid keybase1.UID) error {
+	err := k.addTeamWriterForTest(tid, uid)
+	if err != nil {
+		return err
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	t, err := k.localTeams.getLocalTeam(tid)
+	if err != nil {
+		return err
+	}
+
+	if t.Admins == nil {
+		t.Admins = make(map[keybase1.UID]bool)
+	}
+	t.Admins[uid] = true
+	k.localTeams[tid] = t
+	return nil
+}
+
 func (k *KeybaseDaemonLocal) addTeamKeyForTest(
 	tid keybase1.TeamID, newKeyGen kbfsmd.KeyGen,
 	newKey kbfscrypto.TLFCryptKey) error {
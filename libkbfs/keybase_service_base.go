@@ -828,6 +828,21 @@ func (k *KeybaseServiceBase) LoadTeamPlusKeys(
 	for _, user := range res.OnlyReaders {
 		info.Readers[user.Uid] = true
 	}
+	// Implicit teams have no admins beyond their writers.
+	info.Admins = make(map[keybase1.UID]bool)
+	if !res.Implicit {
+		details, err := k.teamsClient.TeamGet(
+			ctx, keybase1.TeamGetArg{Name: res.Name})
+		if err != nil {
+			return TeamInfo{}, err
+		}
+		for _, members := range [][]keybase1.TeamMemberDetails{
+			details.Members.Owners, details.Members.Admins} {
+			for _, member := range members {
+				info.Admins[member.Uv.Uid] = true
+			}
+		}
+	}
 
 	// For subteams, get the root team ID.
 	if tid.IsSubTeam() {
@@ -12,7 +12,6 @@ import (
 	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/kbfsmd"
 	"github.com/keybase/kbfs/tlf"
-	metrics "github.com/rcrowley/go-metrics"
 	"golang.org/x/net/context"
 )
 
@@ -20,50 +19,47 @@ import (
 // but also keeps track of stats.
 type KeybaseServiceMeasured struct {
 	delegate                         KeybaseService
-	resolveTimer                     metrics.Timer
-	identifyTimer                    metrics.Timer
-	resolveIdentifyImplicitTeamTimer metrics.Timer
-	resolveImplicitTeamByIDTimer     metrics.Timer
-	loadUserPlusKeysTimer            metrics.Timer
-	loadTeamPlusKeysTimer            metrics.Timer
-	createTeamTLFTimer               metrics.Timer
-	getTeamSettingsTimer             metrics.Timer
-	getCurrentMerkleRootTimer        metrics.Timer
-	verifyMerkleRootTimer            metrics.Timer
-	currentSessionTimer              metrics.Timer
-	favoriteAddTimer                 metrics.Timer
-	favoriteDeleteTimer              metrics.Timer
-	favoriteListTimer                metrics.Timer
-	notifyTimer                      metrics.Timer
-	notifyPathUpdatedTimer           metrics.Timer
-	putGitMetadataTimer              metrics.Timer
+	resolveTimer                     MetricsTimer
+	identifyTimer                    MetricsTimer
+	resolveIdentifyImplicitTeamTimer MetricsTimer
+	resolveImplicitTeamByIDTimer     MetricsTimer
+	loadUserPlusKeysTimer            MetricsTimer
+	loadTeamPlusKeysTimer            MetricsTimer
+	createTeamTLFTimer               MetricsTimer
+	getTeamSettingsTimer             MetricsTimer
+	getCurrentMerkleRootTimer        MetricsTimer
+	verifyMerkleRootTimer            MetricsTimer
+	currentSessionTimer              MetricsTimer
+	favoriteAddTimer                 MetricsTimer
+	favoriteDeleteTimer              MetricsTimer
+	favoriteListTimer                MetricsTimer
+	notifyTimer                      MetricsTimer
+	notifyPathUpdatedTimer           MetricsTimer
+	putGitMetadataTimer              MetricsTimer
 }
 
 var _ KeybaseService = KeybaseServiceMeasured{}
 
 // NewKeybaseServiceMeasured creates and returns a new KeybaseServiceMeasured
-// instance with the given delegate and registry.
-func NewKeybaseServiceMeasured(delegate KeybaseService, r metrics.Registry) KeybaseServiceMeasured {
-	resolveTimer := metrics.GetOrRegisterTimer("KeybaseService.Resolve", r)
-	identifyTimer := metrics.GetOrRegisterTimer("KeybaseService.Identify", r)
-	resolveIdentifyImplicitTeamTimer := metrics.GetOrRegisterTimer(
-		"KeybaseService.ResolveIdentifyImplicitTeam", r)
-	resolveImplicitTeamByIDTimer := metrics.GetOrRegisterTimer(
-		"KeybaseService.ResolveImplicitTeamByID", r)
-	loadUserPlusKeysTimer := metrics.GetOrRegisterTimer("KeybaseService.LoadUserPlusKeys", r)
-	loadTeamPlusKeysTimer := metrics.GetOrRegisterTimer("KeybaseService.LoadTeamPlusKeys", r)
-	createTeamTLFTimer := metrics.GetOrRegisterTimer("KeybaseService.CreateTeamTLF", r)
-	getTeamSettingsTimer := metrics.GetOrRegisterTimer("KeybaseService.GetTeamSettings", r)
-	getCurrentMerkleRootTimer := metrics.GetOrRegisterTimer("KeybaseService.GetCurrentMerkleRoot", r)
-	verifyMerkleRootTimer := metrics.GetOrRegisterTimer("KeybaseService.VerifyMerkleRoot", r)
-	currentSessionTimer := metrics.GetOrRegisterTimer("KeybaseService.CurrentSession", r)
-	favoriteAddTimer := metrics.GetOrRegisterTimer("KeybaseService.FavoriteAdd", r)
-	favoriteDeleteTimer := metrics.GetOrRegisterTimer("KeybaseService.FavoriteDelete", r)
-	favoriteListTimer := metrics.GetOrRegisterTimer("KeybaseService.FavoriteList", r)
-	notifyTimer := metrics.GetOrRegisterTimer("KeybaseService.Notify", r)
-	notifyPathUpdatedTimer := metrics.GetOrRegisterTimer("KeybaseService.NotifyPathUpdated", r)
-	putGitMetadataTimer := metrics.GetOrRegisterTimer(
-		"KeybaseService.PutGitMetadata", r)
+// instance with the given delegate and metrics sink.
+func NewKeybaseServiceMeasured(delegate KeybaseService, r MetricsSink) KeybaseServiceMeasured {
+	resolveTimer := r.Timer("KeybaseService.Resolve")
+	identifyTimer := r.Timer("KeybaseService.Identify")
+	resolveIdentifyImplicitTeamTimer := r.Timer("KeybaseService.ResolveIdentifyImplicitTeam")
+	resolveImplicitTeamByIDTimer := r.Timer("KeybaseService.ResolveImplicitTeamByID")
+	loadUserPlusKeysTimer := r.Timer("KeybaseService.LoadUserPlusKeys")
+	loadTeamPlusKeysTimer := r.Timer("KeybaseService.LoadTeamPlusKeys")
+	createTeamTLFTimer := r.Timer("KeybaseService.CreateTeamTLF")
+	getTeamSettingsTimer := r.Timer("KeybaseService.GetTeamSettings")
+	getCurrentMerkleRootTimer := r.Timer("KeybaseService.GetCurrentMerkleRoot")
+	verifyMerkleRootTimer := r.Timer("KeybaseService.VerifyMerkleRoot")
+	currentSessionTimer := r.Timer("KeybaseService.CurrentSession")
+	favoriteAddTimer := r.Timer("KeybaseService.FavoriteAdd")
+	favoriteDeleteTimer := r.Timer("KeybaseService.FavoriteDelete")
+	favoriteListTimer := r.Timer("KeybaseService.FavoriteList")
+	notifyTimer := r.Timer("KeybaseService.Notify")
+	notifyPathUpdatedTimer := r.Timer("KeybaseService.NotifyPathUpdated")
+	putGitMetadataTimer := r.Timer("KeybaseService.PutGitMetadata")
 	return KeybaseServiceMeasured{
 		delegate:                         delegate,
 		resolveTimer:                     resolveTimer,
@@ -0,0 +1,154 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LockProfileEntry holds the contention stats for a single operation
+// type (i.e., the function that took the lock).
+type LockProfileEntry struct {
+	// Acquisitions is the number of times the lock was obtained.
+	Acquisitions int64
+	// Waiting is the number of callers currently waiting on the
+	// lock.
+	Waiting int
+	// TotalWait and MaxWait describe how long callers waited to
+	// get the lock.
+	TotalWait time.Duration
+	MaxWait   time.Duration
+	// TotalHold and MaxHold describe how long callers held the
+	// lock once they got it.
+	TotalHold time.Duration
+	MaxHold   time.Duration
+}
+
+// LockProfiler records wait and hold times for a lock, broken down by
+// operation type.  It is disabled by default, in which case it costs
+// only an atomic load per lock operation.
+type LockProfiler struct {
+	enabled int32
+
+	lock    sync.Mutex
+	entries map[string]*LockProfileEntry
+}
+
+// NewLockProfiler constructs a new, disabled, LockProfiler.
+func NewLockProfiler() *LockProfiler {
+	return &LockProfiler{
+		entries: make(map[string]*LockProfileEntry),
+	}
+}
+
+// Enabled returns whether the profiler is currently recording.  It
+// is safe to call on a nil LockProfiler.
+func (lp *LockProfiler) Enabled() bool {
+	return lp != nil && atomic.LoadInt32(&lp.enabled) == 1
+}
+
+// SetEnabled turns recording on or off.  Enabling the profiler
+// clears any previously-recorded stats.
+func (lp *LockProfiler) SetEnabled(enabled bool) {
+	if enabled {
+		lp.Reset()
+		atomic.StoreInt32(&lp.enabled, 1)
+	} else {
+		atomic.StoreInt32(&lp.enabled, 0)
+	}
+}
+
+// Reset clears all the recorded stats.
+func (lp *LockProfiler) Reset() {
+	lp.lock.Lock()
+	defer lp.lock.Unlock()
+	lp.entries = make(map[string]*LockProfileEntry)
+}
+
+// Snapshot returns a copy of the currently-recorded stats, keyed by
+// operation type.
+func (lp *LockProfiler) Snapshot() map[string]LockProfileEntry {
+	lp.lock.Lock()
+	defer lp.lock.Unlock()
+	snapshot := make(map[string]LockProfileEntry, len(lp.entries))
+	for op, e := range lp.entries {
+		snapshot[op] = *e
+	}
+	return snapshot
+}
+
+// lock must be held by the caller.
+func (lp *LockProfiler) getEntryLocked(op string) *LockProfileEntry {
+	e, ok := lp.entries[op]
+	if !ok {
+		e = &LockProfileEntry{}
+		lp.entries[op] = e
+	}
+	return e
+}
+
+func (lp *LockProfiler) startWait(op string) time.Time {
+	lp.lock.Lock()
+	defer lp.lock.Unlock()
+	lp.getEntryLocked(op).Waiting++
+	return time.Now()
+}
+
+func (lp *LockProfiler) endWait(op string, start time.Time) time.Time {
+	now := time.Now()
+	wait := now.Sub(start)
+	lp.lock.Lock()
+	defer lp.lock.Unlock()
+	e := lp.getEntryLocked(op)
+	e.Waiting--
+	e.Acquisitions++
+	e.TotalWait += wait
+	if wait > e.MaxWait {
+		e.MaxWait = wait
+	}
+	return now
+}
+
+func (lp *LockProfiler) recordHold(op string, start time.Time) {
+	hold := time.Since(start)
+	lp.lock.Lock()
+	defer lp.lock.Unlock()
+	e := lp.getEntryLocked(op)
+	e.TotalHold += hold
+	if hold > e.MaxHold {
+		e.MaxHold = hold
+	}
+}
+
+// lockCallerOp returns a short name, like "folderBlockOps.Write", for
+// the function `skip` frames above the caller of lockCallerOp.
+func lockCallerOp(skip int) string {
+	pc, _, _, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return "unknown"
+	}
+	f := runtime.FuncForPC(pc)
+	if f == nil {
+		return "unknown"
+	}
+	name := f.Name()
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	if i := strings.Index(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	return strings.NewReplacer("(*", "", ")", "").Replace(name)
+}
+
+// lockHold tracks a single in-progress hold of a profiled lock.
+type lockHold struct {
+	op    string
+	start time.Time
+}
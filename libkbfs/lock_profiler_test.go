@@ -0,0 +1,69 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func lockBlockLockForTest(bl *blockLock, lState *lockState) {
+	bl.Lock(lState)
+}
+
+func TestBlockLockProfiler(t *testing.T) {
+	profiler := NewLockProfiler()
+	bl := &blockLock{
+		leveledRWMutex: makeLeveledRWMutex(
+			mutexLevel(fboBlock), &sync.RWMutex{}),
+		profiler: profiler,
+	}
+
+	t.Log("Nothing is recorded while the profiler is disabled")
+	lState := makeFBOLockState()
+	bl.Lock(lState)
+	bl.Unlock(lState)
+	require.Len(t, profiler.Snapshot(), 0)
+
+	t.Log("Contention is recorded per caller once enabled")
+	profiler.SetEnabled(true)
+	lockBlockLockForTest(bl, lState)
+	waitDone := make(chan struct{})
+	go func() {
+		defer close(waitDone)
+		rlState := makeFBOLockState()
+		bl.RLock(rlState)
+		bl.RUnlock(rlState)
+	}()
+	for waiting := false; !waiting; {
+		for _, e := range profiler.Snapshot() {
+			waiting = waiting || e.Waiting == 1
+		}
+		time.Sleep(time.Millisecond)
+	}
+	bl.Unlock(lState)
+	<-waitDone
+
+	snapshot := profiler.Snapshot()
+	require.Len(t, snapshot, 2)
+	writer := snapshot["lockBlockLockForTest"]
+	require.Equal(t, int64(1), writer.Acquisitions)
+	require.True(t, writer.MaxHold >= time.Millisecond)
+	reader := snapshot["TestBlockLockProfiler.func1"]
+	require.Equal(t, int64(1), reader.Acquisitions)
+	require.Equal(t, 0, reader.Waiting)
+	require.True(t, reader.MaxWait >= time.Millisecond)
+
+	t.Log("Disabling stops recording, and re-enabling resets the stats")
+	profiler.SetEnabled(false)
+	bl.Lock(lState)
+	bl.Unlock(lState)
+	require.Len(t, profiler.Snapshot(), 2)
+	profiler.SetEnabled(true)
+	require.Len(t, profiler.Snapshot(), 0)
+}
@@ -0,0 +1,452 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// LogModule names a group of loggers whose level can be set
+// together.  A logger belongs to the module named by the first word
+// of the name it was made with, lowercased, unless that word is one
+// of the aliases listed below.
+type LogModule string
+
+const (
+	// LogModuleBlockOps is the module for block operations.
+	LogModuleBlockOps LogModule = "blockops"
+	// LogModuleMDOps is the module for MD operations.
+	LogModuleMDOps LogModule = "mdops"
+	// LogModuleCR is the module for conflict resolution.
+	LogModuleCR LogModule = "cr"
+	// LogModuleJournal is the module for the journal.
+	LogModuleJournal LogModule = "journal"
+)
+
+var logModuleAliases = map[string]LogModule{
+	"BOPS":  LogModuleBlockOps,
+	"PRE":   LogModuleBlockOps,
+	"MDOPS": LogModuleMDOps,
+	"MDV":   LogModuleMDOps,
+	"CR":    LogModuleCR,
+	"TLFJ":  LogModuleJournal,
+	"JS":    LogModuleJournal,
+}
+
+func logModuleForName(name string) LogModule {
+	if i := strings.IndexByte(name, ' '); i >= 0 {
+		name = name[:i]
+	}
+	if m, ok := logModuleAliases[name]; ok {
+		return m
+	}
+	return LogModule(strings.ToLower(name))
+}
+
+var logLevelNames = map[string]keybase1.LogLevel{
+	"debug":    keybase1.LogLevel_DEBUG,
+	"info":     keybase1.LogLevel_INFO,
+	"notice":   keybase1.LogLevel_NOTICE,
+	"warning":  keybase1.LogLevel_WARN,
+	"error":    keybase1.LogLevel_ERROR,
+	"critical": keybase1.LogLevel_CRITICAL,
+}
+
+func logLevelName(level keybase1.LogLevel) string {
+	for name, l := range logLevelNames {
+		if l == level {
+			return name
+		}
+	}
+	return level.String()
+}
+
+// LogLevels holds the minimum level of the messages logged by each
+// LogModule, and can be changed at runtime.  It also controls whether
+// messages are written as structured JSON.
+type LogLevels struct {
+	lock     sync.RWMutex
+	defLevel keybase1.LogLevel
+	levels   map[LogModule]keybase1.LogLevel
+	jsonOut  io.Writer
+	debugBuf *DebugLogBuffer
+
+	// jsonLock serializes writes to jsonOut.
+	jsonLock sync.Mutex
+}
+
+// NewLogLevels returns a LogLevels that logs everything at or above
+// `defLevel` for every module.
+func NewLogLevels(defLevel keybase1.LogLevel) *LogLevels {
+	return &LogLevels{
+		defLevel: defLevel,
+		levels:   make(map[LogModule]keybase1.LogLevel),
+	}
+}
+
+// Level returns the minimum level logged for the given module.
+func (ll *LogLevels) Level(module LogModule) keybase1.LogLevel {
+	ll.lock.RLock()
+	defer ll.lock.RUnlock()
+	if level, ok := ll.levels[module]; ok {
+		return level
+	}
+	return ll.defLevel
+}
+
+// SetLevel sets the minimum level logged for the given module.  The
+// module "all" sets the default level and clears all per-module
+// levels.
+func (ll *LogLevels) SetLevel(module LogModule, level keybase1.LogLevel) {
+	ll.lock.Lock()
+	defer ll.lock.Unlock()
+	if module == "all" {
+		ll.defLevel = level
+		ll.levels = make(map[LogModule]keybase1.LogLevel)
+		return
+	}
+	ll.levels[module] = level
+}
+
+// Set parses a comma- or whitespace-separated list of module=level
+// pairs, like "blockops=debug,cr=warning", and sets those levels.
+// Levels are one of debug, info, notice, warning, error, or critical.
+func (ll *LogLevels) Set(spec string) error {
+	type setting struct {
+		module LogModule
+		level  keybase1.LogLevel
+	}
+	var settings []setting
+	for _, pair := range strings.FieldsFunc(spec, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	}) {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return errors.Errorf("Bad log level setting %q", pair)
+		}
+		level, ok := logLevelNames[strings.ToLower(kv[1])]
+		if !ok {
+			return errors.Errorf("Unknown log level %q", kv[1])
+		}
+		settings = append(settings,
+			setting{LogModule(strings.ToLower(kv[0])), level})
+	}
+	for _, s := range settings {
+		ll.SetLevel(s.module, s.level)
+	}
+	return nil
+}
+
+// String returns the current levels in the format accepted by Set.
+func (ll *LogLevels) String() string {
+	ll.lock.RLock()
+	defer ll.lock.RUnlock()
+	pairs := []string{"all=" + logLevelName(ll.defLevel)}
+	var modules []string
+	for m := range ll.levels {
+		modules = append(modules, string(m))
+	}
+	sort.Strings(modules)
+	for _, m := range modules {
+		pairs = append(pairs,
+			m+"="+logLevelName(ll.levels[LogModule(m)]))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// SetJSONOutput makes all loggers write structured JSON objects,
+// separated by newlines, to `w` instead of their usual output.  A
+// nil `w` restores the usual output.
+func (ll *LogLevels) SetJSONOutput(w io.Writer) {
+	ll.lock.Lock()
+	defer ll.lock.Unlock()
+	ll.jsonOut = w
+}
+
+func (ll *LogLevels) jsonOutput() io.Writer {
+	ll.lock.RLock()
+	defer ll.lock.RUnlock()
+	return ll.jsonOut
+}
+
+// SetDebugBuffer makes all loggers keep their messages of every
+// level in `b`, regardless of the levels set for their modules.  A
+// nil `b` stops keeping them.
+func (ll *LogLevels) SetDebugBuffer(b *DebugLogBuffer) {
+	ll.lock.Lock()
+	defer ll.lock.Unlock()
+	ll.debugBuf = b
+}
+
+// DebugBuffer returns the buffer set by SetDebugBuffer, if any.
+func (ll *LogLevels) DebugBuffer() *DebugLogBuffer {
+	ll.lock.RLock()
+	defer ll.lock.RUnlock()
+	return ll.debugBuf
+}
+
+type logFieldsKey struct{}
+
+// LogFields are structured fields describing the operation in
+// progress, which are included in JSON log messages.
+type LogFields struct {
+	TlfID    tlf.ID
+	Op       string
+	BlockPtr BlockPointer
+	Revision kbfsmd.Revision
+}
+
+// CtxWithLogFields returns a context carrying the given log fields,
+// on top of any set fields already carried by `ctx`.
+func CtxWithLogFields(ctx context.Context, fields LogFields) context.Context {
+	if old, ok := ctx.Value(logFieldsKey{}).(LogFields); ok {
+		if fields.TlfID == tlf.NullID {
+			fields.TlfID = old.TlfID
+		}
+		if fields.Op == "" {
+			fields.Op = old.Op
+		}
+		if fields.BlockPtr == zeroPtr {
+			fields.BlockPtr = old.BlockPtr
+		}
+		if fields.Revision == kbfsmd.RevisionUninitialized {
+			fields.Revision = old.Revision
+		}
+	}
+	return context.WithValue(ctx, logFieldsKey{}, fields)
+}
+
+func logFieldsFromCtx(ctx context.Context) LogFields {
+	fields, _ := ctx.Value(logFieldsKey{}).(LogFields)
+	return fields
+}
+
+type jsonLogMessage struct {
+	Time     time.Time
+	Level    string
+	Module   string
+	Msg      string
+	Tags     map[string]string `json:",omitempty"`
+	TlfID    string            `json:",omitempty"`
+	Op       string            `json:",omitempty"`
+	BlockPtr string            `json:",omitempty"`
+	Revision int64             `json:",omitempty"`
+}
+
+// leveledLogger wraps a logger, dropping messages below the level set
+// for its module, and optionally writing them as JSON.
+type leveledLogger struct {
+	logger.Logger
+	name   string
+	module LogModule
+	levels *LogLevels
+	// tlfID is the TLF this logger is about, if any, used when the
+	// context doesn't name a TLF.
+	tlfID tlf.ID
+}
+
+var _ logger.Logger = leveledLogger{}
+
+func newLeveledLogger(
+	log logger.Logger, name string, levels *LogLevels) logger.Logger {
+	return leveledLogger{
+		Logger: log.CloneWithAddedDepth(1),
+		name:   name,
+		module: logModuleForName(name),
+		levels: levels,
+	}
+}
+
+// logWithTlfID returns a logger like `log`, whose messages are
+// considered to be about the given TLF unless their context says
+// otherwise.
+func logWithTlfID(log logger.Logger, tlfID tlf.ID) logger.Logger {
+	if ll, ok := log.(leveledLogger); ok {
+		ll.tlfID = tlfID
+		return ll
+	}
+	return log
+}
+
+func (ll leveledLogger) fields(ctx context.Context) LogFields {
+	fields := logFieldsFromCtx(ctx)
+	if fields.TlfID == tlf.NullID {
+		fields.TlfID = ll.tlfID
+	}
+	return fields
+}
+
+func (ll leveledLogger) writeJSON(ctx context.Context, w io.Writer,
+	level keybase1.LogLevel, format string, args []interface{}) {
+	fields := ll.fields(ctx)
+	msg := jsonLogMessage{
+		Time:   time.Now(),
+		Level:  logLevelName(level),
+		Module: ll.name,
+		Msg:    fmt.Sprintf(format, args...),
+		Op:     fields.Op,
+	}
+	if fields.TlfID != tlf.NullID {
+		msg.TlfID = fields.TlfID.String()
+	}
+	if fields.BlockPtr != zeroPtr {
+		msg.BlockPtr = fields.BlockPtr.String()
+	}
+	if fields.Revision != kbfsmd.RevisionUninitialized {
+		msg.Revision = int64(fields.Revision)
+	}
+	if tags, ok := logger.LogTagsFromContext(ctx); ok {
+		msg.Tags = make(map[string]string, len(tags))
+		for key, name := range tags {
+			if v := ctx.Value(key); v != nil {
+				msg.Tags[name] = fmt.Sprintf("%v", v)
+			}
+		}
+	}
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		ll.Logger.Warning("Couldn't encode log message: %+v", err)
+		return
+	}
+	ll.levels.jsonLock.Lock()
+	defer ll.levels.jsonLock.Unlock()
+	_, _ = w.Write(append(buf, '\n'))
+}
+
+// enabled returns true if a message at the given level should be
+// passed to the wrapped logger.  If it returns false, the message
+// has either been dropped or written as JSON already.
+func (ll leveledLogger) enabled(ctx context.Context,
+	level keybase1.LogLevel, format string, args []interface{}) bool {
+	if b := ll.levels.DebugBuffer(); b != nil {
+		b.add(ll.fields(ctx).TlfID, logLevelName(level), ll.name,
+			fmt.Sprintf(format, args...))
+	}
+	if level < ll.levels.Level(ll.module) {
+		return false
+	}
+	if w := ll.levels.jsonOutput(); w != nil {
+		ll.writeJSON(ctx, w, level, format, args)
+		return false
+	}
+	return true
+}
+
+// Debug implements the logger.Logger interface for leveledLogger.
+func (ll leveledLogger) Debug(format string, args ...interface{}) {
+	if ll.enabled(context.Background(), keybase1.LogLevel_DEBUG, format, args) {
+		ll.Logger.Debug(format, args...)
+	}
+}
+
+// CDebugf implements the logger.Logger interface for leveledLogger.
+func (ll leveledLogger) CDebugf(
+	ctx context.Context, format string, args ...interface{}) {
+	if ll.enabled(ctx, keybase1.LogLevel_DEBUG, format, args) {
+		ll.Logger.CDebugf(ctx, format, args...)
+	}
+}
+
+// Info implements the logger.Logger interface for leveledLogger.
+func (ll leveledLogger) Info(format string, args ...interface{}) {
+	if ll.enabled(context.Background(), keybase1.LogLevel_INFO, format, args) {
+		ll.Logger.Info(format, args...)
+	}
+}
+
+// CInfof implements the logger.Logger interface for leveledLogger.
+func (ll leveledLogger) CInfof(
+	ctx context.Context, format string, args ...interface{}) {
+	if ll.enabled(ctx, keybase1.LogLevel_INFO, format, args) {
+		ll.Logger.CInfof(ctx, format, args...)
+	}
+}
+
+// Notice implements the logger.Logger interface for leveledLogger.
+func (ll leveledLogger) Notice(format string, args ...interface{}) {
+	if ll.enabled(context.Background(), keybase1.LogLevel_NOTICE, format, args) {
+		ll.Logger.Notice(format, args...)
+	}
+}
+
+// CNoticef implements the logger.Logger interface for leveledLogger.
+func (ll leveledLogger) CNoticef(
+	ctx context.Context, format string, args ...interface{}) {
+	if ll.enabled(ctx, keybase1.LogLevel_NOTICE, format, args) {
+		ll.Logger.CNoticef(ctx, format, args...)
+	}
+}
+
+// Warning implements the logger.Logger interface for leveledLogger.
+func (ll leveledLogger) Warning(format string, args ...interface{}) {
+	if ll.enabled(context.Background(), keybase1.LogLevel_WARN, format, args) {
+		ll.Logger.Warning(format, args...)
+	}
+}
+
+// CWarningf implements the logger.Logger interface for leveledLogger.
+func (ll leveledLogger) CWarningf(
+	ctx context.Context, format string, args ...interface{}) {
+	if ll.enabled(ctx, keybase1.LogLevel_WARN, format, args) {
+		ll.Logger.CWarningf(ctx, format, args...)
+	}
+}
+
+// Error implements the logger.Logger interface for leveledLogger.
+func (ll leveledLogger) Error(format string, args ...interface{}) {
+	if ll.enabled(context.Background(), keybase1.LogLevel_ERROR, format, args) {
+		ll.Logger.Error(format, args...)
+	}
+}
+
+// Errorf implements the logger.Logger interface for leveledLogger.
+func (ll leveledLogger) Errorf(format string, args ...interface{}) {
+	if ll.enabled(context.Background(), keybase1.LogLevel_ERROR, format, args) {
+		ll.Logger.Errorf(format, args...)
+	}
+}
+
+// CErrorf implements the logger.Logger interface for leveledLogger.
+func (ll leveledLogger) CErrorf(
+	ctx context.Context, format string, args ...interface{}) {
+	if ll.enabled(ctx, keybase1.LogLevel_ERROR, format, args) {
+		ll.Logger.CErrorf(ctx, format, args...)
+	}
+}
+
+// Critical implements the logger.Logger interface for leveledLogger.
+func (ll leveledLogger) Critical(format string, args ...interface{}) {
+	if ll.enabled(context.Background(), keybase1.LogLevel_CRITICAL, format, args) {
+		ll.Logger.Critical(format, args...)
+	}
+}
+
+// CCriticalf implements the logger.Logger interface for leveledLogger.
+func (ll leveledLogger) CCriticalf(
+	ctx context.Context, format string, args ...interface{}) {
+	if ll.enabled(ctx, keybase1.LogLevel_CRITICAL, format, args) {
+		ll.Logger.CCriticalf(ctx, format, args...)
+	}
+}
+
+// CloneWithAddedDepth implements the logger.Logger interface for
+// leveledLogger.
+func (ll leveledLogger) CloneWithAddedDepth(depth int) logger.Logger {
+	ll.Logger = ll.Logger.CloneWithAddedDepth(depth)
+	return ll
+}
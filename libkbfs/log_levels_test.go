@@ -0,0 +1,84 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestLogLevelsSet(t *testing.T) {
+	levels := NewLogLevels(keybase1.LogLevel_DEBUG)
+	require.NoError(t, levels.Set("blockops=warning, CR=error"))
+	require.Equal(t, keybase1.LogLevel_WARN, levels.Level(LogModuleBlockOps))
+	require.Equal(t, keybase1.LogLevel_ERROR, levels.Level(LogModuleCR))
+	require.Equal(t, keybase1.LogLevel_DEBUG, levels.Level(LogModuleMDOps))
+	require.Equal(t, "all=debug,blockops=warning,cr=error", levels.String())
+
+	require.NoError(t, levels.Set("all=info"))
+	require.Equal(t, keybase1.LogLevel_INFO, levels.Level(LogModuleBlockOps))
+	require.Equal(t, "all=info", levels.String())
+
+	for _, bad := range []string{"blockops", "=debug", "cr=loud"} {
+		require.Error(t, levels.Set(bad), bad)
+	}
+	require.Equal(t, "all=info", levels.String())
+
+	require.Equal(t, LogModuleBlockOps, logModuleForName("BOPS"))
+	require.Equal(t, LogModuleCR, logModuleForName("CR 12345678-1"))
+	require.Equal(t, LogModule("fbo"), logModuleForName("FBO 12345678"))
+}
+
+func TestLogLevelsJSON(t *testing.T) {
+	levels := NewLogLevels(keybase1.LogLevel_DEBUG)
+	require.NoError(t, levels.Set("mdops=warning"))
+	var buf bytes.Buffer
+	levels.SetJSONOutput(&buf)
+
+	bopsLog := newLeveledLogger(logger.NewTestLogger(t), "BOPS", levels)
+	mdopsLog := newLeveledLogger(logger.NewTestLogger(t), "MDOPS", levels)
+
+	tlfID := tlf.FakeID(1, tlf.Private)
+	ptr := BlockPointer{ID: kbfsblock.FakeID(2)}
+	ctx := CtxWithLogFields(context.Background(), LogFields{
+		TlfID: tlfID,
+		Op:    "BlockGet",
+	})
+	ctx = CtxWithLogFields(ctx, LogFields{BlockPtr: ptr})
+	bopsLog.CDebugf(ctx, "Getting block %d", 2)
+	mdopsLog.CDebugf(ctx, "Dropped")
+	mdopsLog.CWarningf(CtxWithLogFields(ctx, LogFields{
+		Revision: kbfsmd.Revision(5),
+	}), "Put failed")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+
+	var msg jsonLogMessage
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &msg))
+	require.Equal(t, "debug", msg.Level)
+	require.Equal(t, "BOPS", msg.Module)
+	require.Equal(t, "Getting block 2", msg.Msg)
+	require.Equal(t, tlfID.String(), msg.TlfID)
+	require.Equal(t, "BlockGet", msg.Op)
+	require.Equal(t, ptr.String(), msg.BlockPtr)
+	require.Equal(t, int64(0), msg.Revision)
+
+	msg = jsonLogMessage{}
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &msg))
+	require.Equal(t, "warning", msg.Level)
+	require.Equal(t, "MDOPS", msg.Module)
+	require.Equal(t, int64(5), msg.Revision)
+}
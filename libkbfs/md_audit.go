@@ -0,0 +1,122 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// mdAuditChunkSize is how many revisions are fetched from the MD
+// server at a time during an audit.
+const mdAuditChunkSize = 100
+
+// MDAuditResult describes the outcome of auditing the merged MD
+// history of a TLF.
+type MDAuditResult struct {
+	// Head is the latest merged revision according to the MD
+	// server.
+	Head kbfsmd.Revision
+	// LastVerified is the latest revision such that it and all of
+	// its predecessors passed the audit.
+	LastVerified kbfsmd.Revision
+	// FirstBad is the first revision that failed the audit, or
+	// kbfsmd.RevisionUninitialized if the whole history passed.
+	FirstBad kbfsmd.Revision
+	// Err describes what was wrong with FirstBad.
+	Err error
+}
+
+// Passed returns whether every revision up to the head passed the
+// audit.
+func (r MDAuditResult) Passed() bool {
+	return r.FirstBad == kbfsmd.RevisionUninitialized
+}
+
+// AuditMDChain walks the entire merged MD history of the given TLF,
+// starting from the first revision, bypassing any caches.  Each
+// revision's signatures are verified, its writer's key is checked
+// against the writer's devices (or the team's membership) at the
+// time it was written, and its previous-root pointer is checked
+// against the revision before it.  It stops at the first revision
+// that fails any of those checks, and reports it in the result.  An
+// error is returned only if the audit itself couldn't be completed,
+// e.g. due to a network failure.
+func AuditMDChain(ctx context.Context, config Config, tlfID tlf.ID) (
+	result MDAuditResult, err error) {
+	headRmds, err := config.MDServer().GetForTLF(
+		ctx, tlfID, kbfsmd.NullBranchID, kbfsmd.Merged, nil)
+	if err != nil {
+		return MDAuditResult{}, err
+	}
+	if headRmds == nil {
+		return MDAuditResult{}, nil
+	}
+	result.Head = headRmds.MD.RevisionNumber()
+
+	// Use a fresh MDOps so verification doesn't depend on anything
+	// the configured one might have cached or skipped.
+	mdOps := NewMDOpsStandard(config)
+	var prev ImmutableRootMetadata
+	for start := kbfsmd.RevisionInitial; start <= result.Head; start +=
+		mdAuditChunkSize {
+		stop := start + mdAuditChunkSize - 1
+		if stop > result.Head {
+			stop = result.Head
+		}
+		rmdses, err := config.MDServer().GetRange(
+			ctx, tlfID, kbfsmd.NullBranchID, kbfsmd.Merged, start, stop, nil)
+		if err != nil {
+			return MDAuditResult{}, err
+		}
+
+		expected := start
+		for _, rmds := range rmdses {
+			rev := rmds.MD.RevisionNumber()
+			if rev != expected {
+				result.FirstBad = expected
+				result.Err = errors.Errorf(
+					"Got revision %d when expecting %d", rev, expected)
+				return result, nil
+			}
+			irmd, err := mdOps.processSignedMD(
+				ctx, tlfID, kbfsmd.NullBranchID, rmds)
+			if err != nil {
+				if ctx.Err() != nil {
+					return MDAuditResult{}, ctx.Err()
+				}
+				result.FirstBad = rev
+				result.Err = err
+				return result, nil
+			}
+
+			if prev == (ImmutableRootMetadata{}) {
+				if irmd.PrevRoot() != (kbfsmd.ID{}) {
+					err = errors.Errorf(
+						"First revision has previous root %s", irmd.PrevRoot())
+				}
+			} else {
+				err = prev.CheckValidSuccessor(prev.mdID, irmd.ReadOnly())
+			}
+			if err != nil {
+				result.FirstBad = rev
+				result.Err = err
+				return result, nil
+			}
+
+			result.LastVerified = rev
+			prev = irmd
+			expected++
+		}
+		if expected <= stop {
+			result.FirstBad = expected
+			result.Err = errors.Errorf("Revision %d is missing", expected)
+			return result, nil
+		}
+	}
+	return result, nil
+}
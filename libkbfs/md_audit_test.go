@@ -0,0 +1,90 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// tamperingMDServer corrupts or drops a single merged revision on
+// its way out of the MD server.
+type tamperingMDServer struct {
+	MDServer
+	rev     kbfsmd.Revision
+	corrupt bool
+}
+
+func (s tamperingMDServer) GetRange(ctx context.Context, id tlf.ID,
+	bid kbfsmd.BranchID, mStatus kbfsmd.MergeStatus,
+	start, stop kbfsmd.Revision, lockBeforeGet *keybase1.LockID) (
+	[]*RootMetadataSigned, error) {
+	rmdses, err := s.MDServer.GetRange(
+		ctx, id, bid, mStatus, start, stop, lockBeforeGet)
+	if err != nil {
+		return nil, err
+	}
+	var ret []*RootMetadataSigned
+	for _, rmds := range rmdses {
+		if rmds.MD.RevisionNumber() == s.rev {
+			if !s.corrupt {
+				continue
+			}
+			sig := append([]byte(nil), rmds.SigInfo.Signature...)
+			sig[0] ^= 0xff
+			rmds.SigInfo.Signature = sig
+		}
+		ret = append(ret, rmds)
+	}
+	return ret, nil
+}
+
+func TestAuditMDChain(t *testing.T) {
+	ctx := BackgroundContextWithCancellationDelayer()
+	defer CleanupCancellationDelayer(ctx)
+	config := MakeTestConfigOrBust(t, "u1")
+	defer CheckConfigAndShutdown(ctx, t, config)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	tlfID := rootNode.GetFolderBranch().Tlf
+	kbfsOps := config.KBFSOps()
+	for _, name := range []string{"a", "b", "c"} {
+		_, _, err := kbfsOps.CreateFile(ctx, rootNode, name, false, NoExcl)
+		require.NoError(t, err)
+		err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+		require.NoError(t, err)
+	}
+
+	t.Log("An untouched history passes")
+	result, err := AuditMDChain(ctx, config, tlfID)
+	require.NoError(t, err)
+	require.True(t, result.Passed())
+	require.Equal(t, kbfsmd.Revision(4), result.Head)
+	require.Equal(t, result.Head, result.LastVerified)
+
+	mdserv := config.MDServer()
+	defer config.SetMDServer(mdserv)
+
+	t.Log("A bad signature is caught at its revision")
+	config.SetMDServer(tamperingMDServer{mdserv, 3, true})
+	result, err = AuditMDChain(ctx, config, tlfID)
+	require.NoError(t, err)
+	require.False(t, result.Passed())
+	require.Equal(t, kbfsmd.Revision(3), result.FirstBad)
+	require.Equal(t, kbfsmd.Revision(2), result.LastVerified)
+	require.Error(t, result.Err)
+
+	t.Log("A missing revision is caught")
+	config.SetMDServer(tamperingMDServer{mdserv, 2, false})
+	result, err = AuditMDChain(ctx, config, tlfID)
+	require.NoError(t, err)
+	require.Equal(t, kbfsmd.Revision(2), result.FirstBad)
+	require.Equal(t, kbfsmd.Revision(1), result.LastVerified)
+}
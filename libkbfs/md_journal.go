@@ -155,6 +155,10 @@ type mdJournal struct {
 	// flushing. This doesn't need to be persisted for the same
 	// reason as branchID.
 	lastMdID kbfsmd.ID
+
+	// crashRepair describes how the journal was repaired when it
+	// was opened, if at all.
+	crashRepair diskJournalRepair
 }
 
 func makeMDJournalWithIDJournal(
@@ -162,7 +166,7 @@ func makeMDJournalWithIDJournal(
 	codec kbfscodec.Codec, crypto cryptoPure, clock Clock,
 	teamMemChecker kbfsmd.TeamMembershipChecker, tlfID tlf.ID,
 	mdVer kbfsmd.MetadataVer, dir string, idJournal mdIDJournal,
-	log logger.Logger) (*mdJournal, error) {
+	log logger.Logger, repair bool) (*mdJournal, error) {
 	if uid == keybase1.UID("") {
 		return nil, errors.New("Empty user")
 	}
@@ -186,6 +190,33 @@ func makeMDJournalWithIDJournal(
 		j:              idJournal,
 	}
 
+	if repair {
+		// Only the server can tell whether a leading revision was
+		// already flushed, so one left by an interrupted removal is
+		// kept.  Flushing it again hits a revision conflict with the
+		// same MD ID on the server, which the flush treats as
+		// already done.
+		r, err := idJournal.j.repair(nil, func(
+			o journalOrdinal, entry interface{}) (bool, error) {
+			_, _, err := journal.readMD(entry.(mdIDJournalEntry).ID)
+			if err != nil {
+				log.CDebugf(ctx,
+					"Couldn't read MD for journal entry %s: %+v", o, err)
+				return false, nil
+			}
+			return true, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		journal.crashRepair = r
+		if r.repaired() {
+			log.CWarningf(ctx, "Repaired MD journal after a crash: "+
+				"rebuilt ordinals=%t, dropped %d revisions starting at %s",
+				r.rebuiltOrdinals, r.dropped, r.firstDropped)
+		}
+	}
+
 	_, earliest, _, _, err := journal.getEarliestWithExtra(ctx, false)
 	if err != nil {
 		return nil, err
@@ -226,7 +257,7 @@ func makeMDJournal(
 	codec kbfscodec.Codec, crypto cryptoPure, clock Clock,
 	teamMemChecker kbfsmd.TeamMembershipChecker, tlfID tlf.ID,
 	mdVer kbfsmd.MetadataVer, dir string,
-	log logger.Logger) (*mdJournal, error) {
+	log logger.Logger, repair bool) (*mdJournal, error) {
 	journalDir := mdJournalPath(dir)
 	idJournal, err := makeMdIDJournal(codec, journalDir)
 	if err != nil {
@@ -234,7 +265,7 @@ func makeMDJournal(
 	}
 	return makeMDJournalWithIDJournal(
 		ctx, uid, key, codec, crypto, clock, teamMemChecker, tlfID, mdVer, dir,
-		idJournal, log)
+		idJournal, log, repair)
 }
 
 // The functions below are for building various paths.
@@ -416,50 +447,61 @@ func (j mdJournal) putExtraMetadata(rmd kbfsmd.RootMetadata, extra kbfsmd.ExtraM
 	return extraV3.IsWriterKeyBundleNew(), extraV3.IsReaderKeyBundleNew(), nil
 }
 
-// getMDAndExtra verifies the MD data, the writer signature (but not
-// the key), and the extra metadata for the given ID and returns
-// them. It also returns the last-modified timestamp of the
-// file. verifyBranchID should be false only when called from
-// makeMDJournal, i.e. when figuring out what to set j.branchID in the
-// first place.
-//
-// It returns a kbfsmd.MutableRootMetadata so that it can be put in a
-// RootMetadataSigned object.
-func (j mdJournal) getMDAndExtra(ctx context.Context, entry mdIDJournalEntry,
-	verifyBranchID bool) (
-	kbfsmd.MutableRootMetadata, kbfsmd.ExtraMetadata, time.Time, error) {
+// readMD reads the MD with the given ID, and checks that its contents
+// match the ID.
+func (j mdJournal) readMD(id kbfsmd.ID) (
+	kbfsmd.MutableRootMetadata, time.Time, error) {
 	// Read info.
 
-	timestamp, version, err := j.getMDInfo(entry.ID)
+	timestamp, version, err := j.getMDInfo(id)
 	if err != nil {
-		return nil, nil, time.Time{}, err
+		return nil, time.Time{}, err
 	}
 
 	// Read data.
 
-	p := j.mdDataPath(entry.ID)
+	p := j.mdDataPath(id)
 	data, err := ioutil.ReadFile(p)
 	if err != nil {
-		return nil, nil, time.Time{}, err
+		return nil, time.Time{}, err
 	}
 
 	rmd, err := kbfsmd.DecodeRootMetadata(
 		j.codec, j.tlfID, version, j.mdVer, data)
 	if err != nil {
-		return nil, nil, time.Time{}, err
+		return nil, time.Time{}, err
 	}
 
 	// Check integrity.
 
 	mdID, err := kbfsmd.MakeID(j.codec, rmd)
 	if err != nil {
-		return nil, nil, time.Time{}, err
+		return nil, time.Time{}, err
 	}
 
-	if mdID != entry.ID {
-		return nil, nil, time.Time{}, errors.Errorf(
-			"Metadata ID mismatch: expected %s, got %s",
-			entry.ID, mdID)
+	if mdID != id {
+		return nil, time.Time{}, errors.Errorf(
+			"Metadata ID mismatch: expected %s, got %s", id, mdID)
+	}
+
+	return rmd, timestamp, nil
+}
+
+// getMDAndExtra verifies the MD data, the writer signature (but not
+// the key), and the extra metadata for the given ID and returns
+// them. It also returns the last-modified timestamp of the
+// file. verifyBranchID should be false only when called from
+// makeMDJournal, i.e. when figuring out what to set j.branchID in the
+// first place.
+//
+// It returns a kbfsmd.MutableRootMetadata so that it can be put in a
+// RootMetadataSigned object.
+func (j mdJournal) getMDAndExtra(ctx context.Context, entry mdIDJournalEntry,
+	verifyBranchID bool) (
+	kbfsmd.MutableRootMetadata, kbfsmd.ExtraMetadata, time.Time, error) {
+	rmd, timestamp, err := j.readMD(entry.ID)
+	if err != nil {
+		return nil, nil, time.Time{}, err
 	}
 
 	err = rmd.IsLastModifiedBy(j.uid, j.key)
@@ -490,6 +532,67 @@ func (j mdJournal) getMDAndExtra(ctx context.Context, entry mdIDJournalEntry,
 	return rmd, extra, timestamp, nil
 }
 
+// getCrashDroppedMDs returns the MDs of the revisions that were
+// dropped from the journal when it was repaired after a crash, and
+// whose data can still be read, in revision order.
+func (j mdJournal) getCrashDroppedMDs(
+	ctx context.Context) []ImmutableBareRootMetadata {
+	var ibrmds []ImmutableBareRootMetadata
+	for _, e := range j.crashRepair.droppedEntries {
+		entry := e.(mdIDJournalEntry)
+		rmd, extra, ts, err := j.getMDAndExtra(ctx, entry, false)
+		if err != nil {
+			j.log.CDebugf(ctx, "Couldn't read dropped MD %s: %+v",
+				entry.ID, err)
+			continue
+		}
+		ibrmds = append(ibrmds,
+			MakeImmutableBareRootMetadata(rmd, extra, entry.ID, ts))
+	}
+	return ibrmds
+}
+
+// dropAfterCrashFrom removes `rev` and every later revision from the
+// journal, after a crash repair found that they might reference
+// blocks that never made it into the block journal.  The dropped
+// revisions are counted in the journal's crash repair, along with
+// any that the repair itself dropped.  The MD data is kept, so that
+// getCrashDroppedMDs can still read it.
+func (j *mdJournal) dropAfterCrashFrom(
+	ctx context.Context, rev kbfsmd.Revision) error {
+	latest, err := j.j.readLatestRevision()
+	if err != nil {
+		return err
+	}
+	start, entries, err := j.j.getEntryRange(rev, latest)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	err = j.j.clearFrom(start)
+	if err != nil {
+		return err
+	}
+	if j.j.length() == 0 {
+		j.branchID = kbfsmd.NullBranchID
+	}
+
+	j.log.CWarningf(ctx, "Dropped revisions %s through %s from the MD "+
+		"journal, since their blocks may have been lost", start, latest)
+	dropped := make([]interface{}, 0,
+		len(entries)+len(j.crashRepair.droppedEntries))
+	for _, entry := range entries {
+		dropped = append(dropped, entry)
+	}
+	j.crashRepair.droppedEntries = append(
+		dropped, j.crashRepair.droppedEntries...)
+	j.crashRepair.firstDropped = journalOrdinal(start)
+	j.crashRepair.dropped += uint64(len(entries))
+	return nil
+}
+
 // putMD stores the given metadata under its ID, if it's not already
 // stored. The extra metadata is put separately, since sometimes,
 // (e.g., when converting to a branch) we don't need to put it.
@@ -1487,7 +1590,7 @@ func (j *mdJournal) resolveAndClear(
 
 	otherJournal, err := makeMDJournalWithIDJournal(
 		ctx, j.uid, j.key, j.codec, j.crypto, j.clock, j.teamMemChecker,
-		j.tlfID, j.mdVer, j.dir, otherIDJournal, j.log)
+		j.tlfID, j.mdVer, j.dir, otherIDJournal, j.log, false)
 	if err != nil {
 		return kbfsmd.ID{}, err
 	}
@@ -72,11 +72,11 @@ func setupMDJournalTest(t testing.TB, ver kbfsmd.MetadataVer) (
 	ctx := context.Background()
 	j, err = makeMDJournal(
 		ctx, uid, verifyingKey, codec, crypto, wallClock{}, nil,
-		tlfID, ver, tempdir, log)
+		tlfID, ver, tempdir, log, false)
 	require.NoError(t, err)
 
 	bsplit = &BlockSplitterSimple{
-		64 * 1024, int(64 * 1024 / bpSize), 8 * 1024, 0}
+		64 * 1024, int(64 * 1024 / bpSize), 8 * 1024, 0, 0}
 
 	return codec, crypto, tlfID, signer, ekg, bsplit, tempdir, j
 }
@@ -1001,7 +1001,7 @@ func testMDJournalRestart(t *testing.T, ver kbfsmd.MetadataVer) {
 	// Restart journal.
 	ctx := context.Background()
 	j, err := makeMDJournal(ctx, j.uid, j.key, codec, crypto, j.clock,
-		j.teamMemChecker, j.tlfID, j.mdVer, j.dir, j.log)
+		j.teamMemChecker, j.tlfID, j.mdVer, j.dir, j.log, true)
 	require.NoError(t, err)
 
 	require.Equal(t, uint64(mdCount), j.length())
@@ -1043,7 +1043,7 @@ func testMDJournalRestartAfterBranchConversion(t *testing.T, ver kbfsmd.Metadata
 	// Restart journal.
 
 	j, err = makeMDJournal(ctx, j.uid, j.key, codec, crypto, j.clock,
-		j.teamMemChecker, j.tlfID, j.mdVer, j.dir, j.log)
+		j.teamMemChecker, j.tlfID, j.mdVer, j.dir, j.log, true)
 	require.NoError(t, err)
 
 	require.Equal(t, uint64(mdCount), j.length())
@@ -59,7 +59,7 @@ type MDOpsStandard struct {
 
 // NewMDOpsStandard returns a new MDOpsStandard
 func NewMDOpsStandard(config Config) *MDOpsStandard {
-	return &MDOpsStandard{config, config.MakeLogger("")}
+	return &MDOpsStandard{config, config.MakeLogger("MDOPS")}
 }
 
 // convertVerifyingKeyError gives a better error when the TLF was
@@ -451,9 +451,11 @@ func (md *MDOpsStandard) verifyKey(
 	irmd ImmutableRootMetadata) (cacheable bool, err error) {
 	err = md.config.KBPKI().HasVerifyingKey(ctx, uid, verifyingKey,
 		rmds.untrustedServerTimestamp)
+	verifier := md.config.mdVerifier()
 	var info revokedKeyInfo
 	switch e := errors.Cause(err).(type) {
 	case nil:
+		verifier.rememberUserKey(ctx, uid, verifyingKey)
 		return true, nil
 	case RevokedDeviceVerificationError:
 		if ctx.Value(ctxMDOpsSkipKeyVerification) != nil {
@@ -464,13 +466,28 @@ func (md *MDOpsStandard) verifyKey(
 		if e.info.MerkleRoot.Seqno <= 0 {
 			md.log.CDebugf(ctx, "Can't verify an MD written by a revoked "+
 				"device if there's no valid root seqno to check: %+v", e)
+			verifier.noteAssumption(ctx, irmd.TlfID(),
+				"revision %d was written by revoked device key %s of "+
+					"user %s before the revocation, with no Merkle root "+
+					"to check against", irmd.Revision(), verifyingKey, uid)
 			return true, nil
 		}
 
 		info = e.info
 		// Fall through to check via the merkle tree.
 	default:
-		return false, err
+		if isDefinitiveVerificationError(err) ||
+			!verifier.hasUserKey(uid, verifyingKey) {
+			return false, err
+		}
+		// We can't reach the service right now, but this key was
+		// verified before.  That doesn't prove it hasn't been
+		// revoked since, so don't cache the result.
+		verifier.noteAssumption(ctx, irmd.TlfID(),
+			"revision %d was written by device key %s of user %s, which "+
+				"was only verified from the local cache (%v)",
+			irmd.Revision(), verifyingKey, uid, err)
+		return false, nil
 	}
 
 	md.log.CDebugf(ctx, "Revision %d for %s was signed by a device that was "+
@@ -610,12 +627,22 @@ type merkleBasedTeamChecker struct {
 func (mbtc merkleBasedTeamChecker) IsTeamWriter(
 	ctx context.Context, tid keybase1.TeamID, uid keybase1.UID,
 	verifyingKey kbfscrypto.VerifyingKey) (bool, error) {
+	verifier := mbtc.md.config.mdVerifier()
 	isCurrentWriter, err := mbtc.teamMembershipChecker.IsTeamWriter(
 		ctx, tid, uid, verifyingKey)
 	if err != nil {
-		return false, err
+		if isDefinitiveVerificationError(err) ||
+			!verifier.hasTeamWriter(tid, uid, verifyingKey) {
+			return false, err
+		}
+		verifier.noteAssumption(ctx, mbtc.irmd.TlfID(),
+			"revision %d was written by user %s as a writer of team %s, "+
+				"which was only verified from the local cache (%v)",
+			mbtc.irmd.Revision(), uid, tid, err)
+		return true, nil
 	}
 	if isCurrentWriter {
+		verifier.rememberTeamWriter(ctx, tid, uid, verifyingKey)
 		return true, nil
 	}
 
@@ -1148,6 +1175,11 @@ func (md *MDOpsStandard) GetUnmergedRange(ctx context.Context, id tlf.ID,
 func (md *MDOpsStandard) put(ctx context.Context, rmd *RootMetadata,
 	verifyingKey kbfscrypto.VerifyingKey, lockContext *keybase1.LockContext,
 	priority keybase1.MDPriority) (ImmutableRootMetadata, error) {
+	ctx = CtxWithLogFields(ctx, LogFields{
+		TlfID:    rmd.TlfID(),
+		Op:       "MDPut",
+		Revision: rmd.Revision(),
+	})
 	session, err := md.config.KBPKI().GetCurrentSession(ctx)
 	if err != nil {
 		return ImmutableRootMetadata{}, err
@@ -0,0 +1,177 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// maxVerificationAssumptionsPerTlf caps how many distinct
+// assumptions are remembered for a single TLF.
+const maxVerificationAssumptionsPerTlf = 100
+
+// mdVerifier remembers which writer keys have been verified online,
+// so that MD written with them can still be verified while the
+// service can't be reached.  It also keeps track of every assumption
+// made while verifying each TLF's MD -- such as trusting a cached
+// key, or a revoked device without a Merkle root to check against
+// -- so callers can tell whether their view of a TLF is fully
+// verified.
+type mdVerifier struct {
+	log logger.Logger
+
+	lock sync.RWMutex
+	// Verified keys, as encoded by userKeyName and teamWriterKeyName.
+	keys map[string]bool
+	// db persists keys across restarts, if non-nil.
+	db          *levelDb
+	assumptions map[tlf.ID][]string
+}
+
+func newMDVerifier(log logger.Logger, db *levelDb) *mdVerifier {
+	v := &mdVerifier{
+		log:         log,
+		keys:        make(map[string]bool),
+		db:          db,
+		assumptions: make(map[tlf.ID][]string),
+	}
+	if db != nil {
+		iter := db.NewIterator(nil, nil)
+		defer iter.Release()
+		for iter.Next() {
+			v.keys[string(iter.Key())] = true
+		}
+		if err := iter.Error(); err != nil {
+			log.Warning("Couldn't load all verified keys: %+v", err)
+		}
+	}
+	return v
+}
+
+func userKeyName(uid keybase1.UID, key kbfscrypto.VerifyingKey) string {
+	return fmt.Sprintf("user:%s:%s", uid, key)
+}
+
+func teamWriterKeyName(tid keybase1.TeamID, uid keybase1.UID,
+	key kbfscrypto.VerifyingKey) string {
+	return fmt.Sprintf("team:%s:%s:%s", tid, uid, key)
+}
+
+func (v *mdVerifier) remember(ctx context.Context, name string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.keys[name] {
+		return
+	}
+	v.keys[name] = true
+	if v.db == nil {
+		return
+	}
+	if err := v.db.Put([]byte(name), nil, nil); err != nil {
+		v.log.CDebugf(ctx, "Couldn't persist verified key %s: %+v",
+			name, err)
+	}
+}
+
+func (v *mdVerifier) has(name string) bool {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	return v.keys[name]
+}
+
+// rememberUserKey records that `key` was verified to belong to `uid`.
+func (v *mdVerifier) rememberUserKey(ctx context.Context,
+	uid keybase1.UID, key kbfscrypto.VerifyingKey) {
+	v.remember(ctx, userKeyName(uid, key))
+}
+
+// hasUserKey returns whether `key` was ever verified to belong to
+// `uid`.
+func (v *mdVerifier) hasUserKey(
+	uid keybase1.UID, key kbfscrypto.VerifyingKey) bool {
+	return v.has(userKeyName(uid, key))
+}
+
+// rememberTeamWriter records that `uid` was verified to be a writer
+// of `tid`, using `key`.
+func (v *mdVerifier) rememberTeamWriter(ctx context.Context,
+	tid keybase1.TeamID, uid keybase1.UID, key kbfscrypto.VerifyingKey) {
+	v.remember(ctx, teamWriterKeyName(tid, uid, key))
+}
+
+// hasTeamWriter returns whether `uid` was ever verified to be a
+// writer of `tid`, using `key`.
+func (v *mdVerifier) hasTeamWriter(tid keybase1.TeamID, uid keybase1.UID,
+	key kbfscrypto.VerifyingKey) bool {
+	return v.has(teamWriterKeyName(tid, uid, key))
+}
+
+// noteAssumption records that verifying some MD for `tlfID` relied
+// on something that couldn't be checked.
+func (v *mdVerifier) noteAssumption(ctx context.Context, tlfID tlf.ID,
+	format string, args ...interface{}) {
+	assumption := fmt.Sprintf(format, args...)
+	v.log.CDebugf(ctx, "Verification of %s assumed: %s", tlfID, assumption)
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	assumptions := v.assumptions[tlfID]
+	if len(assumptions) >= maxVerificationAssumptionsPerTlf {
+		return
+	}
+	for _, a := range assumptions {
+		if a == assumption {
+			return
+		}
+	}
+	v.assumptions[tlfID] = append(assumptions, assumption)
+}
+
+// getAssumptions returns, in sorted order, everything assumed while
+// verifying MD for `tlfID`.
+func (v *mdVerifier) getAssumptions(tlfID tlf.ID) []string {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	assumptions := append([]string(nil), v.assumptions[tlfID]...)
+	sort.Strings(assumptions)
+	return assumptions
+}
+
+func (v *mdVerifier) shutdown() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.db == nil {
+		return
+	}
+	if err := v.db.Close(); err != nil {
+		v.log.Warning("Couldn't close verified key db: %+v", err)
+	}
+	v.db = nil
+}
+
+// isDefinitiveVerificationError returns whether `err` means a key
+// check actually failed, rather than that it couldn't be done (e.g.,
+// because the service was unreachable).  Only the latter may fall
+// back to the cached keys.
+func isDefinitiveVerificationError(err error) bool {
+	switch errors.Cause(err).(type) {
+	case VerifyingKeyNotFoundError, RevokedDeviceVerificationError,
+		UnverifiableTlfUpdateError:
+		return true
+	}
+	switch errors.Cause(err) {
+	case context.Canceled, context.DeadlineExceeded:
+		return true
+	}
+	return false
+}
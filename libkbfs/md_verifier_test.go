@@ -0,0 +1,111 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"golang.org/x/net/context"
+)
+
+func TestMDVerifierPersistsKeys(t *testing.T) {
+	ctx := context.Background()
+	tempdir, err := ioutil.TempDir(os.TempDir(), "md_verifier")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	open := func() *mdVerifier {
+		stor, err := storage.OpenFile(tempdir, false)
+		require.NoError(t, err)
+		db, err := openLevelDB(stor)
+		require.NoError(t, err)
+		return newMDVerifier(logger.NewTestLogger(t), db)
+	}
+
+	uid := keybase1.MakeTestUID(1)
+	tid := keybase1.MakeTestTeamID(1, false)
+	key := kbfscrypto.MakeFakeVerifyingKeyOrBust("key")
+	v := open()
+	require.False(t, v.hasUserKey(uid, key))
+	v.rememberUserKey(ctx, uid, key)
+	v.rememberTeamWriter(ctx, tid, uid, key)
+	v.shutdown()
+
+	v = open()
+	defer v.shutdown()
+	require.True(t, v.hasUserKey(uid, key))
+	require.True(t, v.hasTeamWriter(tid, uid, key))
+	require.False(t, v.hasUserKey(keybase1.MakeTestUID(2), key))
+}
+
+// offlineKBPKI fails key checks as if the service were unreachable.
+type offlineKBPKI struct {
+	KBPKI
+}
+
+func (k offlineKBPKI) HasVerifyingKey(
+	_ context.Context, _ keybase1.UID, _ kbfscrypto.VerifyingKey,
+	_ time.Time) error {
+	return errors.New("offline")
+}
+
+func TestMDVerifierOffline(t *testing.T) {
+	ctx := BackgroundContextWithCancellationDelayer()
+	defer CleanupCancellationDelayer(ctx)
+	config := MakeTestConfigOrBust(t, "u1")
+	defer CheckConfigAndShutdown(ctx, t, config)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	_, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	t.Log("Verify the history while online")
+	getRange := func() error {
+		config.SetMDCache(NewMDCacheStandard(defaultMDCacheCapacity))
+		_, err := config.MDOps().GetRange(
+			ctx, fb.Tlf, kbfsmd.RevisionInitial, kbfsmd.RevisionInitial+1,
+			nil)
+		return err
+	}
+	err = getRange()
+	require.NoError(t, err)
+	status, _, err := kbfsOps.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	require.True(t, status.FullyVerified)
+
+	t.Log("Offline, the cached keys are used, but noted")
+	kbpki := config.KBPKI()
+	defer config.SetKBPKI(kbpki)
+	config.SetKBPKI(offlineKBPKI{kbpki})
+	err = getRange()
+	require.NoError(t, err)
+	status, _, err = kbfsOps.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	require.False(t, status.FullyVerified)
+	require.Len(t, status.VerificationAssumptions, 2)
+
+	t.Log("Offline, keys that were never verified are rejected")
+	config.verifier = newMDVerifier(config.MakeLogger(""), nil)
+	err = getRange()
+	require.Error(t, err)
+}
@@ -8,6 +8,7 @@ import (
 	"sync"
 
 	lru "github.com/hashicorp/golang-lru"
+	"github.com/keybase/kbfs/kbfscodec"
 	"github.com/keybase/kbfs/kbfsmd"
 	"github.com/keybase/kbfs/tlf"
 	"github.com/pkg/errors"
@@ -161,3 +162,27 @@ func (md *MDCacheStandard) ChangeHandleForID(
 	md.idLRU.Add(newKey, tmp)
 	return
 }
+
+// memoryUsage returns the estimated memory held by the MDs in this
+// cache, counting each by its encoded size.
+func (md *MDCacheStandard) memoryUsage(codec kbfscodec.Codec) MemoryUsage {
+	md.lock.RLock()
+	defer md.lock.RUnlock()
+	var usage MemoryUsage
+	for _, key := range md.lru.Keys() {
+		tmp, ok := md.lru.Peek(key)
+		if !ok {
+			continue
+		}
+		rmd, ok := tmp.(ImmutableRootMetadata)
+		if !ok || rmd.RootMetadata == nil {
+			continue
+		}
+		buf, err := codec.Encode(rmd.bareMd)
+		if err != nil {
+			continue
+		}
+		usage.add(key.(mdCacheKey).tlf, int64(len(buf)))
+	}
+	return usage
+}
@@ -419,8 +419,13 @@ func (md *MDServerRemote) OnDisconnected(ctx context.Context,
 	if md.authToken != nil {
 		md.authToken.Shutdown()
 	}
-	md.config.RekeyQueue().Shutdown()
-	md.config.SetRekeyQueue(NewRekeyQueueStandard(md.config))
+	oldRekeyQueue := md.config.RekeyQueue()
+	oldRekeyQueue.Shutdown()
+	rekeyQueue := NewRekeyQueueStandard(md.config)
+	if old, ok := oldRekeyQueue.(*RekeyQueueStandard); ok {
+		rekeyQueue.SetRateLimit(old.RateLimit())
+	}
+	md.config.SetRekeyQueue(rekeyQueue)
 	// Reset the timer since we will get folders for rekey again on
 	// the re-connect.
 	md.resetRekeyTimer()
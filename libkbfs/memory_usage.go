@@ -0,0 +1,78 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"github.com/keybase/kbfs/tlf"
+)
+
+// nodeCacheEntryBytesEstimate is a rough estimate of the memory used
+// by one cached node and its bookkeeping, not counting its name.
+const nodeCacheEntryBytesEstimate = 256
+
+// MemoryUsage is the estimated number of bytes held in memory by one
+// cache, in total and broken down by TLF.  Bytes not associated with
+// any TLF are only counted in the total.
+type MemoryUsage struct {
+	Bytes    int64
+	TLFBytes map[tlf.ID]int64 `json:",omitempty"`
+}
+
+func (u *MemoryUsage) add(tlfID tlf.ID, bytes int64) {
+	u.Bytes += bytes
+	if tlfID == tlf.NullID {
+		return
+	}
+	if u.TLFBytes == nil {
+		u.TLFBytes = make(map[tlf.ID]int64)
+	}
+	u.TLFBytes[tlfID] += bytes
+}
+
+// MemoryUsageStatus reports the memory held by each of the in-memory
+// caches of a KBFS instance.  Caches that aren't the standard
+// implementations are reported as empty.  The sizes are estimates:
+// blocks are counted by their plaintext or encoded size, and MDs by
+// their encoded size.
+type MemoryUsageStatus struct {
+	BlockCache      MemoryUsage
+	DirtyBlockCache MemoryUsage
+	NodeCache       MemoryUsage
+	MDCache         MemoryUsage
+	// BlockRetrievalQueue counts the blocks being fetched, both on
+	// demand and for prefetching, by their encoded size.
+	BlockRetrievalQueue MemoryUsage
+	TotalBytes          int64
+}
+
+// GetMemoryUsage returns the estimated memory usage of the caches in
+// the given config.
+func GetMemoryUsage(config Config) MemoryUsageStatus {
+	var status MemoryUsageStatus
+	if bcache, ok := config.BlockCache().(*BlockCacheStandard); ok {
+		status.BlockCache = bcache.memoryUsage()
+	}
+	if dbcache, ok :=
+		config.DirtyBlockCache().(*DirtyBlockCacheStandard); ok {
+		status.DirtyBlockCache = dbcache.memoryUsage()
+	}
+	if mdcache, ok := config.MDCache().(*MDCacheStandard); ok {
+		status.MDCache = mdcache.memoryUsage(config.Codec())
+	}
+	if bops, ok := config.BlockOps().(*BlockOpsStandard); ok {
+		status.BlockRetrievalQueue = bops.queue.memoryUsage()
+	}
+	switch ops := config.KBFSOps().(type) {
+	case *KBFSOpsStandard:
+		status.NodeCache = ops.nodeCacheMemoryUsage()
+	case *OpLogRecorder:
+		status.NodeCache = ops.ops.nodeCacheMemoryUsage()
+	}
+
+	status.TotalBytes = status.BlockCache.Bytes +
+		status.DirtyBlockCache.Bytes + status.NodeCache.Bytes +
+		status.MDCache.Bytes + status.BlockRetrievalQueue.Bytes
+	return status
+}
@@ -0,0 +1,51 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetMemoryUsage(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "alice")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "alice", tlf.Private)
+	tlfID := rootNode.GetFolderBranch().Tlf
+	_, _, err := config.KBFSOps().CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	err = config.KBFSOps().SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	otherTlfID := tlf.FakeID(2, tlf.Public)
+	block := makeFakeFileBlock(t, true)
+	err = config.BlockCache().Put(
+		makeRandomBlockPointer(t), otherTlfID, block, TransientEntry)
+	require.NoError(t, err)
+	dirtyPtr := makeRandomBlockPointer(t)
+	dirtyBlock := makeFakeFileBlock(t, true)
+	err = config.DirtyBlockCache().Put(
+		otherTlfID, dirtyPtr, MasterBranch, dirtyBlock)
+	require.NoError(t, err)
+
+	usage := GetMemoryUsage(config)
+	require.Equal(t, int64(len(block.Contents)),
+		usage.BlockCache.TLFBytes[otherTlfID])
+	require.Equal(t, int64(len(dirtyBlock.Contents)),
+		usage.DirtyBlockCache.Bytes)
+	require.Equal(t, int64(len(dirtyBlock.Contents)),
+		usage.DirtyBlockCache.TLFBytes[otherTlfID])
+	require.True(t, usage.NodeCache.TLFBytes[tlfID] > 0)
+	require.True(t, usage.MDCache.TLFBytes[tlfID] > 0)
+	require.Equal(t, usage.BlockCache.Bytes+usage.DirtyBlockCache.Bytes+
+		usage.NodeCache.Bytes+usage.MDCache.Bytes+
+		usage.BlockRetrievalQueue.Bytes, usage.TotalBytes)
+
+	err = config.DirtyBlockCache().Delete(otherTlfID, dirtyPtr, MasterBranch)
+	require.NoError(t, err)
+}
@@ -0,0 +1,108 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// MetricsCounter is a count that only ever goes up.
+type MetricsCounter interface {
+	Inc(n int64)
+}
+
+// MetricsMeter counts events, such as cache hits, so that their rate
+// can be tracked.
+type MetricsMeter interface {
+	Mark(n int64)
+}
+
+// MetricsTimer records how long an operation takes.
+type MetricsTimer interface {
+	// Time runs `f` and records how long it took.
+	Time(f func())
+	// UpdateSince records the time elapsed since `start`.
+	UpdateSince(start time.Time)
+}
+
+// MetricsSink is where KBFS records its metrics.  Embedders can
+// supply their own implementation to send them to Prometheus,
+// statsd, or anywhere else; by default they're kept in a go-metrics
+// registry.  Implementations must be goroutine-safe, and must return
+// the same metric whenever they're given the same name.
+type MetricsSink interface {
+	Counter(name string) MetricsCounter
+	Meter(name string) MetricsMeter
+	Timer(name string) MetricsTimer
+}
+
+// goMetricsSink is a MetricsSink backed by a go-metrics registry.
+type goMetricsSink struct {
+	registry metrics.Registry
+}
+
+var _ MetricsSink = goMetricsSink{}
+
+// NewGoMetricsSink returns a MetricsSink that keeps its metrics in
+// the given go-metrics registry.
+func NewGoMetricsSink(r metrics.Registry) MetricsSink {
+	return goMetricsSink{r}
+}
+
+// Counter implements the MetricsSink interface for goMetricsSink.
+func (s goMetricsSink) Counter(name string) MetricsCounter {
+	return metrics.GetOrRegisterCounter(name, s.registry)
+}
+
+// Meter implements the MetricsSink interface for goMetricsSink.
+func (s goMetricsSink) Meter(name string) MetricsMeter {
+	return metrics.GetOrRegisterMeter(name, s.registry)
+}
+
+// Timer implements the MetricsSink interface for goMetricsSink.
+func (s goMetricsSink) Timer(name string) MetricsTimer {
+	return metrics.GetOrRegisterTimer(name, s.registry)
+}
+
+// nullMetricsSink is a MetricsSink that drops everything.
+type nullMetricsSink struct{}
+
+var _ MetricsSink = nullMetricsSink{}
+
+type nullMetricsCounter struct{}
+
+func (nullMetricsCounter) Inc(int64) {}
+
+type nullMetricsMeter struct{}
+
+func (nullMetricsMeter) Mark(int64) {}
+
+type nullMetricsTimer struct{}
+
+func (nullMetricsTimer) Time(f func())         { f() }
+func (nullMetricsTimer) UpdateSince(time.Time) {}
+
+func (nullMetricsSink) Counter(string) MetricsCounter {
+	return nullMetricsCounter{}
+}
+
+func (nullMetricsSink) Meter(string) MetricsMeter {
+	return nullMetricsMeter{}
+}
+
+func (nullMetricsSink) Timer(string) MetricsTimer {
+	return nullMetricsTimer{}
+}
+
+// metricsSinkOrNull returns the MetricsSink of `config`, or one that
+// drops everything if metrics are turned off.
+func metricsSinkOrNull(config Config) MetricsSink {
+	if sink := config.MetricsSink(); sink != nil {
+		return sink
+	}
+	return nullMetricsSink{}
+}
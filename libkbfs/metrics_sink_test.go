@@ -0,0 +1,72 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	kbname "github.com/keybase/client/go/kbun"
+	"github.com/keybase/kbfs/tlf"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGoMetricsSink(t *testing.T) {
+	r := metrics.NewRegistry()
+	sink := NewGoMetricsSink(r)
+
+	t.Log("The same name always gives the same metric")
+	sink.Counter("c").Inc(2)
+	sink.Counter("c").Inc(3)
+	require.Equal(t, int64(5), r.Get("c").(metrics.Counter).Count())
+	sink.Meter("m").Mark(1)
+	require.Equal(t, int64(1), r.Get("m").(metrics.Meter).Count())
+	sink.Timer("t").Time(func() {})
+	require.Equal(t, int64(1), r.Get("t").(metrics.Timer).Count())
+}
+
+func TestFolderBlockOpsCountsDeferredWrites(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+	r := metrics.NewRegistry()
+	config.SetMetricsSink(NewGoMetricsSink(r))
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1}, 0)
+	require.NoError(t, err)
+
+	t.Log("Write to the file while it's being synced")
+	onPutStalledCh, putUnstallCh, putCtx :=
+		StallMDOp(ctx, config, StallableMDAfterPut, 1)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- kbfsOps.SyncAll(putCtx, fb)
+	}()
+	select {
+	case <-onPutStalledCh:
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	}
+	err = kbfsOps.Write(ctx, fileNode, []byte{2}, 1)
+	require.NoError(t, err)
+	close(putUnstallCh)
+	err = <-errChan
+	require.NoError(t, err)
+
+	t.Log("The write was counted as deferred")
+	c := r.Get("FolderBlockOps.DeferredWrites").(metrics.Counter)
+	require.Equal(t, int64(1), c.Count())
+	c = r.Get("FolderBlockOps.SyncRetries").(metrics.Counter)
+	require.Zero(t, c.Count())
+
+	t.Log("Sync the deferred write")
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+}
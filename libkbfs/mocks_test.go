@@ -18,6 +18,7 @@ import (
 	tlf "github.com/keybase/kbfs/tlf"
 	go_metrics "github.com/rcrowley/go-metrics"
 	context "golang.org/x/net/context"
+	io "io"
 	reflect "reflect"
 	time "time"
 )
@@ -232,6 +233,76 @@ func (mr *MockblockServerGetterMockRecorder) BlockServer() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "BlockServer", reflect.TypeOf((*MockblockServerGetter)(nil).BlockServer))
 }
 
+// MockpublicBlockFetcherGetter is a mock of publicBlockFetcherGetter interface
+type MockpublicBlockFetcherGetter struct {
+	ctrl     *gomock.Controller
+	recorder *MockpublicBlockFetcherGetterMockRecorder
+}
+
+// MockpublicBlockFetcherGetterMockRecorder is the mock recorder for MockpublicBlockFetcherGetter
+type MockpublicBlockFetcherGetterMockRecorder struct {
+	mock *MockpublicBlockFetcherGetter
+}
+
+// NewMockpublicBlockFetcherGetter creates a new mock instance
+func NewMockpublicBlockFetcherGetter(ctrl *gomock.Controller) *MockpublicBlockFetcherGetter {
+	mock := &MockpublicBlockFetcherGetter{ctrl: ctrl}
+	mock.recorder = &MockpublicBlockFetcherGetterMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockpublicBlockFetcherGetter) EXPECT() *MockpublicBlockFetcherGetterMockRecorder {
+	return m.recorder
+}
+
+// PublicBlockFetcher mocks base method
+func (m *MockpublicBlockFetcherGetter) PublicBlockFetcher() BlockFetcher {
+	ret := m.ctrl.Call(m, "PublicBlockFetcher")
+	ret0, _ := ret[0].(BlockFetcher)
+	return ret0
+}
+
+// PublicBlockFetcher indicates an expected call of PublicBlockFetcher
+func (mr *MockpublicBlockFetcherGetterMockRecorder) PublicBlockFetcher() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PublicBlockFetcher", reflect.TypeOf((*MockpublicBlockFetcherGetter)(nil).PublicBlockFetcher))
+}
+
+// MockmdVerifierGetter is a mock of mdVerifierGetter interface
+type MockmdVerifierGetter struct {
+	ctrl     *gomock.Controller
+	recorder *MockmdVerifierGetterMockRecorder
+}
+
+// MockmdVerifierGetterMockRecorder is the mock recorder for MockmdVerifierGetter
+type MockmdVerifierGetterMockRecorder struct {
+	mock *MockmdVerifierGetter
+}
+
+// NewMockmdVerifierGetter creates a new mock instance
+func NewMockmdVerifierGetter(ctrl *gomock.Controller) *MockmdVerifierGetter {
+	mock := &MockmdVerifierGetter{ctrl: ctrl}
+	mock.recorder = &MockmdVerifierGetterMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockmdVerifierGetter) EXPECT() *MockmdVerifierGetterMockRecorder {
+	return m.recorder
+}
+
+// mdVerifier mocks base method
+func (m *MockmdVerifierGetter) mdVerifier() *mdVerifier {
+	ret := m.ctrl.Call(m, "mdVerifier")
+	ret0, _ := ret[0].(*mdVerifier)
+	return ret0
+}
+
+// mdVerifier indicates an expected call of mdVerifier
+func (mr *MockmdVerifierGetterMockRecorder) mdVerifier() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "mdVerifier", reflect.TypeOf((*MockmdVerifierGetter)(nil).mdVerifier))
+}
+
 // MockcryptoPureGetter is a mock of cryptoPureGetter interface
 type MockcryptoPureGetter struct {
 	ctrl     *gomock.Controller
@@ -594,6 +665,30 @@ func (mr *MocksyncedTlfGetterSetterMockRecorder) SetTlfSyncState(tlfID, isSynced
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetTlfSyncState", reflect.TypeOf((*MocksyncedTlfGetterSetter)(nil).SetTlfSyncState), tlfID, isSynced)
 }
 
+// IsMetadataSyncedTlf mocks base method
+func (m *MocksyncedTlfGetterSetter) IsMetadataSyncedTlf(tlfID tlf.ID) bool {
+	ret := m.ctrl.Call(m, "IsMetadataSyncedTlf", tlfID)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// IsMetadataSyncedTlf indicates an expected call of IsMetadataSyncedTlf
+func (mr *MocksyncedTlfGetterSetterMockRecorder) IsMetadataSyncedTlf(tlfID interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "IsMetadataSyncedTlf", reflect.TypeOf((*MocksyncedTlfGetterSetter)(nil).IsMetadataSyncedTlf), tlfID)
+}
+
+// SetTlfMetadataSyncState mocks base method
+func (m *MocksyncedTlfGetterSetter) SetTlfMetadataSyncState(tlfID tlf.ID, isSynced bool) error {
+	ret := m.ctrl.Call(m, "SetTlfMetadataSyncState", tlfID, isSynced)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetTlfMetadataSyncState indicates an expected call of SetTlfMetadataSyncState
+func (mr *MocksyncedTlfGetterSetterMockRecorder) SetTlfMetadataSyncState(tlfID, isSynced interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetTlfMetadataSyncState", reflect.TypeOf((*MocksyncedTlfGetterSetter)(nil).SetTlfMetadataSyncState), tlfID, isSynced)
+}
+
 // MockblockRetrieverGetter is a mock of blockRetrieverGetter interface
 type MockblockRetrieverGetter struct {
 	ctrl     *gomock.Controller
@@ -629,6 +724,111 @@ func (mr *MockblockRetrieverGetterMockRecorder) BlockRetriever() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "BlockRetriever", reflect.TypeOf((*MockblockRetrieverGetter)(nil).BlockRetriever))
 }
 
+// MockidleTrackerGetter is a mock of idleTrackerGetter interface
+type MockidleTrackerGetter struct {
+	ctrl     *gomock.Controller
+	recorder *MockidleTrackerGetterMockRecorder
+}
+
+// MockidleTrackerGetterMockRecorder is the mock recorder for MockidleTrackerGetter
+type MockidleTrackerGetterMockRecorder struct {
+	mock *MockidleTrackerGetter
+}
+
+// NewMockidleTrackerGetter creates a new mock instance
+func NewMockidleTrackerGetter(ctrl *gomock.Controller) *MockidleTrackerGetter {
+	mock := &MockidleTrackerGetter{ctrl: ctrl}
+	mock.recorder = &MockidleTrackerGetterMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockidleTrackerGetter) EXPECT() *MockidleTrackerGetterMockRecorder {
+	return m.recorder
+}
+
+// IdleTracker mocks base method
+func (m *MockidleTrackerGetter) IdleTracker() *IdleTracker {
+	ret := m.ctrl.Call(m, "IdleTracker")
+	ret0, _ := ret[0].(*IdleTracker)
+	return ret0
+}
+
+// IdleTracker indicates an expected call of IdleTracker
+func (mr *MockidleTrackerGetterMockRecorder) IdleTracker() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "IdleTracker", reflect.TypeOf((*MockidleTrackerGetter)(nil).IdleTracker))
+}
+
+// MockpowerMonitorGetter is a mock of powerMonitorGetter interface
+type MockpowerMonitorGetter struct {
+	ctrl     *gomock.Controller
+	recorder *MockpowerMonitorGetterMockRecorder
+}
+
+// MockpowerMonitorGetterMockRecorder is the mock recorder for MockpowerMonitorGetter
+type MockpowerMonitorGetterMockRecorder struct {
+	mock *MockpowerMonitorGetter
+}
+
+// NewMockpowerMonitorGetter creates a new mock instance
+func NewMockpowerMonitorGetter(ctrl *gomock.Controller) *MockpowerMonitorGetter {
+	mock := &MockpowerMonitorGetter{ctrl: ctrl}
+	mock.recorder = &MockpowerMonitorGetterMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockpowerMonitorGetter) EXPECT() *MockpowerMonitorGetterMockRecorder {
+	return m.recorder
+}
+
+// PowerMonitor mocks base method
+func (m *MockpowerMonitorGetter) PowerMonitor() *PowerMonitor {
+	ret := m.ctrl.Call(m, "PowerMonitor")
+	ret0, _ := ret[0].(*PowerMonitor)
+	return ret0
+}
+
+// PowerMonitor indicates an expected call of PowerMonitor
+func (mr *MockpowerMonitorGetterMockRecorder) PowerMonitor() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PowerMonitor", reflect.TypeOf((*MockpowerMonitorGetter)(nil).PowerMonitor))
+}
+
+// MockprefetchBudgetGetter is a mock of prefetchBudgetGetter interface
+type MockprefetchBudgetGetter struct {
+	ctrl     *gomock.Controller
+	recorder *MockprefetchBudgetGetterMockRecorder
+}
+
+// MockprefetchBudgetGetterMockRecorder is the mock recorder for MockprefetchBudgetGetter
+type MockprefetchBudgetGetterMockRecorder struct {
+	mock *MockprefetchBudgetGetter
+}
+
+// NewMockprefetchBudgetGetter creates a new mock instance
+func NewMockprefetchBudgetGetter(ctrl *gomock.Controller) *MockprefetchBudgetGetter {
+	mock := &MockprefetchBudgetGetter{ctrl: ctrl}
+	mock.recorder = &MockprefetchBudgetGetterMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockprefetchBudgetGetter) EXPECT() *MockprefetchBudgetGetterMockRecorder {
+	return m.recorder
+}
+
+// PrefetchBudget mocks base method
+func (m *MockprefetchBudgetGetter) PrefetchBudget() *PrefetchBudget {
+	ret := m.ctrl.Call(m, "PrefetchBudget")
+	ret0, _ := ret[0].(*PrefetchBudget)
+	return ret0
+}
+
+// PrefetchBudget indicates an expected call of PrefetchBudget
+func (mr *MockprefetchBudgetGetterMockRecorder) PrefetchBudget() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PrefetchBudget", reflect.TypeOf((*MockprefetchBudgetGetter)(nil).PrefetchBudget))
+}
+
 // MockOffset is a mock of Offset interface
 type MockOffset struct {
 	ctrl     *gomock.Controller
@@ -1267,6 +1467,19 @@ func (mr *MockKBFSOpsMockRecorder) DeleteFavorite(ctx, fav interface{}) *gomock.
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteFavorite", reflect.TypeOf((*MockKBFSOps)(nil).DeleteFavorite), ctx, fav)
 }
 
+// ConfigureTlfs mocks base method
+func (m *MockKBFSOps) ConfigureTlfs(ctx context.Context, reqs []TlfConfigRequest) ([]error, error) {
+	ret := m.ctrl.Call(m, "ConfigureTlfs", ctx, reqs)
+	ret0, _ := ret[0].([]error)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ConfigureTlfs indicates an expected call of ConfigureTlfs
+func (mr *MockKBFSOpsMockRecorder) ConfigureTlfs(ctx, reqs interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ConfigureTlfs", reflect.TypeOf((*MockKBFSOps)(nil).ConfigureTlfs), ctx, reqs)
+}
+
 // GetTLFCryptKeys mocks base method
 func (m *MockKBFSOps) GetTLFCryptKeys(ctx context.Context, tlfHandle *TlfHandle) ([]kbfscrypto.TLFCryptKey, tlf.ID, error) {
 	ret := m.ctrl.Call(m, "GetTLFCryptKeys", ctx, tlfHandle)
@@ -1348,6 +1561,18 @@ func (mr *MockKBFSOpsMockRecorder) GetDirChildren(ctx, dir interface{}) *gomock.
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetDirChildren", reflect.TypeOf((*MockKBFSOps)(nil).GetDirChildren), ctx, dir)
 }
 
+// WalkTLF mocks base method
+func (m *MockKBFSOps) WalkTLF(ctx context.Context, dir Node, walkFn WalkTLFFunc) error {
+	ret := m.ctrl.Call(m, "WalkTLF", ctx, dir, walkFn)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// WalkTLF indicates an expected call of WalkTLF
+func (mr *MockKBFSOpsMockRecorder) WalkTLF(ctx, dir, walkFn interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WalkTLF", reflect.TypeOf((*MockKBFSOps)(nil).WalkTLF), ctx, dir, walkFn)
+}
+
 // Lookup mocks base method
 func (m *MockKBFSOps) Lookup(ctx context.Context, dir Node, name string) (Node, EntryInfo, error) {
 	ret := m.ctrl.Call(m, "Lookup", ctx, dir, name)
@@ -1375,6 +1600,109 @@ func (mr *MockKBFSOpsMockRecorder) Stat(ctx, node interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Stat", reflect.TypeOf((*MockKBFSOps)(nil).Stat), ctx, node)
 }
 
+// GetAllocatedSize mocks base method
+func (m *MockKBFSOps) GetAllocatedSize(ctx context.Context, node Node) (uint64, error) {
+	ret := m.ctrl.Call(m, "GetAllocatedSize", ctx, node)
+	ret0, _ := ret[0].(uint64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAllocatedSize indicates an expected call of GetAllocatedSize
+func (mr *MockKBFSOpsMockRecorder) GetAllocatedSize(ctx, node interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAllocatedSize", reflect.TypeOf((*MockKBFSOps)(nil).GetAllocatedSize), ctx, node)
+}
+
+// GetFileBlockLayout mocks base method
+func (m *MockKBFSOps) GetFileBlockLayout(ctx context.Context, file Node) (FileBlockLayout, error) {
+	ret := m.ctrl.Call(m, "GetFileBlockLayout", ctx, file)
+	ret0, _ := ret[0].(FileBlockLayout)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetFileBlockLayout indicates an expected call of GetFileBlockLayout
+func (mr *MockKBFSOpsMockRecorder) GetFileBlockLayout(ctx, file interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetFileBlockLayout", reflect.TypeOf((*MockKBFSOps)(nil).GetFileBlockLayout), ctx, file)
+}
+
+// ReadFileAt mocks base method
+func (m *MockKBFSOps) ReadFileAt(ctx context.Context, p string) ([]byte, error) {
+	ret := m.ctrl.Call(m, "ReadFileAt", ctx, p)
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ReadFileAt indicates an expected call of ReadFileAt
+func (mr *MockKBFSOpsMockRecorder) ReadFileAt(ctx, p interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReadFileAt", reflect.TypeOf((*MockKBFSOps)(nil).ReadFileAt), ctx, p)
+}
+
+// WriteFileAt mocks base method
+func (m *MockKBFSOps) WriteFileAt(ctx context.Context, p string, data []byte) error {
+	ret := m.ctrl.Call(m, "WriteFileAt", ctx, p, data)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// WriteFileAt indicates an expected call of WriteFileAt
+func (mr *MockKBFSOpsMockRecorder) WriteFileAt(ctx, p, data interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WriteFileAt", reflect.TypeOf((*MockKBFSOps)(nil).WriteFileAt), ctx, p, data)
+}
+
+// StatAt mocks base method
+func (m *MockKBFSOps) StatAt(ctx context.Context, p string) (EntryInfo, error) {
+	ret := m.ctrl.Call(m, "StatAt", ctx, p)
+	ret0, _ := ret[0].(EntryInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// StatAt indicates an expected call of StatAt
+func (mr *MockKBFSOpsMockRecorder) StatAt(ctx, p interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StatAt", reflect.TypeOf((*MockKBFSOps)(nil).StatAt), ctx, p)
+}
+
+// StatMany mocks base method
+func (m *MockKBFSOps) StatMany(ctx context.Context, paths []string) (map[string]DirEntry, error) {
+	ret := m.ctrl.Call(m, "StatMany", ctx, paths)
+	ret0, _ := ret[0].(map[string]DirEntry)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// StatMany indicates an expected call of StatMany
+func (mr *MockKBFSOpsMockRecorder) StatMany(ctx, paths interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StatMany", reflect.TypeOf((*MockKBFSOps)(nil).StatMany), ctx, paths)
+}
+
+// Watch mocks base method
+func (m *MockKBFSOps) Watch(ctx context.Context, p string, recursive bool, filter WatchEventType, fn WatchFunc) (func(), error) {
+	ret := m.ctrl.Call(m, "Watch", ctx, p, recursive, filter, fn)
+	ret0, _ := ret[0].(func())
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Watch indicates an expected call of Watch
+func (mr *MockKBFSOpsMockRecorder) Watch(ctx, p, recursive, filter, fn interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Watch", reflect.TypeOf((*MockKBFSOps)(nil).Watch), ctx, p, recursive, filter, fn)
+}
+
+// ListAt mocks base method
+func (m *MockKBFSOps) ListAt(ctx context.Context, p string) (map[string]EntryInfo, error) {
+	ret := m.ctrl.Call(m, "ListAt", ctx, p)
+	ret0, _ := ret[0].(map[string]EntryInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListAt indicates an expected call of ListAt
+func (mr *MockKBFSOpsMockRecorder) ListAt(ctx, p interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListAt", reflect.TypeOf((*MockKBFSOps)(nil).ListAt), ctx, p)
+}
+
 // CreateDir mocks base method
 func (m *MockKBFSOps) CreateDir(ctx context.Context, dir Node, name string) (Node, EntryInfo, error) {
 	ret := m.ctrl.Call(m, "CreateDir", ctx, dir, name)
@@ -1403,6 +1731,34 @@ func (mr *MockKBFSOpsMockRecorder) CreateFile(ctx, dir, name, isExec, excl inter
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateFile", reflect.TypeOf((*MockKBFSOps)(nil).CreateFile), ctx, dir, name, isExec, excl)
 }
 
+// CreateFiles mocks base method
+func (m *MockKBFSOps) CreateFiles(ctx context.Context, dir Node, files []NewFileInfo) ([]Node, []EntryInfo, error) {
+	ret := m.ctrl.Call(m, "CreateFiles", ctx, dir, files)
+	ret0, _ := ret[0].([]Node)
+	ret1, _ := ret[1].([]EntryInfo)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// CreateFiles indicates an expected call of CreateFiles
+func (mr *MockKBFSOpsMockRecorder) CreateFiles(ctx, dir, files interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateFiles", reflect.TypeOf((*MockKBFSOps)(nil).CreateFiles), ctx, dir, files)
+}
+
+// InstantiateTemplate mocks base method
+func (m *MockKBFSOps) InstantiateTemplate(ctx context.Context, template, dir Node, name string) (Node, EntryInfo, error) {
+	ret := m.ctrl.Call(m, "InstantiateTemplate", ctx, template, dir, name)
+	ret0, _ := ret[0].(Node)
+	ret1, _ := ret[1].(EntryInfo)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// InstantiateTemplate indicates an expected call of InstantiateTemplate
+func (mr *MockKBFSOpsMockRecorder) InstantiateTemplate(ctx, template, dir, name interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "InstantiateTemplate", reflect.TypeOf((*MockKBFSOps)(nil).InstantiateTemplate), ctx, template, dir, name)
+}
+
 // CreateLink mocks base method
 func (m *MockKBFSOps) CreateLink(ctx context.Context, dir Node, fromName, toPath string) (EntryInfo, error) {
 	ret := m.ctrl.Call(m, "CreateLink", ctx, dir, fromName, toPath)
@@ -1465,6 +1821,32 @@ func (mr *MockKBFSOpsMockRecorder) Read(ctx, file, dest, off interface{}) *gomoc
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Read", reflect.TypeOf((*MockKBFSOps)(nil).Read), ctx, file, dest, off)
 }
 
+// FetchFileRange mocks base method
+func (m *MockKBFSOps) FetchFileRange(ctx context.Context, file Node, off, length int64) (FileRange, error) {
+	ret := m.ctrl.Call(m, "FetchFileRange", ctx, file, off, length)
+	ret0, _ := ret[0].(FileRange)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FetchFileRange indicates an expected call of FetchFileRange
+func (mr *MockKBFSOpsMockRecorder) FetchFileRange(ctx, file, off, length interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FetchFileRange", reflect.TypeOf((*MockKBFSOps)(nil).FetchFileRange), ctx, file, off, length)
+}
+
+// GetLocalFileRanges mocks base method
+func (m *MockKBFSOps) GetLocalFileRanges(ctx context.Context, file Node) ([]FileRange, error) {
+	ret := m.ctrl.Call(m, "GetLocalFileRanges", ctx, file)
+	ret0, _ := ret[0].([]FileRange)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetLocalFileRanges indicates an expected call of GetLocalFileRanges
+func (mr *MockKBFSOpsMockRecorder) GetLocalFileRanges(ctx, file interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetLocalFileRanges", reflect.TypeOf((*MockKBFSOps)(nil).GetLocalFileRanges), ctx, file)
+}
+
 // Write mocks base method
 func (m *MockKBFSOps) Write(ctx context.Context, file Node, data []byte, off int64) error {
 	ret := m.ctrl.Call(m, "Write", ctx, file, data, off)
@@ -1477,6 +1859,71 @@ func (mr *MockKBFSOpsMockRecorder) Write(ctx, file, data, off interface{}) *gomo
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Write", reflect.TypeOf((*MockKBFSOps)(nil).Write), ctx, file, data, off)
 }
 
+// ReadVec mocks base method
+func (m *MockKBFSOps) ReadVec(ctx context.Context, file Node, vecs []IOVec) ([]int64, error) {
+	ret := m.ctrl.Call(m, "ReadVec", ctx, file, vecs)
+	ret0, _ := ret[0].([]int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ReadVec indicates an expected call of ReadVec
+func (mr *MockKBFSOpsMockRecorder) ReadVec(ctx, file, vecs interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReadVec", reflect.TypeOf((*MockKBFSOps)(nil).ReadVec), ctx, file, vecs)
+}
+
+// WriteVec mocks base method
+func (m *MockKBFSOps) WriteVec(ctx context.Context, file Node, vecs []IOVec) error {
+	ret := m.ctrl.Call(m, "WriteVec", ctx, file, vecs)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// WriteVec indicates an expected call of WriteVec
+func (mr *MockKBFSOpsMockRecorder) WriteVec(ctx, file, vecs interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WriteVec", reflect.TypeOf((*MockKBFSOps)(nil).WriteVec), ctx, file, vecs)
+}
+
+// WriteStream mocks base method
+func (m *MockKBFSOps) WriteStream(ctx context.Context, file Node, r io.Reader, off int64) (int64, error) {
+	ret := m.ctrl.Call(m, "WriteStream", ctx, file, r, off)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// WriteStream indicates an expected call of WriteStream
+func (mr *MockKBFSOpsMockRecorder) WriteStream(ctx, file, r, off interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WriteStream", reflect.TypeOf((*MockKBFSOps)(nil).WriteStream), ctx, file, r, off)
+}
+
+// CopyFileRange mocks base method
+func (m *MockKBFSOps) CopyFileRange(ctx context.Context, src, dst Node, srcOff, dstOff, length int64) (int64, error) {
+	ret := m.ctrl.Call(m, "CopyFileRange", ctx, src, dst, srcOff, dstOff, length)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CopyFileRange indicates an expected call of CopyFileRange
+func (mr *MockKBFSOpsMockRecorder) CopyFileRange(ctx, src, dst, srcOff, dstOff, length interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CopyFileRange", reflect.TypeOf((*MockKBFSOps)(nil).CopyFileRange), ctx, src, dst, srcOff, dstOff, length)
+}
+
+// CloneFile mocks base method
+func (m *MockKBFSOps) CloneFile(ctx context.Context, src, dstDir Node, name string) (Node, EntryInfo, error) {
+	ret := m.ctrl.Call(m, "CloneFile", ctx, src, dstDir, name)
+	ret0, _ := ret[0].(Node)
+	ret1, _ := ret[1].(EntryInfo)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// CloneFile indicates an expected call of CloneFile
+func (mr *MockKBFSOpsMockRecorder) CloneFile(ctx, src, dstDir, name interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CloneFile", reflect.TypeOf((*MockKBFSOps)(nil).CloneFile), ctx, src, dstDir, name)
+}
+
 // Truncate mocks base method
 func (m *MockKBFSOps) Truncate(ctx context.Context, file Node, size uint64) error {
 	ret := m.ctrl.Call(m, "Truncate", ctx, file, size)
@@ -1501,6 +1948,18 @@ func (mr *MockKBFSOpsMockRecorder) SetEx(ctx, file, ex interface{}) *gomock.Call
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetEx", reflect.TypeOf((*MockKBFSOps)(nil).SetEx), ctx, file, ex)
 }
 
+// SetExInSubtree mocks base method
+func (m *MockKBFSOps) SetExInSubtree(ctx context.Context, dir Node, ex bool) error {
+	ret := m.ctrl.Call(m, "SetExInSubtree", ctx, dir, ex)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetExInSubtree indicates an expected call of SetExInSubtree
+func (mr *MockKBFSOpsMockRecorder) SetExInSubtree(ctx, dir, ex interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetExInSubtree", reflect.TypeOf((*MockKBFSOps)(nil).SetExInSubtree), ctx, dir, ex)
+}
+
 // SetMtime mocks base method
 func (m *MockKBFSOps) SetMtime(ctx context.Context, file Node, mtime *time.Time) error {
 	ret := m.ctrl.Call(m, "SetMtime", ctx, file, mtime)
@@ -1513,6 +1972,30 @@ func (mr *MockKBFSOpsMockRecorder) SetMtime(ctx, file, mtime interface{}) *gomoc
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetMtime", reflect.TypeOf((*MockKBFSOps)(nil).SetMtime), ctx, file, mtime)
 }
 
+// SetTimes mocks base method
+func (m *MockKBFSOps) SetTimes(ctx context.Context, file Node, mtime time.Time, ctime *time.Time) error {
+	ret := m.ctrl.Call(m, "SetTimes", ctx, file, mtime, ctime)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetTimes indicates an expected call of SetTimes
+func (mr *MockKBFSOpsMockRecorder) SetTimes(ctx, file, mtime, ctime interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetTimes", reflect.TypeOf((*MockKBFSOps)(nil).SetTimes), ctx, file, mtime, ctime)
+}
+
+// SetTimesBatch mocks base method
+func (m *MockKBFSOps) SetTimesBatch(ctx context.Context, times []NodeTimes) error {
+	ret := m.ctrl.Call(m, "SetTimesBatch", ctx, times)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetTimesBatch indicates an expected call of SetTimesBatch
+func (mr *MockKBFSOpsMockRecorder) SetTimesBatch(ctx, times interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetTimesBatch", reflect.TypeOf((*MockKBFSOps)(nil).SetTimesBatch), ctx, times)
+}
+
 // SyncAll mocks base method
 func (m *MockKBFSOps) SyncAll(ctx context.Context, folderBranch FolderBranch) error {
 	ret := m.ctrl.Call(m, "SyncAll", ctx, folderBranch)
@@ -1525,6 +2008,43 @@ func (mr *MockKBFSOpsMockRecorder) SyncAll(ctx, folderBranch interface{}) *gomoc
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SyncAll", reflect.TypeOf((*MockKBFSOps)(nil).SyncAll), ctx, folderBranch)
 }
 
+// SyncAllAsync mocks base method
+func (m *MockKBFSOps) SyncAllAsync(ctx context.Context, folderBranch FolderBranch) (SyncTicket, error) {
+	ret := m.ctrl.Call(m, "SyncAllAsync", ctx, folderBranch)
+	ret0, _ := ret[0].(SyncTicket)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SyncAllAsync indicates an expected call of SyncAllAsync
+func (mr *MockKBFSOpsMockRecorder) SyncAllAsync(ctx, folderBranch interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SyncAllAsync", reflect.TypeOf((*MockKBFSOps)(nil).SyncAllAsync), ctx, folderBranch)
+}
+
+// SetWriteThrough mocks base method
+func (m *MockKBFSOps) SetWriteThrough(ctx context.Context, file Node, writeThrough bool) error {
+	ret := m.ctrl.Call(m, "SetWriteThrough", ctx, file, writeThrough)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetWriteThrough indicates an expected call of SetWriteThrough
+func (mr *MockKBFSOpsMockRecorder) SetWriteThrough(ctx, file, writeThrough interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetWriteThrough", reflect.TypeOf((*MockKBFSOps)(nil).SetWriteThrough), ctx, file, writeThrough)
+}
+
+// Barrier mocks base method
+func (m *MockKBFSOps) Barrier(ctx context.Context, file Node) error {
+	ret := m.ctrl.Call(m, "Barrier", ctx, file)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Barrier indicates an expected call of Barrier
+func (mr *MockKBFSOpsMockRecorder) Barrier(ctx, file interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Barrier", reflect.TypeOf((*MockKBFSOps)(nil).Barrier), ctx, file)
+}
+
 // FolderStatus mocks base method
 func (m *MockKBFSOps) FolderStatus(ctx context.Context, folderBranch FolderBranch) (FolderBranchStatus, <-chan StatusUpdate, error) {
 	ret := m.ctrl.Call(m, "FolderStatus", ctx, folderBranch)
@@ -1553,6 +2073,81 @@ func (mr *MockKBFSOpsMockRecorder) Status(ctx interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Status", reflect.TypeOf((*MockKBFSOps)(nil).Status), ctx)
 }
 
+// GetUnlinkedNodeStats mocks base method
+func (m *MockKBFSOps) GetUnlinkedNodeStats(ctx context.Context, folderBranch FolderBranch) (UnlinkedNodeStats, error) {
+	ret := m.ctrl.Call(m, "GetUnlinkedNodeStats", ctx, folderBranch)
+	ret0, _ := ret[0].(UnlinkedNodeStats)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUnlinkedNodeStats indicates an expected call of GetUnlinkedNodeStats
+func (mr *MockKBFSOpsMockRecorder) GetUnlinkedNodeStats(ctx, folderBranch interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUnlinkedNodeStats", reflect.TypeOf((*MockKBFSOps)(nil).GetUnlinkedNodeStats), ctx, folderBranch)
+}
+
+// SetTlfBlockSize mocks base method
+func (m *MockKBFSOps) SetTlfBlockSize(ctx context.Context, folderBranch FolderBranch, size int64) error {
+	ret := m.ctrl.Call(m, "SetTlfBlockSize", ctx, folderBranch, size)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetTlfBlockSize indicates an expected call of SetTlfBlockSize
+func (mr *MockKBFSOpsMockRecorder) SetTlfBlockSize(ctx, folderBranch, size interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetTlfBlockSize", reflect.TypeOf((*MockKBFSOps)(nil).SetTlfBlockSize), ctx, folderBranch, size)
+}
+
+// RevertToRevision mocks base method
+func (m *MockKBFSOps) RevertToRevision(ctx context.Context, folderBranch FolderBranch, rev, expectedHead kbfsmd.Revision, dryRun bool) (TLFRevert, error) {
+	ret := m.ctrl.Call(m, "RevertToRevision", ctx, folderBranch, rev, expectedHead, dryRun)
+	ret0, _ := ret[0].(TLFRevert)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RevertToRevision indicates an expected call of RevertToRevision
+func (mr *MockKBFSOpsMockRecorder) RevertToRevision(ctx, folderBranch, rev, expectedHead, dryRun interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RevertToRevision", reflect.TypeOf((*MockKBFSOps)(nil).RevertToRevision), ctx, folderBranch, rev, expectedHead, dryRun)
+}
+
+// ReclaimUnlinkedNodes mocks base method
+func (m *MockKBFSOps) ReclaimUnlinkedNodes(ctx context.Context, folderBranch FolderBranch) (UnlinkedNodeStats, error) {
+	ret := m.ctrl.Call(m, "ReclaimUnlinkedNodes", ctx, folderBranch)
+	ret0, _ := ret[0].(UnlinkedNodeStats)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ReclaimUnlinkedNodes indicates an expected call of ReclaimUnlinkedNodes
+func (mr *MockKBFSOpsMockRecorder) ReclaimUnlinkedNodes(ctx, folderBranch interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReclaimUnlinkedNodes", reflect.TypeOf((*MockKBFSOps)(nil).ReclaimUnlinkedNodes), ctx, folderBranch)
+}
+
+// SubscribeSubtrees mocks base method
+func (m *MockKBFSOps) SubscribeSubtrees(ctx context.Context, folderBranch FolderBranch, subtrees []string) error {
+	ret := m.ctrl.Call(m, "SubscribeSubtrees", ctx, folderBranch, subtrees)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SubscribeSubtrees indicates an expected call of SubscribeSubtrees
+func (mr *MockKBFSOpsMockRecorder) SubscribeSubtrees(ctx, folderBranch, subtrees interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SubscribeSubtrees", reflect.TypeOf((*MockKBFSOps)(nil).SubscribeSubtrees), ctx, folderBranch, subtrees)
+}
+
+// CancelSync mocks base method
+func (m *MockKBFSOps) CancelSync(ctx context.Context, file Node) error {
+	ret := m.ctrl.Call(m, "CancelSync", ctx, file)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CancelSync indicates an expected call of CancelSync
+func (mr *MockKBFSOpsMockRecorder) CancelSync(ctx, file interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CancelSync", reflect.TypeOf((*MockKBFSOps)(nil).CancelSync), ctx, file)
+}
+
 // UnstageForTesting mocks base method
 func (m *MockKBFSOps) UnstageForTesting(ctx context.Context, folderBranch FolderBranch) error {
 	ret := m.ctrl.Call(m, "UnstageForTesting", ctx, folderBranch)
@@ -2485,29 +3080,65 @@ type MockteamRootIDGetterMockRecorder struct {
 	mock *MockteamRootIDGetter
 }
 
-// NewMockteamRootIDGetter creates a new mock instance
-func NewMockteamRootIDGetter(ctrl *gomock.Controller) *MockteamRootIDGetter {
-	mock := &MockteamRootIDGetter{ctrl: ctrl}
-	mock.recorder = &MockteamRootIDGetterMockRecorder{mock}
+// NewMockteamRootIDGetter creates a new mock instance
+func NewMockteamRootIDGetter(ctrl *gomock.Controller) *MockteamRootIDGetter {
+	mock := &MockteamRootIDGetter{ctrl: ctrl}
+	mock.recorder = &MockteamRootIDGetterMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockteamRootIDGetter) EXPECT() *MockteamRootIDGetterMockRecorder {
+	return m.recorder
+}
+
+// GetTeamRootID mocks base method
+func (m *MockteamRootIDGetter) GetTeamRootID(ctx context.Context, tid keybase1.TeamID) (keybase1.TeamID, error) {
+	ret := m.ctrl.Call(m, "GetTeamRootID", ctx, tid)
+	ret0, _ := ret[0].(keybase1.TeamID)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetTeamRootID indicates an expected call of GetTeamRootID
+func (mr *MockteamRootIDGetterMockRecorder) GetTeamRootID(ctx, tid interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetTeamRootID", reflect.TypeOf((*MockteamRootIDGetter)(nil).GetTeamRootID), ctx, tid)
+}
+
+// MockteamRoleGetter is a mock of teamRoleGetter interface
+type MockteamRoleGetter struct {
+	ctrl     *gomock.Controller
+	recorder *MockteamRoleGetterMockRecorder
+}
+
+// MockteamRoleGetterMockRecorder is the mock recorder for MockteamRoleGetter
+type MockteamRoleGetterMockRecorder struct {
+	mock *MockteamRoleGetter
+}
+
+// NewMockteamRoleGetter creates a new mock instance
+func NewMockteamRoleGetter(ctrl *gomock.Controller) *MockteamRoleGetter {
+	mock := &MockteamRoleGetter{ctrl: ctrl}
+	mock.recorder = &MockteamRoleGetterMockRecorder{mock}
 	return mock
 }
 
 // EXPECT returns an object that allows the caller to indicate expected use
-func (m *MockteamRootIDGetter) EXPECT() *MockteamRootIDGetterMockRecorder {
+func (m *MockteamRoleGetter) EXPECT() *MockteamRoleGetterMockRecorder {
 	return m.recorder
 }
 
-// GetTeamRootID mocks base method
-func (m *MockteamRootIDGetter) GetTeamRootID(ctx context.Context, tid keybase1.TeamID) (keybase1.TeamID, error) {
-	ret := m.ctrl.Call(m, "GetTeamRootID", ctx, tid)
-	ret0, _ := ret[0].(keybase1.TeamID)
+// GetTeamRole mocks base method
+func (m *MockteamRoleGetter) GetTeamRole(ctx context.Context, tid keybase1.TeamID, uid keybase1.UID) (keybase1.TeamRole, error) {
+	ret := m.ctrl.Call(m, "GetTeamRole", ctx, tid, uid)
+	ret0, _ := ret[0].(keybase1.TeamRole)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// GetTeamRootID indicates an expected call of GetTeamRootID
-func (mr *MockteamRootIDGetterMockRecorder) GetTeamRootID(ctx, tid interface{}) *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetTeamRootID", reflect.TypeOf((*MockteamRootIDGetter)(nil).GetTeamRootID), ctx, tid)
+// GetTeamRole indicates an expected call of GetTeamRole
+func (mr *MockteamRoleGetterMockRecorder) GetTeamRole(ctx, tid, uid interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetTeamRole", reflect.TypeOf((*MockteamRoleGetter)(nil).GetTeamRole), ctx, tid, uid)
 }
 
 // MockKBPKI is a mock of KBPKI interface
@@ -2745,6 +3376,19 @@ func (mr *MockKBPKIMockRecorder) GetTeamRootID(ctx, tid interface{}) *gomock.Cal
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetTeamRootID", reflect.TypeOf((*MockKBPKI)(nil).GetTeamRootID), ctx, tid)
 }
 
+// GetTeamRole mocks base method
+func (m *MockKBPKI) GetTeamRole(ctx context.Context, tid keybase1.TeamID, uid keybase1.UID) (keybase1.TeamRole, error) {
+	ret := m.ctrl.Call(m, "GetTeamRole", ctx, tid, uid)
+	ret0, _ := ret[0].(keybase1.TeamRole)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetTeamRole indicates an expected call of GetTeamRole
+func (mr *MockKBPKIMockRecorder) GetTeamRole(ctx, tid, uid interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetTeamRole", reflect.TypeOf((*MockKBPKI)(nil).GetTeamRole), ctx, tid, uid)
+}
+
 // PutGitMetadata mocks base method
 func (m *MockKBPKI) PutGitMetadata(ctx context.Context, folder keybase1.Folder, repoID keybase1.RepoID, metadata keybase1.GitLocalMetadata) error {
 	ret := m.ctrl.Call(m, "PutGitMetadata", ctx, folder, repoID, metadata)
@@ -5784,6 +6428,43 @@ func (mr *MockmdServerLocalMockRecorder) setKbfsMerkleRoot(treeID, root interfac
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "setKbfsMerkleRoot", reflect.TypeOf((*MockmdServerLocal)(nil).setKbfsMerkleRoot), treeID, root)
 }
 
+// MockBlockFetcher is a mock of BlockFetcher interface
+type MockBlockFetcher struct {
+	ctrl     *gomock.Controller
+	recorder *MockBlockFetcherMockRecorder
+}
+
+// MockBlockFetcherMockRecorder is the mock recorder for MockBlockFetcher
+type MockBlockFetcherMockRecorder struct {
+	mock *MockBlockFetcher
+}
+
+// NewMockBlockFetcher creates a new mock instance
+func NewMockBlockFetcher(ctrl *gomock.Controller) *MockBlockFetcher {
+	mock := &MockBlockFetcher{ctrl: ctrl}
+	mock.recorder = &MockBlockFetcherMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockBlockFetcher) EXPECT() *MockBlockFetcherMockRecorder {
+	return m.recorder
+}
+
+// Get mocks base method
+func (m *MockBlockFetcher) Get(ctx context.Context, tlfID tlf.ID, id kbfsblock.ID, context kbfsblock.Context) ([]byte, kbfscrypto.BlockCryptKeyServerHalf, error) {
+	ret := m.ctrl.Call(m, "Get", ctx, tlfID, id, context)
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(kbfscrypto.BlockCryptKeyServerHalf)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// Get indicates an expected call of Get
+func (mr *MockBlockFetcherMockRecorder) Get(ctx, tlfID, id, context interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockBlockFetcher)(nil).Get), ctx, tlfID, id, context)
+}
+
 // MockBlockServer is a mock of BlockServer interface
 type MockBlockServer struct {
 	ctrl     *gomock.Controller
@@ -6195,6 +6876,18 @@ func (mr *MockBlockSplitterMockRecorder) SplitDirIfNeeded(block interface{}) *go
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SplitDirIfNeeded", reflect.TypeOf((*MockBlockSplitter)(nil).SplitDirIfNeeded), block)
 }
 
+// DirHashBuckets mocks base method
+func (m *MockBlockSplitter) DirHashBuckets() int {
+	ret := m.ctrl.Call(m, "DirHashBuckets")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+// DirHashBuckets indicates an expected call of DirHashBuckets
+func (mr *MockBlockSplitterMockRecorder) DirHashBuckets() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DirHashBuckets", reflect.TypeOf((*MockBlockSplitter)(nil).DirHashBuckets))
+}
+
 // MockKeyServer is a mock of KeyServer interface
 type MockKeyServer struct {
 	ctrl     *gomock.Controller
@@ -6946,6 +7639,18 @@ func (mr *MockConfigMockRecorder) keyGetter() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "keyGetter", reflect.TypeOf((*MockConfig)(nil).keyGetter))
 }
 
+// mdVerifier mocks base method
+func (m *MockConfig) mdVerifier() *mdVerifier {
+	ret := m.ctrl.Call(m, "mdVerifier")
+	ret0, _ := ret[0].(*mdVerifier)
+	return ret0
+}
+
+// mdVerifier indicates an expected call of mdVerifier
+func (mr *MockConfigMockRecorder) mdVerifier() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "mdVerifier", reflect.TypeOf((*MockConfig)(nil).mdVerifier))
+}
+
 // Crypto mocks base method
 func (m *MockConfig) Crypto() Crypto {
 	ret := m.ctrl.Call(m, "Crypto")
@@ -7066,6 +7771,30 @@ func (mr *MockConfigMockRecorder) SetTlfSyncState(tlfID, isSynced interface{}) *
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetTlfSyncState", reflect.TypeOf((*MockConfig)(nil).SetTlfSyncState), tlfID, isSynced)
 }
 
+// IsMetadataSyncedTlf mocks base method
+func (m *MockConfig) IsMetadataSyncedTlf(tlfID tlf.ID) bool {
+	ret := m.ctrl.Call(m, "IsMetadataSyncedTlf", tlfID)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// IsMetadataSyncedTlf indicates an expected call of IsMetadataSyncedTlf
+func (mr *MockConfigMockRecorder) IsMetadataSyncedTlf(tlfID interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "IsMetadataSyncedTlf", reflect.TypeOf((*MockConfig)(nil).IsMetadataSyncedTlf), tlfID)
+}
+
+// SetTlfMetadataSyncState mocks base method
+func (m *MockConfig) SetTlfMetadataSyncState(tlfID tlf.ID, isSynced bool) error {
+	ret := m.ctrl.Call(m, "SetTlfMetadataSyncState", tlfID, isSynced)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetTlfMetadataSyncState indicates an expected call of SetTlfMetadataSyncState
+func (mr *MockConfigMockRecorder) SetTlfMetadataSyncState(tlfID, isSynced interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetTlfMetadataSyncState", reflect.TypeOf((*MockConfig)(nil).SetTlfMetadataSyncState), tlfID, isSynced)
+}
+
 // Mode mocks base method
 func (m *MockConfig) Mode() InitMode {
 	ret := m.ctrl.Call(m, "Mode")
@@ -7426,6 +8155,28 @@ func (mr *MockConfigMockRecorder) SetBlockServer(arg0 interface{}) *gomock.Call
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetBlockServer", reflect.TypeOf((*MockConfig)(nil).SetBlockServer), arg0)
 }
 
+// PublicBlockFetcher mocks base method
+func (m *MockConfig) PublicBlockFetcher() BlockFetcher {
+	ret := m.ctrl.Call(m, "PublicBlockFetcher")
+	ret0, _ := ret[0].(BlockFetcher)
+	return ret0
+}
+
+// PublicBlockFetcher indicates an expected call of PublicBlockFetcher
+func (mr *MockConfigMockRecorder) PublicBlockFetcher() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PublicBlockFetcher", reflect.TypeOf((*MockConfig)(nil).PublicBlockFetcher))
+}
+
+// SetPublicBlockFetcher mocks base method
+func (m *MockConfig) SetPublicBlockFetcher(arg0 BlockFetcher) {
+	m.ctrl.Call(m, "SetPublicBlockFetcher", arg0)
+}
+
+// SetPublicBlockFetcher indicates an expected call of SetPublicBlockFetcher
+func (mr *MockConfigMockRecorder) SetPublicBlockFetcher(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetPublicBlockFetcher", reflect.TypeOf((*MockConfig)(nil).SetPublicBlockFetcher), arg0)
+}
+
 // KeyServer mocks base method
 func (m *MockConfig) KeyServer() KeyServer {
 	ret := m.ctrl.Call(m, "KeyServer")
@@ -7492,6 +8243,28 @@ func (mr *MockConfigMockRecorder) SetBlockSplitter(arg0 interface{}) *gomock.Cal
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetBlockSplitter", reflect.TypeOf((*MockConfig)(nil).SetBlockSplitter), arg0)
 }
 
+// TlfBlockSplitter mocks base method
+func (m *MockConfig) TlfBlockSplitter(tlfID tlf.ID) BlockSplitter {
+	ret := m.ctrl.Call(m, "TlfBlockSplitter", tlfID)
+	ret0, _ := ret[0].(BlockSplitter)
+	return ret0
+}
+
+// TlfBlockSplitter indicates an expected call of TlfBlockSplitter
+func (mr *MockConfigMockRecorder) TlfBlockSplitter(tlfID interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TlfBlockSplitter", reflect.TypeOf((*MockConfig)(nil).TlfBlockSplitter), tlfID)
+}
+
+// SetTlfBlockSplitter mocks base method
+func (m *MockConfig) SetTlfBlockSplitter(tlfID tlf.ID, b BlockSplitter) {
+	m.ctrl.Call(m, "SetTlfBlockSplitter", tlfID, b)
+}
+
+// SetTlfBlockSplitter indicates an expected call of SetTlfBlockSplitter
+func (mr *MockConfigMockRecorder) SetTlfBlockSplitter(tlfID, b interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetTlfBlockSplitter", reflect.TypeOf((*MockConfig)(nil).SetTlfBlockSplitter), tlfID, b)
+}
+
 // Notifier mocks base method
 func (m *MockConfig) Notifier() Notifier {
 	ret := m.ctrl.Call(m, "Notifier")
@@ -7670,6 +8443,94 @@ func (mr *MockConfigMockRecorder) MaxDirBytes() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MaxDirBytes", reflect.TypeOf((*MockConfig)(nil).MaxDirBytes))
 }
 
+// MaxFileBytes mocks base method
+func (m *MockConfig) MaxFileBytes(tlfID tlf.ID) uint64 {
+	ret := m.ctrl.Call(m, "MaxFileBytes", tlfID)
+	ret0, _ := ret[0].(uint64)
+	return ret0
+}
+
+// MaxFileBytes indicates an expected call of MaxFileBytes
+func (mr *MockConfigMockRecorder) MaxFileBytes(tlfID interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MaxFileBytes", reflect.TypeOf((*MockConfig)(nil).MaxFileBytes), tlfID)
+}
+
+// SetMaxFileBytes mocks base method
+func (m *MockConfig) SetMaxFileBytes(tlfID tlf.ID, maxBytes uint64) {
+	m.ctrl.Call(m, "SetMaxFileBytes", tlfID, maxBytes)
+}
+
+// SetMaxFileBytes indicates an expected call of SetMaxFileBytes
+func (mr *MockConfigMockRecorder) SetMaxFileBytes(tlfID, maxBytes interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetMaxFileBytes", reflect.TypeOf((*MockConfig)(nil).SetMaxFileBytes), tlfID, maxBytes)
+}
+
+// MaxDirEntries mocks base method
+func (m *MockConfig) MaxDirEntries(tlfID tlf.ID) int {
+	ret := m.ctrl.Call(m, "MaxDirEntries", tlfID)
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+// MaxDirEntries indicates an expected call of MaxDirEntries
+func (mr *MockConfigMockRecorder) MaxDirEntries(tlfID interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MaxDirEntries", reflect.TypeOf((*MockConfig)(nil).MaxDirEntries), tlfID)
+}
+
+// SetMaxDirEntries mocks base method
+func (m *MockConfig) SetMaxDirEntries(tlfID tlf.ID, maxEntries int) {
+	m.ctrl.Call(m, "SetMaxDirEntries", tlfID, maxEntries)
+}
+
+// SetMaxDirEntries indicates an expected call of SetMaxDirEntries
+func (mr *MockConfigMockRecorder) SetMaxDirEntries(tlfID, maxEntries interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetMaxDirEntries", reflect.TypeOf((*MockConfig)(nil).SetMaxDirEntries), tlfID, maxEntries)
+}
+
+// MaxSymlinkDepth mocks base method
+func (m *MockConfig) MaxSymlinkDepth() int {
+	ret := m.ctrl.Call(m, "MaxSymlinkDepth")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+// MaxSymlinkDepth indicates an expected call of MaxSymlinkDepth
+func (mr *MockConfigMockRecorder) MaxSymlinkDepth() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MaxSymlinkDepth", reflect.TypeOf((*MockConfig)(nil).MaxSymlinkDepth))
+}
+
+// SetMaxSymlinkDepth mocks base method
+func (m *MockConfig) SetMaxSymlinkDepth(depth int) {
+	m.ctrl.Call(m, "SetMaxSymlinkDepth", depth)
+}
+
+// SetMaxSymlinkDepth indicates an expected call of SetMaxSymlinkDepth
+func (mr *MockConfigMockRecorder) SetMaxSymlinkDepth(depth interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetMaxSymlinkDepth", reflect.TypeOf((*MockConfig)(nil).SetMaxSymlinkDepth), depth)
+}
+
+// CRBlockBudget mocks base method
+func (m *MockConfig) CRBlockBudget() int64 {
+	ret := m.ctrl.Call(m, "CRBlockBudget")
+	ret0, _ := ret[0].(int64)
+	return ret0
+}
+
+// CRBlockBudget indicates an expected call of CRBlockBudget
+func (mr *MockConfigMockRecorder) CRBlockBudget() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CRBlockBudget", reflect.TypeOf((*MockConfig)(nil).CRBlockBudget))
+}
+
+// SetCRBlockBudget mocks base method
+func (m *MockConfig) SetCRBlockBudget(budget int64) {
+	m.ctrl.Call(m, "SetCRBlockBudget", budget)
+}
+
+// SetCRBlockBudget indicates an expected call of SetCRBlockBudget
+func (mr *MockConfigMockRecorder) SetCRBlockBudget(budget interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetCRBlockBudget", reflect.TypeOf((*MockConfig)(nil).SetCRBlockBudget), budget)
+}
+
 // DoBackgroundFlushes mocks base method
 func (m *MockConfig) DoBackgroundFlushes() bool {
 	ret := m.ctrl.Call(m, "DoBackgroundFlushes")
@@ -7782,6 +8643,100 @@ func (mr *MockConfigMockRecorder) MetricsRegistry() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MetricsRegistry", reflect.TypeOf((*MockConfig)(nil).MetricsRegistry))
 }
 
+// BlockTrafficLog mocks base method
+func (m *MockConfig) BlockTrafficLog() *BlockTrafficLog {
+	ret := m.ctrl.Call(m, "BlockTrafficLog")
+	ret0, _ := ret[0].(*BlockTrafficLog)
+	return ret0
+}
+
+// BlockTrafficLog indicates an expected call of BlockTrafficLog
+func (mr *MockConfigMockRecorder) BlockTrafficLog() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "BlockTrafficLog", reflect.TypeOf((*MockConfig)(nil).BlockTrafficLog))
+}
+
+// ReadNotifications mocks base method
+func (m *MockConfig) ReadNotifications() *ReadNotificationFilter {
+	ret := m.ctrl.Call(m, "ReadNotifications")
+	ret0, _ := ret[0].(*ReadNotificationFilter)
+	return ret0
+}
+
+// ReadNotifications indicates an expected call of ReadNotifications
+func (mr *MockConfigMockRecorder) ReadNotifications() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReadNotifications", reflect.TypeOf((*MockConfig)(nil).ReadNotifications))
+}
+
+// SyncOutbox mocks base method
+func (m *MockConfig) SyncOutbox() *SyncOutbox {
+	ret := m.ctrl.Call(m, "SyncOutbox")
+	ret0, _ := ret[0].(*SyncOutbox)
+	return ret0
+}
+
+// SyncOutbox indicates an expected call of SyncOutbox
+func (mr *MockConfigMockRecorder) SyncOutbox() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SyncOutbox", reflect.TypeOf((*MockConfig)(nil).SyncOutbox))
+}
+
+// IdleTracker mocks base method
+func (m *MockConfig) IdleTracker() *IdleTracker {
+	ret := m.ctrl.Call(m, "IdleTracker")
+	ret0, _ := ret[0].(*IdleTracker)
+	return ret0
+}
+
+// IdleTracker indicates an expected call of IdleTracker
+func (mr *MockConfigMockRecorder) IdleTracker() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "IdleTracker", reflect.TypeOf((*MockConfig)(nil).IdleTracker))
+}
+
+// PowerMonitor mocks base method
+func (m *MockConfig) PowerMonitor() *PowerMonitor {
+	ret := m.ctrl.Call(m, "PowerMonitor")
+	ret0, _ := ret[0].(*PowerMonitor)
+	return ret0
+}
+
+// PowerMonitor indicates an expected call of PowerMonitor
+func (mr *MockConfigMockRecorder) PowerMonitor() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PowerMonitor", reflect.TypeOf((*MockConfig)(nil).PowerMonitor))
+}
+
+// PrefetchBudget mocks base method
+func (m *MockConfig) PrefetchBudget() *PrefetchBudget {
+	ret := m.ctrl.Call(m, "PrefetchBudget")
+	ret0, _ := ret[0].(*PrefetchBudget)
+	return ret0
+}
+
+// PrefetchBudget indicates an expected call of PrefetchBudget
+func (mr *MockConfigMockRecorder) PrefetchBudget() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PrefetchBudget", reflect.TypeOf((*MockConfig)(nil).PrefetchBudget))
+}
+
+// MetricsSink mocks base method
+func (m *MockConfig) MetricsSink() MetricsSink {
+	ret := m.ctrl.Call(m, "MetricsSink")
+	ret0, _ := ret[0].(MetricsSink)
+	return ret0
+}
+
+// MetricsSink indicates an expected call of MetricsSink
+func (mr *MockConfigMockRecorder) MetricsSink() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MetricsSink", reflect.TypeOf((*MockConfig)(nil).MetricsSink))
+}
+
+// SetMetricsSink mocks base method
+func (m *MockConfig) SetMetricsSink(arg0 MetricsSink) {
+	m.ctrl.Call(m, "SetMetricsSink", arg0)
+}
+
+// SetMetricsSink indicates an expected call of SetMetricsSink
+func (mr *MockConfigMockRecorder) SetMetricsSink(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetMetricsSink", reflect.TypeOf((*MockConfig)(nil).SetMetricsSink), arg0)
+}
+
 // SetMetricsRegistry mocks base method
 func (m *MockConfig) SetMetricsRegistry(arg0 go_metrics.Registry) {
 	m.ctrl.Call(m, "SetMetricsRegistry", arg0)
@@ -7836,6 +8791,150 @@ func (mr *MockConfigMockRecorder) BGFlushDirOpBatchSize() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "BGFlushDirOpBatchSize", reflect.TypeOf((*MockConfig)(nil).BGFlushDirOpBatchSize))
 }
 
+// NewFileExecMode mocks base method
+func (m *MockConfig) NewFileExecMode(tlfID tlf.ID) NewFileExecMode {
+	ret := m.ctrl.Call(m, "NewFileExecMode", tlfID)
+	ret0, _ := ret[0].(NewFileExecMode)
+	return ret0
+}
+
+// NewFileExecMode indicates an expected call of NewFileExecMode
+func (mr *MockConfigMockRecorder) NewFileExecMode(tlfID interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NewFileExecMode", reflect.TypeOf((*MockConfig)(nil).NewFileExecMode), tlfID)
+}
+
+// SetNewFileExecMode mocks base method
+func (m *MockConfig) SetNewFileExecMode(tlfID tlf.ID, mode NewFileExecMode) {
+	m.ctrl.Call(m, "SetNewFileExecMode", tlfID, mode)
+}
+
+// SetNewFileExecMode indicates an expected call of SetNewFileExecMode
+func (mr *MockConfigMockRecorder) SetNewFileExecMode(tlfID, mode interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetNewFileExecMode", reflect.TypeOf((*MockConfig)(nil).SetNewFileExecMode), tlfID, mode)
+}
+
+// OrderedWrites mocks base method
+func (m *MockConfig) OrderedWrites(tlfID tlf.ID) bool {
+	ret := m.ctrl.Call(m, "OrderedWrites", tlfID)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// OrderedWrites indicates an expected call of OrderedWrites
+func (mr *MockConfigMockRecorder) OrderedWrites(tlfID interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "OrderedWrites", reflect.TypeOf((*MockConfig)(nil).OrderedWrites), tlfID)
+}
+
+// SetOrderedWrites mocks base method
+func (m *MockConfig) SetOrderedWrites(tlfID tlf.ID, ordered bool) {
+	m.ctrl.Call(m, "SetOrderedWrites", tlfID, ordered)
+}
+
+// SetOrderedWrites indicates an expected call of SetOrderedWrites
+func (mr *MockConfigMockRecorder) SetOrderedWrites(tlfID, ordered interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetOrderedWrites", reflect.TypeOf((*MockConfig)(nil).SetOrderedWrites), tlfID, ordered)
+}
+
+// AdaptiveBlockSizes mocks base method
+func (m *MockConfig) AdaptiveBlockSizes(tlfID tlf.ID) bool {
+	ret := m.ctrl.Call(m, "AdaptiveBlockSizes", tlfID)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// AdaptiveBlockSizes indicates an expected call of AdaptiveBlockSizes
+func (mr *MockConfigMockRecorder) AdaptiveBlockSizes(tlfID interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AdaptiveBlockSizes", reflect.TypeOf((*MockConfig)(nil).AdaptiveBlockSizes), tlfID)
+}
+
+// SetAdaptiveBlockSizes mocks base method
+func (m *MockConfig) SetAdaptiveBlockSizes(tlfID tlf.ID, adaptive bool) {
+	m.ctrl.Call(m, "SetAdaptiveBlockSizes", tlfID, adaptive)
+}
+
+// SetAdaptiveBlockSizes indicates an expected call of SetAdaptiveBlockSizes
+func (mr *MockConfigMockRecorder) SetAdaptiveBlockSizes(tlfID, adaptive interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetAdaptiveBlockSizes", reflect.TypeOf((*MockConfig)(nil).SetAdaptiveBlockSizes), tlfID, adaptive)
+}
+
+// BlockLockProfiler mocks base method
+func (m *MockConfig) BlockLockProfiler() *LockProfiler {
+	ret := m.ctrl.Call(m, "BlockLockProfiler")
+	ret0, _ := ret[0].(*LockProfiler)
+	return ret0
+}
+
+// BlockLockProfiler indicates an expected call of BlockLockProfiler
+func (mr *MockConfigMockRecorder) BlockLockProfiler() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "BlockLockProfiler", reflect.TypeOf((*MockConfig)(nil).BlockLockProfiler))
+}
+
+// EarlyBlockUploadEnabled mocks base method
+func (m *MockConfig) EarlyBlockUploadEnabled() bool {
+	ret := m.ctrl.Call(m, "EarlyBlockUploadEnabled")
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// EarlyBlockUploadEnabled indicates an expected call of EarlyBlockUploadEnabled
+func (mr *MockConfigMockRecorder) EarlyBlockUploadEnabled() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EarlyBlockUploadEnabled", reflect.TypeOf((*MockConfig)(nil).EarlyBlockUploadEnabled))
+}
+
+// SetEarlyBlockUploadEnabled mocks base method
+func (m *MockConfig) SetEarlyBlockUploadEnabled(enabled bool) {
+	m.ctrl.Call(m, "SetEarlyBlockUploadEnabled", enabled)
+}
+
+// SetEarlyBlockUploadEnabled indicates an expected call of SetEarlyBlockUploadEnabled
+func (mr *MockConfigMockRecorder) SetEarlyBlockUploadEnabled(enabled interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetEarlyBlockUploadEnabled", reflect.TypeOf((*MockConfig)(nil).SetEarlyBlockUploadEnabled), enabled)
+}
+
+// FsyncMode mocks base method
+func (m *MockConfig) FsyncMode() FsyncMode {
+	ret := m.ctrl.Call(m, "FsyncMode")
+	ret0, _ := ret[0].(FsyncMode)
+	return ret0
+}
+
+// FsyncMode indicates an expected call of FsyncMode
+func (mr *MockConfigMockRecorder) FsyncMode() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FsyncMode", reflect.TypeOf((*MockConfig)(nil).FsyncMode))
+}
+
+// SetFsyncMode mocks base method
+func (m *MockConfig) SetFsyncMode(mode FsyncMode) {
+	m.ctrl.Call(m, "SetFsyncMode", mode)
+}
+
+// SetFsyncMode indicates an expected call of SetFsyncMode
+func (mr *MockConfigMockRecorder) SetFsyncMode(mode interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetFsyncMode", reflect.TypeOf((*MockConfig)(nil).SetFsyncMode), mode)
+}
+
+// TimestampMode mocks base method
+func (m *MockConfig) TimestampMode() TimestampMode {
+	ret := m.ctrl.Call(m, "TimestampMode")
+	ret0, _ := ret[0].(TimestampMode)
+	return ret0
+}
+
+// TimestampMode indicates an expected call of TimestampMode
+func (mr *MockConfigMockRecorder) TimestampMode() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TimestampMode", reflect.TypeOf((*MockConfig)(nil).TimestampMode))
+}
+
+// SetTimestampMode mocks base method
+func (m *MockConfig) SetTimestampMode(mode TimestampMode) {
+	m.ctrl.Call(m, "SetTimestampMode", mode)
+}
+
+// SetTimestampMode indicates an expected call of SetTimestampMode
+func (mr *MockConfigMockRecorder) SetTimestampMode(mode interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetTimestampMode", reflect.TypeOf((*MockConfig)(nil).SetTimestampMode), mode)
+}
+
 // SetBGFlushDirOpBatchSize mocks base method
 func (m *MockConfig) SetBGFlushDirOpBatchSize(s int) {
 	m.ctrl.Call(m, "SetBGFlushDirOpBatchSize", s)
@@ -7868,6 +8967,28 @@ func (mr *MockConfigMockRecorder) SetBGFlushPeriod(p interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetBGFlushPeriod", reflect.TypeOf((*MockConfig)(nil).SetBGFlushPeriod), p)
 }
 
+// DirtyFileMaxAge mocks base method
+func (m *MockConfig) DirtyFileMaxAge() time.Duration {
+	ret := m.ctrl.Call(m, "DirtyFileMaxAge")
+	ret0, _ := ret[0].(time.Duration)
+	return ret0
+}
+
+// DirtyFileMaxAge indicates an expected call of DirtyFileMaxAge
+func (mr *MockConfigMockRecorder) DirtyFileMaxAge() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DirtyFileMaxAge", reflect.TypeOf((*MockConfig)(nil).DirtyFileMaxAge))
+}
+
+// SetDirtyFileMaxAge mocks base method
+func (m *MockConfig) SetDirtyFileMaxAge(age time.Duration) {
+	m.ctrl.Call(m, "SetDirtyFileMaxAge", age)
+}
+
+// SetDirtyFileMaxAge indicates an expected call of SetDirtyFileMaxAge
+func (mr *MockConfigMockRecorder) SetDirtyFileMaxAge(age interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetDirtyFileMaxAge", reflect.TypeOf((*MockConfig)(nil).SetDirtyFileMaxAge), age)
+}
+
 // Shutdown mocks base method
 func (m *MockConfig) Shutdown(arg0 context.Context) error {
 	ret := m.ctrl.Call(m, "Shutdown", arg0)
@@ -8045,6 +9166,28 @@ func (mr *MockNodeCacheMockRecorder) UpdateUnlinkedDirEntry(node, newDe interfac
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateUnlinkedDirEntry", reflect.TypeOf((*MockNodeCache)(nil).UpdateUnlinkedDirEntry), node, newDe)
 }
 
+// SetAtime mocks base method
+func (m *MockNodeCache) SetAtime(node Node, atime time.Time) {
+	m.ctrl.Call(m, "SetAtime", node, atime)
+}
+
+// SetAtime indicates an expected call of SetAtime
+func (mr *MockNodeCacheMockRecorder) SetAtime(node, atime interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetAtime", reflect.TypeOf((*MockNodeCache)(nil).SetAtime), node, atime)
+}
+
+// Atime mocks base method
+func (m *MockNodeCache) Atime(node Node) time.Time {
+	ret := m.ctrl.Call(m, "Atime", node)
+	ret0, _ := ret[0].(time.Time)
+	return ret0
+}
+
+// Atime indicates an expected call of Atime
+func (mr *MockNodeCacheMockRecorder) Atime(node interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Atime", reflect.TypeOf((*MockNodeCache)(nil).Atime), node)
+}
+
 // PathFromNode mocks base method
 func (m *MockNodeCache) PathFromNode(node Node) path {
 	ret := m.ctrl.Call(m, "PathFromNode", node)
@@ -8079,6 +9222,28 @@ func (mr *MockNodeCacheMockRecorder) AddRootWrapper(arg0 interface{}) *gomock.Ca
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddRootWrapper", reflect.TypeOf((*MockNodeCache)(nil).AddRootWrapper), arg0)
 }
 
+// IsInUse mocks base method
+func (m *MockNodeCache) IsInUse(node Node) bool {
+	ret := m.ctrl.Call(m, "IsInUse", node)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// IsInUse indicates an expected call of IsInUse
+func (mr *MockNodeCacheMockRecorder) IsInUse(node interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "IsInUse", reflect.TypeOf((*MockNodeCache)(nil).IsInUse), node)
+}
+
+// SetUnlinkedForgetHandler mocks base method
+func (m *MockNodeCache) SetUnlinkedForgetHandler(arg0 func(path)) {
+	m.ctrl.Call(m, "SetUnlinkedForgetHandler", arg0)
+}
+
+// SetUnlinkedForgetHandler indicates an expected call of SetUnlinkedForgetHandler
+func (mr *MockNodeCacheMockRecorder) SetUnlinkedForgetHandler(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetUnlinkedForgetHandler", reflect.TypeOf((*MockNodeCache)(nil).SetUnlinkedForgetHandler), arg0)
+}
+
 // MockcrAction is a mock of crAction interface
 type MockcrAction struct {
 	ctrl     *gomock.Controller
@@ -23,6 +23,8 @@ func NewInitModeFromType(t InitModeType) InitMode {
 		return modeSingleOp{modeDefault{}}
 	case InitConstrained:
 		return modeConstrained{modeDefault{}}
+	case InitViewer:
+		return modeViewer{modeDefault{}}
 	default:
 		panic(fmt.Sprintf("Unknown mode: %s", t))
 	}
@@ -31,6 +33,13 @@ func NewInitModeFromType(t InitModeType) InitMode {
 const (
 	defaultQRPeriod      = 1 * time.Hour
 	defaultQRMinUnrefAge = 2 * 7 * 24 * time.Hour // 2 weeks
+
+	// viewerCleanBlockCacheFactor is how many times larger than
+	// the default the clean block cache is in viewer mode.
+	viewerCleanBlockCacheFactor = 2
+	// viewerTLFValidDuration is how long TLFs stay valid before
+	// identifies are redone in viewer mode.
+	viewerTLFValidDuration = 24 * time.Hour
 )
 
 // Default mode:
@@ -412,6 +421,104 @@ func (mc modeConstrained) LocalHTTPServerEnabled() bool {
 	return true
 }
 
+// Viewer mode:
+
+type modeViewer struct {
+	InitMode
+}
+
+func (mv modeViewer) Type() InitModeType {
+	return InitViewer
+}
+
+func (mv modeViewer) DirtyBlockCacheEnabled() bool {
+	// No blocks will be dirtied in viewer mode; this also makes
+	// all nodes reject writes.
+	return false
+}
+
+func (mv modeViewer) BackgroundFlushesEnabled() bool {
+	return false
+}
+
+func (mv modeViewer) ConflictResolutionEnabled() bool {
+	// There won't be any writes, so there won't be any conflicts.
+	return false
+}
+
+func (mv modeViewer) BlockManagementEnabled() bool {
+	return false
+}
+
+func (mv modeViewer) QuotaReclamationEnabled() bool {
+	return false
+}
+
+func (mv modeViewer) QuotaReclamationPeriod() time.Duration {
+	return 0
+}
+
+func (mv modeViewer) QuotaReclamationMinUnrefAge() time.Duration {
+	return 0
+}
+
+func (mv modeViewer) QuotaReclamationMinHeadAge() time.Duration {
+	return 0
+}
+
+func (mv modeViewer) JournalEnabled() bool {
+	return false
+}
+
+func (mv modeViewer) UnmergedTLFsEnabled() bool {
+	return false
+}
+
+func (mv modeViewer) TLFEditHistoryEnabled() bool {
+	return false
+}
+
+func (mv modeViewer) SendEditNotificationsEnabled() bool {
+	return false
+}
+
+// Wrapper for scratch folders.
+
+type modeScratch struct {
+	InitMode
+}
+
+func (ms modeScratch) JournalEnabled() bool {
+	// Everything is already local, so there's nothing to journal.
+	return false
+}
+
+func (ms modeScratch) TLFUpdatesEnabled() bool {
+	return false
+}
+
+func (ms modeScratch) KBFSServiceEnabled() bool {
+	return false
+}
+
+func (ms modeScratch) ServiceKeepaliveEnabled() bool {
+	return false
+}
+
+func (ms modeScratch) TLFEditHistoryEnabled() bool {
+	return false
+}
+
+func (ms modeScratch) SendEditNotificationsEnabled() bool {
+	// Edit notifications go out over chat, which would leak the
+	// scratch folder to the servers.
+	return false
+}
+
+func (ms modeScratch) LocalHTTPServerEnabled() bool {
+	return false
+}
+
 // Wrapper for tests.
 
 type modeTest struct {
@@ -8,6 +8,7 @@ import (
 	"context"
 	"fmt"
 	"runtime"
+	"time"
 )
 
 // nodeCore holds info shared among one or more nodeStandard objects.
@@ -18,6 +19,9 @@ type nodeCore struct {
 	// used only when parent is nil (the object has been unlinked)
 	cachedPath path
 	cachedDe   DirEntry
+	// atime is the last access time, if tracked (see
+	// `TimestampsPOSIXWithAtime`).
+	atime time.Time
 }
 
 func newNodeCore(ptr BlockPointer, name string, parent Node,
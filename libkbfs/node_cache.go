@@ -7,6 +7,7 @@ package libkbfs
 import (
 	"fmt"
 	"sync"
+	"time"
 )
 
 type nodeCacheEntry struct {
@@ -23,6 +24,7 @@ type nodeCacheStandard struct {
 	lock         sync.RWMutex
 	nodes        map[BlockRef]*nodeCacheEntry
 	rootWrappers []func(Node) Node
+	forgetFn     func(path)
 }
 
 var _ NodeCache = (*nodeCacheStandard)(nil)
@@ -34,29 +36,37 @@ func newNodeCacheStandard(fb FolderBranch) *nodeCacheStandard {
 	}
 }
 
-// lock must be locked for writing by the caller
-func (ncs *nodeCacheStandard) forgetLocked(core *nodeCore) {
+// lock must be locked for writing by the caller.  It returns the
+// cached path of the node if it was unlinked and is now completely
+// forgotten.
+func (ncs *nodeCacheStandard) forgetLocked(core *nodeCore) path {
 	ref := core.pathNode.Ref()
 
 	entry, ok := ncs.nodes[ref]
 	if !ok {
-		return
+		return path{}
 	}
 	if entry.core != core {
-		return
+		return path{}
 	}
 
 	entry.refCount--
 	if entry.refCount <= 0 {
 		delete(ncs.nodes, ref)
+		return core.cachedPath
 	}
+	return path{}
 }
 
 // should be called only by nodeStandardFinalizer().
 func (ncs *nodeCacheStandard) forget(core *nodeCore) {
 	ncs.lock.Lock()
-	defer ncs.lock.Unlock()
-	ncs.forgetLocked(core)
+	unlinked := ncs.forgetLocked(core)
+	forgetFn := ncs.forgetFn
+	ncs.lock.Unlock()
+	if unlinked.isValid() && forgetFn != nil {
+		forgetFn(unlinked)
+	}
 }
 
 // lock must be held for writing by the caller
@@ -94,9 +104,7 @@ func (ncs *nodeCacheStandard) makeNodeStandardForEntryLocked(
 func (ncs *nodeCacheStandard) GetOrCreate(
 	ptr BlockPointer, name string, parent Node) (Node, error) {
 	if !ptr.IsValid() {
-		// Temporary code to track down bad block
-		// pointers. Remove when not needed anymore.
-		panic(InvalidBlockRefError{ptr.Ref()})
+		return nil, InvalidBlockRefError{ptr.Ref()}
 	}
 
 	if name == "" {
@@ -195,10 +203,8 @@ func (ncs *nodeCacheStandard) Move(
 		return nil, nil
 	}
 
-	// Temporary code to track down bad block pointers. Remove (or
-	// return an error) when not needed anymore.
 	if !ref.IsValid() {
-		panic(InvalidBlockRefError{ref})
+		return nil, InvalidBlockRefError{ref}
 	}
 
 	if newName == "" {
@@ -313,6 +319,32 @@ func (ncs *nodeCacheStandard) UpdateUnlinkedDirEntry(
 	ns.core.cachedDe = newDe
 }
 
+// SetAtime implements the NodeCache interface for nodeCacheStandard.
+func (ncs *nodeCacheStandard) SetAtime(node Node, atime time.Time) {
+	ncs.lock.Lock()
+	defer ncs.lock.Unlock()
+
+	ns, ok := node.Unwrap().(*nodeStandard)
+	if !ok {
+		return
+	}
+
+	ns.core.atime = atime
+}
+
+// Atime implements the NodeCache interface for nodeCacheStandard.
+func (ncs *nodeCacheStandard) Atime(node Node) time.Time {
+	ncs.lock.RLock()
+	defer ncs.lock.RUnlock()
+
+	ns, ok := node.Unwrap().(*nodeStandard)
+	if !ok {
+		return time.Time{}
+	}
+
+	return ns.core.atime
+}
+
 // PathFromNode implements the NodeCache interface for nodeCacheStandard.
 func (ncs *nodeCacheStandard) PathFromNode(node Node) (p path) {
 	ncs.lock.RLock()
@@ -376,3 +408,41 @@ func (ncs *nodeCacheStandard) AddRootWrapper(f func(Node) Node) {
 	defer ncs.lock.Unlock()
 	ncs.rootWrappers = append(ncs.rootWrappers, f)
 }
+
+// IsInUse implements the NodeCache interface for nodeCacheStandard.
+func (ncs *nodeCacheStandard) IsInUse(node Node) bool {
+	ncs.lock.RLock()
+	defer ncs.lock.RUnlock()
+
+	ns, ok := node.Unwrap().(*nodeStandard)
+	if !ok {
+		return false
+	}
+
+	entry, ok := ncs.nodes[ns.core.pathNode.Ref()]
+	if !ok || entry.core != ns.core {
+		return false
+	}
+	return entry.refCount > 1
+}
+
+// SetUnlinkedForgetHandler implements the NodeCache interface for
+// nodeCacheStandard.
+func (ncs *nodeCacheStandard) SetUnlinkedForgetHandler(f func(path)) {
+	ncs.lock.Lock()
+	defer ncs.lock.Unlock()
+	ncs.forgetFn = f
+}
+
+// memoryUsage returns the estimated number of bytes held by the
+// nodes in this cache.
+func (ncs *nodeCacheStandard) memoryUsage() int64 {
+	ncs.lock.RLock()
+	defer ncs.lock.RUnlock()
+	var bytes int64
+	for _, entry := range ncs.nodes {
+		bytes += nodeCacheEntryBytesEstimate +
+			int64(len(entry.core.pathNode.Name))
+	}
+	return bytes
+}
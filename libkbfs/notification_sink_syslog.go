@@ -0,0 +1,56 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package libkbfs
+
+import (
+	"encoding/json"
+	"log/syslog"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// SyslogNotificationSink writes each event, encoded as JSON, to the
+// local syslog.  Errors are logged at the error priority, and
+// everything else at the info priority.
+type SyslogNotificationSink struct {
+	w *syslog.Writer
+}
+
+var _ NotificationSink = (*SyslogNotificationSink)(nil)
+
+// NewSyslogNotificationSink returns a new SyslogNotificationSink
+// that logs with the given tag.
+func NewSyslogNotificationSink(tag string) (*SyslogNotificationSink, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &SyslogNotificationSink{w}, nil
+}
+
+// Send implements the NotificationSink interface for
+// SyslogNotificationSink.
+func (s *SyslogNotificationSink) Send(
+	_ context.Context, event NotificationEvent) error {
+	buf, err := json.Marshal(event)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if event.Type == NotificationEventError {
+		err = s.w.Err(string(buf))
+	} else {
+		err = s.w.Info(string(buf))
+	}
+	return errors.WithStack(err)
+}
+
+// Shutdown implements the NotificationSink interface for
+// SyslogNotificationSink.
+func (s *SyslogNotificationSink) Shutdown() {
+	s.w.Close()
+}
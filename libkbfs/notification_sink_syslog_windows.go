@@ -0,0 +1,31 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// SyslogNotificationSink is not supported on Windows.
+type SyslogNotificationSink struct{}
+
+var _ NotificationSink = (*SyslogNotificationSink)(nil)
+
+// NewSyslogNotificationSink always returns an error on Windows.
+func NewSyslogNotificationSink(_ string) (*SyslogNotificationSink, error) {
+	return nil, errors.New("syslog is not supported on Windows")
+}
+
+// Send implements the NotificationSink interface for
+// SyslogNotificationSink.
+func (s *SyslogNotificationSink) Send(
+	_ context.Context, _ NotificationEvent) error {
+	return errors.New("syslog is not supported on Windows")
+}
+
+// Shutdown implements the NotificationSink interface for
+// SyslogNotificationSink.
+func (s *SyslogNotificationSink) Shutdown() {}
@@ -0,0 +1,415 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// notificationSinkBufSize is how many events may be queued for a
+	// single sink before new ones are dropped.
+	notificationSinkBufSize = 1000
+	// notificationSinkTimeout bounds how long a sink may take to
+	// deliver a single event.
+	notificationSinkTimeout = 10 * time.Second
+)
+
+// NotificationEventType is the kind of a NotificationEvent.
+type NotificationEventType string
+
+const (
+	// NotificationEventFS is a filesystem notification, e.g. for
+	// a rekey or a connection status change.
+	NotificationEventFS NotificationEventType = "fs"
+	// NotificationEventSyncStatus is a journal sync status update.
+	NotificationEventSyncStatus NotificationEventType = "sync_status"
+	// NotificationEventError is a reported error, e.g. a sync or
+	// conflict resolution failure, or a quota warning.
+	NotificationEventError NotificationEventType = "error"
+)
+
+// NotificationEvent is a single KBFS event, as delivered to a
+// NotificationSink.  It is meant to be encoded as JSON.
+type NotificationEvent struct {
+	Time time.Time
+	Type NotificationEventType
+
+	// Set for NotificationEventFS.
+	Notification *keybase1.FSNotification `json:",omitempty"`
+	// Set for NotificationEventSyncStatus.
+	SyncStatus *keybase1.FSPathSyncStatus `json:",omitempty"`
+
+	// Set for NotificationEventError.
+	TlfName string `json:",omitempty"`
+	TlfType string `json:",omitempty"`
+	Mode    string `json:",omitempty"`
+	Error   string `json:",omitempty"`
+}
+
+// NotificationSink is an alternative destination for KBFS events,
+// so that headless deployments can route them into their own
+// monitoring.
+type NotificationSink interface {
+	// Send delivers a single event.  Events for a given sink are
+	// sent one at a time.
+	Send(ctx context.Context, event NotificationEvent) error
+	// Shutdown frees any resources held by the sink.
+	Shutdown()
+}
+
+// notificationSinkRunner delivers events to one sink in the
+// background, so that a slow sink never blocks the caller.
+type notificationSinkRunner struct {
+	sink   NotificationSink
+	log    logger.Logger
+	events chan NotificationEvent
+	ctx    context.Context
+	cancel context.CancelFunc
+	doneCh chan struct{}
+}
+
+func newNotificationSinkRunner(
+	sink NotificationSink, log logger.Logger) *notificationSinkRunner {
+	nsr := &notificationSinkRunner{
+		sink:   sink,
+		log:    log,
+		events: make(chan NotificationEvent, notificationSinkBufSize),
+		doneCh: make(chan struct{}),
+	}
+	nsr.ctx, nsr.cancel = context.WithCancel(context.Background())
+	go nsr.run()
+	return nsr
+}
+
+func (nsr *notificationSinkRunner) run() {
+	defer close(nsr.doneCh)
+	for event := range nsr.events {
+		if nsr.ctx.Err() != nil {
+			// Shutting down; drop the rest.
+			continue
+		}
+		ctx, cancel := context.WithTimeout(nsr.ctx, notificationSinkTimeout)
+		err := nsr.sink.Send(ctx, event)
+		cancel()
+		if err != nil {
+			nsr.log.CDebugf(ctx, "Couldn't send %s event to sink %T: %+v",
+				event.Type, nsr.sink, err)
+		}
+	}
+}
+
+func (nsr *notificationSinkRunner) queue(event NotificationEvent) {
+	select {
+	case nsr.events <- event:
+	default:
+		nsr.log.Debug("Sink %T is full, dropping %s event",
+			nsr.sink, event.Type)
+	}
+}
+
+// shutdown gives the sink a little time to deliver the queued
+// events, and then drops any that are left.
+func (nsr *notificationSinkRunner) shutdown() {
+	close(nsr.events)
+	select {
+	case <-nsr.doneCh:
+	case <-time.After(notificationSinkTimeout):
+		nsr.cancel()
+		<-nsr.doneCh
+	}
+	nsr.cancel()
+	nsr.sink.Shutdown()
+}
+
+// ReporterWithSinks wraps another Reporter, and additionally
+// delivers every notification, sync status update and reported error
+// to a set of NotificationSinks.
+type ReporterWithSinks struct {
+	Reporter
+	clock Clock
+	log   logger.Logger
+
+	lock       sync.RWMutex
+	sinks      []*notificationSinkRunner
+	isShutdown bool
+}
+
+var _ Reporter = (*ReporterWithSinks)(nil)
+
+// NewReporterWithSinks returns a new ReporterWithSinks wrapping
+// `delegate`, with no sinks.
+func NewReporterWithSinks(
+	delegate Reporter, clock Clock, log logger.Logger) *ReporterWithSinks {
+	return &ReporterWithSinks{
+		Reporter: delegate,
+		clock:    clock,
+		log:      log,
+	}
+}
+
+// AddSink registers a new sink.  The sink is shut down along with
+// the reporter.
+func (r *ReporterWithSinks) AddSink(sink NotificationSink) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.isShutdown {
+		sink.Shutdown()
+		return
+	}
+	r.sinks = append(r.sinks, newNotificationSinkRunner(sink, r.log))
+}
+
+func (r *ReporterWithSinks) queue(event NotificationEvent) {
+	event.Time = r.clock.Now()
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if r.isShutdown {
+		return
+	}
+	for _, s := range r.sinks {
+		s.queue(event)
+	}
+}
+
+// ReportErr implements the Reporter interface for ReporterWithSinks.
+func (r *ReporterWithSinks) ReportErr(ctx context.Context,
+	tlfName tlf.CanonicalName, t tlf.Type, mode ErrorModeType, err error) {
+	r.Reporter.ReportErr(ctx, tlfName, t, mode, err)
+	modeStr := errorModeRead
+	if mode == WriteMode {
+		modeStr = errorModeWrite
+	}
+	r.queue(NotificationEvent{
+		Type:    NotificationEventError,
+		TlfName: string(tlfName),
+		TlfType: t.String(),
+		Mode:    modeStr,
+		Error:   err.Error(),
+	})
+}
+
+// Notify implements the Reporter interface for ReporterWithSinks.
+func (r *ReporterWithSinks) Notify(
+	ctx context.Context, notification *keybase1.FSNotification) {
+	r.Reporter.Notify(ctx, notification)
+	r.queue(NotificationEvent{
+		Type:         NotificationEventFS,
+		Notification: notification,
+	})
+}
+
+// NotifySyncStatus implements the Reporter interface for
+// ReporterWithSinks.
+func (r *ReporterWithSinks) NotifySyncStatus(
+	ctx context.Context, status *keybase1.FSPathSyncStatus) {
+	r.Reporter.NotifySyncStatus(ctx, status)
+	r.queue(NotificationEvent{
+		Type:       NotificationEventSyncStatus,
+		SyncStatus: status,
+	})
+}
+
+// Shutdown implements the Reporter interface for ReporterWithSinks.
+func (r *ReporterWithSinks) Shutdown() {
+	r.Reporter.Shutdown()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.isShutdown {
+		return
+	}
+	r.isShutdown = true
+	for _, s := range r.sinks {
+		s.shutdown()
+	}
+	r.sinks = nil
+}
+
+// AddNotificationSink registers `sink` with the Reporter of
+// `config`, first wrapping it in a ReporterWithSinks if needed.
+func AddNotificationSink(config Config, sink NotificationSink) {
+	r, ok := config.Reporter().(*ReporterWithSinks)
+	if !ok {
+		r = NewReporterWithSinks(
+			config.Reporter(), config.Clock(), config.MakeLogger("NSK"))
+		config.SetReporter(r)
+	}
+	r.AddSink(sink)
+}
+
+// WebhookNotificationSink POSTs each event, encoded as JSON, to a
+// URL.
+type WebhookNotificationSink struct {
+	url    string
+	client *http.Client
+}
+
+var _ NotificationSink = (*WebhookNotificationSink)(nil)
+
+// NewWebhookNotificationSink returns a new WebhookNotificationSink
+// that posts to `url`.
+func NewWebhookNotificationSink(url string) *WebhookNotificationSink {
+	return &WebhookNotificationSink{
+		url:    url,
+		client: &http.Client{Timeout: notificationSinkTimeout},
+	}
+}
+
+// Send implements the NotificationSink interface for
+// WebhookNotificationSink.
+func (w *WebhookNotificationSink) Send(
+	ctx context.Context, event NotificationEvent) error {
+	buf, err := json.Marshal(event)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(buf))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("Webhook %s returned status %s",
+			w.url, resp.Status)
+	}
+	return nil
+}
+
+// Shutdown implements the NotificationSink interface for
+// WebhookNotificationSink.
+func (w *WebhookNotificationSink) Shutdown() {}
+
+// SocketNotificationSink writes each event, encoded as a single line
+// of JSON, to a local (unix domain) socket.  It reconnects to the
+// socket as needed.
+type SocketNotificationSink struct {
+	path string
+
+	lock sync.Mutex
+	conn net.Conn
+}
+
+var _ NotificationSink = (*SocketNotificationSink)(nil)
+
+// NewSocketNotificationSink returns a new SocketNotificationSink
+// that writes to the socket at `path`.
+func NewSocketNotificationSink(path string) *SocketNotificationSink {
+	return &SocketNotificationSink{path: path}
+}
+
+// Send implements the NotificationSink interface for
+// SocketNotificationSink.
+func (s *SocketNotificationSink) Send(
+	ctx context.Context, event NotificationEvent) error {
+	buf, err := json.Marshal(event)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	buf = append(buf, '\n')
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.conn == nil {
+		var d net.Dialer
+		s.conn, err = d.DialContext(ctx, "unix", s.path)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		err = s.conn.SetWriteDeadline(deadline)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	_, err = s.conn.Write(buf)
+	if err != nil {
+		// Reconnect on the next event.
+		s.conn.Close()
+		s.conn = nil
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// Shutdown implements the NotificationSink interface for
+// SocketNotificationSink.
+func (s *SocketNotificationSink) Shutdown() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// ParseNotificationSinks parses a comma-separated list of sink
+// specs, and returns the corresponding sinks.  Each spec is one of
+// "webhook:<url>", "socket:<path to a unix domain socket>", or
+// "syslog[:<tag>]".
+func ParseNotificationSinks(specs string) (
+	sinks []NotificationSink, err error) {
+	defer func() {
+		if err != nil {
+			for _, sink := range sinks {
+				sink.Shutdown()
+			}
+		}
+	}()
+	for _, spec := range strings.Split(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		parts := strings.SplitN(spec, ":", 2)
+		kind, arg := parts[0], ""
+		if len(parts) > 1 {
+			arg = parts[1]
+		}
+		var sink NotificationSink
+		switch kind {
+		case "webhook":
+			if arg == "" {
+				return sinks, errors.Errorf("No URL in sink spec %q", spec)
+			}
+			sink = NewWebhookNotificationSink(arg)
+		case "socket":
+			if arg == "" {
+				return sinks, errors.Errorf("No path in sink spec %q", spec)
+			}
+			sink = NewSocketNotificationSink(arg)
+		case "syslog":
+			if arg == "" {
+				arg = "kbfs"
+			}
+			sink, err = NewSyslogNotificationSink(arg)
+			if err != nil {
+				return sinks, err
+			}
+		default:
+			return sinks, errors.Errorf(
+				"Unknown kind %q in sink spec %q", kind, spec)
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
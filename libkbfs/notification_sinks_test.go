@@ -0,0 +1,99 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type testNotificationSink struct {
+	events chan NotificationEvent
+}
+
+func (s testNotificationSink) Send(
+	_ context.Context, event NotificationEvent) error {
+	s.events <- event
+	return nil
+}
+
+func (s testNotificationSink) Shutdown() {
+	close(s.events)
+}
+
+func TestReporterWithSinks(t *testing.T) {
+	ctx := context.Background()
+	clock := newTestClockNow()
+	r := NewReporterWithSinks(
+		NewReporterSimple(clock, 1), clock, newTestLogMaker(t).MakeLogger(""))
+	sink := testNotificationSink{make(chan NotificationEvent, 10)}
+	r.AddSink(sink)
+
+	t.Log("Errors go to both the wrapped reporter and the sink")
+	err := NoSuchUserError{"foo"}
+	r.ReportErr(ctx, "u1", tlf.Private, WriteMode, err)
+	require.Len(t, r.AllKnownErrors(), 1)
+	event := <-sink.events
+	require.Equal(t, NotificationEventError, event.Type)
+	require.Equal(t, clock.Now(), event.Time)
+	require.Equal(t, "u1", event.TlfName)
+	require.Equal(t, errorModeWrite, event.Mode)
+	require.Equal(t, err.Error(), event.Error)
+
+	t.Log("So do notifications")
+	n := &keybase1.FSNotification{
+		NotificationType: keybase1.FSNotificationType_REKEYING,
+	}
+	r.Notify(ctx, n)
+	event = <-sink.events
+	require.Equal(t, NotificationEventFS, event.Type)
+	require.Equal(t, n, event.Notification)
+
+	t.Log("Shutting down the reporter shuts down the sink")
+	r.Shutdown()
+	_, ok := <-sink.events
+	require.False(t, ok)
+}
+
+func TestWebhookNotificationSink(t *testing.T) {
+	received := make(chan NotificationEvent, 1)
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			var event NotificationEvent
+			err := json.NewDecoder(req.Body).Decode(&event)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			received <- event
+		}))
+	defer s.Close()
+
+	sinks, err := ParseNotificationSinks("webhook:" + s.URL)
+	require.NoError(t, err)
+	require.Len(t, sinks, 1)
+	defer sinks[0].Shutdown()
+
+	err = sinks[0].Send(context.Background(), NotificationEvent{
+		Type:  NotificationEventError,
+		Error: "oops",
+	})
+	require.NoError(t, err)
+	event := <-received
+	require.Equal(t, NotificationEventError, event.Type)
+	require.Equal(t, "oops", event.Error)
+
+	_, err = ParseNotificationSinks("carrier-pigeon:coop")
+	require.Error(t, err)
+	_, err = ParseNotificationSinks("webhook:")
+	require.Error(t, err)
+}
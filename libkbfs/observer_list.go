@@ -57,6 +57,17 @@ func (ol *observerList) batchChanges(
 	}
 }
 
+func (ol *observerList) syncAllDone(
+	ctx context.Context, ticket SyncTicket, err error) {
+	ol.lock.RLock()
+	defer ol.lock.RUnlock()
+	for _, o := range ol.observers {
+		if so, ok := o.(SyncObserver); ok {
+			so.SyncAllDone(ctx, ticket, err)
+		}
+	}
+}
+
 func (ol *observerList) tlfHandleChange(
 	ctx context.Context, newHandle *TlfHandle) {
 	ol.lock.RLock()
@@ -0,0 +1,607 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// OpLogEntry is a single KBFSOps call captured by an OpLogRecorder.
+// No file contents are recorded, only their offsets and sizes.
+type OpLogEntry struct {
+	// Op is the name of the KBFSOps method.
+	Op string
+	// Path is the canonical path of the node the op was called on,
+	// or of the TLF root for GetRootNode and SyncAll.
+	Path string
+	// Name is the name of the child entry the op acted on, if any.
+	Name string `json:",omitempty"`
+	// NewPath and NewName are the destination of a Rename or a
+	// CloneFile, or the link target (in NewPath) of a CreateLink.
+	NewPath string `json:",omitempty"`
+	NewName string `json:",omitempty"`
+	// Flag is the isExec argument of CreateFile, or the ex argument
+	// of SetEx.
+	Flag bool `json:",omitempty"`
+	// Off and Size describe the byte range of a Read or Write, or
+	// the new size of a Truncate.
+	Off  int64 `json:",omitempty"`
+	Size int64 `json:",omitempty"`
+	// N is the number of bytes returned by a Read.
+	N int64 `json:",omitempty"`
+	// Mtime is the time given to SetMtime, if any.
+	Mtime *time.Time `json:",omitempty"`
+	// Start is when the op started, relative to the start of the
+	// recording, and Duration is how long it took.
+	Start    time.Duration
+	Duration time.Duration
+	// Err is the error the op returned, if any.
+	Err string `json:",omitempty"`
+}
+
+// OpLogRecorder implements the KBFSOps interface by relaying requests
+// to a KBFSOpsStandard, while writing an OpLogEntry for each
+// filesystem operation to a log, as JSON objects separated by
+// newlines.  The log can be reproduced later with ReplayOpLog.
+type OpLogRecorder struct {
+	KBFSOps
+	ops   *KBFSOpsStandard
+	clock Clock
+	log   logger.Logger
+	start time.Time
+
+	lock sync.Mutex
+	w    io.Writer
+	enc  *json.Encoder
+	// tlfPaths maps each TLF seen so far to its canonical root path.
+	tlfPaths map[tlf.ID]string
+}
+
+var _ KBFSOps = (*OpLogRecorder)(nil)
+
+// NewOpLogRecorder returns a recorder that wraps the given config's
+// current KBFSOps and logs to `w`, which is closed when the recorder
+// is shut down if it's an io.Closer.  The caller must install it with
+// config.SetKBFSOps.
+func NewOpLogRecorder(config Config, w io.Writer) (*OpLogRecorder, error) {
+	ops, ok := standardKBFSOps(config.KBFSOps())
+	if !ok {
+		return nil, errors.Errorf(
+			"Can't record ops of %T", config.KBFSOps())
+	}
+	return &OpLogRecorder{
+		KBFSOps:  config.KBFSOps(),
+		ops:      ops,
+		w:        w,
+		clock:    config.Clock(),
+		log:      config.MakeLogger("OLR"),
+		start:    config.Clock().Now(),
+		enc:      json.NewEncoder(w),
+		tlfPaths: make(map[tlf.ID]string),
+	}, nil
+}
+
+func (r *OpLogRecorder) wrappedKBFSOps() KBFSOps {
+	return r.KBFSOps
+}
+
+// Shutdown implements the KBFSOps interface for OpLogRecorder.  The
+// log is closed after the wrapped ops are shut down, if it can be.
+func (r *OpLogRecorder) Shutdown(ctx context.Context) error {
+	err := r.KBFSOps.Shutdown(ctx)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if c, ok := r.w.(io.Closer); ok {
+		if closeErr := c.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (r *OpLogRecorder) nodePath(ctx context.Context, node Node) string {
+	if node == nil {
+		return ""
+	}
+	p := r.ops.nodePath(ctx, node)
+	if !p.isValid() {
+		return ""
+	}
+	canonical := p.CanonicalPathString()
+	if len(p.path) == 1 {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		r.tlfPaths[p.Tlf] = canonical
+	}
+	return canonical
+}
+
+// begin returns the entry for an op, to be passed to end() once the
+// op has completed.
+func (r *OpLogRecorder) begin(
+	ctx context.Context, op string, node Node) *OpLogEntry {
+	return &OpLogEntry{
+		Op:    op,
+		Path:  r.nodePath(ctx, node),
+		Start: r.clock.Now().Sub(r.start),
+	}
+}
+
+func (r *OpLogRecorder) end(ctx context.Context, e *OpLogEntry, err error) {
+	e.Duration = r.clock.Now().Sub(r.start) - e.Start
+	if err != nil {
+		e.Err = err.Error()
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if encErr := r.enc.Encode(e); encErr != nil {
+		r.log.CDebugf(ctx, "Couldn't record %s: %+v", e.Op, encErr)
+	}
+}
+
+// GetOrCreateRootNode implements the KBFSOps interface for
+// OpLogRecorder.
+func (r *OpLogRecorder) GetOrCreateRootNode(
+	ctx context.Context, h *TlfHandle, branch BranchName) (
+	node Node, ei EntryInfo, err error) {
+	e := r.begin(ctx, "GetRootNode", nil)
+	node, ei, err = r.KBFSOps.GetOrCreateRootNode(ctx, h, branch)
+	if err == nil {
+		e.Path = r.nodePath(ctx, node)
+	}
+	r.end(ctx, e, err)
+	return node, ei, err
+}
+
+// GetDirChildren implements the KBFSOps interface for OpLogRecorder.
+func (r *OpLogRecorder) GetDirChildren(
+	ctx context.Context, dir Node) (map[string]EntryInfo, error) {
+	e := r.begin(ctx, "GetDirChildren", dir)
+	children, err := r.KBFSOps.GetDirChildren(ctx, dir)
+	r.end(ctx, e, err)
+	return children, err
+}
+
+// Lookup implements the KBFSOps interface for OpLogRecorder.
+func (r *OpLogRecorder) Lookup(
+	ctx context.Context, dir Node, name string) (Node, EntryInfo, error) {
+	e := r.begin(ctx, "Lookup", dir)
+	e.Name = name
+	node, ei, err := r.KBFSOps.Lookup(ctx, dir, name)
+	r.end(ctx, e, err)
+	return node, ei, err
+}
+
+// Stat implements the KBFSOps interface for OpLogRecorder.
+func (r *OpLogRecorder) Stat(ctx context.Context, node Node) (
+	EntryInfo, error) {
+	e := r.begin(ctx, "Stat", node)
+	ei, err := r.KBFSOps.Stat(ctx, node)
+	r.end(ctx, e, err)
+	return ei, err
+}
+
+// CreateDir implements the KBFSOps interface for OpLogRecorder.
+func (r *OpLogRecorder) CreateDir(
+	ctx context.Context, dir Node, name string) (Node, EntryInfo, error) {
+	e := r.begin(ctx, "CreateDir", dir)
+	e.Name = name
+	node, ei, err := r.KBFSOps.CreateDir(ctx, dir, name)
+	r.end(ctx, e, err)
+	return node, ei, err
+}
+
+// CreateFile implements the KBFSOps interface for OpLogRecorder.
+func (r *OpLogRecorder) CreateFile(
+	ctx context.Context, dir Node, name string, isExec bool, excl Excl) (
+	Node, EntryInfo, error) {
+	e := r.begin(ctx, "CreateFile", dir)
+	e.Name = name
+	e.Flag = isExec
+	node, ei, err := r.KBFSOps.CreateFile(ctx, dir, name, isExec, excl)
+	r.end(ctx, e, err)
+	return node, ei, err
+}
+
+// CreateLink implements the KBFSOps interface for OpLogRecorder.
+func (r *OpLogRecorder) CreateLink(
+	ctx context.Context, dir Node, fromName string, toPath string) (
+	EntryInfo, error) {
+	e := r.begin(ctx, "CreateLink", dir)
+	e.Name = fromName
+	e.NewPath = toPath
+	ei, err := r.KBFSOps.CreateLink(ctx, dir, fromName, toPath)
+	r.end(ctx, e, err)
+	return ei, err
+}
+
+// RemoveDir implements the KBFSOps interface for OpLogRecorder.
+func (r *OpLogRecorder) RemoveDir(
+	ctx context.Context, dir Node, dirName string) error {
+	e := r.begin(ctx, "RemoveDir", dir)
+	e.Name = dirName
+	err := r.KBFSOps.RemoveDir(ctx, dir, dirName)
+	r.end(ctx, e, err)
+	return err
+}
+
+// RemoveEntry implements the KBFSOps interface for OpLogRecorder.
+func (r *OpLogRecorder) RemoveEntry(
+	ctx context.Context, dir Node, name string) error {
+	e := r.begin(ctx, "RemoveEntry", dir)
+	e.Name = name
+	err := r.KBFSOps.RemoveEntry(ctx, dir, name)
+	r.end(ctx, e, err)
+	return err
+}
+
+// Rename implements the KBFSOps interface for OpLogRecorder.
+func (r *OpLogRecorder) Rename(ctx context.Context, oldParent Node,
+	oldName string, newParent Node, newName string) error {
+	e := r.begin(ctx, "Rename", oldParent)
+	e.Name = oldName
+	e.NewPath = r.nodePath(ctx, newParent)
+	e.NewName = newName
+	err := r.KBFSOps.Rename(ctx, oldParent, oldName, newParent, newName)
+	r.end(ctx, e, err)
+	return err
+}
+
+// CloneFile implements the KBFSOps interface for OpLogRecorder.
+func (r *OpLogRecorder) CloneFile(ctx context.Context, src Node,
+	dstDir Node, name string) (Node, EntryInfo, error) {
+	e := r.begin(ctx, "CloneFile", src)
+	e.NewPath = r.nodePath(ctx, dstDir)
+	e.NewName = name
+	node, ei, err := r.KBFSOps.CloneFile(ctx, src, dstDir, name)
+	r.end(ctx, e, err)
+	return node, ei, err
+}
+
+// Read implements the KBFSOps interface for OpLogRecorder.
+func (r *OpLogRecorder) Read(
+	ctx context.Context, file Node, dest []byte, off int64) (int64, error) {
+	e := r.begin(ctx, "Read", file)
+	e.Off = off
+	e.Size = int64(len(dest))
+	n, err := r.KBFSOps.Read(ctx, file, dest, off)
+	e.N = n
+	r.end(ctx, e, err)
+	return n, err
+}
+
+// Write implements the KBFSOps interface for OpLogRecorder.
+func (r *OpLogRecorder) Write(
+	ctx context.Context, file Node, data []byte, off int64) error {
+	e := r.begin(ctx, "Write", file)
+	e.Off = off
+	e.Size = int64(len(data))
+	err := r.KBFSOps.Write(ctx, file, data, off)
+	r.end(ctx, e, err)
+	return err
+}
+
+// ReadVec implements the KBFSOps interface for OpLogRecorder.  Each
+// vector is recorded as its own Read.
+func (r *OpLogRecorder) ReadVec(
+	ctx context.Context, file Node, vecs []IOVec) ([]int64, error) {
+	es := make([]*OpLogEntry, len(vecs))
+	for i, vec := range vecs {
+		es[i] = r.begin(ctx, "Read", file)
+		es[i].Off = vec.Off
+		es[i].Size = int64(len(vec.Buf))
+	}
+	ns, err := r.KBFSOps.ReadVec(ctx, file, vecs)
+	for i, e := range es {
+		if i < len(ns) {
+			e.N = ns[i]
+		}
+		r.end(ctx, e, err)
+	}
+	return ns, err
+}
+
+// WriteVec implements the KBFSOps interface for OpLogRecorder.  Each
+// vector is recorded as its own Write.
+func (r *OpLogRecorder) WriteVec(
+	ctx context.Context, file Node, vecs []IOVec) error {
+	es := make([]*OpLogEntry, len(vecs))
+	for i, vec := range vecs {
+		es[i] = r.begin(ctx, "Write", file)
+		es[i].Off = vec.Off
+		es[i].Size = int64(len(vec.Buf))
+	}
+	err := r.KBFSOps.WriteVec(ctx, file, vecs)
+	for _, e := range es {
+		r.end(ctx, e, err)
+	}
+	return err
+}
+
+// WriteStream implements the KBFSOps interface for OpLogRecorder.
+// It is recorded as a single Write of all the streamed bytes.
+func (r *OpLogRecorder) WriteStream(
+	ctx context.Context, file Node, src io.Reader, off int64) (int64, error) {
+	e := r.begin(ctx, "Write", file)
+	e.Off = off
+	n, err := r.KBFSOps.WriteStream(ctx, file, src, off)
+	e.Size = n
+	r.end(ctx, e, err)
+	return n, err
+}
+
+// Truncate implements the KBFSOps interface for OpLogRecorder.
+func (r *OpLogRecorder) Truncate(
+	ctx context.Context, file Node, size uint64) error {
+	e := r.begin(ctx, "Truncate", file)
+	e.Size = int64(size)
+	err := r.KBFSOps.Truncate(ctx, file, size)
+	r.end(ctx, e, err)
+	return err
+}
+
+// SetEx implements the KBFSOps interface for OpLogRecorder.
+func (r *OpLogRecorder) SetEx(ctx context.Context, file Node, ex bool) error {
+	e := r.begin(ctx, "SetEx", file)
+	e.Flag = ex
+	err := r.KBFSOps.SetEx(ctx, file, ex)
+	r.end(ctx, e, err)
+	return err
+}
+
+// SetMtime implements the KBFSOps interface for OpLogRecorder.
+func (r *OpLogRecorder) SetMtime(
+	ctx context.Context, file Node, mtime *time.Time) error {
+	e := r.begin(ctx, "SetMtime", file)
+	e.Mtime = mtime
+	err := r.KBFSOps.SetMtime(ctx, file, mtime)
+	r.end(ctx, e, err)
+	return err
+}
+
+// SyncAll implements the KBFSOps interface for OpLogRecorder.
+func (r *OpLogRecorder) SyncAll(
+	ctx context.Context, folderBranch FolderBranch) error {
+	r.lock.Lock()
+	tlfPath := r.tlfPaths[folderBranch.Tlf]
+	r.lock.Unlock()
+	e := r.begin(ctx, "SyncAll", nil)
+	e.Path = tlfPath
+	err := r.KBFSOps.SyncAll(ctx, folderBranch)
+	r.end(ctx, e, err)
+	return err
+}
+
+// SyncAllAsync implements the KBFSOps interface for OpLogRecorder.
+// It is recorded as a SyncAll, with the error from starting the sync.
+func (r *OpLogRecorder) SyncAllAsync(
+	ctx context.Context, folderBranch FolderBranch) (SyncTicket, error) {
+	r.lock.Lock()
+	tlfPath := r.tlfPaths[folderBranch.Tlf]
+	r.lock.Unlock()
+	e := r.begin(ctx, "SyncAll", nil)
+	e.Path = tlfPath
+	ticket, err := r.KBFSOps.SyncAllAsync(ctx, folderBranch)
+	r.end(ctx, e, err)
+	return ticket, err
+}
+
+// OpLogReplayResult summarizes the replay of an op log.
+type OpLogReplayResult struct {
+	// Ops is the number of ops replayed.
+	Ops int
+	// Mismatches is the number of ops whose outcome differed from
+	// the recording: they failed when the recorded op succeeded, or
+	// vice versa, or a Read returned a different number of bytes.
+	Mismatches int
+	// Recorded is how long the recorded ops took in total, and
+	// Replayed is how long the replayed ones did.
+	Recorded time.Duration
+	Replayed time.Duration
+}
+
+// opLogReplayer reproduces logged ops against a config.
+type opLogReplayer struct {
+	config Config
+	log    logger.Logger
+	// nodes caches the node for each path looked up so far.
+	nodes map[string]Node
+}
+
+// ReplayOpLog reads a log written by an OpLogRecorder from `r`, and
+// performs the same ops, in order, against `config`.  Writes use
+// synthetic data of the recorded sizes.  If `keepTiming` is true,
+// each op is delayed until the same time after the start of the
+// replay as it was after the start of the recording.  Failing ops
+// don't stop the replay; they are counted as mismatches if the
+// recorded op didn't fail too.
+func ReplayOpLog(ctx context.Context, config Config, r io.Reader,
+	keepTiming bool) (result OpLogReplayResult, err error) {
+	rp := &opLogReplayer{
+		config: config,
+		log:    config.MakeLogger("OLP"),
+		nodes:  make(map[string]Node),
+	}
+	clock := config.Clock()
+	start := clock.Now()
+	dec := json.NewDecoder(r)
+	for {
+		var e OpLogEntry
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return result, errors.Wrapf(
+				err, "Couldn't decode op %d", result.Ops+1)
+		}
+
+		if keepTiming {
+			if wait := e.Start - clock.Now().Sub(start); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+					return result, ctx.Err()
+				}
+			}
+		}
+
+		opStart := clock.Now()
+		n, err := rp.replay(ctx, e)
+		result.Replayed += clock.Now().Sub(opStart)
+		result.Recorded += e.Duration
+		result.Ops++
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		if (err != nil) != (e.Err != "") || (e.Op == "Read" && n != e.N) {
+			rp.log.CDebugf(ctx, "Replay of %s %s (recorded err=%q, n=%d) "+
+				"mismatched: err=%+v, n=%d", e.Op, e.Path, e.Err, e.N, err, n)
+			result.Mismatches++
+		}
+	}
+	return result, nil
+}
+
+// getNode returns the node for the given canonical path, resolving
+// the TLF and looking up each component as needed.
+func (rp *opLogReplayer) getNode(ctx context.Context, p string) (
+	Node, error) {
+	if node, ok := rp.nodes[p]; ok {
+		return node, nil
+	}
+
+	parts := strings.Split(
+		strings.TrimPrefix(p, "/"+string(KeybasePathType)+"/"), "/")
+	if len(parts) < 2 {
+		return nil, errors.Errorf("Bad path %q", p)
+	}
+	if len(parts) > 2 {
+		parentPath := strings.Join(parts[:len(parts)-1], "/")
+		parent, err := rp.getNode(
+			ctx, "/"+string(KeybasePathType)+"/"+parentPath)
+		if err != nil {
+			return nil, err
+		}
+		node, _, err := rp.config.KBFSOps().Lookup(
+			ctx, parent, parts[len(parts)-1])
+		if err != nil {
+			return nil, err
+		}
+		rp.nodes[p] = node
+		return node, nil
+	}
+
+	var t tlf.Type
+	switch PathType(parts[0]) {
+	case PrivatePathType:
+		t = tlf.Private
+	case PublicPathType:
+		t = tlf.Public
+	case SingleTeamPathType:
+		t = tlf.SingleTeam
+	default:
+		return nil, errors.Errorf("Bad path type in %q", p)
+	}
+	h, err := GetHandleFromFolderNameAndType(
+		ctx, rp.config.KBPKI(), rp.config.MDOps(), parts[1], t)
+	if err != nil {
+		return nil, err
+	}
+	node, _, err := rp.config.KBFSOps().GetOrCreateRootNode(
+		ctx, h, MasterBranch)
+	if err != nil {
+		return nil, err
+	}
+	rp.nodes[p] = node
+	return node, nil
+}
+
+// forget drops any cached nodes at or below the given path.
+func (rp *opLogReplayer) forget(p string) {
+	for cached := range rp.nodes {
+		if cached == p || strings.HasPrefix(cached, p+"/") {
+			delete(rp.nodes, cached)
+		}
+	}
+}
+
+// replay performs a single logged op, returning the number of bytes
+// read for a Read.
+func (rp *opLogReplayer) replay(ctx context.Context, e OpLogEntry) (
+	n int64, err error) {
+	kbfsOps := rp.config.KBFSOps()
+	node, err := rp.getNode(ctx, e.Path)
+	if err != nil {
+		return 0, err
+	}
+
+	switch e.Op {
+	case "GetRootNode":
+		return 0, nil
+	case "GetDirChildren":
+		_, err = kbfsOps.GetDirChildren(ctx, node)
+	case "Lookup":
+		_, err = rp.getNode(ctx, e.Path+"/"+e.Name)
+	case "Stat":
+		_, err = kbfsOps.Stat(ctx, node)
+	case "CreateDir":
+		_, _, err = kbfsOps.CreateDir(ctx, node, e.Name)
+	case "CreateFile":
+		_, _, err = kbfsOps.CreateFile(ctx, node, e.Name, e.Flag, NoExcl)
+	case "CreateLink":
+		_, err = kbfsOps.CreateLink(ctx, node, e.Name, e.NewPath)
+	case "RemoveDir":
+		rp.forget(e.Path + "/" + e.Name)
+		err = kbfsOps.RemoveDir(ctx, node, e.Name)
+	case "RemoveEntry":
+		rp.forget(e.Path + "/" + e.Name)
+		err = kbfsOps.RemoveEntry(ctx, node, e.Name)
+	case "Rename":
+		var newParent Node
+		newParent, err = rp.getNode(ctx, e.NewPath)
+		if err != nil {
+			return 0, err
+		}
+		rp.forget(e.Path + "/" + e.Name)
+		rp.forget(e.NewPath + "/" + e.NewName)
+		err = kbfsOps.Rename(ctx, node, e.Name, newParent, e.NewName)
+	case "CloneFile":
+		var dstDir Node
+		dstDir, err = rp.getNode(ctx, e.NewPath)
+		if err != nil {
+			return 0, err
+		}
+		rp.forget(e.NewPath + "/" + e.NewName)
+		_, _, err = kbfsOps.CloneFile(ctx, node, dstDir, e.NewName)
+	case "Read":
+		n, err = kbfsOps.Read(ctx, node, make([]byte, e.Size), e.Off)
+	case "Write":
+		data := make([]byte, e.Size)
+		for i := range data {
+			data[i] = byte(e.Off + int64(i))
+		}
+		err = kbfsOps.Write(ctx, node, data, e.Off)
+	case "Truncate":
+		err = kbfsOps.Truncate(ctx, node, uint64(e.Size))
+	case "SetEx":
+		err = kbfsOps.SetEx(ctx, node, e.Flag)
+	case "SetMtime":
+		err = kbfsOps.SetMtime(ctx, node, e.Mtime)
+	case "SyncAll":
+		err = kbfsOps.SyncAll(ctx, node.GetFolderBranch())
+	default:
+		return 0, errors.Errorf("Unknown op %q", e.Op)
+	}
+	return n, err
+}
@@ -0,0 +1,75 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpLogRecordAndReplay(t *testing.T) {
+	ctx := BackgroundContextWithCancellationDelayer()
+	defer CleanupCancellationDelayer(ctx)
+	config := MakeTestConfigOrBust(t, "u1")
+	defer CheckConfigAndShutdown(ctx, t, config)
+
+	var buf bytes.Buffer
+	recorder, err := NewOpLogRecorder(config, &buf)
+	require.NoError(t, err)
+	config.SetKBFSOps(recorder)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	fileNode, _, err := kbfsOps.CreateFile(ctx, dirNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, make([]byte, 100), 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	n, err := kbfsOps.Read(ctx, fileNode, make([]byte, 200), 50)
+	require.NoError(t, err)
+	require.Equal(t, int64(50), n)
+	_, _, err = kbfsOps.Lookup(ctx, dirNode, "missing")
+	require.Error(t, err)
+	err = kbfsOps.Rename(ctx, dirNode, "b", rootNode, "c")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	var ops []string
+	dec := json.NewDecoder(bytes.NewReader(buf.Bytes()))
+	for dec.More() {
+		var e OpLogEntry
+		require.NoError(t, dec.Decode(&e))
+		ops = append(ops, e.Op)
+		if e.Op == "Write" {
+			require.Equal(t, "/keybase/private/u1/a/b", e.Path)
+			require.Equal(t, int64(100), e.Size)
+		}
+	}
+	require.Equal(t, []string{"GetRootNode", "CreateDir", "CreateFile",
+		"Write", "SyncAll", "Read", "Lookup", "Rename", "SyncAll"}, ops)
+
+	// Replay against a fresh config.
+	config2 := MakeTestConfigOrBust(t, "u1")
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	result, err := ReplayOpLog(
+		ctx, config2, bytes.NewReader(buf.Bytes()), false)
+	require.NoError(t, err)
+	require.Equal(t, len(ops), result.Ops)
+	require.Equal(t, 0, result.Mismatches)
+
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "u1", tlf.Private)
+	children, err := config2.KBFSOps().GetDirChildren(ctx, rootNode2)
+	require.NoError(t, err)
+	require.Contains(t, children, "a")
+	require.Equal(t, uint64(100), children["c"].Size)
+}
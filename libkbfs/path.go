@@ -153,6 +153,19 @@ func (p path) String() string {
 	return strings.Join(names, "/")
 }
 
+// tlfRelativeString returns the slash-separated path of the last
+// node, relative to the TLF root.  The root itself is "".
+func (p path) tlfRelativeString() string {
+	if len(p.path) <= 1 {
+		return ""
+	}
+	names := make([]string, 0, len(p.path))
+	for _, node := range p.path[1:] {
+		names = append(names, node.Name)
+	}
+	return strings.Join(names, "/")
+}
+
 // CanonicalPathString returns canonical representation of the full path,
 // always prefaced by /keybase. This may require conversion to a platform
 // specific path, for example, by replacing /keybase with the appropriate drive
@@ -0,0 +1,168 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// powerStateCheckPeriod is how long a PowerMonitor trusts the
+	// last power state it read from the OS.
+	powerStateCheckPeriod = time.Minute
+	// defaultJournalFlushDelay is how long journal flushes are
+	// delayed under the default power policy.
+	defaultJournalFlushDelay = 5 * time.Minute
+)
+
+// PowerState describes the power source and network of the device
+// KBFS is running on.
+type PowerState struct {
+	// OnBattery is true if the device is running on battery power.
+	OnBattery bool
+	// Metered is true if the device's network connection is metered.
+	Metered bool
+}
+
+// PowerPolicy describes how KBFS scales back its background work
+// when the device is constrained, i.e. on battery power or a metered
+// network.  The zero value never treats the device as constrained.
+type PowerPolicy struct {
+	// OnBattery is true if running on battery power constrains the
+	// device.
+	OnBattery bool
+	// OnMetered is true if being on a metered network constrains
+	// the device.
+	OnMetered bool
+	// ReducePrefetch, if true, stops regular reads from triggering
+	// prefetches on a constrained device, and stops synced TLFs
+	// from getting a boosted prefetch priority.
+	ReducePrefetch bool
+	// JournalFlushDelay is how long the journal waits before
+	// flushing new writes on a constrained device, so that they go
+	// out in fewer, larger batches.
+	JournalFlushDelay time.Duration
+	// PauseMaintenance, if true, pauses quota reclamation and node
+	// revalidation on a constrained device.
+	PauseMaintenance bool
+}
+
+// DefaultPowerPolicy returns the power policy KBFS uses unless
+// configured otherwise.
+func DefaultPowerPolicy() PowerPolicy {
+	return PowerPolicy{
+		OnBattery:         true,
+		OnMetered:         true,
+		ReducePrefetch:    true,
+		JournalFlushDelay: defaultJournalFlushDelay,
+		PauseMaintenance:  true,
+	}
+}
+
+// PowerMonitor tracks the power state of the device, and applies the
+// configured PowerPolicy to it.  Unless a state is set explicitly via
+// `SetPowerState` (e.g., by a mobile app that knows better), it
+// periodically reads the state from the OS.  A nil PowerMonitor never
+// treats the device as constrained.
+type PowerMonitor struct {
+	clocks clockGetter
+
+	lock      sync.Mutex
+	policy    PowerPolicy
+	override  *PowerState
+	state     PowerState
+	lastCheck time.Time
+}
+
+// NewPowerMonitor returns a new PowerMonitor with the default policy.
+func NewPowerMonitor(clocks clockGetter) *PowerMonitor {
+	return &PowerMonitor{
+		clocks: clocks,
+		policy: DefaultPowerPolicy(),
+	}
+}
+
+// SetPolicy sets the power policy.
+func (pm *PowerMonitor) SetPolicy(policy PowerPolicy) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	pm.policy = policy
+}
+
+// Policy returns the current power policy.
+func (pm *PowerMonitor) Policy() PowerPolicy {
+	if pm == nil {
+		return PowerPolicy{}
+	}
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	return pm.policy
+}
+
+// SetPowerState sets the power state of the device, overriding what
+// the OS reports from now on.
+func (pm *PowerMonitor) SetPowerState(state PowerState) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	pm.override = &state
+}
+
+func (pm *PowerMonitor) powerStateLocked() PowerState {
+	if pm.override != nil {
+		return *pm.override
+	}
+	now := pm.clocks.Clock().Now()
+	if !pm.lastCheck.IsZero() &&
+		now.Sub(pm.lastCheck) < powerStateCheckPeriod {
+		return pm.state
+	}
+	state, err := getOSPowerState()
+	if err == nil {
+		pm.state = state
+	}
+	// On an error, keep using the last known state until the next
+	// check.
+	pm.lastCheck = now
+	return pm.state
+}
+
+// PowerState returns the current power state of the device.
+func (pm *PowerMonitor) PowerState() PowerState {
+	if pm == nil {
+		return PowerState{}
+	}
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	return pm.powerStateLocked()
+}
+
+// activePolicy returns the power policy if it currently applies, or
+// the zero policy if the device isn't constrained.
+func (pm *PowerMonitor) activePolicy() PowerPolicy {
+	if pm == nil {
+		return PowerPolicy{}
+	}
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	state := pm.powerStateLocked()
+	if (state.OnBattery && pm.policy.OnBattery) ||
+		(state.Metered && pm.policy.OnMetered) {
+		return pm.policy
+	}
+	return PowerPolicy{}
+}
+
+func (pm *PowerMonitor) shouldReducePrefetch() bool {
+	return pm.activePolicy().ReducePrefetch
+}
+
+func (pm *PowerMonitor) journalFlushDelay() time.Duration {
+	return pm.activePolicy().JournalFlushDelay
+}
+
+func (pm *PowerMonitor) shouldPauseMaintenance() bool {
+	return pm.activePolicy().PauseMaintenance
+}
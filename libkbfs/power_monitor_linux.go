@@ -0,0 +1,54 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/keybase/kbfs/ioutil"
+)
+
+const sysPowerSupplyDir = "/sys/class/power_supply"
+
+func readPowerSupplyAttr(supply, attr string) (string, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(sysPowerSupplyDir, supply, attr))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(buf)), nil
+}
+
+// getOSPowerState reads the power state from sysfs.  The device is on
+// battery if it has a battery, and none of its mains supplies are
+// online.  Linux doesn't expose whether the network is metered in a
+// generic way, so that's left to `PowerMonitor.SetPowerState`.
+func getOSPowerState() (PowerState, error) {
+	infos, err := ioutil.ReadDir(sysPowerSupplyDir)
+	if ioutil.IsNotExist(err) {
+		return PowerState{}, nil
+	} else if err != nil {
+		return PowerState{}, err
+	}
+
+	hasBattery := false
+	for _, info := range infos {
+		supplyType, err := readPowerSupplyAttr(info.Name(), "type")
+		if err != nil {
+			// Not every supply exposes a type.
+			continue
+		}
+		switch supplyType {
+		case "Battery":
+			hasBattery = true
+		case "Mains":
+			online, err := readPowerSupplyAttr(info.Name(), "online")
+			if err == nil && online == "1" {
+				return PowerState{}, nil
+			}
+		}
+	}
+	return PowerState{OnBattery: hasBattery}, nil
+}
@@ -0,0 +1,14 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package libkbfs
+
+// getOSPowerState isn't implemented on this platform, so the device
+// is never considered constrained unless `PowerMonitor.SetPowerState`
+// says otherwise.
+func getOSPowerState() (PowerState, error) {
+	return PowerState{}, nil
+}
@@ -0,0 +1,46 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPowerMonitor(t *testing.T) {
+	pm := NewPowerMonitor(newTestClockGetter())
+
+	t.Log("An unconstrained device doesn't scale anything back")
+	pm.SetPowerState(PowerState{})
+	require.False(t, pm.shouldReducePrefetch())
+	require.Equal(t, time.Duration(0), pm.journalFlushDelay())
+	require.False(t, pm.shouldPauseMaintenance())
+
+	t.Log("On battery, the default policy scales everything back")
+	pm.SetPowerState(PowerState{OnBattery: true})
+	require.True(t, pm.shouldReducePrefetch())
+	require.Equal(t, defaultJournalFlushDelay, pm.journalFlushDelay())
+	require.True(t, pm.shouldPauseMaintenance())
+
+	t.Log("A policy can ignore the battery but still react to metering")
+	policy := DefaultPowerPolicy()
+	policy.OnBattery = false
+	policy.PauseMaintenance = false
+	pm.SetPolicy(policy)
+	require.False(t, pm.shouldReducePrefetch())
+	pm.SetPowerState(PowerState{OnBattery: true, Metered: true})
+	require.True(t, pm.shouldReducePrefetch())
+	require.Equal(t, defaultJournalFlushDelay, pm.journalFlushDelay())
+	require.False(t, pm.shouldPauseMaintenance())
+
+	t.Log("The zero policy and a nil monitor never scale anything back")
+	pm.SetPolicy(PowerPolicy{})
+	require.False(t, pm.shouldReducePrefetch())
+	var nilMonitor *PowerMonitor
+	require.Equal(t, PowerState{}, nilMonitor.PowerState())
+	require.False(t, nilMonitor.shouldPauseMaintenance())
+}
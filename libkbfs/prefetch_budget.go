@@ -0,0 +1,157 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"time"
+)
+
+// PrefetchBudgetLimits caps how many bytes the prefetcher may
+// download from the server.  A limit of 0 means no limit.
+type PrefetchBudgetLimits struct {
+	// PerHour caps the prefetched bytes in any one hour.
+	PerHour int64
+	// PerDay caps the prefetched bytes in any one day.
+	PerDay int64
+}
+
+// PrefetchBudgetStatus describes how much of the prefetch budget has
+// been used up.
+type PrefetchBudgetStatus struct {
+	Limits       PrefetchBudgetLimits
+	UsedThisHour int64
+	UsedToday    int64
+	// Remaining is the number of bytes that may still be prefetched
+	// before the budget runs out, or -1 if there is no limit.
+	Remaining int64
+}
+
+// prefetchBudgetWindow counts the bytes used within one fixed-length
+// window of time.
+type prefetchBudgetWindow struct {
+	length time.Duration
+	start  time.Time
+	used   int64
+}
+
+func (w *prefetchBudgetWindow) roll(now time.Time) {
+	if w.start.IsZero() || now.Sub(w.start) >= w.length {
+		w.start = now
+		w.used = 0
+	}
+}
+
+func remainingInWindow(limit int64, w prefetchBudgetWindow) int64 {
+	if limit <= 0 {
+		return -1
+	}
+	if w.used >= limit {
+		return 0
+	}
+	return limit - w.used
+}
+
+// PrefetchBudget tracks the bytes downloaded by the prefetcher during
+// this session, and stops further prefetching once they exceed the
+// configured hourly or daily limits.  Unlike bandwidth throttling,
+// this caps the total amount of background fetching, to protect
+// metered connections.  On-demand fetches are never counted or
+// limited.  A nil PrefetchBudget has no limits.
+type PrefetchBudget struct {
+	clocks clockGetter
+
+	lock   sync.Mutex
+	limits PrefetchBudgetLimits
+	hour   prefetchBudgetWindow
+	day    prefetchBudgetWindow
+}
+
+// NewPrefetchBudget returns a new PrefetchBudget with no limits.
+func NewPrefetchBudget(clocks clockGetter) *PrefetchBudget {
+	return &PrefetchBudget{
+		clocks: clocks,
+		hour:   prefetchBudgetWindow{length: time.Hour},
+		day:    prefetchBudgetWindow{length: 24 * time.Hour},
+	}
+}
+
+// SetLimits sets the prefetch budget limits.
+func (pb *PrefetchBudget) SetLimits(limits PrefetchBudgetLimits) {
+	pb.lock.Lock()
+	defer pb.lock.Unlock()
+	pb.limits = limits
+}
+
+// Limits returns the current prefetch budget limits.
+func (pb *PrefetchBudget) Limits() PrefetchBudgetLimits {
+	if pb == nil {
+		return PrefetchBudgetLimits{}
+	}
+	pb.lock.Lock()
+	defer pb.lock.Unlock()
+	return pb.limits
+}
+
+func (pb *PrefetchBudget) rollLocked() {
+	now := pb.clocks.Clock().Now()
+	pb.hour.roll(now)
+	pb.day.roll(now)
+}
+
+func (pb *PrefetchBudget) remainingLocked() int64 {
+	hour := remainingInWindow(pb.limits.PerHour, pb.hour)
+	day := remainingInWindow(pb.limits.PerDay, pb.day)
+	if hour < 0 || (day >= 0 && day < hour) {
+		return day
+	}
+	return hour
+}
+
+// Remaining returns the number of bytes that may still be prefetched
+// before the budget runs out, or -1 if there is no limit.
+func (pb *PrefetchBudget) Remaining() int64 {
+	if pb == nil {
+		return -1
+	}
+	pb.lock.Lock()
+	defer pb.lock.Unlock()
+	pb.rollLocked()
+	return pb.remainingLocked()
+}
+
+// Status returns the current status of the prefetch budget.
+func (pb *PrefetchBudget) Status() PrefetchBudgetStatus {
+	if pb == nil {
+		return PrefetchBudgetStatus{Remaining: -1}
+	}
+	pb.lock.Lock()
+	defer pb.lock.Unlock()
+	pb.rollLocked()
+	return PrefetchBudgetStatus{
+		Limits:       pb.limits,
+		UsedThisHour: pb.hour.used,
+		UsedToday:    pb.day.used,
+		Remaining:    pb.remainingLocked(),
+	}
+}
+
+// spend records that `bytes` bytes were downloaded by the prefetcher.
+func (pb *PrefetchBudget) spend(bytes int64) {
+	if pb == nil {
+		return
+	}
+	pb.lock.Lock()
+	defer pb.lock.Unlock()
+	pb.rollLocked()
+	pb.hour.used += bytes
+	pb.day.used += bytes
+}
+
+// isExhausted returns true if no more bytes may be prefetched right
+// now.
+func (pb *PrefetchBudget) isExhausted() bool {
+	return pb.Remaining() == 0
+}
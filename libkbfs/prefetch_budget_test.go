@@ -0,0 +1,50 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefetchBudget(t *testing.T) {
+	cg := newTestClockGetter()
+	clock := cg.TestClock()
+	now := clock.Now()
+	pb := NewPrefetchBudget(cg)
+
+	t.Log("With no limits, the budget never runs out")
+	pb.spend(1 << 40)
+	require.Equal(t, int64(-1), pb.Remaining())
+	require.False(t, pb.isExhausted())
+
+	t.Log("The hourly limit runs out first, and resets after an hour")
+	pb.SetLimits(PrefetchBudgetLimits{PerHour: 100, PerDay: 150})
+	clock.Set(now.Add(24 * time.Hour))
+	pb.spend(60)
+	require.Equal(t, int64(40), pb.Remaining())
+	pb.spend(60)
+	require.True(t, pb.isExhausted())
+	status := pb.Status()
+	require.Equal(t, int64(120), status.UsedThisHour)
+	require.Equal(t, int64(120), status.UsedToday)
+	require.Equal(t, int64(0), status.Remaining)
+	clock.Set(now.Add(25 * time.Hour))
+	require.Equal(t, int64(30), pb.Remaining())
+
+	t.Log("Then the daily limit runs out, and resets after a day")
+	pb.spend(30)
+	require.True(t, pb.isExhausted())
+	clock.Set(now.Add(48 * time.Hour))
+	require.Equal(t, int64(100), pb.Remaining())
+
+	t.Log("A nil budget has no limits")
+	var nilBudget *PrefetchBudget
+	nilBudget.spend(1)
+	require.Equal(t, int64(-1), nilBudget.Remaining())
+	require.False(t, nilBudget.isExhausted())
+}
@@ -32,6 +32,9 @@ type prefetcherConfig interface {
 	logMaker
 	blockCacher
 	diskBlockCacheGetter
+	idleTrackerGetter
+	powerMonitorGetter
+	prefetchBudgetGetter
 }
 
 type prefetchRequest struct {
@@ -200,9 +203,15 @@ func (p *blockPrefetcher) completePrefetch(
 					"complete its prefetch, canceled it instead: %+v", err)
 				return
 			}
+			// A metadata-only prefetch skipped the file contents, so
+			// the subtree isn't finished from the point of view of a
+			// later full sync.
+			status := FinishedPrefetch
+			if p.isMetadataOnlyTlf(pp.req.kmd.TlfID()) {
+				status = TriggeredPrefetch
+			}
 			err = p.retriever.PutInCaches(pp.ctx, pp.req.ptr,
-				pp.req.kmd.TlfID(), b, pp.req.lifetime,
-				FinishedPrefetch)
+				pp.req.kmd.TlfID(), b, pp.req.lifetime, status)
 			if err != nil {
 				p.log.CWarningf(pp.ctx, "failed to complete prefetch due to "+
 					"cache error, canceled it instead: %+v", err)
@@ -254,16 +263,42 @@ top:
 	p.almostDoneCh <- struct{}{}
 }
 
+// canBoostPriority returns true if deep prefetches may currently
+// run at a high priority.  While the user is active, or the power
+// policy says to reduce prefetching, they get the base priority, so
+// that they don't compete with on-demand requests.
+func (p *blockPrefetcher) canBoostPriority() bool {
+	return p.config.IdleTracker().IsIdle() &&
+		!p.config.PowerMonitor().shouldReducePrefetch()
+}
+
 // calculatePriority returns either a base priority for an unsynced TLF or a
 // high priority for a synced TLF.
 func (p *blockPrefetcher) calculatePriority(basePriority int,
 	tlfID tlf.ID) int {
-	if p.config.IsSyncedTlf(tlfID) {
+	if p.config.IsSyncedTlf(tlfID) && p.canBoostPriority() {
 		return defaultOnDemandRequestPriority - 1
 	}
 	return basePriority
 }
 
+// isMetadataOnlyTlf returns true if only the directory blocks of the
+// given TLF should be deeply prefetched.  A fully-synced TLF takes
+// precedence over a metadata-only one.
+func (p *blockPrefetcher) isMetadataOnlyTlf(tlfID tlf.ID) bool {
+	return !p.config.IsSyncedTlf(tlfID) && p.config.IsMetadataSyncedTlf(tlfID)
+}
+
+// calculateDirPriority is like `calculatePriority`, but also returns a
+// high priority for the directory blocks of a metadata-only TLF.
+func (p *blockPrefetcher) calculateDirPriority(basePriority int,
+	tlfID tlf.ID) int {
+	if p.config.IsMetadataSyncedTlf(tlfID) && p.canBoostPriority() {
+		return defaultOnDemandRequestPriority - 1
+	}
+	return p.calculatePriority(basePriority, tlfID)
+}
+
 // request maps the parent->child block relationship in the prefetcher, and it
 // triggers child prefetches that aren't already in progress.
 func (p *blockPrefetcher) request(ctx context.Context, priority int,
@@ -326,7 +361,7 @@ func (p *blockPrefetcher) prefetchIndirectDirBlock(ctx context.Context,
 	isTail bool) {
 	// Prefetch indirect block pointers.
 	startingPriority :=
-		p.calculatePriority(fileIndirectBlockPrefetchPriority, kmd.TlfID())
+		p.calculateDirPriority(fileIndirectBlockPrefetchPriority, kmd.TlfID())
 	for i, ptr := range b.IPtrs {
 		numBlocks += p.request(ctx, startingPriority-i, kmd,
 			ptr.BlockPointer, b.NewEmpty(), lifetime,
@@ -343,7 +378,8 @@ func (p *blockPrefetcher) prefetchDirectDirBlock(ctx context.Context,
 	dirEntries := dirEntriesBySizeAsc{dirEntryMapToDirEntries(b.Children)}
 	sort.Sort(dirEntries)
 	startingPriority :=
-		p.calculatePriority(dirEntryPrefetchPriority, kmd.TlfID())
+		p.calculateDirPriority(dirEntryPrefetchPriority, kmd.TlfID())
+	metadataOnly := p.isMetadataOnlyTlf(kmd.TlfID())
 	totalChildEntries := 0
 	for i, entry := range dirEntries.dirEntries {
 		// Prioritize small files
@@ -352,9 +388,11 @@ func (p *blockPrefetcher) prefetchDirectDirBlock(ctx context.Context,
 		switch entry.Type {
 		case Dir:
 			block = &DirBlock{}
-		case File:
-			block = &FileBlock{}
-		case Exec:
+		case File, Exec:
+			if metadataOnly {
+				// File contents stay online-only for metadata-only TLFs.
+				continue
+			}
 			block = &FileBlock{}
 		case Sym:
 			// Skip symbolic links because there's nothing to prefetch.
@@ -691,7 +729,18 @@ func (p *blockPrefetcher) cacheOrCancelPrefetch(ctx context.Context,
 func (p *blockPrefetcher) ProcessBlockForPrefetch(ctx context.Context,
 	ptr BlockPointer, block Block, kmd KeyMetadata, priority int,
 	lifetime BlockCacheLifetime, prefetchStatus PrefetchStatus) {
-	isDeepSync := p.config.IsSyncedTlf(kmd.TlfID())
+	isSynced := p.config.IsSyncedTlf(kmd.TlfID())
+	isDeepSync := isSynced || p.config.IsMetadataSyncedTlf(kmd.TlfID())
+	if !isDeepSync && p.config.PowerMonitor().shouldReducePrefetch() {
+		// On battery or a metered network, regular reads don't
+		// trigger prefetches.
+		priority = defaultPrefetchPriority
+	}
+	if p.config.PrefetchBudget().isExhausted() {
+		// Once the prefetch budget is used up, nothing triggers
+		// prefetches (not even synced TLFs) until it frees up again.
+		priority = defaultPrefetchPriority
+	}
 	req := &prefetchRequest{ptr, block.NewEmpty(), kmd, priority, lifetime,
 		prefetchStatus, isDeepSync}
 	if prefetchStatus == FinishedPrefetch {
@@ -712,7 +761,7 @@ func (p *blockPrefetcher) ProcessBlockForPrefetch(ctx context.Context,
 			return
 		}
 		dbc := p.config.DiskBlockCache()
-		if isDeepSync && dbc != nil {
+		if isSynced && dbc != nil {
 			wrappedCache := dbc.(*diskBlockCacheWrapped)
 			if !wrappedCache.DoesSyncCacheHaveSpace(ctx) {
 				// If the sync cache is close to full, cancel prefetches.
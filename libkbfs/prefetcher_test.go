@@ -33,6 +33,7 @@ func makeRandomDirEntry(
 			102,
 			"",
 			nil,
+			0,
 		},
 		codec.UnknownFieldSetHandler{},
 	}
@@ -599,6 +600,83 @@ func TestPrefetcherForSyncedTLF(t *testing.T) {
 		FinishedPrefetch, TransientEntry)
 }
 
+func TestPrefetcherForMetadataSyncedTLF(t *testing.T) {
+	t.Log("Test metadata-only TLF prefetching.")
+	q, bg, config := initPrefetcherTest(t)
+	defer shutdownPrefetcherTest(q)
+	prefetchSyncCh := make(chan struct{})
+	q.TogglePrefetcher(true, prefetchSyncCh)
+	notifySyncCh(t, prefetchSyncCh)
+
+	kmd := makeKMD()
+	config.SetTlfMetadataSyncState(kmd.TlfID(), true)
+
+	t.Log("Initialize a direct dir block with entries pointing to 2 files " +
+		"and 1 directory. The directory has an entry pointing to another " +
+		"file, and another empty directory.")
+	rootPtr := makeRandomBlockPointer(t)
+	rootDir := &DirBlock{Children: map[string]DirEntry{
+		"a": makeRandomDirEntry(t, File, 100, "a"),
+		"b": makeRandomDirEntry(t, Dir, 60, "b"),
+		"c": makeRandomDirEntry(t, Exec, 20, "c"),
+	}}
+	dirB := &DirBlock{Children: map[string]DirEntry{
+		"d": makeRandomDirEntry(t, File, 100, "d"),
+		"e": makeRandomDirEntry(t, Dir, 60, "e"),
+	}}
+	dirBdirE := &DirBlock{Children: map[string]DirEntry{}}
+
+	_, continueChRootDir := bg.setBlockToReturn(rootPtr, rootDir)
+	_, continueChDirB :=
+		bg.setBlockToReturn(rootDir.Children["b"].BlockPointer, dirB)
+	_, continueChDirBdirE :=
+		bg.setBlockToReturn(dirB.Children["e"].BlockPointer, dirBdirE)
+
+	var block Block = &DirBlock{}
+	ch := q.Request(context.Background(),
+		defaultOnDemandRequestPriority, kmd, rootPtr, block, TransientEntry)
+	continueChRootDir <- nil
+	err := <-ch
+	require.NoError(t, err)
+	require.Equal(t, rootDir, block)
+
+	t.Log("Release the directory blocks; the file blocks should never " +
+		"be requested.")
+	go func() {
+		continueChDirB <- nil
+		continueChDirBdirE <- nil
+	}()
+	t.Log("Wait for prefetching to complete.")
+	// Release after prefetching rootDir
+	notifySyncCh(t, prefetchSyncCh)
+	// Release after prefetching dirB
+	notifySyncCh(t, prefetchSyncCh)
+	// Release after prefetching dirBdirE
+	notifySyncCh(t, prefetchSyncCh)
+	waitForPrefetchOrBust(t, q.Prefetcher().Shutdown())
+	q.TogglePrefetcher(true, prefetchSyncCh)
+	notifySyncCh(t, prefetchSyncCh)
+
+	t.Log("Ensure that only the directory blocks are in the cache, and " +
+		"that they aren't marked as fully prefetched.")
+	testPrefetcherCheckGet(t, config.BlockCache(), rootPtr, rootDir,
+		TriggeredPrefetch, TransientEntry)
+	testPrefetcherCheckGet(t, config.BlockCache(),
+		rootDir.Children["b"].BlockPointer, dirB, TriggeredPrefetch,
+		TransientEntry)
+	testPrefetcherCheckGet(t, config.BlockCache(),
+		dirB.Children["e"].BlockPointer, dirBdirE, TriggeredPrefetch,
+		TransientEntry)
+	for _, ptr := range []BlockPointer{
+		rootDir.Children["a"].BlockPointer,
+		rootDir.Children["c"].BlockPointer,
+		dirB.Children["d"].BlockPointer,
+	} {
+		_, err := config.BlockCache().Get(ptr)
+		require.IsType(t, NoSuchBlockError{}, err)
+	}
+}
+
 func TestPrefetcherMultiLevelIndirectFile(t *testing.T) {
 	t.Log("Test multi-level indirect file block prefetching.")
 	q, bg, config := initPrefetcherTest(t)
@@ -0,0 +1,168 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"time"
+
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"golang.org/x/net/context"
+)
+
+// qrSimulationChunkSize is how many revisions are fetched at a time
+// while simulating quota reclamation.
+const qrSimulationChunkSize = 100
+
+// QRSimulationWindow reports what quota reclamation would reclaim if
+// it used a given minimum unref age.
+type QRSimulationWindow struct {
+	MinUnrefAge time.Duration
+	// LatestRev is the most recent revision that is old enough to be
+	// reclaimed, or kbfsmd.RevisionUninitialized if none is.
+	LatestRev kbfsmd.Revision
+	// Blocks is the number of block references that would be
+	// deleted.
+	Blocks int
+	// Bytes is the total size of the unreferenced blocks.  Blocks
+	// that are still referenced elsewhere aren't freed when one of
+	// their references is deleted, so this is an upper bound.
+	Bytes uint64
+}
+
+// QRSimulation is the result of SimulateQuotaReclamation.
+type QRSimulation struct {
+	Head kbfsmd.Revision
+	// LastGCRev is the latest revision that has already been
+	// reclaimed.
+	LastGCRev kbfsmd.Revision
+	Windows   []QRSimulationWindow
+}
+
+// qrSimulationRev is what one unreclaimed revision would contribute
+// to a reclamation.
+type qrSimulationRev struct {
+	rev       kbfsmd.Revision
+	timestamp time.Time
+	blocks    int
+	bytes     uint64
+}
+
+// numUnrefsForQR returns the number of block references quota
+// reclamation would delete for `rmd`; see
+// `folderBlockManager.getUnreferencedBlocks`.
+func numUnrefsForQR(rmd ImmutableRootMetadata) int {
+	n := 0
+	for _, op := range rmd.data.Changes.Ops {
+		if _, ok := op.(*GCOp); ok {
+			continue
+		}
+		for _, ptr := range op.Unrefs() {
+			if ptr != zeroPtr {
+				n++
+			}
+		}
+		for _, update := range op.allUpdates() {
+			if update.Ref != update.Unref {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// SimulateQuotaReclamation reports, for each of `minUnrefAges`, how
+// much a quota reclamation of the TLF `tlfID` would reclaim right
+// now if it used that minimum unref age, without deleting anything.
+// Unlike a real reclamation, which does at most
+// `numMaxRevisionsPerQR` revisions at a time, it covers every
+// revision since the last one.
+func SimulateQuotaReclamation(ctx context.Context, config Config,
+	tlfID tlf.ID, minUnrefAges []time.Duration) (QRSimulation, error) {
+	head, err := config.MDOps().GetForTLF(ctx, tlfID, nil)
+	if err != nil {
+		return QRSimulation{}, err
+	}
+	if head == (ImmutableRootMetadata{}) {
+		return QRSimulation{}, nil
+	}
+
+	sim := QRSimulation{
+		Head:      head.Revision(),
+		LastGCRev: kbfsmd.RevisionUninitialized,
+	}
+	if head.data.LastGCRevision >= kbfsmd.RevisionInitial {
+		sim.LastGCRev = head.data.LastGCRevision
+	}
+
+	// Walk backwards from the head to the last reclaimed revision,
+	// which may only be found along the way in older histories.
+	var revs []qrSimulationRev
+	currHead := head.Revision()
+outer:
+	for currHead >= kbfsmd.RevisionInitial {
+		startRev := currHead - qrSimulationChunkSize + 1
+		if startRev < kbfsmd.RevisionInitial {
+			startRev = kbfsmd.RevisionInitial
+		}
+		rmds, err := getMDRange(ctx, config, tlfID, kbfsmd.NullBranchID,
+			startRev, currHead, kbfsmd.Merged, nil)
+		if err != nil {
+			return QRSimulation{}, err
+		}
+		if len(rmds) == 0 {
+			break
+		}
+
+		for i := len(rmds) - 1; i >= 0; i-- {
+			rmd := rmds[i]
+			if rmd.Revision() <= sim.LastGCRev {
+				break outer
+			}
+			if sim.LastGCRev == kbfsmd.RevisionUninitialized {
+				if rmd.data.LastGCRevision >= kbfsmd.RevisionInitial {
+					sim.LastGCRev = rmd.data.LastGCRevision
+				} else {
+					for j := len(rmd.data.Changes.Ops) - 1; j >= 0; j-- {
+						if gcOp, ok := rmd.data.Changes.Ops[j].(*GCOp); ok {
+							sim.LastGCRev = gcOp.LatestRev
+							break
+						}
+					}
+				}
+			}
+			revs = append(revs, qrSimulationRev{
+				rev:       rmd.Revision(),
+				timestamp: rmd.localTimestamp,
+				blocks:    numUnrefsForQR(rmd),
+				bytes:     rmd.UnrefBytes(),
+			})
+		}
+		currHead = rmds[0].Revision() - 1
+	}
+
+	now := config.Clock().Now()
+	for _, age := range minUnrefAges {
+		window := QRSimulationWindow{
+			MinUnrefAge: age,
+			LatestRev:   kbfsmd.RevisionUninitialized,
+		}
+		// `revs` is in descending order; everything from the most
+		// recent old-enough revision back is reclaimed, just like in
+		// `folderBlockManager.doReclamation`.
+		for _, r := range revs {
+			if window.LatestRev == kbfsmd.RevisionUninitialized {
+				if !r.timestamp.Add(age).Before(now) {
+					continue
+				}
+				window.LatestRev = r.rev
+			}
+			window.Blocks += r.blocks
+			window.Bytes += r.bytes
+		}
+		sim.Windows = append(sim.Windows, window)
+	}
+	return sim, nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	kbname "github.com/keybase/client/go/kbun"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSimulateQuotaReclamation(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+	clock, now := newTestClockAndTimeNow()
+	config.SetClock(clock)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	writeAndSync := func(n Node, data []byte) kbfsmd.Revision {
+		err := kbfsOps.Write(ctx, n, data, 0)
+		require.NoError(t, err)
+		err = kbfsOps.SyncAll(ctx, fb)
+		require.NoError(t, err)
+		status, _, err := kbfsOps.FolderStatus(ctx, fb)
+		require.NoError(t, err)
+		return status.Revision
+	}
+
+	t.Log("Overwrite a file twice, two hours apart")
+	aNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	writeAndSync(aNode, []byte{1, 2, 3})
+	oldRev := writeAndSync(aNode, []byte{4, 5, 6})
+	clock.Set(now.Add(2 * time.Hour))
+	head := writeAndSync(aNode, []byte{7, 8, 9})
+	clock.Set(now.Add(2*time.Hour + time.Minute))
+
+	t.Log("Longer windows reclaim less")
+	sim, err := SimulateQuotaReclamation(ctx, config, fb.Tlf,
+		[]time.Duration{0, time.Hour, 3 * time.Hour})
+	require.NoError(t, err)
+	require.Equal(t, head, sim.Head)
+	require.Equal(t, kbfsmd.RevisionUninitialized, sim.LastGCRev)
+	require.Len(t, sim.Windows, 3)
+
+	all, hour, none := sim.Windows[0], sim.Windows[1], sim.Windows[2]
+	require.Equal(t, head, all.LatestRev)
+	require.Equal(t, oldRev, hour.LatestRev)
+	require.Equal(t, kbfsmd.RevisionUninitialized, none.LatestRev)
+	require.True(t, all.Bytes > hour.Bytes)
+	require.True(t, hour.Bytes > 0)
+	require.True(t, all.Blocks > hour.Blocks)
+	require.Zero(t, none.Bytes)
+	require.Zero(t, none.Blocks)
+
+	t.Log("Nothing was deleted")
+	status, _, err := kbfsOps.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, head, status.Revision)
+	require.Equal(t, kbfsmd.RevisionUninitialized, status.LastGCRevision)
+}
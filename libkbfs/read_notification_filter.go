@@ -0,0 +1,169 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/keybase/kbfs/tlf"
+)
+
+// readNotificationState tracks the read notifications for one file.
+type readNotificationState struct {
+	// inFlight counts the block fetches for the file that are
+	// currently in progress.
+	inFlight int
+	// notified is true if a start notification was sent for the
+	// current batch of fetches, so a finish notification is owed
+	// once they're all done.
+	notified bool
+	// lastNotified is when the last start notification was sent.
+	lastNotified time.Time
+}
+
+// ReadNotificationFilter decides which of the read notifications
+// fired while fetching file blocks actually get sent to the
+// Reporter, so that bulk reads (e.g., backups) don't flood UIs.
+//
+// Block fetches for the same file that overlap in time are
+// aggregated into a single pair of start and finish notifications.
+// In addition, if an aggregation interval is set, a file gets at most
+// one pair of notifications per interval.  Read notifications can
+// also be suppressed entirely for individual TLFs.  A nil
+// ReadNotificationFilter lets every notification through.
+type ReadNotificationFilter struct {
+	clocks clockGetter
+
+	lock       sync.Mutex
+	interval   time.Duration
+	suppressed map[tlf.ID]bool
+	files      map[string]*readNotificationState
+	lastPrune  time.Time
+}
+
+// NewReadNotificationFilter returns a new ReadNotificationFilter
+// with no aggregation interval and no suppressed TLFs.
+func NewReadNotificationFilter(clocks clockGetter) *ReadNotificationFilter {
+	return &ReadNotificationFilter{
+		clocks:     clocks,
+		suppressed: make(map[tlf.ID]bool),
+		files:      make(map[string]*readNotificationState),
+	}
+}
+
+// SetAggregationInterval sets the minimum time between two start
+// notifications for the same file.  0 only aggregates overlapping
+// fetches.
+func (rnf *ReadNotificationFilter) SetAggregationInterval(
+	interval time.Duration) {
+	rnf.lock.Lock()
+	defer rnf.lock.Unlock()
+	rnf.interval = interval
+}
+
+// AggregationInterval returns the current aggregation interval.
+func (rnf *ReadNotificationFilter) AggregationInterval() time.Duration {
+	if rnf == nil {
+		return 0
+	}
+	rnf.lock.Lock()
+	defer rnf.lock.Unlock()
+	return rnf.interval
+}
+
+// SetSuppressed sets whether read notifications for files in the
+// given TLF are suppressed.
+func (rnf *ReadNotificationFilter) SetSuppressed(
+	tlfID tlf.ID, suppressed bool) {
+	rnf.lock.Lock()
+	defer rnf.lock.Unlock()
+	if suppressed {
+		rnf.suppressed[tlfID] = true
+	} else {
+		delete(rnf.suppressed, tlfID)
+	}
+}
+
+// IsSuppressed returns true if read notifications for files in the
+// given TLF are suppressed.
+func (rnf *ReadNotificationFilter) IsSuppressed(tlfID tlf.ID) bool {
+	if rnf == nil {
+		return false
+	}
+	rnf.lock.Lock()
+	defer rnf.lock.Unlock()
+	return rnf.suppressed[tlfID]
+}
+
+// pruneLocked forgets about files that have no fetches in flight,
+// and whose aggregation interval has passed.
+func (rnf *ReadNotificationFilter) pruneLocked(now time.Time) {
+	if now.Sub(rnf.lastPrune) < rnf.interval {
+		return
+	}
+	for key, state := range rnf.files {
+		if state.inFlight == 0 &&
+			now.Sub(state.lastNotified) >= rnf.interval {
+			delete(rnf.files, key)
+		}
+	}
+	rnf.lastPrune = now
+}
+
+// startRead records that a block fetch for `file` is starting, and
+// returns true if a start notification should be sent for it.  Every
+// call must be followed by a call to `finishRead`.
+func (rnf *ReadNotificationFilter) startRead(file path) bool {
+	if rnf == nil {
+		return true
+	}
+	rnf.lock.Lock()
+	defer rnf.lock.Unlock()
+	now := rnf.clocks.Clock().Now()
+	rnf.pruneLocked(now)
+	key := file.CanonicalPathString()
+	state, ok := rnf.files[key]
+	if !ok {
+		state = &readNotificationState{}
+		rnf.files[key] = state
+	}
+	state.inFlight++
+	if state.inFlight > 1 {
+		// Aggregate into the fetches already in flight.
+		return false
+	}
+	if rnf.suppressed[file.Tlf] || (!state.lastNotified.IsZero() &&
+		now.Sub(state.lastNotified) < rnf.interval) {
+		state.notified = false
+		return false
+	}
+	state.notified = true
+	state.lastNotified = now
+	return true
+}
+
+// finishRead records that a block fetch for `file` has finished, and
+// returns true if a finish notification should be sent for it.
+func (rnf *ReadNotificationFilter) finishRead(file path) bool {
+	if rnf == nil {
+		return true
+	}
+	rnf.lock.Lock()
+	defer rnf.lock.Unlock()
+	key := file.CanonicalPathString()
+	state, ok := rnf.files[key]
+	if !ok {
+		return false
+	}
+	state.inFlight--
+	if state.inFlight > 0 {
+		return false
+	}
+	if rnf.interval == 0 {
+		delete(rnf.files, key)
+	}
+	return state.notified
+}
@@ -0,0 +1,69 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadNotificationFilter(t *testing.T) {
+	cg := newTestClockGetter()
+	clock := cg.TestClock()
+	now := clock.Now()
+	rnf := NewReadNotificationFilter(cg)
+
+	id := tlf.FakeID(1, tlf.Private)
+	makePath := func(id tlf.ID, name string) path {
+		return path{
+			FolderBranch{Tlf: id},
+			[]pathNode{{Name: "u1"}, {Name: name}},
+		}
+	}
+	a := makePath(id, "a")
+	b := makePath(id, "b")
+
+	t.Log("Overlapping reads of one file share a notification pair")
+	require.True(t, rnf.startRead(a))
+	require.False(t, rnf.startRead(a))
+	require.True(t, rnf.startRead(b))
+	require.False(t, rnf.finishRead(a))
+	require.True(t, rnf.finishRead(a))
+	require.True(t, rnf.finishRead(b))
+
+	t.Log("With no interval, later reads notify again")
+	require.True(t, rnf.startRead(a))
+	require.True(t, rnf.finishRead(a))
+
+	t.Log("With an interval, a file notifies at most once per interval")
+	rnf.SetAggregationInterval(time.Minute)
+	require.True(t, rnf.startRead(a))
+	require.True(t, rnf.finishRead(a))
+	clock.Set(now.Add(30 * time.Second))
+	require.False(t, rnf.startRead(a))
+	require.False(t, rnf.finishRead(a))
+	clock.Set(now.Add(time.Minute))
+	require.True(t, rnf.startRead(a))
+	require.True(t, rnf.finishRead(a))
+
+	t.Log("Suppressed TLFs never notify")
+	id2 := tlf.FakeID(2, tlf.Private)
+	c := makePath(id2, "c")
+	rnf.SetSuppressed(id2, true)
+	require.True(t, rnf.IsSuppressed(id2))
+	require.False(t, rnf.startRead(c))
+	require.False(t, rnf.finishRead(c))
+	rnf.SetSuppressed(id2, false)
+	require.True(t, rnf.startRead(c))
+	require.True(t, rnf.finishRead(c))
+
+	t.Log("A nil filter lets everything through")
+	var nilFilter *ReadNotificationFilter
+	require.True(t, nilFilter.startRead(a))
+	require.True(t, nilFilter.finishRead(a))
+}
@@ -0,0 +1,62 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// ReadSnapshot is a read-only view of a TLF, pinned at the revision
+// that was current when it was begun.  Reads through it never see
+// revisions that arrive later, so a tool walking the whole tree
+// (e.g., tar) gets a consistent copy even while others are writing.
+type ReadSnapshot struct {
+	// Revision is the revision the view is pinned at.
+	Revision kbfsmd.Revision
+	// Root is the root node of the pinned view.  It, and every node
+	// looked up from it, is on an archive branch of the TLF (see
+	// `MakeRevBranchName`), and can be passed to the usual KBFSOps
+	// read methods.
+	Root Node
+}
+
+// BeginReadSnapshot pins a view of the TLF for `h` at its current
+// revision.  Local writes that haven't been synced yet aren't part
+// of the view, so callers that need them should call SyncAll first.
+// The view stays readable until its revision is garbage-collected.
+func BeginReadSnapshot(
+	ctx context.Context, config Config, h *TlfHandle) (*ReadSnapshot, error) {
+	kbfsOps := config.KBFSOps()
+	root, _, err := kbfsOps.GetRootNode(ctx, h, MasterBranch)
+	if err != nil {
+		return nil, err
+	}
+	if root == nil {
+		return nil, errors.Errorf("%s doesn't exist", h.GetCanonicalPath())
+	}
+
+	status, _, err := kbfsOps.FolderStatus(ctx, root.GetFolderBranch())
+	if err != nil {
+		return nil, err
+	}
+	if status.Staged {
+		// Archive branches can only be made from merged revisions.
+		return nil, errors.Errorf(
+			"Can't snapshot %s while it has unmerged changes",
+			h.GetCanonicalPath())
+	}
+
+	snapRoot, _, err := kbfsOps.GetRootNode(
+		ctx, h, MakeRevBranchName(status.Revision))
+	if err != nil {
+		return nil, err
+	}
+	return &ReadSnapshot{
+		Revision: status.Revision,
+		Root:     snapRoot,
+	}, nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	kbname "github.com/keybase/client/go/kbun"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadSnapshot(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	h, err := kbfsOps.GetTLFHandle(ctx, rootNode)
+	require.NoError(t, err)
+	readAll := func(n Node) []byte {
+		buf := make([]byte, 10)
+		nRead, err := kbfsOps.Read(ctx, n, buf, 0)
+		require.NoError(t, err)
+		return buf[:nRead]
+	}
+
+	t.Log("Sync a file, and begin a snapshot")
+	aNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, aNode, []byte{1}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	snap, err := BeginReadSnapshot(ctx, config, h)
+	require.NoError(t, err)
+	status, _, err := kbfsOps.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, status.Revision, snap.Revision)
+
+	t.Log("Later revisions don't show up in the snapshot")
+	err = kbfsOps.Write(ctx, aNode, []byte{2}, 0)
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	snapA, _, err := kbfsOps.Lookup(ctx, snap.Root, "a")
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, readAll(snapA))
+	_, _, err = kbfsOps.Lookup(ctx, snap.Root, "b")
+	require.IsType(t, NoSuchNameError{}, errors.Cause(err))
+	require.Equal(t, []byte{2}, readAll(aNode))
+
+	t.Log("The snapshot is read-only")
+	err = kbfsOps.Write(ctx, snapA, []byte{3}, 0)
+	require.IsType(t, WriteToReadonlyNodeError{}, errors.Cause(err))
+}
@@ -5,6 +5,7 @@
 package libkbfs
 
 import (
+	"container/heap"
 	"sync"
 
 	"github.com/keybase/client/go/logger"
@@ -34,21 +35,84 @@ import (
 // access to the key yet) the existing MD revision while setting the rekey bit
 // in the flag.
 
+// TLFs are rekeyed in order of how recently they were last used on
+// this device, so that after a device revocation or a team member
+// removal, the folders the user is actually working in are secured
+// first.  TLFs that haven't been used since this process started are
+// rekeyed in the order they were enqueued.
+
 const (
 	numConcurrentRekeys            = 64
 	rekeysPerSecond     rate.Limit = 16
 )
 
+// rekeyQueueEntry is a TLF waiting to be rekeyed.
+type rekeyQueueEntry struct {
+	id tlf.ID
+	// lastUsed orders the entries; higher values are rekeyed first.
+	lastUsed uint64
+	// seq breaks ties in the order of enqueueing.
+	seq uint64
+}
+
+// rekeyQueueHeap implements heap.Interface, with the most recently
+// used TLF at the top.
+type rekeyQueueHeap []rekeyQueueEntry
+
+func (h rekeyQueueHeap) Len() int { return len(h) }
+
+func (h rekeyQueueHeap) Less(i, j int) bool {
+	if h[i].lastUsed != h[j].lastUsed {
+		return h[i].lastUsed > h[j].lastUsed
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h rekeyQueueHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *rekeyQueueHeap) Push(x interface{}) {
+	*h = append(*h, x.(rekeyQueueEntry))
+}
+
+func (h *rekeyQueueHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	*h = old[:n-1]
+	return e
+}
+
+// RekeyQueueStatus describes the progress of the current batch of
+// rekeys.  A batch starts when a TLF is enqueued to an idle queue.
+type RekeyQueueStatus struct {
+	// Pending is the number of TLFs still waiting to be rekeyed.
+	Pending int
+	// Queued is the number of TLFs enqueued during this batch.
+	Queued int
+	// Started is the number of TLFs from this batch handed off for
+	// rekeying so far.
+	Started int
+	// Dropped is the number of TLFs turned away during this batch
+	// because the queue was full.
+	Dropped int
+	// RekeysPerSecond is the current rate limit.
+	RekeysPerSecond float64
+}
+
 // RekeyQueueStandard implements the RekeyQueue interface.
 type RekeyQueueStandard struct {
 	config  Config
 	log     logger.Logger
-	queue   chan tlf.ID
 	limiter *rate.Limiter
 	cancel  context.CancelFunc
+	// wakeCh is signaled whenever a TLF is enqueued.
+	wakeCh chan struct{}
 
 	mu       sync.RWMutex // guards everything below
 	pendings map[tlf.ID]bool
+	queue    rekeyQueueHeap
+	nextSeq  uint64
+	status   RekeyQueueStatus
 }
 
 // Test that RekeyQueueStandard fully implements the RekeyQueue interface.
@@ -60,8 +124,8 @@ func NewRekeyQueueStandard(config Config) (rkq *RekeyQueueStandard) {
 	rkq = &RekeyQueueStandard{
 		config:   config,
 		log:      config.MakeLogger("RQ"),
-		queue:    make(chan tlf.ID, config.Mode().RekeyQueueSize()),
 		limiter:  rate.NewLimiter(rekeysPerSecond, numConcurrentRekeys),
+		wakeCh:   make(chan struct{}, 1),
 		pendings: make(map[tlf.ID]bool),
 		cancel:   cancel,
 	}
@@ -71,43 +135,88 @@ func NewRekeyQueueStandard(config Config) (rkq *RekeyQueueStandard) {
 	return rkq
 }
 
+// next pops the highest-priority TLF off the queue, if there is one.
+func (rkq *RekeyQueueStandard) next() (id tlf.ID, ok bool) {
+	rkq.mu.Lock()
+	defer rkq.mu.Unlock()
+	if rkq.queue.Len() == 0 {
+		return tlf.NullID, false
+	}
+	return heap.Pop(&rkq.queue).(rekeyQueueEntry).id, true
+}
+
+// dispatched records that the rekey of `id` has been handed off.
+func (rkq *RekeyQueueStandard) dispatched(id tlf.ID) {
+	rkq.mu.Lock()
+	defer rkq.mu.Unlock()
+	delete(rkq.pendings, id)
+	rkq.status.Started++
+	if rkq.queue.Len() == 0 {
+		rkq.log.Debug("Finished rekey batch: %d rekeyed, %d dropped",
+			rkq.status.Started, rkq.status.Dropped)
+	} else if rkq.status.Started%numConcurrentRekeys == 0 {
+		rkq.log.Debug("Rekey progress: %d/%d",
+			rkq.status.Started, rkq.status.Queued)
+	}
+}
+
 // start spawns a goroutine that dispatches rekey requests to correct folder
 // branch ops while conforming to the rater limiter.
 func (rkq *RekeyQueueStandard) start(ctx context.Context) {
 	go func() {
 		for {
-			select {
-			case id := <-rkq.queue:
-				if err := rkq.limiter.Wait(ctx); err != nil {
-					rkq.log.Debug("Waiting on rate limiter for tlf=%v error: %v", id, err)
+			id, ok := rkq.next()
+			if !ok {
+				select {
+				case <-rkq.wakeCh:
+					continue
+				case err := <-ctx.Done():
+					rkq.log.Debug("Rekey queue background routine context done: %v", err)
 					return
 				}
-				rkq.config.KBFSOps().RequestRekey(context.Background(), id)
-				func(id tlf.ID) {
-					rkq.mu.Lock()
-					defer rkq.mu.Unlock()
-					delete(rkq.pendings, id)
-				}(id)
-			case err := <-ctx.Done():
-				rkq.log.Debug("Rekey queue background routine context done: %v", err)
+			}
+			if err := rkq.limiter.Wait(ctx); err != nil {
+				rkq.log.Debug("Waiting on rate limiter for tlf=%v error: %v", id, err)
 				return
 			}
+			rkq.config.KBFSOps().RequestRekey(context.Background(), id)
+			rkq.dispatched(id)
 		}
 	}()
 }
 
 // Enqueue implements the RekeyQueue interface for RekeyQueueStandard.
 func (rkq *RekeyQueueStandard) Enqueue(id tlf.ID) {
+	var lastUsed uint64
+	if kbfsOps, ok := standardKBFSOps(rkq.config.KBFSOps()); ok {
+		lastUsed = kbfsOps.tlfLastUsed(id)
+	}
+
 	rkq.mu.Lock()
 	defer rkq.mu.Unlock()
-	rkq.pendings[id] = true
-
-	select {
-	case rkq.queue <- id:
-	default:
+	if rkq.pendings[id] {
+		return
+	}
+	if rkq.queue.Len() == 0 &&
+		rkq.status.Started >= rkq.status.Queued {
+		// The queue is idle, so start a new batch.
+		rkq.status = RekeyQueueStatus{}
+	}
+	if rkq.queue.Len() >= rkq.config.Mode().RekeyQueueSize() {
 		// The queue is full; drop this one for now until the next
 		// request to the server for more rekeys.
 		rkq.log.Debug("Rekey queue is full; dropping %s", id)
+		rkq.status.Dropped++
+		return
+	}
+
+	rkq.pendings[id] = true
+	heap.Push(&rkq.queue, rekeyQueueEntry{id, lastUsed, rkq.nextSeq})
+	rkq.nextSeq++
+	rkq.status.Queued++
+	select {
+	case rkq.wakeCh <- struct{}{}:
+	default:
 	}
 }
 
@@ -118,6 +227,26 @@ func (rkq *RekeyQueueStandard) IsRekeyPending(id tlf.ID) bool {
 	return rkq.pendings[id]
 }
 
+// SetRateLimit changes how many rekeys may be started per second.
+func (rkq *RekeyQueueStandard) SetRateLimit(perSecond rate.Limit) {
+	rkq.limiter.SetLimit(perSecond)
+}
+
+// RateLimit returns how many rekeys may be started per second.
+func (rkq *RekeyQueueStandard) RateLimit() rate.Limit {
+	return rkq.limiter.Limit()
+}
+
+// Status returns the progress of the current batch of rekeys.
+func (rkq *RekeyQueueStandard) Status() RekeyQueueStatus {
+	rkq.mu.RLock()
+	defer rkq.mu.RUnlock()
+	status := rkq.status
+	status.Pending = rkq.queue.Len()
+	status.RekeysPerSecond = float64(rkq.limiter.Limit())
+	return status
+}
+
 // Shutdown implements the RekeyQueue interface for RekeyQueueStandard.
 func (rkq *RekeyQueueStandard) Shutdown() {
 	rkq.mu.Lock()
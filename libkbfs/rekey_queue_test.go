@@ -10,7 +10,9 @@ import (
 
 	kbname "github.com/keybase/client/go/kbun"
 	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
 )
 
 func TestRekeyQueueBasic(t *testing.T) {
@@ -109,3 +111,54 @@ func TestRekeyQueueBasic(t *testing.T) {
 		_ = GetRootNodeOrBust(ctx, t, config2Dev2, name, tlf.Private)
 	}
 }
+
+func TestRekeyQueuePriority(t *testing.T) {
+	ctx := BackgroundContextWithCancellationDelayer()
+	defer CleanupCancellationDelayer(ctx)
+	config := MakeTestConfigOrBust(t, "u1")
+	defer CheckConfigAndShutdown(ctx, t, config)
+
+	privRoot := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	pubRoot := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Public)
+	privID := privRoot.GetFolderBranch().Tlf
+	pubID := pubRoot.GetFolderBranch().Tlf
+	unusedID := tlf.FakeID(1, tlf.Private)
+
+	// Use the private TLF again so it's the most recent.
+	_, err := config.KBFSOps().GetDirChildren(ctx, privRoot)
+	require.NoError(t, err)
+
+	// Don't start the background routine, so the order can be
+	// checked directly.
+	rkq := &RekeyQueueStandard{
+		config:   config,
+		log:      config.MakeLogger("RQ"),
+		limiter:  rate.NewLimiter(rekeysPerSecond, numConcurrentRekeys),
+		wakeCh:   make(chan struct{}, 1),
+		pendings: make(map[tlf.ID]bool),
+	}
+	rkq.Enqueue(unusedID)
+	rkq.Enqueue(pubID)
+	rkq.Enqueue(privID)
+	rkq.Enqueue(pubID)
+	require.True(t, rkq.IsRekeyPending(pubID))
+	status := rkq.Status()
+	require.Equal(t, 3, status.Pending)
+	require.Equal(t, 3, status.Queued)
+
+	rkq.SetRateLimit(2)
+	require.Equal(t, float64(2), rkq.Status().RekeysPerSecond)
+
+	for _, expected := range []tlf.ID{privID, pubID, unusedID} {
+		id, ok := rkq.next()
+		require.True(t, ok)
+		require.Equal(t, expected, id)
+		rkq.dispatched(id)
+	}
+	_, ok := rkq.next()
+	require.False(t, ok)
+	require.False(t, rkq.IsRekeyPending(pubID))
+	status = rkq.Status()
+	require.Equal(t, 0, status.Pending)
+	require.Equal(t, 3, status.Started)
+}
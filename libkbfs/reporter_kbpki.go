@@ -35,6 +35,9 @@ const (
 	errorParamFolderLimit         = "folderLimit"
 	errorParamApplicationExecPath = "applicationExecPath"
 
+	// notification param keys
+	notifyParamBlockTier = "blockTier"
+
 	// error operation modes
 	errorModeRead  = "read"
 	errorModeWrite = "write"
@@ -150,7 +153,7 @@ func (r *ReporterKBPKI) ReportErr(ctx context.Context,
 	case FileTooBigForCRError:
 		code = keybase1.FSErrorType_NOT_IMPLEMENTED
 		params[errorParamFeature] = errorFeatureFileLimit
-	case DirTooBigError:
+	case DirTooBigError, DirTooManyEntriesError:
 		code = keybase1.FSErrorType_NOT_IMPLEMENTED
 		params[errorParamFeature] = errorFeatureDirLimit
 	case kbfsmd.NewMetadataVersionError:
@@ -330,13 +333,18 @@ func writeNotification(file path, finish bool) *keybase1.FSNotification {
 
 // readNotification creates FSNotifications from paths for file
 // read events.
-func readNotification(file path, finish bool) *keybase1.FSNotification {
+func readNotification(
+	file path, finish bool, tier BlockTier) *keybase1.FSNotification {
 	n := baseNotification(file, finish)
 	if file.Tlf.Type() == tlf.Public {
 		n.NotificationType = keybase1.FSNotificationType_VERIFYING
 	} else {
 		n.NotificationType = keybase1.FSNotificationType_DECRYPTING
 	}
+	if tier != HotBlockTier {
+		// Let the UI show that this read may take a while.
+		n.Params = map[string]string{notifyParamBlockTier: tier.String()}
+	}
 	return n
 }
 
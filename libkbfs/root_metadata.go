@@ -36,6 +36,10 @@ type PrivateMetadata struct {
 	// was performed on this TLF.
 	LastGCRevision kbfsmd.Revision `codec:"lgc"`
 
+	// The block size chosen for the file data of this TLF, or 0 for
+	// the default size.
+	BlockSize int64 `codec:"bs,omitempty"`
+
 	codec.UnknownFieldSetHandler
 
 	// When the above Changes field gets unembedded into its own
@@ -163,6 +163,7 @@ func makeFakePrivateMetadataFuture(t *testing.T) privateMetadataFuture {
 				0,
 			},
 			0,
+			0,
 			codec.UnknownFieldSetHandler{},
 			BlockChanges{},
 		},
@@ -0,0 +1,212 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/env"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// scratchKeybaseService wraps the KeybaseService of the config that
+// owns a scratch folder.  It passes through user and key lookups,
+// but keeps everything that would make the scratch folder visible
+// outside of this process (favorites, notifications, team TLF
+// registration) from reaching the service.
+type scratchKeybaseService struct {
+	KeybaseService
+}
+
+var _ KeybaseService = scratchKeybaseService{}
+
+// ResolveIdentifyImplicitTeam implements the KeybaseService interface
+// for scratchKeybaseService.  Scratch folders always use classic
+// handles, so that looking one up never creates or reuses an
+// implicit team on the server.
+func (sks scratchKeybaseService) ResolveIdentifyImplicitTeam(
+	_ context.Context, assertions, suffix string, _ tlf.Type, _ bool,
+	_ string) (ImplicitTeamInfo, error) {
+	return ImplicitTeamInfo{}, errors.Errorf(
+		"No implicit team %s%s for a scratch folder", assertions, suffix)
+}
+
+// CreateTeamTLF implements the KeybaseService interface for
+// scratchKeybaseService.
+func (sks scratchKeybaseService) CreateTeamTLF(
+	_ context.Context, teamID keybase1.TeamID, _ tlf.ID) error {
+	return errors.Errorf(
+		"Can't associate a scratch folder with team %s", teamID)
+}
+
+// PutGitMetadata implements the KeybaseService interface for
+// scratchKeybaseService.
+func (sks scratchKeybaseService) PutGitMetadata(
+	_ context.Context, _ keybase1.Folder, _ keybase1.RepoID,
+	_ keybase1.GitLocalMetadata) error {
+	return nil
+}
+
+// FavoriteAdd implements the KeybaseService interface for
+// scratchKeybaseService.
+func (sks scratchKeybaseService) FavoriteAdd(
+	_ context.Context, _ keybase1.Folder) error {
+	return nil
+}
+
+// FavoriteDelete implements the KeybaseService interface for
+// scratchKeybaseService.
+func (sks scratchKeybaseService) FavoriteDelete(
+	_ context.Context, _ keybase1.Folder) error {
+	return nil
+}
+
+// FavoriteList implements the KeybaseService interface for
+// scratchKeybaseService.
+func (sks scratchKeybaseService) FavoriteList(
+	_ context.Context, _ int) ([]keybase1.Folder, error) {
+	return nil, nil
+}
+
+// Notify implements the KeybaseService interface for
+// scratchKeybaseService.
+func (sks scratchKeybaseService) Notify(
+	_ context.Context, _ *keybase1.FSNotification) error {
+	return nil
+}
+
+// NotifyPathUpdated implements the KeybaseService interface for
+// scratchKeybaseService.
+func (sks scratchKeybaseService) NotifyPathUpdated(
+	_ context.Context, _ string) error {
+	return nil
+}
+
+// NotifySyncStatus implements the KeybaseService interface for
+// scratchKeybaseService.
+func (sks scratchKeybaseService) NotifySyncStatus(
+	_ context.Context, _ *keybase1.FSPathSyncStatus) error {
+	return nil
+}
+
+// Shutdown implements the KeybaseService interface for
+// scratchKeybaseService.  The wrapped service belongs to the parent
+// config, so it is left running.
+func (sks scratchKeybaseService) Shutdown() {}
+
+// scratchCrypto wraps the Crypto of the config that owns a scratch
+// folder, so that shutting down the scratch folder leaves it running.
+type scratchCrypto struct {
+	Crypto
+}
+
+// Shutdown implements the Crypto interface for scratchCrypto.
+func (sc scratchCrypto) Shutdown() {}
+
+// ScratchFolder is a local-only, private TLF for the current user.
+// It has the full KBFS semantics of a regular TLF (all of its blocks
+// and metadata are encrypted and signed as usual), but its blocks,
+// metadata and keys live only in memory, and are never sent to the
+// servers.  Everything in it is discarded on `Shutdown`, which the
+// caller must call when the folder is unmounted.  It's useful for
+// staging data before copying it into a real TLF.
+type ScratchFolder struct {
+	config *ConfigLocal
+	root   Node
+}
+
+// NewScratchFolder creates a new, empty scratch folder for the user
+// logged into `config`.  The scratch folder shares the user's
+// identity and device keys with `config`, but nothing else.
+func NewScratchFolder(ctx context.Context, config Config) (
+	sf *ScratchFolder, err error) {
+	c := NewConfigLocal(
+		modeScratch{config.Mode()}, config.MakeLogger, "", DiskCacheModeOff,
+		nil)
+	c.SetClock(config.Clock())
+	c.SetMetadataVersion(config.MetadataVersion())
+
+	bsplitter, err := NewBlockSplitterSimple(
+		MaxBlockSizeBytesDefault, 8*1024, c.Codec())
+	if err != nil {
+		return nil, err
+	}
+	c.SetBlockSplitter(bsplitter)
+
+	// Blocks, metadata and keys all stay in memory.
+	mdServer, err := NewMDServerMemory(mdServerLocalConfigAdapter{c})
+	if err != nil {
+		return nil, err
+	}
+	c.SetMDServer(mdServer)
+	keyServer, err := NewKeyServerMemory(mdServerLocalConfigAdapter{c})
+	if err != nil {
+		return nil, err
+	}
+	c.SetKeyServer(keyServer)
+	c.SetBlockServer(NewBlockServerMemory(c.MakeLogger("BSM")))
+
+	c.SetKeybaseService(scratchKeybaseService{config.KeybaseService()})
+	c.SetCrypto(scratchCrypto{config.Crypto()})
+	c.SetChat(config.Chat())
+	c.SetKBPKI(NewKBPKIClient(c, c.MakeLogger("")))
+
+	c.SetBlockOps(NewBlockOpsStandard(
+		c, c.Mode().BlockWorkers(), c.Mode().PrefetchWorkers()))
+	kbfsOps := NewKBFSOpsStandard(env.EmptyAppStateUpdater{}, c)
+	c.SetKBFSOps(kbfsOps)
+	c.SetNotifier(kbfsOps)
+	c.SetKeyManager(NewKeyManagerStandard(c))
+	c.SetMDOps(NewMDOpsStandard(c))
+
+	defer func() {
+		if err != nil {
+			shutdownErr := c.Shutdown(ctx)
+			if shutdownErr != nil {
+				c.MakeLogger("").CDebugf(
+					ctx, "Couldn't shut down scratch folder: %+v",
+					shutdownErr)
+			}
+		}
+	}()
+
+	session, err := c.KBPKI().GetCurrentSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	h, err := ParseTlfHandle(
+		ctx, c.KBPKI(), c.MDOps(), string(session.Name), tlf.Private)
+	if err != nil {
+		return nil, err
+	}
+	root, _, err := kbfsOps.GetOrCreateRootNode(ctx, h, MasterBranch)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ScratchFolder{config: c, root: root}, nil
+}
+
+// Config returns the config backing this scratch folder.
+func (sf *ScratchFolder) Config() Config {
+	return sf.config
+}
+
+// KBFSOps returns the KBFSOps instance that must be used for all
+// operations on this scratch folder.
+func (sf *ScratchFolder) KBFSOps() KBFSOps {
+	return sf.config.KBFSOps()
+}
+
+// Root returns the root node of this scratch folder.
+func (sf *ScratchFolder) Root() Node {
+	return sf.root
+}
+
+// Shutdown discards this scratch folder and everything in it.
+func (sf *ScratchFolder) Shutdown(ctx context.Context) error {
+	return sf.config.Shutdown(ctx)
+}
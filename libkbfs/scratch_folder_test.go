@@ -0,0 +1,53 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScratchFolder(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	t.Log("Write a file into a scratch folder and read it back")
+	sf, err := NewScratchFolder(ctx, config)
+	require.NoError(t, err)
+	kbfsOps := sf.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, sf.Root(), "a", false, NoExcl)
+	require.NoError(t, err)
+	data := []byte{1, 2, 3, 4, 5}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, sf.Root().GetFolderBranch())
+	require.NoError(t, err)
+	gotData := make([]byte, len(data))
+	n, err := kbfsOps.Read(ctx, fileNode, gotData, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, gotData)
+
+	t.Log("Nothing reached the real servers")
+	tlfID := sf.Root().GetFolderBranch().Tlf
+	rmds, err := config.MDServer().GetForTLF(
+		ctx, tlfID, kbfsmd.NullBranchID, kbfsmd.Merged, nil)
+	require.NoError(t, err)
+	require.Nil(t, rmds)
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	require.NotEqual(t, tlfID, rootNode.GetFolderBranch().Tlf)
+	children, err := config.KBFSOps().GetDirChildren(ctx, rootNode)
+	require.NoError(t, err)
+	require.Len(t, children, 0)
+
+	t.Log("Shutting down the scratch folder leaves the parent running")
+	err = sf.Shutdown(ctx)
+	require.NoError(t, err)
+	_, err = config.KBPKI().GetCurrentSession(ctx)
+	require.NoError(t, err)
+}
@@ -0,0 +1,578 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"mime"
+	"net/http"
+	pathpkg "path"
+	"strconv"
+	"time"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// shareLinkBlockSize is the most plaintext put in each block of a
+// share link.
+const shareLinkBlockSize = 512 * 1024
+
+// shareLinksDirName is the directory, at the root of a TLF, holding
+// a record of each share link minted for one of the TLF's files, so
+// that any writer can list and revoke them.
+const shareLinksDirName = ".kbfs_share_links"
+
+// shareLinkIDPrefix is hashed along with the key of a share link to
+// make its ID.
+const shareLinkIDPrefix = "Keybase-KBFS-Share-Link-ID-1"
+
+// shareLinkSigPrefix keeps share link record signatures from being
+// valid in any other context.
+const shareLinkSigPrefix = "kbfs-share-link-v1"
+
+// ShareLinkBlock is one block of the copy of a file made for a share
+// link.
+type ShareLinkBlock struct {
+	ID      kbfsblock.ID
+	Context kbfsblock.Context
+	// Off is the offset in the file of the block's first byte.
+	Off int64
+	// EncodedSize is the size of the block on the block server.
+	EncodedSize uint32
+}
+
+// ShareLinkCapability lets whoever holds it read one file, as it was
+// when the capability was minted, from the block server.
+//
+// The file's own blocks can't be handed out: each block key is its
+// server half masked with the TLF crypt key, so anyone who could
+// fetch a block along with its key could recover the TLF key.
+// Instead, minting a capability stores a copy of the file in new
+// blocks of the same TLF, keyed the same way but by a fresh random
+// key made only for that copy.  Holding the capability reveals
+// nothing about the TLF key or the rest of the TLF.  The copy isn't
+// part of any file of the TLF, so it doesn't change when the file
+// does, and it isn't counted in the TLF's usage; the block server
+// charges it to the quota of the user who minted it.  Instead, a
+// ShareLink record of it, signed by that user and without its key,
+// is kept in the TLF under shareLinksDirName.  Once the removal of
+// that record, with RevokeShareLink or otherwise, is synced, the
+// copy's references are removed from the block server, and the
+// capability can no longer be redeemed.  A ShareLinkGateway redeems
+// capabilities.
+type ShareLinkCapability struct {
+	// ID names the capability's record in the TLF.  It's derived
+	// from Key; see makeShareLinkID.
+	ID    string
+	TlfID tlf.ID
+	Name  string
+	Size  uint64
+	// Key plays the part of the TLF crypt key for the blocks of the
+	// copy: each of their keys is their server half masked with it.
+	Key    kbfscrypto.TLFCryptKey
+	Blocks []ShareLinkBlock
+}
+
+// ShareLink is the record of a share link kept in its TLF.  It has
+// everything needed to revoke the link and reclaim its blocks, but
+// not the key needed to read them.
+type ShareLink struct {
+	ID    string
+	TlfID tlf.ID
+	// Minter is the user who minted the link, and who created each
+	// of its blocks.
+	Minter keybase1.UID
+	Name   string
+	Size   uint64
+	Blocks []ShareLinkBlock
+}
+
+// signedShareLink is what's stored in a share link record.  Any
+// writer can write the records, so one is only honored if it's
+// signed by a device of the link's minter.
+type signedShareLink struct {
+	Link ShareLink
+	Sig  kbfscrypto.SignatureInfo
+}
+
+func shareLinkSigMsg(codec kbfscodec.Codec, link ShareLink) ([]byte, error) {
+	buf, err := codec.Encode(link)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(shareLinkSigPrefix+":"), buf...), nil
+}
+
+// makeShareLinkID returns the ID of the share link whose copy is
+// keyed by `key`.  It's a hash of the key, so that it can be
+// recorded in the TLF without revealing the key.
+func makeShareLinkID(key kbfscrypto.TLFCryptKey) string {
+	data := key.Data()
+	h := sha256.New()
+	_, _ = h.Write([]byte(shareLinkIDPrefix))
+	_, _ = h.Write(data[:])
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// decodeShareLink decodes the share link record named `name` in the
+// TLF `tlfID`, and makes sure it was signed by a device of the link's
+// minter, for that name and TLF, and that each block of the link's
+// copy was first put to the block server by the minter.
+func decodeShareLink(ctx context.Context, config Config, tlfID tlf.ID,
+	name string, buf []byte) (ShareLink, error) {
+	var signed signedShareLink
+	err := config.Codec().Decode(buf, &signed)
+	if err != nil {
+		return ShareLink{}, err
+	}
+	link := signed.Link
+	msg, err := shareLinkSigMsg(config.Codec(), link)
+	if err != nil {
+		return ShareLink{}, err
+	}
+	err = kbfscrypto.Verify(msg, signed.Sig)
+	if err != nil {
+		return ShareLink{}, err
+	}
+	err = config.KBPKI().HasVerifyingKey(
+		ctx, link.Minter, signed.Sig.VerifyingKey, time.Time{})
+	if err != nil {
+		return ShareLink{}, err
+	}
+
+	if link.TlfID != tlfID {
+		return ShareLink{}, errors.Errorf(
+			"Share link %s is for TLF %s, not %s", link.ID, link.TlfID, tlfID)
+	}
+	if link.ID != name {
+		return ShareLink{}, errors.Errorf(
+			"Share link %s is recorded as %s", link.ID, name)
+	}
+	minter := link.Minter.AsUserOrTeam()
+	for _, b := range link.Blocks {
+		if b.Context.GetCreator() != minter ||
+			b.Context.GetRefNonce() != kbfsblock.ZeroRefNonce {
+			return ShareLink{}, errors.Errorf(
+				"Block %v of share link %s has context %v, which its "+
+					"minter %s didn't create", b.ID, link.ID, b.Context,
+				link.Minter)
+		}
+	}
+	return link, nil
+}
+
+// getShareLinksDir returns the node of the share link records of the
+// TLF with root `rootNode`, creating it if `create` is true.  If it
+// doesn't exist and `create` is false, it returns nil.
+func getShareLinksDir(ctx context.Context, config Config, rootNode Node,
+	create bool) (Node, error) {
+	dir, _, err := config.KBFSOps().Lookup(ctx, rootNode, shareLinksDirName)
+	switch errors.Cause(err).(type) {
+	case nil:
+		return dir, nil
+	case NoSuchNameError:
+		if !create {
+			return nil, nil
+		}
+		// Like the git repos, the records live under a name users
+		// can't create.
+		ctx = context.WithValue(ctx, CtxAllowNameKey, shareLinksDirName)
+		dir, _, err = config.KBFSOps().CreateDir(
+			ctx, rootNode, shareLinksDirName)
+		return dir, err
+	default:
+		return nil, err
+	}
+}
+
+// recordShareLink saves a signed record of `link` in the TLF of
+// `file`.
+func recordShareLink(ctx context.Context, config Config, file Node,
+	link ShareLink) error {
+	h, err := config.KBFSOps().GetTLFHandle(ctx, file)
+	if err != nil {
+		return err
+	}
+	rootNode, _, err := config.KBFSOps().GetRootNode(
+		ctx, h, file.GetFolderBranch().Branch)
+	if err != nil {
+		return err
+	}
+	dir, err := getShareLinksDir(ctx, config, rootNode, true)
+	if err != nil {
+		return err
+	}
+	msg, err := shareLinkSigMsg(config.Codec(), link)
+	if err != nil {
+		return err
+	}
+	sig, err := config.Crypto().Sign(ctx, msg)
+	if err != nil {
+		return err
+	}
+	buf, err := config.Codec().Encode(signedShareLink{link, sig})
+	if err != nil {
+		return err
+	}
+	record, _, err := config.KBFSOps().CreateFile(
+		ctx, dir, link.ID, false, WithExcl)
+	if err != nil {
+		return err
+	}
+	return config.KBFSOps().Write(ctx, record, buf, 0)
+}
+
+// MintShareLink copies the current contents of `file`, including
+// any unsynced writes, into new blocks, records a capability for
+// reading the copy in the file's TLF, and returns it.  The blocks are
+// charged to the current user.  The record is synced along with the
+// TLF's other changes.
+func MintShareLink(ctx context.Context, config Config, file Node) (
+	_ ShareLinkCapability, err error) {
+	ei, err := config.KBFSOps().Stat(ctx, file)
+	if err != nil {
+		return ShareLinkCapability{}, err
+	}
+	if ei.Type != File && ei.Type != Exec {
+		return ShareLinkCapability{}, errors.Errorf(
+			"%s is not a file", file.GetBasename())
+	}
+	session, err := config.KBPKI().GetCurrentSession(ctx)
+	if err != nil {
+		return ShareLinkCapability{}, err
+	}
+	key, err := kbfscrypto.MakeRandomTLFCryptKey()
+	if err != nil {
+		return ShareLinkCapability{}, err
+	}
+
+	capability := ShareLinkCapability{
+		ID:    makeShareLinkID(key),
+		TlfID: file.GetFolderBranch().Tlf,
+		Name:  file.GetBasename(),
+		Key:   key,
+	}
+	defer func() {
+		if err == nil || len(capability.Blocks) == 0 {
+			return
+		}
+		// Don't leak the blocks of a link that was never recorded.
+		_ = removeShareLinkBlocks(ctx, config, capability)
+	}()
+	crypto := config.cryptoPure()
+	buf := make([]byte, shareLinkBlockSize)
+	var off int64
+	for off < int64(ei.Size) {
+		n, err := config.KBFSOps().Read(ctx, file, buf, off)
+		if err != nil {
+			return ShareLinkCapability{}, err
+		}
+		if n == 0 {
+			// The file shrank since the Stat.
+			break
+		}
+
+		fblock := NewFileBlock().(*FileBlock)
+		fblock.Contents = append([]byte(nil), buf[:n]...)
+		serverHalf, err := crypto.MakeRandomBlockCryptKeyServerHalf()
+		if err != nil {
+			return ShareLinkCapability{}, err
+		}
+		_, encryptedBlock, err := crypto.EncryptBlock(
+			fblock, kbfscrypto.UnmaskBlockCryptKey(serverHalf, key))
+		if err != nil {
+			return ShareLinkCapability{}, err
+		}
+		encoded, err := config.Codec().Encode(encryptedBlock)
+		if err != nil {
+			return ShareLinkCapability{}, err
+		}
+		id, err := kbfsblock.MakePermanentID(encoded)
+		if err != nil {
+			return ShareLinkCapability{}, err
+		}
+		bctx := kbfsblock.MakeFirstContext(
+			session.UID.AsUserOrTeam(), keybase1.BlockType_DATA)
+		err = config.BlockServer().Put(
+			ctx, capability.TlfID, id, bctx, encoded, serverHalf)
+		if err != nil {
+			return ShareLinkCapability{}, err
+		}
+
+		capability.Blocks = append(capability.Blocks, ShareLinkBlock{
+			ID:          id,
+			Context:     bctx,
+			Off:         off,
+			EncodedSize: uint32(len(encoded)),
+		})
+		off += n
+	}
+	capability.Size = uint64(off)
+
+	err = recordShareLink(ctx, config, file, ShareLink{
+		ID:     capability.ID,
+		TlfID:  capability.TlfID,
+		Minter: session.UID,
+		Name:   capability.Name,
+		Size:   capability.Size,
+		Blocks: capability.Blocks,
+	})
+	if err != nil {
+		return ShareLinkCapability{}, err
+	}
+	return capability, nil
+}
+
+// ListShareLinks returns the records of all the share links kept in
+// the TLF with root `rootNode`.  Records that weren't signed by the
+// minter of their link are skipped.
+func ListShareLinks(ctx context.Context, config Config, rootNode Node) (
+	[]ShareLink, error) {
+	dir, err := getShareLinksDir(ctx, config, rootNode, false)
+	if err != nil {
+		return nil, err
+	}
+	if dir == nil {
+		return nil, nil
+	}
+	children, err := config.KBFSOps().GetDirChildren(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	log := config.MakeLogger("")
+	links := make([]ShareLink, 0, len(children))
+	for name, ei := range children {
+		record, _, err := config.KBFSOps().Lookup(ctx, dir, name)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, ei.Size)
+		n, err := config.KBFSOps().Read(ctx, record, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+		link, err := decodeShareLink(
+			ctx, config, rootNode.GetFolderBranch().Tlf, name, buf[:n])
+		if err != nil {
+			log.CWarningf(ctx, "Skipping share link record %s: %+v",
+				name, err)
+			continue
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+// removeShareLinkBlocks removes the blocks of a share link that was
+// never recorded.
+func removeShareLinkBlocks(ctx context.Context, config Config,
+	capability ShareLinkCapability) error {
+	contexts := make(kbfsblock.ContextMap, len(capability.Blocks))
+	for _, b := range capability.Blocks {
+		contexts[b.ID] = append(contexts[b.ID], b.Context)
+	}
+	_, err := config.BlockServer().RemoveBlockReferences(
+		ctx, capability.TlfID, contexts)
+	return err
+}
+
+// RevokeShareLink deletes the record of the share link `id` from the
+// TLF with root `rootNode`, and syncs the TLF.  That removes the
+// references to the copy of the file made for the link from the
+// block server, after which the link can no longer be redeemed.  Any
+// writer of the TLF can revoke its links, whether or not they minted
+// them.
+func RevokeShareLink(ctx context.Context, config Config, rootNode Node,
+	id string) error {
+	dir, err := getShareLinksDir(ctx, config, rootNode, false)
+	if err != nil {
+		return err
+	}
+	if dir == nil {
+		return NoSuchNameError{id}
+	}
+	err = config.KBFSOps().RemoveEntry(ctx, dir, id)
+	if err != nil {
+		return err
+	}
+	return config.KBFSOps().SyncAll(ctx, rootNode.GetFolderBranch())
+}
+
+// EncodeShareLinkCapability returns `capability` as a string that can
+// be put in a URL, for a ShareLinkGateway to redeem.
+func EncodeShareLinkCapability(codec kbfscodec.Codec,
+	capability ShareLinkCapability) (string, error) {
+	buf, err := codec.Encode(capability)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// DecodeShareLinkCapability decodes a string made by
+// EncodeShareLinkCapability.
+func DecodeShareLinkCapability(codec kbfscodec.Codec, s string) (
+	ShareLinkCapability, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return ShareLinkCapability{}, err
+	}
+	var capability ShareLinkCapability
+	err = codec.Decode(buf, &capability)
+	if err != nil {
+		return ShareLinkCapability{}, err
+	}
+	return capability, nil
+}
+
+// ShareLinkGateway redeems share link capabilities, fetching the
+// blocks of their copies from a block server and decrypting them
+// with nothing but the capability.  It never needs any TLF keys.
+//
+// The KBFS block server only serves a TLF's blocks to its readers,
+// so for now a gateway must be logged in as a reader of each TLF
+// whose links it redeems.  It only ever fetches the blocks named by
+// a capability, under the capability's own contexts, so once the
+// link is revoked the server refuses them.
+type ShareLinkGateway struct {
+	bserver BlockServer
+	codec   kbfscodec.Codec
+	crypto  cryptoPure
+}
+
+var _ http.Handler = (*ShareLinkGateway)(nil)
+
+// NewShareLinkGateway returns a gateway that fetches blocks from
+// `bserver`.
+func NewShareLinkGateway(
+	bserver BlockServer, codec kbfscodec.Codec) *ShareLinkGateway {
+	return &ShareLinkGateway{
+		bserver: bserver,
+		codec:   codec,
+		crypto:  MakeCryptoCommon(codec),
+	}
+}
+
+func (g *ShareLinkGateway) getBlock(ctx context.Context,
+	capability ShareLinkCapability, b ShareLinkBlock) (*FileBlock, error) {
+	buf, serverHalf, err := g.bserver.Get(
+		ctx, capability.TlfID, b.ID, b.Context)
+	if err != nil {
+		return nil, err
+	}
+	if err := kbfsblock.VerifyID(buf, b.ID); err != nil {
+		return nil, err
+	}
+	var encryptedBlock kbfscrypto.EncryptedBlock
+	if err := g.codec.Decode(buf, &encryptedBlock); err != nil {
+		return nil, err
+	}
+	fblock := NewFileBlock().(*FileBlock)
+	err = g.crypto.DecryptBlock(encryptedBlock,
+		kbfscrypto.UnmaskBlockCryptKey(serverHalf, capability.Key), fblock)
+	if err != nil {
+		return nil, err
+	}
+	return fblock, nil
+}
+
+// WriteTo writes the whole file of `capability` to `w`, and returns
+// the number of bytes written.
+func (g *ShareLinkGateway) WriteTo(ctx context.Context,
+	capability ShareLinkCapability, w io.Writer) (int64, error) {
+	var written int64
+	for _, b := range capability.Blocks {
+		if b.Off != written {
+			return written, errors.Errorf(
+				"Block %v of %s starts at %d, not %d",
+				b.ID, capability.Name, b.Off, written)
+		}
+		fblock, err := g.getBlock(ctx, capability, b)
+		if err != nil {
+			return written, err
+		}
+		n, err := w.Write(fblock.Contents)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	if written != int64(capability.Size) {
+		return written, errors.Errorf("%s has %d bytes, not %d",
+			capability.Name, written, capability.Size)
+	}
+	return written, nil
+}
+
+// shareLinkResponseWriter sets the headers of a redeemed file just
+// before its first byte is written, so that a capability that can't
+// be redeemed at all still gets an error status.
+type shareLinkResponseWriter struct {
+	http.ResponseWriter
+	capability  ShareLinkCapability
+	wroteHeader bool
+}
+
+func (w *shareLinkResponseWriter) writeHeader() {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	h := w.Header()
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("Content-Length", strconv.FormatUint(w.capability.Size, 10))
+	h.Set("Content-Disposition", mime.FormatMediaType(
+		"attachment", map[string]string{"filename": w.capability.Name}))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (w *shareLinkResponseWriter) Write(buf []byte) (int, error) {
+	w.writeHeader()
+	return w.ResponseWriter.Write(buf)
+}
+
+// ServeHTTP implements the http.Handler interface for
+// ShareLinkGateway.  It serves the file of the capability encoded,
+// by EncodeShareLinkCapability, in the last element of the request
+// path.
+func (g *ShareLinkGateway) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	capability, err := DecodeShareLinkCapability(
+		g.codec, pathpkg.Base(req.URL.Path))
+	if err != nil {
+		http.Error(w, "Invalid share link", http.StatusBadRequest)
+		return
+	}
+
+	sw := &shareLinkResponseWriter{ResponseWriter: w, capability: capability}
+	_, err = g.WriteTo(req.Context(), capability, sw)
+	switch {
+	case err == nil:
+		// An empty file has no blocks to trigger the headers.
+		sw.writeHeader()
+	case sw.wroteHeader:
+		// Too late for an error status; the short body shows the
+		// failure.
+	case isRecoverableBlockError(errors.Cause(err)):
+		// The link was revoked.
+		http.Error(w, "Share link not found", http.StatusNotFound)
+	default:
+		http.Error(w, "Couldn't redeem share link",
+			http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	kbname "github.com/keybase/client/go/kbun"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShareLink(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, uid, ctx, cancel := kbfsOpsInitNoMocks(t, u1)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	gateway := httptest.NewServer(
+		NewShareLinkGateway(config.BlockServer(), config.Codec()))
+	defer gateway.Close()
+
+	t.Log("Mint a link for a file spanning more than one link block")
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := make([]byte, shareLinkBlockSize+100)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	capability, err := MintShareLink(ctx, config, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, makeShareLinkID(capability.Key), capability.ID)
+	require.Equal(t, "a", capability.Name)
+	require.Equal(t, uint64(len(data)), capability.Size)
+	require.Len(t, capability.Blocks, 2)
+	for _, b := range capability.Blocks {
+		require.NotZero(t, b.EncodedSize)
+	}
+	fb := rootNode.GetFolderBranch()
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	t.Log("The link is recorded in the TLF, signed and without its key")
+	link := ShareLink{
+		ID:     capability.ID,
+		TlfID:  capability.TlfID,
+		Minter: uid,
+		Name:   capability.Name,
+		Size:   capability.Size,
+		Blocks: capability.Blocks,
+	}
+	links, err := ListShareLinks(ctx, config, rootNode)
+	require.NoError(t, err)
+	require.Equal(t, []ShareLink{link}, links)
+	linksPath := "/keybase/private/u1/" + shareLinksDirName
+	record, err := kbfsOps.ReadFileAt(ctx, linksPath+"/"+capability.ID)
+	require.NoError(t, err)
+	key := capability.Key.Data()
+	require.False(t, bytes.Contains(record, key[:]))
+
+	t.Log("The link is unaffected by later changes to the file")
+	err = kbfsOps.Write(ctx, fileNode, []byte{0, 0, 0}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	t.Log("The gateway serves the file with only the encoded capability")
+	token, err := EncodeShareLinkCapability(config.Codec(), capability)
+	require.NoError(t, err)
+	redeem := func() (int, []byte) {
+		resp, err := http.Get(gateway.URL + "/" + token)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, body
+	}
+	status, body := redeem()
+	require.Equal(t, http.StatusOK, status)
+	require.True(t, bytes.Equal(data, body))
+	resp, err := http.Get(gateway.URL + "/garbage")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	t.Log("A copy of the record is ignored, and removing it keeps the link")
+	linksNode, _, err := kbfsOps.Lookup(ctx, rootNode, shareLinksDirName)
+	require.NoError(t, err)
+	copyNode, _, err := kbfsOps.CreateFile(
+		ctx, linksNode, "copy", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, copyNode, record, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	links, err = ListShareLinks(ctx, config, rootNode)
+	require.NoError(t, err)
+	require.Equal(t, []ShareLink{link}, links)
+	err = RevokeShareLink(ctx, config, rootNode, "copy")
+	require.NoError(t, err)
+	status, _ = redeem()
+	require.Equal(t, http.StatusOK, status)
+
+	t.Log("Revoking a link never removes blocks the tree still uses")
+	ops := kbfsOps.(*KBFSOpsStandard).getOpsByNode(ctx, rootNode)
+	filePtr := ops.nodeCache.PathFromNode(fileNode).tailPointer()
+	forged := ShareLink{
+		ID:     "forged",
+		TlfID:  capability.TlfID,
+		Minter: uid,
+		Blocks: []ShareLinkBlock{{ID: filePtr.ID, Context: filePtr.Context}},
+	}
+	err = recordShareLink(ctx, config, fileNode, forged)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	err = RevokeShareLink(ctx, config, rootNode, forged.ID)
+	require.NoError(t, err)
+	_, _, err = config.BlockServer().Get(
+		ctx, capability.TlfID, filePtr.ID, filePtr.Context)
+	require.NoError(t, err)
+
+	t.Log("A revoked link is no longer listed or served")
+	err = RevokeShareLink(ctx, config, rootNode, capability.ID)
+	require.NoError(t, err)
+	links, err = ListShareLinks(ctx, config, rootNode)
+	require.NoError(t, err)
+	require.Len(t, links, 0)
+	status, _ = redeem()
+	require.Equal(t, http.StatusNotFound, status)
+	err = RevokeShareLink(ctx, config, rootNode, capability.ID)
+	require.IsType(t, NoSuchNameError{}, errors.Cause(err))
+}
@@ -106,14 +106,18 @@ func (sc *StateChecker) findAllBlocksInPath(ctx context.Context,
 func (sc *StateChecker) getLastGCData(ctx context.Context,
 	tlfID tlf.ID) (time.Time, kbfsmd.Revision) {
 	config, ok := sc.config.(*ConfigLocal)
-	if !ok {
+	if !ok || config.allKnownConfigsForTesting == nil {
 		return time.Time{}, kbfsmd.RevisionUninitialized
 	}
 
 	var latestTime time.Time
 	var latestRev kbfsmd.Revision
 	for _, c := range *config.allKnownConfigsForTesting {
-		ops := c.KBFSOps().(*KBFSOpsStandard).getOps(context.Background(),
+		kbfsOps, ok := standardKBFSOps(c.KBFSOps())
+		if !ok {
+			continue
+		}
+		ops := kbfsOps.getOps(context.Background(),
 			FolderBranch{tlfID, MasterBranch}, FavoritesOpNoChange)
 		rt, rev := ops.fbm.getLastQRData()
 		if rt.After(latestTime) && rev > latestRev {
@@ -153,7 +157,7 @@ func (sc *StateChecker) CheckMergedState(ctx context.Context, tlfID tlf.ID) erro
 	lState := makeFBOLockState()
 
 	// Re-embed block changes.
-	kbfsOps, ok := sc.config.KBFSOps().(*KBFSOpsStandard)
+	kbfsOps, ok := standardKBFSOps(sc.config.KBFSOps())
 	if !ok {
 		return errors.New("Unexpected KBFSOps type")
 	}
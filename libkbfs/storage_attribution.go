@@ -0,0 +1,256 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"time"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"golang.org/x/net/context"
+)
+
+// storageAttributionChunkSize is how many revisions are fetched at a
+// time while attributing storage.
+const storageAttributionChunkSize = 100
+
+// StorageAttributionOp is the share of a TLF's storage attributed to
+// a single op of a revision.
+type StorageAttributionOp struct {
+	// Op describes the op, as returned by its String method.
+	Op     string
+	Blocks int
+	Bytes  uint64
+}
+
+// StorageAttributionRevision is the share of a TLF's storage
+// attributed to a single revision.
+type StorageAttributionRevision struct {
+	Revision kbfsmd.Revision
+	Writer   keybase1.UID
+	Time     time.Time
+	Blocks   int
+	Bytes    uint64
+	// Ops lists the ops of the revision that introduced live
+	// blocks, in the order they appear in the revision.  The blocks
+	// holding the revision's unembedded block changes, if any, are
+	// attributed to the revision but not to any op.
+	Ops []StorageAttributionOp `json:",omitempty"`
+}
+
+// StorageAttribution attributes the storage used by a TLF to the
+// revisions, and the ops within them, that introduced each of its
+// live blocks.
+type StorageAttribution struct {
+	Head kbfsmd.Revision
+	// TotalBytes is the encoded size of all the live blocks.
+	TotalBytes uint64
+	// UnattributedBytes is the size of the live blocks whose
+	// references couldn't be found in any revision.
+	UnattributedBytes uint64
+	// Revisions lists the revisions that introduced live blocks,
+	// in revision order.
+	Revisions []StorageAttributionRevision
+}
+
+// liveBlock is a block referenced by the head of a TLF.
+type liveBlock struct {
+	// size is the encoded size charged for the block, which is zero
+	// for all but one of the references to any given block ID.
+	size       uint64
+	attributed bool
+}
+
+// storageAttributor gathers the live blocks of a TLF, and then looks
+// for the revisions that referenced each of them.
+type storageAttributor struct {
+	config  Config
+	kmd     KeyMetadata
+	live    map[BlockRef]*liveBlock
+	seenIDs map[kbfsblock.ID]bool
+}
+
+func (sa *storageAttributor) addLive(info BlockInfo) {
+	if _, ok := sa.live[info.Ref()]; ok {
+		return
+	}
+	// A block's data is only stored once, no matter how many
+	// references it has.
+	var size uint64
+	if !sa.seenIDs[info.ID] {
+		sa.seenIDs[info.ID] = true
+		size = uint64(info.EncodedSize)
+	}
+	sa.live[info.Ref()] = &liveBlock{size: size}
+}
+
+func (sa *storageAttributor) addFile(
+	ctx context.Context, info BlockInfo) error {
+	sa.addLive(info)
+	if info.DirectType == DirectBlock {
+		return nil
+	}
+	block := NewFileBlock().(*FileBlock)
+	err := sa.config.BlockOps().Get(
+		ctx, sa.kmd, info.BlockPointer, block, TransientEntry)
+	if err != nil {
+		return err
+	}
+	if !block.IsInd {
+		return nil
+	}
+	for _, iptr := range block.IPtrs {
+		err := sa.addFile(ctx, iptr.BlockInfo)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sa *storageAttributor) addDir(
+	ctx context.Context, info BlockInfo) error {
+	sa.addLive(info)
+	block := NewDirBlock().(*DirBlock)
+	err := sa.config.BlockOps().Get(
+		ctx, sa.kmd, info.BlockPointer, block, TransientEntry)
+	if err != nil {
+		return err
+	}
+	if block.IsInd {
+		for _, iptr := range block.IPtrs {
+			err := sa.addDir(ctx, iptr.BlockInfo)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, de := range block.Children {
+		switch de.Type {
+		case Dir:
+			err = sa.addDir(ctx, de.BlockInfo)
+		case File, Exec:
+			err = sa.addFile(ctx, de.BlockInfo)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// attribute claims the live block `ptr`, if it hasn't been claimed
+// yet, and returns its size.
+func (sa *storageAttributor) attribute(ptr BlockPointer) (uint64, bool) {
+	lb, ok := sa.live[ptr.Ref()]
+	if !ok || lb.attributed {
+		return 0, false
+	}
+	lb.attributed = true
+	return lb.size, true
+}
+
+func (sa *storageAttributor) attributeRevision(
+	rmd ImmutableRootMetadata) StorageAttributionRevision {
+	rev := StorageAttributionRevision{
+		Revision: rmd.Revision(),
+		Writer:   rmd.LastModifyingWriter(),
+		Time:     rmd.LocalTimestamp(),
+	}
+	// Unembedded block changes are never cleaned up, so they're
+	// always live.
+	if info := rmd.data.Changes.Info; info.BlockPointer != zeroPtr {
+		sa.addLive(info)
+		if size, ok := sa.attribute(info.BlockPointer); ok {
+			rev.Blocks++
+			rev.Bytes += size
+		}
+	}
+	for _, op := range rmd.data.Changes.Ops {
+		if _, ok := op.(*GCOp); ok {
+			continue
+		}
+		ptrs := op.Refs()
+		for _, update := range op.allUpdates() {
+			if update.Ref != update.Unref {
+				ptrs = append(ptrs, update.Ref)
+			}
+		}
+		opShare := StorageAttributionOp{Op: op.String()}
+		for _, ptr := range ptrs {
+			if size, ok := sa.attribute(ptr); ok {
+				opShare.Blocks++
+				opShare.Bytes += size
+			}
+		}
+		if opShare.Blocks > 0 {
+			rev.Ops = append(rev.Ops, opShare)
+			rev.Blocks += opShare.Blocks
+			rev.Bytes += opShare.Bytes
+		}
+	}
+	return rev
+}
+
+// AttributeStorage attributes the storage used by the latest merged
+// revision of the TLF `tlfID` to the revisions that introduced it.
+// First every block reachable from the head is found, along with
+// its size; then the whole merged history is walked, and each of
+// those blocks is attributed to the op of the first revision that
+// referenced it.  Blocks that have been unreferenced, but not yet
+// garbage-collected, still count against the quota of the TLF, but
+// aren't included.
+func AttributeStorage(ctx context.Context, config Config, tlfID tlf.ID) (
+	StorageAttribution, error) {
+	head, err := config.MDOps().GetForTLF(ctx, tlfID, nil)
+	if err != nil {
+		return StorageAttribution{}, err
+	}
+	if head == (ImmutableRootMetadata{}) {
+		return StorageAttribution{}, nil
+	}
+
+	sa := &storageAttributor{
+		config:  config,
+		kmd:     head,
+		live:    make(map[BlockRef]*liveBlock),
+		seenIDs: make(map[kbfsblock.ID]bool),
+	}
+	err = sa.addDir(ctx, head.data.Dir.BlockInfo)
+	if err != nil {
+		return StorageAttribution{}, err
+	}
+
+	result := StorageAttribution{Head: head.Revision()}
+	for start := kbfsmd.RevisionInitial; start <= result.Head; start +=
+		storageAttributionChunkSize {
+		stop := start + storageAttributionChunkSize - 1
+		if stop > result.Head {
+			stop = result.Head
+		}
+		rmds, err := getMDRange(ctx, config, tlfID, kbfsmd.NullBranchID,
+			start, stop, kbfsmd.Merged, nil)
+		if err != nil {
+			return StorageAttribution{}, err
+		}
+		for _, rmd := range rmds {
+			rev := sa.attributeRevision(rmd)
+			if rev.Blocks > 0 {
+				result.Revisions = append(result.Revisions, rev)
+			}
+		}
+	}
+
+	for _, lb := range sa.live {
+		result.TotalBytes += lb.size
+		if !lb.attributed {
+			result.UnattributedBytes += lb.size
+		}
+	}
+	return result, nil
+}
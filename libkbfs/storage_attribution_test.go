@@ -0,0 +1,78 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	kbname "github.com/keybase/client/go/kbun"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAttributeStorage(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	syncAndGetRev := func() kbfsmd.Revision {
+		err := kbfsOps.SyncAll(ctx, fb)
+		require.NoError(t, err)
+		status, _, err := kbfsOps.FolderStatus(ctx, fb)
+		require.NoError(t, err)
+		return status.Revision
+	}
+
+	t.Log("Write a file, then another, then overwrite the first")
+	aNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, aNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	revA := syncAndGetRev()
+	bNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, bNode, []byte{4, 5, 6, 7}, 0)
+	require.NoError(t, err)
+	revB := syncAndGetRev()
+	err = kbfsOps.Write(ctx, aNode, []byte{8, 9}, 0)
+	require.NoError(t, err)
+	revC := syncAndGetRev()
+
+	layoutA, err := kbfsOps.GetFileBlockLayout(ctx, aNode)
+	require.NoError(t, err)
+	layoutB, err := kbfsOps.GetFileBlockLayout(ctx, bNode)
+	require.NoError(t, err)
+
+	t.Log("Each live block is attributed to the revision that made it")
+	attribution, err := AttributeStorage(ctx, config, fb.Tlf)
+	require.NoError(t, err)
+	require.Equal(t, revC, attribution.Head)
+	byRev := make(map[kbfsmd.Revision]StorageAttributionRevision)
+	sum := attribution.UnattributedBytes
+	for _, rev := range attribution.Revisions {
+		byRev[rev.Revision] = rev
+		sum += rev.Bytes
+		var opBytes uint64
+		for _, op := range rev.Ops {
+			opBytes += op.Bytes
+		}
+		require.Equal(t, rev.Bytes, opBytes)
+	}
+	require.Equal(t, attribution.TotalBytes, sum)
+
+	// The blocks written in the first revision have all been
+	// replaced since.
+	require.NotContains(t, byRev, revA)
+	require.Contains(t, byRev, revB)
+	require.True(t,
+		byRev[revB].Bytes >= uint64(layoutB.Root.EncodedSize))
+	require.Contains(t, byRev, revC)
+	require.True(t,
+		byRev[revC].Bytes >= uint64(layoutA.Root.EncodedSize))
+}
@@ -0,0 +1,68 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// subtreeInterest is the set of subtrees of a TLF that a client has
+// subscribed to, each stored as the names of its path components
+// under the TLF root.  A nil *subtreeInterest covers the whole TLF.
+type subtreeInterest struct {
+	subtrees [][]string
+}
+
+// newSubtreeInterest returns the interest covering the given
+// slash-separated paths, relative to the TLF root.  It returns nil
+// if the paths cover the whole TLF.
+func newSubtreeInterest(subtrees []string) (*subtreeInterest, error) {
+	if len(subtrees) == 0 {
+		return nil, nil
+	}
+	si := &subtreeInterest{}
+	for _, s := range subtrees {
+		var names []string
+		for _, name := range strings.Split(s, "/") {
+			switch name {
+			case "", ".":
+				continue
+			case "..":
+				return nil, errors.Errorf("Invalid subtree path %q", s)
+			}
+			names = append(names, name)
+		}
+		if len(names) == 0 {
+			// The root covers everything.
+			return nil, nil
+		}
+		si.subtrees = append(si.subtrees, names)
+	}
+	return si, nil
+}
+
+// includes returns true if `p` is within one of the subtrees, or is
+// one of their ancestors.
+func (si *subtreeInterest) includes(p path) bool {
+	if si == nil || len(p.path) <= 1 {
+		return true
+	}
+	names := p.path[1:]
+	for _, sub := range si.subtrees {
+		n := len(sub)
+		if len(names) < n {
+			n = len(names)
+		}
+		i := 0
+		for ; i < n && names[i].Name == sub[i]; i++ {
+		}
+		if i == n {
+			return true
+		}
+	}
+	return false
+}
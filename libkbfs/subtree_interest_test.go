@@ -0,0 +1,153 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"testing"
+
+	kbname "github.com/keybase/client/go/kbun"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestSubtreeInterestIncludes(t *testing.T) {
+	makePath := func(names ...string) path {
+		p := path{path: []pathNode{{Name: "u1"}}}
+		for _, name := range names {
+			p.path = append(p.path, pathNode{Name: name})
+		}
+		return p
+	}
+
+	t.Log("The root, or no subtrees at all, covers everything")
+	for _, subtrees := range [][]string{nil, {"a", "/"}} {
+		si, err := newSubtreeInterest(subtrees)
+		require.NoError(t, err)
+		require.Nil(t, si)
+		require.True(t, si.includes(makePath("b", "c")))
+	}
+
+	_, err := newSubtreeInterest([]string{"a/../b"})
+	require.Error(t, err)
+
+	t.Log("Subtrees include their contents and their ancestors")
+	si, err := newSubtreeInterest([]string{"proj/a/", "./other"})
+	require.NoError(t, err)
+	require.True(t, si.includes(makePath()))
+	require.True(t, si.includes(makePath("proj")))
+	require.True(t, si.includes(makePath("proj", "a")))
+	require.True(t, si.includes(makePath("proj", "a", "b", "c")))
+	require.True(t, si.includes(makePath("other", "d")))
+	require.False(t, si.includes(makePath("proj", "b")))
+	require.False(t, si.includes(makePath("proja")))
+}
+
+type subtreeTestObserver struct {
+	lock    sync.Mutex
+	changed map[NodeID]bool
+}
+
+func (o *subtreeTestObserver) LocalChange(ctx context.Context, node Node,
+	write WriteRange) {
+	// ignore
+}
+
+func (o *subtreeTestObserver) BatchChanges(ctx context.Context,
+	changes []NodeChange, _ []NodeID) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for _, change := range changes {
+		o.changed[change.Node.GetID()] = true
+	}
+}
+
+func (o *subtreeTestObserver) TlfHandleChange(ctx context.Context,
+	newHandle *TlfHandle) {
+	// ignore
+}
+
+func (o *subtreeTestObserver) takeChanged() map[NodeID]bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	changed := o.changed
+	o.changed = make(map[NodeID]bool)
+	return changed
+}
+
+func TestSubscribeSubtreesSkipsOtherChanges(t *testing.T) {
+	var userName1, userName2 kbname.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+
+	t.Log("User 1 creates a file in each of two directories")
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, tlf.Private)
+	kbfsOps1 := config1.KBFSOps()
+	fb := rootNode1.GetFolderBranch()
+	aNode1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "a")
+	require.NoError(t, err)
+	xNode1, _, err := kbfsOps1.CreateFile(ctx, aNode1, "x", false, NoExcl)
+	require.NoError(t, err)
+	bNode1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "b")
+	require.NoError(t, err)
+	yNode1, _, err := kbfsOps1.CreateFile(ctx, bNode1, "y", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	t.Log("User 2 looks up both files, but only subscribes to one")
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, tlf.Private)
+	kbfsOps2 := config2.KBFSOps()
+	aNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	xNode2, _, err := kbfsOps2.Lookup(ctx, aNode2, "x")
+	require.NoError(t, err)
+	bNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "b")
+	require.NoError(t, err)
+	yNode2, _, err := kbfsOps2.Lookup(ctx, bNode2, "y")
+	require.NoError(t, err)
+	err = kbfsOps2.SubscribeSubtrees(ctx, fb, []string{"a"})
+	require.NoError(t, err)
+	obs := &subtreeTestObserver{changed: make(map[NodeID]bool)}
+	err = config2.Notifier().RegisterForChanges([]FolderBranch{fb}, obs)
+	require.NoError(t, err)
+
+	write := func(b byte) {
+		err := kbfsOps1.Write(ctx, xNode1, []byte{b}, 0)
+		require.NoError(t, err)
+		err = kbfsOps1.Write(ctx, yNode1, []byte{b}, 0)
+		require.NoError(t, err)
+		err = kbfsOps1.SyncAll(ctx, fb)
+		require.NoError(t, err)
+		err = kbfsOps2.SyncFromServer(ctx, fb, nil)
+		require.NoError(t, err)
+	}
+
+	t.Log("Only the subscribed file's change is reported")
+	write(1)
+	changed := obs.takeChanged()
+	require.True(t, changed[xNode2.GetID()])
+	require.False(t, changed[yNode2.GetID()])
+
+	t.Log("The other file is still up to date")
+	data := make([]byte, 1)
+	_, err = kbfsOps2.Read(ctx, yNode2, data, 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, data)
+
+	t.Log("Subscribing to everything reports both again")
+	err = kbfsOps2.SubscribeSubtrees(ctx, fb, nil)
+	require.NoError(t, err)
+	write(2)
+	changed = obs.takeChanged()
+	require.True(t, changed[xNode2.GetID()])
+	require.True(t, changed[yNode2.GetID()])
+}
@@ -0,0 +1,45 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import "github.com/pkg/errors"
+
+// SymlinkResolver enforces the symlink policy of a Config while a
+// single path is being resolved, so that every consumer of libkbfs
+// that resolves paths on its own (rather than through a kernel) fails
+// the same way on deep or looping symlinks.  It is not
+// goroutine-safe, and should only be used for one resolution.
+type SymlinkResolver struct {
+	maxDepth int
+	followed int
+	seen     map[string]bool
+}
+
+// NewSymlinkResolver returns a new SymlinkResolver using the symlink
+// depth limit of the given config.
+func NewSymlinkResolver(config Config) *SymlinkResolver {
+	return &SymlinkResolver{
+		maxDepth: config.MaxSymlinkDepth(),
+		seen:     make(map[string]bool),
+	}
+}
+
+// Follow records that the symlink at `link` is being followed, and
+// that resolution will continue with `newPath`, which includes any
+// path components remaining after the link.  It returns a
+// SymlinkLoopError if that exact path was already reached by an
+// earlier symlink, and a SymlinkDepthError if the link would exceed
+// the depth limit.
+func (sr *SymlinkResolver) Follow(link, newPath string) error {
+	if sr.seen[newPath] {
+		return errors.WithStack(SymlinkLoopError{link, newPath})
+	}
+	if sr.followed >= sr.maxDepth {
+		return errors.WithStack(SymlinkDepthError{link, sr.maxDepth})
+	}
+	sr.followed++
+	sr.seen[newPath] = true
+	return nil
+}
@@ -0,0 +1,38 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestSymlinkResolver(t *testing.T) {
+	ctx := context.Background()
+	config := MakeTestConfigOrBust(t, "u1")
+	defer CheckConfigAndShutdown(ctx, t, config)
+	require.Equal(t, maxSymlinkDepthDefault, config.MaxSymlinkDepth())
+
+	t.Log("Revisiting a link with a different remainder is fine")
+	sr := NewSymlinkResolver(config)
+	require.NoError(t, sr.Follow("a/l", "a/l/x"))
+	require.NoError(t, sr.Follow("a/l", "a/x"))
+
+	t.Log("Reaching the same path twice is a loop")
+	err := sr.Follow("a/m", "a/x")
+	_, ok := errors.Cause(err).(SymlinkLoopError)
+	require.True(t, ok, "err=%+v", err)
+
+	t.Log("The depth limit is enforced")
+	config.SetMaxSymlinkDepth(1)
+	sr = NewSymlinkResolver(config)
+	require.NoError(t, sr.Follow("a", "b"))
+	err = sr.Follow("b", "c")
+	_, ok = errors.Cause(err).(SymlinkDepthError)
+	require.True(t, ok, "err=%+v", err)
+}
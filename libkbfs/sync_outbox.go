@@ -0,0 +1,560 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/go-codec/codec"
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// syncOutboxDirname is the name of the directory, under the
+	// storage root, that holds the sync outbox.
+	syncOutboxDirname     = "kbfs_sync_outbox"
+	syncOutboxEntrySuffix = ".entry"
+	syncOutboxBlocksDir   = ".blocks"
+	// syncOutboxBlockSize is how much of a dirty file is read, and
+	// readied as a single block, at once when moving it into the
+	// outbox.
+	syncOutboxBlockSize = 1 << 20
+	// syncOutboxOverQuotaThreshold is how long syncs of a TLF have to
+	// keep failing for being over quota before its dirty files are
+	// moved into the outbox.
+	syncOutboxOverQuotaThreshold = 1 * time.Hour
+)
+
+// isSyncOutboxError returns true if `err` is a sync error that no
+// amount of retrying will fix, because the user isn't allowed to
+// write to the TLF (or the part of it being synced) anymore.
+// Errors that might go away on their own, like an unauthorized
+// session, leave the dirty state in place.  Being over quota is only
+// treated like this once it has lasted for a while; see
+// `isOverQuotaSyncError`.
+func isSyncOutboxError(err error) bool {
+	switch errors.Cause(err).(type) {
+	case kbfsmd.ServerErrorWriteAccess, WriteAccessError,
+		WriteUnsupportedError, TeamReadOnlySubtreeError:
+		return true
+	default:
+		return false
+	}
+}
+
+// isOverQuotaSyncError returns true if `err` is a sync error caused
+// by the TLF being over quota.  Such an error goes away if the user
+// frees up space, so the dirty state is only moved into the outbox
+// once syncs have kept failing with it for
+// `syncOutboxOverQuotaThreshold`.
+func isOverQuotaSyncError(err error) bool {
+	_, ok := errors.Cause(err).(kbfsblock.ServerErrorOverQuota)
+	return ok
+}
+
+// SyncOutboxEntry describes the contents of one file that were
+// moved into the sync outbox.
+type SyncOutboxEntry struct {
+	ID      string
+	TlfID   tlf.ID
+	TlfName tlf.CanonicalName
+	TlfType tlf.Type
+	// Path is the TLF-relative path the file had when its sync
+	// failed.
+	Path string
+	Size int64
+	Time time.Time
+	// Err is the sync error that caused the move.
+	Err string
+	// NumBlocks is the number of readied blocks holding the
+	// contents.
+	NumBlocks int
+	// Op is the file's dirty sync op, saying which parts of the
+	// file were written since its last successful sync.  It's nil
+	// if the file was new.
+	Op *syncOp `codec:",omitempty"`
+
+	codec.UnknownFieldSetHandler
+}
+
+// syncOutboxBlock is one block's worth of a file's contents in the
+// outbox, readied (encoded and encrypted) with the TLF's key just
+// like a block that's about to be put to the server.
+type syncOutboxBlock struct {
+	// Off is the offset in the file where this block's contents
+	// start.
+	Off        int64
+	ID         kbfsblock.ID
+	KeyGen     kbfsmd.KeyGen
+	DataVer    DataVer
+	Buf        []byte
+	ServerHalf kbfscrypto.BlockCryptKeyServerHalf
+
+	codec.UnknownFieldSetHandler
+}
+
+func (sob syncOutboxBlock) decrypt(ctx context.Context, config Config,
+	kmd KeyMetadata) (*FileBlock, error) {
+	ptr := BlockPointer{
+		ID:      sob.ID,
+		KeyGen:  sob.KeyGen,
+		DataVer: sob.DataVer,
+	}
+	block := NewFileBlock().(*FileBlock)
+	err := assembleBlock(ctx, config.keyGetter(), config.Codec(),
+		config.cryptoPure(), kmd, ptr, block, sob.Buf, sob.ServerHalf)
+	if err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+type syncOutboxConfig interface {
+	clockGetter
+	codecGetter
+}
+
+// SyncOutbox holds the contents of files whose sync failed with an
+// error that retrying can't fix (see `isSyncOutboxError`).  Rather
+// than keeping such data dirty until the process exits, the TLF
+// drops its dirty state and the file contents are moved here, where
+// the user can list them, export them to a local file, retry writing
+// them back into the TLF, or discard them.
+//
+// The contents are never kept in plaintext: each entry holds the
+// file's readied blocks, which can only be decrypted with the TLF's
+// keys, along with the file's dirty op.
+//
+// Until `Load` is called, the outbox only lives in memory.
+// Afterward, each entry is saved in the loaded directory as an entry
+// file and a directory of blocks, so that it survives restarts.
+type SyncOutbox struct {
+	config syncOutboxConfig
+
+	lock    sync.Mutex
+	dir     string
+	entries map[string]SyncOutboxEntry
+	// blocks holds the readied blocks while there's no directory.
+	blocks map[string][]syncOutboxBlock
+}
+
+// NewSyncOutbox returns a new, empty, in-memory SyncOutbox.
+func NewSyncOutbox(config syncOutboxConfig) *SyncOutbox {
+	return &SyncOutbox{
+		config:  config,
+		entries: make(map[string]SyncOutboxEntry),
+		blocks:  make(map[string][]syncOutboxBlock),
+	}
+}
+
+func (so *SyncOutbox) entryPath(id string) string {
+	return filepath.Join(so.dir, id+syncOutboxEntrySuffix)
+}
+
+func (so *SyncOutbox) blocksPath(id string) string {
+	return filepath.Join(so.dir, id+syncOutboxBlocksDir)
+}
+
+func (so *SyncOutbox) blockPath(id string, i int) string {
+	return filepath.Join(so.blocksPath(id), strconv.Itoa(i))
+}
+
+// Load replaces the outbox contents with the entries saved in `dir`,
+// creating it if needed, and saves all future entries there.
+func (so *SyncOutbox) Load(dir string) error {
+	err := ioutil.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	entries := make(map[string]SyncOutboxEntry)
+	for _, fi := range fileInfos {
+		name := fi.Name()
+		if !strings.HasSuffix(name, syncOutboxEntrySuffix) {
+			continue
+		}
+		var entry SyncOutboxEntry
+		err := kbfscodec.DeserializeFromFile(
+			so.config.Codec(), filepath.Join(dir, name), &entry)
+		if err != nil {
+			return err
+		}
+		entries[entry.ID] = entry
+	}
+
+	so.lock.Lock()
+	defer so.lock.Unlock()
+	so.dir = dir
+	so.entries = entries
+	so.blocks = make(map[string][]syncOutboxBlock)
+	return nil
+}
+
+// newEntryID returns a new, random entry ID, under which blocks can
+// be saved with `putBlock` before the entry itself is added.
+func (so *SyncOutbox) newEntryID() (string, error) {
+	var idBytes [8]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(idBytes[:]), nil
+}
+
+// putBlock saves `block` as the `i`th block of the entry with the
+// given ID, which hasn't been added yet.  Blocks must be put in
+// order.
+func (so *SyncOutbox) putBlock(
+	id string, i int, block syncOutboxBlock) error {
+	so.lock.Lock()
+	defer so.lock.Unlock()
+	if so.dir == "" {
+		so.blocks[id] = append(so.blocks[id], block)
+		return nil
+	}
+	if i == 0 {
+		err := ioutil.MkdirAll(so.blocksPath(id), 0700)
+		if err != nil {
+			return err
+		}
+	}
+	return kbfscodec.SerializeToFile(
+		so.config.Codec(), block, so.blockPath(id, i))
+}
+
+// removeLocked removes the entry with the given ID, and all its
+// blocks.  The entry file goes first, so that `Load` never finds an
+// entry without its blocks.
+func (so *SyncOutbox) removeLocked(id string) error {
+	if so.dir == "" {
+		delete(so.blocks, id)
+	} else {
+		err := ioutil.Remove(so.entryPath(id))
+		if err != nil && !ioutil.IsNotExist(err) {
+			return err
+		}
+		err = ioutil.RemoveAll(so.blocksPath(id))
+		if err != nil {
+			return err
+		}
+	}
+	delete(so.entries, id)
+	return nil
+}
+
+// add saves `entry`, whose ID, size and blocks were already filled
+// in, filling in its time.  If it fails, or to abandon an entry
+// before adding it, call `abandon`.
+func (so *SyncOutbox) add(entry SyncOutboxEntry) (SyncOutboxEntry, error) {
+	entry.Time = so.config.Clock().Now()
+
+	so.lock.Lock()
+	defer so.lock.Unlock()
+	if so.dir != "" {
+		// Write the entry last, so that `Load` never finds an entry
+		// without its blocks.
+		err := kbfscodec.SerializeToFile(
+			so.config.Codec(), entry, so.entryPath(entry.ID))
+		if err != nil {
+			return SyncOutboxEntry{}, err
+		}
+	}
+	so.entries[entry.ID] = entry
+	return entry, nil
+}
+
+// abandon removes whatever was saved for the entry with the given
+// ID, whether or not it was added.
+func (so *SyncOutbox) abandon(id string) error {
+	so.lock.Lock()
+	defer so.lock.Unlock()
+	return so.removeLocked(id)
+}
+
+// List returns all the entries in the outbox, oldest first.
+func (so *SyncOutbox) List() []SyncOutboxEntry {
+	so.lock.Lock()
+	defer so.lock.Unlock()
+	entries := make([]SyncOutboxEntry, 0, len(so.entries))
+	for _, entry := range so.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].Time.Equal(entries[j].Time) {
+			return entries[i].Time.Before(entries[j].Time)
+		}
+		return entries[i].ID < entries[j].ID
+	})
+	return entries
+}
+
+// Get returns the entry with the given ID.
+func (so *SyncOutbox) Get(id string) (SyncOutboxEntry, error) {
+	so.lock.Lock()
+	defer so.lock.Unlock()
+	entry, ok := so.entries[id]
+	if !ok {
+		return SyncOutboxEntry{}, NoSuchSyncOutboxEntryError{id}
+	}
+	return entry, nil
+}
+
+// getBlock returns the `i`th readied block of the entry with the
+// given ID.
+func (so *SyncOutbox) getBlock(id string, i int) (syncOutboxBlock, error) {
+	so.lock.Lock()
+	defer so.lock.Unlock()
+	if _, ok := so.entries[id]; !ok {
+		return syncOutboxBlock{}, NoSuchSyncOutboxEntryError{id}
+	}
+	if so.dir == "" {
+		blocks := so.blocks[id]
+		if i >= len(blocks) {
+			return syncOutboxBlock{}, errors.Errorf(
+				"Outbox entry %s has no block %d", id, i)
+		}
+		return blocks[i], nil
+	}
+	var block syncOutboxBlock
+	err := kbfscodec.DeserializeFromFile(
+		so.config.Codec(), so.blockPath(id, i), &block)
+	if err != nil {
+		return syncOutboxBlock{}, err
+	}
+	return block, nil
+}
+
+// Discard removes the entry with the given ID, and the file
+// contents it holds, from the outbox.
+func (so *SyncOutbox) Discard(id string) error {
+	so.lock.Lock()
+	defer so.lock.Unlock()
+	if _, ok := so.entries[id]; !ok {
+		return NoSuchSyncOutboxEntryError{id}
+	}
+	return so.removeLocked(id)
+}
+
+// forEachSyncOutboxBlock decrypts the blocks of the given outbox
+// entry one at a time, in order, and passes each one's offset and
+// contents to `fn`.
+func forEachSyncOutboxBlock(ctx context.Context, config Config,
+	entry SyncOutboxEntry, fn func(off int64, contents []byte) error) error {
+	if entry.NumBlocks == 0 {
+		return nil
+	}
+	kmd, err := config.MDOps().GetForTLF(ctx, entry.TlfID, nil)
+	if err != nil {
+		return err
+	}
+	if kmd == (ImmutableRootMetadata{}) {
+		return errors.Errorf("No MD for TLF %s", entry.TlfID)
+	}
+	outbox := config.SyncOutbox()
+	for i := 0; i < entry.NumBlocks; i++ {
+		sob, err := outbox.getBlock(entry.ID, i)
+		if err != nil {
+			return err
+		}
+		block, err := sob.decrypt(ctx, config, kmd)
+		if err != nil {
+			return err
+		}
+		err = fn(sob.Off, block.Contents)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExportSyncOutboxEntry writes the file contents held by the outbox
+// entry with the given ID to `localPath`, which must not exist yet.
+// The entry stays in the outbox.
+func ExportSyncOutboxEntry(ctx context.Context, config Config, id string,
+	localPath string) (err error) {
+	entry, err := config.SyncOutbox().Get(id)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.OpenFile(
+		localPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		closeErr := f.Close()
+		if err == nil {
+			err = errors.WithStack(closeErr)
+		}
+	}()
+	return forEachSyncOutboxBlock(ctx, config, entry,
+		func(off int64, contents []byte) error {
+			_, err := f.WriteAt(contents, off)
+			return errors.WithStack(err)
+		})
+}
+
+// syncOutboxRange is a byte range, [start, end), of a file.
+type syncOutboxRange struct {
+	start, end int64
+}
+
+// retryRanges returns the parts of the file that need to be
+// rewritten from `entry` when retrying it, and the offset the file
+// should be truncated to first.  If the file already exists and
+// `entry` has its dirty op, only the parts the op changed are
+// rewritten; everything from the first truncate on counts as
+// changed.
+func (entry SyncOutboxEntry) retryRanges(exists bool) (
+	ranges []syncOutboxRange, truncateTo int64) {
+	if !exists || entry.Op == nil {
+		return []syncOutboxRange{{0, entry.Size}}, 0
+	}
+	truncateTo = -1
+	for _, w := range entry.Op.Writes {
+		if w.isTruncate() {
+			if truncateTo < 0 || int64(w.Off) < truncateTo {
+				truncateTo = int64(w.Off)
+			}
+			continue
+		}
+		ranges = append(ranges,
+			syncOutboxRange{int64(w.Off), int64(w.Off + w.Len)})
+	}
+	if truncateTo >= 0 {
+		ranges = append(ranges, syncOutboxRange{truncateTo, entry.Size})
+	}
+	return ranges, truncateTo
+}
+
+// RetrySyncOutboxEntry writes the file contents held by the outbox
+// entry with the given ID back to the path they came from, creating
+// any missing directories along the way, and syncs the TLF.  If the
+// file is still there, only the parts changed by the entry's dirty
+// op are rewritten; otherwise the whole file is.  The entry is
+// discarded if the sync succeeds.  If the sync fails again and the
+// contents moved into a new entry, the old one is discarded as well.
+func RetrySyncOutboxEntry(ctx context.Context, config Config, id string) (
+	err error) {
+	outbox := config.SyncOutbox()
+	entry, err := outbox.Get(id)
+	if err != nil {
+		return err
+	}
+	if entry.Path == "" {
+		return errors.Errorf("Outbox entry %s has no path", id)
+	}
+
+	h, err := GetHandleFromFolderNameAndType(ctx, config.KBPKI(),
+		config.MDOps(), string(entry.TlfName), entry.TlfType)
+	if err != nil {
+		return err
+	}
+	kbfsOps := config.KBFSOps()
+	dir, _, err := kbfsOps.GetOrCreateRootNode(ctx, h, MasterBranch)
+	if err != nil {
+		return err
+	}
+
+	names := strings.Split(entry.Path, "/")
+	for _, name := range names[:len(names)-1] {
+		child, _, err := kbfsOps.Lookup(ctx, dir, name)
+		if _, isMiss := errors.Cause(err).(NoSuchNameError); isMiss {
+			child, _, err = kbfsOps.CreateDir(ctx, dir, name)
+		}
+		if err != nil {
+			return err
+		}
+		dir = child
+	}
+	name := names[len(names)-1]
+	exists := true
+	file, _, err := kbfsOps.Lookup(ctx, dir, name)
+	if _, isMiss := errors.Cause(err).(NoSuchNameError); isMiss {
+		exists = false
+		file, _, err = kbfsOps.CreateFile(ctx, dir, name, false, NoExcl)
+	}
+	if err != nil {
+		return err
+	}
+
+	ranges, truncateTo := entry.retryRanges(exists)
+	if truncateTo >= 0 {
+		err = kbfsOps.Truncate(ctx, file, uint64(truncateTo))
+		if err != nil {
+			return err
+		}
+	}
+	err = forEachSyncOutboxBlock(ctx, config, entry,
+		func(off int64, contents []byte) error {
+			end := off + int64(len(contents))
+			for _, r := range ranges {
+				start, stop := r.start, r.end
+				if start < off {
+					start = off
+				}
+				if stop > end {
+					stop = end
+				}
+				if start >= stop {
+					continue
+				}
+				err := kbfsOps.Write(
+					ctx, file, contents[start-off:stop-off], start)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+	err = kbfsOps.Truncate(ctx, file, uint64(entry.Size))
+	if err != nil {
+		return err
+	}
+	oldEntries := make(map[string]bool)
+	for _, e := range outbox.List() {
+		oldEntries[e.ID] = true
+	}
+	err = kbfsOps.SyncAll(ctx, file.GetFolderBranch())
+	if err != nil {
+		moved := false
+		for _, e := range outbox.List() {
+			if !oldEntries[e.ID] && e.TlfID == entry.TlfID &&
+				e.Path == entry.Path {
+				moved = true
+				break
+			}
+		}
+		if !moved {
+			return err
+		}
+	}
+	if discardErr := outbox.Discard(id); discardErr != nil && err == nil {
+		return discardErr
+	}
+	return err
+}
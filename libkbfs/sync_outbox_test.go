@@ -0,0 +1,228 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	kbname "github.com/keybase/client/go/kbun"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type mdServerPutErr struct {
+	MDServer
+	err error
+}
+
+func (mspe mdServerPutErr) Put(ctx context.Context, rmds *RootMetadataSigned,
+	extra kbfsmd.ExtraMetadata, lc *keybase1.LockContext,
+	priority keybase1.MDPriority) error {
+	return mspe.err
+}
+
+func TestSyncOutbox(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "sync_outbox")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+	outboxDir := filepath.Join(tempdir, syncOutboxDirname)
+	outbox := config.SyncOutbox()
+	err = outbox.Load(outboxDir)
+	require.NoError(t, err)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	readAll := func(n Node, size int) []byte {
+		buf := make([]byte, size+1)
+		nRead, err := kbfsOps.Read(ctx, n, buf, 0)
+		require.NoError(t, err)
+		return buf[:nRead]
+	}
+
+	t.Log("Sync one file, and then dirty it along with a new one")
+	aNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	aData := []byte("old contents of a")
+	err = kbfsOps.Write(ctx, aNode, aData, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	aNewData := []byte("new contents of a")
+	err = kbfsOps.Write(ctx, aNode, aNewData[:3], 0)
+	require.NoError(t, err)
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	bNode, _, err := kbfsOps.CreateFile(ctx, dirNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	bData := []byte("contents of b")
+	err = kbfsOps.Write(ctx, bNode, bData, 0)
+	require.NoError(t, err)
+
+	t.Log("An over-quota sync leaves the dirty files alone")
+	realBserv := config.BlockServer()
+	config.SetBlockServer(blockServerPutErr{
+		realBserv, kbfsblock.ServerErrorOverQuota{Throttled: true}})
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.IsType(t, kbfsblock.ServerErrorOverQuota{}, errors.Cause(err))
+	config.SetBlockServer(realBserv)
+	require.Empty(t, outbox.List())
+	err = kbfsOps.Write(ctx, aNode, aNewData[3:], 3)
+	require.NoError(t, err)
+
+	t.Log("Losing write access moves the dirty files into the outbox")
+	realMDServer := config.MDServer()
+	config.SetMDServer(mdServerPutErr{
+		realMDServer, kbfsmd.ServerErrorWriteAccess{}})
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.IsType(t, kbfsmd.ServerErrorWriteAccess{}, errors.Cause(err))
+	entries := outbox.List()
+	require.Len(t, entries, 2)
+	byPath := make(map[string]SyncOutboxEntry)
+	for _, entry := range entries {
+		require.Equal(t, fb.Tlf, entry.TlfID)
+		require.Equal(t, tlf.CanonicalName("u1"), entry.TlfName)
+		require.Equal(t, err.Error(), entry.Err)
+		byPath[entry.Path] = entry
+	}
+	aEntry, bEntry := byPath["a"], byPath["d/b"]
+	require.Equal(t, int64(len(aNewData)), aEntry.Size)
+	require.NotNil(t, aEntry.Op)
+	require.Equal(t, int64(len(bData)), bEntry.Size)
+
+	t.Log("Nothing is saved in plaintext")
+	err = filepath.Walk(outboxDir,
+		func(path string, info os.FileInfo, err error) error {
+			require.NoError(t, err)
+			if info.IsDir() {
+				return nil
+			}
+			buf, err := ioutil.ReadFile(path)
+			require.NoError(t, err)
+			require.False(t, bytes.Contains(buf, aNewData))
+			require.False(t, bytes.Contains(buf, bData))
+			return nil
+		})
+	require.NoError(t, err)
+
+	t.Log("The TLF is back to its last synced state")
+	require.Equal(t, aData, readAll(aNode, len(aNewData)))
+	_, _, err = kbfsOps.Lookup(ctx, rootNode, "d")
+	require.IsType(t, NoSuchNameError{}, errors.Cause(err))
+	config.SetMDServer(realMDServer)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	t.Log("Export an entry to a new local file")
+	exportPath := filepath.Join(tempdir, "b")
+	err = ExportSyncOutboxEntry(ctx, config, bEntry.ID, exportPath)
+	require.NoError(t, err)
+	data, err := ioutil.ReadFile(exportPath)
+	require.NoError(t, err)
+	require.Equal(t, bData, data)
+	err = ExportSyncOutboxEntry(ctx, config, bEntry.ID, exportPath)
+	require.Error(t, err)
+
+	t.Log("Retry an entry, which discards it once it's synced")
+	err = RetrySyncOutboxEntry(ctx, config, bEntry.ID)
+	require.NoError(t, err)
+	dirNode, _, err = kbfsOps.Lookup(ctx, rootNode, "d")
+	require.NoError(t, err)
+	bNode, _, err = kbfsOps.Lookup(ctx, dirNode, "b")
+	require.NoError(t, err)
+	require.Equal(t, bData, readAll(bNode, len(bData)))
+	require.Equal(t, []SyncOutboxEntry{aEntry}, outbox.List())
+
+	t.Log("Entries survive a reload")
+	reloaded := NewSyncOutbox(config)
+	err = reloaded.Load(outboxDir)
+	require.NoError(t, err)
+	require.Len(t, reloaded.List(), 1)
+	require.Equal(t, aEntry.ID, reloaded.List()[0].ID)
+
+	t.Log("Retry the entry for the existing file, replaying its dirty op")
+	require.Equal(t, aData, readAll(aNode, len(aNewData)))
+	err = RetrySyncOutboxEntry(ctx, config, aEntry.ID)
+	require.NoError(t, err)
+	require.Equal(t, aNewData, readAll(aNode, len(aNewData)))
+	require.Empty(t, outbox.List())
+
+	t.Log("Discarding a missing entry fails")
+	err = outbox.Discard(aEntry.ID)
+	require.Equal(t, NoSuchSyncOutboxEntryError{aEntry.ID}, err)
+}
+
+func TestSyncOutboxOverQuota(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+	clock := newTestClockNow()
+	config.SetClock(clock)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	outbox := config.SyncOutbox()
+	aNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	aData := []byte("contents of a")
+	err = kbfsOps.Write(ctx, aNode, aData, 0)
+	require.NoError(t, err)
+
+	t.Log("Over-quota syncs leave the dirty file alone for a while")
+	realBserv := config.BlockServer()
+	config.SetBlockServer(blockServerPutErr{
+		realBserv, kbfsblock.ServerErrorOverQuota{Throttled: true}})
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.IsType(t, kbfsblock.ServerErrorOverQuota{}, errors.Cause(err))
+	clock.Add(syncOutboxOverQuotaThreshold - time.Second)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.IsType(t, kbfsblock.ServerErrorOverQuota{}, errors.Cause(err))
+	require.Empty(t, outbox.List())
+
+	t.Log("Once it has lasted long enough, the file moves to the outbox")
+	clock.Add(time.Second)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.IsType(t, kbfsblock.ServerErrorOverQuota{}, errors.Cause(err))
+	entries := outbox.List()
+	require.Len(t, entries, 1)
+	require.Equal(t, "a", entries[0].Path)
+
+	t.Log("Retrying while still over quota moves it to a new entry")
+	err = RetrySyncOutboxEntry(ctx, config, entries[0].ID)
+	require.IsType(t, kbfsblock.ServerErrorOverQuota{}, errors.Cause(err))
+	newEntries := outbox.List()
+	require.Len(t, newEntries, 1)
+	require.NotEqual(t, entries[0].ID, newEntries[0].ID)
+
+	t.Log("Retrying once there's space syncs the file")
+	config.SetBlockServer(realBserv)
+	err = RetrySyncOutboxEntry(ctx, config, newEntries[0].ID)
+	require.NoError(t, err)
+	require.Empty(t, outbox.List())
+	buf := make([]byte, len(aData)+1)
+	n, err := kbfsOps.Read(ctx, aNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, aData, buf[:n])
+}
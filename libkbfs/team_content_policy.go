@@ -0,0 +1,263 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// teamContentPolicyFileName is the name of the file, at the root
+	// of a team TLF, that holds the team's content policy.
+	teamContentPolicyFileName = ".kbfs_team_policy"
+	// maxTeamContentPolicyBytes is the largest policy file that's
+	// read.
+	maxTeamContentPolicyBytes = 64 * 1024
+	// teamContentPolicySigPrefix keeps policy signatures from being
+	// valid in any other context.
+	teamContentPolicySigPrefix = "kbfs-team-content-policy-v1"
+)
+
+// TeamSubtreeRule restricts which team members may change a subtree
+// of a team TLF, so that different subgroups of the team can own
+// different areas of the same folder.  A member may change the
+// subtree if their role is at least MinWriteRole, or if they're in
+// Writers.  If MinWriteRole is TeamRole_NONE, only Writers may.
+type TeamSubtreeRule struct {
+	// Path is the slash-separated path of the subtree root,
+	// relative to the TLF root.
+	Path         string
+	MinWriteRole keybase1.TeamRole
+	Writers      map[keybase1.UID]bool
+}
+
+func (r TeamSubtreeRule) allows(
+	uid keybase1.UID, role keybase1.TeamRole) bool {
+	if r.Writers[uid] {
+		return true
+	}
+	return r.MinWriteRole != keybase1.TeamRole_NONE && role >= r.MinWriteRole
+}
+
+// TeamContentPolicy restricts the changes that team members may make
+// to a team TLF.  A team admin sets it with SetTeamContentPolicy,
+// which stores it, signed, in a file at the root of the TLF, and
+// it's enforced by each client in its write paths; the servers know
+// nothing about it.
+type TeamContentPolicy struct {
+	// MaxFileSize, if non-zero, is the largest size a file may be
+	// written or truncated to.
+	MaxFileSize uint64
+	// BannedExtensions are the file name extensions (like ".exe")
+	// that new or renamed entries may not have.  Matching ignores
+	// case.
+	BannedExtensions []string
+	// ReadOnlySubtrees lists subtrees that only some members may
+	// change.
+	ReadOnlySubtrees []TeamSubtreeRule
+	// RetentionLock, if set, keeps the whole history of the TLF, for
+	// teams with compliance requirements.  Quota reclamation, which
+	// is what deletes the blocks only referenced by old revisions,
+	// is disabled, so deleting an entry only hides it from the
+	// latest revision; its blocks stay readable from the earlier
+	// ones.
+	RetentionLock bool
+}
+
+// restrictedTeamContentPolicy is enforced in place of a policy file
+// that can't be verified: only admins may change anything, and
+// nothing is reclaimed, until an admin signs a new policy.
+var restrictedTeamContentPolicy = TeamContentPolicy{
+	ReadOnlySubtrees: []TeamSubtreeRule{
+		{Path: "", MinWriteRole: keybase1.TeamRole_ADMIN},
+	},
+	RetentionLock: true,
+}
+
+// checkSubtrees returns an error if the member `uid`, with the given
+// role, may not change the entry at `relPath`.
+func (p TeamContentPolicy) checkSubtrees(
+	relPath string, uid keybase1.UID, role keybase1.TeamRole) error {
+	for _, rule := range p.ReadOnlySubtrees {
+		subtree := strings.Trim(rule.Path, "/")
+		if subtree != "" && relPath != subtree &&
+			!strings.HasPrefix(relPath, subtree+"/") {
+			continue
+		}
+		if !rule.allows(uid, role) {
+			return TeamReadOnlySubtreeError{relPath, subtree, rule.MinWriteRole}
+		}
+	}
+	return nil
+}
+
+// checkName returns an error if an entry may not be given the name
+// at the end of `relPath`.
+func (p TeamContentPolicy) checkName(relPath string) error {
+	lower := strings.ToLower(relPath[strings.LastIndex(relPath, "/")+1:])
+	for _, ext := range p.BannedExtensions {
+		if ext != "" && strings.HasSuffix(lower, strings.ToLower(ext)) {
+			return TeamBannedExtensionError{relPath, ext}
+		}
+	}
+	return nil
+}
+
+// checkSize returns an error if the file at `relPath` may not end up
+// with the given size.
+func (p TeamContentPolicy) checkSize(relPath string, size uint64) error {
+	if p.MaxFileSize > 0 && size > p.MaxFileSize {
+		return TeamFileTooLargeError{relPath, size, p.MaxFileSize}
+	}
+	return nil
+}
+
+func (p TeamContentPolicy) isEmpty() bool {
+	return p.MaxFileSize == 0 && len(p.BannedExtensions) == 0 &&
+		len(p.ReadOnlySubtrees) == 0 && !p.RetentionLock
+}
+
+// signedTeamContentPolicy is what's stored in the policy file.  Any
+// team writer can write the file, so it's only honored if it's
+// signed by a device of a team admin.
+type signedTeamContentPolicy struct {
+	Policy TeamContentPolicy
+	Signer keybase1.UID
+	Sig    kbfscrypto.SignatureInfo
+}
+
+func teamContentPolicySigMsg(
+	tlfID tlf.ID, codec codecGetter, policy TeamContentPolicy) (
+	[]byte, error) {
+	buf, err := codec.Codec().Encode(policy)
+	if err != nil {
+		return nil, err
+	}
+	return append(
+		[]byte(fmt.Sprintf("%s:%s:", teamContentPolicySigPrefix, tlfID)),
+		buf...), nil
+}
+
+// decodeTeamContentPolicy decodes the contents of the policy file of
+// the team `tid`'s TLF, and makes sure it was signed by a team admin.
+// Only admins may change the policy file itself, so the returned
+// policy also covers it.
+func decodeTeamContentPolicy(ctx context.Context, config Config,
+	tid keybase1.TeamID, tlfID tlf.ID, buf []byte) (
+	TeamContentPolicy, error) {
+	var signed signedTeamContentPolicy
+	err := config.Codec().Decode(buf, &signed)
+	if err != nil {
+		return TeamContentPolicy{}, err
+	}
+	msg, err := teamContentPolicySigMsg(tlfID, config, signed.Policy)
+	if err != nil {
+		return TeamContentPolicy{}, err
+	}
+	err = kbfscrypto.Verify(msg, signed.Sig)
+	if err != nil {
+		return TeamContentPolicy{}, err
+	}
+	err = config.KBPKI().HasVerifyingKey(
+		ctx, signed.Signer, signed.Sig.VerifyingKey, time.Time{})
+	if err != nil {
+		return TeamContentPolicy{}, err
+	}
+	role, err := config.KBPKI().GetTeamRole(ctx, tid, signed.Signer)
+	if err != nil {
+		return TeamContentPolicy{}, err
+	}
+	if role < keybase1.TeamRole_ADMIN {
+		return TeamContentPolicy{}, errors.Errorf(
+			"Team content policy signed by non-admin %s", signed.Signer)
+	}
+
+	policy := signed.Policy
+	policy.ReadOnlySubtrees = append(
+		policy.ReadOnlySubtrees[:len(policy.ReadOnlySubtrees):len(
+			policy.ReadOnlySubtrees)], TeamSubtreeRule{
+			Path:         teamContentPolicyFileName,
+			MinWriteRole: keybase1.TeamRole_ADMIN,
+		})
+	return policy, nil
+}
+
+// SetTeamContentPolicy sets the content policy of the team TLF with
+// root node `rootNode`, and syncs it.  The current user must be an
+// admin of the team.
+func SetTeamContentPolicy(ctx context.Context, config Config,
+	rootNode Node, policy TeamContentPolicy) error {
+	fb := rootNode.GetFolderBranch()
+	if fb.Tlf.Type() != tlf.SingleTeam {
+		return errors.Errorf("%s isn't a team TLF", fb.Tlf)
+	}
+	session, err := config.KBPKI().GetCurrentSession(ctx)
+	if err != nil {
+		return err
+	}
+	msg, err := teamContentPolicySigMsg(fb.Tlf, config, policy)
+	if err != nil {
+		return err
+	}
+	sig, err := config.Signer().SignForKBFS(ctx, msg)
+	if err != nil {
+		return err
+	}
+	buf, err := config.Codec().Encode(signedTeamContentPolicy{
+		Policy: policy,
+		Signer: session.UID,
+		Sig:    sig,
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx = context.WithValue(ctx, CtxAllowNameKey, teamContentPolicyFileName)
+	kbfsOps := config.KBFSOps()
+	node, _, err := kbfsOps.Lookup(ctx, rootNode, teamContentPolicyFileName)
+	switch errors.Cause(err).(type) {
+	case nil:
+	case NoSuchNameError:
+		node, _, err = kbfsOps.CreateFile(
+			ctx, rootNode, teamContentPolicyFileName, false, NoExcl)
+		if err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+	err = kbfsOps.Truncate(ctx, node, 0)
+	if err != nil {
+		return err
+	}
+	err = kbfsOps.Write(ctx, node, buf, 0)
+	if err != nil {
+		return err
+	}
+	return kbfsOps.SyncAll(ctx, fb)
+}
+
+// teamRole returns the role of `uid` in the team described by
+// `info`.
+func teamRole(info TeamInfo, uid keybase1.UID) keybase1.TeamRole {
+	switch {
+	case info.Admins[uid]:
+		return keybase1.TeamRole_ADMIN
+	case info.Writers[uid]:
+		return keybase1.TeamRole_WRITER
+	case info.Readers[uid]:
+		return keybase1.TeamRole_READER
+	default:
+		return keybase1.TeamRole_NONE
+	}
+}
@@ -0,0 +1,391 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	kbname "github.com/keybase/client/go/kbun"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTeamContentPolicyChecks(t *testing.T) {
+	p := TeamContentPolicy{
+		MaxFileSize:      10,
+		BannedExtensions: []string{".exe"},
+		ReadOnlySubtrees: []TeamSubtreeRule{
+			{Path: "/release/", MinWriteRole: keybase1.TeamRole_ADMIN},
+		},
+	}
+
+	require.NoError(t, p.checkName("a/b.txt"))
+	require.IsType(t, TeamBannedExtensionError{}, p.checkName("a/B.EXE"))
+	require.NoError(t, p.checkName("a.exe/b"))
+
+	require.NoError(t, p.checkSize("a", 10))
+	require.IsType(t, TeamFileTooLargeError{}, p.checkSize("a", 11))
+
+	uid := keybase1.MakeTestUID(1)
+	require.NoError(t, p.checkSubtrees(
+		"releases/a", uid, keybase1.TeamRole_WRITER))
+	require.IsType(t, TeamReadOnlySubtreeError{},
+		p.checkSubtrees("release", uid, keybase1.TeamRole_WRITER))
+	require.IsType(t, TeamReadOnlySubtreeError{},
+		p.checkSubtrees("release/a", uid, keybase1.TeamRole_WRITER))
+	require.NoError(t, p.checkSubtrees(
+		"release/a", uid, keybase1.TeamRole_ADMIN))
+
+	t.Log("Listed writers may change a subtree whatever their role")
+	other := keybase1.MakeTestUID(2)
+	p.ReadOnlySubtrees = append(p.ReadOnlySubtrees, TeamSubtreeRule{
+		Path:    "docs",
+		Writers: map[keybase1.UID]bool{uid: true},
+	})
+	require.NoError(t, p.checkSubtrees(
+		"docs/a", uid, keybase1.TeamRole_WRITER))
+	require.IsType(t, TeamReadOnlySubtreeError{},
+		p.checkSubtrees("docs/a", other, keybase1.TeamRole_OWNER))
+}
+
+func TestKBFSOpsTeamContentPolicy(t *testing.T) {
+	var u1, u2 kbname.NormalizedUsername = "u1", "u2"
+	config1, uid1, ctx, cancel := kbfsOpsInitNoMocks(t, u1, u2)
+	defer kbfsTestShutdownNoMocks(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, u2)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	session2, err := config2.KBPKI().GetCurrentSession(ctx)
+	require.NoError(t, err)
+	uid2 := session2.UID
+
+	t.Log("Make u1 an admin and u2 a writer of a team with a policy")
+	name := kbname.NormalizedUsername("t1")
+	teamInfos := AddEmptyTeamsForTestOrBust(t, config1, name)
+	_ = AddEmptyTeamsForTestOrBust(t, config2, name)
+	tid := teamInfos[0].TID
+	policy := TeamContentPolicy{
+		MaxFileSize:      4,
+		BannedExtensions: []string{".exe"},
+		ReadOnlySubtrees: []TeamSubtreeRule{
+			{Path: "release", MinWriteRole: keybase1.TeamRole_ADMIN},
+		},
+	}
+	for _, config := range []Config{config1, config2} {
+		AddTeamAdminForTestOrBust(t, config, tid, uid1)
+		AddTeamWriterForTestOrBust(t, config, tid, uid2)
+	}
+
+	h, err := ParseTlfHandle(
+		ctx, config1.KBPKI(), config1.MDOps(), string(name), tlf.SingleTeam)
+	require.NoError(t, err)
+	kbfsOps1 := config1.KBFSOps()
+	rootNode1, _, err := kbfsOps1.GetOrCreateRootNode(ctx, h, MasterBranch)
+	require.NoError(t, err)
+	err = SetTeamContentPolicy(ctx, config1, rootNode1, policy)
+	require.NoError(t, err)
+
+	t.Log("The admin can write to the read-only subtree")
+	releaseNode1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "release")
+	require.NoError(t, err)
+	_, _, err = kbfsOps1.CreateFile(ctx, releaseNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	kbfsOps2 := config2.KBFSOps()
+	rootNode2, _, err := kbfsOps2.GetOrCreateRootNode(ctx, h, MasterBranch)
+	require.NoError(t, err)
+
+	t.Log("The writer can't change the read-only subtree")
+	releaseNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "release")
+	require.NoError(t, err)
+	_, _, err = kbfsOps2.CreateFile(ctx, releaseNode2, "b", false, NoExcl)
+	require.IsType(t, TeamReadOnlySubtreeError{}, errors.Cause(err))
+	err = kbfsOps2.RemoveEntry(ctx, releaseNode2, "a")
+	require.IsType(t, TeamReadOnlySubtreeError{}, errors.Cause(err))
+	aNode2, _, err := kbfsOps2.Lookup(ctx, releaseNode2, "a")
+	require.NoError(t, err)
+	err = kbfsOps2.Write(ctx, aNode2, []byte{1}, 0)
+	require.IsType(t, TeamReadOnlySubtreeError{}, errors.Cause(err))
+
+	t.Log("The writer can't use banned extensions")
+	_, _, err = kbfsOps2.CreateFile(ctx, rootNode2, "b.EXE", false, NoExcl)
+	require.IsType(t, TeamBannedExtensionError{}, errors.Cause(err))
+	bNode2, _, err := kbfsOps2.CreateFile(ctx, rootNode2, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps2.Rename(ctx, rootNode2, "b", rootNode2, "b.exe")
+	require.IsType(t, TeamBannedExtensionError{}, errors.Cause(err))
+
+	t.Log("The writer can't grow a file past the limit")
+	err = kbfsOps2.Write(ctx, bNode2, []byte{1, 2, 3, 4}, 0)
+	require.NoError(t, err)
+	err = kbfsOps2.Write(ctx, bNode2, []byte{5}, 4)
+	require.IsType(t, TeamFileTooLargeError{}, errors.Cause(err))
+	err = kbfsOps2.Truncate(ctx, bNode2, 5)
+	require.IsType(t, TeamFileTooLargeError{}, errors.Cause(err))
+	err = kbfsOps2.SyncAll(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+
+	t.Log("The writer can't change the policy")
+	err = SetTeamContentPolicy(ctx, config2, rootNode2, TeamContentPolicy{})
+	require.IsType(t, TeamReadOnlySubtreeError{}, errors.Cause(err))
+
+	t.Log("Only a policy signed by an admin is honored")
+	for _, c := range []struct {
+		config Config
+		ok     bool
+	}{{config1, true}, {config2, false}} {
+		session, err := c.config.KBPKI().GetCurrentSession(ctx)
+		require.NoError(t, err)
+		msg, err := teamContentPolicySigMsg(rootNode1.GetFolderBranch().Tlf, c.config, policy)
+		require.NoError(t, err)
+		sig, err := c.config.Signer().SignForKBFS(ctx, msg)
+		require.NoError(t, err)
+		buf, err := c.config.Codec().Encode(signedTeamContentPolicy{
+			Policy: policy,
+			Signer: session.UID,
+			Sig:    sig,
+		})
+		require.NoError(t, err)
+		_, err = decodeTeamContentPolicy(ctx, config1, tid, rootNode1.GetFolderBranch().Tlf, buf)
+		require.Equal(t, c.ok, err == nil, "%+v", err)
+	}
+}
+
+func TestKBFSOpsTeamContentPolicyFailsClosed(t *testing.T) {
+	var u1, u2 kbname.NormalizedUsername = "u1", "u2"
+	config1, uid1, ctx, cancel := kbfsOpsInitNoMocks(t, u1, u2)
+	defer kbfsTestShutdownNoMocks(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, u2)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	session2, err := config2.KBPKI().GetCurrentSession(ctx)
+	require.NoError(t, err)
+	uid2 := session2.UID
+
+	t.Log("u2 is only an admin in its own view of the team")
+	name := kbname.NormalizedUsername("t1")
+	teamInfos := AddEmptyTeamsForTestOrBust(t, config1, name)
+	_ = AddEmptyTeamsForTestOrBust(t, config2, name)
+	tid := teamInfos[0].TID
+	for _, config := range []Config{config1, config2} {
+		AddTeamAdminForTestOrBust(t, config, tid, uid1)
+		AddTeamWriterForTestOrBust(t, config, tid, uid2)
+	}
+	AddTeamAdminForTestOrBust(t, config2, tid, uid2)
+
+	h, err := ParseTlfHandle(
+		ctx, config1.KBPKI(), config1.MDOps(), string(name), tlf.SingleTeam)
+	require.NoError(t, err)
+	kbfsOps1 := config1.KBFSOps()
+	rootNode1, _, err := kbfsOps1.GetOrCreateRootNode(ctx, h, MasterBranch)
+	require.NoError(t, err)
+	kbfsOps2 := config2.KBFSOps()
+	rootNode2, _, err := kbfsOps2.GetOrCreateRootNode(ctx, h, MasterBranch)
+	require.NoError(t, err)
+	err = SetTeamContentPolicy(ctx, config2, rootNode2, TeamContentPolicy{})
+	require.NoError(t, err)
+
+	t.Log("u1 can't verify the policy, so reports it and restricts the TLF")
+	err = kbfsOps1.SyncFromServer(ctx, rootNode1.GetFolderBranch(), nil)
+	require.NoError(t, err)
+	ops1 := getOps(config1, rootNode1.GetFolderBranch().Tlf)
+	head, _ := ops1.getHead(makeFBOLockState())
+	locked, err := ops1.isRetentionLocked(ctx, head)
+	require.NoError(t, err)
+	require.True(t, locked)
+	reported := false
+	for _, re := range config1.Reporter().AllKnownErrors() {
+		if _, ok := re.Error.(InvalidTeamContentPolicyError); ok {
+			reported = true
+		}
+	}
+	require.True(t, reported)
+
+	t.Log("u1 rejects u2's later changes")
+	_, _, err = kbfsOps2.CreateDir(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	err = kbfsOps2.SyncAll(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps1.SyncFromServer(ctx, rootNode1.GetFolderBranch(), nil)
+	require.IsType(t, UnauthorizedSubtreeWriteError{}, errors.Cause(err))
+
+	t.Log("The admin can still replace the policy")
+	config1b := ConfigAsUser(config1, u1)
+	defer CheckConfigAndShutdown(ctx, t, config1b)
+	AddEmptyTeamsForTestOrBust(t, config1b, name)
+	AddTeamAdminForTestOrBust(t, config1b, tid, uid1)
+	AddTeamWriterForTestOrBust(t, config1b, tid, uid2)
+	rootNode1b, _, err := config1b.KBFSOps().GetOrCreateRootNode(
+		ctx, h, MasterBranch)
+	require.NoError(t, err)
+	err = SetTeamContentPolicy(ctx, config1b, rootNode1b, TeamContentPolicy{})
+	require.NoError(t, err)
+}
+
+func TestKBFSOpsTeamSubtreeWriters(t *testing.T) {
+	var u1, u2 kbname.NormalizedUsername = "u1", "u2"
+	config1, uid1, ctx, cancel := kbfsOpsInitNoMocks(t, u1, u2)
+	defer kbfsTestShutdownNoMocks(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, u2)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	session2, err := config2.KBPKI().GetCurrentSession(ctx)
+	require.NoError(t, err)
+	uid2 := session2.UID
+
+	t.Log("Give u2 sole ownership of a subtree, even over admin u1")
+	name := kbname.NormalizedUsername("t1")
+	teamInfos := AddEmptyTeamsForTestOrBust(t, config1, name)
+	_ = AddEmptyTeamsForTestOrBust(t, config2, name)
+	tid := teamInfos[0].TID
+	policy := TeamContentPolicy{
+		ReadOnlySubtrees: []TeamSubtreeRule{{
+			Path:    "u2-area",
+			Writers: map[keybase1.UID]bool{uid2: true},
+		}, {
+			Path:         "release",
+			MinWriteRole: keybase1.TeamRole_ADMIN,
+		}},
+	}
+	for _, config := range []Config{config1, config2} {
+		AddTeamAdminForTestOrBust(t, config, tid, uid1)
+		AddTeamWriterForTestOrBust(t, config, tid, uid2)
+	}
+
+	h, err := ParseTlfHandle(
+		ctx, config1.KBPKI(), config1.MDOps(), string(name), tlf.SingleTeam)
+	require.NoError(t, err)
+	kbfsOps1 := config1.KBFSOps()
+	rootNode1, _, err := kbfsOps1.GetOrCreateRootNode(ctx, h, MasterBranch)
+	require.NoError(t, err)
+	err = SetTeamContentPolicy(ctx, config1, rootNode1, policy)
+	require.NoError(t, err)
+	_, _, err = kbfsOps1.CreateDir(ctx, rootNode1, "u2-area")
+	require.IsType(t, TeamReadOnlySubtreeError{}, errors.Cause(err))
+
+	t.Log("u2 can populate the subtree, and u1 accepts the update")
+	kbfsOps2 := config2.KBFSOps()
+	rootNode2, _, err := kbfsOps2.GetOrCreateRootNode(ctx, h, MasterBranch)
+	require.NoError(t, err)
+	_, _, err = kbfsOps2.CreateDir(ctx, rootNode2, "u2-area")
+	require.NoError(t, err)
+	err = kbfsOps2.SyncAll(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps1.SyncFromServer(ctx, rootNode1.GetFolderBranch(), nil)
+	require.NoError(t, err)
+	areaNode1, _, err := kbfsOps1.Lookup(ctx, rootNode1, "u2-area")
+	require.NoError(t, err)
+	_, _, err = kbfsOps1.CreateFile(ctx, areaNode1, "a", false, NoExcl)
+	require.IsType(t, TeamReadOnlySubtreeError{}, errors.Cause(err))
+
+	t.Log("An update that breaks the policy is rejected, and reported")
+	// Simulate a client that doesn't enforce the policy by making u2
+	// an admin in its own view of the team only.
+	AddTeamAdminForTestOrBust(t, config2, tid, uid2)
+	_, _, err = kbfsOps2.CreateDir(ctx, rootNode2, "release")
+	require.NoError(t, err)
+	err = kbfsOps2.SyncAll(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps1.SyncFromServer(ctx, rootNode1.GetFolderBranch(), nil)
+	require.IsType(t, UnauthorizedSubtreeWriteError{}, errors.Cause(err))
+	_, _, err = kbfsOps1.Lookup(ctx, rootNode1, "release")
+	require.IsType(t, NoSuchNameError{}, errors.Cause(err))
+	reported := false
+	for _, re := range config1.Reporter().AllKnownErrors() {
+		if _, ok := re.Error.(UnauthorizedSubtreeWriteError); ok {
+			reported = true
+		}
+	}
+	require.True(t, reported)
+
+	t.Log("A revision with a gap before it isn't applied unchecked")
+	_, _, err = kbfsOps2.CreateDir(ctx, rootNode2, "b")
+	require.NoError(t, err)
+	err = kbfsOps2.SyncAll(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	ops1 := getOps(config1, rootNode1.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	head, _ := ops1.getHead(lState)
+	rmds, err := getMergedMDUpdatesWithEnd(ctx, config1,
+		head.TlfID(), head.Revision()+2, head.Revision()+2, nil)
+	require.NoError(t, err)
+	require.Len(t, rmds, 1)
+	rmds, err = ops1.checkMergedMDUpdates(ctx, lState, rmds)
+	require.IsType(t, kbfsmd.MDRevisionMismatch{}, errors.Cause(err))
+	require.Len(t, rmds, 0)
+}
+
+func TestQuotaReclamationRetentionLock(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, uid, ctx, cancel := kbfsOpsInitNoMocks(t, u1)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	clock, now := newTestClockAndTimeNow()
+	config.SetClock(clock)
+
+	t.Log("Make a retention-locked team TLF")
+	name := kbname.NormalizedUsername("t1")
+	teamInfos := AddEmptyTeamsForTestOrBust(t, config, name)
+	tid := teamInfos[0].TID
+	AddTeamAdminForTestOrBust(t, config, tid, uid)
+	h, err := ParseTlfHandle(
+		ctx, config.KBPKI(), config.MDOps(), string(name), tlf.SingleTeam)
+	require.NoError(t, err)
+	kbfsOps := config.KBFSOps()
+	rootNode, _, err := kbfsOps.GetOrCreateRootNode(ctx, h, MasterBranch)
+	require.NoError(t, err)
+	fb := rootNode.GetFolderBranch()
+	err = SetTeamContentPolicy(
+		ctx, config, rootNode, TeamContentPolicy{RetentionLock: true})
+	require.NoError(t, err)
+
+	t.Log("Create and delete a file, then make a much later revision")
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	err = kbfsOps.RemoveEntry(ctx, rootNode, "a")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	clock.Set(now.Add(2 * config.Mode().QuotaReclamationMinUnrefAge()))
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "b")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	err = kbfsOps.SyncFromServer(ctx, fb, nil)
+	require.NoError(t, err)
+
+	bserverLocal, ok := config.BlockServer().(blockServerLocal)
+	require.True(t, ok)
+	preQRBlocks, err := bserverLocal.getAllRefsForTest(ctx, fb.Tlf)
+	require.NoError(t, err)
+
+	t.Log("Quota reclamation leaves the history alone")
+	ops := getOps(config, fb.Tlf)
+	ops.fbm.forceQuotaReclamation()
+	err = ops.fbm.waitForQuotaReclamations(ctx)
+	require.NoError(t, err)
+	postQRBlocks, err := bserverLocal.getAllRefsForTest(ctx, fb.Tlf)
+	require.NoError(t, err)
+	require.Equal(t, preQRBlocks, postQRBlocks)
+
+	t.Log("Once the lock is lifted, the history is reclaimed")
+	err = SetTeamContentPolicy(ctx, config, rootNode, TeamContentPolicy{})
+	require.NoError(t, err)
+	ops.fbm.forceQuotaReclamation()
+	err = ops.fbm.waitForQuotaReclamations(ctx)
+	require.NoError(t, err)
+	postQRBlocks, err = bserverLocal.getAllRefsForTest(ctx, fb.Tlf)
+	require.NoError(t, err)
+	require.True(t,
+		totalBlockRefs(postQRBlocks) < totalBlockRefs(preQRBlocks))
+}
@@ -55,9 +55,19 @@ func newConfigForTest(modeType InitModeType, loggerFn func(module string) logger
 	if err != nil {
 		panic(err)
 	}
+	dirHashBuckets, err := getDirHashBuckets()
+	if err != nil {
+		panic(err)
+	}
 
 	config.SetBlockSplitter(&BlockSplitterSimple{
-		64 * 1024, 64 * 1024 / int(bpSize), 8 * 1024, maxDirEntriesPerBlock})
+		64 * 1024, 64 * 1024 / int(bpSize), 8 * 1024, maxDirEntriesPerBlock,
+		dirHashBuckets})
+
+	// Don't make background work wait for the test to go idle, or
+	// depend on the power state of the machine running the test.
+	config.IdleTracker().SetThreshold(0)
+	config.PowerMonitor().SetPowerState(PowerState{})
 
 	return config
 }
@@ -530,6 +540,27 @@ func AddTeamReaderForTestOrBust(t logger.TestLogBackend, config Config,
 	}
 }
 
+// AddTeamAdminForTest makes the given user a team admin.
+func AddTeamAdminForTest(
+	config Config, tid keybase1.TeamID, uid keybase1.UID) error {
+	kbd, ok := config.KeybaseService().(*KeybaseDaemonLocal)
+	if !ok {
+		return errors.New("Bad keybase daemon")
+	}
+
+	return kbd.addTeamAdminForTest(tid, uid)
+}
+
+// AddTeamAdminForTestOrBust is like AddTeamAdminForTest, but
+// dies if there's an error.
+func AddTeamAdminForTestOrBust(t logger.TestLogBackend, config Config,
+	tid keybase1.TeamID, uid keybase1.UID) {
+	err := AddTeamAdminForTest(config, tid, uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 // AddTeamKeyForTest adds a new key for the given team.
 func AddTeamKeyForTest(config Config, tid keybase1.TeamID) error {
 	kbd, ok := config.KeybaseService().(*KeybaseDaemonLocal)
@@ -717,7 +748,7 @@ func testRPCWithCanceledContext(t logger.TestLogBackend,
 // notifications
 func DisableUpdatesForTesting(config Config, folderBranch FolderBranch) (
 	chan<- struct{}, error) {
-	kbfsOps, ok := config.KBFSOps().(*KBFSOpsStandard)
+	kbfsOps, ok := standardKBFSOps(config.KBFSOps())
 	if !ok {
 		return nil, errors.New("Unexpected KBFSOps type")
 	}
@@ -731,7 +762,7 @@ func DisableUpdatesForTesting(config Config, folderBranch FolderBranch) (
 // DisableCRForTesting stops conflict resolution for the given folder.
 // RestartCRForTesting should be called to restart it.
 func DisableCRForTesting(config Config, folderBranch FolderBranch) error {
-	kbfsOps, ok := config.KBFSOps().(*KBFSOpsStandard)
+	kbfsOps, ok := standardKBFSOps(config.KBFSOps())
 	if !ok {
 		return errors.New("Unexpected KBFSOps type")
 	}
@@ -745,7 +776,7 @@ func DisableCRForTesting(config Config, folderBranch FolderBranch) error {
 // folder.  baseCtx must have a cancellation delayer.
 func RestartCRForTesting(baseCtx context.Context, config Config,
 	folderBranch FolderBranch) error {
-	kbfsOps, ok := config.KBFSOps().(*KBFSOpsStandard)
+	kbfsOps, ok := standardKBFSOps(config.KBFSOps())
 	if !ok {
 		return errors.New("Unexpected KBFSOps type")
 	}
@@ -766,7 +797,7 @@ func RestartCRForTesting(baseCtx context.Context, config Config,
 // the given config, for the given folder-branch.
 func ForceQuotaReclamationForTesting(config Config,
 	folderBranch FolderBranch) error {
-	kbfsOps, ok := config.KBFSOps().(*KBFSOpsStandard)
+	kbfsOps, ok := standardKBFSOps(config.KBFSOps())
 	if !ok {
 		return errors.New("Unexpected KBFSOps type")
 	}
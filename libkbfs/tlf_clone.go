@@ -0,0 +1,340 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// TLFCloneProgress describes how much of a TLF has been copied so far
+// by CloneTLF.
+type TLFCloneProgress struct {
+	Entries int
+	Bytes   int64
+}
+
+// nodeReader is an io.Reader over the contents of a file node.
+type nodeReader struct {
+	ctx     context.Context
+	kbfsOps KBFSOps
+	node    Node
+	off     int64
+}
+
+func (nr *nodeReader) Read(p []byte) (int, error) {
+	n, err := nr.kbfsOps.Read(nr.ctx, nr.node, p, nr.off)
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	nr.off += n
+	return int(n), nil
+}
+
+// tlfCloner copies a directory tree from one TLF to another.
+type tlfCloner struct {
+	kbfsOps  KBFSOps
+	progress func(TLFCloneProgress)
+	done     TLFCloneProgress
+}
+
+func (tc *tlfCloner) entryDone(bytes int64) {
+	tc.done.Entries++
+	tc.done.Bytes += bytes
+	if tc.progress != nil {
+		tc.progress(tc.done)
+	}
+}
+
+// copyDir copies all the children of `src` into `dst`, and then sets
+// their times to match the originals.
+func (tc *tlfCloner) copyDir(ctx context.Context, src, dst Node) error {
+	children, err := tc.kbfsOps.GetDirChildren(ctx, src)
+	if err != nil {
+		return err
+	}
+
+	times := make([]NodeTimes, 0, len(children))
+	for name, ei := range children {
+		var newNode Node
+		switch ei.Type {
+		case Dir:
+			srcChild, _, err := tc.kbfsOps.Lookup(ctx, src, name)
+			if err != nil {
+				return err
+			}
+			newNode, _, err = tc.kbfsOps.CreateDir(ctx, dst, name)
+			if err != nil {
+				return err
+			}
+			err = tc.copyDir(ctx, srcChild, newNode)
+			if err != nil {
+				return err
+			}
+			tc.entryDone(0)
+		case File, Exec:
+			srcChild, _, err := tc.kbfsOps.Lookup(ctx, src, name)
+			if err != nil {
+				return err
+			}
+			// `dst` started out empty, so there's no need for an
+			// exclusive create, which would sync every new file.
+			newNode, _, err = tc.kbfsOps.CreateFile(
+				ctx, dst, name, ei.Type == Exec, NoExcl)
+			if err != nil {
+				return err
+			}
+			n, err := tc.kbfsOps.WriteStream(ctx, newNode, &nodeReader{
+				ctx:     ctx,
+				kbfsOps: tc.kbfsOps,
+				node:    srcChild,
+			}, 0)
+			if err != nil {
+				return err
+			}
+			tc.entryDone(n)
+		case Sym:
+			_, err := tc.kbfsOps.CreateLink(ctx, dst, name, ei.SymPath)
+			if err != nil {
+				return err
+			}
+			tc.entryDone(0)
+			// Symlinks have no node, so their times can't be set.
+			continue
+		default:
+			return errors.Errorf("Unknown entry type %s for %s", ei.Type, name)
+		}
+
+		ctime := time.Unix(0, ei.Ctime)
+		times = append(times, NodeTimes{
+			Node:  newNode,
+			Mtime: time.Unix(0, ei.Mtime),
+			Ctime: &ctime,
+		})
+	}
+
+	if len(times) == 0 {
+		return nil
+	}
+	return tc.kbfsOps.SetTimesBatch(ctx, times)
+}
+
+func (tc *tlfCloner) copyLocalFile(
+	ctx context.Context, src string, dst Node) (int64, error) {
+	f, err := ioutil.OpenFile(src, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return tc.kbfsOps.WriteStream(ctx, dst, f, 0)
+}
+
+// copyLocalDir copies all the entries under the local directory
+// `src` into `dst`, and then sets their mtimes to match the
+// originals.  Special files, like devices and sockets, are skipped.
+func (tc *tlfCloner) copyLocalDir(
+	ctx context.Context, src string, dst Node) error {
+	fileInfos, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+
+	times := make([]NodeTimes, 0, len(fileInfos))
+	for _, fi := range fileInfos {
+		name := fi.Name()
+		srcPath := filepath.Join(src, name)
+		mode := fi.Mode()
+		var newNode Node
+		switch {
+		case mode.IsDir():
+			newNode, _, err = tc.kbfsOps.CreateDir(ctx, dst, name)
+			if err != nil {
+				return err
+			}
+			err = tc.copyLocalDir(ctx, srcPath, newNode)
+			if err != nil {
+				return err
+			}
+			tc.entryDone(0)
+		case mode.IsRegular():
+			newNode, _, err = tc.kbfsOps.CreateFile(
+				ctx, dst, name, mode&0100 != 0, NoExcl)
+			if err != nil {
+				return err
+			}
+			n, err := tc.copyLocalFile(ctx, srcPath, newNode)
+			if err != nil {
+				return err
+			}
+			tc.entryDone(n)
+		case mode&os.ModeSymlink != 0:
+			target, err := os.Readlink(srcPath)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			_, err = tc.kbfsOps.CreateLink(ctx, dst, name, target)
+			if err != nil {
+				return err
+			}
+			tc.entryDone(0)
+			continue
+		default:
+			continue
+		}
+
+		times = append(times, NodeTimes{Node: newNode, Mtime: fi.ModTime()})
+	}
+
+	if len(times) == 0 {
+		return nil
+	}
+	return tc.kbfsOps.SetTimesBatch(ctx, times)
+}
+
+// getOrCreateEmptyRoot returns the root node of the TLF for `h`,
+// creating the TLF if needed, and returns an error if it already has
+// any entries.
+func getOrCreateEmptyRoot(
+	ctx context.Context, kbfsOps KBFSOps, h *TlfHandle) (Node, error) {
+	root, _, err := kbfsOps.GetOrCreateRootNode(ctx, h, MasterBranch)
+	if err != nil {
+		return nil, err
+	}
+	children, err := kbfsOps.GetDirChildren(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+	if len(children) > 0 {
+		return nil, errors.Errorf("%s is not empty", h.GetCanonicalPath())
+	}
+	return root, nil
+}
+
+// CloneTLF creates the TLF for `dst`, which must not have any entries
+// yet, and fills it with a copy of the contents of `src` as of
+// revision `rev`, or as of its latest revision if `rev` is
+// kbfsmd.RevisionUninitialized.  Entry types, exec bits, symlink
+// targets, and times are preserved.  If `progress` is non-nil, it is
+// called after each entry is copied.
+//
+// Every block is encrypted with keys belonging to its own TLF, and
+// the block server only accepts new references to a block from the
+// TLF that put it, so no block of `src` can be re-referenced by
+// `dst`.  Instead, all file data is read back and written again
+// under the keys of `dst`, in bounded batches via WriteStream; only
+// the reads of blocks already in the local caches are cheap.
+func CloneTLF(ctx context.Context, config Config, src *TlfHandle,
+	rev kbfsmd.Revision, dst *TlfHandle,
+	progress func(TLFCloneProgress)) error {
+	kbfsOps := config.KBFSOps()
+	branch := MasterBranch
+	if rev != kbfsmd.RevisionUninitialized {
+		branch = MakeRevBranchName(rev)
+	}
+	srcRoot, _, err := kbfsOps.GetRootNode(ctx, src, branch)
+	if err != nil {
+		return err
+	}
+	if srcRoot == nil {
+		return errors.Errorf("%s doesn't exist", src.GetCanonicalPath())
+	}
+
+	dstRoot, err := getOrCreateEmptyRoot(ctx, kbfsOps, dst)
+	if err != nil {
+		return err
+	}
+	if dstRoot.GetFolderBranch().Tlf == srcRoot.GetFolderBranch().Tlf {
+		return errors.Errorf("Can't clone %s into itself",
+			src.GetCanonicalPath())
+	}
+
+	tc := &tlfCloner{kbfsOps: kbfsOps, progress: progress}
+	err = tc.copyDir(ctx, srcRoot, dstRoot)
+	if err != nil {
+		return err
+	}
+	return kbfsOps.SyncAll(ctx, dstRoot.GetFolderBranch())
+}
+
+// TeamTLFSeed describes the initial contents of a team TLF created
+// by CreateTeamTLF.  At most one of its fields may be set; if
+// neither is, the TLF is created empty.
+type TeamTLFSeed struct {
+	// LocalDir is a local directory whose whole tree is copied into
+	// the TLF.
+	LocalDir string
+	// Template is an existing TLF whose latest contents are copied
+	// into the TLF, as by CloneTLF.
+	Template *TlfHandle
+	// MaxBlockSize, if non-zero, is the block size used for the data
+	// of the new TLF (see `KBFSOps.SetTlfBlockSize`).
+	MaxBlockSize int64
+}
+
+// CreateTeamTLF resolves the handle of the TLF for the existing team
+// `teamName`, creates that TLF, which must not have any entries yet,
+// and fills it with the contents described by `seed`.  If `progress`
+// is non-nil, it is called after each entry is copied.  It returns
+// the handle of the new TLF.
+func CreateTeamTLF(ctx context.Context, config Config, teamName string,
+	seed TeamTLFSeed, progress func(TLFCloneProgress)) (*TlfHandle, error) {
+	if seed.LocalDir != "" && seed.Template != nil {
+		return nil, errors.New(
+			"Can't seed a TLF from both a local directory and a template")
+	}
+
+	h, err := GetHandleFromFolderNameAndType(
+		ctx, config.KBPKI(), config.MDOps(), teamName, tlf.SingleTeam)
+	if err != nil {
+		return nil, err
+	}
+
+	kbfsOps := config.KBFSOps()
+	root, err := getOrCreateEmptyRoot(ctx, kbfsOps, h)
+	if err != nil {
+		return nil, err
+	}
+	if seed.MaxBlockSize != 0 {
+		// Set the block size before any data is written, so that
+		// the seeded contents use it too.
+		err = kbfsOps.SetTlfBlockSize(
+			ctx, root.GetFolderBranch(), seed.MaxBlockSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if seed.Template != nil {
+		err = CloneTLF(ctx, config, seed.Template,
+			kbfsmd.RevisionUninitialized, h, progress)
+		if err != nil {
+			return nil, err
+		}
+		return h, nil
+	}
+	if seed.LocalDir != "" {
+		tc := &tlfCloner{kbfsOps: kbfsOps, progress: progress}
+		err = tc.copyLocalDir(ctx, seed.LocalDir, root)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = kbfsOps.SyncAll(ctx, root.GetFolderBranch())
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
@@ -0,0 +1,135 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCloneTLF(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1", "u2")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	kbfsOps := config.KBFSOps()
+
+	t.Log("Populate the source TLF")
+	src := "/keybase/private/u1"
+	err := kbfsOps.WriteFileAt(ctx, src+"/a", []byte{1, 2, 3})
+	require.NoError(t, err)
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	execNode, _, err := kbfsOps.CreateFile(ctx, dirNode, "x", true, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, execNode, []byte{4}, 0)
+	require.NoError(t, err)
+	_, err = kbfsOps.CreateLink(ctx, rootNode, "l", "d/x")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	aInfo, err := kbfsOps.StatAt(ctx, src+"/a")
+	require.NoError(t, err)
+
+	t.Log("Change the source after the revision being cloned")
+	rev := getOps(config, rootNode.GetFolderBranch().Tlf).getCurrMDRevision(
+		makeFBOLockState())
+	err = kbfsOps.WriteFileAt(ctx, src+"/b", []byte{5})
+	require.NoError(t, err)
+
+	t.Log("Clone into a new TLF")
+	h, err := kbfsOps.GetTLFHandle(ctx, rootNode)
+	require.NoError(t, err)
+	dst, err := ParseTlfHandle(
+		ctx, config.KBPKI(), config.MDOps(), "u1,u2", tlf.Private)
+	require.NoError(t, err)
+	var last TLFCloneProgress
+	err = CloneTLF(ctx, config, h, rev, dst, func(p TLFCloneProgress) {
+		last = p
+	})
+	require.NoError(t, err)
+	require.Equal(t, TLFCloneProgress{Entries: 4, Bytes: 4}, last)
+
+	dstPath := "/keybase/private/u1,u2"
+	children, err := kbfsOps.ListAt(ctx, dstPath)
+	require.NoError(t, err)
+	require.Len(t, children, 3)
+	require.Equal(t, Sym, children["l"].Type)
+	require.Equal(t, "d/x", children["l"].SymPath)
+	require.Equal(t, aInfo.Mtime, children["a"].Mtime)
+	data, err := kbfsOps.ReadFileAt(ctx, dstPath+"/a")
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2, 3}, data)
+	data, err = kbfsOps.ReadFileAt(ctx, dstPath+"/l")
+	require.NoError(t, err)
+	require.Equal(t, []byte{4}, data)
+	ei, err := kbfsOps.StatAt(ctx, dstPath+"/d/x")
+	require.NoError(t, err)
+	require.Equal(t, Exec, ei.Type)
+
+	t.Log("Cloning into a non-empty TLF fails")
+	err = CloneTLF(ctx, config, h, kbfsmd.RevisionUninitialized, dst, nil)
+	require.Error(t, err)
+}
+
+func TestCreateTeamTLFFromLocalDir(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	kbfsOps := config.KBFSOps()
+	session, err := config.KBPKI().GetCurrentSession(ctx)
+	require.NoError(t, err)
+	teamInfos := AddEmptyTeamsForTestOrBust(t, config, "t1")
+	AddTeamWriterForTestOrBust(t, config, teamInfos[0].TID, session.UID)
+
+	t.Log("Populate a local directory")
+	tempdir, err := ioutil.TempDir(os.TempDir(), "team_tlf_seed")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+	err = ioutil.WriteFile(filepath.Join(tempdir, "a"), []byte{1, 2}, 0600)
+	require.NoError(t, err)
+	err = ioutil.MkdirAll(filepath.Join(tempdir, "d"), 0700)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(tempdir, "d", "x"), []byte{3}, 0700)
+	require.NoError(t, err)
+	err = os.Symlink("d/x", filepath.Join(tempdir, "l"))
+	require.NoError(t, err)
+
+	t.Log("Create the team TLF from it")
+	var last TLFCloneProgress
+	h, err := CreateTeamTLF(ctx, config, "t1", TeamTLFSeed{
+		LocalDir: tempdir,
+	}, func(p TLFCloneProgress) {
+		last = p
+	})
+	require.NoError(t, err)
+	require.Equal(t, tlf.SingleTeam, h.Type())
+	require.Equal(t, TLFCloneProgress{Entries: 4, Bytes: 3}, last)
+
+	dstPath := "/keybase/team/t1"
+	children, err := kbfsOps.ListAt(ctx, dstPath)
+	require.NoError(t, err)
+	require.Len(t, children, 3)
+	require.Equal(t, "d/x", children["l"].SymPath)
+	data, err := kbfsOps.ReadFileAt(ctx, dstPath+"/a")
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2}, data)
+	ei, err := kbfsOps.StatAt(ctx, dstPath+"/d/x")
+	require.NoError(t, err)
+	require.Equal(t, Exec, ei.Type)
+
+	t.Log("Seeding a non-empty TLF fails")
+	_, err = CreateTeamTLF(ctx, config, "t1", TeamTLFSeed{
+		LocalDir: tempdir,
+	}, nil)
+	require.Error(t, err)
+}
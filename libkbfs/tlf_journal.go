@@ -7,6 +7,7 @@ package libkbfs
 import (
 	"fmt"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 
@@ -47,6 +48,7 @@ type tlfJournalConfig interface {
 	diskLimitTimeout() time.Duration
 	teamMembershipChecker() kbfsmd.TeamMembershipChecker
 	BGFlushDirOpBatchSize() int
+	PowerMonitor() *PowerMonitor
 }
 
 // tlfJournalConfigWrapper is an adapter for Config objects to the
@@ -124,6 +126,23 @@ type TLFJournalStatus struct {
 	QuotaUsedBytes  int64
 	QuotaLimitBytes int64
 	LastFlushErr    string `json:",omitempty"`
+	// CrashRepair is set if the journal had to be repaired when
+	// it was opened, after a crash interrupted a write to it.
+	CrashRepair *TLFJournalRepairStatus `json:",omitempty"`
+}
+
+// TLFJournalRepairStatus describes how a TLF's journal was repaired
+// on startup.  Any changes in the dropped MD revisions were lost.
+type TLFJournalRepairStatus struct {
+	RebuiltOrdinals     bool
+	DroppedBlockOps     uint64
+	DroppedRevisionsMin kbfsmd.Revision `json:",omitempty"`
+	DroppedRevisionsMax kbfsmd.Revision `json:",omitempty"`
+	// LostPaths lists the files and directories changed by the
+	// dropped MD revisions, as far as they could still be read, so
+	// that the user knows which changes to make again.  It's only
+	// filled in by getJournalStatusWithPaths.
+	LostPaths []string `json:",omitempty"`
 }
 
 // TLFJournalBackgroundWorkStatus indicates whether a journal should
@@ -257,6 +276,9 @@ type tlfJournal struct {
 	needResumeCh      chan struct{}
 	needShutdownCh    chan struct{}
 	needBranchCheckCh chan struct{}
+	// flushNowCh cuts short any power-policy delay of the current
+	// flush, because someone is waiting for it.
+	flushNowCh chan struct{}
 
 	// Track the ways in which the journal is paused.  We don't allow
 	// work to resume unless a resume has come in corresponding to
@@ -285,11 +307,15 @@ type tlfJournal struct {
 	// instead.
 	journalLock sync.RWMutex
 	// both of these are nil after shutdown() is called.
-	blockJournal   *blockJournal
-	mdJournal      *mdJournal
-	disabled       bool
-	lastFlushErr   error
-	unflushedPaths *unflushedPathCache
+	blockJournal *blockJournal
+	mdJournal    *mdJournal
+	disabled     bool
+	lastFlushErr error
+	crashRepair  *TLFJournalRepairStatus
+	// crashLostPathsDone is true once crashRepair.LostPaths has
+	// been filled in.
+	crashLostPathsDone bool
+	unflushedPaths     *unflushedPathCache
 	// An estimate of how many bytes have been written since the last
 	// squash.
 	unsquashedBytes uint64
@@ -304,6 +330,11 @@ type tlfJournal struct {
 	needInfoFile        bool
 
 	bwDelegate tlfJournalBWDelegate
+
+	// flushedBlocks remembers the blocks recently flushed to the
+	// server, so new block puts can be deduplicated against them.
+	// It has its own lock.
+	flushedBlocks *flushedBlockFilter
 }
 
 func getTLFJournalInfoFilePath(dir string) string {
@@ -345,6 +376,81 @@ func writeTLFJournalInfoFile(dir string, uid keybase1.UID,
 	return ioutil.SerializeToJSONFile(info, getTLFJournalInfoFilePath(dir))
 }
 
+func getTLFJournalCleanShutdownFilePath(dir string) string {
+	return filepath.Join(dir, "clean_shutdown.json")
+}
+
+// tlfJournalCleanShutdown is the structure stored in
+// getTLFJournalCleanShutdownFilePath(dir) when a journal is shut down
+// cleanly.  It summarizes the journal, so that the next startup can
+// tell that nothing changed since, and skip the crash repair scans.
+type tlfJournalCleanShutdown struct {
+	BlockOpCount   uint64
+	StoredBytes    int64
+	UnflushedBytes int64
+	RevisionEnd    kbfsmd.Revision
+}
+
+func makeTLFJournalCleanShutdown(
+	blockJournal *blockJournal, mdJournal *mdJournal) (
+	tlfJournalCleanShutdown, error) {
+	revisionEnd, err := mdJournal.readLatestRevision()
+	if err != nil {
+		return tlfJournalCleanShutdown{}, err
+	}
+	return tlfJournalCleanShutdown{
+		BlockOpCount:   blockJournal.length(),
+		StoredBytes:    blockJournal.getStoredBytes(),
+		UnflushedBytes: blockJournal.getUnflushedBytes(),
+		RevisionEnd:    revisionEnd,
+	}, nil
+}
+
+// readAndRemoveTLFJournalCleanShutdown returns the clean shutdown
+// summary for the journal in `dir`, or nil if the last shutdown
+// wasn't clean.  The summary is removed, so that it isn't trusted
+// again if the journal isn't shut down cleanly this time.
+func readAndRemoveTLFJournalCleanShutdown(dir string) (
+	*tlfJournalCleanShutdown, error) {
+	path := getTLFJournalCleanShutdownFilePath(dir)
+	var cs tlfJournalCleanShutdown
+	err := ioutil.DeserializeFromJSONFile(path, &cs)
+	if ioutil.IsNotExist(err) {
+		return nil, nil
+	}
+	removeErr := ioutil.Remove(path)
+	if removeErr != nil {
+		return nil, removeErr
+	}
+	if err != nil {
+		// A torn summary means the shutdown didn't finish.
+		return nil, nil
+	}
+	return &cs, nil
+}
+
+// makeBlockAndMDJournals opens the block and MD journals in `dir`,
+// checking them for writes torn by a crash if `repair` is true.
+func makeBlockAndMDJournals(
+	ctx context.Context, uid keybase1.UID, key kbfscrypto.VerifyingKey,
+	dir string, tlfID tlf.ID, config tlfJournalConfig, log logger.Logger,
+	repair bool) (*blockJournal, *mdJournal, error) {
+	blockJournal, err := makeBlockJournal(
+		ctx, config.Codec(), dir, log, repair)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mdJournal, err := makeMDJournal(
+		ctx, uid, key, config.Codec(), config.Crypto(), config.Clock(),
+		config.teamMembershipChecker(), tlfID, config.MetadataVersion(), dir,
+		log, repair)
+	if err != nil {
+		return nil, nil, err
+	}
+	return blockJournal, mdJournal, nil
+}
+
 func makeTLFJournal(
 	ctx context.Context, uid keybase1.UID, key kbfscrypto.VerifyingKey,
 	dir string, tlfID tlf.ID, chargedTo keybase1.UserOrTeamID,
@@ -408,15 +514,35 @@ func makeTLFJournal(
 
 	log := config.MakeLogger("TLFJ")
 
-	blockJournal, err := makeBlockJournal(ctx, config.Codec(), dir, log)
+	// Scanning the journals for torn writes is only needed if the
+	// last shutdown wasn't clean, or if the journals don't match
+	// what was recorded at the clean shutdown.
+	cleanShutdown, err := readAndRemoveTLFJournalCleanShutdown(dir)
+	if err != nil {
+		return nil, err
+	}
+	blockJournal, mdJournal, err := makeBlockAndMDJournals(
+		ctx, uid, key, dir, tlfID, config, log, cleanShutdown == nil)
+	if err == nil && cleanShutdown != nil {
+		var cs tlfJournalCleanShutdown
+		cs, err = makeTLFJournalCleanShutdown(blockJournal, mdJournal)
+		if err == nil && cs != *cleanShutdown {
+			err = errors.Errorf("Journal %+v doesn't match the clean "+
+				"shutdown summary %+v", cs, *cleanShutdown)
+		}
+	}
+	if err != nil && cleanShutdown != nil {
+		log.CWarningf(ctx, "Checking journal after clean shutdown "+
+			"failed, so repairing it: %+v", err)
+		blockJournal, mdJournal, err = makeBlockAndMDJournals(
+			ctx, uid, key, dir, tlfID, config, log, true)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	mdJournal, err := makeMDJournal(
-		ctx, uid, key, config.Codec(), config.Crypto(), config.Clock(),
-		config.teamMembershipChecker(), tlfID, config.MetadataVersion(), dir,
-		log)
+	crashRepair, err := repairTLFJournalAfterCrash(
+		ctx, blockJournal, mdJournal, log)
 	if err != nil {
 		return nil, err
 	}
@@ -444,6 +570,7 @@ func makeTLFJournal(
 		needResumeCh:         make(chan struct{}, 1),
 		needShutdownCh:       make(chan struct{}, 1),
 		needBranchCheckCh:    make(chan struct{}, 1),
+		flushNowCh:           make(chan struct{}, 1),
 		backgroundShutdownCh: make(chan struct{}),
 		finishSingleOpCh:     make(chan flushContext, 1),
 		singleOpFlushContext: defaultFlushContext(),
@@ -452,7 +579,9 @@ func makeTLFJournal(
 		unflushedPaths:       &unflushedPathCache{},
 		flushingBlocks:       make(map[kbfsblock.ID]bool),
 		bytesPerSecEstimate:  ewma.NewMovingAverage(),
+		flushedBlocks:        newFlushedBlockFilter(),
 		bwDelegate:           bwDelegate,
+		crashRepair:          crashRepair,
 	}
 
 	switch bws {
@@ -704,12 +833,46 @@ func (j *tlfJournal) doBackgroundWork(ctx context.Context) <-chan error {
 	// TODO: Handle panics.
 	go func() {
 		defer j.wg.Done()
+		if err := j.delayFlush(ctx); err != nil {
+			errCh <- err
+			close(errCh)
+			return
+		}
 		errCh <- j.flush(ctx)
 		close(errCh)
 	}()
 	return errCh
 }
 
+// delayFlush waits out the journal flush delay of the power policy,
+// if the device is on battery or a metered network, so that new
+// writes go out in fewer, larger batches.  The delay is cut short if
+// someone starts waiting for the flush.
+func (j *tlfJournal) delayFlush(ctx context.Context) error {
+	delay := j.config.PowerMonitor().journalFlushDelay()
+	if delay == 0 {
+		return nil
+	}
+	j.log.CDebugf(ctx, "Delaying flush for %s by %s", j.tlfID, delay)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-j.flushNowCh:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (j *tlfJournal) signalFlushNow() {
+	select {
+	case j.flushNowCh <- struct{}{}:
+	default:
+	}
+}
+
 // We don't guarantee that background pause/resume requests will be
 // processed in strict FIFO order. In particular, multiple pause
 // requests are collapsed into one (also multiple resume requests), so
@@ -816,6 +979,13 @@ func (j *tlfJournal) checkAndFinishSingleOpFlushLocked(
 }
 
 func (j *tlfJournal) flush(ctx context.Context) (err error) {
+	ctx = CtxWithLogFields(ctx, LogFields{
+		TlfID: j.tlfID,
+		Op:    "JournalFlush",
+	})
+	// The blocks were counted in the traffic log when they were
+	// journaled.
+	ctx = ctxWithBlockTrafficJournalFlush(ctx)
 	j.flushLock.Lock()
 	defer j.flushLock.Unlock()
 
@@ -1169,6 +1339,9 @@ func (j *tlfJournal) flushBlockEntries(
 		return 0, kbfsmd.RevisionUninitialized, false, err
 	}
 	endFlush := j.config.Clock().Now()
+	for _, bs := range entries.puts.blockStates {
+		j.flushedBlocks.add(bs.blockPtr.ID)
+	}
 
 	err = j.clearFlushingBlockIDs(entries)
 	cleared = true
@@ -1655,9 +1828,57 @@ func (j *tlfJournal) getJournalStatusLocked() (TLFJournalStatus, error) {
 		UnflushedBytes:  unflushedBytes,
 		EndEstimate:     endEstimate,
 		LastFlushErr:    lastFlushErr,
+		CrashRepair:     j.crashRepair,
 	}, nil
 }
 
+// repairTLFJournalAfterCrash summarizes the repairs made to the block
+// and MD journals when they were opened, and returns nil if there
+// weren't any.  The blocks of an MD revision are always journaled
+// before its revision marker, so if block journal entries were
+// dropped, any MD revision after the latest marker left in the block
+// journal might reference a block that was never put.  Those
+// revisions are dropped from the MD journal too, so that they can't
+// be flushed, and their changes are reported as lost.  The changes
+// aren't re-dirtied: the file data they need may be in exactly the
+// blocks that were lost, so the paths are left for the user to
+// restore.
+func repairTLFJournalAfterCrash(ctx context.Context,
+	blockJournal *blockJournal, mdJournal *mdJournal,
+	log logger.Logger) (*TLFJournalRepairStatus, error) {
+	if blockJournal.crashRepair.dropped > 0 {
+		markedRev, err := blockJournal.latestMDRevMarker()
+		if err != nil {
+			return nil, err
+		}
+		// Without any marker left, none of the journaled revisions
+		// can be trusted, even those whose markers were already
+		// flushed, since they can't be told apart.
+		err = mdJournal.dropAfterCrashFrom(ctx, markedRev+1)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	blockRepair := blockJournal.crashRepair
+	mdRepair := mdJournal.crashRepair
+	if !blockRepair.repaired() && !mdRepair.repaired() {
+		return nil, nil
+	}
+
+	status := &TLFJournalRepairStatus{
+		RebuiltOrdinals: blockRepair.rebuiltOrdinals ||
+			mdRepair.rebuiltOrdinals,
+		DroppedBlockOps: blockRepair.dropped,
+	}
+	if mdRepair.dropped > 0 {
+		status.DroppedRevisionsMin = kbfsmd.Revision(mdRepair.firstDropped)
+		status.DroppedRevisionsMax = kbfsmd.Revision(
+			uint64(mdRepair.firstDropped) + mdRepair.dropped - 1)
+	}
+	return status, nil
+}
+
 func (j *tlfJournal) getJournalStatus() (TLFJournalStatus, error) {
 	j.journalLock.RLock()
 	defer j.journalLock.RUnlock()
@@ -1846,9 +2067,71 @@ func (j *tlfJournal) getJournalStatusWithPaths(ctx context.Context,
 		jStatus.UnflushedPaths =
 			append(jStatus.UnflushedPaths, incompleteUnflushedPathsMarker)
 	}
+	jStatus.CrashRepair = j.fillInCrashLostPaths(ctx, cpp)
 	return jStatus, nil
 }
 
+// fillInCrashLostPaths returns the crash repair status of the
+// journal, with the paths changed by the dropped MD revisions that
+// can still be read.  The paths are only computed once.
+func (j *tlfJournal) fillInCrashLostPaths(
+	ctx context.Context, cpp chainsPathPopulator) *TLFJournalRepairStatus {
+	j.journalLock.RLock()
+	crashRepair := j.crashRepair
+	done := j.crashLostPathsDone
+	var ibrmds []ImmutableBareRootMetadata
+	if crashRepair != nil && !done && j.mdJournal != nil {
+		ibrmds = j.mdJournal.getCrashDroppedMDs(ctx)
+	}
+	j.journalLock.RUnlock()
+	if crashRepair == nil || done {
+		return crashRepair
+	}
+
+	var lostPaths []string
+	if len(ibrmds) > 0 {
+		// Like for the unflushed paths, the journal lock must not
+		// be held while decrypting.
+		revPaths := make(unflushedPathsMap)
+		mdInfos, err := j.getUnflushedPathMDInfos(ctx, ibrmds)
+		if err == nil {
+			err = addUnflushedPaths(ctx, j.uid, j.key,
+				j.config.Codec(), j.log, mdInfos, cpp, revPaths)
+		}
+		if err != nil {
+			j.log.CWarningf(ctx, "Couldn't get the paths changed by the "+
+				"dropped revisions: %+v", err)
+		}
+		pathsSeen := make(map[string]bool)
+		for _, paths := range revPaths {
+			for path := range paths {
+				if !pathsSeen[path] {
+					lostPaths = append(lostPaths, path)
+					pathsSeen[path] = true
+				}
+			}
+		}
+		sort.Strings(lostPaths)
+	}
+
+	j.journalLock.Lock()
+	defer j.journalLock.Unlock()
+	if j.crashLostPathsDone {
+		return j.crashRepair
+	}
+	if len(lostPaths) > 0 {
+		j.log.CWarningf(ctx, "Changes to %v were lost when the journal "+
+			"was repaired", lostPaths)
+		// Don't modify the old status, since it may have been
+		// handed out already.
+		newRepair := *j.crashRepair
+		newRepair.LostPaths = lostPaths
+		j.crashRepair = &newRepair
+	}
+	j.crashLostPathsDone = true
+	return j.crashRepair
+}
+
 func (j *tlfJournal) getByteCounts() (
 	storedBytes, storedFiles, unflushedBytes int64, err error) {
 	j.journalLock.RLock()
@@ -1876,6 +2159,17 @@ func (j *tlfJournal) shutdown(ctx context.Context) {
 		return
 	}
 
+	// Record the clean shutdown, so the next startup can skip
+	// the crash repair scans.
+	cs, err := makeTLFJournalCleanShutdown(j.blockJournal, j.mdJournal)
+	if err == nil {
+		err = ioutil.SerializeToJSONFile(
+			cs, getTLFJournalCleanShutdownFilePath(j.dir))
+	}
+	if err != nil {
+		j.log.CWarningf(ctx, "Couldn't record clean shutdown: %+v", err)
+	}
+
 	// Even if we shut down the journal, its blocks still take up
 	// space, but we don't want to double-count them if we start
 	// up this journal again, so we need to adjust them here.
@@ -2133,6 +2427,31 @@ func (j *tlfJournal) addBlockReference(
 	return nil
 }
 
+// addFlushedBlockReference records a reference that was already
+// added on the server, to a block flushed earlier, so that it's
+// removed again if the revision that uses it is dropped.
+func (j *tlfJournal) addFlushedBlockReference(
+	ctx context.Context, id kbfsblock.ID, context kbfsblock.Context) error {
+	j.journalLock.Lock()
+	defer j.journalLock.Unlock()
+	if err := j.checkEnabledLocked(); err != nil {
+		return err
+	}
+
+	if err := j.checkInfoFileLocked(); err != nil {
+		return err
+	}
+
+	err := j.blockJournal.addFlushedReference(ctx, id, context)
+	if err != nil {
+		return err
+	}
+
+	j.signalWork()
+
+	return nil
+}
+
 func (j *tlfJournal) removeBlockReferences(
 	ctx context.Context, contexts kbfsblock.ContextMap) (
 	liveCounts map[kbfsblock.ID]int, err error) {
@@ -2188,6 +2507,43 @@ func (j *tlfJournal) isBlockUnflushed(id kbfsblock.ID) (bool, error) {
 	return j.blockJournal.isUnflushed(id)
 }
 
+// wasBlockFlushed returns true if the block `id` was probably
+// flushed to the server recently, and isn't still in the journal.
+// It may return false positives.
+func (j *tlfJournal) wasBlockFlushed(id kbfsblock.ID) (bool, error) {
+	if !j.flushedBlocks.mayContain(id) {
+		return false, nil
+	}
+	unflushed, err := j.isBlockUnflushed(id)
+	if err != nil {
+		return false, err
+	}
+	return !unflushed, nil
+}
+
+// getExistingBlocks returns which of the given blocks the journal
+// already has, with live references matching all their contexts.
+func (j *tlfJournal) getExistingBlocks(contexts kbfsblock.ContextMap) (
+	map[kbfsblock.ID]bool, error) {
+	j.journalLock.RLock()
+	defer j.journalLock.RUnlock()
+	if err := j.checkEnabledLocked(); err != nil {
+		return nil, err
+	}
+
+	existing := make(map[kbfsblock.ID]bool)
+	for id, idContexts := range contexts {
+		ok, err := j.blockJournal.hasLiveContexts(id, idContexts)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			existing[id] = true
+		}
+	}
+	return existing, nil
+}
+
 func (j *tlfJournal) markFlushingBlockIDs(entries blockEntriesToFlush) error {
 	j.journalLock.Lock()
 	defer j.journalLock.Unlock()
@@ -2485,6 +2841,7 @@ func (j *tlfJournal) resolveBranch(ctx context.Context,
 }
 
 func (j *tlfJournal) wait(ctx context.Context) error {
+	j.signalFlushNow()
 	workLeft, err := j.wg.WaitUnlessPaused(ctx)
 	if err != nil {
 		return err
@@ -2513,6 +2870,7 @@ func (j *tlfJournal) waitForCompleteFlush(ctx context.Context) error {
 		// Let the background flusher know it should try to flush
 		// everything again, once any conflicts have been resolved.
 		j.signalWork()
+		j.signalFlushNow()
 
 		err = j.wg.Wait(ctx)
 		if err != nil {
@@ -160,6 +160,10 @@ func (c testTLFJournalConfig) BGFlushDirOpBatchSize() int {
 	return 1
 }
 
+func (c testTLFJournalConfig) PowerMonitor() *PowerMonitor {
+	return nil
+}
+
 func (c testTLFJournalConfig) makeBlock(data []byte) (
 	kbfsblock.ID, kbfsblock.Context, kbfscrypto.BlockCryptKeyServerHalf) {
 	id, err := kbfsblock.MakePermanentID(data)
@@ -215,7 +219,7 @@ func setupTLFJournalTest(
 	delegate testBWDelegate) {
 	// Set up config and dependencies.
 	bsplitter := &BlockSplitterSimple{
-		64 * 1024, int(64 * 1024 / bpSize), 8 * 1024, 0}
+		64 * 1024, int(64 * 1024 / bpSize), 8 * 1024, 0, 0}
 	codec := kbfscodec.NewMsgpack()
 	signingKey := kbfscrypto.MakeFakeSigningKeyOrBust("client sign")
 	cryptPrivateKey := kbfscrypto.MakeFakeCryptPrivateKeyOrBust("client crypt private")
@@ -1855,6 +1859,126 @@ func testTLFJournalSingleOp(t *testing.T, ver kbfsmd.MetadataVer) {
 	require.Len(t, mdserver.rmdses, 1)
 }
 
+func testTLFJournalCleanShutdown(t *testing.T, ver kbfsmd.MetadataVer) {
+	tempdir, config, ctx, cancel, tlfJournal, delegate :=
+		setupTLFJournalTest(t, ver, TLFJournalBackgroundWorkPaused)
+
+	putBlock(ctx, t, config, tlfJournal, []byte{1, 2, 3, 4})
+	putOneMD(ctx, config, tlfJournal)
+	expected, err := makeTLFJournalCleanShutdown(
+		tlfJournal.blockJournal, tlfJournal.mdJournal)
+	require.NoError(t, err)
+
+	tlfJournal.shutdown(ctx)
+	select {
+	case <-delegate.shutdownCh:
+	case <-ctx.Done():
+		require.FailNow(t, ctx.Err().Error())
+	}
+
+	path := getTLFJournalCleanShutdownFilePath(tempdir)
+	var cs tlfJournalCleanShutdown
+	err = ioutil.DeserializeFromJSONFile(path, &cs)
+	require.NoError(t, err)
+	require.Equal(t, expected, cs)
+
+	// Restarting should use up the summary, without any repair.
+	delegate = testBWDelegate{
+		t:          t,
+		testCtx:    ctx,
+		stateCh:    make(chan bwState),
+		shutdownCh: make(chan struct{}),
+	}
+	tlfJournal, err = makeTLFJournal(ctx, tlfJournal.uid, tlfJournal.key,
+		tempdir, config.tlfID, tlfJournal.uid.AsUserOrTeam(), config,
+		tlfJournal.delegateBlockServer, TLFJournalBackgroundWorkPaused,
+		delegate, nil, nil, tlfJournal.diskLimiter)
+	require.NoError(t, err)
+	defer teardownTLFJournalTest(
+		tempdir, config, ctx, cancel, tlfJournal, delegate)
+	delegate.requireNextState(ctx, bwPaused)
+
+	_, err = ioutil.Stat(path)
+	require.True(t, ioutil.IsNotExist(err))
+	require.Nil(t, tlfJournal.crashRepair)
+	restarted, err := makeTLFJournalCleanShutdown(
+		tlfJournal.blockJournal, tlfJournal.mdJournal)
+	require.NoError(t, err)
+	require.Equal(t, expected, restarted)
+
+	// A torn summary is ignored.
+	err = ioutil.WriteFile(path, []byte("{"), 0600)
+	require.NoError(t, err)
+	torn, err := readAndRemoveTLFJournalCleanShutdown(tempdir)
+	require.NoError(t, err)
+	require.Nil(t, torn)
+	_, err = ioutil.Stat(path)
+	require.True(t, ioutil.IsNotExist(err))
+}
+
+func testTLFJournalCrashDropsMDsOfLostBlocks(
+	t *testing.T, ver kbfsmd.MetadataVer) {
+	tempdir, config, ctx, cancel, tlfJournal, delegate :=
+		setupTLFJournalTest(t, ver, TLFJournalBackgroundWorkPaused)
+
+	// Each revision's block is journaled before the revision's
+	// marker.
+	firstRevision := kbfsmd.Revision(10)
+	prevRoot := kbfsmd.FakeID(1)
+	for i := 0; i < 2; i++ {
+		putBlock(ctx, t, config, tlfJournal, []byte{1, 2, 3, byte(i)})
+		md := config.makeMD(firstRevision+kbfsmd.Revision(i), prevRoot)
+		irmd, err := tlfJournal.putMD(ctx, md, tlfJournal.key)
+		require.NoError(t, err)
+		prevRoot = irmd.mdID
+	}
+	requireJournalEntryCounts(t, tlfJournal, 4, 2)
+	blockEntryPath := tlfJournal.blockJournal.j.journalEntryPath(
+		firstValidJournalOrdinal + 2)
+
+	tlfJournal.shutdown(ctx)
+	select {
+	case <-delegate.shutdownCh:
+	case <-ctx.Done():
+		require.FailNow(t, ctx.Err().Error())
+	}
+
+	// Simulate a crash that tore the second block put, while the MD
+	// that references it survived.
+	err := ioutil.Remove(getTLFJournalCleanShutdownFilePath(tempdir))
+	require.NoError(t, err)
+	err = ioutil.WriteFile(blockEntryPath, []byte{0xc1}, 0600)
+	require.NoError(t, err)
+
+	delegate = testBWDelegate{
+		t:          t,
+		testCtx:    ctx,
+		stateCh:    make(chan bwState),
+		shutdownCh: make(chan struct{}),
+	}
+	tlfJournal, err = makeTLFJournal(ctx, tlfJournal.uid, tlfJournal.key,
+		tempdir, config.tlfID, tlfJournal.uid.AsUserOrTeam(), config,
+		tlfJournal.delegateBlockServer, TLFJournalBackgroundWorkPaused,
+		delegate, nil, nil, tlfJournal.diskLimiter)
+	require.NoError(t, err)
+	defer teardownTLFJournalTest(
+		tempdir, config, ctx, cancel, tlfJournal, delegate)
+	delegate.requireNextState(ctx, bwPaused)
+
+	// The second revision is dropped along with its block, so it
+	// can never be flushed.
+	requireJournalEntryCounts(t, tlfJournal, 2, 1)
+	latest, err := tlfJournal.mdJournal.readLatestRevision()
+	require.NoError(t, err)
+	require.Equal(t, firstRevision, latest)
+	require.Equal(t, &TLFJournalRepairStatus{
+		DroppedBlockOps:     2,
+		DroppedRevisionsMin: firstRevision + 1,
+		DroppedRevisionsMax: firstRevision + 1,
+	}, tlfJournal.crashRepair)
+	require.Len(t, tlfJournal.mdJournal.getCrashDroppedMDs(ctx), 1)
+}
+
 func TestTLFJournal(t *testing.T) {
 	tests := []func(*testing.T, kbfsmd.MetadataVer){
 		testTLFJournalBasic,
@@ -1887,6 +2011,8 @@ func TestTLFJournal(t *testing.T) {
 		testTLFJournalSquashByBytes,
 		testTLFJournalFirstRevNoSquash,
 		testTLFJournalSingleOp,
+		testTLFJournalCleanShutdown,
+		testTLFJournalCrashDropsMDsOfLostBlocks,
 	}
 	runTestsOverMetadataVers(t, "testTLFJournal", tests)
 }
@@ -0,0 +1,683 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	pathpkg "path"
+	"sort"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// TLFRevertAction says what a revert does to a single entry.
+type TLFRevertAction string
+
+const (
+	// TLFRevertCreate means the entry is recreated from the old
+	// revision.
+	TLFRevertCreate TLFRevertAction = "create"
+	// TLFRevertUpdate means the entry's contents, exec bit or
+	// symlink target are restored from the old revision.
+	TLFRevertUpdate TLFRevertAction = "update"
+	// TLFRevertRemove means the entry didn't exist in the old
+	// revision, and is removed.
+	TLFRevertRemove TLFRevertAction = "remove"
+)
+
+// TLFRevertChange is one change made (or, in a dry run, that would
+// be made) by RevertTLF.
+type TLFRevertChange struct {
+	Path   string
+	Action TLFRevertAction
+}
+
+// TLFRevert describes a revert done by RevertTLF.
+type TLFRevert struct {
+	// FromRevision is the head revision the revert started from.
+	FromRevision kbfsmd.Revision
+	// ToRevision is the revision whose tree was restored.
+	ToRevision kbfsmd.Revision
+	Changes    []TLFRevertChange
+}
+
+// tlfReverter builds, in a single MD revision, a copy of the tree of
+// an older revision of a TLF on top of its current head.  Entries
+// whose blocks haven't changed since the old revision are kept as
+// they are, and the others get new references to the old blocks, so
+// no file data is read or uploaded again.  In a dry run (when `md`
+// is nil), it only lists the changes.
+type tlfReverter struct {
+	fbo       *folderBranchOps
+	lState    *lockState
+	head      ImmutableRootMetadata
+	oldMD     ImmutableRootMetadata
+	md        *RootMetadata
+	chargedTo keybase1.UserOrTeamID
+	bps       *blockPutState
+	// refs are the new references already added on the server,
+	// which must be removed if the revert fails.
+	refs    []BlockPointer
+	changes []TLFRevertChange
+}
+
+func (tr *tlfReverter) dryRun() bool {
+	return tr.md == nil
+}
+
+func (tr *tlfReverter) record(relPath string, action TLFRevertAction) {
+	tr.changes = append(tr.changes, TLFRevertChange{relPath, action})
+}
+
+func sortedEntryNames(entries map[string]DirEntry) []string {
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isSameEntryKind returns true if an entry of type `a` can be
+// updated in place to one of type `b`.
+func isSameEntryKind(a, b EntryType) bool {
+	isFile := func(t EntryType) bool { return t == File || t == Exec }
+	return a == b || (isFile(a) && isFile(b))
+}
+
+// restoredEntry returns the entry `oldDe` from the old revision,
+// pointing to the new copy of its blocks described by `info`.
+// `prevRevisions` is the history of the entry it replaces, if any.
+func (tr *tlfReverter) restoredEntry(oldDe DirEntry,
+	prevRevisions PrevRevisions, info BlockInfo) DirEntry {
+	de := oldDe
+	de.BlockInfo = info
+	de.PrevRevisions = prevRevisions.addRevision(
+		tr.md.Revision(), tr.md.data.LastGCRevision)
+	return de
+}
+
+// reference adds the new reference `ptr` to the block that `oldPtr`
+// points to.  If the block can't take a new reference, e.g. because
+// all the old ones have been archived since the old revision, or
+// because it hasn't been flushed from the journal yet, it's fetched
+// and put again under the new reference.
+func (tr *tlfReverter) reference(
+	ctx context.Context, ptr, oldPtr BlockPointer) error {
+	fbo := tr.fbo
+	bserv := fbo.config.BlockServer()
+	err := PutBlockCheckLimitErrs(ctx, bserv, fbo.config.Reporter(),
+		fbo.id(), ptr, ReadyBlockData{},
+		tr.md.GetTlfHandle().GetCanonicalName())
+	if isRecoverableBlockError(err) {
+		fbo.log.CDebugf(ctx, "Putting %v again, since it can't be "+
+			"referenced: %+v", ptr, err)
+		buf, serverHalf, err := bserv.Get(
+			ctx, fbo.id(), oldPtr.ID, oldPtr.Context)
+		if err != nil {
+			return err
+		}
+		err = bserv.PutAgain(
+			ctx, fbo.id(), ptr.ID, ptr.Context, buf, serverHalf)
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	tr.refs = append(tr.refs, ptr)
+	return nil
+}
+
+// deleteRefs removes the references added by `reference`, after the
+// revert failed.
+func (tr *tlfReverter) deleteRefs(ctx context.Context) {
+	if len(tr.refs) == 0 {
+		return
+	}
+	_, err := tr.fbo.config.BlockOps().Delete(ctx, tr.fbo.id(), tr.refs)
+	if err != nil {
+		tr.fbo.log.CDebugf(ctx, "Couldn't delete unused references "+
+			"for a revert: %+v", err)
+	}
+}
+
+// unrefChildBlocks unreferences the blocks under the top block of
+// the current entry `de` at `p`, but not the entries of a directory.
+func (tr *tlfReverter) unrefChildBlocks(
+	ctx context.Context, p path, de DirEntry) error {
+	fbo := tr.fbo
+	var infos []BlockInfo
+	var err error
+	switch de.Type {
+	case Sym:
+		return nil
+	case Dir:
+		infos, err = fbo.blocks.GetIndirectDirBlockInfos(
+			ctx, tr.lState, tr.head.ReadOnly(), p)
+	default:
+		infos, err = fbo.blocks.GetIndirectFileBlockInfos(
+			ctx, tr.lState, tr.head.ReadOnly(), p)
+	}
+	if isRecoverableBlockErrorForRemoval(err) {
+		fbo.log.CWarningf(ctx, "Recoverable block error encountered "+
+			"while unreferencing %v; continuing: %+v", p, err)
+	} else if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		tr.md.AddUnrefBlock(info)
+	}
+	return nil
+}
+
+// unrefEntry unreferences all the blocks of the current entry `de`
+// at `p`, and of everything under it.
+func (tr *tlfReverter) unrefEntry(
+	ctx context.Context, p path, de DirEntry) error {
+	if de.Type == Sym {
+		return nil
+	}
+	if de.Type == Dir {
+		entries, err := tr.fbo.blocks.GetEntries(
+			ctx, tr.lState, tr.head.ReadOnly(), p)
+		if err != nil {
+			return err
+		}
+		for name, childDe := range entries {
+			err := tr.unrefEntry(
+				ctx, p.ChildPath(name, childDe.BlockPointer), childDe)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err := tr.unrefChildBlocks(ctx, p, de)
+	if err != nil {
+		return err
+	}
+	tr.md.AddUnrefBlock(de.BlockInfo)
+	return nil
+}
+
+// sameFileData returns true if the old file `oldDe` at `oldFile` and
+// the current file `curDe` at `curFile` hold the same data.  That's
+// the case if they share a top block, or, since a revert gives the
+// copy of a file a new top block, if they have the same leaf blocks
+// at the same offsets.
+func (tr *tlfReverter) sameFileData(ctx context.Context,
+	oldFile, curFile path, oldDe, curDe DirEntry) (bool, error) {
+	if oldDe.ID == curDe.ID {
+		return true, nil
+	}
+	if oldDe.Size != curDe.Size ||
+		oldDe.DirectType != IndirectBlock ||
+		curDe.DirectType != IndirectBlock {
+		return false, nil
+	}
+
+	oldLayout, err := tr.fbo.blocks.GetFileBlockLayout(
+		ctx, tr.lState, tr.oldMD.ReadOnly(), oldFile)
+	if err != nil {
+		return false, err
+	}
+	curLayout, err := tr.fbo.blocks.GetFileBlockLayout(
+		ctx, tr.lState, tr.head.ReadOnly(), curFile)
+	if err != nil {
+		return false, err
+	}
+	oldLeaves := appendLayoutLeaves(nil, oldLayout.Root)
+	curLeaves := appendLayoutLeaves(nil, curLayout.Root)
+	if len(oldLeaves) != len(curLeaves) {
+		return false, nil
+	}
+	for i := range oldLeaves {
+		if oldLeaves[i].Off != curLeaves[i].Off ||
+			oldLeaves[i].ID != curLeaves[i].ID {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// appendLayoutLeaves appends the leaves under `n` to `leaves`, in
+// offset order.
+func appendLayoutLeaves(leaves []*FileBlockLayoutNode,
+	n *FileBlockLayoutNode) []*FileBlockLayoutNode {
+	if len(n.Children) == 0 {
+		return append(leaves, n)
+	}
+	for _, child := range n.Children {
+		leaves = appendLayoutLeaves(leaves, child)
+	}
+	return leaves
+}
+
+// copyFile makes a copy of the block tree of the old file `oldDe` at
+// `oldFile`, like `folderBranchOps.cloneFileLocked` does: the copy
+// gets new indirect blocks, and new references to the leaf blocks
+// (or to the top block, for a direct file).  It returns the info
+// for the new top block, which the caller must add to the MD.
+func (tr *tlfReverter) copyFile(
+	ctx context.Context, oldFile path, oldDe DirEntry) (BlockInfo, error) {
+	fbo := tr.fbo
+	// Simple dirty bcaches don't need to be shut down.
+	dirtyBcache := simpleDirtyBlockCacheStandard()
+	newTopPtr, _, err := fbo.blocks.DeepCopyCleanFile(
+		ctx, tr.lState, tr.oldMD.ReadOnly(), oldFile, dirtyBcache,
+		fbo.config.DataVersion())
+	if err != nil {
+		return BlockInfo{}, err
+	}
+	block, err := dirtyBcache.Get(fbo.id(), newTopPtr, fbo.branch())
+	if err != nil {
+		return BlockInfo{}, err
+	}
+	fblock, isFileBlock := block.(*FileBlock)
+	if !isFileBlock {
+		return BlockInfo{}, NotFileBlockError{newTopPtr, fbo.branch(), oldFile}
+	}
+
+	if !fblock.IsInd {
+		err = tr.reference(ctx, newTopPtr, oldDe.BlockPointer)
+		if err != nil {
+			return BlockInfo{}, err
+		}
+		return BlockInfo{newTopPtr, oldDe.EncodedSize}, nil
+	}
+
+	// Index the old leaves by ID, in case any of them have to be
+	// fetched.
+	oldInfos, err := fbo.blocks.GetIndirectFileBlockInfos(
+		ctx, tr.lState, tr.oldMD.ReadOnly(), oldFile)
+	if err != nil {
+		return BlockInfo{}, err
+	}
+	oldPtrs := make(map[kbfsblock.ID]BlockPointer, len(oldInfos))
+	for _, info := range oldInfos {
+		oldPtrs[info.ID] = info.BlockPointer
+	}
+
+	newPath := oldFile.parentPath().ChildPath(oldFile.tailName(), newTopPtr)
+	_, err = fbo.blocks.ReadyNonLeafBlocksInCopy(
+		ctx, tr.lState, tr.md.ReadOnly(), newPath, tr.bps, dirtyBcache,
+		fblock)
+	if err != nil {
+		return BlockInfo{}, err
+	}
+	infos, err := fbo.blocks.GetIndirectFileBlockInfosWithTopBlock(
+		ctx, tr.lState, tr.md.ReadOnly(), newPath, fblock)
+	if err != nil {
+		return BlockInfo{}, err
+	}
+	for _, info := range infos {
+		// The indirect blocks were already added to `bps`, so
+		// only the leaves need new references.
+		if info.RefNonce != kbfsblock.ZeroRefNonce {
+			err = tr.reference(ctx, info.BlockPointer, oldPtrs[info.ID])
+			if err != nil {
+				return BlockInfo{}, err
+			}
+		}
+		tr.md.AddRefBlock(info)
+	}
+
+	info, _, err := fbo.prepper.readyBlockMultiple(
+		ctx, tr.md.ReadOnly(), fblock, tr.chargedTo, tr.bps,
+		fbo.config.DefaultBlockType())
+	return info, err
+}
+
+// writeDir readies a new directory named `name` holding `entries`,
+// split into as many blocks as needed.  It returns the info for the
+// new top block, which the caller must add to the MD, and the
+// directory's size.
+func (tr *tlfReverter) writeDir(ctx context.Context, name string,
+	entries map[string]DirEntry) (BlockInfo, uint64, error) {
+	fbo := tr.fbo
+	newID, err := fbo.config.cryptoPure().MakeTemporaryBlockID()
+	if err != nil {
+		return BlockInfo{}, 0, err
+	}
+	ptr := BlockPointer{
+		ID:         newID,
+		KeyGen:     tr.md.LatestKeyGeneration(),
+		DataVer:    fbo.config.DataVersion(),
+		DirectType: DirectBlock,
+		Context: kbfsblock.MakeFirstContext(
+			tr.chargedTo, fbo.config.DefaultBlockType()),
+	}
+	lbc := localBcache{ptr: NewDirBlock().(*DirBlock)}
+	dd := newDirData(path{fbo.folderBranch, []pathNode{{ptr, name}}},
+		tr.chargedTo, fbo.config.Crypto(),
+		fbo.config.TlfBlockSplitter(fbo.id()), tr.md,
+		func(ctx context.Context, kmd KeyMetadata, ptr BlockPointer,
+			dir path, rtype blockReqType) (*DirBlock, bool, error) {
+			block, ok := lbc[ptr]
+			if !ok {
+				return nil, false, errors.Errorf(
+					"No block for %v in a new directory", ptr)
+			}
+			return block, true, nil
+		},
+		func(ptr BlockPointer, block Block) error {
+			lbc[ptr] = block.(*DirBlock)
+			return nil
+		}, fbo.log)
+	for _, name := range sortedEntryNames(entries) {
+		_, err := dd.addEntry(ctx, name, entries[name])
+		if err != nil {
+			return BlockInfo{}, 0, err
+		}
+	}
+
+	topBlock := lbc[ptr]
+	if topBlock.IsIndirect() {
+		newInfos, err := dd.ready(
+			ctx, fbo.id(), fbo.config.BlockCache(),
+			isDirtyWithLBC{lbc, fbo.config.DirtyBlockCache()},
+			fbo.config.BlockOps(), tr.bps, topBlock)
+		if err != nil {
+			return BlockInfo{}, 0, err
+		}
+		for newInfo := range newInfos {
+			tr.md.AddRefBlock(newInfo)
+		}
+	}
+	info, plainSize, err := fbo.prepper.readyBlockMultiple(
+		ctx, tr.md.ReadOnly(), topBlock, tr.chargedTo, tr.bps,
+		fbo.config.DefaultBlockType())
+	if err != nil {
+		return BlockInfo{}, 0, err
+	}
+	return info, uint64(plainSize), nil
+}
+
+// recordRemoves records the removal of the current entry `de` at
+// `p`, after that of everything under it.
+func (tr *tlfReverter) recordRemoves(
+	ctx context.Context, p path, relPath string, de DirEntry) error {
+	if de.Type == Dir {
+		entries, err := tr.fbo.blocks.GetEntries(
+			ctx, tr.lState, tr.head.ReadOnly(), p)
+		if err != nil {
+			return err
+		}
+		for _, name := range sortedEntryNames(entries) {
+			if hiddenEntries[name] {
+				continue
+			}
+			childDe := entries[name]
+			err := tr.recordRemoves(ctx,
+				p.ChildPath(name, childDe.BlockPointer),
+				pathpkg.Join(relPath, name), childDe)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	tr.record(relPath, TLFRevertRemove)
+	return nil
+}
+
+// removeEntry removes the current entry `de` at `p`, and everything
+// under it.
+func (tr *tlfReverter) removeEntry(
+	ctx context.Context, p path, relPath string, de DirEntry) error {
+	err := tr.recordRemoves(ctx, p, relPath, de)
+	if err != nil || tr.dryRun() {
+		return err
+	}
+	return tr.unrefEntry(ctx, p, de)
+}
+
+// createEntry returns a copy of the old entry `oldDe` at `oldPath`,
+// which has no current counterpart, along with everything under it.
+func (tr *tlfReverter) createEntry(ctx context.Context, oldPath path,
+	relPath string, oldDe DirEntry) (DirEntry, error) {
+	tr.record(relPath, TLFRevertCreate)
+	var info BlockInfo
+	switch oldDe.Type {
+	case Sym:
+		return oldDe, nil
+	case Dir:
+		entries, _, err := tr.revertDir(ctx, oldPath, path{}, relPath)
+		if err != nil || tr.dryRun() {
+			return oldDe, err
+		}
+		var size uint64
+		info, size, err = tr.writeDir(ctx, oldPath.tailName(), entries)
+		if err != nil {
+			return DirEntry{}, err
+		}
+		oldDe.Size = size
+	case File, Exec:
+		if tr.dryRun() {
+			return oldDe, nil
+		}
+		var err error
+		info, err = tr.copyFile(ctx, oldPath, oldDe)
+		if err != nil {
+			return DirEntry{}, err
+		}
+	default:
+		return DirEntry{}, errors.Errorf(
+			"Unknown entry type %s for %s", oldDe.Type, relPath)
+	}
+	tr.md.AddRefBlock(info)
+	return tr.restoredEntry(oldDe, oldDe.PrevRevisions, info), nil
+}
+
+// updateEntry returns the entry that restores the current entry
+// `curDe` at `curPath`, whose kind matches that of the old entry
+// `oldDe` at `oldPath`, to its old state.  It also returns whether
+// that's any different from `curDe`.
+func (tr *tlfReverter) updateEntry(ctx context.Context,
+	oldPath, curPath path, relPath string, oldDe, curDe DirEntry) (
+	DirEntry, bool, error) {
+	if oldDe.BlockPointer == curDe.BlockPointer &&
+		oldDe.Type == curDe.Type && oldDe.SymPath == curDe.SymPath {
+		return curDe, false, nil
+	}
+
+	var info BlockInfo
+	switch oldDe.Type {
+	case Sym:
+		if oldDe.SymPath == curDe.SymPath {
+			return curDe, false, nil
+		}
+		tr.record(relPath, TLFRevertUpdate)
+		return oldDe, true, nil
+	case Dir:
+		entries, changed, err := tr.revertDir(
+			ctx, oldPath, curPath, relPath)
+		if err != nil || !changed || tr.dryRun() {
+			return curDe, changed, err
+		}
+		var size uint64
+		info, size, err = tr.writeDir(ctx, oldPath.tailName(), entries)
+		if err != nil {
+			return DirEntry{}, false, err
+		}
+		oldDe.Size = size
+	case File, Exec:
+		same, err := tr.sameFileData(ctx, oldPath, curPath, oldDe, curDe)
+		if err != nil {
+			return DirEntry{}, false, err
+		}
+		if same {
+			// Only the exec bit or the mtime differ, so keep the
+			// current blocks.
+			if oldDe.Type == curDe.Type && oldDe.Mtime == curDe.Mtime {
+				return curDe, false, nil
+			}
+			tr.record(relPath, TLFRevertUpdate)
+			de := curDe
+			de.Type = oldDe.Type
+			de.Mtime = oldDe.Mtime
+			return de, true, nil
+		}
+		tr.record(relPath, TLFRevertUpdate)
+		if tr.dryRun() {
+			return oldDe, true, nil
+		}
+		info, err = tr.copyFile(ctx, oldPath, oldDe)
+		if err != nil {
+			return DirEntry{}, false, err
+		}
+	default:
+		return DirEntry{}, false, errors.Errorf(
+			"Unknown entry type %s for %s", oldDe.Type, relPath)
+	}
+
+	// The new top block replaces the current one, which keeps any
+	// nodes for it in place; the rest of the current blocks go.
+	err := tr.unrefChildBlocks(ctx, curPath, curDe)
+	if err != nil {
+		return DirEntry{}, false, err
+	}
+	tr.md.AddUpdate(curDe.BlockInfo, info)
+	return tr.restoredEntry(oldDe, curDe.PrevRevisions, info), true, nil
+}
+
+// revertDir returns the entries that the directory at `curPath`
+// must have to match the old directory at `oldPath`, and whether
+// they differ from its current ones.  `curPath` is invalid if there
+// is no current directory.  Hidden entries are left as they are.
+func (tr *tlfReverter) revertDir(ctx context.Context,
+	oldPath, curPath path, relPath string) (
+	entries map[string]DirEntry, changed bool, err error) {
+	oldEntries, err := tr.fbo.blocks.GetEntries(
+		ctx, tr.lState, tr.oldMD.ReadOnly(), oldPath)
+	if err != nil {
+		return nil, false, err
+	}
+	var curEntries map[string]DirEntry
+	if curPath.isValid() {
+		curEntries, err = tr.fbo.blocks.GetEntries(
+			ctx, tr.lState, tr.head.ReadOnly(), curPath)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	entries = make(map[string]DirEntry, len(oldEntries))
+	// Record removals first, so that an entry whose kind changed is
+	// listed as removed and then created again.
+	for _, name := range sortedEntryNames(curEntries) {
+		curDe := curEntries[name]
+		if hiddenEntries[name] {
+			entries[name] = curDe
+			continue
+		}
+		oldDe, ok := oldEntries[name]
+		if ok && isSameEntryKind(oldDe.Type, curDe.Type) {
+			continue
+		}
+		err := tr.removeEntry(ctx, curPath.ChildPath(name, curDe.BlockPointer),
+			pathpkg.Join(relPath, name), curDe)
+		if err != nil {
+			return nil, false, err
+		}
+		changed = true
+	}
+
+	for _, name := range sortedEntryNames(oldEntries) {
+		if hiddenEntries[name] {
+			continue
+		}
+		oldDe := oldEntries[name]
+		oldChild := oldPath.ChildPath(name, oldDe.BlockPointer)
+		childPath := pathpkg.Join(relPath, name)
+		curDe, ok := curEntries[name]
+		var newDe DirEntry
+		childChanged := true
+		if ok && isSameEntryKind(oldDe.Type, curDe.Type) {
+			newDe, childChanged, err = tr.updateEntry(ctx, oldChild,
+				curPath.ChildPath(name, curDe.BlockPointer), childPath,
+				oldDe, curDe)
+		} else {
+			newDe, err = tr.createEntry(ctx, oldChild, childPath, oldDe)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		entries[name] = newDe
+		changed = changed || childChanged
+	}
+	return entries, changed, nil
+}
+
+// revertRoot reverts the whole tree.  It returns false if nothing
+// needs to change.
+func (tr *tlfReverter) revertRoot(ctx context.Context) (bool, error) {
+	name := string(tr.head.GetTlfHandle().GetCanonicalName())
+	curRoot := tr.head.data.Dir
+	oldRoot := tr.oldMD.data.Dir
+	if oldRoot.BlockPointer == curRoot.BlockPointer {
+		return false, nil
+	}
+	curPath := path{tr.fbo.folderBranch,
+		[]pathNode{{curRoot.BlockPointer, name}}}
+	oldPath := path{tr.fbo.folderBranch,
+		[]pathNode{{oldRoot.BlockPointer, name}}}
+	entries, changed, err := tr.revertDir(ctx, oldPath, curPath, "")
+	if err != nil || !changed || tr.dryRun() {
+		return changed, err
+	}
+
+	info, size, err := tr.writeDir(ctx, name, entries)
+	if err != nil {
+		return false, err
+	}
+	err = tr.unrefChildBlocks(ctx, curPath, curRoot)
+	if err != nil {
+		return false, err
+	}
+	tr.md.AddUpdate(curRoot.BlockInfo, info)
+	now := tr.fbo.nowUnixNano()
+	de := curRoot
+	de.BlockInfo = info
+	de.Size = size
+	de.Mtime = now
+	de.Ctime = now
+	de.PrevRevisions = de.PrevRevisions.addRevision(
+		tr.md.Revision(), tr.md.data.LastGCRevision)
+	tr.md.data.Dir = de
+	return true, nil
+}
+
+// RevertTLF restores the tree of the TLF for `h` to its state as of
+// the earlier revision `rev`, in a single new revision on top of the
+// current head; no history is lost.  Entries whose blocks haven't
+// changed since `rev` keep them, while the others are restored with
+// new references to their blocks from `rev`.  If `dryRun` is true,
+// nothing is changed, and the result only lists the changes that
+// would be made.
+//
+// As a guard against reverting over changes the caller hasn't seen,
+// `expectedHead`, if not kbfsmd.RevisionUninitialized, must be the
+// current head revision of the TLF (e.g., as returned by a previous
+// dry run).  The TLF also can't have unmerged or unsynced changes,
+// and `rev` must be newer than the last garbage-collected revision,
+// since blocks only referenced by older revisions may be gone.
+func RevertTLF(ctx context.Context, config Config, h *TlfHandle,
+	rev, expectedHead kbfsmd.Revision, dryRun bool) (TLFRevert, error) {
+	kbfsOps := config.KBFSOps()
+	root, _, err := kbfsOps.GetRootNode(ctx, h, MasterBranch)
+	if err != nil {
+		return TLFRevert{}, err
+	}
+	if root == nil {
+		return TLFRevert{}, errors.Errorf(
+			"%s doesn't exist", h.GetCanonicalPath())
+	}
+	return kbfsOps.RevertToRevision(
+		ctx, root.GetFolderBranch(), rev, expectedHead, dryRun)
+}
@@ -0,0 +1,175 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	kbname "github.com/keybase/client/go/kbun"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRevertTLF(t *testing.T) {
+	var u1 kbname.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+
+	// Use small blocks, so that some files are indirect.
+	bsplitter, err := NewBlockSplitterSimple(20, 8*1024, config.Codec())
+	require.NoError(t, err)
+	config.SetBlockSplitter(bsplitter)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	h, err := kbfsOps.GetTLFHandle(ctx, rootNode)
+	require.NoError(t, err)
+	readAll := func(n Node) []byte {
+		buf := make([]byte, 300)
+		nRead, err := kbfsOps.Read(ctx, n, buf, 0)
+		require.NoError(t, err)
+		return buf[:nRead]
+	}
+
+	t.Log("Make the tree to revert to")
+	aNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	aData := []byte{1, 2, 3}
+	err = kbfsOps.Write(ctx, aNode, aData, 0)
+	require.NoError(t, err)
+	dNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	bNode, _, err := kbfsOps.CreateFile(ctx, dNode, "b", true, NoExcl)
+	require.NoError(t, err)
+	bData := []byte{4, 5}
+	err = kbfsOps.Write(ctx, bNode, bData, 0)
+	require.NoError(t, err)
+	eNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "e", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, eNode, []byte{6}, 0)
+	require.NoError(t, err)
+	fNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "f", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fNode, []byte{11, 12}, 0)
+	require.NoError(t, err)
+	gNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "g", false, NoExcl)
+	require.NoError(t, err)
+	gData := make([]byte, 200)
+	for i := range gData {
+		gData[i] = byte(i)
+	}
+	err = kbfsOps.Write(ctx, gNode, gData, 0)
+	require.NoError(t, err)
+	_, err = kbfsOps.CreateLink(ctx, rootNode, "l", "a")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	status, _, err := kbfsOps.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	rev := status.Revision
+	aMD, err := kbfsOps.GetNodeMetadata(ctx, aNode)
+	require.NoError(t, err)
+	fMD, err := kbfsOps.GetNodeMetadata(ctx, fNode)
+	require.NoError(t, err)
+	_, fEI, err := kbfsOps.Lookup(ctx, rootNode, "f")
+	require.NoError(t, err)
+
+	t.Log("Change it")
+	err = kbfsOps.Write(ctx, aNode, []byte{7, 8, 9, 10}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.RemoveEntry(ctx, dNode, "b")
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "c", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.RemoveEntry(ctx, rootNode, "l")
+	require.NoError(t, err)
+	_, err = kbfsOps.CreateLink(ctx, rootNode, "l", "c")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	// Rewrite f with data of the same size, and restore its mtime,
+	// so that only its blocks tell that it changed.
+	err = kbfsOps.Write(ctx, fNode, []byte{13, 14}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	fMtime := time.Unix(0, fEI.Mtime)
+	err = kbfsOps.SetMtime(ctx, fNode, &fMtime)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, gNode, []byte{1, 1, 1}, 100)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	status, _, err = kbfsOps.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	head := status.Revision
+
+	t.Log("A dry run lists the changes, without making them")
+	expectedChanges := []TLFRevertChange{
+		{"c", TLFRevertRemove},
+		{"a", TLFRevertUpdate},
+		{"d/b", TLFRevertCreate},
+		{"f", TLFRevertUpdate},
+		{"g", TLFRevertUpdate},
+		{"l", TLFRevertUpdate},
+	}
+	revert, err := RevertTLF(ctx, config, h, rev, head, true)
+	require.NoError(t, err)
+	require.Equal(t, head, revert.FromRevision)
+	require.Equal(t, rev, revert.ToRevision)
+	require.Equal(t, expectedChanges, revert.Changes)
+	_, _, err = kbfsOps.Lookup(ctx, rootNode, "c")
+	require.NoError(t, err)
+	status, _, err = kbfsOps.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, head, status.Revision)
+
+	t.Log("The revert is refused if the head isn't the expected one")
+	_, err = RevertTLF(ctx, config, h, rev, head-1, false)
+	require.Error(t, err)
+	_, err = RevertTLF(ctx, config, h, head, kbfsmd.RevisionUninitialized,
+		false)
+	require.Error(t, err)
+
+	t.Log("Revert")
+	revert, err = RevertTLF(ctx, config, h, rev, head, false)
+	require.NoError(t, err)
+	require.Equal(t, expectedChanges, revert.Changes)
+	require.Equal(t, aData, readAll(aNode))
+	bNode, ei, err := kbfsOps.Lookup(ctx, dNode, "b")
+	require.NoError(t, err)
+	require.Equal(t, Exec, ei.Type)
+	require.Equal(t, bData, readAll(bNode))
+	_, _, err = kbfsOps.Lookup(ctx, rootNode, "c")
+	require.IsType(t, NoSuchNameError{}, errors.Cause(err))
+	_, ei, err = kbfsOps.Lookup(ctx, rootNode, "l")
+	require.NoError(t, err)
+	require.Equal(t, "a", ei.SymPath)
+	require.Equal(t, []byte{6}, readAll(eNode))
+	require.Equal(t, []byte{11, 12}, readAll(fNode))
+	require.Equal(t, gData, readAll(gNode))
+	status, _, err = kbfsOps.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, head+1, status.Revision)
+
+	t.Log("The restored files reuse their old blocks")
+	md, err := kbfsOps.GetNodeMetadata(ctx, aNode)
+	require.NoError(t, err)
+	require.Equal(t, aMD.BlockInfo.ID, md.BlockInfo.ID)
+	require.NotEqual(t, aMD.BlockInfo.BlockPointer, md.BlockInfo.BlockPointer)
+	md, err = kbfsOps.GetNodeMetadata(ctx, fNode)
+	require.NoError(t, err)
+	require.Equal(t, fMD.BlockInfo.ID, md.BlockInfo.ID)
+
+	t.Log("Nothing is left to revert")
+	revert, err = RevertTLF(ctx, config, h, rev,
+		kbfsmd.RevisionUninitialized, true)
+	require.NoError(t, err)
+	require.Empty(t, revert.Changes)
+}
@@ -0,0 +1,285 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	pathpkg "path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// UnmergedExportUnmergedDir is the top-level directory of an
+	// export that holds the contents of the local unmerged branch.
+	UnmergedExportUnmergedDir = "unmerged"
+	// UnmergedExportMergedDir is the top-level directory of an
+	// export that holds the contents of the latest merged revision.
+	UnmergedExportMergedDir = "merged"
+)
+
+// UnmergedExport describes the views of a TLF written out by
+// ExportUnmergedBranchToDir or ExportUnmergedBranchToTar.
+type UnmergedExport struct {
+	BranchID string
+	// UnmergedRevision is the head of the local unmerged branch.
+	UnmergedRevision kbfsmd.Revision
+	// MergedRevision is the latest merged revision of the TLF.
+	MergedRevision kbfsmd.Revision
+}
+
+// exportSink receives the entries of an exported tree.  Each
+// directory is added before any of its children.
+type exportSink interface {
+	addDir(relPath string, ei EntryInfo) error
+	addFile(relPath string, ei EntryInfo, r io.Reader) error
+	addSymlink(relPath string, ei EntryInfo) error
+}
+
+// dirExportSink writes exported entries under a local directory.
+type dirExportSink struct {
+	root string
+}
+
+func (des dirExportSink) localPath(relPath string) string {
+	return filepath.Join(des.root, filepath.FromSlash(relPath))
+}
+
+func (des dirExportSink) addDir(relPath string, _ EntryInfo) error {
+	return ioutil.Mkdir(des.localPath(relPath), 0700)
+}
+
+func (des dirExportSink) addFile(
+	relPath string, ei EntryInfo, r io.Reader) (err error) {
+	p := des.localPath(relPath)
+	mode := os.FileMode(0600)
+	if ei.Type == Exec {
+		mode = 0700
+	}
+	f, err := ioutil.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		closeErr := f.Close()
+		if err == nil {
+			err = errors.WithStack(closeErr)
+		}
+	}()
+	_, err = io.Copy(f, r)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	mtime := time.Unix(0, ei.Mtime)
+	return errors.WithStack(os.Chtimes(p, mtime, mtime))
+}
+
+func (des dirExportSink) addSymlink(relPath string, ei EntryInfo) error {
+	return errors.WithStack(os.Symlink(ei.SymPath, des.localPath(relPath)))
+}
+
+// tarExportSink writes exported entries to a tar archive.
+type tarExportSink struct {
+	tw *tar.Writer
+}
+
+func (tes tarExportSink) addDir(relPath string, ei EntryInfo) error {
+	return errors.WithStack(tes.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     relPath + "/",
+		Mode:     0700,
+		ModTime:  time.Unix(0, ei.Mtime),
+	}))
+}
+
+func (tes tarExportSink) addFile(
+	relPath string, ei EntryInfo, r io.Reader) error {
+	mode := int64(0600)
+	if ei.Type == Exec {
+		mode = 0700
+	}
+	err := tes.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     relPath,
+		Mode:     mode,
+		Size:     int64(ei.Size),
+		ModTime:  time.Unix(0, ei.Mtime),
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	// The file may have changed size since its entry was read, so
+	// never write more than the header promised.
+	_, err = io.CopyN(tes.tw, r, int64(ei.Size))
+	return errors.WithStack(err)
+}
+
+func (tes tarExportSink) addSymlink(relPath string, ei EntryInfo) error {
+	return errors.WithStack(tes.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeSymlink,
+		Name:     relPath,
+		Linkname: ei.SymPath,
+		Mode:     0700,
+		ModTime:  time.Unix(0, ei.Mtime),
+	}))
+}
+
+// exportTree adds everything under the directory `dir` to `sink`,
+// under `relPath`, in name order.
+func exportTree(ctx context.Context, kbfsOps KBFSOps, dir Node,
+	relPath string, sink exportSink) error {
+	children, err := kbfsOps.GetDirChildren(ctx, dir)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		ei := children[name]
+		childPath := pathpkg.Join(relPath, name)
+		switch ei.Type {
+		case Dir:
+			child, _, err := kbfsOps.Lookup(ctx, dir, name)
+			if err != nil {
+				return err
+			}
+			err = sink.addDir(childPath, ei)
+			if err != nil {
+				return err
+			}
+			err = exportTree(ctx, kbfsOps, child, childPath, sink)
+			if err != nil {
+				return err
+			}
+		case File, Exec:
+			child, _, err := kbfsOps.Lookup(ctx, dir, name)
+			if err != nil {
+				return err
+			}
+			err = sink.addFile(childPath, ei, &nodeReader{
+				ctx:     ctx,
+				kbfsOps: kbfsOps,
+				node:    child,
+			})
+			if err != nil {
+				return err
+			}
+		case Sym:
+			err := sink.addSymlink(childPath, ei)
+			if err != nil {
+				return err
+			}
+		default:
+			return errors.Errorf("Unknown entry type %s for %s", ei.Type, name)
+		}
+	}
+	return nil
+}
+
+func exportUnmergedBranch(ctx context.Context, config Config,
+	h *TlfHandle, sink exportSink) (UnmergedExport, error) {
+	kbfsOps := config.KBFSOps()
+	root, _, err := kbfsOps.GetRootNode(ctx, h, MasterBranch)
+	if err != nil {
+		return UnmergedExport{}, err
+	}
+	if root == nil {
+		return UnmergedExport{}, errors.Errorf(
+			"%s doesn't exist", h.GetCanonicalPath())
+	}
+	fb := root.GetFolderBranch()
+
+	status, _, err := kbfsOps.FolderStatus(ctx, fb)
+	if err != nil {
+		return UnmergedExport{}, err
+	}
+	if !status.Staged {
+		return UnmergedExport{}, errors.Errorf(
+			"%s has no unmerged changes", h.GetCanonicalPath())
+	}
+
+	mergedMD, err := config.MDOps().GetForTLF(ctx, fb.Tlf, nil)
+	if err != nil {
+		return UnmergedExport{}, err
+	}
+	if mergedMD == (ImmutableRootMetadata{}) {
+		return UnmergedExport{}, errors.Errorf(
+			"%s has no merged revisions", h.GetCanonicalPath())
+	}
+	mergedRoot, _, err := kbfsOps.GetRootNode(
+		ctx, h, MakeRevBranchName(mergedMD.Revision()))
+	if err != nil {
+		return UnmergedExport{}, err
+	}
+
+	// Export the unmerged branch first, through the usual local
+	// view of the TLF, so unsynced local writes are included.
+	views := []struct {
+		relPath string
+		root    Node
+	}{
+		{UnmergedExportUnmergedDir, root},
+		{UnmergedExportMergedDir, mergedRoot},
+	}
+	for _, view := range views {
+		ei, err := kbfsOps.Stat(ctx, view.root)
+		if err != nil {
+			return UnmergedExport{}, err
+		}
+		err = sink.addDir(view.relPath, ei)
+		if err != nil {
+			return UnmergedExport{}, err
+		}
+		err = exportTree(ctx, kbfsOps, view.root, view.relPath, sink)
+		if err != nil {
+			return UnmergedExport{}, err
+		}
+	}
+
+	return UnmergedExport{
+		BranchID:         status.BranchID,
+		UnmergedRevision: status.Revision,
+		MergedRevision:   mergedMD.Revision(),
+	}, nil
+}
+
+// ExportUnmergedBranchToDir copies the full contents of the local
+// unmerged branch of the TLF for `h` into the `unmerged` directory
+// under `dir`, and the contents of its latest merged revision into
+// the `merged` directory, so the two can be reconciled by hand.
+// `dir` must already exist, and not contain either of them yet.  It
+// returns an error if the TLF isn't unmerged.
+func ExportUnmergedBranchToDir(ctx context.Context, config Config,
+	h *TlfHandle, dir string) (UnmergedExport, error) {
+	return exportUnmergedBranch(ctx, config, h, dirExportSink{dir})
+}
+
+// ExportUnmergedBranchToTar is like ExportUnmergedBranchToDir, but
+// writes both views to `w` as a tar archive.
+func ExportUnmergedBranchToTar(ctx context.Context, config Config,
+	h *TlfHandle, w io.Writer) (UnmergedExport, error) {
+	tw := tar.NewWriter(w)
+	export, err := exportUnmergedBranch(ctx, config, h, tarExportSink{tw})
+	if err != nil {
+		return UnmergedExport{}, err
+	}
+	err = tw.Close()
+	if err != nil {
+		return UnmergedExport{}, errors.WithStack(err)
+	}
+	return export, nil
+}
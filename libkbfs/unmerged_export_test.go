@@ -0,0 +1,135 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	kbname "github.com/keybase/client/go/kbun"
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportUnmergedBranch(t *testing.T) {
+	var u1, u2 kbname.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, u1, u2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+	config2 := ConfigAsUser(config1, u2)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+
+	name := u1.String() + "," + u2.String()
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, tlf.Private)
+	kbfsOps1 := config1.KBFSOps()
+	fb := rootNode1.GetFolderBranch()
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, tlf.Private)
+	kbfsOps2 := config2.KBFSOps()
+	h, err := kbfsOps2.GetTLFHandle(ctx, rootNode2)
+	require.NoError(t, err)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "unmerged_export")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	t.Log("Exporting a merged TLF fails")
+	_, err = ExportUnmergedBranchToDir(ctx, config2, h, tempdir)
+	require.Error(t, err)
+
+	t.Log("Make user 2 unmerged")
+	c, err := DisableUpdatesForTesting(config2, fb)
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, fb)
+	require.NoError(t, err)
+
+	aNode1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+	aData := []byte{1, 2, 3}
+	err = kbfsOps1.Write(ctx, aNode1, aData, 0)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	dNode2, _, err := kbfsOps2.CreateDir(ctx, rootNode2, "d")
+	require.NoError(t, err)
+	bNode2, _, err := kbfsOps2.CreateFile(ctx, dNode2, "b", true, NoExcl)
+	require.NoError(t, err)
+	bData := []byte{4, 5}
+	err = kbfsOps2.Write(ctx, bNode2, bData, 0)
+	require.NoError(t, err)
+	_, err = kbfsOps2.CreateLink(ctx, rootNode2, "l", "d/b")
+	require.NoError(t, err)
+	err = kbfsOps2.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	t.Log("Export both views to a directory")
+	export, err := ExportUnmergedBranchToDir(ctx, config2, h, tempdir)
+	require.NoError(t, err)
+	status, _, err := kbfsOps2.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, status.BranchID, export.BranchID)
+	require.Equal(t, status.Revision, export.UnmergedRevision)
+	status1, _, err := kbfsOps1.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, status1.Revision, export.MergedRevision)
+
+	unmergedDir := filepath.Join(tempdir, UnmergedExportUnmergedDir)
+	mergedDir := filepath.Join(tempdir, UnmergedExportMergedDir)
+	data, err := ioutil.ReadFile(filepath.Join(unmergedDir, "d", "b"))
+	require.NoError(t, err)
+	require.Equal(t, bData, data)
+	target, err := os.Readlink(filepath.Join(unmergedDir, "l"))
+	require.NoError(t, err)
+	require.Equal(t, "d/b", target)
+	_, err = ioutil.Stat(filepath.Join(unmergedDir, "a"))
+	require.True(t, ioutil.IsNotExist(err))
+	data, err = ioutil.ReadFile(filepath.Join(mergedDir, "a"))
+	require.NoError(t, err)
+	require.Equal(t, aData, data)
+	_, err = ioutil.Stat(filepath.Join(mergedDir, "d"))
+	require.True(t, ioutil.IsNotExist(err))
+
+	t.Log("Export both views to a tar archive")
+	var buf bytes.Buffer
+	_, err = ExportUnmergedBranchToTar(ctx, config2, h, &buf)
+	require.NoError(t, err)
+	tr := tar.NewReader(&buf)
+	contents := make(map[string][]byte)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(tr)
+		require.NoError(t, err)
+		contents[hdr.Name] = data
+	}
+	require.Equal(t, map[string][]byte{
+		"unmerged/":    {},
+		"unmerged/d/":  {},
+		"unmerged/d/b": bData,
+		"unmerged/l":   {},
+		"merged/":      {},
+		"merged/a":     aData,
+	}, contents)
+
+	t.Log("Resolve the conflict before shutting down")
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2, fb)
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServer(ctx, fb, nil)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncFromServer(ctx, fb, nil)
+	require.NoError(t, err)
+}
@@ -0,0 +1,66 @@
+// Auto-generated by avdl-compiler v1.3.9 (https://github.com/keybase/node-avdl-compiler)
+//   Input file: kbgitkbfs-avdl/debug_log.avdl
+
+package kbgitkbfs1
+
+import (
+	"github.com/keybase/go-framed-msgpack-rpc/rpc"
+	context "golang.org/x/net/context"
+)
+
+// DebugLogEntry is a single recent log message.
+type DebugLogEntry struct {
+	TlfID  []byte `codec:"tlfID" json:"tlfID"`
+	Time   int64  `codec:"time" json:"time"`
+	Level  string `codec:"level" json:"level"`
+	Module string `codec:"module" json:"module"`
+	Msg    string `codec:"msg" json:"msg"`
+}
+
+type GetDebugLogArg struct {
+	TlfID []byte `codec:"tlfID" json:"tlfID"`
+}
+
+// DebugLogInterface specifies how to retrieve recent log messages
+// from a running KBFS instance.
+type DebugLogInterface interface {
+	// GetDebugLog gets the recent log messages kept in memory for a
+	// TLF, or for all TLFs if tlfID is empty.
+	GetDebugLog(context.Context, []byte) ([]DebugLogEntry, error)
+}
+
+func DebugLogProtocol(i DebugLogInterface) rpc.Protocol {
+	return rpc.Protocol{
+		Name: "kbgitkbfs.1.DebugLog",
+		Methods: map[string]rpc.ServeHandlerDescription{
+			"GetDebugLog": {
+				MakeArg: func() interface{} {
+					ret := make([]GetDebugLogArg, 1)
+					return &ret
+				},
+				Handler: func(ctx context.Context, args interface{}) (ret interface{}, err error) {
+					typedArgs, ok := args.(*[]GetDebugLogArg)
+					if !ok {
+						err = rpc.NewTypeError((*[]GetDebugLogArg)(nil), args)
+						return
+					}
+					ret, err = i.GetDebugLog(ctx, (*typedArgs)[0].TlfID)
+					return
+				},
+				MethodType: rpc.MethodCall,
+			},
+		},
+	}
+}
+
+type DebugLogClient struct {
+	Cli rpc.GenericClient
+}
+
+// GetDebugLog gets the recent log messages kept in memory for a
+// TLF, or for all TLFs if tlfID is empty.
+func (c DebugLogClient) GetDebugLog(ctx context.Context, tlfID []byte) (res []DebugLogEntry, err error) {
+	__arg := GetDebugLogArg{TlfID: tlfID}
+	err = c.Cli.Call(ctx, "kbgitkbfs.1.DebugLog.GetDebugLog", []interface{}{__arg}, &res)
+	return
+}
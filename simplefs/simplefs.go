@@ -838,6 +838,23 @@ func copyWithCancellation(ctx context.Context, dst io.Writer, src io.Reader) err
 	}
 }
 
+// cancelableReader stops reading once its context is canceled.
+type cancelableReader struct {
+	ctx   context.Context
+	input io.Reader
+}
+
+var _ io.Reader = (*cancelableReader)(nil)
+
+func (cr *cancelableReader) Read(p []byte) (n int, err error) {
+	select {
+	case <-cr.ctx.Done():
+		return 0, cr.ctx.Err()
+	default:
+	}
+	return cr.input.Read(p)
+}
+
 type progressReader struct {
 	k     *SimpleFS
 	opID  keybase1.OpID
@@ -892,6 +909,23 @@ func (k *SimpleFS) doCopyFromSource(
 		return dstFS.MkdirAll(finalDstElem, 0755)
 	}
 
+	// Within a single TLF, clone the file instead, so that it shares
+	// the blocks of the source rather than uploading them again.
+	srcLibFS, srcOK := srcFS.(*libfs.FS)
+	dstLibFS, dstOK := dstFS.(*libfs.FS)
+	if srcOK && dstOK && srcLibFS.RootNode().GetFolderBranch() ==
+		dstLibFS.RootNode().GetFolderBranch() {
+		err = dstLibFS.CloneFile(srcLibFS, srcFI.Name(), finalDstElem)
+		if err == nil {
+			k.updateReadProgress(opID, srcFI.Size(), 0)
+			k.updateWriteProgress(opID, srcFI.Size(), 0)
+			return nil
+		} else if !os.IsExist(err) {
+			return err
+		}
+		// Overwrite the existing file with a regular copy instead.
+	}
+
 	src, err := srcFS.Open(srcFI.Name())
 	if err != nil {
 		return err
@@ -905,6 +939,17 @@ func (k *SimpleFS) doCopyFromSource(
 	}
 	defer dst.Close()
 
+	// Stream uploads into KBFS, so a large file never has to sit in
+	// the dirty block cache all at once.
+	if dstFile, ok := dst.(*libfs.File); ok {
+		n, err := dstFile.WriteStream(&cancelableReader{
+			ctx, &progressReader{k, opID, src}})
+		if n > 0 {
+			k.updateWriteProgress(opID, n, 0)
+		}
+		return err
+	}
+
 	return copyWithCancellation(
 		ctx,
 		&progressWriter{k, opID, dst},